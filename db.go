@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// localSubcommands are handled by gotel itself rather than the collector, so
+// the embedded --config must not be injected in front of them.
+var localSubcommands = map[string]bool{
+	"db":     true,
+	"doctor": true,
+}
+
+func isLocalSubcommand(args []string) bool {
+	return len(args) > 0 && localSubcommands[args[0]]
+}
+
+// defaultDBPath mirrors the exporter's db_path default and GOTEL_DB_PATH override.
+func defaultDBPath() string {
+	if p := strings.TrimSpace(os.Getenv("GOTEL_DB_PATH")); p != "" {
+		return p
+	}
+	return "gotel.db"
+}
+
+// newDBCommand returns the `gotel db` maintenance command tree.
+func newDBCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Maintenance commands for the SQLite database",
+	}
+	cmd.PersistentFlags().String("db-path", defaultDBPath(), "Path to the SQLite database file")
+	cmd.AddCommand(newDBDedupeCommand())
+	return cmd
+}
+
+func newDBDedupeCommand() *cobra.Command {
+	var dryRun, vacuum bool
+
+	cmd := &cobra.Command{
+		Use:   "dedupe",
+		Short: "Remove duplicate (trace_id, span_id) span rows",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbPath, _ := cmd.Flags().GetString("db-path")
+			store, err := openExistingStore(dbPath)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			ctx := cmd.Context()
+			report, err := store.DedupeSpans(ctx, dryRun)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Duplicate spans found: %d\n", report.DuplicateSpans)
+			if dryRun {
+				fmt.Fprintf(out, "Dry run: nothing removed (about %s reclaimable)\n", formatBytes(report.ReclaimableBytes))
+				return nil
+			}
+			fmt.Fprintf(out, "Duplicate spans removed: %d\n", report.RemovedSpans)
+
+			if !vacuum {
+				fmt.Fprintf(out, "Reclaimable by vacuum: %s\n", formatBytes(report.ReclaimableBytes))
+				return nil
+			}
+			if err := store.Vacuum(ctx); err != nil {
+				return fmt.Errorf("vacuum failed: %w", err)
+			}
+			fmt.Fprintf(out, "Vacuum reclaimed: %s\n", formatBytes(report.ReclaimableBytes))
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Report duplicates without removing them")
+	cmd.Flags().BoolVar(&vacuum, "vacuum", false, "Run VACUUM after removing duplicates")
+	return cmd
+}
+
+// openExistingStore opens the database at path without creating a new file.
+func openExistingStore(path string) (*tracestore.Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("database %s: %w", path, err)
+	}
+	return tracestore.New(path)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
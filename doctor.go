@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotel/pkg/tracestore"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/collector/otelcol"
+)
+
+// doctorPorts are the listeners of the embedded config and the commented-out
+// carbon receiver
+var doctorPorts = []int{4317, 4318, 3200, 2003}
+
+const (
+	doctorDialTimeout = 3 * time.Second
+	// doctorWALWarnBytes matches wal_checkpoint's default max_size_mb
+	doctorWALWarnBytes = 64 << 20
+	// doctorFreeWarnRatio is the share of free pages worth a VACUUM
+	doctorFreeWarnRatio = 0.25
+)
+
+// doctorStatus grades a finding
+type doctorStatus string
+
+const (
+	doctorOK   doctorStatus = "OK"
+	doctorWarn doctorStatus = "WARN"
+	doctorFail doctorStatus = "FAIL"
+)
+
+// doctor collects findings and prints them as they are made
+type doctor struct {
+	out    io.Writer
+	failed int
+}
+
+func (d *doctor) report(status doctorStatus, check, format string, args ...interface{}) {
+	if status == doctorFail {
+		d.failed++
+	}
+	fmt.Fprintf(d.out, "%-6s %-10s %s\n", "["+string(status)+"]", check, fmt.Sprintf(format, args...))
+}
+
+// newDoctorCommand returns `gotel doctor`, which checks the config, the
+// database, the listening ports and downstream endpoints, and prints what to
+// do about each problem found. It exits non-zero when a check fails.
+func newDoctorCommand(set otelcol.CollectorSettings) *cobra.Command {
+	var configs, endpoints []string
+	var ports []int
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose the config, database, ports and downstream endpoints",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbPath, _ := cmd.Flags().GetString("db-path")
+			d := &doctor{out: cmd.OutOrStdout()}
+
+			d.checkConfig(set, configs)
+			d.checkDatabase(cmd.Context(), dbPath)
+			for _, port := range ports {
+				d.checkPort(port)
+			}
+			for _, endpoint := range endpoints {
+				d.checkEndpoint(endpoint)
+			}
+
+			if d.failed > 0 {
+				return fmt.Errorf("%d check(s) failed", d.failed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&configs, "config", nil, "Config file or URI to validate (default: as the collector would pick)")
+	cmd.Flags().String("db-path", defaultDBPath(), "Path to the SQLite database file")
+	cmd.Flags().IntSliceVar(&ports, "ports", doctorPorts, "Local ports to check")
+	cmd.Flags().StringSliceVar(&endpoints, "endpoint", nil, "Downstream host:port to check, e.g. a Tempo or Graphite endpoint (repeatable)")
+	return cmd
+}
+
+// checkConfig validates the config with the collector's own validate
+// command, falling back to the embedded config as gotel does at startup
+func (d *doctor) checkConfig(set otelcol.CollectorSettings, configs []string) {
+	var args []string
+	var source string
+	if len(configs) > 0 {
+		for _, c := range configs {
+			args = append(args, "--config", c)
+		}
+		source = fmt.Sprint(configs)
+	} else if file := defaultConfigFile(); fileExists(file) {
+		args = []string{"--config", file}
+		source = file
+	} else {
+		args = defaultConfigArgs(os.Getenv(otlpAuthEnv) != "")
+		source = "embedded config"
+	}
+
+	validate := otelcol.NewCommand(set)
+	validate.SetArgs(append([]string{"validate"}, args...))
+	validate.SetOut(io.Discard)
+	validate.SetErr(io.Discard)
+	validate.SilenceUsage = true
+	if err := validate.Execute(); err != nil {
+		d.report(doctorFail, "config", "%s is invalid: %v", source, err)
+		return
+	}
+	d.report(doctorOK, "config", "%s is valid", source)
+}
+
+// checkDatabase checks the database file's schema, integrity, free space
+// and WAL. The file is only read: migrations are reported, not run.
+func (d *doctor) checkDatabase(ctx context.Context, path string) {
+	if !fileExists(path) {
+		d.report(doctorWarn, "database", "%s does not exist; it is created on first start (set --db-path or GOTEL_DB_PATH if it lives elsewhere)", path)
+		return
+	}
+	// Opened read-only so the doctor never migrates or backfills the file
+	store, err := tracestore.OpenReadOnly(path)
+	if err != nil {
+		d.report(doctorFail, "database", "cannot open %s: %v", path, err)
+		return
+	}
+	defer store.Close()
+
+	problems, err := store.IntegrityCheck(ctx)
+	switch {
+	case err != nil:
+		d.report(doctorFail, "database", "integrity check failed: %v", err)
+	case len(problems) > 0:
+		d.report(doctorFail, "database", "%s is corrupt (%s); restore a backup or recover it with the sqlite3 .recover command", path, problems[0])
+	default:
+		d.report(doctorOK, "database", "%s passed the integrity check", path)
+	}
+
+	pending, err := store.PendingMigrations(ctx)
+	switch {
+	case err != nil:
+		d.report(doctorFail, "schema", "%v", err)
+	case len(pending) > 0:
+		d.report(doctorWarn, "schema", "%s lacks %s; gotel migrates it on the next start, which can take a while on a large file", path, strings.Join(pending, ", "))
+	default:
+		d.report(doctorOK, "schema", "schema is up to date")
+	}
+
+	used, file, err := store.UsedBytes(ctx)
+	if err != nil {
+		d.report(doctorFail, "size", "cannot read the database size: %v", err)
+	} else if free := file - used; file > 0 && float64(free)/float64(file) > doctorFreeWarnRatio {
+		d.report(doctorWarn, "size", "%s in use, %s free in a %s file; `gotel db dedupe --vacuum` returns the free pages", formatBytes(used), formatBytes(free), formatBytes(file))
+	} else {
+		d.report(doctorOK, "size", "%s in use, %s file", formatBytes(used), formatBytes(file))
+	}
+
+	wal, err := store.WALSize()
+	switch {
+	case err != nil:
+		d.report(doctorFail, "wal", "cannot read the WAL size: %v", err)
+	case wal > doctorWALWarnBytes:
+		d.report(doctorWarn, "wal", "-wal file is %s; set wal_checkpoint.interval so it is truncated", formatBytes(wal))
+	default:
+		d.report(doctorOK, "wal", "-wal file is %s", formatBytes(wal))
+	}
+}
+
+// checkPort reports whether a local port is free to listen on or already
+// taken, and whether whatever holds it accepts connections
+func (d *doctor) checkPort(port int) {
+	addr := ":" + strconv.Itoa(port)
+	if ln, err := net.Listen("tcp", addr); err == nil {
+		ln.Close()
+		d.report(doctorOK, "port", "%d is free", port)
+		return
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), doctorDialTimeout)
+	if err != nil {
+		d.report(doctorFail, "port", "%d cannot be listened on and does not accept connections; check permissions and firewall rules", port)
+		return
+	}
+	conn.Close()
+	d.report(doctorWarn, "port", "%d is in use and accepting connections; fine if gotel is running, otherwise stop the process holding it", port)
+}
+
+// checkEndpoint dials a downstream endpoint
+func (d *doctor) checkEndpoint(endpoint string) {
+	conn, err := net.DialTimeout("tcp", endpoint, doctorDialTimeout)
+	if err != nil {
+		d.report(doctorFail, "endpoint", "%s is unreachable: %v; check the address, DNS and firewall rules", endpoint, err)
+		return
+	}
+	conn.Close()
+	d.report(doctorOK, "endpoint", "%s is reachable", endpoint)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,166 @@
+package sqliteexporter
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Attribute keys anonymize uses when strip_keys or hash_keys are not set.
+// status.message, trace_state and tenant name span fields (see spans).
+var (
+	defaultAnonymizeStripKeys = []string{
+		"http.url", "url.full", "url.query", "http.request.header.*", "http.response.header.*",
+		"db.statement", "db.query.text", "exception.stacktrace", "trace_state",
+	}
+	defaultAnonymizeHashKeys = []string{
+		"service.name", "service.namespace", "service.instance.id", "host.name", "host.id",
+		"enduser.id", "user.id", "user.name", "user.email", "client.address", "net.peer.ip",
+		"k8s.pod.name", "k8s.namespace.name", "k8s.node.name",
+		"exception.message", "status.message", "tenant",
+	}
+)
+
+// anonymizer rewrites stored span documents for ?anonymize=true exports.
+// Hashes are keyed with the configured salt, so the same service or user
+// maps to the same hash across spans, traces and requests.
+type anonymizer struct {
+	strip []string
+	hash  []string
+	salt  []byte
+
+	// tenantAttribute is tenancy's resource_attribute, which holds the
+	// tenant and is anonymized like the tenant field
+	tenantAttribute string
+}
+
+func newAnonymizer(cfg AnonymizeConfig, tenancy TenancyConfig) (*anonymizer, error) {
+	a := &anonymizer{strip: cfg.StripKeys, hash: cfg.HashKeys, salt: []byte(cfg.Salt)}
+	if tenancy.Enabled {
+		a.tenantAttribute = tenancy.ResourceAttribute
+	}
+	if a.strip == nil {
+		a.strip = defaultAnonymizeStripKeys
+	}
+	if a.hash == nil {
+		a.hash = defaultAnonymizeHashKeys
+	}
+	if len(a.salt) == 0 {
+		a.salt = make([]byte, 32)
+		if _, err := rand.Read(a.salt); err != nil {
+			return nil, fmt.Errorf("failed to generate anonymize salt: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// matchKey reports whether key is listed in patterns; a trailing * matches
+// any key with that prefix
+func matchKey(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if p == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *anonymizer) hashValue(v interface{}) string {
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(fmt.Sprint(v)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// attributes strips and hashes one attribute map in place
+func (a *anonymizer) attributes(v interface{}) {
+	attrs, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for k, val := range attrs {
+		tenant := a.tenantAttribute != "" && k == a.tenantAttribute
+		if matchKey(a.strip, k) || (tenant && matchKey(a.strip, "tenant")) {
+			delete(attrs, k)
+		} else if matchKey(a.hash, k) || (tenant && matchKey(a.hash, "tenant")) {
+			attrs[k] = a.hashValue(val)
+		}
+	}
+}
+
+// field strips or hashes the span field m[name], listed in strip_keys and
+// hash_keys as key
+func (a *anonymizer) field(m map[string]interface{}, name, key string) {
+	v, ok := m[name]
+	if !ok {
+		return
+	}
+	if matchKey(a.strip, key) {
+		delete(m, name)
+	} else if matchKey(a.hash, key) && v != "" {
+		m[name] = a.hashValue(v)
+	}
+}
+
+// nestedAttributes anonymizes the attributes and trace_state of each event
+// or link in v
+func (a *anonymizer) nestedAttributes(v interface{}) {
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			a.attributes(m["attributes"])
+			a.field(m, "trace_state", "trace_state")
+		}
+	}
+}
+
+// spans returns anonymized copies of stored span documents. The
+// service_name field is hashed like the service.name attribute, so it still
+// matches the resource. The status message, trace state and tenant are not
+// attributes but follow strip_keys and hash_keys as status.message,
+// trace_state and tenant.
+func (a *anonymizer) spans(spans []json.RawMessage) []json.RawMessage {
+	out := make([]json.RawMessage, 0, len(spans))
+	for _, raw := range spans {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			continue
+		}
+		if name, ok := doc["service_name"].(string); ok && matchKey(a.hash, "service.name") {
+			doc["service_name"] = a.hashValue(name)
+		}
+		if status, ok := doc["status"].(map[string]interface{}); ok {
+			a.field(status, "message", "status.message")
+		}
+		a.field(doc, "trace_state", "trace_state")
+		a.field(doc, "tenant", "tenant")
+		a.attributes(doc["resource"])
+		a.attributes(doc["attributes"])
+		a.nestedAttributes(doc["events"])
+		a.nestedAttributes(doc["links"])
+		b, err := json.Marshal(doc)
+		if err != nil {
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// wantsAnonymized reports whether the request asked for anonymize=true
+func wantsAnonymized(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("anonymize")
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
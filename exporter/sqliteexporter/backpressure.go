@@ -0,0 +1,77 @@
+package sqliteexporter
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/exporter/exporterhelper"
+)
+
+// errWriteLatencyDegraded is returned (wrapped as a throttle-retry error)
+// while batches are refused because SQLite inserts are too slow.
+var errWriteLatencyDegraded = errors.New("sqlite write latency degraded, retry later")
+
+// writeLatencyWeight is the weight of the newest sample in the moving average.
+const writeLatencyWeight = 0.3
+
+// writeThrottle tracks an exponentially weighted moving average of insert
+// latency. While the average exceeds the threshold, batches are refused for a
+// cooldown period; the first batch after the cooldown is written as a probe,
+// so the average decays once the database recovers.
+type writeThrottle struct {
+	threshold time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	avg   time.Duration
+	until time.Time
+}
+
+// newWriteThrottle returns nil when backpressure is disabled; a nil
+// throttle never refuses.
+func newWriteThrottle(cfg BackpressureConfig) *writeThrottle {
+	if cfg.LatencyThreshold <= 0 {
+		return nil
+	}
+	return &writeThrottle{
+		threshold: cfg.LatencyThreshold,
+		cooldown:  cfg.Cooldown,
+		now:       time.Now,
+	}
+}
+
+// check returns a retryable error asking the sender to wait out the rest of
+// the cooldown, or nil when writes are allowed.
+func (t *writeThrottle) check() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if remaining := t.until.Sub(t.now()); remaining > 0 {
+		return exporterhelper.NewThrottleRetry(errWriteLatencyDegraded, remaining)
+	}
+	return nil
+}
+
+// observe records one insert latency. It reports whether the average is over
+// the threshold, which starts (or extends) a cooldown.
+func (t *writeThrottle) observe(latency time.Duration) (time.Duration, bool) {
+	if t == nil {
+		return latency, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.avg == 0 {
+		t.avg = latency
+	} else {
+		t.avg = time.Duration(writeLatencyWeight*float64(latency) + (1-writeLatencyWeight)*float64(t.avg))
+	}
+	if t.avg > t.threshold {
+		t.until = t.now().Add(t.cooldown)
+		return t.avg, true
+	}
+	return t.avg, false
+}
@@ -0,0 +1,272 @@
+package sqliteexporter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// ingestBatch is what pushTraces publishes once a batch is parsed. It holds
+// encoded rows rather than pdata, which the collector may reuse after
+// pushTraces returns, so queued consumers can keep it.
+type ingestBatch struct {
+	spans        []tracestore.EncodedSpan
+	metrics      []tracestore.MetricRecord
+	operations   [][2]string // service and span name of each stored span
+	aggregations []spanMetricsSample
+	traceIDs     []string // only collected when ingest hooks are registered
+}
+
+// busPolicy is what publish does for a consumer
+type busPolicy int
+
+const (
+	// busInline runs the consumer in pushTraces. An error fails the batch,
+	// so the collector retries it, and no later consumer sees it.
+	busInline busPolicy = iota
+
+	// busBlock queues the batch, waiting for room: the consumer sees every
+	// batch, and ingest slows down when it falls behind
+	busBlock
+
+	// busDrop queues the batch if there is room and otherwise drops it for
+	// this consumer only, so a slow consumer never slows ingest
+	busDrop
+)
+
+func (p busPolicy) String() string {
+	switch p {
+	case busInline:
+		return "inline"
+	case busBlock:
+		return "block"
+	case busDrop:
+		return "drop"
+	}
+	return fmt.Sprintf("busPolicy(%d)", int(p))
+}
+
+type busConsumer struct {
+	name    string
+	policy  busPolicy
+	handle  func(context.Context, *ingestBatch) error
+	queue   chan *ingestBatch
+	dropped atomic.Int64
+}
+
+// ingestBus fans parsed batches out to independent consumers, so new ones
+// (live tail, alert evaluation, ...) are added with subscribe rather than in
+// pushTraces. Inline consumers run first, in subscription order; queued
+// consumers each have a worker and only see batches every inline consumer
+// accepted.
+type ingestBus struct {
+	logger    *zap.Logger
+	consumers []*busConsumer
+
+	// done is closed by stop. Queues are never closed, so a publish racing
+	// stop cannot send on a closed channel, and no lock is held while
+	// publish waits on a busBlock queue.
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newIngestBus(logger *zap.Logger) *ingestBus {
+	return &ingestBus{logger: logger, done: make(chan struct{})}
+}
+
+// subscribe adds a consumer. Queued consumers buffer up to queueSize
+// batches. Consumers are subscribed before start.
+func (b *ingestBus) subscribe(name string, policy busPolicy, queueSize int, handle func(context.Context, *ingestBatch) error) {
+	c := &busConsumer{name: name, policy: policy, handle: handle}
+	if policy != busInline {
+		c.queue = make(chan *ingestBatch, queueSize)
+	}
+	b.consumers = append(b.consumers, c)
+}
+
+// start runs a worker for each queued consumer
+func (b *ingestBus) start() {
+	for _, c := range b.consumers {
+		if c.queue != nil {
+			b.wg.Add(1)
+			go b.run(c)
+		}
+	}
+}
+
+// run hands a queued consumer its batches until stop, then the batches
+// still in its queue
+func (b *ingestBus) run(c *busConsumer) {
+	defer b.wg.Done()
+	for {
+		select {
+		case batch := <-c.queue:
+			b.deliver(c, batch)
+		case <-b.done:
+			for {
+				select {
+				case batch := <-c.queue:
+					b.deliver(c, batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *ingestBus) deliver(c *busConsumer, batch *ingestBatch) {
+	if err := c.handle(context.Background(), batch); err != nil {
+		b.logger.Warn("Ingest consumer failed", zap.String("consumer", c.name), zap.Error(err))
+	}
+}
+
+// publish hands batch to every consumer. It returns the first inline
+// consumer's error; queued consumers cannot fail a batch.
+func (b *ingestBus) publish(ctx context.Context, batch *ingestBatch) error {
+	for _, c := range b.consumers {
+		if c.policy == busInline {
+			if err := c.handle(ctx, batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	select {
+	case <-b.done:
+		return nil
+	default:
+	}
+	for _, c := range b.consumers {
+		switch c.policy {
+		case busBlock:
+			select {
+			case c.queue <- batch:
+			case <-ctx.Done():
+				c.dropped.Add(1)
+			case <-b.done:
+				c.dropped.Add(1)
+			}
+		case busDrop:
+			select {
+			case c.queue <- batch:
+			default:
+				c.dropped.Add(1)
+			}
+		}
+	}
+	return nil
+}
+
+// stop lets queued consumers finish the batches they hold, waiting until
+// ctx is done. Batches published afterwards only reach inline consumers, and
+// a publish waiting on a busBlock queue gives up and counts the batch as
+// dropped.
+func (b *ingestBus) stop(ctx context.Context) {
+	b.stopOnce.Do(func() { close(b.done) })
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		b.logger.Warn("Ingest consumers still busy at shutdown", zap.Error(ctx.Err()))
+	}
+}
+
+// collectors exposes gotel_ingest_queue_batches and
+// gotel_ingest_dropped_batches_total for each queued consumer
+func (b *ingestBus) collectors() []prometheus.Collector {
+	var out []prometheus.Collector
+	for _, c := range b.consumers {
+		if c.queue == nil {
+			continue
+		}
+		c := c
+		labels := prometheus.Labels{"consumer": c.name, "policy": c.policy.String()}
+		out = append(out,
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "gotel_ingest_queue_batches",
+				Help:        "Batches waiting for an ingest consumer.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(len(c.queue)) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "gotel_ingest_dropped_batches_total",
+				Help:        "Batches an ingest consumer missed because its queue was full or ingest was cancelled.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(c.dropped.Load()) }),
+		)
+	}
+	return out
+}
+
+// newIngestBus subscribes the built-in consumers. The policy is: consumers
+// that only update memory run inline, and consumers doing I/O beyond the
+// store are queued with busDrop, so ingest never waits on them. The storage
+// writer is inline so a failed write fails the batch, and so are the
+// in-memory ones after it, so the catalog, /metrics and ingest hooks only
+// count stored batches and are up to date as soon as pushTraces returns.
+// live_push makes network calls, so it is queued with the drop policy.
+// busBlock is for consumers that must see every batch and can keep up.
+func (e *sqliteExporter) newIngestBus() *ingestBus {
+	b := newIngestBus(e.logger)
+	b.subscribe("storage", busInline, 0, e.writeBatch)
+	b.subscribe("catalog", busInline, 0, func(_ context.Context, batch *ingestBatch) error {
+		for _, op := range batch.operations {
+			e.catalog.observe(op[0], op[1])
+		}
+		return nil
+	})
+	b.subscribe("span_metrics", busInline, 0, func(_ context.Context, batch *ingestBatch) error {
+		for _, sample := range batch.aggregations {
+			e.spanMetrics.observe(sample.tags, sample.agg)
+		}
+		return nil
+	})
+	if e.pendingTraces != nil && e.dryRun == nil {
+		b.subscribe("trace_hooks", busInline, 0, func(_ context.Context, batch *ingestBatch) error {
+			e.pendingTraces.observe(batch.traceIDs, time.Now())
+			return nil
+		})
+	}
+	if e.livePush != nil {
+		b.subscribe("live_push", busDrop, e.config.LivePush.QueueSize, e.livePush.push)
+	}
+	return b
+}
+
+// writeBatch stores a batch's spans and metrics in one transaction, or
+// counts them in dry_run mode
+func (e *sqliteExporter) writeBatch(ctx context.Context, batch *ingestBatch) error {
+	if e.dryRun != nil {
+		e.dryRun.addSpans(batch.spans)
+		e.dryRun.addMetrics(batch.metrics)
+		return nil
+	}
+	start := time.Now()
+	if err := e.store.InsertEncodedData(ctx, batch.spans, batch.metrics); err != nil {
+		e.ingest.writeErrors.Add(1)
+		return e.writeFailed(fmt.Errorf("failed to insert data: %w", err))
+	}
+	e.writeSucceeded()
+	e.ingest.spansStored.Add(int64(len(batch.spans)))
+	e.ingest.pointsStored.Add(int64(len(batch.metrics)))
+	if avg, degraded := e.throttle.observe(time.Since(start)); degraded {
+		e.logger.Warn("SQLite write latency over threshold, refusing batches",
+			zap.Duration("avg_latency", avg),
+			zap.Duration("threshold", e.config.Backpressure.LatencyThreshold),
+			zap.Duration("cooldown", e.config.Backpressure.Cooldown))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package sqliteexporter
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serviceCatalog is an in-memory snapshot of the stored services and their
+// operations. Grafana dashboards with several template variables query these
+// on every load; serving them from memory avoids a DISTINCT scan per
+// variable. Ingest adds new names as they arrive and a periodic refresh drops
+// the ones retention cleanup has removed.
+type serviceCatalog struct {
+	mu         sync.RWMutex
+	loaded     bool
+	operations map[string][]string // sorted span names per service
+}
+
+func newServiceCatalog() *serviceCatalog {
+	return &serviceCatalog{operations: make(map[string][]string)}
+}
+
+// refresh replaces the snapshot with the store's current contents
+func (c *serviceCatalog) refresh(ctx context.Context, list func(context.Context) (map[string][]string, error)) error {
+	ops, err := list(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.operations = ops
+	c.loaded = true
+	return nil
+}
+
+// observe records a service/operation seen at ingest
+func (c *serviceCatalog) observe(service, operation string) {
+	c.mu.RLock()
+	ops, known := c.operations[service]
+	if known {
+		i := sort.SearchStrings(ops, operation)
+		known = i < len(ops) && ops[i] == operation
+	}
+	c.mu.RUnlock()
+	if known {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ops = c.operations[service]
+	i := sort.SearchStrings(ops, operation)
+	if i < len(ops) && ops[i] == operation {
+		return
+	}
+	// Copy so snapshots handed to readers are never modified.
+	updated := make([]string, 0, len(ops)+1)
+	updated = append(updated, ops[:i]...)
+	updated = append(updated, operation)
+	updated = append(updated, ops[i:]...)
+	c.operations[service] = updated
+}
+
+// services returns the sorted service names, or false before the first refresh
+func (c *serviceCatalog) services() ([]string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.loaded {
+		return nil, false
+	}
+	services := make([]string, 0, len(c.operations))
+	for s := range c.operations {
+		services = append(services, s)
+	}
+	sort.Strings(services)
+	return services, true
+}
+
+// spanNames returns the sorted span names of one service, or of all services
+// when service is empty, or false before the first refresh.
+func (c *serviceCatalog) spanNames(service string) ([]string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.loaded {
+		return nil, false
+	}
+	if service != "" {
+		return append([]string{}, c.operations[service]...), true
+	}
+	seen := make(map[string]struct{})
+	var names []string
+	for _, ops := range c.operations {
+		for _, op := range ops {
+			if _, ok := seen[op]; !ok {
+				seen[op] = struct{}{}
+				names = append(names, op)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// runCatalogRefresh refreshes the service catalog until shutdown
+func (e *sqliteExporter) runCatalogRefresh() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.config.CatalogRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+			if err := e.catalog.refresh(e.cleanupCtx, e.store.ListServiceOperations); err != nil && e.cleanupCtx.Err() == nil {
+				e.logger.Warn("Failed to refresh service catalog", zap.Error(err))
+			}
+		}
+	}
+}
+
+// listServices serves from the catalog once loaded, otherwise (or for a
+// single tenant) from the store
+func (e *sqliteExporter) listServices(ctx context.Context) ([]string, error) {
+	if services, ok := e.catalog.services(); ok && !tenantScoped(ctx) {
+		return services, nil
+	}
+	return e.store.ListServices(ctx)
+}
+
+// listSpanNames serves from the catalog once loaded, otherwise (or for a
+// single tenant) from the store
+func (e *sqliteExporter) listSpanNames(ctx context.Context, service string) ([]string, error) {
+	if names, ok := e.catalog.spanNames(service); ok && !tenantScoped(ctx) {
+		return names, nil
+	}
+	if service != "" {
+		return e.store.ListOperations(ctx, service)
+	}
+	ops, err := e.store.ListServiceOperations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fallback := &serviceCatalog{operations: ops, loaded: true}
+	names, _ := fallback.spanNames("")
+	return names, nil
+}
@@ -0,0 +1,51 @@
+package sqliteexporter
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runTraceCompaction compacts complete traces every trace_compaction.interval
+func (e *sqliteExporter) runTraceCompaction() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.config.TraceCompaction.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+			e.compactTraces(time.Now())
+		}
+	}
+}
+
+// compactTraces repeats compaction batches until no complete trace is left
+// among the oldest rows, and logs what was compacted
+func (e *sqliteExporter) compactTraces(now time.Time) {
+	start := time.Now()
+	var traces, spans int64
+	for {
+		result, err := e.store.CompactTraces(e.cleanupCtx, now, e.config.TraceCompaction.After, e.config.TraceCompaction.BatchSize)
+		if err != nil {
+			if e.cleanupCtx.Err() == nil {
+				e.logger.Warn("Trace compaction failed", zap.Error(err))
+			}
+			break
+		}
+		traces += result.Traces
+		spans += result.Spans
+		if result.Traces == 0 {
+			break
+		}
+	}
+	if traces > 0 {
+		e.logger.Debug("Traces compacted",
+			zap.Int64("traces", traces),
+			zap.Int64("spans", spans),
+			zap.Duration("duration", time.Since(start)))
+	}
+}
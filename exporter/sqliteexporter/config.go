@@ -2,9 +2,16 @@ package sqliteexporter
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/collector/config/configopaque"
+	"go.opentelemetry.io/collector/config/configoptional"
+	"go.opentelemetry.io/collector/config/configretry"
+	"go.opentelemetry.io/collector/config/configtls"
+	"go.opentelemetry.io/collector/exporter/exporterhelper"
 )
 
 // Config defines the configuration for the SQLite exporter
@@ -21,6 +28,34 @@ type Config struct {
 	// Format: prefix.namespace.metric
 	Namespace string `mapstructure:"namespace"`
 
+	// InstanceLabel identifies this gotel instance in derived metrics so that
+	// several instances feeding the same backend don't overwrite each other.
+	// Use "hostname" to take the machine's hostname.
+	// Format: prefix.namespace.instance.metric
+	InstanceLabel string `mapstructure:"instance_label"`
+
+	// PathTemplate lays out the path of span metrics with placeholders:
+	// {prefix} (prefix, namespace and instance), {service}, {span},
+	// {metric}, and any resource attribute, e.g.
+	// {prefix}.{deployment.environment}.{service}.{span}.{metric}. It must
+	// contain {service} and {span} and end with .{metric}.
+	// Default: {prefix}.{service}.{span}.{metric}
+	PathTemplate string `mapstructure:"path_template"`
+
+	// MetricTimestamp is what span metrics are stamped with: "export" (when
+	// the batch arrives) or "span_end" (each span's end time, so delayed
+	// batches and replays are graphed when the spans happened; a batch then
+	// writes a point per operation and second its spans ended in)
+	// Default: export
+	MetricTimestamp string `mapstructure:"metric_timestamp"`
+
+	// TagAttributes lists span attributes added as tags to span metrics,
+	// e.g. [http.method, http.status_code], splitting each operation's
+	// points by their values. Every distinct value adds a series, so pick
+	// attributes with few values.
+	// Default: none
+	TagAttributes []string `mapstructure:"tag_attributes"`
+
 	// SendMetrics enables sending derived metrics from traces
 	// (span counts, duration histograms, error rates)
 	// Default: true
@@ -30,17 +65,821 @@ type Config struct {
 	// Default: true
 	StoreTraces bool `mapstructure:"store_traces"`
 
+	// StorageFormat is how spans are stored: "json" (one JSON document per
+	// span) or "protobuf" (the OTLP protobuf span plus a small JSON header for
+	// the indexed columns, which is smaller and served as-is to protobuf
+	// trace requests). Both can be read regardless of this setting.
+	// Default: json
+	StorageFormat string `mapstructure:"storage_format"`
+
+	// MigrateStorageFormat rewrites spans stored in the other format into
+	// StorageFormat in the background after startup.
+	MigrateStorageFormat bool `mapstructure:"migrate_storage_format"`
+
+	// DryRun parses and aggregates everything as usual but writes no spans,
+	// metrics or logs, counting the rows and bytes it would have written
+	// instead, to size storage for a new environment.
+	// Default: false
+	DryRun bool `mapstructure:"dry_run"`
+
 	// Retention is the duration to keep data before cleanup
 	// Default: 168h (7 days)
 	Retention time.Duration `mapstructure:"retention"`
 
+	// TraceRetention is how long spans, logs and service graph edges are kept
+	// Default: retention
+	TraceRetention time.Duration `mapstructure:"trace_retention"`
+
+	// MetricRetention is how long metrics are kept, which may be longer than
+	// TraceRetention since they are rolled up
+	// Default: retention
+	MetricRetention time.Duration `mapstructure:"metric_retention"`
+
 	// CleanupInterval is how often to run cleanup
 	// Default: 1h
 	CleanupInterval time.Duration `mapstructure:"cleanup_interval"`
 
+	// MaxDBSizeMiB caps the database size in MiB: once its pages in use
+	// exceed it, the oldest spans and metrics are deleted until they are
+	// below 90% of it, regardless of retention (0 disables)
+	// Default: 0
+	MaxDBSizeMiB int64 `mapstructure:"max_db_size_mib"`
+
 	// QueryPort is the HTTP port for the query API (0 to disable)
 	// Default: 3200
 	QueryPort int `mapstructure:"query_port"`
+
+	// BasePath mounts the whole query API under a path prefix (e.g. /gotel)
+	// for reverse proxies that route by path and forward it unchanged
+	// Default: "" (served at the root)
+	BasePath string `mapstructure:"base_path"`
+
+	// MaxRequestBodyBytes caps the body of POST and PUT requests to the query
+	// API (/render, /metrics/find, /api/search, ...); larger bodies are
+	// rejected with 413 before they reach the store
+	// Default: 10485760 (10 MiB)
+	MaxRequestBodyBytes int64 `mapstructure:"max_request_body_bytes"`
+
+	// TLS serves the query API over HTTPS with cert_file and key_file. Setting
+	// client_ca_file also requires clients to present a certificate signed by
+	// that CA (mTLS)
+	// Default: unset (plain HTTP)
+	TLS configoptional.Optional[configtls.ServerConfig] `mapstructure:"tls"`
+
+	// QueryAuth requires a bearer token or basic-auth credentials on query
+	// API requests
+	// Default: no authentication
+	QueryAuth QueryAuthConfig `mapstructure:"query_auth"`
+
+	// StreamingQuery serves Tempo's StreamingQuerier gRPC service on the
+	// query port, so Grafana's streaming search sees results as they are read
+	// Default: disabled
+	StreamingQuery StreamingQueryConfig `mapstructure:"streaming_query"`
+
+	// Anonymize configures the anonymize=true option of /api/traces/{id} and
+	// /api/spans, for sharing traces outside the team
+	Anonymize AnonymizeConfig `mapstructure:"anonymize"`
+
+	// Tenancy stores a tenant with each span and metric point and scopes
+	// query API requests to one tenant, so one instance can serve several
+	// isolated teams
+	// Default: disabled
+	Tenancy TenancyConfig `mapstructure:"tenancy"`
+
+	// DefaultLookback bounds /api/search, /api/traces and /render requests
+	// that give no start time to this window before their end (or now), so an
+	// unbounded query does not scan every row. Requests can pass all=true to
+	// search everything (0 disables)
+	// Default: 0
+	DefaultLookback time.Duration `mapstructure:"default_lookback"`
+
+	// IndexedAttributes lists span attribute keys (e.g. enduser.id, order.id)
+	// kept in an inverted index table, so trace searches on them are an index
+	// seek instead of a scan of every span.
+	// Default: none
+	IndexedAttributes []string `mapstructure:"indexed_attributes"`
+
+	// CatalogRefreshInterval is how often the in-memory list of services and
+	// operations served to Grafana variable queries is reloaded from SQLite.
+	// New names are added at ingest; the reload drops expired ones.
+	// Default: 30s
+	CatalogRefreshInterval time.Duration `mapstructure:"catalog_refresh_interval"`
+
+	// QueueConfig is the exporterhelper sending queue in front of the
+	// SQLite writer (queue_size, num_consumers, storage for a persistent
+	// queue backed by a storage extension such as file_storage).
+	// Default: enabled, num_consumers 1
+	QueueConfig configoptional.Optional[exporterhelper.QueueBatchConfig] `mapstructure:"sending_queue"`
+
+	// BackOffConfig retries batches that failed with a retryable error,
+	// including batches refused by Backpressure.
+	// Default: enabled, exporterhelper defaults
+	BackOffConfig configretry.BackOffConfig `mapstructure:"retry_on_failure"`
+
+	// Backpressure refuses batches with a retryable error while SQLite
+	// inserts are slow, so the collector's queue, retry and memory_limiter
+	// react before buffered data grows without bound.
+	Backpressure BackpressureConfig `mapstructure:"backpressure"`
+
+	// DiskFull configures how ingest pauses while the disk holding the
+	// database is full.
+	DiskFull DiskFullConfig `mapstructure:"disk_full"`
+
+	// Prometheus configures the /metrics scrape endpoint for the derived
+	// span metrics.
+	Prometheus PrometheusConfig `mapstructure:"prometheus"`
+
+	// SlowIngest logs trace batches that take longer than a threshold to
+	// process, with their size and a sample of span names, and keeps the
+	// most recent ones for /api/status/slow-ingest.
+	SlowIngest SlowIngestConfig `mapstructure:"slow_ingest"`
+
+	// ServiceGraph builds the service dependency graph served at
+	// /api/dependencies from parent/child spans in different services.
+	ServiceGraph SpanJoinConfig `mapstructure:"service_graph"`
+
+	// SelfTime maintains each span's self-time (duration minus its direct
+	// children) for /api/self-time.
+	SelfTime SpanJoinConfig `mapstructure:"self_time"`
+
+	// WriteBatch coalesces span and metric writes from concurrent pushes
+	// into shared transactions. Raise sending_queue.num_consumers so there
+	// are concurrent pushes to coalesce.
+	WriteBatch WriteBatchConfig `mapstructure:"write_batch"`
+
+	// WALCheckpoint truncates the SQLite -wal file once it grows past a
+	// size, which automatic checkpoints never do.
+	WALCheckpoint WALCheckpointConfig `mapstructure:"wal_checkpoint"`
+
+	// Rollup averages aging metric points into one-minute and one-hour
+	// tables, which /render reads for older time ranges.
+	Rollup RollupConfig `mapstructure:"rollup"`
+
+	// TraceCompaction merges the spans of aged, complete traces into one
+	// compressed row per trace, which stays available by trace ID.
+	TraceCompaction TraceCompactionConfig `mapstructure:"trace_compaction"`
+
+	// SelfMetrics writes the exporter's own ingest and storage stats as
+	// metrics under <prefix>.self, as carbon reports itself under
+	// carbon.agents.
+	SelfMetrics SelfMetricsConfig `mapstructure:"self_metrics"`
+
+	// Hooks configures the ingest hooks custom builds register with
+	// RegisterIngestHook
+	Hooks HooksConfig `mapstructure:"hooks"`
+
+	// Percentiles lists duration quantiles (0-100] computed per
+	// service/operation over each batch and stored as duration_ms.p<N>,
+	// e.g. [50, 95, 99].
+	// Default: none
+	Percentiles []float64 `mapstructure:"percentiles"`
+
+	// LatencyBudgets sets expected maximum durations per service/operation.
+	// Spans exceeding their budget are counted in over_budget_count metrics
+	// and can be searched with /api/search?overBudget=true.
+	LatencyBudgets []LatencyBudget `mapstructure:"latency_budgets"`
+
+	// Incidents copies full traces into a separate database, exempt from
+	// retention, when a service breaches an error rate or latency threshold.
+	Incidents IncidentsConfig `mapstructure:"incidents"`
+
+	// LivePush pushes newly seen exception groups and slow traces to Grafana
+	// Live or a webhook as they are ingested.
+	LivePush LivePushConfig `mapstructure:"live_push"`
+
+	// Replication configures warm-standby replication to a secondary node
+	Replication ReplicationConfig `mapstructure:"replication"`
+
+	// FileIngest ingests OTLP JSON files dropped into a directory
+	FileIngest FileIngestConfig `mapstructure:"file_ingest"`
+
+	// Enrichment adds lookup-based attributes to spans before they are
+	// stored, e.g. GeoIP data for client.address or node labels for host.name.
+	Enrichment []EnrichmentConfig `mapstructure:"enrichment"`
+
+	// Include, when set, keeps only spans matching at least one rule
+	Include []SpanMatchConfig `mapstructure:"include"`
+
+	// Exclude drops spans matching any rule, e.g. health checks, before
+	// they are stored or counted in metrics
+	Exclude []SpanMatchConfig `mapstructure:"exclude"`
+
+	// DerivedMetrics defines custom metrics computed from spans at ingest,
+	// stored next to the built-in span_count/duration_ms/error_count.
+	DerivedMetrics []DerivedMetricConfig `mapstructure:"derived_metrics"`
+
+	// Attach opens other gotel databases read-only next to DBPath, e.g. a
+	// rotated file or a replica from another node. Trace search, trace
+	// lookups and metric queries return results from all of them.
+	Attach []AttachConfig `mapstructure:"attach"`
+}
+
+// AttachConfig names an additional read-only database
+type AttachConfig struct {
+	// Name is the SQLite schema name, a plain identifier such as "yesterday"
+	Name string `mapstructure:"name"`
+
+	// Path is the database file, which must already exist
+	Path string `mapstructure:"path"`
+}
+
+// LatencyBudget is the expected maximum duration for a service's spans
+type LatencyBudget struct {
+	// Service is the service.name the budget applies to
+	Service string `mapstructure:"service"`
+
+	// Operation limits the budget to one span name. When empty the budget
+	// covers all operations of the service that have no budget of their own.
+	Operation string `mapstructure:"operation"`
+
+	// Budget is the maximum expected span duration
+	Budget time.Duration `mapstructure:"budget"`
+}
+
+// IncidentsConfig configures threshold-triggered trace snapshots
+type IncidentsConfig struct {
+	// DBPath is the incidents database. Empty disables snapshots.
+	DBPath string `mapstructure:"db_path"`
+
+	// Interval is how often services are evaluated, each time over the
+	// spans that started in the preceding interval
+	// Default: 1m
+	Interval time.Duration `mapstructure:"interval"`
+
+	// MaxTraces caps the traces copied per incident
+	// Default: 500
+	MaxTraces int `mapstructure:"max_traces"`
+
+	// Rules set the thresholds; the first rule matching a service applies
+	Rules []IncidentRule `mapstructure:"rules"`
+}
+
+// LivePushConfig configures near-real-time notifications of new exception
+// groups and slow traces
+type LivePushConfig struct {
+	// Endpoint is the URL notifications are POSTed to, e.g. Grafana Live's
+	// http://grafana:3000/api/live/push/gotel. Empty disables pushing.
+	Endpoint string `mapstructure:"endpoint"`
+
+	// Format is "influx" (line protocol, as Grafana Live's push endpoint
+	// expects) or "json" (an array of events, for generic webhooks)
+	// Default: influx
+	Format string `mapstructure:"format"`
+
+	// Headers are set on every request, e.g. Authorization with a Grafana
+	// service account token
+	Headers map[string]configopaque.String `mapstructure:"headers"`
+
+	// SlowTraceThreshold pushes every trace whose root span lasts at least
+	// this long (0 pushes no slow traces)
+	// Default: 0
+	SlowTraceThreshold time.Duration `mapstructure:"slow_trace_threshold"`
+
+	// Timeout bounds each request
+	// Default: 5s
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// QueueSize is the number of ingested batches waiting to be checked;
+	// batches arriving while it is full are not checked, so a slow endpoint
+	// never slows ingest
+	// Default: 100
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+func (c *LivePushConfig) validate() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("endpoint must be an http or https URL, got %q", c.Endpoint)
+	}
+	switch c.Format {
+	case "":
+		c.Format = livePushFormatInflux
+	case livePushFormatInflux, livePushFormatJSON:
+	default:
+		return fmt.Errorf("format must be %q or %q, got %q", livePushFormatInflux, livePushFormatJSON, c.Format)
+	}
+	if c.SlowTraceThreshold < 0 {
+		return fmt.Errorf("slow_trace_threshold must not be negative")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultLivePushTimeout
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("queue_size must not be negative")
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultLivePushQueueSize
+	}
+	return nil
+}
+
+// IncidentRule is the threshold for one service, or every service
+type IncidentRule struct {
+	// Service is the service.name the rule applies to; "*" matches any
+	Service string `mapstructure:"service"`
+
+	// ErrorRate is the fraction of error spans, (0, 1], at which a snapshot
+	// is taken (0 disables)
+	ErrorRate float64 `mapstructure:"error_rate"`
+
+	// P95Latency is the 95th percentile span duration at which a snapshot is
+	// taken (0 disables)
+	P95Latency time.Duration `mapstructure:"p95_latency"`
+
+	// MinSpans is the fewest spans in a window for it to be evaluated, so a
+	// single failed request on an idle service is not an incident
+	// Default: 20
+	MinSpans int64 `mapstructure:"min_spans"`
+}
+
+// ReplicationConfig defines how stored spans, metrics and logs are streamed
+// from a primary gotel to a standby over gRPC.
+type ReplicationConfig struct {
+	// Role is "primary", "standby" or empty to disable replication
+	Role string `mapstructure:"role"`
+
+	// ListenAddress is the gRPC address a primary serves replication on.
+	// A promoted standby also starts serving here.
+	// Default: :3201
+	ListenAddress string `mapstructure:"listen_address"`
+
+	// PrimaryEndpoint is the primary's replication address (standby only)
+	PrimaryEndpoint string `mapstructure:"primary_endpoint"`
+
+	// SyncInterval is how often new rows are polled and shipped
+	// Default: 5s
+	SyncInterval time.Duration `mapstructure:"sync_interval"`
+
+	// BatchSize caps the number of spans, metrics and logs per shipped batch
+	// Default: 1000
+	BatchSize int `mapstructure:"batch_size"`
+
+	// TLS serves replication over TLS with cert_file and key_file, on the
+	// primary and on a standby once promoted. Setting client_ca_file also
+	// requires standbys to present a certificate signed by that CA (mTLS)
+	// Default: unset (plain text)
+	TLS configoptional.Optional[configtls.ServerConfig] `mapstructure:"tls"`
+
+	// PrimaryTLS is the TLS configuration a standby dials primary_endpoint
+	// with (ca_file, cert_file and key_file for mTLS, ...)
+	// Default: unset (plain text)
+	PrimaryTLS configoptional.Optional[configtls.ClientConfig] `mapstructure:"primary_tls"`
+
+	// Token is a shared secret a standby sends with its subscription; a
+	// primary with a token refuses standbys that do not send it. The
+	// /api/replication endpoints require it in X-Replication-Token and are
+	// refused while it is unset
+	// Default: unset (no authentication)
+	Token configopaque.String `mapstructure:"token"`
+}
+
+// BackpressureConfig configures write-latency based throttling
+type BackpressureConfig struct {
+	// LatencyThreshold is the moving-average insert latency above which
+	// batches are refused (0 disables backpressure)
+	// Default: 2s
+	LatencyThreshold time.Duration `mapstructure:"latency_threshold"`
+
+	// Cooldown is how long batches are refused before a write is tried again
+	// Default: 1s
+	Cooldown time.Duration `mapstructure:"cooldown"`
+}
+
+// DiskFullConfig configures the pause in ingest after a write fails because
+// the disk is full. Batches are refused with a retryable error, so the
+// sending queue holds them, and a write is tried again every RetryInterval
+// until one succeeds.
+type DiskFullConfig struct {
+	// RetryInterval is how long batches are refused before a write is tried
+	// again
+	// Default: 30s
+	RetryInterval time.Duration `mapstructure:"retry_interval"`
+
+	// EmergencyCleanupPercent, when above 0, deletes the oldest spans and
+	// metrics on a full disk until this share of the space in use is freed,
+	// and returns it to the filesystem
+	// Default: 0 (disabled)
+	EmergencyCleanupPercent int `mapstructure:"emergency_cleanup_percent"`
+}
+
+// PrometheusConfig configures the /metrics scrape endpoint
+type PrometheusConfig struct {
+	// Labels maps derived metric tag keys (service, span, instance and any
+	// tag_attributes) to Prometheus label names; tags not listed are dropped.
+	// Default: service, span and (with instance_label) instance under their
+	// own names
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+// SlowIngestConfig configures the slow batch log
+type SlowIngestConfig struct {
+	// Threshold is the pushTraces duration above which a batch is logged
+	// at Warn and recorded (0 disables)
+	// Default: 1s
+	Threshold time.Duration `mapstructure:"threshold"`
+
+	// BufferSize is how many recent slow batches are kept
+	// Default: 20
+	BufferSize int `mapstructure:"buffer_size"`
+}
+
+// WriteBatchConfig configures the group commit writer
+type WriteBatchConfig struct {
+	// Enabled routes writes through the group commit writer
+	// Default: true
+	Enabled bool `mapstructure:"enabled"`
+
+	// FlushInterval is how long a transaction waits for more writes after
+	// the first (0 only takes writes already queued, adding no latency)
+	// Default: 0
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+
+	// MaxRows caps the spans and metrics committed per transaction
+	// Default: 10000
+	MaxRows int `mapstructure:"max_rows"`
+}
+
+// WALCheckpointConfig configures size-triggered WAL checkpoints
+type WALCheckpointConfig struct {
+	// Interval is how often the -wal file size is checked (0 disables)
+	// Default: 1m
+	Interval time.Duration `mapstructure:"interval"`
+
+	// MaxSizeMB is the -wal file size in megabytes above which it is
+	// checkpointed and truncated
+	// Default: 64
+	MaxSizeMB int64 `mapstructure:"max_size_mb"`
+}
+
+// RollupConfig configures metric downsampling
+type RollupConfig struct {
+	// Interval is how often aged points are rolled up (0 disables)
+	// Default: 0
+	Interval time.Duration `mapstructure:"interval"`
+
+	// MinuteAfter is the age after which raw points are averaged into
+	// one-minute buckets
+	// Default: 1h
+	MinuteAfter time.Duration `mapstructure:"minute_after"`
+
+	// HourAfter is the age after which one-minute buckets are averaged into
+	// one-hour buckets
+	// Default: 24h
+	HourAfter time.Duration `mapstructure:"hour_after"`
+}
+
+// TraceCompactionConfig configures the trace blob compactor
+type TraceCompactionConfig struct {
+	// Interval is how often complete traces are compacted (0 disables)
+	// Default: 0
+	Interval time.Duration `mapstructure:"interval"`
+
+	// After is how long a trace must have received no spans to be
+	// compacted. Compacted traces only match searches answered from their
+	// trace summary, so this should be longer than the window span queries
+	// and span-level searches are made over.
+	// Default: 24h
+	After time.Duration `mapstructure:"after"`
+
+	// BatchSize is how many of the oldest span rows are considered per
+	// transaction
+	// Default: 10000
+	BatchSize int `mapstructure:"batch_size"`
+}
+
+func (c *TraceCompactionConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if c.Interval == 0 {
+		return nil
+	}
+	if c.After < 0 {
+		return fmt.Errorf("after must not be negative")
+	}
+	if c.After == 0 {
+		c.After = defaultTraceCompactionAfter
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch_size must not be negative")
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultTraceCompactionBatchSize
+	}
+	return nil
+}
+
+// SelfMetricsConfig configures the exporter's own metrics
+type SelfMetricsConfig struct {
+	// Interval is how often self metrics are written (0 disables)
+	// Default: 1m
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// QueryAuthConfig configures authentication on the query API
+type QueryAuthConfig struct {
+	// Type is "bearer", "basic" or empty to disable authentication
+	Type string `mapstructure:"type"`
+
+	// Token is the bearer token clients send as "Authorization: Bearer ..."
+	Token configopaque.String `mapstructure:"token"`
+
+	// Username and Password are the basic-auth credentials
+	Username string              `mapstructure:"username"`
+	Password configopaque.String `mapstructure:"password"`
+}
+
+func (c *QueryAuthConfig) validate() error {
+	switch c.Type {
+	case "":
+	case queryAuthBearer:
+		if c.Token == "" {
+			return fmt.Errorf("token is required for bearer authentication")
+		}
+	case queryAuthBasic:
+		if c.Username == "" || c.Password == "" {
+			return fmt.Errorf("username and password are required for basic authentication")
+		}
+	default:
+		return fmt.Errorf("invalid type %q: must be %q or %q", c.Type, queryAuthBearer, queryAuthBasic)
+	}
+	return nil
+}
+
+// StreamingQueryConfig configures the gRPC streaming query service
+type StreamingQueryConfig struct {
+	// Enabled serves tempopb.StreamingQuerier (Search, SearchTagValues and
+	// SearchTagValuesV2) over HTTP/2 on the query port, alongside the HTTP API
+	Enabled bool `mapstructure:"enabled"`
+
+	// BatchSize is how many traces or tag values each streamed message holds
+	// Default: 100
+	BatchSize int `mapstructure:"batch_size"`
+}
+
+func (c *StreamingQueryConfig) validate() error {
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch_size must not be negative")
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultStreamingQueryBatchSize
+	}
+	return nil
+}
+
+// AnonymizeConfig configures anonymized exports
+type AnonymizeConfig struct {
+	// StripKeys lists attribute keys removed from resources, spans, events
+	// and links. A trailing * matches any key with that prefix, and
+	// status.message, trace_state and tenant name those span fields
+	// Default: URL, header, database statement and stack trace attributes,
+	// and trace_state
+	StripKeys []string `mapstructure:"strip_keys"`
+
+	// HashKeys lists attribute keys whose values are replaced by a keyed
+	// hash, so equal values still match across spans and traces. Listing
+	// service.name also hashes each span's service_name
+	// Default: service, host, user, client and Kubernetes identifiers,
+	// exception.message, status.message and tenant
+	HashKeys []string `mapstructure:"hash_keys"`
+
+	// Salt keys the hashes. Set it to keep hashes stable across restarts;
+	// without it a random salt is picked at startup
+	Salt configopaque.String `mapstructure:"salt"`
+}
+
+// TenancyConfig configures multi-tenant ingest and queries
+type TenancyConfig struct {
+	// Enabled turns tenancy on. Telemetry without a tenant, and query
+	// requests without the header, belong to the default tenant
+	Enabled bool `mapstructure:"enabled"`
+
+	// Header carries the tenant on OTLP requests (read from the receiver's
+	// include_metadata client metadata) and on query API requests
+	// Default: X-Scope-OrgID
+	Header string `mapstructure:"header"`
+
+	// ResourceAttribute is read for the tenant of telemetry that arrives
+	// without the header, e.g. one set by an attributes processor's
+	// from_context action
+	// Default: unset
+	ResourceAttribute string `mapstructure:"resource_attribute"`
+}
+
+func (c *TenancyConfig) validate() error {
+	if c.Header == "" {
+		c.Header = defaultTenancyHeader
+	}
+	if strings.ContainsAny(c.Header, " \t:") {
+		return fmt.Errorf("header %q is not a valid header name", c.Header)
+	}
+	return nil
+}
+
+// HooksConfig configures when ingest hooks see a trace as complete
+type HooksConfig struct {
+	// TraceCompleteAfter is how long a trace must go without new spans
+	// before OnTraceComplete is called
+	// Default: 30s
+	TraceCompleteAfter time.Duration `mapstructure:"trace_complete_after"`
+
+	// MaxPendingTraces bounds the traces waiting to complete; traces past it
+	// are not reported
+	// Default: 100000
+	MaxPendingTraces int `mapstructure:"max_pending_traces"`
+}
+
+func (c *HooksConfig) validate() error {
+	if c.TraceCompleteAfter < 0 {
+		return fmt.Errorf("trace_complete_after must not be negative")
+	}
+	if c.TraceCompleteAfter == 0 {
+		c.TraceCompleteAfter = defaultHooksTraceCompleteAfter
+	}
+	if c.MaxPendingTraces < 0 {
+		return fmt.Errorf("max_pending_traces must not be negative")
+	}
+	if c.MaxPendingTraces == 0 {
+		c.MaxPendingTraces = defaultHooksMaxPendingTraces
+	}
+	return nil
+}
+
+func (c *RollupConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if c.Interval == 0 {
+		return nil
+	}
+	if c.MinuteAfter == 0 {
+		c.MinuteAfter = defaultRollupMinuteAfter
+	}
+	if c.HourAfter == 0 {
+		c.HourAfter = defaultRollupHourAfter
+	}
+	if c.MinuteAfter < 0 {
+		return fmt.Errorf("minute_after must not be negative")
+	}
+	if c.HourAfter <= c.MinuteAfter {
+		return fmt.Errorf("hour_after must be greater than minute_after")
+	}
+	return nil
+}
+
+// SpanJoinConfig configures a background job that joins newly stored spans
+// with their parents and children
+type SpanJoinConfig struct {
+	// Interval is how often newly stored spans are processed (0 disables
+	// the job)
+	// Default: 30s
+	Interval time.Duration `mapstructure:"interval"`
+
+	// BatchSize is how many spans are joined per transaction
+	// Default: 10000
+	BatchSize int `mapstructure:"batch_size"`
+}
+
+func (c *IncidentsConfig) validate() error {
+	if c.DBPath == "" {
+		return nil
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultIncidentsInterval
+	}
+	if c.MaxTraces < 0 {
+		return fmt.Errorf("max_traces must not be negative")
+	}
+	if c.MaxTraces == 0 {
+		c.MaxTraces = defaultIncidentsMaxTraces
+	}
+	if len(c.Rules) == 0 {
+		return fmt.Errorf("rules: at least one rule is required")
+	}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if r.Service == "" {
+			return fmt.Errorf("rules[%d]: service is required", i)
+		}
+		if r.ErrorRate < 0 || r.ErrorRate > 1 {
+			return fmt.Errorf("rules[%d]: error_rate must be between 0 and 1", i)
+		}
+		if r.P95Latency < 0 {
+			return fmt.Errorf("rules[%d]: p95_latency must not be negative", i)
+		}
+		if r.ErrorRate == 0 && r.P95Latency == 0 {
+			return fmt.Errorf("rules[%d]: error_rate or p95_latency is required", i)
+		}
+		if r.MinSpans < 0 {
+			return fmt.Errorf("rules[%d]: min_spans must not be negative", i)
+		}
+		if r.MinSpans == 0 {
+			r.MinSpans = defaultIncidentMinSpans
+		}
+	}
+	return nil
+}
+
+func (c *SpanJoinConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if c.Interval > 0 && c.BatchSize <= 0 {
+		c.BatchSize = defaultSpanJoinBatchSize
+	}
+	return nil
+}
+
+// FileIngestConfig configures ingestion of OTLP JSON trace files dropped into
+// a directory, for hosts where traces arrive by file transfer rather than
+// over the network.
+type FileIngestConfig struct {
+	// Directory is scanned for *.json (one OTLP TracesData document) and
+	// *.jsonl (one document per line) files. Empty disables file ingest.
+	Directory string `mapstructure:"directory"`
+
+	// PollInterval is how often the directory is scanned
+	// Default: 10s
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+
+	// ArchiveDirectory receives files after a successful ingest. When empty,
+	// ingested files are deleted.
+	ArchiveDirectory string `mapstructure:"archive_directory"`
+}
+
+// DerivedMetricConfig defines one custom metric aggregated per service and
+// batch from the spans matching Where
+type DerivedMetricConfig struct {
+	// Name is the metric path segment after the service, e.g. server_errors
+	Name string `mapstructure:"name"`
+
+	// Where is an OTTL-style condition selecting spans, e.g.
+	// attributes["http.status_code"] >= 500 and kind == "server"
+	// Default: every span
+	Where string `mapstructure:"where"`
+
+	// GroupBy lists attribute keys (span first, then resource) whose values
+	// split the metric into series
+	GroupBy []string `mapstructure:"group_by"`
+
+	// Aggregate is count, sum, avg, min or max
+	// Default: count
+	Aggregate string `mapstructure:"aggregate"`
+
+	// Value is the path aggregated by sum, avg, min and max, e.g.
+	// duration_ms or attributes["db.rows"]; spans without a numeric value
+	// are skipped
+	Value string `mapstructure:"value"`
+}
+
+// SpanMatchConfig selects spans for Include and Exclude. Every field that is
+// set must match.
+type SpanMatchConfig struct {
+	// Service matches the service.name resource attribute
+	Service string `mapstructure:"service"`
+
+	// SpanName matches the span name
+	SpanName string `mapstructure:"span_name"`
+
+	// Attributes maps attribute keys (span first, then resource) to
+	// patterns their values must match
+	Attributes map[string]string `mapstructure:"attributes"`
+
+	// MatchType is glob (* and ? wildcards, whole value) or regexp
+	// (unanchored unless the pattern uses ^ and $)
+	// Default: glob
+	MatchType string `mapstructure:"match_type"`
+}
+
+// EnrichmentConfig configures one attribute lookup applied at ingest
+type EnrichmentConfig struct {
+	// Source is "geoip" (longest-prefix CIDR match) or "static" (exact match)
+	Source string `mapstructure:"source"`
+
+	// Attribute is the span or resource attribute whose value is looked up
+	// Default: client.address for geoip
+	Attribute string `mapstructure:"attribute"`
+
+	// File is a CSV lookup table. The header names the key column followed by
+	// the attributes to add; for geoip the key column holds CIDR networks.
+	// Required for geoip.
+	File string `mapstructure:"file"`
+
+	// Values maps attribute values to the attributes to add (static only).
+	// Entries here override rows with the same key in File.
+	Values map[string]map[string]string `mapstructure:"values"`
+
+	// Prefix is prepended to the added attribute names
+	// Default: "geo." for geoip, none for static
+	Prefix string `mapstructure:"prefix"`
 }
 
 // applyEnvironmentOverrides reads well-known environment variables and applies
@@ -57,6 +896,14 @@ func (cfg *Config) applyEnvironmentOverrides() error {
 		}
 		cfg.Retention = d
 	}
+	if envBasePath := strings.TrimSpace(os.Getenv("GOTEL_BASE_PATH")); envBasePath != "" {
+		cfg.BasePath = envBasePath
+	}
+	// A token from the environment keeps it out of the config file
+	if envToken := strings.TrimSpace(os.Getenv("GOTEL_QUERY_BEARER_TOKEN")); envToken != "" {
+		cfg.QueryAuth.Type = queryAuthBearer
+		cfg.QueryAuth.Token = configopaque.String(envToken)
+	}
 	return nil
 }
 
@@ -71,8 +918,294 @@ func (cfg *Config) Validate() error {
 	if cfg.Retention == 0 {
 		cfg.Retention = defaultRetention
 	}
+	if cfg.TraceRetention == 0 {
+		cfg.TraceRetention = cfg.Retention
+	}
+	if cfg.MetricRetention == 0 {
+		cfg.MetricRetention = cfg.Retention
+	}
+	if cfg.InstanceLabel == instanceLabelHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to resolve instance_label hostname: %w", err)
+		}
+		cfg.InstanceLabel = hostname
+	}
 	if cfg.CleanupInterval == 0 {
 		cfg.CleanupInterval = time.Hour
 	}
+	if cfg.CatalogRefreshInterval <= 0 {
+		cfg.CatalogRefreshInterval = defaultCatalogRefreshInterval
+	}
+	cfg.BasePath = strings.TrimRight(strings.TrimSpace(cfg.BasePath), "/")
+	if cfg.BasePath != "" && !strings.HasPrefix(cfg.BasePath, "/") {
+		return fmt.Errorf("base_path must start with /, got %q", cfg.BasePath)
+	}
+	switch cfg.StorageFormat {
+	case "":
+		cfg.StorageFormat = storageFormatJSON
+	case storageFormatJSON, storageFormatProtobuf:
+	default:
+		return fmt.Errorf("invalid storage_format %q: must be %q or %q", cfg.StorageFormat, storageFormatJSON, storageFormatProtobuf)
+	}
+	for i, p := range cfg.Percentiles {
+		if p <= 0 || p > 100 {
+			return fmt.Errorf("percentiles[%d]: %v is not in (0, 100]", i, p)
+		}
+	}
+	for i, b := range cfg.LatencyBudgets {
+		if b.Service == "" {
+			return fmt.Errorf("latency_budgets[%d]: service is required", i)
+		}
+		if b.Budget <= 0 {
+			return fmt.Errorf("latency_budgets[%d]: budget must be positive", i)
+		}
+	}
+	if err := cfg.Replication.validate(); err != nil {
+		return err
+	}
+	if cfg.FileIngest.Directory != "" && cfg.FileIngest.PollInterval <= 0 {
+		cfg.FileIngest.PollInterval = defaultFileIngestPollInterval
+	}
+	if cfg.Backpressure.LatencyThreshold < 0 {
+		return fmt.Errorf("backpressure.latency_threshold must not be negative")
+	}
+	if cfg.Backpressure.LatencyThreshold > 0 && cfg.Backpressure.Cooldown <= 0 {
+		cfg.Backpressure.Cooldown = defaultBackpressureCooldown
+	}
+	if cfg.DiskFull.RetryInterval <= 0 {
+		cfg.DiskFull.RetryInterval = defaultDiskFullRetryInterval
+	}
+	if cfg.DiskFull.EmergencyCleanupPercent < 0 || cfg.DiskFull.EmergencyCleanupPercent >= 100 {
+		return fmt.Errorf("disk_full.emergency_cleanup_percent must be between 0 and 99")
+	}
+	if len(cfg.Prometheus.Labels) == 0 {
+		cfg.Prometheus.Labels = map[string]string{"service": "service", "span": "span"}
+		if cfg.InstanceLabel != "" {
+			cfg.Prometheus.Labels["instance"] = "instance"
+		}
+	}
+	seenLabels := make(map[string]bool, len(cfg.Prometheus.Labels))
+	for key, label := range cfg.Prometheus.Labels {
+		if !prometheusLabelName.MatchString(label) || strings.HasPrefix(label, "__") {
+			return fmt.Errorf("prometheus.labels[%s]: invalid label name %q", key, label)
+		}
+		if seenLabels[label] {
+			return fmt.Errorf("prometheus.labels[%s]: duplicate label name %q", key, label)
+		}
+		seenLabels[label] = true
+	}
+	if cfg.SlowIngest.Threshold < 0 {
+		return fmt.Errorf("slow_ingest.threshold must not be negative")
+	}
+	if cfg.SlowIngest.Threshold > 0 && cfg.SlowIngest.BufferSize <= 0 {
+		cfg.SlowIngest.BufferSize = defaultSlowIngestBufferSize
+	}
+	if err := cfg.ServiceGraph.validate(); err != nil {
+		return fmt.Errorf("service_graph.%w", err)
+	}
+	if err := cfg.SelfTime.validate(); err != nil {
+		return fmt.Errorf("self_time.%w", err)
+	}
+	if err := cfg.Incidents.validate(); err != nil {
+		return fmt.Errorf("incidents.%w", err)
+	}
+	if cfg.Incidents.DBPath != "" && cfg.Incidents.DBPath == cfg.DBPath {
+		return fmt.Errorf("incidents.db_path must differ from db_path")
+	}
+	if err := cfg.LivePush.validate(); err != nil {
+		return fmt.Errorf("live_push.%w", err)
+	}
+	if cfg.WriteBatch.FlushInterval < 0 {
+		return fmt.Errorf("write_batch.flush_interval must not be negative")
+	}
+	if cfg.WriteBatch.MaxRows < 0 {
+		return fmt.Errorf("write_batch.max_rows must not be negative")
+	}
+	if cfg.WriteBatch.Enabled && cfg.WriteBatch.MaxRows == 0 {
+		cfg.WriteBatch.MaxRows = defaultWriteBatchMaxRows
+	}
+	if cfg.MaxDBSizeMiB < 0 {
+		return fmt.Errorf("max_db_size_mib must not be negative")
+	}
+	if cfg.DefaultLookback < 0 {
+		return fmt.Errorf("default_lookback must not be negative")
+	}
+	if cfg.MaxRequestBodyBytes < 0 {
+		return fmt.Errorf("max_request_body_bytes must not be negative")
+	}
+	if cfg.MaxRequestBodyBytes == 0 {
+		cfg.MaxRequestBodyBytes = defaultMaxRequestBodyBytes
+	}
+	if cfg.TLS.HasValue() {
+		if t := cfg.TLS.Get(); (t.CertFile == "" && string(t.CertPem) == "") || (t.KeyFile == "" && string(t.KeyPem) == "") {
+			return fmt.Errorf("tls requires cert_file and key_file")
+		}
+	}
+	if cfg.WALCheckpoint.Interval < 0 {
+		return fmt.Errorf("wal_checkpoint.interval must not be negative")
+	}
+	if cfg.WALCheckpoint.MaxSizeMB < 0 {
+		return fmt.Errorf("wal_checkpoint.max_size_mb must not be negative")
+	}
+	if cfg.WALCheckpoint.Interval > 0 && cfg.WALCheckpoint.MaxSizeMB == 0 {
+		cfg.WALCheckpoint.MaxSizeMB = defaultWALCheckpointMaxSizeMB
+	}
+	switch cfg.MetricTimestamp {
+	case "":
+		cfg.MetricTimestamp = metricTimestampExport
+	case metricTimestampExport, metricTimestampSpanEnd:
+	default:
+		return fmt.Errorf("metric_timestamp must be %q or %q, got %q", metricTimestampExport, metricTimestampSpanEnd, cfg.MetricTimestamp)
+	}
+	for _, key := range cfg.TagAttributes {
+		if key == "" || reservedMetricTags[key] {
+			return fmt.Errorf("tag_attributes: invalid attribute %q", key)
+		}
+	}
+	if _, err := compileMetricPathTemplate(cfg.PathTemplate); err != nil {
+		return fmt.Errorf("path_template %w", err)
+	}
+	if err := cfg.Rollup.validate(); err != nil {
+		return fmt.Errorf("rollup.%w", err)
+	}
+	if err := cfg.TraceCompaction.validate(); err != nil {
+		return fmt.Errorf("trace_compaction.%w", err)
+	}
+	if cfg.SelfMetrics.Interval < 0 {
+		return fmt.Errorf("self_metrics.interval must not be negative")
+	}
+	if err := cfg.Hooks.validate(); err != nil {
+		return fmt.Errorf("hooks.%w", err)
+	}
+	if err := cfg.QueryAuth.validate(); err != nil {
+		return fmt.Errorf("query_auth.%w", err)
+	}
+	if err := cfg.Tenancy.validate(); err != nil {
+		return fmt.Errorf("tenancy.%w", err)
+	}
+	if err := cfg.StreamingQuery.validate(); err != nil {
+		return fmt.Errorf("streaming_query.%w", err)
+	}
+	for i := range cfg.Enrichment {
+		if err := cfg.Enrichment[i].validate(); err != nil {
+			return fmt.Errorf("enrichment[%d]: %w", i, err)
+		}
+	}
+	for i := range cfg.Include {
+		if _, err := compileSpanMatcher(cfg.Include[i]); err != nil {
+			return fmt.Errorf("include[%d]: %w", i, err)
+		}
+	}
+	for i := range cfg.Exclude {
+		if _, err := compileSpanMatcher(cfg.Exclude[i]); err != nil {
+			return fmt.Errorf("exclude[%d]: %w", i, err)
+		}
+	}
+	for i := range cfg.DerivedMetrics {
+		if cfg.DerivedMetrics[i].Aggregate == "" {
+			cfg.DerivedMetrics[i].Aggregate = derivedCount
+		}
+		if _, err := compileDerivedMetric(cfg.DerivedMetrics[i]); err != nil {
+			return fmt.Errorf("derived_metrics[%d]: %w", i, err)
+		}
+	}
+	for i, a := range cfg.Attach {
+		if a.Name == "" || a.Path == "" {
+			return fmt.Errorf("attach[%d]: name and path are required", i)
+		}
+	}
+	seenAttrs := make(map[string]bool, len(cfg.IndexedAttributes))
+	for i, key := range cfg.IndexedAttributes {
+		if key == "" || strings.ContainsAny(key, `"\`) {
+			return fmt.Errorf("indexed_attributes[%d]: invalid attribute key %q", i, key)
+		}
+		if seenAttrs[key] {
+			return fmt.Errorf("indexed_attributes[%d]: duplicate attribute key %q", i, key)
+		}
+		seenAttrs[key] = true
+	}
+	return nil
+}
+
+func (ec *EnrichmentConfig) validate() error {
+	switch ec.Source {
+	case enrichmentSourceGeoIP:
+		if ec.File == "" {
+			return fmt.Errorf("file is required for source %q", enrichmentSourceGeoIP)
+		}
+		if ec.Attribute == "" {
+			ec.Attribute = defaultGeoIPAttribute
+		}
+		if ec.Prefix == "" {
+			ec.Prefix = defaultGeoIPPrefix
+		}
+	case enrichmentSourceStatic:
+		if ec.Attribute == "" {
+			return fmt.Errorf("attribute is required for source %q", enrichmentSourceStatic)
+		}
+		if ec.File == "" && len(ec.Values) == 0 {
+			return fmt.Errorf("file or values is required for source %q", enrichmentSourceStatic)
+		}
+	default:
+		return fmt.Errorf("invalid source %q: must be %q or %q", ec.Source, enrichmentSourceGeoIP, enrichmentSourceStatic)
+	}
+	return nil
+}
+
+func (rc *ReplicationConfig) validate() error {
+	switch rc.Role {
+	case "":
+		return nil
+	case replicationRolePrimary, replicationRoleStandby:
+	default:
+		return fmt.Errorf("invalid replication role %q: must be %q or %q", rc.Role, replicationRolePrimary, replicationRoleStandby)
+	}
+	if rc.Role == replicationRoleStandby && rc.PrimaryEndpoint == "" {
+		return fmt.Errorf("replication.primary_endpoint is required for role %q", replicationRoleStandby)
+	}
+	if rc.ListenAddress == "" {
+		rc.ListenAddress = defaultReplicationListenAddress
+	}
+	if rc.SyncInterval <= 0 {
+		rc.SyncInterval = defaultReplicationSyncInterval
+	}
+	if rc.BatchSize <= 0 {
+		rc.BatchSize = defaultReplicationBatchSize
+	}
+	if rc.TLS.HasValue() {
+		if t := rc.TLS.Get(); (t.CertFile == "" && string(t.CertPem) == "") || (t.KeyFile == "" && string(t.KeyPem) == "") {
+			return fmt.Errorf("replication.tls requires cert_file and key_file")
+		}
+	}
 	return nil
 }
+
+// prometheusRoot is the metric root used to name /metrics counters: the
+// prefix and namespace, since the instance becomes a label.
+func (cfg *Config) prometheusRoot() string {
+	if cfg.Namespace != "" {
+		return cfg.Prefix + "." + cfg.Namespace
+	}
+	return cfg.Prefix
+}
+
+// latencyBudget returns the budget for a service/operation, preferring an
+// operation-specific budget over the service-wide one.
+func (cfg *Config) latencyBudget(service, operation string) (time.Duration, bool) {
+	var serviceBudget time.Duration
+	found := false
+	for _, b := range cfg.LatencyBudgets {
+		if b.Service != service {
+			continue
+		}
+		if b.Operation == operation {
+			return b.Budget, true
+		}
+		if b.Operation == "" {
+			serviceBudget = b.Budget
+			found = true
+		}
+	}
+	return serviceBudget, found
+}
@@ -0,0 +1,120 @@
+package sqliteexporter
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Column sets for CSV output. Dotted paths address nested JSON fields; the
+// header uses the path with dots replaced by underscores.
+var (
+	spanCSVColumns = []string{
+		"trace_id", "span_id", "parent_span_id", "service_name", "span_name", "kind",
+		"start_time_unix_nano", "end_time_unix_nano", "duration_ms", "status.code", "status.message",
+	}
+	exceptionCSVColumns = []string{
+		"timestamp", "trace_id", "span_id", "service_name", "span_name",
+		"exception_type", "message", "severity", "stack_trace",
+	}
+	traceCSVColumns = []string{
+		"trace_id", "service_name", "span_name", "start_time", "duration_ms", "duration_nanos", "status_code", "span_count",
+	}
+)
+
+// wantsCSV reports whether the client asked for CSV via ?format=csv or an
+// Accept header that lists text/csv.
+func wantsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.EqualFold(format, "csv")
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == "text/csv" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCSV renders rows as CSV with a header line. name is used for the
+// download filename.
+func (e *sqliteExporter) writeCSV(w http.ResponseWriter, name string, columns []string, rows []map[string]interface{}) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = strings.ReplaceAll(c, ".", "_")
+	}
+	cw.Write(header)
+
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, c := range columns {
+			record[i] = formatCSVValue(lookupPath(row, c))
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		e.writeError(w, "Failed to encode CSV", err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		e.logger.Debug("Failed to write CSV response", zap.Error(err))
+	}
+}
+
+// rawSpansToRows decodes stored span JSON for CSV output, keeping numbers as
+// json.Number so nanosecond timestamps are not rounded through float64.
+func rawSpansToRows(spans []json.RawMessage) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0, len(spans))
+	for _, raw := range spans {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		var row map[string]interface{}
+		if err := dec.Decode(&row); err != nil {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func lookupPath(row map[string]interface{}, path string) interface{} {
+	var cur interface{} = row
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[key]
+	}
+	return cur
+}
+
+func formatCSVValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(val)
+		return string(b)
+	default:
+		return fmt.Sprint(val)
+	}
+}
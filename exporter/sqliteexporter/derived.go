@@ -0,0 +1,639 @@
+package sqliteexporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// Derived metric aggregates
+const (
+	derivedCount = "count"
+	derivedSum   = "sum"
+	derivedAvg   = "avg"
+	derivedMin   = "min"
+	derivedMax   = "max"
+)
+
+// spanContext is the span a derived metric expression is evaluated against
+type spanContext struct {
+	span     ptrace.Span
+	resource pcommon.Resource
+}
+
+// spanPredicate and spanOperand are compiled derived metric expressions
+type (
+	spanPredicate func(spanContext) bool
+	spanOperand   func(spanContext) interface{}
+)
+
+// derivedMetric is a compiled DerivedMetricConfig
+type derivedMetric struct {
+	name      string
+	where     spanPredicate
+	groupBy   []string
+	aggregate string
+	value     spanOperand
+}
+
+func newDerivedMetrics(cfgs []DerivedMetricConfig) ([]*derivedMetric, error) {
+	metrics := make([]*derivedMetric, 0, len(cfgs))
+	for i, c := range cfgs {
+		m, err := compileDerivedMetric(c)
+		if err != nil {
+			return nil, fmt.Errorf("derived_metrics[%d]: %w", i, err)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+func compileDerivedMetric(c DerivedMetricConfig) (*derivedMetric, error) {
+	m := &derivedMetric{name: c.Name, groupBy: c.GroupBy, aggregate: c.Aggregate}
+	if c.Name == "" || sanitizeMetricName(c.Name) != c.Name {
+		return nil, fmt.Errorf("invalid name %q: must be a single metric path segment", c.Name)
+	}
+	if c.Where == "" {
+		m.where = func(spanContext) bool { return true }
+	} else {
+		where, err := parseSpanCondition(c.Where)
+		if err != nil {
+			return nil, fmt.Errorf("invalid where: %w", err)
+		}
+		m.where = where
+	}
+	switch c.Aggregate {
+	case derivedCount:
+	case derivedSum, derivedAvg, derivedMin, derivedMax:
+		if c.Value == "" {
+			return nil, fmt.Errorf("aggregate %q needs a value", c.Aggregate)
+		}
+		value, err := parseSpanOperand(c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %w", err)
+		}
+		m.value = value
+	default:
+		return nil, fmt.Errorf("invalid aggregate %q: must be count, sum, avg, min or max", c.Aggregate)
+	}
+	for _, key := range c.GroupBy {
+		if key == "" {
+			return nil, fmt.Errorf("empty group_by key")
+		}
+	}
+	return m, nil
+}
+
+// derivedAggregation accumulates one derived metric series within a batch
+type derivedAggregation struct {
+	metric    *derivedMetric
+	service   string
+	tenant    string
+	groups    []string
+	timestamp int64
+	count     int64
+	sum       float64
+	min       float64
+	max       float64
+}
+
+// derivedAggregator collects derived metrics for one pushTraces batch
+type derivedAggregator struct {
+	metrics   []*derivedMetric
+	series    map[string]*derivedAggregation
+	tagTenant func(tags map[string]string, tenant string)
+}
+
+func newDerivedAggregator(metrics []*derivedMetric, tagTenant func(map[string]string, string)) *derivedAggregator {
+	return &derivedAggregator{metrics: metrics, series: make(map[string]*derivedAggregation), tagTenant: tagTenant}
+}
+
+// observe adds a span to every derived metric whose condition it matches,
+// in the series stamped with timestamp
+func (a *derivedAggregator) observe(service, tenant string, timestamp int64, ctx spanContext) {
+	for _, m := range a.metrics {
+		if !m.where(ctx) {
+			continue
+		}
+		var value float64
+		if m.value != nil {
+			v, ok := toFloat(m.value(ctx))
+			if !ok {
+				continue
+			}
+			value = v
+		}
+
+		groups := make([]string, len(m.groupBy))
+		for i, key := range m.groupBy {
+			groups[i] = lookupSpanAttribute(ctx, key)
+		}
+		key := m.name + "\x00" + service + "\x00" + tenant + "\x00" + strconv.FormatInt(timestamp, 10) + "\x00" + strings.Join(groups, "\x00")
+		agg, ok := a.series[key]
+		if !ok {
+			agg = &derivedAggregation{metric: m, service: service, tenant: tenant, groups: groups, timestamp: timestamp, min: value, max: value}
+			a.series[key] = agg
+		}
+		agg.count++
+		agg.sum += value
+		agg.min = math.Min(agg.min, value)
+		agg.max = math.Max(agg.max, value)
+	}
+}
+
+// records returns one metric row per series, named
+// <root>.<service>.<name>[.<key>-<value>...] like OTLP metric data points.
+func (a *derivedAggregator) records(root, instance string) []tracestore.MetricRecord {
+	keys := make([]string, 0, len(a.series))
+	for key := range a.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([]tracestore.MetricRecord, 0, len(keys))
+	for _, key := range keys {
+		agg := a.series[key]
+		m := agg.metric
+		name := strings.Join([]string{root, sanitizeMetricName(agg.service), m.name}, ".")
+		tags := map[string]string{"service": agg.service, "metric": m.name}
+		if instance != "" {
+			tags["instance"] = instance
+		}
+		for i, k := range m.groupBy {
+			name += "." + sanitizeMetricName(k) + "-" + sanitizeMetricName(agg.groups[i])
+			tags[k] = agg.groups[i]
+		}
+		a.tagTenant(tags, agg.tenant)
+		tagsJSON, err := json.Marshal(tags)
+		if err != nil {
+			tagsJSON = []byte("{}")
+		}
+
+		var value float64
+		switch m.aggregate {
+		case derivedCount:
+			value = float64(agg.count)
+		case derivedSum:
+			value = agg.sum
+		case derivedAvg:
+			value = agg.sum / float64(agg.count)
+		case derivedMin:
+			value = agg.min
+		case derivedMax:
+			value = agg.max
+		}
+		records = append(records, tracestore.MetricRecord{Name: name, Value: value, Timestamp: agg.timestamp, Tags: string(tagsJSON)})
+	}
+	return records
+}
+
+// lookupSpanAttribute returns a span attribute, falling back to the resource
+// attribute, as a string ("" when missing)
+func lookupSpanAttribute(ctx spanContext, key string) string {
+	if v, ok := ctx.span.Attributes().Get(key); ok {
+		return v.AsString()
+	}
+	if v, ok := ctx.resource.Attributes().Get(key); ok {
+		return v.AsString()
+	}
+	return ""
+}
+
+// parseSpanCondition compiles an OTTL-style condition on a span. Supported:
+//
+//   - paths name, kind (lowercase, e.g. "server"), status ("ok", "error",
+//     "unset"), duration_ms, service, attributes["key"] and
+//     resource.attributes["key"]
+//   - comparisons == != < <= > >= between paths and string, number, bool or
+//     nil literals (nil matches a missing attribute)
+//   - IsMatch(path, "regex"), which matches anywhere in the value
+//   - and, or, not and parentheses
+func parseSpanCondition(expr string) (spanPredicate, error) {
+	tokens, err := lexSpanExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &spanExprParser{tokens: tokens}
+	pred, err := p.orExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != sxEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return pred, nil
+}
+
+// parseSpanOperand compiles a single path or literal
+func parseSpanOperand(expr string) (spanOperand, error) {
+	tokens, err := lexSpanExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &spanExprParser{tokens: tokens}
+	operand, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != sxEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return operand, nil
+}
+
+type spanExprTokenKind int
+
+const (
+	sxEOF spanExprTokenKind = iota
+	sxPunct
+	sxIdent
+	sxString
+	sxNumber
+)
+
+type spanExprToken struct {
+	kind spanExprTokenKind
+	text string
+	pos  int
+}
+
+// spanExprPunct lists operators and delimiters, longest first
+var spanExprPunct = []string{"==", "!=", ">=", "<=", ">", "<", "(", ")", "[", "]", ","}
+
+func lexSpanExpr(expr string) ([]spanExprToken, error) {
+	var tokens []spanExprToken
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			value, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %w", i, err)
+			}
+			tokens = append(tokens, spanExprToken{kind: sxString, text: value, pos: i})
+			i = end + 1
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(expr) && (expr[end] == '.' || expr[end] == 'e' || (expr[end] >= '0' && expr[end] <= '9')) {
+				end++
+			}
+			tokens = append(tokens, spanExprToken{kind: sxNumber, text: expr[i:end], pos: i})
+			i = end
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i + 1
+			for end < len(expr) && (expr[end] == '_' || expr[end] == '.' || unicode.IsLetter(rune(expr[end])) || (expr[end] >= '0' && expr[end] <= '9')) {
+				end++
+			}
+			tokens = append(tokens, spanExprToken{kind: sxIdent, text: expr[i:end], pos: i})
+			i = end
+		default:
+			matched := false
+			for _, p := range spanExprPunct {
+				if strings.HasPrefix(expr[i:], p) {
+					tokens = append(tokens, spanExprToken{kind: sxPunct, text: p, pos: i})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(tokens, spanExprToken{kind: sxEOF, pos: len(expr)}), nil
+}
+
+type spanExprParser struct {
+	tokens []spanExprToken
+	pos    int
+}
+
+func (p *spanExprParser) peek() spanExprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *spanExprParser) next() spanExprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != sxEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is the punctuation or keyword text
+func (p *spanExprParser) accept(text string) bool {
+	if tok := p.peek(); (tok.kind == sxPunct || tok.kind == sxIdent) && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *spanExprParser) expect(text string) error {
+	if p.accept(text) {
+		return nil
+	}
+	tok := p.peek()
+	if tok.kind == sxEOF {
+		return fmt.Errorf("expected %q at end of expression", text)
+	}
+	return fmt.Errorf("expected %q at offset %d, got %q", text, tok.pos, tok.text)
+}
+
+// orExpr := andExpr ('or' andExpr)*
+func (p *spanExprParser) orExpr() (spanPredicate, error) {
+	left, err := p.andExpr()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.andExpr()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(ctx spanContext) bool { return l(ctx) || right(ctx) }
+	}
+	return left, nil
+}
+
+// andExpr := notExpr ('and' notExpr)*
+func (p *spanExprParser) andExpr() (spanPredicate, error) {
+	left, err := p.notExpr()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.notExpr()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(ctx spanContext) bool { return l(ctx) && right(ctx) }
+	}
+	return left, nil
+}
+
+// notExpr := 'not' notExpr | '(' orExpr ')' | 'IsMatch' '(' operand ',' string ')' | comparison
+func (p *spanExprParser) notExpr() (spanPredicate, error) {
+	if p.accept("not") {
+		inner, err := p.notExpr()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx spanContext) bool { return !inner(ctx) }, nil
+	}
+	if p.accept("(") {
+		inner, err := p.orExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	if p.accept("IsMatch") {
+		return p.isMatch()
+	}
+	return p.comparison()
+}
+
+func (p *spanExprParser) isMatch() (spanPredicate, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	target, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	tok := p.next()
+	if tok.kind != sxString {
+		return nil, fmt.Errorf("IsMatch needs a string pattern at offset %d", tok.pos)
+	}
+	re, err := regexp.Compile(tok.text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %q: %w", tok.text, err)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return func(ctx spanContext) bool {
+		switch v := target(ctx).(type) {
+		case nil:
+			return false
+		case string:
+			return re.MatchString(v)
+		default:
+			return re.MatchString(fmt.Sprint(v))
+		}
+	}, nil
+}
+
+// comparison := operand op operand
+func (p *spanExprParser) comparison() (spanPredicate, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op.kind != sxPunct {
+		return nil, fmt.Errorf("expected comparison operator at offset %d, got %q", op.pos, op.text)
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch op.text {
+	case "==":
+		return func(ctx spanContext) bool { return compareValues(left(ctx), right(ctx)) == 0 }, nil
+	case "!=":
+		return func(ctx spanContext) bool { return compareValues(left(ctx), right(ctx)) != 0 }, nil
+	case "<":
+		return func(ctx spanContext) bool { return compareValues(left(ctx), right(ctx)) == -1 }, nil
+	case "<=":
+		return func(ctx spanContext) bool { c := compareValues(left(ctx), right(ctx)); return c == -1 || c == 0 }, nil
+	case ">":
+		return func(ctx spanContext) bool { return compareValues(left(ctx), right(ctx)) == 1 }, nil
+	case ">=":
+		return func(ctx spanContext) bool { c := compareValues(left(ctx), right(ctx)); return c == 1 || c == 0 }, nil
+	default:
+		return nil, fmt.Errorf("unsupported operator %q at offset %d", op.text, op.pos)
+	}
+}
+
+// operand := path | string | number | true | false | nil
+func (p *spanExprParser) operand() (spanOperand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case sxString:
+		value := tok.text
+		return func(spanContext) interface{} { return value }, nil
+	case sxNumber:
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", tok.text, tok.pos)
+		}
+		return func(spanContext) interface{} { return value }, nil
+	case sxIdent:
+		switch tok.text {
+		case "true", "false":
+			value := tok.text == "true"
+			return func(spanContext) interface{} { return value }, nil
+		case "nil":
+			return func(spanContext) interface{} { return nil }, nil
+		case "attributes", "resource.attributes":
+			key, err := p.attributeKey()
+			if err != nil {
+				return nil, err
+			}
+			if tok.text == "attributes" {
+				return func(ctx spanContext) interface{} { return attributeValue(ctx.span.Attributes(), key) }, nil
+			}
+			return func(ctx spanContext) interface{} { return attributeValue(ctx.resource.Attributes(), key) }, nil
+		}
+		if field, ok := spanFields[tok.text]; ok {
+			return field, nil
+		}
+		return nil, fmt.Errorf("unknown path %q at offset %d", tok.text, tok.pos)
+	case sxEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+}
+
+// attributeKey parses ["key"]
+func (p *spanExprParser) attributeKey() (string, error) {
+	if err := p.expect("["); err != nil {
+		return "", err
+	}
+	tok := p.next()
+	if tok.kind != sxString {
+		return "", fmt.Errorf("expected attribute key string at offset %d", tok.pos)
+	}
+	if err := p.expect("]"); err != nil {
+		return "", err
+	}
+	return tok.text, nil
+}
+
+// spanFields are the span paths besides attributes
+var spanFields = map[string]spanOperand{
+	"name": func(ctx spanContext) interface{} { return ctx.span.Name() },
+	"kind": func(ctx spanContext) interface{} {
+		return strings.ToLower(strings.TrimPrefix(ctx.span.Kind().String(), "SPAN_KIND_"))
+	},
+	"status": func(ctx spanContext) interface{} {
+		return strings.ToLower(ctx.span.Status().Code().String())
+	},
+	"duration_ms": func(ctx spanContext) interface{} {
+		return float64(ctx.span.EndTimestamp().AsTime().Sub(ctx.span.StartTimestamp().AsTime()).Nanoseconds()) / 1e6
+	},
+	"service": func(ctx spanContext) interface{} {
+		if v, ok := ctx.resource.Attributes().Get("service.name"); ok {
+			return v.AsString()
+		}
+		return nil
+	},
+}
+
+// attributeValue returns the attribute as a string, float64 or bool, or nil
+// when missing
+func attributeValue(attrs pcommon.Map, key string) interface{} {
+	v, ok := attrs.Get(key)
+	if !ok {
+		return nil
+	}
+	switch v.Type() {
+	case pcommon.ValueTypeInt:
+		return float64(v.Int())
+	case pcommon.ValueTypeDouble:
+		return v.Double()
+	case pcommon.ValueTypeBool:
+		return v.Bool()
+	default:
+		return v.AsString()
+	}
+}
+
+// compareValues orders two operands: -1, 0 or 1, or 2 when they are not
+// comparable (different types, or nil against a value)
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		}
+		return 2
+	}
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		if !ok {
+			return 2
+		}
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		default:
+			return 0
+		}
+	}
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 2
+		}
+		return strings.Compare(av, bv)
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return 2
+		}
+		if av == bv {
+			return 0
+		}
+		return 2
+	}
+	return 2
+}
+
+// toFloat converts numeric operands; numeric strings are not converted
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,170 @@
+package sqliteexporter
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/collector/exporter/exporterhelper"
+	"go.uber.org/zap"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// errDiskFull is returned (wrapped as a throttle-retry error) while batches
+// are refused because the disk holding the database is full.
+var errDiskFull = errors.New("sqlite disk full, retry later")
+
+// diskFullGuard pauses ingest after a write fails on a full disk. Batches are
+// refused until the retry interval has passed; the first batch after it is
+// written as a probe, and ingest resumes once a write succeeds.
+type diskFullGuard struct {
+	retryInterval time.Duration
+	now           func() time.Time
+	cleaning      atomic.Bool // an emergency cleanup is running
+
+	mu        sync.Mutex
+	since     time.Time // zero while writes succeed
+	until     time.Time
+	lastError string
+	refused   int64
+}
+
+// diskFullStatus is the guard's state as reported by /api/status
+type diskFullStatus struct {
+	Since          time.Time `json:"since"`
+	RetryAt        time.Time `json:"retry_at"`
+	LastError      string    `json:"last_error"`
+	BatchesRefused int64     `json:"batches_refused"`
+}
+
+func newDiskFullGuard(cfg DiskFullConfig) *diskFullGuard {
+	return &diskFullGuard{retryInterval: cfg.RetryInterval, now: time.Now}
+}
+
+// check returns a retryable error asking the sender to wait out the rest of
+// the retry interval, or nil when writes are allowed. A nil guard never
+// refuses.
+func (g *diskFullGuard) check() error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if remaining := g.until.Sub(g.now()); remaining > 0 {
+		g.refused++
+		return exporterhelper.NewThrottleRetry(errDiskFull, remaining)
+	}
+	return nil
+}
+
+// failed records a write that failed on a full disk. It reports whether
+// this started the pause, rather than extending one.
+func (g *diskFullGuard) failed(err error) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	started := g.since.IsZero()
+	if started {
+		g.since = g.now()
+	}
+	g.until = g.now().Add(g.retryInterval)
+	g.lastError = err.Error()
+	return started
+}
+
+// succeeded records a successful write, returning how long the pause lasted
+// when this ended one.
+func (g *diskFullGuard) succeeded() (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.since.IsZero() {
+		return 0, false
+	}
+	paused := g.now().Sub(g.since)
+	g.since, g.until, g.lastError, g.refused = time.Time{}, time.Time{}, "", 0
+	return paused, true
+}
+
+// status returns the guard's state, or nil while writes succeed
+func (g *diskFullGuard) status() *diskFullStatus {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.since.IsZero() {
+		return nil
+	}
+	return &diskFullStatus{Since: g.since, RetryAt: g.until, LastError: g.lastError, BatchesRefused: g.refused}
+}
+
+// admit returns the retryable error refusing a batch while the disk is full
+// or writes are slow, or nil when it may be written
+func (e *sqliteExporter) admit() error {
+	if err := e.diskFull.check(); err != nil {
+		return err
+	}
+	return e.throttle.check()
+}
+
+// writeFailed turns a failed store write into the error returned to the
+// collector. A full disk pauses ingest and is returned as retryable, so the
+// batch stays queued instead of being dropped; it is logged once per pause
+// rather than per batch.
+func (e *sqliteExporter) writeFailed(err error) error {
+	if !tracestore.IsDiskFull(err) {
+		return err
+	}
+	if e.diskFull.failed(err) {
+		e.logger.Error("Disk full, refusing batches until a write succeeds",
+			zap.Duration("retry_interval", e.config.DiskFull.RetryInterval),
+			zap.Error(err))
+		if e.config.DiskFull.EmergencyCleanupPercent > 0 && e.diskFull.cleaning.CompareAndSwap(false, true) {
+			e.wg.Add(1)
+			go e.emergencyCleanup()
+		}
+	} else {
+		e.logger.Debug("Disk still full", zap.Error(err))
+	}
+	return exporterhelper.NewThrottleRetry(errDiskFull, e.config.DiskFull.RetryInterval)
+}
+
+// writeSucceeded ends a disk-full pause after a successful write
+func (e *sqliteExporter) writeSucceeded() {
+	if paused, ok := e.diskFull.succeeded(); ok {
+		e.logger.Info("Disk space available again, resuming ingest", zap.Duration("paused", paused))
+	}
+}
+
+// emergencyCleanup deletes the oldest data until emergency_cleanup_percent
+// of the space in use is freed, and truncates the WAL
+func (e *sqliteExporter) emergencyCleanup() {
+	defer e.wg.Done()
+	defer e.diskFull.cleaning.Store(false)
+
+	used, _, err := e.store.UsedBytes(e.cleanupCtx)
+	if err != nil {
+		e.logger.Warn("Emergency cleanup failed", zap.Error(err))
+		return
+	}
+	target := used * int64(100-e.config.DiskFull.EmergencyCleanupPercent) / 100
+	result, err := e.store.EnforceSizeLimit(e.cleanupCtx, target, target)
+	if err != nil {
+		if e.cleanupCtx.Err() == nil {
+			e.logger.Warn("Emergency cleanup failed", zap.Error(err))
+		}
+		return
+	}
+	if _, err := e.store.CheckpointWAL(e.cleanupCtx, 0); err != nil && e.cleanupCtx.Err() == nil {
+		e.logger.Warn("Emergency WAL checkpoint failed", zap.Error(err))
+	}
+	if result != nil {
+		e.logger.Warn("Disk full, deleted oldest data",
+			zap.Int64("used_bytes_before", result.UsedBytesBefore),
+			zap.Int64("used_bytes_after", result.UsedBytesAfter),
+			zap.Int64("file_bytes_after", result.FileBytesAfter),
+			zap.Int64("spans_deleted", result.SpansDeleted),
+			zap.Int64("metrics_deleted", result.MetricsDeleted))
+	}
+}
@@ -0,0 +1,193 @@
+package sqliteexporter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	enrichmentSourceGeoIP  = "geoip"
+	enrichmentSourceStatic = "static"
+
+	defaultGeoIPAttribute = "client.address"
+	defaultGeoIPPrefix    = "geo."
+)
+
+// spanEnricher adds attributes looked up from the value of one span or
+// resource attribute.
+type spanEnricher struct {
+	attribute string
+	prefix    string
+	lookup    func(value string) map[string]string
+}
+
+// newSpanEnrichers loads the lookup tables for the configured sources
+func newSpanEnrichers(cfgs []EnrichmentConfig) ([]spanEnricher, error) {
+	enrichers := make([]spanEnricher, 0, len(cfgs))
+	for i, c := range cfgs {
+		var lookup func(string) map[string]string
+		switch c.Source {
+		case enrichmentSourceGeoIP:
+			table, err := loadGeoIPTable(c.File)
+			if err != nil {
+				return nil, fmt.Errorf("enrichment[%d]: %w", i, err)
+			}
+			lookup = table.lookup
+		case enrichmentSourceStatic:
+			table := c.Values
+			if c.File != "" {
+				loaded, err := loadStaticTable(c.File)
+				if err != nil {
+					return nil, fmt.Errorf("enrichment[%d]: %w", i, err)
+				}
+				// Inline values take precedence over the file.
+				for k, v := range table {
+					loaded[k] = v
+				}
+				table = loaded
+			}
+			lookup = func(value string) map[string]string { return table[value] }
+		}
+		enrichers = append(enrichers, spanEnricher{attribute: c.Attribute, prefix: c.Prefix, lookup: lookup})
+	}
+	return enrichers, nil
+}
+
+// enrichAttributes adds looked-up attributes to spanAttrs. The lookup key is
+// read from the span attributes first, then the resource attributes.
+// Existing attributes are never overwritten.
+func enrichAttributes(enrichers []spanEnricher, spanAttrs, resourceAttrs map[string]interface{}) {
+	for _, en := range enrichers {
+		raw, ok := spanAttrs[en.attribute]
+		if !ok {
+			if raw, ok = resourceAttrs[en.attribute]; !ok {
+				continue
+			}
+		}
+		value, ok := raw.(string)
+		if !ok {
+			value = fmt.Sprint(raw)
+		}
+		for k, v := range en.lookup(value) {
+			key := en.prefix + k
+			if _, exists := spanAttrs[key]; !exists {
+				spanAttrs[key] = v
+			}
+		}
+	}
+}
+
+// geoIPTable maps networks to attributes, most specific network first.
+type geoIPTable struct {
+	networks []netip.Prefix
+	attrs    []map[string]string
+}
+
+// loadGeoIPTable reads a CSV whose header is "network,<attr>,<attr>..." and
+// whose rows hold a CIDR followed by the attribute values, e.g.
+//
+//	network,country_iso_code,city_name
+//	10.1.0.0/16,PT,Lisbon
+func loadGeoIPTable(path string) (*geoIPTable, error) {
+	header, rows, err := readLookupCSV(path)
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		network netip.Prefix
+		attrs   map[string]string
+	}
+	entries := make([]entry, 0, len(rows))
+	for i, row := range rows {
+		network, err := netip.ParsePrefix(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, i+2, err)
+		}
+		entries = append(entries, entry{network.Masked(), rowAttributes(header, row)})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].network.Bits() > entries[j].network.Bits() })
+
+	table := &geoIPTable{}
+	for _, e := range entries {
+		table.networks = append(table.networks, e.network)
+		table.attrs = append(table.attrs, e.attrs)
+	}
+	return table, nil
+}
+
+// lookup accepts a bare IP or host:port and returns the attributes of the
+// most specific matching network.
+func (t *geoIPTable) lookup(value string) map[string]string {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	for i, network := range t.networks {
+		if network.Contains(addr) {
+			return t.attrs[i]
+		}
+	}
+	return nil
+}
+
+// loadStaticTable reads a CSV whose header is "key,<attr>,<attr>..." into an
+// exact-match lookup table.
+func loadStaticTable(path string) (map[string]map[string]string, error) {
+	header, rows, err := readLookupCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	table := make(map[string]map[string]string, len(rows))
+	for _, row := range rows {
+		table[row[0]] = rowAttributes(header, row)
+	}
+	return table, nil
+}
+
+func readLookupCSV(path string) ([]string, [][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("%s is empty", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(header) < 2 {
+		return nil, nil, fmt.Errorf("%s: header needs a key column and at least one attribute", path)
+	}
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return header, rows, nil
+}
+
+// rowAttributes pairs header names with row values, skipping empty cells.
+func rowAttributes(header, row []string) map[string]string {
+	attrs := make(map[string]string, len(header)-1)
+	for i := 1; i < len(header) && i < len(row); i++ {
+		if v := strings.TrimSpace(row[i]); v != "" {
+			attrs[strings.TrimSpace(header[i])] = v
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,70 @@
+package sqliteexporter
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// renderExemplarLimit caps the exemplars read for one /render series query
+const renderExemplarLimit = 10000
+
+// renderExemplar links a point of a /render series to a trace: the slowest
+// span's trace for duration_ms points
+type renderExemplar struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+	TraceID   string  `json:"trace_id"`
+}
+
+// renderExemplars returns the exemplars of the raw points whose names match
+// a /render path, as queryMetricSeries matches it, grouped by metric name.
+// It returns nil unless sq asks for exemplars.
+func (e *sqliteExporter) renderExemplars(ctx context.Context, path string, sq seriesQuery) (map[string][]renderExemplar, error) {
+	if !sq.exemplars {
+		return nil, nil
+	}
+	namePattern := strings.Contains(path, "*") || strings.Contains(path, "?")
+	name := path
+	if namePattern {
+		name = graphiteToLikePattern(path)
+	}
+	records, err := e.queryExemplars(ctx, name, namePattern, sq)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]renderExemplar)
+	for _, m := range records {
+		out[m.Name] = append(out[m.Name], renderExemplar{Timestamp: m.Timestamp, Value: m.Value, TraceID: m.ExemplarTraceID})
+	}
+	return out, nil
+}
+
+// taggedExemplars returns the exemplars of one metric name for
+// seriesByTag, grouped by the raw tags of their series
+func (e *sqliteExporter) taggedExemplars(ctx context.Context, name string, sq seriesQuery) (map[string][]renderExemplar, error) {
+	if !sq.exemplars {
+		return nil, nil
+	}
+	records, err := e.queryExemplars(ctx, name, false, sq)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]renderExemplar)
+	for _, m := range records {
+		out[m.Tags] = append(out[m.Tags], renderExemplar{Timestamp: m.Timestamp, Value: m.Value, TraceID: m.ExemplarTraceID})
+	}
+	return out, nil
+}
+
+func (e *sqliteExporter) queryExemplars(ctx context.Context, name string, namePattern bool, sq seriesQuery) ([]tracestore.MetricRecord, error) {
+	return e.store.QueryMetricExemplars(ctx, tracestore.MetricQueryOptions{
+		Name:        name,
+		NamePattern: namePattern,
+		Service:     sq.service,
+		MinTime:     sq.tr.startSeconds(),
+		MaxTime:     sq.tr.endSeconds(),
+		Limit:       renderExemplarLimit,
+	})
+}
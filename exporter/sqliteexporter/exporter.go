@@ -2,37 +2,127 @@ package sqliteexporter
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer/consumererror"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 
-	"github.com/gotel/storage/sqlite"
+	"github.com/gotel/pkg/tracestore"
 )
 
 // sqliteExporter exports traces to SQLite and serves query API
 type sqliteExporter struct {
-	config     *Config
-	logger     *zap.Logger
-	store      *sqlite.Store
-	server     *http.Server
-	cleanupCtx context.Context
-	cancelFunc context.CancelFunc
-	wg         sync.WaitGroup
+	config        *Config
+	logger        *zap.Logger
+	store         *tracestore.Store
+	server        *http.Server
+	queryGRPC     *grpc.Server // set when streaming_query is enabled
+	queryMetrics  *queryServerMetrics
+	enrichers     []spanEnricher
+	filter        *spanFilter
+	pathTemplate  metricPathTemplate // set when path_template is
+	throttle      *writeThrottle
+	diskFull      *diskFullGuard
+	slowIngest    *slowIngestLog
+	shed          *shedCounters
+	spanMetrics   *spanMetricsCollector
+	derived       []*derivedMetric
+	catalog       *serviceCatalog
+	replication   *replicator
+	incidents     *tracestore.Store
+	dryRun        *dryRunVolume // set in dry_run mode
+	ingest        ingestCounters
+	hooks         []namedIngestHook
+	pendingTraces *pendingTraces // set when hooks are registered
+	anonymizer    *anonymizer
+	livePush      *livePusher // set when live_push.endpoint is
+	bus           *ingestBus
+	cleanupCtx    context.Context
+	cancelFunc    context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// spanMetricsSample is one aggregation waiting for the batch to be stored
+// before it is added to the /metrics counters.
+type spanMetricsSample struct {
+	tags map[string]string
+	agg  *spanAggregation
 }
 
 type spanAggregation struct {
 	rawSpanName   string
+	timestamp     int64             // unix seconds the metric points are stamped with
+	attributeTags map[string]string // tag_attributes values
 	count         int64
 	totalDuration float64
 	errorCount    int64
+	// exceptionCount counts exception events, which SDKs also record for
+	// handled exceptions on spans that end OK
+	exceptionCount int64
+	overBudget     int64
+	durations      []float64 // only kept when percentiles are configured
+	// slowest is the longest duration seen and slowestTraceID its trace,
+	// stored as the exemplar of the duration points
+	slowest        float64
+	slowestTraceID string
+}
+
+const (
+	metricTimestampExport  = "export"
+	metricTimestampSpanEnd = "span_end"
+)
+
+// spanAggKey identifies a span aggregation within a batch
+type spanAggKey struct {
+	spanName   string // sanitized
+	timestamp  int64
+	attributes string // tag_attributes values, NUL-separated
+}
+
+// reservedMetricTags are the tags span metrics set themselves, which
+// tag_attributes cannot override
+var reservedMetricTags = map[string]bool{"service": true, "span": true, "instance": true, "tenant": true}
+
+// spanTagAttributes returns the tag_attributes values of a span as tags and
+// as the key splitting its aggregation. Attributes the span lacks are left
+// out, so its points share the series of spans without tag_attributes.
+func (e *sqliteExporter) spanTagAttributes(span ptrace.Span) (map[string]string, string) {
+	if len(e.config.TagAttributes) == 0 {
+		return nil, ""
+	}
+	tags := make(map[string]string, len(e.config.TagAttributes))
+	var key strings.Builder
+	for _, name := range e.config.TagAttributes {
+		if v, ok := span.Attributes().Get(name); ok {
+			tags[name] = v.AsString()
+			key.WriteString(tags[name])
+		}
+		key.WriteByte(0)
+	}
+	return tags, key.String()
+}
+
+// metricTimestamp is the unix second a span's metrics are stamped with: the
+// batch's export time, or with metric_timestamp: span_end the span's end
+// time, so delayed batches and replays land where the spans happened
+func (e *sqliteExporter) metricTimestamp(span ptrace.Span, exportTime int64) int64 {
+	if e.config.MetricTimestamp != metricTimestampSpanEnd || span.EndTimestamp() == 0 {
+		return exportTime
+	}
+	return span.EndTimestamp().AsTime().Unix()
 }
 
 // newSQLiteExporter creates a new SQLite exporter
@@ -44,29 +134,216 @@ func newSQLiteExporter(config *Config, logger *zap.Logger) (*sqliteExporter, err
 		return nil, err
 	}
 
-	return &sqliteExporter{
-		config: config,
-		logger: logger,
-	}, nil
+	derived, err := newDerivedMetrics(config.DerivedMetrics)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newSpanFilter(config.Include, config.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	pathTemplate, err := compileMetricPathTemplate(config.PathTemplate)
+	if err != nil {
+		return nil, err
+	}
+	anon, err := newAnonymizer(config.Anonymize, config.Tenancy)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &sqliteExporter{
+		config:       config,
+		logger:       logger,
+		queryMetrics: newQueryServerMetrics(),
+		throttle:     newWriteThrottle(config.Backpressure),
+		diskFull:     newDiskFullGuard(config.DiskFull),
+		slowIngest:   newSlowIngestLog(config.SlowIngest),
+		shed:         newShedCounters(config),
+		spanMetrics:  newSpanMetricsCollector(config.prometheusRoot(), config.Prometheus.Labels),
+		derived:      derived,
+		filter:       filter,
+		pathTemplate: pathTemplate,
+		catalog:      newServiceCatalog(),
+		hooks:        registeredIngestHooks(),
+		anonymizer:   anon,
+	}
+	if len(e.hooks) > 0 {
+		e.pendingTraces = newPendingTraces(config.Hooks.MaxPendingTraces)
+	}
+	if config.DryRun {
+		e.dryRun = &dryRunVolume{}
+		e.queryMetrics.registry.MustRegister(e.dryRun.collectors()...)
+	}
+	if config.LivePush.Endpoint != "" {
+		e.livePush = newLivePusher(config.LivePush)
+	}
+	e.bus = e.newIngestBus()
+	e.queryMetrics.registry.MustRegister(e.bus.collectors()...)
+	return e, nil
 }
 
 // start initializes the SQLite store and HTTP server
 func (e *sqliteExporter) start(ctx context.Context, host component.Host) error {
-	store, err := sqlite.New(e.config.DBPath)
+	enrichers, err := newSpanEnrichers(e.config.Enrichment)
+	if err != nil {
+		return err
+	}
+	e.enrichers = enrichers
+
+	// Certificates are loaded before the store is opened, so a bad path fails
+	// start without leaving anything running
+	var tlsConfig *tls.Config
+	if e.config.QueryPort > 0 && e.config.TLS.HasValue() {
+		if tlsConfig, err = e.config.TLS.Get().LoadTLSConfig(ctx); err != nil {
+			return fmt.Errorf("failed to load query server TLS config: %w", err)
+		}
+	}
+
+	attached := make([]tracestore.AttachedDatabase, len(e.config.Attach))
+	for i, a := range e.config.Attach {
+		attached[i] = tracestore.AttachedDatabase{Name: a.Name, Path: a.Path}
+	}
+	store, err := tracestore.NewWithAttached(e.config.DBPath, attached)
 	if err != nil {
 		return fmt.Errorf("failed to open SQLite database at %s: %w", e.config.DBPath, err)
 	}
+	store.SetSpanDecoder(decodeSpanPayload)
+	store.SetSpanUpgrader(upgradeSpanDocument)
+	if e.config.WriteBatch.Enabled {
+		store.SetWriteBatching(tracestore.WriteBatchConfig{
+			FlushInterval: e.config.WriteBatch.FlushInterval,
+			MaxRows:       e.config.WriteBatch.MaxRows,
+		})
+	}
+	// Backfills keys added since the last start, so it may take a while on
+	// a large database.
+	if err := store.SetIndexedAttributes(ctx, e.config.IndexedAttributes); err != nil {
+		store.Close()
+		return fmt.Errorf("failed to build attribute index: %w", err)
+	}
 	e.store = store
 
 	e.logger.Info("SQLite store opened",
 		zap.String("db_path", e.config.DBPath),
-		zap.Duration("retention", e.config.Retention))
+		zap.String("storage_format", e.config.StorageFormat),
+		zap.Duration("trace_retention", e.config.TraceRetention),
+		zap.Duration("metric_retention", e.config.MetricRetention),
+		zap.Int("attached", len(attached)))
+	if e.dryRun != nil {
+		e.logger.Warn("dry_run is set: spans, metrics and logs are counted but not stored")
+	}
+
+	// Warm the service catalog so the first dashboard load is served from memory
+	if err := e.catalog.refresh(ctx, store.ListServiceOperations); err != nil {
+		e.logger.Warn("Failed to load service catalog", zap.Error(err))
+	}
+
+	if e.config.FileIngest.Directory != "" {
+		if err := e.prepareFileIngest(); err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	if e.config.Incidents.DBPath != "" {
+		if e.incidents, err = tracestore.OpenIncidents(e.config.Incidents.DBPath); err != nil {
+			store.Close()
+			return fmt.Errorf("failed to open incidents database at %s: %w", e.config.Incidents.DBPath, err)
+		}
+	}
+
+	// Start replication before serving queries so a standby never accepts writes
+	if e.config.Replication.Role != "" {
+		e.replication = newReplicator(e.config.Replication, store, e.logger)
+		if err := e.replication.start(); err != nil {
+			if e.incidents != nil {
+				e.incidents.Close()
+			}
+			store.Close()
+			return err
+		}
+	}
 
 	// Start cleanup goroutine
 	e.cleanupCtx, e.cancelFunc = context.WithCancel(context.Background())
 	e.wg.Add(1)
 	go e.runCleanup()
 
+	if e.config.FileIngest.Directory != "" {
+		e.wg.Add(1)
+		go e.runFileIngest()
+	}
+
+	e.wg.Add(1)
+	go e.runCatalogRefresh()
+
+	if e.config.ServiceGraph.Interval > 0 {
+		e.wg.Add(1)
+		go e.runSpanJoin("service graph", e.config.ServiceGraph, e.store.BuildServiceEdges)
+	}
+	if e.config.SelfTime.Interval > 0 {
+		e.wg.Add(1)
+		go e.runSpanJoin("self-time", e.config.SelfTime, e.store.UpdateSelfTimes)
+	}
+
+	if e.config.WALCheckpoint.Interval > 0 {
+		e.wg.Add(1)
+		go e.runWALCheckpoint()
+	}
+
+	if e.config.MaxDBSizeMiB > 0 {
+		e.wg.Add(1)
+		go e.runSizeLimit()
+	}
+
+	if e.config.Rollup.Interval > 0 {
+		e.wg.Add(1)
+		go e.runRollup()
+	}
+
+	if e.config.TraceCompaction.Interval > 0 {
+		e.wg.Add(1)
+		go e.runTraceCompaction()
+	}
+
+	if len(e.hooks) > 0 {
+		names := make([]string, len(e.hooks))
+		for i, h := range e.hooks {
+			names[i] = h.name
+		}
+		e.logger.Info("Ingest hooks registered", zap.Strings("hooks", names))
+
+		// Completed traces are read back from the store, so need stored spans
+		if e.config.StoreTraces && e.dryRun == nil {
+			e.wg.Add(1)
+			go e.runTraceHooks()
+		}
+	}
+
+	// dry_run writes nothing, its own metrics included
+	if e.config.SelfMetrics.Interval > 0 && e.dryRun == nil {
+		e.wg.Add(1)
+		go e.runSelfMetrics()
+	}
+
+	if e.incidents != nil {
+		e.wg.Add(1)
+		go e.runIncidents()
+	}
+
+	e.bus.start()
+
+	if e.config.MigrateStorageFormat {
+		e.wg.Add(1)
+		go e.runStorageMigration()
+	}
+
+	// Rewrites span documents from older versions; dry_run leaves them be
+	if e.dryRun == nil {
+		e.wg.Add(1)
+		go e.runSpanUpgrade()
+	}
+
 	// Start query HTTP server if port configured
 	if e.config.QueryPort > 0 {
 		e.server = &http.Server{
@@ -76,6 +353,10 @@ func (e *sqliteExporter) start(ctx context.Context, host component.Host) error {
 			WriteTimeout:      60 * time.Second,
 			MaxHeaderBytes:    1 << 20, // 1 MB
 		}
+		e.server.TLSConfig = tlsConfig
+		if e.config.StreamingQuery.Enabled {
+			e.queryGRPC = newStreamingQueryServer(e)
+		}
 		e.wg.Add(1)
 		go e.startQueryServer()
 	}
@@ -89,11 +370,26 @@ func (e *sqliteExporter) shutdown(ctx context.Context) error {
 		e.cancelFunc()
 	}
 
+	// Streams would otherwise hold the HTTP server's shutdown open
+	if e.queryGRPC != nil {
+		e.queryGRPC.Stop()
+	}
 	if e.server != nil {
 		e.server.Shutdown(ctx)
 	}
 
 	e.wg.Wait()
+	if e.bus != nil {
+		e.bus.stop(ctx)
+	}
+
+	if e.replication != nil {
+		e.replication.stop()
+	}
+
+	if e.incidents != nil {
+		e.incidents.Close()
+	}
 
 	if e.store != nil {
 		// Checkpoint before closing
@@ -104,10 +400,36 @@ func (e *sqliteExporter) shutdown(ctx context.Context) error {
 }
 
 // pushTraces converts traces to SQLite records
-func (e *sqliteExporter) pushTraces(ctx context.Context, td ptrace.Traces) error {
-	var spanJSONs [][]byte
-	var metrics []sqlite.MetricRecord
+func (e *sqliteExporter) pushTraces(ctx context.Context, td ptrace.Traces) (err error) {
+	start := time.Now()
+	defer func() {
+		if b, slow := e.slowIngest.observe(td, time.Since(start), err); slow {
+			e.logger.Warn("Slow trace batch",
+				zap.Float64("duration_ms", b.DurationMs),
+				zap.Int("spans", b.Spans),
+				zap.Int("bytes", b.Bytes),
+				zap.Strings("services", b.Services),
+				zap.Strings("span_names", b.SpanNames))
+		}
+	}()
+
+	if e.replication != nil && e.replication.isStandby() {
+		return consumererror.NewPermanent(errStandbyReadOnly)
+	}
+	if err := e.admit(); err != nil {
+		e.ingest.batchesRejected.Add(1)
+		e.shed.throttled(td)
+		return err
+	}
+
+	var storedSpans []tracestore.EncodedSpan
+	var operations [][2]string
+	var metrics []tracestore.MetricRecord
+	var aggregations []spanMetricsSample
+	var traceIDs []string
+	derived := newDerivedAggregator(e.derived, e.tagTenant)
 	timestamp := time.Now().Unix()
+	headerTenant := e.metadataTenant(ctx)
 
 	resourceSpans := td.ResourceSpans()
 	for i := 0; i < resourceSpans.Len(); i++ {
@@ -120,36 +442,57 @@ func (e *sqliteExporter) pushTraces(ctx context.Context, td ptrace.Traces) error
 			serviceNameRaw = serviceAttr.Str()
 		}
 		serviceNameMetric := sanitizeMetricName(serviceNameRaw)
+		tenant, err := e.resourceTenant(headerTenant, resource)
+		if err != nil {
+			return consumererror.NewPermanent(err)
+		}
 
+		var shed shedCount
 		scopeSpans := rs.ScopeSpans()
 		for j := 0; j < scopeSpans.Len(); j++ {
 			ss := scopeSpans.At(j)
 			spans := ss.Spans()
+			shed.received += int64(spans.Len())
 
-			// Aggregate metrics per span name
-			spanAggs := make(map[string]*spanAggregation)
+			// Aggregate metrics per span name and metric timestamp
+			spanAggs := make(map[spanAggKey]*spanAggregation)
 
 			for k := 0; k < spans.Len(); k++ {
 				span := spans.At(k)
+				if !e.filter.keep(serviceNameRaw, span, resource) {
+					shed.excluded++
+					continue
+				}
+				if len(e.hooks) > 0 {
+					var hookMetrics []HookMetric
+					span, hookMetrics = e.runSpanHooks(ctx, span, resource, ss.Scope(), serviceNameRaw)
+					metrics = append(metrics, e.hookMetricRecords(serviceNameRaw, tenant, hookMetrics, timestamp)...)
+				}
 				spanNameRaw := span.Name()
 				spanNameMetric := sanitizeMetricName(spanNameRaw)
 
-				// Build span JSON for storage
+				// Encode span for storage
 				if e.config.StoreTraces {
-					spanJSON, err := e.spanToJSON(span, resource, ss.Scope())
+					stored, err := e.storeSpan(span, resource, ss.Scope(), tenant)
 					if err != nil {
-						e.logger.Error("Failed to marshal span JSON", zap.Error(err))
+						e.logger.Error("Failed to encode span", zap.Error(err))
 						continue
 					}
-					spanJSONs = append(spanJSONs, spanJSON)
+					storedSpans = append(storedSpans, stored)
+					operations = append(operations, [2]string{serviceNameRaw, spanNameRaw})
+					if e.pendingTraces != nil {
+						traceIDs = append(traceIDs, span.TraceID().String())
+					}
 				}
 
 				// Aggregate metrics
 				if e.config.SendMetrics {
-					agg, ok := spanAggs[spanNameMetric]
+					attributeTags, attributes := e.spanTagAttributes(span)
+					key := spanAggKey{spanName: spanNameMetric, timestamp: e.metricTimestamp(span, timestamp), attributes: attributes}
+					agg, ok := spanAggs[key]
 					if !ok {
-						agg = &spanAggregation{rawSpanName: spanNameRaw}
-						spanAggs[spanNameMetric] = agg
+						agg = &spanAggregation{rawSpanName: spanNameRaw, timestamp: key.timestamp, attributeTags: attributeTags}
+						spanAggs[key] = agg
 					}
 					agg.count++
 
@@ -163,26 +506,55 @@ func (e *sqliteExporter) pushTraces(ctx context.Context, td ptrace.Traces) error
 						e.logger.Debug("Found error span", zap.String("span_name", spanNameRaw), zap.Float64("duration_ms", duration))
 					}
 
+					for ev := 0; ev < span.Events().Len(); ev++ {
+						if span.Events().At(ev).Name() == "exception" {
+							agg.exceptionCount++
+						}
+					}
+
+					if budget, ok := e.config.latencyBudget(serviceNameRaw, spanNameRaw); ok && duration > float64(budget)/float64(time.Millisecond) {
+						agg.overBudget++
+					}
+
 					// Accumulate duration for all spans to avoid bias
 					agg.totalDuration += duration
+					if agg.slowestTraceID == "" || duration > agg.slowest {
+						agg.slowest = duration
+						agg.slowestTraceID = span.TraceID().String()
+					}
+					if len(e.config.Percentiles) > 0 {
+						agg.durations = append(agg.durations, duration)
+					}
+
+					if len(e.derived) > 0 {
+						derived.observe(serviceNameRaw, tenant, key.timestamp, spanContext{span: span, resource: resource})
+					}
 				}
 			}
 
 			// Generate metrics
 			if e.config.SendMetrics {
-				for spanNameMetric, agg := range spanAggs {
-					prefix := e.buildPrefix(serviceNameMetric, spanNameMetric)
+				for key, agg := range spanAggs {
+					prefix := e.spanMetricPrefix(serviceNameMetric, key.spanName, resource)
 					tags := map[string]string{"service": serviceNameRaw, "span": agg.rawSpanName}
+					for k, v := range agg.attributeTags {
+						tags[k] = v
+					}
+					if e.config.InstanceLabel != "" {
+						tags["instance"] = e.config.InstanceLabel
+					}
+					e.tagTenant(tags, tenant)
 					tagsJSON, err := json.Marshal(tags)
 					if err != nil {
 						e.logger.Error("Failed to marshal metric tags", zap.Error(err))
 						continue
 					}
+					aggregations = append(aggregations, spanMetricsSample{tags: tags, agg: agg})
 
-					metrics = append(metrics, sqlite.MetricRecord{
+					metrics = append(metrics, tracestore.MetricRecord{
 						Name:      fmt.Sprintf("%s.span_count", prefix),
 						Value:     float64(agg.count),
-						Timestamp: timestamp,
+						Timestamp: agg.timestamp,
 						Tags:      string(tagsJSON),
 					})
 
@@ -192,48 +564,102 @@ func (e *sqliteExporter) pushTraces(ctx context.Context, td ptrace.Traces) error
 						e.logger.Debug("Average duration calculated",
 							zap.String("span_name", agg.rawSpanName),
 							zap.Float64("avg_duration_ms", avgDuration))
-						metrics = append(metrics, sqlite.MetricRecord{
-							Name:      fmt.Sprintf("%s.duration_ms", prefix),
-							Value:     avgDuration,
-							Timestamp: timestamp,
-							Tags:      string(tagsJSON),
+						metrics = append(metrics, tracestore.MetricRecord{
+							Name:            fmt.Sprintf("%s.duration_ms", prefix),
+							Value:           avgDuration,
+							Timestamp:       agg.timestamp,
+							Tags:            string(tagsJSON),
+							ExemplarTraceID: agg.slowestTraceID,
 						})
+
+						sort.Float64s(agg.durations)
+						for _, p := range e.config.Percentiles {
+							metrics = append(metrics, tracestore.MetricRecord{
+								Name:            fmt.Sprintf("%s.duration_ms.%s", prefix, percentileSuffix(p)),
+								Value:           durationPercentile(agg.durations, p),
+								Timestamp:       agg.timestamp,
+								Tags:            string(tagsJSON),
+								ExemplarTraceID: agg.slowestTraceID,
+							})
+						}
 					}
 
 					if agg.errorCount > 0 {
-						metrics = append(metrics, sqlite.MetricRecord{
+						metrics = append(metrics, tracestore.MetricRecord{
 							Name:      fmt.Sprintf("%s.error_count", prefix),
 							Value:     float64(agg.errorCount),
-							Timestamp: timestamp,
+							Timestamp: agg.timestamp,
+							Tags:      string(tagsJSON),
+						})
+					}
+
+					if agg.exceptionCount > 0 {
+						metrics = append(metrics, tracestore.MetricRecord{
+							Name:      fmt.Sprintf("%s.exception_count", prefix),
+							Value:     float64(agg.exceptionCount),
+							Timestamp: agg.timestamp,
+							Tags:      string(tagsJSON),
+						})
+					}
+
+					if agg.overBudget > 0 {
+						metrics = append(metrics, tracestore.MetricRecord{
+							Name:      fmt.Sprintf("%s.over_budget_count", prefix),
+							Value:     float64(agg.overBudget),
+							Timestamp: agg.timestamp,
 							Tags:      string(tagsJSON),
 						})
 					}
 				}
 			}
 		}
+		e.shed.add(serviceNameRaw, shed)
 	}
 
-	// Batch insert spans and metrics atomically
-	if len(spanJSONs) > 0 || len(metrics) > 0 {
-		if err := e.store.InsertData(ctx, spanJSONs, metrics); err != nil {
-			return fmt.Errorf("failed to insert data: %w", err)
+	metrics = append(metrics, derived.records(e.metricRoot(), e.config.InstanceLabel)...)
+
+	// Storage writes spans and metrics atomically, then the other consumers
+	// see the batch (see newIngestBus)
+	if len(storedSpans) > 0 || len(metrics) > 0 {
+		if err := e.bus.publish(ctx, &ingestBatch{
+			spans:        storedSpans,
+			metrics:      metrics,
+			operations:   operations,
+			aggregations: aggregations,
+			traceIDs:     traceIDs,
+		}); err != nil {
+			return err
 		}
 	}
 
 	e.logger.Debug("Stored traces",
-		zap.Int("spans", len(spanJSONs)),
+		zap.Int("spans", len(storedSpans)),
 		zap.Int("metrics", len(metrics)))
 
 	return nil
 }
 
-// spanToJSON converts a span to JSON for storage
-func (e *sqliteExporter) spanToJSON(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) ([]byte, error) {
-	// Extract service name from resource
-	serviceName := "unknown"
+// spanToJSON converts a span to JSON for storage, recording its tenant
+// unless it is the default one
+func (e *sqliteExporter) spanToJSON(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope, tenant string) ([]byte, error) {
+	doc := spanDocument(span, resource, scope, e.enrichers)
+	if tenant != "" {
+		doc["tenant"] = tenant
+	}
+	return json.Marshal(doc)
+}
+
+// spanServiceName returns the resource's service.name, or "unknown"
+func spanServiceName(resource pcommon.Resource) string {
 	if serviceAttr, ok := resource.Attributes().Get("service.name"); ok {
-		serviceName = serviceAttr.Str()
+		return serviceAttr.Str()
 	}
+	return "unknown"
+}
+
+// spanDocument builds the JSON document stored for a span
+func spanDocument(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope, enrichers []spanEnricher) map[string]interface{} {
+	serviceName := spanServiceName(resource)
 
 	// Calculate duration in milliseconds (float for precision)
 	durationMs := float64(span.EndTimestamp().AsTime().Sub(span.StartTimestamp().AsTime()).Nanoseconds()) / 1e6
@@ -242,6 +668,7 @@ func (e *sqliteExporter) spanToJSON(span ptrace.Span, resource pcommon.Resource,
 	}
 
 	data := map[string]interface{}{
+		"v":                    spanDocVersion,
 		"trace_id":             span.TraceID().String(),
 		"span_id":              span.SpanID().String(),
 		"parent_span_id":       span.ParentSpanID().String(),
@@ -289,6 +716,7 @@ func (e *sqliteExporter) spanToJSON(span ptrace.Span, resource pcommon.Resource,
 		attrs[k] = v.AsRaw()
 		return true
 	})
+	enrichAttributes(enrichers, attrs, resourceAttrs)
 	if len(attrs) > 0 {
 		data["attributes"] = attrs
 	}
@@ -340,16 +768,38 @@ func (e *sqliteExporter) spanToJSON(span ptrace.Span, resource pcommon.Resource,
 		data["events"] = events
 	}
 
-	return json.Marshal(data)
+	return data
 }
 
 // buildPrefix constructs the metric prefix
 func (e *sqliteExporter) buildPrefix(serviceName, spanName string) string {
+	return strings.Join([]string{e.metricRoot(), serviceName, spanName}, ".")
+}
+
+// durationPercentile returns the nearest-rank percentile p of sorted, which
+// must not be empty
+func durationPercentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// percentileSuffix names a percentile metric: 95 is p95, 99.9 is p99_9
+func percentileSuffix(p float64) string {
+	return "p" + sanitizeMetricName(strconv.FormatFloat(p, 'f', -1, 64))
+}
+
+// metricRoot returns the metric path in front of the service segment
+func (e *sqliteExporter) metricRoot() string {
 	parts := []string{e.config.Prefix}
 	if e.config.Namespace != "" {
 		parts = append(parts, e.config.Namespace)
 	}
-	parts = append(parts, serviceName, spanName)
+	if e.config.InstanceLabel != "" {
+		parts = append(parts, sanitizeMetricName(e.config.InstanceLabel))
+	}
 	return strings.Join(parts, ".")
 }
 
@@ -365,7 +815,7 @@ func (e *sqliteExporter) runCleanup() {
 		case <-e.cleanupCtx.Done():
 			return
 		case <-ticker.C:
-			deleted, err := e.store.Cleanup(e.cleanupCtx, e.config.Retention)
+			deleted, err := e.store.CleanupTables(e.cleanupCtx, e.config.TraceRetention, e.config.MetricRetention)
 			if err != nil {
 				if e.cleanupCtx.Err() != nil {
 					// Context cancelled during shutdown, don't log as error
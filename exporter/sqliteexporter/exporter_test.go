@@ -1,20 +1,53 @@
 package sqliteexporter
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/collector/client"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/config/configopaque"
+	"go.opentelemetry.io/collector/config/configoptional"
+	"go.opentelemetry.io/collector/config/configtls"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/exporter"
 	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
 
-	"github.com/gotel/storage/sqlite"
+	"github.com/gotel/pkg/tracestore"
 )
 
 func TestNewSQLiteExporter(t *testing.T) {
@@ -74,6 +107,19 @@ func TestConfigValidate(t *testing.T) {
 	}
 }
 
+func TestConfigValidateTableRetention(t *testing.T) {
+	cfg := &Config{Retention: 24 * time.Hour, MetricRetention: 30 * 24 * time.Hour}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if cfg.TraceRetention != 24*time.Hour {
+		t.Errorf("TraceRetention = %v, want retention", cfg.TraceRetention)
+	}
+	if cfg.MetricRetention != 30*24*time.Hour {
+		t.Errorf("MetricRetention = %v, want 720h", cfg.MetricRetention)
+	}
+}
+
 func TestPushTraces(t *testing.T) {
 	exp := newTestExporter(t)
 	defer exp.shutdown(context.Background())
@@ -268,7 +314,7 @@ func TestServiceNamePreservedForStorage(t *testing.T) {
 	}
 
 	metricName := "otel.checkout_API_v1.GET__cart_items.span_count"
-	metrics, err := exp.store.QueryMetrics(ctx, sqlite.MetricQueryOptions{Name: metricName})
+	metrics, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: metricName})
 	if err != nil {
 		t.Fatalf("QueryMetrics() error = %v", err)
 	}
@@ -310,6 +356,13 @@ func TestBuildPrefix(t *testing.T) {
 			spanName:    "myspan",
 			expected:    "otel.prod.myservice.myspan",
 		},
+		{
+			name:        "with instance label",
+			config:      &Config{Prefix: "otel", Namespace: "prod", InstanceLabel: "node-1.example"},
+			serviceName: "myservice",
+			spanName:    "myspan",
+			expected:    "otel.prod.node-1_example.myservice.myspan",
+		},
 	}
 
 	for _, tt := range tests {
@@ -323,6 +376,180 @@ func TestBuildPrefix(t *testing.T) {
 	}
 }
 
+func TestMetricPathTemplate(t *testing.T) {
+	for _, bad := range []string{
+		"{prefix}.{service}.{span}",
+		"{prefix}.{service}.{metric}",
+		"{prefix}.{service}.{span}.{metric}.{metric}",
+		"{prefix}.{service.{span}.{metric}",
+		"{prefix}.service}.{span}.{metric}",
+		"{prefix}.{}.{service}.{span}.{metric}",
+	} {
+		if _, err := compileMetricPathTemplate(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+	if err := (&Config{PathTemplate: "{prefix}.{service}"}).Validate(); err == nil || !strings.Contains(err.Error(), "path_template") {
+		t.Errorf("Expected Validate to reject the template, got %v", err)
+	}
+
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+	tmpl, err := compileMetricPathTemplate("{prefix}.{deployment.environment}.{service}.{span}.{metric}")
+	if err != nil {
+		t.Fatalf("compileMetricPathTemplate() error = %v", err)
+	}
+	exp.pathTemplate = tmpl
+
+	td := ptrace.NewTraces()
+	for i, env := range []string{"prod.eu", "staging", ""} {
+		rs := td.ResourceSpans().AppendEmpty()
+		rs.Resource().Attributes().PutStr("service.name", "checkout")
+		if env != "" {
+			rs.Resource().Attributes().PutStr("deployment.environment", env)
+		}
+		span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		span.SetName("GET /cart")
+		span.SetTraceID(pcommon.TraceID([16]byte{1}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	for _, name := range []string{
+		"otel.prod_eu.checkout.GET__cart.span_count",
+		"otel.staging.checkout.GET__cart.span_count",
+		"otel.unknown.checkout.GET__cart.span_count",
+	} {
+		records, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: name})
+		if err != nil || len(records) != 1 {
+			t.Errorf("Expected one %s point, got %d, %v", name, len(records), err)
+		}
+	}
+}
+
+func TestMetricTimestamp(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.MetricTimestamp = "span_start"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected unknown metric_timestamp to be rejected")
+	}
+
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+	if exp.config.MetricTimestamp != metricTimestampExport {
+		t.Errorf("Expected metric_timestamp to default to export, got %q", exp.config.MetricTimestamp)
+	}
+	derived, err := newDerivedMetrics([]DerivedMetricConfig{{Name: "ops", Aggregate: derivedCount}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.derived = derived
+
+	// A replayed batch: two spans ended an hour ago, one a second later
+	ended := time.Now().Add(-time.Hour).Truncate(time.Second)
+	replay := func(service string) ptrace.Traces {
+		td := ptrace.NewTraces()
+		rs := td.ResourceSpans().AppendEmpty()
+		rs.Resource().Attributes().PutStr("service.name", service)
+		spans := rs.ScopeSpans().AppendEmpty().Spans()
+		for i, end := range []time.Time{ended, ended.Add(100 * time.Millisecond), ended.Add(time.Second)} {
+			span := spans.AppendEmpty()
+			span.SetName("op")
+			span.SetTraceID(pcommon.TraceID([16]byte{byte(len(service))}))
+			span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+			span.SetStartTimestamp(pcommon.NewTimestampFromTime(end.Add(-time.Millisecond)))
+			span.SetEndTimestamp(pcommon.NewTimestampFromTime(end))
+		}
+		return td
+	}
+	points := func(name string) map[int64]float64 {
+		t.Helper()
+		records, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: name})
+		if err != nil {
+			t.Fatalf("QueryMetrics() error = %v", err)
+		}
+		out := make(map[int64]float64)
+		for _, r := range records {
+			out[r.Timestamp] += r.Value
+		}
+		return out
+	}
+
+	if err := exp.pushTraces(ctx, replay("live")); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	for ts := range points("otel.live.op.span_count") {
+		if ts < ended.Add(30*time.Minute).Unix() {
+			t.Errorf("Expected export mode to stamp points with the export time, got %d", ts)
+		}
+	}
+
+	exp.config.MetricTimestamp = metricTimestampSpanEnd
+	if err := exp.pushTraces(ctx, replay("replayed")); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	want := map[int64]float64{ended.Unix(): 2, ended.Unix() + 1: 1}
+	for _, name := range []string{"otel.replayed.op.span_count", "otel.replayed.ops"} {
+		if got := points(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s points = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestTagAttributes(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.TagAttributes = []string{"http.method", "service"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected tag_attributes overriding a span metric tag to be rejected")
+	}
+
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+	exp.config.TagAttributes = []string{"http.method", "http.status_code"}
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "api")
+	spans := rs.ScopeSpans().AppendEmpty().Spans()
+	for i, tc := range []struct {
+		method string
+		status int64
+	}{{"GET", 200}, {"GET", 200}, {"GET", 500}, {"POST", 200}, {"", 0}} {
+		span := spans.AppendEmpty()
+		span.SetName("handle")
+		span.SetTraceID(pcommon.TraceID([16]byte{1}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		if tc.method != "" {
+			span.Attributes().PutStr("http.method", tc.method)
+			span.Attributes().PutInt("http.status_code", tc.status)
+		}
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	records, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: "otel.api.handle.span_count"})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	got := make(map[string]float64)
+	for _, r := range records {
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(r.Tags), &tags); err != nil {
+			t.Fatalf("Invalid tags %s: %v", r.Tags, err)
+		}
+		got[tags["http.method"]+" "+tags["http.status_code"]] += r.Value
+	}
+	want := map[string]float64{"GET 200": 2, "GET 500": 1, "POST 200": 1, " ": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("span_count by tag = %v, want %v", got, want)
+	}
+}
+
 func TestSanitizeMetricName(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -409,6 +636,13 @@ func TestQueryEndpoints(t *testing.T) {
 		if stats["span_count"].(float64) != 1 {
 			t.Errorf("Expected span_count=1, got %v", stats["span_count"])
 		}
+		memory, ok := stats["memory"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("Expected memory settings in status, got %v", stats["memory"])
+		}
+		if memory["memory_limiter_limit_percentage"].(float64) != 80 {
+			t.Errorf("Expected memory_limiter_limit_percentage=80, got %v", memory["memory_limiter_limit_percentage"])
+		}
 	})
 
 	// Test /ready
@@ -459,6 +693,66 @@ func TestRenderMetrics(t *testing.T) {
 	}
 }
 
+func TestRenderMetricsExemplars(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+	ctx := context.Background()
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "checkout")
+	spans := rs.ScopeSpans().AppendEmpty().Spans()
+	now := time.Now()
+	for i, ms := range []int{20, 250, 40} {
+		span := spans.AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{byte(i + 1)}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		span.SetName("pay")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(now.Add(-time.Duration(ms) * time.Millisecond)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(now))
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	slowest := pcommon.TraceID([16]byte{2}).String()
+
+	render := func(target string) []map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/render?from=-1h&target="+url.QueryEscape(target), nil)
+		w := httptest.NewRecorder()
+		exp.handleRenderMetrics(w, req)
+		var result []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result) != 1 {
+			t.Fatalf("%s: expected one series, got %d %s", target, w.Code, w.Body.String())
+		}
+		return result
+	}
+	exemplarTrace := func(result []map[string]interface{}) string {
+		meta, _ := result[0]["meta"].(map[string]interface{})
+		exemplars, _ := meta["exemplars"].([]interface{})
+		if len(exemplars) != 1 {
+			return ""
+		}
+		return exemplars[0].(map[string]interface{})["trace_id"].(string)
+	}
+
+	for _, target := range []string{
+		"otel.checkout.pay.duration_ms",
+		"aliasByNode(otel.checkout.*.duration_ms, 2)",
+		"seriesByTag('name=otel.checkout.pay.duration_ms')",
+	} {
+		if got := exemplarTrace(render(target)); got != slowest {
+			t.Errorf("%s: expected the slowest trace %s as exemplar, got %q", target, slowest, got)
+		}
+	}
+	if _, ok := render("otel.checkout.pay.span_count")[0]["meta"]; ok {
+		t.Error("Expected no exemplars on span_count")
+	}
+	if _, ok := render("scale(otel.checkout.pay.duration_ms, 2)")[0]["meta"]; ok {
+		t.Error("Expected derived series to drop exemplars")
+	}
+}
+
 func TestFindMetrics(t *testing.T) {
 	exp := newTestExporter(t)
 	defer exp.shutdown(context.Background())
@@ -674,6 +968,129 @@ func TestGetTraceEmpty(t *testing.T) {
 	}
 }
 
+func TestNormalizeTraceID(t *testing.T) {
+	for in, want := range map[string]string{
+		"0102030405060708090a0b0c0d0e0f10":       "0102030405060708090a0b0c0d0e0f10",
+		"  0x0102030405060708090A0B0C0D0E0F10\n": "0102030405060708090a0b0c0d0e0f10",
+		"a3ce929d0e0e4736":                       "0000000000000000a3ce929d0e0e4736",
+	} {
+		if got, err := normalizeTraceID(in); err != nil || got != want {
+			t.Errorf("normalizeTraceID(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"0x", "not-a-trace", "0102030405060708090a0b0c0d0e0f1011"} {
+		if _, err := normalizeTraceID(in); err == nil {
+			t.Errorf("normalizeTraceID(%q) should fail", in)
+		}
+	}
+}
+
+func TestGetTraceInvalidID(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	req := httptest.NewRequest("GET", "/api/traces/trace-123", nil)
+	w := httptest.NewRecorder()
+	exp.handleGetTrace(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for a non-hex trace ID, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "32 hex digits") {
+		t.Errorf("Expected the expected format in the error, got %s", w.Body.String())
+	}
+
+	// A 0x-prefixed, uppercase ID finds the stored trace
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "pasted-id-service")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{0xab, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
+	span.SetSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+	span.SetName("pasted-op")
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+	exp.pushTraces(context.Background(), td)
+
+	req = httptest.NewRequest("GET", "/api/traces/0xAB02030405060708090A0B0C0D0E0F10", nil)
+	w = httptest.NewRecorder()
+	exp.handleGetTrace(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "pasted-op") {
+		t.Errorf("Expected the trace for a pasted ID, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBatchGetTraces(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	ctx := context.Background()
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "batch-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+	for i := 0; i < 2; i++ {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{byte(i + 1)}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		span.SetName("batch-op")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+	}
+	exp.pushTraces(ctx, td)
+
+	first := "01000000000000000000000000000000"
+	second := "02000000000000000000000000000000"
+	body := `{"traceIds": ["` + second + `", "missing-trace", "` + first + `", "` + second + `"]}`
+	req := httptest.NewRequest("POST", "/api/traces:batchGet", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	exp.handleBatchGetTraces(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var result struct {
+		Traces []struct {
+			TraceID       string        `json:"traceId"`
+			ResourceSpans []interface{} `json:"resourceSpans"`
+		} `json:"traces"`
+		Missing []string `json:"missing"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(result.Traces) != 2 || result.Traces[0].TraceID != second || result.Traces[1].TraceID != first {
+		t.Errorf("Expected traces in request order without duplicates, got %+v", result.Traces)
+	}
+	for _, tr := range result.Traces {
+		if len(tr.ResourceSpans) == 0 {
+			t.Errorf("Expected resourceSpans for trace %s", tr.TraceID)
+		}
+	}
+	if len(result.Missing) != 1 || result.Missing[0] != "missing-trace" {
+		t.Errorf("Expected missing-trace to be reported missing, got %v", result.Missing)
+	}
+
+	t.Run("rejects GET", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/traces:batchGet", nil)
+		w := httptest.NewRecorder()
+		exp.handleBatchGetTraces(w, req)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405, got %d", w.Code)
+		}
+	})
+
+	t.Run("rejects empty list", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/traces:batchGet", strings.NewReader(`{"traceIds": []}`))
+		w := httptest.NewRecorder()
+		exp.handleBatchGetTraces(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+}
+
 func TestMultipleSpansPerTrace(t *testing.T) {
 	exp := newTestExporter(t)
 	defer exp.shutdown(context.Background())
@@ -1014,6 +1431,7 @@ func TestListSpans(t *testing.T) {
 		span.SetName("span-operation")
 		span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-100 * time.Millisecond)))
 		span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+		span.Attributes().PutInt("span.index", int64(i))
 	}
 
 	exp.pushTraces(ctx, td)
@@ -1040,6 +1458,21 @@ func TestListSpans(t *testing.T) {
 		}
 	})
 
+	// Test with attribute tags
+	t.Run("tags filter", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/spans?tags="+url.QueryEscape("span.index=1"), nil)
+		w := httptest.NewRecorder()
+		exp.handleListSpans(w, req)
+
+		var spans []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &spans); err != nil {
+			t.Fatalf("Expected valid JSON response: %v", err)
+		}
+		if len(spans) != 1 {
+			t.Errorf("Expected 1 span with span.index=1, got %d", len(spans))
+		}
+	})
+
 	// Test with limit
 	t.Run("limit filter", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "/api/spans?limit=1", nil)
@@ -1050,6 +1483,46 @@ func TestListSpans(t *testing.T) {
 			t.Errorf("Expected status 200, got %d", w.Code)
 		}
 	})
+
+	// Test CSV output via Accept header and format parameter
+	for _, tc := range []struct {
+		name   string
+		url    string
+		accept string
+	}{
+		{"csv accept header", "/api/spans", "text/csv"},
+		{"csv format param", "/api/spans?format=csv", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.url, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			w := httptest.NewRecorder()
+			exp.handleListSpans(w, req)
+
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+				t.Fatalf("Expected text/csv content type, got %q", ct)
+			}
+			records, err := csv.NewReader(w.Body).ReadAll()
+			if err != nil {
+				t.Fatalf("Failed to parse CSV: %v", err)
+			}
+			if len(records) != 4 {
+				t.Fatalf("Expected header + 3 rows, got %d", len(records))
+			}
+			if records[0][0] != "trace_id" || records[0][len(records[0])-1] != "status_message" {
+				t.Errorf("Unexpected header %v", records[0])
+			}
+			if records[1][3] != "list-spans-service" {
+				t.Errorf("Expected service_name column, got %v", records[1])
+			}
+			// Nanosecond timestamps must not be rounded through float64.
+			if _, err := strconv.ParseInt(records[1][6], 10, 64); err != nil {
+				t.Errorf("Expected integer start_time_unix_nano, got %q", records[1][6])
+			}
+		})
+	}
 }
 
 func TestListExceptions(t *testing.T) {
@@ -1177,6 +1650,9 @@ func TestSearchTagValues(t *testing.T) {
 	span.SetTraceID(pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
 	span.SetSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
 	span.SetName("test-op")
+	span.SetKind(ptrace.SpanKindServer)
+	span.Attributes().PutStr("http.method", "GET")
+	rs.Resource().Attributes().PutStr("deployment.environment", "staging")
 	span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-100 * time.Millisecond)))
 	span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
 
@@ -1204,9 +1680,79 @@ func TestSearchTagValues(t *testing.T) {
 		}
 	})
 
-	// Test unsupported tag
+	// A service last seen weeks ago drops out of windowed lookups
+	stale := ptrace.NewTraces()
+	staleRS := stale.ResourceSpans().AppendEmpty()
+	staleRS.Resource().Attributes().PutStr("service.name", "decommissioned-service")
+	staleSpan := staleRS.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	staleSpan.SetTraceID(pcommon.TraceID([16]byte{2, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
+	staleSpan.SetSpanID(pcommon.SpanID([8]byte{2, 2, 3, 4, 5, 6, 7, 8}))
+	staleSpan.SetName("old-op")
+	staleSpan.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-30 * 24 * time.Hour)))
+	staleSpan.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-30*24*time.Hour + time.Millisecond)))
+	exp.pushTraces(ctx, stale)
+
+	t.Run("time range", func(t *testing.T) {
+		start := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		end := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+		for path, want := range map[string]string{
+			"/api/search/tag/service.name/values": "tag-values-service",
+			"/api/search/tag/span.name/values":    "test-op",
+		} {
+			req := httptest.NewRequest("GET", path+"?start="+start+"&end="+end, nil)
+			w := httptest.NewRecorder()
+			exp.handleSearchTagValues(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected status 200, got %d", path, w.Code)
+			}
+			var result struct {
+				TagValues []string `json:"tagValues"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &result)
+			if len(result.TagValues) != 1 || result.TagValues[0] != want {
+				t.Errorf("%s: expected [%s], got %v", path, want, result.TagValues)
+			}
+		}
+	})
+
+	t.Run("invalid time range", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/search/tag/service.name/values?start=bogus", nil)
+		w := httptest.NewRecorder()
+		exp.handleSearchTagValues(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("attributes", func(t *testing.T) {
+		for path, want := range map[string][]string{
+			"/api/search/tag/http.method/values":                     {"GET"},
+			"/api/search/tag/.http.method/values":                    {"GET"},
+			"/api/search/tag/span.http.method/values":                {"GET"},
+			"/api/search/tag/resource.deployment.environment/values": {"staging"},
+			"/api/search/tag/kind/values":                            {"server", "unspecified"},
+			"/api/search/tag/unknown.tag/values":                     {},
+		} {
+			w := httptest.NewRecorder()
+			exp.handleSearchTagValues(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected status 200, got %d: %s", path, w.Code, w.Body.String())
+			}
+			var result struct {
+				TagValues []string `json:"tagValues"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &result)
+			if !reflect.DeepEqual(result.TagValues, want) {
+				t.Errorf("%s: expected %v, got %v", path, want, result.TagValues)
+			}
+		}
+	})
+
+	// Durations are not listed
 	t.Run("unsupported tag", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/api/search/tag/unknown.tag/values", nil)
+		req := httptest.NewRequest("GET", "/api/search/tag/duration/values", nil)
 		w := httptest.NewRecorder()
 		exp.handleSearchTagValues(w, req)
 
@@ -1257,7 +1803,7 @@ func TestSearchTagValuesV2(t *testing.T) {
 
 	// Test unsupported tag
 	t.Run("unsupported tag", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/api/v2/search/tag/unknown.tag/values", nil)
+		req := httptest.NewRequest("GET", "/api/v2/search/tag/duration/values", nil)
 		w := httptest.NewRecorder()
 		exp.handleSearchTagValuesV2(w, req)
 
@@ -1267,38 +1813,237 @@ func TestSearchTagValuesV2(t *testing.T) {
 	})
 }
 
-func TestRenderMetricsWithAlias(t *testing.T) {
+func TestRenderMetricsTimeRange(t *testing.T) {
 	exp := newTestExporter(t)
 	defer exp.shutdown(context.Background())
 
 	ctx := context.Background()
+	now := time.Now()
+	exp.store.InsertMetric(ctx, "otel.svc.op.span_count", 1, now.Add(-2*time.Hour).Unix(), nil)
+	exp.store.InsertMetric(ctx, "otel.svc.op.span_count", 2, now.Unix(), nil)
 
-	// Insert test metric data
-	now := time.Now().Unix()
-	exp.store.InsertMetric(ctx, "otel.service1.op1.span_count", 10, now, map[string]string{"service": "service1", "span": "op1"})
-	exp.store.InsertMetric(ctx, "otel.service1.op2.span_count", 20, now, map[string]string{"service": "service1", "span": "op2"})
-
-	// Test with aliasByNode
-	t.Run("aliasByNode", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/render?target=aliasByNode(otel.*.*.span_count,1)&from=-1h&until=now", nil)
+	for _, from := range []string{"-1h", strconv.FormatInt(now.Add(-time.Hour).UnixMilli(), 10)} {
+		req := httptest.NewRequest("GET", "/render?target=otel.svc.op.span_count&from="+from, nil)
 		w := httptest.NewRecorder()
 		exp.handleRenderMetrics(w, req)
-
 		if w.Code != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", w.Code)
+			t.Fatalf("from=%s: expected status 200, got %d", from, w.Code)
 		}
-	})
+		var result []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		if len(result) != 1 {
+			t.Fatalf("from=%s: expected 1 series, got %d", from, len(result))
+		}
+		if points := result[0]["datapoints"].([]interface{}); len(points) != 1 {
+			t.Errorf("from=%s: expected 1 datapoint in range, got %d", from, len(points))
+		}
+	}
 
-	// Test with aliasSub
-	t.Run("aliasSub", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/render?target=aliasSub(otel.*.*.span_count,'otel.(.+).span_count','$1')&from=-1h&until=now", nil)
+	req := httptest.NewRequest("GET", "/render?target=otel.svc.op.span_count&from=yesterday", nil)
+	w := httptest.NewRecorder()
+	exp.handleRenderMetrics(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid from, got %d", w.Code)
+	}
+}
+
+func TestRenderMetricsMaxDataPoints(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	for i := 0; i < 60; i++ {
+		exp.store.InsertMetric(ctx, "otel.svc.op.span_count", float64(i), start.Add(time.Duration(i)*time.Minute).Unix(), nil)
+	}
+
+	req := httptest.NewRequest("GET", "/render?target=otel.svc.op.span_count&from=-2h&maxDataPoints=10", nil)
+	w := httptest.NewRecorder()
+	exp.handleRenderMetrics(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var result []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result) != 1 {
+		t.Fatalf("Expected 1 series, got %d", len(result))
+	}
+	points := result[0]["datapoints"].([]interface{})
+	if len(points) == 0 || len(points) > 10 {
+		t.Fatalf("Expected 1-10 datapoints, got %d", len(points))
+	}
+	var sum float64
+	for _, p := range points {
+		sum += p.([]interface{})[0].(float64)
+	}
+	if avg := sum / float64(len(points)); avg < 20 || avg > 40 {
+		t.Errorf("Expected consolidated values around 29.5, got mean %v", avg)
+	}
+
+	for _, bad := range []string{"0", "-5", "many"} {
+		req := httptest.NewRequest("GET", "/render?target=otel.svc.op.span_count&maxDataPoints="+bad, nil)
 		w := httptest.NewRecorder()
 		exp.handleRenderMetrics(w, req)
-
-		if w.Code != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", w.Code)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("maxDataPoints=%s: expected status 400, got %d", bad, w.Code)
 		}
-	})
+	}
+}
+
+func TestRenderMetricsFormats(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	ctx := context.Background()
+	start := time.Now().Add(-10 * time.Minute).Truncate(time.Minute).Unix()
+	exp.store.InsertMetric(ctx, "otel.svc.op.span_count", 1.5, start, nil)
+	exp.store.InsertMetric(ctx, "otel.svc.op.span_count", 2, start+60, nil)
+	exp.store.InsertMetric(ctx, "otel.svc.op.span_count", 4, start+180, nil)
+
+	render := func(t *testing.T, format string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/render?target=otel.svc.op.span_count&from=-1h&format="+format, nil)
+		w := httptest.NewRecorder()
+		exp.handleRenderMetrics(w, req)
+		return w
+	}
+
+	t.Run("raw", func(t *testing.T) {
+		w := render(t, "raw")
+		want := fmt.Sprintf("otel.svc.op.span_count,%d,%d,60|1.5,2,None,4\n", start, start+240)
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("Expected %q, got %d %q", want, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		w := render(t, "csv")
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		want := "otel.svc.op.span_count," + time.Unix(start, 0).UTC().Format("2006-01-02 15:04:05") + ",1.5"
+		if len(lines) != 3 || lines[0] != want {
+			t.Errorf("Expected 3 lines starting %q, got %q", want, lines)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+			t.Errorf("Expected text/csv, got %q", ct)
+		}
+	})
+
+	t.Run("pickle", func(t *testing.T) {
+		w := render(t, "pickle")
+		body := w.Body.Bytes()
+		if w.Header().Get("Content-Type") != "application/pickle" || !bytes.HasPrefix(body, []byte{0x80, 2}) || !bytes.HasSuffix(body, []byte(".")) {
+			t.Errorf("Expected a protocol 2 pickle, got %q", body)
+		}
+		if !bytes.Contains(body, []byte("otel.svc.op.span_count")) {
+			t.Error("Expected the series name in the pickle")
+		}
+	})
+
+	if w := render(t, "svg"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unsupported format, got %d", w.Code)
+	}
+}
+
+func TestWriteRenderPickle(t *testing.T) {
+	var buf bytes.Buffer
+	writeRenderPickle(&buf, []regularSeries{{name: "a", start: 60, end: 180, step: 60, values: []interface{}{1.0, nil}}})
+	want := []byte("\x80\x02](}(X\x04\x00\x00\x00nameX\x01\x00\x00\x00a" +
+		"X\x05\x00\x00\x00startJ<\x00\x00\x00" +
+		"X\x03\x00\x00\x00endJ\xb4\x00\x00\x00" +
+		"X\x04\x00\x00\x00stepJ<\x00\x00\x00" +
+		"X\x06\x00\x00\x00values](G?\xf0\x00\x00\x00\x00\x00\x00Neue.")
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("writeRenderPickle() = %q, want %q", buf.Bytes(), want)
+	}
+}
+
+func TestConsolidateDatapoints(t *testing.T) {
+	var points []interface{}
+	for i := 0; i < 7; i++ {
+		points = append(points, []interface{}{float64(i), int64(100 + i)})
+	}
+	got := consolidateDatapoints(points, 3)
+	want := [][]interface{}{{1.0, int64(100)}, {4.0, int64(103)}, {6.0, int64(106)}}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d points, got %d", len(want), len(got))
+	}
+	for i, p := range got {
+		if !reflect.DeepEqual(p, want[i]) {
+			t.Errorf("point %d = %v, want %v", i, p, want[i])
+		}
+	}
+	if got := consolidateDatapoints(points, 10); len(got) != 7 {
+		t.Errorf("Expected short series unchanged, got %d points", len(got))
+	}
+}
+
+func TestDefaultLookback(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+	exp.config.DefaultLookback = time.Hour
+
+	ctx := context.Background()
+	now := time.Now()
+	exp.store.InsertMetric(ctx, "otel.svc.op.span_count", 1, now.Add(-2*time.Hour).Unix(), nil)
+	exp.store.InsertMetric(ctx, "otel.svc.op.span_count", 2, now.Unix(), nil)
+
+	for query, want := range map[string]int{"": 1, "&all=true": 2, "&from=-3h": 2} {
+		req := httptest.NewRequest("GET", "/render?target=otel.svc.op.span_count"+query, nil)
+		w := httptest.NewRecorder()
+		exp.handleRenderMetrics(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: expected status 200, got %d", query, w.Code)
+		}
+		var result []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		if len(result) != 1 {
+			t.Fatalf("%q: expected 1 series, got %d", query, len(result))
+		}
+		if points := result[0]["datapoints"].([]interface{}); len(points) != want {
+			t.Errorf("%q: expected %d datapoints, got %d", query, want, len(points))
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/traces?all=maybe", nil)
+	w := httptest.NewRecorder()
+	exp.handleListTraces(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid all, got %d", w.Code)
+	}
+}
+
+func TestRenderMetricsWithAlias(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	ctx := context.Background()
+
+	// Insert test metric data
+	now := time.Now().Unix()
+	exp.store.InsertMetric(ctx, "otel.service1.op1.span_count", 10, now, map[string]string{"service": "service1", "span": "op1"})
+	exp.store.InsertMetric(ctx, "otel.service1.op2.span_count", 20, now, map[string]string{"service": "service1", "span": "op2"})
+
+	// Test with aliasByNode
+	t.Run("aliasByNode", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/render?target=aliasByNode(otel.*.*.span_count,1)&from=-1h&until=now", nil)
+		w := httptest.NewRecorder()
+		exp.handleRenderMetrics(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
+		}
+	})
+
+	// Test with aliasSub
+	t.Run("aliasSub", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/render?target=aliasSub(otel.*.*.span_count,'otel.(.+).span_count','$1')&from=-1h&until=now", nil)
+		w := httptest.NewRecorder()
+		exp.handleRenderMetrics(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
+		}
+	})
 
 	// Test with no target
 	t.Run("no target", func(t *testing.T) {
@@ -1357,6 +2102,234 @@ func TestSplitTopLevelCSV(t *testing.T) {
 	}
 }
 
+func TestRenderMetricsFunctions(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	ctx := context.Background()
+	start := time.Now().Add(-30 * time.Minute).Truncate(time.Minute).Unix()
+	for i, v := range []float64{1, 2, 3, 4} {
+		ts := start + int64(i)*60
+		exp.store.InsertMetric(ctx, "otel.svc1.op1.span_count", v, ts, nil)
+		exp.store.InsertMetric(ctx, "otel.svc1.op2.span_count", v*10, ts, nil)
+		exp.store.InsertMetric(ctx, "otel.svc2.op1.span_count", 5, ts, nil)
+	}
+
+	render := func(t *testing.T, target string) []map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/render?from=-1h&target="+url.QueryEscape(target), nil)
+		w := httptest.NewRecorder()
+		exp.handleRenderMetrics(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", target, w.Code, w.Body.String())
+		}
+		var result []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", target, err)
+		}
+		return result
+	}
+	firstValue := func(series map[string]interface{}) float64 {
+		return series["datapoints"].([]interface{})[0].([]interface{})[0].(float64)
+	}
+
+	t.Run("sumSeries", func(t *testing.T) {
+		result := render(t, "sumSeries(otel.*.*.span_count)")
+		if len(result) != 1 || firstValue(result[0]) != 16 {
+			t.Errorf("Expected one series starting at 16, got %v", result)
+		}
+	})
+
+	t.Run("groupByNode", func(t *testing.T) {
+		result := render(t, "groupByNode(otel.*.*.span_count, 1, 'sum')")
+		if len(result) != 2 || result[0]["target"] != "svc1" || firstValue(result[0]) != 11 {
+			t.Errorf("Expected svc1 and svc2 groups, got %v", result)
+		}
+	})
+
+	t.Run("scale and alias", func(t *testing.T) {
+		result := render(t, "alias(scale(otel.svc2.op1.span_count, 0.5), 'half')")
+		if len(result) != 1 || result[0]["target"] != "half" || firstValue(result[0]) != 2.5 {
+			t.Errorf("Expected scaled series named half, got %v", result)
+		}
+	})
+
+	t.Run("perSecond", func(t *testing.T) {
+		result := render(t, "perSecond(otel.svc1.op2.span_count)")
+		if points := result[0]["datapoints"].([]interface{}); len(points) != 3 || firstValue(result[0]) != 10.0/60 {
+			t.Errorf("Expected 3 rates of 10/60, got %v", points)
+		}
+	})
+
+	t.Run("summarize", func(t *testing.T) {
+		result := render(t, "summarize(otel.svc2.op1.span_count, '1h', 'sum')")
+		var total float64
+		for _, p := range result[0]["datapoints"].([]interface{}) {
+			total += p.([]interface{})[0].(float64)
+		}
+		if total != 20 {
+			t.Errorf("Expected hourly sums totalling 20, got %v", total)
+		}
+	})
+
+	t.Run("movingAverage", func(t *testing.T) {
+		result := render(t, "movingAverage(otel.svc1.op1.span_count, 2)")
+		points := result[0]["datapoints"].([]interface{})
+		if last := points[len(points)-1].([]interface{})[0].(float64); last != 3.5 {
+			t.Errorf("Expected last moving average 3.5, got %v", last)
+		}
+	})
+
+	t.Run("highestCurrent and sortByMaxima", func(t *testing.T) {
+		result := render(t, "highestCurrent(otel.*.*.span_count, 2)")
+		if len(result) != 2 || result[0]["target"] != "otel.svc1.op2.span_count" || result[1]["target"] != "otel.svc2.op1.span_count" {
+			t.Errorf("Unexpected highestCurrent result %v", result)
+		}
+		result = render(t, "sortByMaxima(otel.*.*.span_count)")
+		if len(result) != 3 || result[2]["target"] != "otel.svc1.op1.span_count" {
+			t.Errorf("Unexpected sortByMaxima order %v", result)
+		}
+	})
+
+	for _, bad := range []string{"noSuchFunction(otel.*)", "scale(otel.*, 'x')", "sumSeries(otel.*"} {
+		req := httptest.NewRequest("GET", "/render?target="+url.QueryEscape(bad), nil)
+		w := httptest.NewRecorder()
+		exp.handleRenderMetrics(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", bad, w.Code)
+		}
+	}
+}
+
+func TestGraphiteTags(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	ctx := context.Background()
+	now := time.Now().Unix()
+	exp.store.InsertMetric(ctx, "requests", 1, now-10, map[string]string{"service": "checkout", "http.route": "/pay"})
+	exp.store.InsertMetric(ctx, "requests", 2, now, map[string]string{"service": "checkout", "http.route": "/pay"})
+	exp.store.InsertMetric(ctx, "requests", 5, now, map[string]string{"service": "checkout", "http.route": "/health"})
+	exp.store.InsertMetric(ctx, "requests", 7, now, map[string]string{"service": "payments", "http.route": "/refund"})
+
+	get := func(t *testing.T, path string, handler http.HandlerFunc) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	t.Run("seriesByTag", func(t *testing.T) {
+		target := url.QueryEscape("seriesByTag('name=requests', 'service=checkout', 'http.route!=~/health')")
+		code, body := get(t, "/render?from=-1h&target="+target, exp.handleRenderMetrics)
+		var result []map[string]interface{}
+		json.Unmarshal([]byte(body), &result)
+		if code != http.StatusOK || len(result) != 1 {
+			t.Fatalf("Expected one series, got %d %s", code, body)
+		}
+		if result[0]["target"] != "requests;http.route=/pay;service=checkout" {
+			t.Errorf("Unexpected tagged name %v", result[0]["target"])
+		}
+		if points := result[0]["datapoints"].([]interface{}); len(points) != 2 {
+			t.Errorf("Expected 2 datapoints, got %d", len(points))
+		}
+	})
+
+	t.Run("aliasByTags", func(t *testing.T) {
+		target := url.QueryEscape("aliasByTags(seriesByTag('http.route=~/'), 'service', 'http.route')")
+		_, body := get(t, "/render?from=-1h&target="+target, exp.handleRenderMetrics)
+		var result []map[string]interface{}
+		json.Unmarshal([]byte(body), &result)
+		if len(result) != 3 || result[0]["target"] != "checkout./health" {
+			t.Errorf("Unexpected aliased series %s", body)
+		}
+	})
+
+	t.Run("only negative expressions", func(t *testing.T) {
+		target := url.QueryEscape("seriesByTag('service!=checkout')")
+		if code, _ := get(t, "/render?target="+target, exp.handleRenderMetrics); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("autoComplete tags", func(t *testing.T) {
+		code, body := get(t, "/tags/autoComplete/tags?expr="+url.QueryEscape("service=checkout"), exp.handleTagsAutoCompleteTags)
+		if code != http.StatusOK || body != `["http.route","name"]` {
+			t.Errorf("Unexpected tags %d %s", code, body)
+		}
+		_, body = get(t, "/tags/autoComplete/tags?tagPrefix=se", exp.handleTagsAutoCompleteTags)
+		if body != `["service"]` {
+			t.Errorf("Unexpected prefixed tags %s", body)
+		}
+	})
+
+	t.Run("autoComplete values", func(t *testing.T) {
+		code, body := get(t, "/tags/autoComplete/values?tag=http.route&valuePrefix=/p", exp.handleTagsAutoCompleteValues)
+		if code != http.StatusOK || body != `["/pay"]` {
+			t.Errorf("Unexpected values %d %s", code, body)
+		}
+		_, body = get(t, "/tags/autoComplete/values?tag=service&expr="+url.QueryEscape("http.route=/refund"), exp.handleTagsAutoCompleteValues)
+		if body != `["payments"]` {
+			t.Errorf("Unexpected filtered values %s", body)
+		}
+		if code, _ := get(t, "/tags/autoComplete/values", exp.handleTagsAutoCompleteValues); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 without tag, got %d", code)
+		}
+	})
+}
+
+func TestParseTagExpr(t *testing.T) {
+	tests := []struct {
+		expr    string
+		key, op string
+		value   string
+	}{
+		{"service=checkout", "service", "=", "checkout"},
+		{"service!=checkout", "service", "!=", "checkout"},
+		{"http.route=~/api/.*", "http.route", "=~", "/api/.*"},
+		{"http.route!=~/health", "http.route", "!=~", "/health"},
+		{"name=", "name", "=", ""},
+	}
+	for _, tt := range tests {
+		te, err := parseTagExpr(tt.expr)
+		if err != nil {
+			t.Errorf("parseTagExpr(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if te.key != tt.key || te.op != tt.op || te.value != tt.value {
+			t.Errorf("parseTagExpr(%q) = %s %s %s, want %s %s %s", tt.expr, te.key, te.op, te.value, tt.key, tt.op, tt.value)
+		}
+	}
+	for _, bad := range []string{"service", "=checkout", "!=x", "a=~("} {
+		if _, err := parseTagExpr(bad); err == nil {
+			t.Errorf("parseTagExpr(%q) expected error", bad)
+		}
+	}
+}
+
+func TestParseRenderTarget(t *testing.T) {
+	expr, err := parseRenderTarget(`aliasSub(sumSeries(otel.{a,b}.*.count, otel.c), "x,(y)", '$1')`)
+	if err != nil {
+		t.Fatalf("parseRenderTarget() error = %v", err)
+	}
+	if expr.call != "aliasSub" || len(expr.args) != 3 {
+		t.Fatalf("Expected aliasSub with 3 args, got %+v", expr)
+	}
+	inner := expr.args[0]
+	if inner.call != "sumSeries" || len(inner.args) != 2 || inner.args[0].path != "otel.{a,b}.*.count" {
+		t.Errorf("Unexpected inner call %+v", inner)
+	}
+	if !expr.args[1].isStr || expr.args[1].str != "x,(y)" {
+		t.Errorf("Expected quoted string with delimiters, got %+v", expr.args[1])
+	}
+
+	for _, bad := range []string{"", "sumSeries(", "scale(a, 'x", "a)b"} {
+		if _, err := parseRenderTarget(bad); err == nil {
+			t.Errorf("parseRenderTarget(%q) expected error", bad)
+		}
+	}
+}
+
 func TestAliasByNode(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -1425,58 +2398,446 @@ func TestExtractServiceFromTags(t *testing.T) {
 	}
 }
 
-func TestExtractServiceFromTraceQL(t *testing.T) {
+func TestParseTraceQL(t *testing.T) {
+	eq := func(scope tracestore.FieldScope, name string, value interface{}) *tracestore.SpanCondition {
+		return &tracestore.SpanCondition{Field: tracestore.SpanField{Scope: scope, Name: name}, Compare: tracestore.CompareEq, Value: value}
+	}
 	tests := []struct {
-		query    string
-		expected string
+		query string
+		want  *tracestore.TraceFilter
 	}{
-		{`{resource.service.name="myservice"}`, "myservice"},
-		{`{resource.service.name = "spaced"}`, "spaced"},
-		{`{span.name="op"}`, ""},
-		{"", ""},
+		{``, &tracestore.TraceFilter{}},
+		{`{}`, &tracestore.TraceFilter{}},
+		{`{resource.service.name="myservice"}`, &tracestore.TraceFilter{Spanset: eq(tracestore.ScopeResource, "service.name", "myservice")}},
+		{`{ span.http.status_code = 500 }`, &tracestore.TraceFilter{Spanset: eq(tracestore.ScopeSpan, "http.status_code", int64(500))}},
+		{`{.cache.hit = true}`, &tracestore.TraceFilter{Spanset: eq(tracestore.ScopeAny, "cache.hit", true)}},
+		{`{status = error}`, &tracestore.TraceFilter{Spanset: eq(tracestore.ScopeIntrinsic, "status", int64(2))}},
+		{`{kind = server}`, &tracestore.TraceFilter{Spanset: eq(tracestore.ScopeIntrinsic, "kind", "server")}},
+		{`{duration > 100ms}`, &tracestore.TraceFilter{Spanset: &tracestore.SpanCondition{
+			Field: tracestore.SpanField{Scope: tracestore.ScopeIntrinsic, Name: "duration"}, Compare: tracestore.CompareGt, Value: int64(100 * time.Millisecond)}}},
+		{`{span.ratio <= 0.5}`, &tracestore.TraceFilter{Spanset: &tracestore.SpanCondition{
+			Field: tracestore.SpanField{Scope: tracestore.ScopeSpan, Name: "ratio"}, Compare: tracestore.CompareLte, Value: 0.5}}},
+		{`{name =~ "GET .*"}`, &tracestore.TraceFilter{Spanset: &tracestore.SpanCondition{
+			Field: tracestore.SpanField{Scope: tracestore.ScopeIntrinsic, Name: "name"}, Compare: tracestore.CompareRegex, Value: "GET .*"}}},
+		{`{.b="1" || .c="2" && .d="3"}`, &tracestore.TraceFilter{Spanset: &tracestore.SpanCondition{Op: tracestore.OpOr,
+			Left:  eq(tracestore.ScopeAny, "b", "1"),
+			Right: &tracestore.SpanCondition{Op: tracestore.OpAnd, Left: eq(tracestore.ScopeAny, "c", "2"), Right: eq(tracestore.ScopeAny, "d", "3")}}}},
+		{`{.a="1"} && ({.b="2"} || {})`, &tracestore.TraceFilter{Op: tracestore.OpAnd,
+			Left: &tracestore.TraceFilter{Spanset: eq(tracestore.ScopeAny, "a", "1")},
+			Right: &tracestore.TraceFilter{Op: tracestore.OpOr,
+				Left:  &tracestore.TraceFilter{Spanset: eq(tracestore.ScopeAny, "b", "2")},
+				Right: &tracestore.TraceFilter{}}}},
+		{`{(.a="1" || .b="2") && .c="3"}`, &tracestore.TraceFilter{Spanset: &tracestore.SpanCondition{Op: tracestore.OpAnd,
+			Left:  &tracestore.SpanCondition{Op: tracestore.OpOr, Left: eq(tracestore.ScopeAny, "a", "1"), Right: eq(tracestore.ScopeAny, "b", "2")},
+			Right: eq(tracestore.ScopeAny, "c", "3")}}},
 	}
-
 	for _, tt := range tests {
-		t.Run(tt.query, func(t *testing.T) {
-			result := extractServiceFromTraceQL(tt.query)
-			if result != tt.expected {
-				t.Errorf("extractServiceFromTraceQL(%q) = %q, want %q", tt.query, result, tt.expected)
+		got, err := parseTraceQL(tt.query)
+		if err != nil {
+			t.Errorf("parseTraceQL(%q) error = %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTraceQL(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{
+		`{.a="1"`,
+		`{a.b="1"}`,
+		`{status = broken}`,
+		`{duration > 100}`,
+		`{.a =~ 5}`,
+		`{.a="1"} | count() > 2`,
+		`{.a="1"} >> {.b="2"}`,
+		`{.a = "unterminated}`,
+		`{.a ? "x"}`,
+	} {
+		if _, err := parseTraceQL(query); err == nil {
+			t.Errorf("parseTraceQL(%q) expected error", query)
+		}
+	}
+}
+
+func TestSearchTraceQL(t *testing.T) {
+	// Protobuf rows answer TraceQL from their header and decoded payload
+	for _, format := range []string{storageFormatJSON, storageFormatProtobuf} {
+		t.Run(format, func(t *testing.T) {
+			ctx := context.Background()
+			exp := newTestExporter(t)
+			defer exp.shutdown(ctx)
+			exp.config.StorageFormat = format
+
+			if err := exp.pushTraces(ctx, newStorageFormatTraces(3)); err != nil {
+				t.Fatalf("pushTraces() error = %v", err)
+			}
+
+			search := func(traceQL string) (int, int) {
+				req := httptest.NewRequest("GET", "/api/search?q="+url.QueryEscape(traceQL), nil)
+				w := httptest.NewRecorder()
+				exp.handleSearchTraces(w, req)
+				var resp struct {
+					Traces []map[string]interface{} `json:"traces"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &resp)
+				return w.Code, len(resp.Traces)
+			}
+
+			for query, want := range map[string]int{
+				`{resource.service.name="format-svc" && span.http.method="GET"}`: 1,
+				`{duration >= 5ms && kind = server}`:                             1,
+				`{kind = client}`:                                                0,
+				`{duration > 1s}`:                                                0,
+				`{status = error}`:                                               0,
+				`{statusMessage = ""}`:                                           1,
+				`{name =~ "op-[12]"} && {name = "op-0"}`:                         1,
+				`{span.http.status_code != 200}`:                                 0,
+				`{resource.host.name = "node-1" && .http.url =~ ".*page=2"}`:     1,
+			} {
+				if code, got := search(query); code != http.StatusOK || got != want {
+					t.Errorf("%s: expected %d traces, got %d (status %d)", query, want, got, code)
+				}
+			}
+
+			if code, _ := search(`{.a="1"} | count() > 1`); code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for unsupported pipeline, got %d", code)
 			}
 		})
 	}
 }
 
-func TestToOTLPAnyValue(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    interface{}
-		expected string // expected value key
-	}{
-		{"string", "hello", "stringValue"},
-		{"int", int(42), "intValue"},
-		{"int64", int64(42), "intValue"},
-		{"float64", float64(3.14), "doubleValue"},
-		{"float64 whole", float64(42.0), "intValue"}, // whole numbers become intValue
-		{"bool", true, "boolValue"},
-		{"nil", nil, "stringValue"}, // nil becomes stringValue with "<nil>"
+func TestSearchSpanSets(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(3)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := toOTLPAnyValue(tt.input)
-			if result == nil {
-				t.Errorf("toOTLPAnyValue(%v) = nil, want non-nil", tt.input)
-			} else if _, ok := result[tt.expected]; !ok {
-				t.Errorf("toOTLPAnyValue(%v) = %v, missing key %q", tt.input, result, tt.expected)
-			}
-		})
+	type spanSet struct {
+		Spans []struct {
+			SpanID        string `json:"spanID"`
+			Name          string `json:"name"`
+			DurationNanos string `json:"durationNanos"`
+			Attributes    []struct {
+				Key   string                 `json:"key"`
+				Value map[string]interface{} `json:"value"`
+			} `json:"attributes"`
+		} `json:"spans"`
+		Matched int `json:"matched"`
+	}
+	search := func(path string) []spanSet {
+		t.Helper()
+		w := httptest.NewRecorder()
+		exp.handleSearchTraces(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Traces []struct {
+				SpanSets []spanSet `json:"spanSets"`
+				SpanSet  *spanSet  `json:"spanSet"`
+			} `json:"traces"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(resp.Traces) != 1 || resp.Traces[0].SpanSet == nil {
+			t.Fatalf("%s: expected one trace with a span set, got %s", path, w.Body.String())
+		}
+		return resp.Traces[0].SpanSets
+	}
+
+	sets := search("/api/v2/search?spss=1&q=" + url.QueryEscape(`{name =~ "op-[12]" && span.http.status_code = 200}`))
+	if len(sets) != 1 || sets[0].Matched != 2 || len(sets[0].Spans) != 1 {
+		t.Fatalf("Expected 1 of 2 matched spans, got %+v", sets)
+	}
+	span := sets[0].Spans[0]
+	if span.Name != "op-1" || span.SpanID != "0102030405060702" || span.DurationNanos != "5000000" || len(span.Attributes) != 2 {
+		t.Fatalf("Unexpected span %+v", span)
+	}
+	if span.Attributes[0].Key != "service.name" || span.Attributes[0].Value["stringValue"] != "format-svc" ||
+		span.Attributes[1].Key != "http.status_code" || span.Attributes[1].Value["intValue"] != "200" {
+		t.Errorf("Unexpected attributes %+v", span.Attributes)
+	}
+
+	if sets := search("/api/search?service=format-svc"); len(sets) != 1 || sets[0].Matched != 3 || len(sets[0].Spans) != defaultSpansPerSpanSet {
+		t.Errorf("Expected every span to match a plain search, got %+v", sets)
+	}
+
+	w := httptest.NewRecorder()
+	exp.handleSearchTraces(w, httptest.NewRequest("GET", "/api/v2/search?spss=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for spss=0, got %d", w.Code)
 	}
 }
 
-func TestToOTLPSpan(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    map[string]interface{}
+// recordingStream is a grpc.ServerStream that keeps the messages sent on it
+type recordingStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []interface{}
+}
+
+func (s *recordingStream) Context() context.Context { return s.ctx }
+
+func (s *recordingStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+func TestStreamingQuery(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+	exp.config.StreamingQuery.BatchSize = 2
+
+	for i := 0; i < 5; i++ {
+		td := newStorageFormatTraces(2)
+		forEachStorageSpan(td, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+			span.SetTraceID(pcommon.TraceID([16]byte{15: byte(i + 1)}))
+		})
+		if err := exp.pushTraces(ctx, td); err != nil {
+			t.Fatalf("pushTraces() error = %v", err)
+		}
+	}
+	service := &streamingQueryService{e: exp}
+
+	t.Run("search", func(t *testing.T) {
+		stream := &recordingStream{ctx: ctx}
+		req := &tempoSearchRequest{Limit: 5, SpansPerSpanSet: 1, Query: `{ span.http.status_code = 200 }`}
+		if err := service.Search(req, stream); err != nil {
+			t.Fatalf("Search() error = %v", err)
+		}
+		if len(stream.sent) != 3 {
+			t.Fatalf("Expected 3 messages of at most 2 traces, got %d", len(stream.sent))
+		}
+		seen := map[string]bool{}
+		for i, m := range stream.sent {
+			resp := m.(*tempoSearchResponse)
+			if resp.Metrics.CompletedJobs != uint32(i+1) || resp.Metrics.InspectedTraces != uint32(min(2*(i+1), 5)) {
+				t.Errorf("Message %d: unexpected metrics %+v", i, *resp.Metrics)
+			}
+			for _, trace := range resp.Traces {
+				if seen[trace.TraceID] {
+					t.Errorf("Trace %s sent twice", trace.TraceID)
+				}
+				seen[trace.TraceID] = true
+				if len(trace.SpanSets) != 1 || trace.SpanSets[0].Matched != 2 || len(trace.SpanSets[0].Spans) != 1 {
+					t.Errorf("Unexpected span sets for %s: %+v", trace.TraceID, trace.SpanSets)
+				}
+			}
+		}
+		if last := stream.sent[2].(*tempoSearchResponse).Metrics; last.TotalJobs != last.CompletedJobs {
+			t.Errorf("Expected the last message to complete every job, got %+v", *last)
+		}
+		if len(seen) != 5 {
+			t.Errorf("Expected 5 traces, got %d", len(seen))
+		}
+	})
+
+	t.Run("invalid query", func(t *testing.T) {
+		err := service.Search(&tempoSearchRequest{Query: "{"}, &recordingStream{ctx: ctx})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument, got %v", err)
+		}
+	})
+
+	t.Run("tag values", func(t *testing.T) {
+		stream := &recordingStream{ctx: ctx}
+		req := &tempoSearchTagValuesRequest{TagName: "name", Query: `{ resource.service.name = "format-svc" }`}
+		if err := service.SearchTagValuesV2(req, stream); err != nil {
+			t.Fatalf("SearchTagValuesV2() error = %v", err)
+		}
+		var values []string
+		for _, m := range stream.sent {
+			for _, v := range m.(*tempoSearchTagValuesV2Response).TagValues {
+				values = append(values, v.Value)
+			}
+		}
+		if len(stream.sent) != 1 || !reflect.DeepEqual(values, []string{"op-0", "op-1"}) {
+			t.Errorf("Unexpected tag values %v in %d messages", values, len(stream.sent))
+		}
+
+		err := service.SearchTagValues(&tempoSearchTagValuesRequest{TagName: "duration"}, &recordingStream{ctx: ctx})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Expected NotFound for duration, got %v", err)
+		}
+	})
+}
+
+func TestTempoCodec(t *testing.T) {
+	var entry, data []byte
+	entry = protowire.AppendString(protowire.AppendTag(entry, 1, protowire.BytesType), "http.method")
+	entry = protowire.AppendString(protowire.AppendTag(entry, 2, protowire.BytesType), "GET")
+	data = protowire.AppendBytes(protowire.AppendTag(data, 1, protowire.BytesType), entry)
+	data = protowire.AppendVarint(protowire.AppendTag(data, 2, protowire.VarintType), 100)
+	data = protowire.AppendVarint(protowire.AppendTag(data, 4, protowire.VarintType), 50)
+	data = protowire.AppendVarint(protowire.AppendTag(data, 5, protowire.VarintType), 1700000000)
+	data = protowire.AppendString(protowire.AppendTag(data, 8, protowire.BytesType), "{}")
+	// Fields gotel does not read are skipped
+	data = protowire.AppendFixed32(protowire.AppendTag(data, 20, protowire.Fixed32Type), 1)
+
+	var req tempoSearchRequest
+	if err := (tempoCodec{}).Unmarshal(data, &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	want := tempoSearchRequest{Tags: map[string]string{"http.method": "GET"}, MinDurationMs: 100, Limit: 50, Start: 1700000000, Query: "{}"}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("Unmarshal() = %+v, want %+v", req, want)
+	}
+	if err := (tempoCodec{}).Unmarshal([]byte{0x0a, 0x05}, &req); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+
+	out, err := tempoCodec{}.Marshal(&tempoSearchTagValuesV2Response{TagValues: []tempoTagValue{{Type: "string", Value: "GET"}}})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var value []byte
+	value = protowire.AppendString(protowire.AppendTag(value, 1, protowire.BytesType), "string")
+	value = protowire.AppendString(protowire.AppendTag(value, 2, protowire.BytesType), "GET")
+	if want := protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), value); !bytes.Equal(out, want) {
+		t.Errorf("Marshal() = %x, want %x", out, want)
+	}
+}
+
+func TestTraceQLMetrics(t *testing.T) {
+	for _, query := range []string{
+		`{} | rate()`,
+		`{ resource.service.name = "api" } | count_over_time() by (span.http.method, name)`,
+		`{} | quantile_over_time(duration, .5, 0.99)`,
+	} {
+		if _, err := parseTraceQLMetrics(query); err != nil {
+			t.Errorf("parseTraceQLMetrics(%q) error = %v", query, err)
+		}
+	}
+	for _, query := range []string{
+		`{}`,
+		`{} | sum()`,
+		`{} | rate() by ()`,
+		`{} | quantile_over_time(duration)`,
+		`{} | quantile_over_time(span.size, .5)`,
+		`{} | quantile_over_time(duration, 2)`,
+		`{.a="1"} && {.b="2"} | rate()`,
+		`{} | rate() > 1`,
+	} {
+		if _, err := parseTraceQLMetrics(query); err == nil {
+			t.Errorf("parseTraceQLMetrics(%q) expected error", query)
+		}
+	}
+
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	start := time.Now().Add(-5 * time.Minute).Truncate(time.Minute)
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "metrics-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+	for i, method := range []string{"GET", "GET", "GET", "POST"} {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{8, byte(i + 1)}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		span.SetName("handle")
+		span.Attributes().PutStr("http.method", method)
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(start.Add(time.Duration(i) * time.Second)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(time.Duration(i)*time.Second + time.Duration(i+1)*100*time.Millisecond)))
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	type series struct {
+		Labels []struct {
+			Key   string                 `json:"key"`
+			Value map[string]interface{} `json:"value"`
+		} `json:"labels"`
+		Samples []struct {
+			TimestampMs string  `json:"timestampMs"`
+			Value       float64 `json:"value"`
+		} `json:"samples"`
+		PromLabels string `json:"promLabels"`
+	}
+	queryRange := func(query string) []series {
+		t.Helper()
+		params := url.Values{"q": {query}, "start": {strconv.FormatInt(start.Unix(), 10)},
+			"end": {strconv.FormatInt(start.Add(2*time.Minute).Unix(), 10)}, "step": {"60s"}}
+		w := httptest.NewRecorder()
+		exp.handleTraceQLMetricsRange(w, httptest.NewRequest("GET", "/api/metrics/query_range?"+params.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", query, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Series []series `json:"series"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return resp.Series
+	}
+
+	rate := queryRange(`{resource.service.name = "metrics-service"} | rate()`)
+	if len(rate) != 1 || rate[0].PromLabels != `{__name__="rate"}` || len(rate[0].Samples) != 3 {
+		t.Fatalf("Expected one rate series over 3 buckets, got %+v", rate)
+	}
+	if rate[0].Samples[0].Value != 4.0/60 || rate[0].Samples[1].Value != 0 ||
+		rate[0].Samples[0].TimestampMs != strconv.FormatInt(start.UnixMilli(), 10) {
+		t.Errorf("Unexpected rate samples %+v", rate[0].Samples)
+	}
+
+	counts := queryRange(`{name = "handle"} | count_over_time() by (span.http.method)`)
+	if len(counts) != 2 || counts[0].PromLabels != `{span.http.method="GET"}` || counts[0].Samples[0].Value != 3 ||
+		counts[1].Labels[0].Value["stringValue"] != "POST" || counts[1].Samples[0].Value != 1 {
+		t.Errorf("Unexpected count series %+v", counts)
+	}
+
+	quantiles := queryRange(`{} | quantile_over_time(duration, 0.5, 1)`)
+	if len(quantiles) != 2 || quantiles[0].PromLabels != `{p="0.5"}` || len(quantiles[0].Samples) != 1 ||
+		quantiles[0].Samples[0].Value != 0.2 || quantiles[1].Samples[0].Value != 0.4 {
+		t.Errorf("Unexpected quantile series %+v", quantiles)
+	}
+
+	w := httptest.NewRecorder()
+	exp.handleTraceQLMetricsRange(w, httptest.NewRequest("GET", "/api/metrics/query_range?q="+url.QueryEscape("{} | rate()")+"&start=-1h&step=1ms", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for too many points, got %d", w.Code)
+	}
+}
+
+func TestToOTLPAnyValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    interface{}
+		expected string // expected value key
+	}{
+		{"string", "hello", "stringValue"},
+		{"int", int(42), "intValue"},
+		{"int64", int64(42), "intValue"},
+		{"float64", float64(3.14), "doubleValue"},
+		{"float64 whole", float64(42.0), "intValue"}, // whole numbers become intValue
+		{"bool", true, "boolValue"},
+		{"nil", nil, "stringValue"}, // nil becomes stringValue with "<nil>"
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := toOTLPAnyValue(tt.input)
+			if result == nil {
+				t.Errorf("toOTLPAnyValue(%v) = nil, want non-nil", tt.input)
+			} else if _, ok := result[tt.expected]; !ok {
+				t.Errorf("toOTLPAnyValue(%v) = %v, missing key %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestToOTLPSpan(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    map[string]interface{}
 		expected map[string]interface{}
 	}{
 		{
@@ -1628,6 +2989,3789 @@ func TestGraphiteToLikePattern(t *testing.T) {
 	}
 }
 
+func TestInstanceLabelHostname(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("hostname unavailable: %v", err)
+	}
+
+	cfg := &Config{InstanceLabel: "hostname"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if cfg.InstanceLabel != hostname {
+		t.Errorf("Expected instance label %q, got %q", hostname, cfg.InstanceLabel)
+	}
+}
+
+func TestReplicationConfigValidate(t *testing.T) {
+	cfg := &Config{Replication: ReplicationConfig{Role: "mirror"}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for invalid replication role")
+	}
+
+	cfg = &Config{Replication: ReplicationConfig{Role: replicationRoleStandby}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for standby without primary_endpoint")
+	}
+
+	cfg = &Config{Replication: ReplicationConfig{Role: replicationRolePrimary}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if cfg.Replication.ListenAddress != defaultReplicationListenAddress {
+		t.Errorf("Expected default listen address, got %q", cfg.Replication.ListenAddress)
+	}
+	if cfg.Replication.SyncInterval != defaultReplicationSyncInterval {
+		t.Errorf("Expected default sync interval, got %v", cfg.Replication.SyncInterval)
+	}
+}
+
+func TestReplicationStandbyPromote(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpFile.Name()) })
+	tmpFile.Close()
+
+	logger, _ := zap.NewDevelopment()
+	cfg := &Config{
+		DBPath:      tmpFile.Name(),
+		SendMetrics: true,
+		StoreTraces: true,
+		Replication: ReplicationConfig{
+			Role:            replicationRoleStandby,
+			ListenAddress:   "127.0.0.1:0",
+			PrimaryEndpoint: "127.0.0.1:1", // nothing listens here
+			SyncInterval:    50 * time.Millisecond,
+			Token:           "repl-secret",
+		},
+	}
+	exp, err := newSQLiteExporter(cfg, logger)
+	if err != nil {
+		t.Fatalf("newSQLiteExporter() error = %v", err)
+	}
+	if err := exp.start(context.Background(), nil); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	defer exp.shutdown(context.Background())
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "standby-service")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
+	span.SetSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+	span.SetName("standby-op")
+
+	if err := exp.pushTraces(context.Background(), td); err == nil {
+		t.Fatal("Expected standby to reject writes")
+	}
+
+	// The replication endpoints need the replication token, not query access
+	promoteRequest := func(token string) *http.Request {
+		req := httptest.NewRequest("POST", "/api/replication/promote", nil)
+		if token != "" {
+			req.Header.Set(replicationTokenHeader, token)
+		}
+		return req
+	}
+	for _, token := range []string{"", "wrong"} {
+		w := httptest.NewRecorder()
+		exp.handleReplicationPromote(w, promoteRequest(token))
+		if w.Code != http.StatusUnauthorized || !exp.replication.isStandby() {
+			t.Fatalf("Expected status 401 for token %q, got %d: %s", token, w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	exp.handleReplicationStatus(w, httptest.NewRequest("GET", "/api/replication/status", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 for status without a token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A standby that cannot listen stays a standby
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.replication.cfg.ListenAddress = busy.Addr().String()
+	w = httptest.NewRecorder()
+	exp.handleReplicationPromote(w, promoteRequest("repl-secret"))
+	busy.Close()
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status 409 when the listen address is taken, got %d: %s", w.Code, w.Body.String())
+	}
+	if !exp.replication.isStandby() {
+		t.Fatal("Expected a failed promotion to leave the node a standby")
+	}
+	if err := exp.pushTraces(context.Background(), td); err == nil {
+		t.Fatal("Expected standby to keep rejecting writes after a failed promotion")
+	}
+
+	exp.replication.cfg.ListenAddress = "127.0.0.1:0"
+	w = httptest.NewRecorder()
+	exp.handleReplicationPromote(w, promoteRequest("repl-secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var status map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status["role"] != replicationRolePrimary {
+		t.Errorf("Expected role primary after promotion, got %v", status["role"])
+	}
+
+	if err := exp.pushTraces(context.Background(), td); err != nil {
+		t.Fatalf("pushTraces() after promotion error = %v", err)
+	}
+}
+
+func TestReplicationToken(t *testing.T) {
+	primary := newTestExporter(t)
+	defer primary.shutdown(context.Background())
+	if err := primary.pushTraces(context.Background(), newStorageFormatTraces(2)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	server := newReplicator(ReplicationConfig{
+		Role:          replicationRolePrimary,
+		ListenAddress: addr,
+		SyncInterval:  20 * time.Millisecond,
+		BatchSize:     100,
+		Token:         "s3cret",
+	}, primary.store, zap.NewNop())
+	if err := server.start(); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	defer server.stop()
+
+	follow := func(token string) map[string]interface{} {
+		standby := newTestExporter(t)
+		defer standby.shutdown(context.Background())
+		r := newReplicator(ReplicationConfig{
+			Role:            replicationRoleStandby,
+			PrimaryEndpoint: addr,
+			SyncInterval:    20 * time.Millisecond,
+			BatchSize:       100,
+			Token:           configopaque.String(token),
+		}, standby.store, zap.NewNop())
+		if err := r.start(); err != nil {
+			t.Fatalf("start() error = %v", err)
+		}
+		defer r.stop()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status, err := r.status(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status["last_sync"] != nil || status["last_error"] != nil || time.Now().After(deadline) {
+				return status
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if status := follow("wrong"); !strings.Contains(fmt.Sprint(status["last_error"]), "Unauthenticated") {
+		t.Errorf("Expected a wrong token to be refused, got %v", status)
+	}
+	if status := follow("s3cret"); status["last_sync"] == nil {
+		t.Errorf("Expected the token to be accepted, got %v", status)
+	}
+
+	// Without a token the HTTP replication endpoints are refused
+	primary.replication = newReplicator(ReplicationConfig{Role: replicationRolePrimary}, primary.store, zap.NewNop())
+	w := httptest.NewRecorder()
+	primary.handleReplicationStatus(w, httptest.NewRequest("GET", "/api/replication/status", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without replication.token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	cfg := &Config{Replication: ReplicationConfig{Role: replicationRolePrimary, TLS: configoptional.Some(configtls.ServerConfig{})}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected replication.tls without a certificate to be rejected")
+	}
+}
+
+func TestLatencyBudgets(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+	exp.config.LatencyBudgets = []LatencyBudget{
+		{Service: "budget-service", Budget: time.Second},
+		{Service: "budget-service", Operation: "slow-op", Budget: 50 * time.Millisecond},
+	}
+
+	if b, ok := exp.config.latencyBudget("budget-service", "slow-op"); !ok || b != 50*time.Millisecond {
+		t.Errorf("Expected operation budget, got %v %v", b, ok)
+	}
+	if b, ok := exp.config.latencyBudget("budget-service", "other-op"); !ok || b != time.Second {
+		t.Errorf("Expected service budget, got %v %v", b, ok)
+	}
+	if _, ok := exp.config.latencyBudget("other-service", "slow-op"); ok {
+		t.Error("Expected no budget for other-service")
+	}
+
+	ctx := context.Background()
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "budget-service")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
+	span.SetSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+	span.SetName("slow-op")
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-100 * time.Millisecond)))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	metrics, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: "otel.budget-service.slow-op.over_budget_count"})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].Value != 1 {
+		t.Errorf("Expected over_budget_count=1, got %v", metrics)
+	}
+
+	req := httptest.NewRequest("GET", "/api/search?overBudget=true", nil)
+	w := httptest.NewRecorder()
+	exp.handleSearchTraces(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var result map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if traces, _ := result["traces"].([]interface{}); len(traces) != 1 {
+		t.Errorf("Expected 1 over-budget trace, got %v", result)
+	}
+
+	req = httptest.NewRequest("GET", "/api/search?overBudget=maybe", nil)
+	w = httptest.NewRecorder()
+	exp.handleSearchTraces(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid overBudget, got %d", w.Code)
+	}
+}
+
+func TestFileIngest(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	archive := t.TempDir()
+	exp.config.FileIngest = FileIngestConfig{Directory: dir, ArchiveDirectory: archive}
+	if err := exp.prepareFileIngest(); err != nil {
+		t.Fatalf("prepareFileIngest() error = %v", err)
+	}
+
+	marshal := func(service string, traceByte byte) []byte {
+		td := ptrace.NewTraces()
+		rs := td.ResourceSpans().AppendEmpty()
+		rs.Resource().Attributes().PutStr("service.name", service)
+		span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{traceByte}))
+		span.SetSpanID(pcommon.SpanID([8]byte{traceByte}))
+		span.SetName("file-op")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+		b, err := (&ptrace.JSONMarshaler{}).MarshalTraces(td)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	jsonl := append(append(marshal("file-a", 1), '\n'), marshal("file-b", 2)...)
+	os.WriteFile(filepath.Join(dir, "batch.jsonl"), jsonl, 0o644)
+	os.WriteFile(filepath.Join(dir, "single.json"), marshal("file-c", 3), 0o644)
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{not json"), 0o644)
+	os.WriteFile(filepath.Join(dir, "pending.json.tmp"), marshal("file-d", 4), 0o644)
+
+	exp.ingestDirectory(ctx)
+
+	stats, _ := exp.store.Stats(ctx)
+	if stats.SpanCount != 3 {
+		t.Errorf("Expected 3 ingested spans, got %d", stats.SpanCount)
+	}
+
+	remaining, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range remaining {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != "failed,pending.json.tmp" {
+		t.Errorf("Expected only failed/ and the .tmp file to remain, got %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed", "broken.json")); err != nil {
+		t.Errorf("Expected broken.json in failed/: %v", err)
+	}
+	archived, _ := os.ReadDir(archive)
+	if len(archived) != 2 {
+		t.Errorf("Expected 2 archived files, got %d", len(archived))
+	}
+
+	t.Run("delete without archive", func(t *testing.T) {
+		exp.config.FileIngest.ArchiveDirectory = ""
+		os.WriteFile(filepath.Join(dir, "again.json"), marshal("file-e", 5), 0o644)
+		exp.ingestDirectory(ctx)
+		if _, err := os.Stat(filepath.Join(dir, "again.json")); !os.IsNotExist(err) {
+			t.Errorf("Expected ingested file to be deleted, stat err = %v", err)
+		}
+	})
+}
+
+func TestSpanEnrichment(t *testing.T) {
+	dir := t.TempDir()
+	geoFile := filepath.Join(dir, "geoip.csv")
+	os.WriteFile(geoFile, []byte("network,country_iso_code,city_name\n"+
+		"10.0.0.0/8,US,\n"+
+		"10.1.0.0/16,PT,Lisbon\n"+
+		"2001:db8::/32,DE,Berlin\n"), 0o644)
+	nodeFile := filepath.Join(dir, "nodes.csv")
+	os.WriteFile(nodeFile, []byte("host,k8s.node.zone,k8s.node.pool\nnode-1,eu-west-1a,general\n"), 0o644)
+
+	cfgs := []EnrichmentConfig{
+		{Source: "geoip", File: geoFile},
+		{Source: "static", Attribute: "host.name", File: nodeFile, Values: map[string]map[string]string{
+			"node-2": {"k8s.node.zone": "eu-west-1b"},
+		}},
+	}
+	for i := range cfgs {
+		if err := cfgs[i].validate(); err != nil {
+			t.Fatalf("validate() error = %v", err)
+		}
+	}
+	enrichers, err := newSpanEnrichers(cfgs)
+	if err != nil {
+		t.Fatalf("newSpanEnrichers() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		span     map[string]interface{}
+		resource map[string]interface{}
+		want     map[string]interface{}
+	}{
+		{
+			name:     "most specific network and resource lookup",
+			span:     map[string]interface{}{"client.address": "10.1.2.3"},
+			resource: map[string]interface{}{"host.name": "node-1"},
+			want: map[string]interface{}{
+				"geo.country_iso_code": "PT", "geo.city_name": "Lisbon",
+				"k8s.node.zone": "eu-west-1a", "k8s.node.pool": "general",
+			},
+		},
+		{
+			name: "broader network skips empty cells",
+			span: map[string]interface{}{"client.address": "10.9.9.9:443"},
+			want: map[string]interface{}{"geo.country_iso_code": "US"},
+		},
+		{
+			name: "ipv6 and inline static values",
+			span: map[string]interface{}{"client.address": "2001:db8::1", "host.name": "node-2"},
+			want: map[string]interface{}{"geo.country_iso_code": "DE", "geo.city_name": "Berlin", "k8s.node.zone": "eu-west-1b"},
+		},
+		{
+			name: "existing attributes win",
+			span: map[string]interface{}{"client.address": "10.1.0.1", "geo.city_name": "Porto"},
+			want: map[string]interface{}{"geo.country_iso_code": "PT", "geo.city_name": "Porto"},
+		},
+		{
+			name: "no match",
+			span: map[string]interface{}{"client.address": "192.168.1.1"},
+			want: map[string]interface{}{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enrichAttributes(enrichers, tt.span, tt.resource)
+			for k, v := range tt.want {
+				if tt.span[k] != v {
+					t.Errorf("Expected %s=%v, got %v", k, v, tt.span[k])
+				}
+			}
+			if _, ok := tt.span["geo.city_name"]; ok && tt.want["geo.city_name"] == nil {
+				t.Errorf("Unexpected geo.city_name %v", tt.span["geo.city_name"])
+			}
+		})
+	}
+
+	t.Run("invalid config", func(t *testing.T) {
+		for _, c := range []EnrichmentConfig{
+			{Source: "geoip"},
+			{Source: "static", Attribute: "host.name"},
+			{Source: "dns"},
+		} {
+			if err := c.validate(); err == nil {
+				t.Errorf("Expected validation error for %+v", c)
+			}
+		}
+	})
+}
+
+func TestAttachConfigValidate(t *testing.T) {
+	cfg := &Config{Attach: []AttachConfig{{Name: "yesterday"}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for attach entry without path")
+	}
+
+	dir := t.TempDir()
+	archive, err := tracestore.New(filepath.Join(dir, "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.InsertSpan(context.Background(), []byte(`{"trace_id":"archived","span_id":"a1","service_name":"old-svc","status":{"code":0}}`))
+	archive.Close()
+
+	cfg = &Config{
+		DBPath: filepath.Join(dir, "main.db"),
+		Attach: []AttachConfig{{Name: "yesterday", Path: filepath.Join(dir, "archive.db")}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	exp, err := newSQLiteExporter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.start(context.Background(), nil); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	defer exp.shutdown(context.Background())
+
+	spans, err := exp.store.QueryTraceByID(context.Background(), "archived")
+	if err != nil || len(spans) != 1 {
+		t.Errorf("Expected archived trace through attached database, got %d spans, %v", len(spans), err)
+	}
+}
+
+func TestStorageFormatProtobuf(t *testing.T) {
+	ctx := context.Background()
+	td := newStorageFormatTraces(3)
+
+	jsonExp := newTestExporter(t)
+	defer jsonExp.shutdown(ctx)
+	protoExp := newTestExporter(t)
+	defer protoExp.shutdown(ctx)
+	protoExp.config.StorageFormat = storageFormatProtobuf
+
+	for _, exp := range []*sqliteExporter{jsonExp, protoExp} {
+		if err := exp.pushTraces(ctx, td); err != nil {
+			t.Fatalf("pushTraces() error = %v", err)
+		}
+	}
+
+	traceID := "0102030405060708090a0b0c0d0e0f10"
+	encoded, err := protoExp.store.QueryEncodedTrace(ctx, traceID)
+	if err != nil || len(encoded) != 3 || encoded[0].Payload == nil {
+		t.Fatalf("Expected 3 protobuf rows, got %d, %v", len(encoded), err)
+	}
+
+	// The header only carries what the indexed columns read
+	var header map[string]interface{}
+	if err := json.Unmarshal(encoded[0].Header, &header); err != nil {
+		t.Fatalf("Failed to decode header: %v", err)
+	}
+	for _, field := range []string{"kind", "attributes", "links"} {
+		if _, ok := header[field]; ok {
+			t.Errorf("Expected no %s in the protobuf header, got %s", field, encoded[0].Header)
+		}
+	}
+	if resource, _ := header["resource"].(map[string]interface{}); resource["host.name"] != nil {
+		t.Errorf("Expected only indexed resource attributes in the header, got %s", encoded[0].Header)
+	}
+
+	// Both formats read back as the same documents.
+	want, _ := jsonExp.store.QueryTraceByID(ctx, traceID)
+	got, _ := protoExp.store.QueryTraceByID(ctx, traceID)
+	assertSameSpanDocuments(t, want, got)
+
+	// Search works off the header columns, and decodes the payload for
+	// attributes outside indexed_attributes.
+	summaries, err := protoExp.store.SearchTraces(ctx, tracestore.TraceSearchOptions{ServiceName: "format-svc"})
+	if err != nil || len(summaries) != 1 || summaries[0].SpanCount != 3 || summaries[0].RootTraceName != "op-0" {
+		t.Errorf("Unexpected search result %+v, %v", summaries, err)
+	}
+	summaries, err = protoExp.store.SearchTraces(ctx, tracestore.TraceSearchOptions{Attributes: map[string]string{"http.method": "GET", "cache.hit": "true"}})
+	if err != nil || len(summaries) != 1 {
+		t.Errorf("Expected a search by unindexed attributes to find the trace, got %+v, %v", summaries, err)
+	}
+
+	// Protobuf responses are the stored payloads, concatenated.
+	for _, exp := range []*sqliteExporter{jsonExp, protoExp} {
+		req := httptest.NewRequest("GET", "/api/traces/"+traceID, nil)
+		req.Header.Set("Accept", "application/protobuf")
+		w := httptest.NewRecorder()
+		exp.handleGetTrace(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/protobuf" {
+			t.Fatalf("Expected protobuf response, got %d %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		decoded, err := (&ptrace.ProtoUnmarshaler{}).UnmarshalTraces(w.Body.Bytes())
+		if err != nil || decoded.SpanCount() != 3 {
+			t.Errorf("Expected 3 spans in protobuf body, got %d, %v", decoded.SpanCount(), err)
+		}
+	}
+	req := httptest.NewRequest("GET", "/api/v2/traces/"+traceID, nil)
+	req.Header.Set("Accept", "application/protobuf")
+	w := httptest.NewRecorder()
+	protoExp.handleGetTrace(w, req)
+	if body := w.Body.Bytes(); len(body) < 2 || body[0] != 0x0a {
+		t.Errorf("Expected v2 protobuf response wrapped in field 1, got % x", body[:min(len(body), 4)])
+	}
+	if w.Header().Get("Vary") != "Accept" {
+		t.Errorf("Expected Vary: Accept, got %q", w.Header().Get("Vary"))
+	}
+}
+
+func TestWantsProtobuf(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                       false,
+		"application/json":                       false,
+		"application/protobuf":                   true,
+		"application/x-protobuf":                 true,
+		"application/json, application/protobuf": true,
+		"application/protobuf;q=0.5, application/json": false,
+		"application/protobuf, application/json;q=0.9": true,
+		"application/protobuf;q=0":                     false,
+		"*/*, application/protobuf;q=0.1":              false,
+		"application/protobuf, */*":                    true,
+		"application/protobuf;q=bad, application/json": false,
+	} {
+		req := httptest.NewRequest("GET", "/api/traces/0102", nil)
+		req.Header.Set("Accept", accept)
+		if got := wantsProtobuf(req); got != want {
+			t.Errorf("wantsProtobuf(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestStorageFormatMigration(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+	traceID := "0102030405060708090a0b0c0d0e0f10"
+
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(5)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	before, _ := exp.store.QueryTraceByID(ctx, traceID)
+
+	exp.config.StorageFormat = storageFormatProtobuf
+	exp.wg.Add(1)
+	exp.runStorageMigration()
+	encoded, _ := exp.store.QueryEncodedTrace(ctx, traceID)
+	for _, row := range encoded {
+		if row.Payload == nil {
+			t.Fatal("Expected every row migrated to protobuf")
+		}
+	}
+	after, _ := exp.store.QueryTraceByID(ctx, traceID)
+	assertSameSpanDocuments(t, before, after)
+
+	exp.config.StorageFormat = storageFormatJSON
+	exp.wg.Add(1)
+	exp.runStorageMigration()
+	encoded, _ = exp.store.QueryEncodedTrace(ctx, traceID)
+	for _, row := range encoded {
+		if row.Payload != nil {
+			t.Fatal("Expected every row migrated back to JSON")
+		}
+	}
+	back, _ := exp.store.QueryTraceByID(ctx, traceID)
+	assertSameSpanDocuments(t, before, back)
+
+	cfg := &Config{StorageFormat: "xml"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for unknown storage_format")
+	}
+}
+
+func TestSpanDocumentUpgrade(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(1)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	pushed, _ := exp.store.QueryEncodedTrace(ctx, "0102030405060708090a0b0c0d0e0f10")
+	if len(pushed) != 1 || !strings.Contains(string(pushed[0].Header), `"v":1`) {
+		t.Fatalf("Expected new spans stored at version %d, got %s", spanDocVersion, pushed)
+	}
+
+	// An unversioned document lacking kind and duration, and one from a
+	// newer version with a field this one does not know
+	old := []byte(`{"trace_id":"old-trace","span_id":"a","service_name":"svc","span_name":"op","start_time_unix_nano":1000000,"end_time_unix_nano":3000000,"status":{"code":2}}`)
+	future := []byte(`{"v":99,"trace_id":"old-trace","span_id":"b","service_name":"svc","span_name":"op","start_time_unix_nano":1500000,"end_time_unix_nano":2000000,"kind":"Server","status":{"code":0},"shape":"new"}`)
+	if err := exp.store.InsertData(ctx, [][]byte{old, future}, nil); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+
+	check := func(spans []json.RawMessage) {
+		t.Helper()
+		if len(spans) != 2 {
+			t.Fatalf("Expected 2 spans, got %d", len(spans))
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(spans[0], &doc); err != nil {
+			t.Fatal(err)
+		}
+		status, _ := doc["status"].(map[string]interface{})
+		if doc["v"] != float64(spanDocVersion) || doc["kind"] != "Unspecified" || doc["duration_ms"] != float64(2) || status["code"] != float64(2) {
+			t.Errorf("Unexpected upgraded document: %s", spans[0])
+		}
+		if string(spans[1]) != string(future) {
+			t.Errorf("Expected the newer document as stored, got %s", spans[1])
+		}
+	}
+
+	// Readers see the upgraded document before the row is rewritten...
+	spans, err := exp.store.QueryTraceByID(ctx, "old-trace")
+	if err != nil {
+		t.Fatalf("QueryTraceByID() error = %v", err)
+	}
+	check(spans)
+
+	// ...and the rewriter upgrades the row itself, so json_extract sees it
+	exp.wg.Add(1)
+	exp.runSpanUpgrade()
+	rows, _ := exp.store.QueryEncodedTrace(ctx, "old-trace")
+	if len(rows) != 2 || !strings.Contains(string(rows[0].Header), `"kind":"Unspecified"`) {
+		t.Fatalf("Expected the stored row rewritten, got %s", rows)
+	}
+	spans, _ = exp.store.QueryTraceByID(ctx, "old-trace")
+	check(spans)
+}
+
+func BenchmarkSpanStorageFormat(b *testing.B) {
+	td := newStorageFormatTraces(100)
+	sizes := make(map[string]int)
+	for _, format := range []string{storageFormatJSON, storageFormatProtobuf} {
+		exp := &sqliteExporter{config: &Config{StorageFormat: format}, logger: zap.NewNop()}
+
+		b.Run(format+"/encode", func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				size = 0
+				forEachStorageSpan(td, func(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+					stored, err := exp.storeSpan(span, resource, scope, "")
+					if err != nil {
+						b.Fatal(err)
+					}
+					size += len(stored.Header) + len(stored.Payload)
+				})
+			}
+			sizes[format] = size
+			b.ReportMetric(float64(size)/float64(td.SpanCount()), "bytes/span")
+		})
+
+		b.Run(format+"/read", func(b *testing.B) {
+			store, err := tracestore.New(filepath.Join(b.TempDir(), "bench.db"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.Close()
+			store.SetSpanDecoder(decodeSpanPayload)
+			var spans []tracestore.EncodedSpan
+			forEachStorageSpan(td, func(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+				stored, _ := exp.storeSpan(span, resource, scope, "")
+				spans = append(spans, stored)
+			})
+			if err := store.InsertEncodedData(context.Background(), spans, nil); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := store.QueryTraceByID(context.Background(), "0102030405060708090a0b0c0d0e0f10"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	// The point of the protobuf format: header and payload together must be
+	// smaller than the JSON document
+	if jsonSize, protoSize := sizes[storageFormatJSON], sizes[storageFormatProtobuf]; jsonSize > 0 && protoSize >= jsonSize {
+		b.Errorf("Expected protobuf rows smaller than JSON, got %d bytes against %d", protoSize, jsonSize)
+	}
+}
+
+// newStorageFormatTraces builds one trace of n spans with attributes, events
+// and links, so storage formats are compared on realistic spans.
+func newStorageFormatTraces(n int) ptrace.Traces {
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "format-svc")
+	rs.Resource().Attributes().PutStr("service.version", "1.2.3")
+	rs.Resource().Attributes().PutStr("host.name", "node-1")
+	ss := rs.ScopeSpans().AppendEmpty()
+	ss.Scope().SetName("format-scope")
+	ss.Scope().SetVersion("0.1.0")
+
+	start := time.Unix(1700000000, 0)
+	traceID := pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	for i := 0; i < n; i++ {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(traceID)
+		span.SetSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, byte(i + 1)}))
+		if i > 0 {
+			span.SetParentSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 1}))
+		}
+		span.SetName(fmt.Sprintf("op-%d", i))
+		span.SetKind(ptrace.SpanKindServer)
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(start.Add(time.Duration(i) * time.Millisecond)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(time.Duration(i+5) * time.Millisecond)))
+		span.Status().SetCode(ptrace.StatusCodeOk)
+		span.Attributes().PutStr("http.method", "GET")
+		span.Attributes().PutStr("http.url", "https://example.com/api/items?page=2")
+		span.Attributes().PutInt("http.status_code", 200)
+		span.Attributes().PutBool("cache.hit", i%2 == 0)
+		event := span.Events().AppendEmpty()
+		event.SetName("exception")
+		event.SetTimestamp(span.StartTimestamp())
+		event.Attributes().PutStr("exception.type", "TimeoutError")
+		link := span.Links().AppendEmpty()
+		link.SetTraceID(traceID)
+		link.SetSpanID(pcommon.SpanID([8]byte{8, 7, 6, 5, 4, 3, 2, 1}))
+	}
+	return td
+}
+
+func forEachStorageSpan(td ptrace.Traces, fn func(ptrace.Span, pcommon.Resource, pcommon.InstrumentationScope)) {
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		rs := td.ResourceSpans().At(i)
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			ss := rs.ScopeSpans().At(j)
+			for k := 0; k < ss.Spans().Len(); k++ {
+				fn(ss.Spans().At(k), rs.Resource(), ss.Scope())
+			}
+		}
+	}
+}
+
+func assertSameSpanDocuments(t *testing.T, want, got []json.RawMessage) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("Expected %d spans, got %d", len(want), len(got))
+	}
+	for i := range want {
+		var w, g interface{}
+		json.Unmarshal(want[i], &w)
+		json.Unmarshal(got[i], &g)
+		wj, _ := json.Marshal(w)
+		gj, _ := json.Marshal(g)
+		if string(wj) != string(gj) {
+			t.Errorf("Span %d differs:\nwant %s\ngot  %s", i, wj, gj)
+		}
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+	ctx := context.Background()
+
+	ts := pcommon.NewTimestampFromTime(time.Unix(1700000000, 0))
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "checkout")
+	metrics := rm.ScopeMetrics().AppendEmpty().Metrics()
+
+	gauge := metrics.AppendEmpty()
+	gauge.SetName("queue.depth")
+	dp := gauge.SetEmptyGauge().DataPoints().AppendEmpty()
+	dp.SetTimestamp(ts)
+	dp.SetIntValue(7)
+	dp.Attributes().PutStr("queue", "orders")
+
+	sum := metrics.AppendEmpty()
+	sum.SetName("http.server.requests")
+	sdp := sum.SetEmptySum().DataPoints().AppendEmpty()
+	sdp.SetTimestamp(ts)
+	sdp.SetDoubleValue(42.5)
+
+	hist := metrics.AppendEmpty()
+	hist.SetName("http.server.request.duration")
+	hdp := hist.SetEmptyHistogram().DataPoints().AppendEmpty()
+	hdp.SetTimestamp(ts)
+	hdp.SetCount(6)
+	hdp.SetSum(1.5)
+	hdp.SetMax(0.9)
+	hdp.ExplicitBounds().FromRaw([]float64{0.1, 0.5})
+	hdp.BucketCounts().FromRaw([]uint64{3, 2, 1})
+
+	ehist := metrics.AppendEmpty()
+	ehist.SetName("rpc.duration")
+	edp := ehist.SetEmptyExponentialHistogram().DataPoints().AppendEmpty()
+	edp.SetTimestamp(ts)
+	edp.SetCount(4)
+	edp.SetSum(2)
+
+	summary := metrics.AppendEmpty()
+	summary.SetName("legacy.summary")
+	summary.SetEmptySummary().DataPoints().AppendEmpty().SetCount(1)
+
+	if err := exp.pushMetrics(ctx, md); err != nil {
+		t.Fatalf("pushMetrics() error = %v", err)
+	}
+
+	tr := timeRange{from: time.Unix(1699999000, 0), until: time.Unix(1700001000, 0)}
+	want := map[string]float64{
+		"otel.checkout.queue.depth.queue-orders":                   7,
+		"otel.checkout.http.server.requests":                       42.5,
+		"otel.checkout.http.server.request.duration.count":         6,
+		"otel.checkout.http.server.request.duration.sum":           1.5,
+		"otel.checkout.http.server.request.duration.max":           0.9,
+		"otel.checkout.http.server.request.duration.bucket.le_0_1": 3,
+		"otel.checkout.http.server.request.duration.bucket.le_0_5": 5,
+		"otel.checkout.http.server.request.duration.bucket.le_inf": 6,
+		"otel.checkout.rpc.duration.count":                         4,
+		"otel.checkout.rpc.duration.sum":                           2,
+	}
+	for name, value := range want {
+		series, err := exp.queryMetricSeries(ctx, name, seriesQuery{tr: tr})
+		if err != nil {
+			t.Fatalf("queryMetricSeries(%s) error = %v", name, err)
+		}
+		points := series[name]
+		if len(points) != 1 {
+			t.Errorf("%s: expected 1 point, got %v", name, points)
+			continue
+		}
+		if got := points[0].([]interface{}); got[0] != value || got[1] != int64(1700000000) {
+			t.Errorf("%s: expected [%v 1700000000], got %v", name, value, got)
+		}
+	}
+
+	if series, _ := exp.queryMetricSeries(ctx, "otel.checkout.legacy.*", seriesQuery{tr: tr}); len(series) != 0 {
+		t.Errorf("Expected summaries to be dropped, got %v", series)
+	}
+
+	records, _ := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: "otel.checkout.queue.depth.queue-orders"})
+	var tags map[string]string
+	if len(records) != 1 || json.Unmarshal([]byte(records[0].Tags), &tags) != nil || tags["queue"] != "orders" || tags["metric"] != "queue.depth" {
+		t.Errorf("Expected attribute and metric tags, got %+v", records)
+	}
+}
+
+func TestSharedExporter(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.DBPath = filepath.Join(t.TempDir(), "shared.db")
+	cfg.QueryPort = 0
+	set := exporter.Settings{TelemetrySettings: component.TelemetrySettings{Logger: zap.NewNop()}}
+
+	traces, err := getSharedExporter(cfg, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := getSharedExporter(cfg, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traces != metrics {
+		t.Fatal("Expected traces and metrics exporters to share one instance")
+	}
+
+	ctx := context.Background()
+	if err := traces.start(ctx, nil); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	if err := metrics.start(ctx, nil); err != nil {
+		t.Fatalf("second start() error = %v", err)
+	}
+
+	// The store stays open until the last user shuts down.
+	if err := traces.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown() error = %v", err)
+	}
+	if err := metrics.store.InsertMetric(ctx, "otel.still.open", 1, 1, nil); err != nil {
+		t.Errorf("Expected store open after first shutdown, got %v", err)
+	}
+	if err := metrics.shutdown(ctx); err != nil {
+		t.Fatalf("last shutdown() error = %v", err)
+	}
+
+	if again, _ := getSharedExporter(cfg, set); again == traces {
+		t.Error("Expected a new instance after the last shutdown")
+	}
+}
+
+func TestServiceCatalog(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	// Ingested names are visible immediately.
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(2)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	if names, _ := exp.catalog.spanNames("format-svc"); !reflect.DeepEqual(names, []string{"op-0", "op-1"}) {
+		t.Errorf("Expected op-0 and op-1 in catalog, got %v", names)
+	}
+
+	// Rows written behind the exporter's back show up after a refresh.
+	span := []byte(`{"trace_id":"aa","span_id":"bb","service_name":"direct-svc","span_name":"direct-op","start_time_unix_nano":1,"end_time_unix_nano":2}`)
+	if err := exp.store.InsertData(ctx, [][]byte{span}, nil); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+	services, _ := exp.listServices(ctx)
+	if len(services) != 1 {
+		t.Errorf("Expected catalog to be stale before refresh, got %v", services)
+	}
+	if err := exp.catalog.refresh(ctx, exp.store.ListServiceOperations); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	services, _ = exp.listServices(ctx)
+	if !reflect.DeepEqual(services, []string{"direct-svc", "format-svc"}) {
+		t.Errorf("Expected both services after refresh, got %v", services)
+	}
+
+	req := httptest.NewRequest("GET", "/api/search/tag/span.name/values?service=direct-svc", nil)
+	w := httptest.NewRecorder()
+	exp.handleSearchTagValues(w, req)
+	var resp struct {
+		TagValues []string `json:"tagValues"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !reflect.DeepEqual(resp.TagValues, []string{"direct-op"}) {
+		t.Errorf("Expected span.name values [direct-op], got %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v2/search/tag/name/values", nil)
+	w = httptest.NewRecorder()
+	exp.handleSearchTagValuesV2(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "op-1") {
+		t.Errorf("Expected v2 span name values, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPushLogs(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	ld := plog.NewLogs()
+	rl := ld.ResourceLogs().AppendEmpty()
+	rl.Resource().Attributes().PutStr("service.name", "log-svc")
+	sl := rl.ScopeLogs().AppendEmpty()
+	sl.Scope().SetName("log-scope")
+
+	base := time.Unix(1700000000, 0)
+	info := sl.LogRecords().AppendEmpty()
+	info.SetTimestamp(pcommon.NewTimestampFromTime(base))
+	info.SetSeverityNumber(plog.SeverityNumberInfo)
+	info.Body().SetStr("checkout started")
+	info.Attributes().PutStr("user.id", "42")
+
+	failed := sl.LogRecords().AppendEmpty()
+	failed.SetObservedTimestamp(pcommon.NewTimestampFromTime(base.Add(time.Second)))
+	failed.SetSeverityNumber(plog.SeverityNumberError)
+	failed.SetSeverityText("Error")
+	failed.Body().SetStr("payment declined")
+	failed.SetTraceID(pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
+	failed.SetSpanID(pcommon.SpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+
+	if err := exp.pushLogs(ctx, ld); err != nil {
+		t.Fatalf("pushLogs() error = %v", err)
+	}
+
+	records, err := exp.store.QueryLogs(ctx, tracestore.LogQueryOptions{ServiceName: "log-svc", Ascending: true})
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected 2 stored logs, got %d, %v", len(records), err)
+	}
+	if records[1].Timestamp != base.Add(time.Second).UnixNano() {
+		t.Errorf("Expected observed timestamp for record without timestamp, got %d", records[1].Timestamp)
+	}
+
+	var doc map[string]interface{}
+	json.Unmarshal(records[0].Data, &doc)
+	if doc["severity_text"] != "INFO" || doc["body"] != "checkout started" {
+		t.Errorf("Unexpected log document %v", doc)
+	}
+	if attrs, _ := doc["attributes"].(map[string]interface{}); attrs["user.id"] != "42" {
+		t.Errorf("Expected log attributes to be stored, got %v", doc["attributes"])
+	}
+
+	byTrace, _ := exp.store.QueryLogs(ctx, tracestore.LogQueryOptions{TraceID: "0102030405060708090a0b0c0d0e0f10"})
+	if len(byTrace) != 1 {
+		t.Errorf("Expected 1 log for trace, got %d", len(byTrace))
+	}
+}
+
+func TestParseLogQL(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    tracestore.LogQueryOptions
+		wantErr bool
+	}{
+		{query: `{service_name="api"}`, want: tracestore.LogQueryOptions{ServiceName: "api"}},
+		{query: `{job="api", level="error"}`, want: tracestore.LogQueryOptions{ServiceName: "api", MinSeverity: 17, MaxSeverity: 20}},
+		{query: `{level="notice"}`, want: tracestore.LogQueryOptions{SeverityText: "notice"}},
+		{query: `{service_name="api"} |= "timeout" |= ` + "`db`", want: tracestore.LogQueryOptions{ServiceName: "api", Contains: []string{"timeout", "db"}}},
+		{query: `{service_name="api"} |= "0102030405060708090a0b0c0d0e0f10"`, want: tracestore.LogQueryOptions{ServiceName: "api", TraceID: "0102030405060708090a0b0c0d0e0f10"}},
+		{query: `{}`, want: tracestore.LogQueryOptions{}},
+		{query: `service_name="api"`, wantErr: true},
+		{query: `{service_name=~"a.*"}`, wantErr: true},
+		{query: `{host="a"}`, wantErr: true},
+		{query: `{service_name="api"} != "x"`, wantErr: true},
+		{query: `{service_name="api"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLogQL(tt.query)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLogQL(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLogQL(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestLokiQueryRange(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	logs := [][]byte{
+		[]byte(`{"timestamp_unix_nano":1000,"severity_number":9,"severity_text":"INFO","service_name":"api","body":"started"}`),
+		[]byte(`{"timestamp_unix_nano":2000,"severity_number":17,"severity_text":"ERROR","service_name":"api","trace_id":"0102030405060708090a0b0c0d0e0f10","body":"failed"}`),
+		[]byte(`{"timestamp_unix_nano":3000,"severity_number":9,"severity_text":"INFO","service_name":"api","body":{"msg":"done"}}`),
+	}
+	if err := exp.store.InsertLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(params url.Values) (int, map[string]interface{}) {
+		req := httptest.NewRequest("GET", "/loki/api/v1/query_range?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		exp.handleLokiQueryRange(w, req)
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := query(url.Values{"query": {`{service_name="api"}`}, "direction": {"forward"}})
+	if code != http.StatusOK || resp["status"] != "success" {
+		t.Fatalf("Expected success, got %d %v", code, resp)
+	}
+	streams := resp["data"].(map[string]interface{})["result"].([]interface{})
+	if len(streams) != 2 {
+		t.Fatalf("Expected info and error streams, got %v", streams)
+	}
+	info := streams[0].(map[string]interface{})
+	if labels := info["stream"].(map[string]interface{}); labels["level"] != "info" || labels["service_name"] != "api" {
+		t.Errorf("Unexpected stream labels %v", labels)
+	}
+	values := info["values"].([]interface{})
+	if len(values) != 2 || values[0].([]interface{})[0] != "1000" || values[1].([]interface{})[1] != `{"msg":"done"}` {
+		t.Errorf("Unexpected info values %v", values)
+	}
+
+	// Trace-to-logs lookups filter on the trace ID.
+	_, resp = query(url.Values{"query": {`{service_name="api"} |= "0102030405060708090a0b0c0d0e0f10"`}})
+	streams = resp["data"].(map[string]interface{})["result"].([]interface{})
+	if len(streams) != 1 {
+		t.Fatalf("Expected one stream for trace, got %v", streams)
+	}
+	line := streams[0].(map[string]interface{})["values"].([]interface{})[0].([]interface{})[1]
+	if line != "failed trace_id=0102030405060708090a0b0c0d0e0f10" {
+		t.Errorf("Unexpected log line %q", line)
+	}
+
+	if code, _ := query(url.Values{"query": {`{service_name=~"a"}`}}); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unsupported matcher, got %d", code)
+	}
+
+	req := httptest.NewRequest("GET", "/loki/api/v1/label/level/values", nil)
+	w := httptest.NewRecorder()
+	exp.handleLokiLabelValues(w, req)
+	if !strings.Contains(w.Body.String(), `"data":["error","info"]`) {
+		t.Errorf("Unexpected level values %s", w.Body.String())
+	}
+}
+
+func TestIndexedAttributes(t *testing.T) {
+	ctx := context.Background()
+
+	for _, keys := range [][]string{{""}, {`a"b`}, {"order.id", "order.id"}} {
+		cfg := &Config{IndexedAttributes: keys}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected indexed_attributes %q to be rejected", keys)
+		}
+	}
+
+	for _, format := range []string{storageFormatJSON, storageFormatProtobuf} {
+		exp := newTestExporter(t)
+		exp.config.StorageFormat = format
+		exp.config.IndexedAttributes = []string{"http.method"}
+		if err := exp.store.SetIndexedAttributes(ctx, exp.config.IndexedAttributes); err != nil {
+			t.Fatal(err)
+		}
+		if err := exp.pushTraces(ctx, newStorageFormatTraces(2)); err != nil {
+			t.Fatalf("pushTraces() error = %v", err)
+		}
+
+		req := httptest.NewRequest("GET", "/api/search?tags="+url.QueryEscape(`service.name=format-svc http.method=GET`), nil)
+		w := httptest.NewRecorder()
+		exp.handleSearchTraces(w, req)
+		var resp struct {
+			Traces []map[string]interface{} `json:"traces"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Traces) != 1 {
+			t.Errorf("%s: expected 1 trace for indexed attribute, got %s", format, w.Body.String())
+		}
+
+		req = httptest.NewRequest("GET", "/api/search?tags="+url.QueryEscape(`http.method=POST`), nil)
+		w = httptest.NewRecorder()
+		exp.handleSearchTraces(w, req)
+		resp.Traces = nil
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Traces) != 0 {
+			t.Errorf("%s: expected no traces for other value, got %s", format, w.Body.String())
+		}
+		exp.shutdown(ctx)
+	}
+}
+
+func TestParseTraceStateFilter(t *testing.T) {
+	entries, err := parseTraceStateFilter("congo=xyz, rojo ,tenant@vendor=a b")
+	want := []tracestore.TraceStateEntry{{Key: "congo", Value: "xyz"}, {Key: "rojo"}, {Key: "tenant@vendor", Value: "a b"}}
+	if err != nil || !reflect.DeepEqual(entries, want) {
+		t.Errorf("parseTraceStateFilter() = %+v, %v, want %+v", entries, err, want)
+	}
+
+	for _, s := range []string{"", " , ", "Congo=xyz", "congo=x=y", "@vendor", "a'b=c"} {
+		if _, err := parseTraceStateFilter(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestSearchTraceState(t *testing.T) {
+	ctx := context.Background()
+
+	for _, format := range []string{storageFormatJSON, storageFormatProtobuf} {
+		exp := newTestExporter(t)
+		exp.config.StorageFormat = format
+		td := newStorageFormatTraces(2)
+		td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(1).TraceState().FromRaw("congo=xyz,rojo=00f067aa0ba902b7")
+		if err := exp.pushTraces(ctx, td); err != nil {
+			t.Fatalf("pushTraces() error = %v", err)
+		}
+
+		for query, want := range map[string]int{
+			"congo=xyz":      1,
+			"congo":          1,
+			"congo=abc":      0,
+			"rojo,congo=xyz": 1,
+			"synthetic=true": 0,
+		} {
+			req := httptest.NewRequest("GET", "/api/search?tracestate="+url.QueryEscape(query), nil)
+			w := httptest.NewRecorder()
+			exp.handleSearchTraces(w, req)
+			var resp struct {
+				Traces []map[string]interface{} `json:"traces"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Traces) != want {
+				t.Errorf("%s: tracestate=%s: expected %d traces, got %s", format, query, want, w.Body.String())
+			}
+		}
+
+		req := httptest.NewRequest("GET", "/api/search?tracestate=Congo", nil)
+		w := httptest.NewRecorder()
+		exp.handleSearchTraces(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 for invalid key, got %d", format, w.Code)
+		}
+		exp.shutdown(ctx)
+	}
+}
+
+func TestSlowIngestLog(t *testing.T) {
+	if newSlowIngestLog(SlowIngestConfig{}) != nil {
+		t.Error("Expected slow ingest log to be disabled without a threshold")
+	}
+
+	slowLog := newSlowIngestLog(SlowIngestConfig{Threshold: time.Second, BufferSize: 2})
+	td := newStorageFormatTraces(3)
+	if _, slow := slowLog.observe(td, time.Millisecond, nil); slow {
+		t.Error("Expected fast batch not to be recorded")
+	}
+	for i := 0; i < 3; i++ {
+		td := newStorageFormatTraces(i + 1)
+		b, slow := slowLog.observe(td, 2*time.Second, nil)
+		if !slow || b.Spans != i+1 || b.Bytes <= 0 || b.DurationMs != 2000 {
+			t.Errorf("Unexpected slow batch %+v (slow=%v)", b, slow)
+		}
+	}
+	batches, total := slowLog.recent()
+	if total != 3 || len(batches) != 2 {
+		t.Fatalf("Expected 2 of 3 batches, got %d of %d", len(batches), total)
+	}
+	if batches[0].Spans != 3 || batches[1].Spans != 2 {
+		t.Errorf("Expected newest batch first, got %+v", batches)
+	}
+	if !reflect.DeepEqual(batches[0].Services, []string{"format-svc"}) || !reflect.DeepEqual(batches[0].SpanNames, []string{"op-0", "op-1", "op-2"}) {
+		t.Errorf("Unexpected batch sample %+v", batches[0])
+	}
+
+	cfg := &Config{SlowIngest: SlowIngestConfig{Threshold: -time.Second}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected negative slow_ingest.threshold to be rejected")
+	}
+}
+
+func TestSlowIngestEndpoint(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	exp.config.SlowIngest = SlowIngestConfig{Threshold: time.Nanosecond, BufferSize: 5}
+	exp.slowIngest = newSlowIngestLog(exp.config.SlowIngest)
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(2)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/status/slow-ingest", nil)
+	w := httptest.NewRecorder()
+	exp.handleSlowIngest(w, req)
+	var resp struct {
+		Total   int64       `json:"total"`
+		Batches []slowBatch `json:"batches"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Total != 1 || len(resp.Batches) != 1 || resp.Batches[0].Spans != 2 {
+		t.Errorf("Unexpected slow ingest response %s", w.Body.String())
+	}
+}
+
+func TestSpanMetricsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	scrape := func() string {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		exp.spanMetrics.handler().ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := exp.pushTraces(ctx, newStorageFormatTraces(3)); err != nil {
+			t.Fatalf("pushTraces() error = %v", err)
+		}
+	}
+	body := scrape()
+	for _, want := range []string{
+		`otel_span_count_total{service="format-svc",span="op-0"} 2`,
+		`otel_duration_ms_sum{service="format-svc",span="op-2"} 10`,
+		`otel_error_count_total{service="format-svc",span="op-1"} 0`,
+		"# TYPE otel_span_count_total counter",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in /metrics output:\n%s", want, body)
+		}
+	}
+
+	exp.spanMetrics = newSpanMetricsCollector("otel.prod", map[string]string{"service": "job_service"})
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(3)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	if body := scrape(); !strings.Contains(body, `otel_prod_span_count_total{job_service="format-svc"} 3`) {
+		t.Errorf("Expected mapped labels in /metrics output:\n%s", body)
+	}
+
+	for _, labels := range []map[string]string{{"service": "9bad"}, {"service": "__name"}, {"service": "a", "span": "a"}} {
+		cfg := &Config{Prometheus: PrometheusConfig{Labels: labels}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected prometheus.labels %v to be rejected", labels)
+		}
+	}
+}
+
+func TestParseSpanCondition(t *testing.T) {
+	res := pcommon.NewResource()
+	res.Attributes().PutStr("service.name", "checkout")
+	res.Attributes().PutStr("deployment.environment", "prod")
+	span := ptrace.NewSpan()
+	span.SetName("GET /cart")
+	span.SetKind(ptrace.SpanKindServer)
+	span.Status().SetCode(ptrace.StatusCodeError)
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Unix(100, 0)))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Unix(100, 0).Add(250 * time.Millisecond)))
+	span.Attributes().PutInt("http.status_code", 503)
+	span.Attributes().PutStr("http.route", "/cart")
+	span.Attributes().PutBool("retry", true)
+	ctx := spanContext{span: span, resource: res}
+
+	for expr, want := range map[string]bool{
+		`attributes["http.status_code"] >= 500`:                           true,
+		`attributes["http.status_code"] >= 500 and kind == "client"`:      false,
+		`kind == "server" and (status == "ok" or duration_ms > 200)`:      true,
+		`not status == "error"`:                                           false,
+		`resource.attributes["deployment.environment"] != "staging"`:      true,
+		`attributes["missing"] == nil and service == "checkout"`:          true,
+		`attributes["http.route"] < "/d" and attributes["retry"] == true`: true,
+		`IsMatch(name, "^GET ")`:                                          true,
+		`IsMatch(attributes["http.status_code"], "^4")`:                   false,
+		`attributes["http.status_code"] == "503"`:                         false,
+	} {
+		pred, err := parseSpanCondition(expr)
+		if err != nil {
+			t.Errorf("parseSpanCondition(%q) error = %v", expr, err)
+			continue
+		}
+		if got := pred(ctx); got != want {
+			t.Errorf("%s = %v, want %v", expr, got, want)
+		}
+	}
+
+	for _, expr := range []string{
+		``,
+		`kind ==`,
+		`attributes[http.route] == "x"`,
+		`unknown == 1`,
+		`name = "x"`,
+		`IsMatch(name, "[")`,
+		`(kind == "server"`,
+		`name == "a" extra`,
+	} {
+		if _, err := parseSpanCondition(expr); err == nil {
+			t.Errorf("Expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	exp.config.DerivedMetrics = []DerivedMetricConfig{
+		{Name: "server_errors", Where: `attributes["http.status_code"] >= 500`, GroupBy: []string{"http.route"}, Aggregate: derivedCount},
+		{Name: "max_latency", Where: `kind == "server"`, Aggregate: derivedMax, Value: "duration_ms"},
+	}
+	derived, err := newDerivedMetrics(exp.config.DerivedMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.derived = derived
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "checkout")
+	spans := rs.ScopeSpans().AppendEmpty().Spans()
+	start := time.Unix(1700000000, 0)
+	for i, tc := range []struct {
+		route  string
+		status int64
+		ms     int
+	}{{"/cart", 503, 10}, {"/cart", 500, 30}, {"/pay", 502, 20}, {"/pay", 200, 40}} {
+		span := spans.AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{byte(i + 1)}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		span.SetName("op")
+		span.SetKind(ptrace.SpanKindServer)
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(time.Duration(tc.ms) * time.Millisecond)))
+		span.Attributes().PutStr("http.route", tc.route)
+		span.Attributes().PutInt("http.status_code", tc.status)
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	for name, want := range map[string]float64{
+		"otel.checkout.server_errors.http_route-_cart": 2,
+		"otel.checkout.server_errors.http_route-_pay":  1,
+		"otel.checkout.max_latency":                    40,
+	} {
+		records, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: name})
+		if err != nil || len(records) != 1 || records[0].Value != want {
+			t.Errorf("%s: expected %v, got %+v (%v)", name, want, records, err)
+			continue
+		}
+		if name == "otel.checkout.server_errors.http_route-_cart" && !strings.Contains(records[0].Tags, `"http.route":"/cart"`) {
+			t.Errorf("Expected group tag in %s", records[0].Tags)
+		}
+	}
+
+	for _, c := range []DerivedMetricConfig{
+		{Name: "", Where: "true == true"},
+		{Name: "a.b"},
+		{Name: "x", Aggregate: derivedSum},
+		{Name: "x", Aggregate: "p99", Value: "duration_ms"},
+		{Name: "x", Where: "kind =="},
+	} {
+		cfg := &Config{DerivedMetrics: []DerivedMetricConfig{c}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected derived metric %+v to be rejected", c)
+		}
+	}
+}
+
+func TestDurationPercentiles(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+	exp.config.Percentiles = []float64{50, 99.9}
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "checkout")
+	spans := rs.ScopeSpans().AppendEmpty().Spans()
+	start := time.Unix(1700000000, 0)
+	for i, ms := range []int{40, 10, 30, 20} {
+		span := spans.AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{byte(i + 1)}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		span.SetName("op")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(time.Duration(ms) * time.Millisecond)))
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	for name, want := range map[string]float64{
+		"otel.checkout.op.duration_ms":       25,
+		"otel.checkout.op.duration_ms.p50":   20,
+		"otel.checkout.op.duration_ms.p99_9": 40,
+	} {
+		records, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: name})
+		if err != nil || len(records) != 1 || records[0].Value != want {
+			t.Errorf("%s: expected %v, got %+v (%v)", name, want, records, err)
+		}
+	}
+
+	for _, p := range []float64{0, -5, 100.5} {
+		cfg := &Config{Percentiles: []float64{p}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected percentile %v to be rejected", p)
+		}
+	}
+}
+
+func TestPaginationMetadata(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "paged-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+	for i := 0; i < 3; i++ {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{byte(i + 1), 9}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1), 9}))
+		span.SetName("paged-op")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Duration(i+1) * time.Second)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+		span.Status().SetCode(ptrace.StatusCodeError)
+		event := span.Events().AppendEmpty()
+		event.SetName("exception")
+		event.Attributes().PutStr("exception.type", "PagedError")
+	}
+	if err := exp.pushTraces(context.Background(), td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	t.Run("search", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/search?service=paged-service&limit=2&offset=2", nil)
+		w := httptest.NewRecorder()
+		exp.handleSearchTraces(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Total-Count"); got != "3" {
+			t.Errorf("Expected X-Total-Count 3, got %q", got)
+		}
+		var resp struct {
+			Traces     []map[string]interface{} `json:"traces"`
+			Pagination struct {
+				Total  int64 `json:"total"`
+				Exact  bool  `json:"exact"`
+				Offset int   `json:"offset"`
+				Limit  int   `json:"limit"`
+			} `json:"pagination"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Expected valid JSON response: %v", err)
+		}
+		if len(resp.Traces) != 1 {
+			t.Errorf("Expected 1 trace on the last page, got %d", len(resp.Traces))
+		}
+		if resp.Pagination.Total != 3 || !resp.Pagination.Exact || resp.Pagination.Offset != 2 || resp.Pagination.Limit != 2 {
+			t.Errorf("Unexpected pagination %+v", resp.Pagination)
+		}
+	})
+
+	for _, tc := range []struct {
+		name    string
+		url     string
+		handler func(http.ResponseWriter, *http.Request)
+	}{
+		{"spans", "/api/spans?service=paged-service&limit=1&offset=1", exp.handleListSpans},
+		{"exceptions", "/api/exceptions?limit=1&offset=1", exp.handleListExceptions},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.handler(w, httptest.NewRequest("GET", tc.url, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("X-Total-Count"); got != "3" {
+				t.Errorf("Expected X-Total-Count 3, got %q", got)
+			}
+			if got := w.Header().Get("X-Total-Count-Exact"); got != "true" {
+				t.Errorf("Expected X-Total-Count-Exact true, got %q", got)
+			}
+			var items []map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+				t.Fatalf("Expected a JSON array: %v", err)
+			}
+			if len(items) != 1 {
+				t.Errorf("Expected 1 item, got %d", len(items))
+			}
+		})
+	}
+
+	t.Run("invalid offset", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		exp.handleListSpans(w, httptest.NewRequest("GET", "/api/spans?offset=-1", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestDependenciesEndpoint(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	// Client and server spans arrive in separate batches, as they do from
+	// separate services.
+	push := func(service string, spanID, parentID byte) {
+		td := ptrace.NewTraces()
+		rs := td.ResourceSpans().AppendEmpty()
+		rs.Resource().Attributes().PutStr("service.name", service)
+		span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{7, 7, 7}))
+		span.SetSpanID(pcommon.SpanID([8]byte{spanID}))
+		if parentID != 0 {
+			span.SetParentSpanID(pcommon.SpanID([8]byte{parentID}))
+		}
+		span.SetName("call")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+		if err := exp.pushTraces(ctx, td); err != nil {
+			t.Fatalf("pushTraces() error = %v", err)
+		}
+	}
+	push("checkout", 2, 1)
+	push("frontend", 1, 0)
+	if _, err := exp.store.BuildServiceEdges(ctx, 100); err != nil {
+		t.Fatalf("BuildServiceEdges() error = %v", err)
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/dependencies?endTs=%d&lookback=3600000", time.Now().UnixMilli()), nil)
+	w := httptest.NewRecorder()
+	exp.handleDependencies(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data []struct {
+			Parent    string `json:"parent"`
+			Child     string `json:"child"`
+			CallCount int64  `json:"callCount"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].Parent != "frontend" || resp.Data[0].Child != "checkout" || resp.Data[0].CallCount != 1 {
+		t.Errorf("Unexpected dependencies %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	exp.handleDependencies(w, httptest.NewRequest("GET", "/api/dependencies?lookback=abc", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid lookback, got %d", w.Code)
+	}
+}
+
+func TestSpanIncludeExclude(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	filter, err := newSpanFilter(
+		[]SpanMatchConfig{{Service: "shop-*"}},
+		[]SpanMatchConfig{
+			{SpanName: "GET /health*"},
+			{Attributes: map[string]string{"user_agent.original": "^kube-probe/"}, MatchType: "regexp"},
+		})
+	if err != nil {
+		t.Fatalf("newSpanFilter() error = %v", err)
+	}
+	exp.filter = filter
+
+	td := ptrace.NewTraces()
+	for _, svc := range []string{"shop-api", "batch-job"} {
+		rs := td.ResourceSpans().AppendEmpty()
+		rs.Resource().Attributes().PutStr("service.name", svc)
+		ss := rs.ScopeSpans().AppendEmpty()
+		for i, name := range []string{"GET /health/live", "GET /orders", "GET /"} {
+			span := ss.Spans().AppendEmpty()
+			span.SetTraceID(pcommon.TraceID([16]byte{8, byte(i)}))
+			span.SetSpanID(pcommon.SpanID([8]byte{byte(len(svc)), byte(i)}))
+			span.SetName(name)
+			span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+			span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+			if name == "GET /" {
+				span.Attributes().PutStr("user_agent.original", "kube-probe/1.29")
+			}
+		}
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	spans, err := exp.store.QuerySpans(ctx, tracestore.SpanQueryOptions{})
+	if err != nil {
+		t.Fatalf("QuerySpans() error = %v", err)
+	}
+	if len(spans) != 1 || !strings.Contains(string(spans[0]), `"GET /orders"`) || !strings.Contains(string(spans[0]), "shop-api") {
+		t.Errorf("Expected only shop-api GET /orders to be stored, got %s", spans)
+	}
+	metrics, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	for _, m := range metrics {
+		if strings.Contains(m.Name, "health") || strings.Contains(m.Name, "batch_job") {
+			t.Errorf("Unexpected metric for a filtered span: %s", m.Name)
+		}
+	}
+
+	for _, cfg := range []SpanMatchConfig{
+		{},
+		{SpanName: "(", MatchType: "regexp"},
+		{SpanName: "x", MatchType: "exact"},
+	} {
+		if _, err := compileSpanMatcher(cfg); err == nil {
+			t.Errorf("Expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestSubMillisecondDurations(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	start := time.Now().Add(-time.Second)
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "cache")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{0xca, 0xc4}))
+	span.SetSpanID(pcommon.SpanID([8]byte{0xca}))
+	span.SetName("GET")
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(250 * time.Microsecond)))
+	exp.pushTraces(context.Background(), td)
+
+	w := httptest.NewRecorder()
+	exp.handleSearchTraces(w, httptest.NewRequest("GET", "/api/search?service=cache", nil))
+	var search struct {
+		Traces []struct {
+			DurationMs    int64  `json:"durationMs"`
+			DurationNanos string `json:"durationNanos"`
+		} `json:"traces"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &search)
+	if len(search.Traces) != 1 || search.Traces[0].DurationMs != 0 || search.Traces[0].DurationNanos != "250000" {
+		t.Errorf("Expected durationMs 0 and durationNanos 250000 from search, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	exp.handleListTraces(w, httptest.NewRequest("GET", "/api/traces", nil))
+	var list []struct {
+		DurationMs    float64 `json:"duration_ms"`
+		DurationNanos int64   `json:"duration_nanos"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 1 || list[0].DurationMs != 0.25 || list[0].DurationNanos != 250000 {
+		t.Errorf("Expected duration_ms 0.25 and duration_nanos 250000 from the trace list, got %s", w.Body.String())
+	}
+}
+
+func TestSelfTimeEndpoint(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	start := time.Now().Add(-time.Second)
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "self-time-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+	for i, d := range []time.Duration{100 * time.Millisecond, 60 * time.Millisecond} {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{6, 6}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		if i > 0 {
+			span.SetParentSpanID(pcommon.SpanID([8]byte{1}))
+			span.SetName("child")
+		} else {
+			span.SetName("parent")
+		}
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(d)))
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	if _, err := exp.store.UpdateSelfTimes(ctx, 100); err != nil {
+		t.Fatalf("UpdateSelfTimes() error = %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	exp.handleSelfTime(w, httptest.NewRequest("GET", "/api/self-time?service=self-time-service", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var ops []struct {
+		Operation  string  `json:"operation"`
+		SelfTimeMs float64 `json:"self_time_ms"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &ops); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(ops) != 2 || ops[0].Operation != "child" || ops[0].SelfTimeMs != 60 || ops[1].SelfTimeMs != 40 {
+		t.Errorf("Unexpected self-time ranking %s", w.Body.String())
+	}
+}
+
+func TestMetricsSummaryEndpoint(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	start := time.Now().Add(-time.Minute)
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "red-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+	// Ten server spans of 10..100ms, the slowest two failing
+	for i := 0; i < 10; i++ {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{7, byte(i + 1)}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		span.SetName("GET /items")
+		span.SetKind(ptrace.SpanKindServer)
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(time.Duration(i+1) * 10 * time.Millisecond)))
+		if i >= 8 {
+			span.Status().SetCode(ptrace.StatusCodeError)
+		}
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	exp.handleMetricsSummary(w, httptest.NewRequest("GET", "/api/metrics/summary?service=red-service&from=-1h&to=now", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	type latency struct {
+		P50 float64 `json:"p50"`
+		P99 float64 `json:"p99"`
+		Max float64 `json:"max"`
+	}
+	var summary struct {
+		Requests   int64   `json:"requests"`
+		Errors     int64   `json:"errors"`
+		ErrorRatio float64 `json:"error_ratio"`
+		GroupBy    string  `json:"group_by"`
+		LatencyMs  latency `json:"latency_ms"`
+		Groups     []struct {
+			Name     string `json:"name"`
+			Requests int64  `json:"requests"`
+		} `json:"groups"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if summary.Requests != 10 || summary.Errors != 2 || summary.ErrorRatio != 0.2 {
+		t.Errorf("Expected 10 requests with 2 errors, got %s", w.Body.String())
+	}
+	if summary.LatencyMs.P50 != 50 || summary.LatencyMs.P99 != 100 || summary.LatencyMs.Max != 100 {
+		t.Errorf("Expected p50 50ms and p99 100ms, got %+v", summary.LatencyMs)
+	}
+	if summary.GroupBy != "operation" || len(summary.Groups) != 1 || summary.Groups[0].Name != "GET /items" {
+		t.Errorf("Expected one operation group, got %s", w.Body.String())
+	}
+
+	for _, query := range []string{"kind=sideways", "group_by=tenant", "from=later"} {
+		w = httptest.NewRecorder()
+		exp.handleMetricsSummary(w, httptest.NewRequest("GET", "/api/metrics/summary?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestTraceTreeEndpoint(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	// op-0 is the root of op-1 and op-2, which overlap it and each other
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(3)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/traces/0102030405060708090A0B0C0D0E0F10/tree", nil)
+	w := httptest.NewRecorder()
+	exp.handleGetTrace(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var tree traceTree
+	if err := json.Unmarshal(w.Body.Bytes(), &tree); err != nil {
+		t.Fatalf("Failed to decode tree: %v", err)
+	}
+	if tree.SpanCount != 3 || len(tree.Roots) != 1 || tree.DurationMs != 7 || tree.DurationNanos != 7000000 {
+		t.Fatalf("Expected one root over 3 spans and 7ms, got %+v", tree)
+	}
+	root := tree.Roots[0]
+	if root.SpanName != "op-0" || len(root.Children) != 2 || !root.CriticalPath {
+		t.Fatalf("Expected op-0 with 2 children on the critical path, got %+v", root)
+	}
+	first, last := root.Children[0], root.Children[1]
+	if first.SpanName != "op-1" || first.Depth != 1 || first.StartOffsetMs != 1 {
+		t.Errorf("Expected op-1 first at depth 1 and 1ms offset, got %+v", first)
+	}
+	// op-2 ends last, and op-1 is still running when op-2 starts
+	if !last.CriticalPath || !first.CriticalPath {
+		t.Errorf("Expected both children on the critical path, got %v and %v", first.CriticalPath, last.CriticalPath)
+	}
+	if root.SelfTimeMs != 0 || last.SelfTimeMs != 5 {
+		t.Errorf("Expected self-time 0ms for the root and 5ms for a leaf, got %v and %v", root.SelfTimeMs, last.SelfTimeMs)
+	}
+
+	w = httptest.NewRecorder()
+	exp.handleGetTrace(w, httptest.NewRequest("GET", "/api/traces/ffffffffffffffffffffffffffffffff/tree", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown trace, got %d", w.Code)
+	}
+}
+
+func TestSearchStatus(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "status-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+	for i, code := range []ptrace.StatusCode{ptrace.StatusCodeError, ptrace.StatusCodeOk, ptrace.StatusCodeUnset} {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{5, byte(i + 1)}))
+		span.SetSpanID(pcommon.SpanID([8]byte{5, byte(i + 1)}))
+		span.SetName("op")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+		span.Status().SetCode(code)
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{"/api/search?status=error", 1},
+		{"/api/search?status=OK", 1},
+		{"/api/search?tags=" + url.QueryEscape("status=unset"), 1},
+		{"/api/search?status=*", 3},
+	} {
+		w := httptest.NewRecorder()
+		exp.handleSearchTraces(w, httptest.NewRequest("GET", tc.url, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", tc.url, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Traces []struct {
+				ErrorCount int64 `json:"errorCount"`
+			} `json:"traces"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(resp.Traces) != tc.want {
+			t.Errorf("%s: expected %d traces, got %d", tc.url, tc.want, len(resp.Traces))
+		}
+		if tc.url == "/api/search?status=error" && len(resp.Traces) == 1 && resp.Traces[0].ErrorCount != 1 {
+			t.Errorf("Expected errorCount 1, got %d", resp.Traces[0].ErrorCount)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	exp.handleSearchTraces(w, httptest.NewRequest("GET", "/api/search?status=failed", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown status, got %d", w.Code)
+	}
+}
+
+func TestSearchDuration(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	start := time.Now().Add(-time.Minute)
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "duration-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+	for i, d := range []time.Duration{50 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second} {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{9, byte(i + 1)}))
+		span.SetSpanID(pcommon.SpanID([8]byte{9, byte(i + 1)}))
+		span.SetName("op")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(d)))
+		if d > time.Second {
+			span.Status().SetCode(ptrace.StatusCodeError)
+		}
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"minDuration=100ms", 2},
+		{"maxDuration=1s", 2},
+		{"minDuration=100ms&maxDuration=1s", 1},
+		{"minDuration=1s&status=error", 1},
+		{"minDuration=5s", 0},
+	} {
+		w := httptest.NewRecorder()
+		exp.handleSearchTraces(w, httptest.NewRequest("GET", "/api/search?"+tc.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", tc.query, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Traces []map[string]interface{} `json:"traces"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(resp.Traces) != tc.want {
+			t.Errorf("%s: expected %d traces, got %d", tc.query, tc.want, len(resp.Traces))
+		}
+	}
+
+	for _, query := range []string{"minDuration=fast", "maxDuration=-1s", "minDuration=2s&maxDuration=1s"} {
+		w := httptest.NewRecorder()
+		exp.handleSearchTraces(w, httptest.NewRequest("GET", "/api/search?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestTextSearchEndpoint(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	if !exp.store.TextSearchAvailable() {
+		w := httptest.NewRecorder()
+		exp.handleTextSearch(w, httptest.NewRequest("GET", "/api/search/text?q=refused", nil))
+		if w.Code != http.StatusNotImplemented {
+			t.Fatalf("Expected 501 without FTS5, got %d", w.Code)
+		}
+		t.Skip("SQLite built without FTS5; run with -tags sqlite_fts5")
+	}
+
+	// Exceptions in compact-format spans are indexed from the header
+	exp.config.StorageFormat = storageFormatProtobuf
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "text-search-service")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{7, 7}))
+	span.SetSpanID(pcommon.SpanID([8]byte{7}))
+	span.SetName("checkout")
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+	ev := span.Events().AppendEmpty()
+	ev.SetName("exception")
+	ev.Attributes().PutStr("exception.type", "ECONNREFUSED")
+	ev.Attributes().PutStr("exception.message", "dial tcp 10.0.0.5:5432: connect: connection refused")
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	exp.handleTextSearch(w, httptest.NewRequest("GET", "/api/search/text?q="+url.QueryEscape("connection refused"), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var results []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("Expected valid JSON response: %v", err)
+	}
+	if len(results) != 1 || results[0]["service"] != "text-search-service" {
+		t.Fatalf("Expected one match in text-search-service, got %v", results)
+	}
+	if snippet, _ := results[0]["snippet"].(string); !strings.Contains(snippet, "[connection refused]") {
+		t.Errorf("Expected highlighted snippet, got %q", snippet)
+	}
+
+	w = httptest.NewRecorder()
+	exp.handleTextSearch(w, httptest.NewRequest("GET", "/api/search/text", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without q, got %d", w.Code)
+	}
+}
+
+func TestExceptionCountMetric(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "exception-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+	// A handled exception on an OK span, two on an error span and an event
+	// that is not an exception
+	for i, events := range [][]string{{"exception"}, {"exception", "exception", "retry"}} {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{8, 8}))
+		span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+		span.SetName("charge")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+		if i == 1 {
+			span.Status().SetCode(ptrace.StatusCodeError)
+		}
+		for _, name := range events {
+			span.Events().AppendEmpty().SetName(name)
+		}
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	for name, want := range map[string]float64{
+		"otel.exception-service.charge.exception_count": 3,
+		"otel.exception-service.charge.error_count":     1,
+	} {
+		metrics, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: name})
+		if err != nil {
+			t.Fatalf("QueryMetrics() error = %v", err)
+		}
+		if len(metrics) != 1 || metrics[0].Value != want {
+			t.Errorf("Expected %s=%v, got %v", name, want, metrics)
+		}
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	if exp.config.WALCheckpoint.Interval != 0 {
+		t.Fatalf("Expected WAL checkpoints disabled without an interval, got %v", exp.config.WALCheckpoint.Interval)
+	}
+	cfg := &Config{DBPath: "x.db", WALCheckpoint: WALCheckpointConfig{Interval: time.Minute}}
+	if err := cfg.Validate(); err != nil || cfg.WALCheckpoint.MaxSizeMB != defaultWALCheckpointMaxSizeMB {
+		t.Errorf("Expected default max_size_mb, got %d, %v", cfg.WALCheckpoint.MaxSizeMB, err)
+	}
+	cfg.WALCheckpoint.MaxSizeMB = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected negative max_size_mb to be rejected")
+	}
+
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(50)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	if size, _ := exp.store.WALSize(); size == 0 {
+		t.Fatal("Expected a non-empty WAL after ingest")
+	}
+
+	// max_size_mb 0 checkpoints any non-empty WAL
+	exp.config.WALCheckpoint.MaxSizeMB = 0
+	exp.checkpointWAL()
+	if size, _ := exp.store.WALSize(); size != 0 {
+		t.Errorf("Expected the WAL truncated, got %d bytes", size)
+	}
+}
+
+func TestWriteBatchConcurrentPushes(t *testing.T) {
+	ctx := context.Background()
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpFile.Name()) })
+	tmpFile.Close()
+
+	cfg := createDefaultConfig().(*Config)
+	cfg.DBPath = tmpFile.Name()
+	cfg.QueryPort = 0
+	cfg.WriteBatch.FlushInterval = 5 * time.Millisecond
+	exp, err := newSQLiteExporter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("newSQLiteExporter() error = %v", err)
+	}
+	if err := exp.start(ctx, nil); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	defer exp.shutdown(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			td := newStorageFormatTraces(10)
+			rs := td.ResourceSpans().At(0)
+			rs.Resource().Attributes().PutStr("service.name", fmt.Sprintf("batch-%d", i))
+			if err := exp.pushTraces(ctx, td); err != nil {
+				t.Errorf("pushTraces() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats, err := exp.store.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.SpanCount != 80 || stats.ServiceCount != 8 {
+		t.Errorf("Expected 80 spans in 8 services once every push returned, got %+v", stats)
+	}
+
+	cfg.WriteBatch.MaxRows = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected negative write_batch.max_rows to be rejected")
+	}
+}
+
+func TestIncidentSnapshots(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := &Config{
+		DBPath:      filepath.Join(dir, "gotel.db"),
+		Prefix:      "otel",
+		StoreTraces: true,
+		Incidents: IncidentsConfig{
+			DBPath: filepath.Join(dir, "incidents.db"),
+			Rules: []IncidentRule{
+				{Service: "quiet-service", ErrorRate: 0.01, MinSpans: 100},
+				{Service: "*", ErrorRate: 0.5},
+			},
+		},
+	}
+	exp, err := newSQLiteExporter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("newSQLiteExporter() error = %v", err)
+	}
+	if cfg.Incidents.Interval != defaultIncidentsInterval || cfg.Incidents.Rules[1].MinSpans != defaultIncidentMinSpans {
+		t.Fatalf("Expected incidents defaults, got %+v", cfg.Incidents)
+	}
+	if err := exp.start(ctx, nil); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	defer exp.shutdown(ctx)
+
+	// 30 spans in each service, two thirds failing
+	now := time.Now()
+	td := ptrace.NewTraces()
+	for _, service := range []string{"failing-service", "quiet-service"} {
+		rs := td.ResourceSpans().AppendEmpty()
+		rs.Resource().Attributes().PutStr("service.name", service)
+		ss := rs.ScopeSpans().AppendEmpty()
+		for i := 0; i < 30; i++ {
+			span := ss.Spans().AppendEmpty()
+			span.SetTraceID(pcommon.TraceID([16]byte{byte(len(service)), byte(i + 1)}))
+			span.SetSpanID(pcommon.SpanID([8]byte{byte(i + 1)}))
+			span.SetName("op")
+			span.SetStartTimestamp(pcommon.NewTimestampFromTime(now.Add(-time.Second)))
+			span.SetEndTimestamp(pcommon.NewTimestampFromTime(now))
+			if i%3 != 0 {
+				span.Status().SetCode(ptrace.StatusCodeError)
+			}
+		}
+	}
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	exp.evaluateIncidents(now.Add(time.Second))
+
+	w := httptest.NewRecorder()
+	exp.handleIncidents(w, httptest.NewRequest("GET", "/api/incidents", nil))
+	var incidents []tracestore.Incident
+	if err := json.Unmarshal(w.Body.Bytes(), &incidents); err != nil {
+		t.Fatalf("Expected valid JSON response: %v", err)
+	}
+	// quiet-service matches its own rule first and has too few spans
+	if len(incidents) != 1 || incidents[0].ServiceName != "failing-service" || incidents[0].TraceCount != 30 {
+		t.Fatalf("Expected one failing-service incident with 30 traces, got %+v", incidents)
+	}
+	if !strings.HasPrefix(incidents[0].Reason, "error rate 66.7%") {
+		t.Errorf("Unexpected reason %q", incidents[0].Reason)
+	}
+
+	cfg.Incidents.DBPath = cfg.DBPath
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected incidents.db_path equal to db_path to be rejected")
+	}
+}
+
+func TestMetricRollup(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	cfg := &Config{DBPath: "x.db", Rollup: RollupConfig{Interval: time.Minute}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if cfg.Rollup.MinuteAfter != defaultRollupMinuteAfter || cfg.Rollup.HourAfter != defaultRollupHourAfter {
+		t.Errorf("Expected default rollup ages, got %+v", cfg.Rollup)
+	}
+	cfg.Rollup.HourAfter = 30 * time.Minute
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected hour_after below minute_after to be rejected")
+	}
+
+	now := time.Now()
+	old := now.Add(-3*time.Hour).Unix() / 60 * 60
+	for i, v := range []float64{1, 2, 3} {
+		if err := exp.store.InsertMetric(ctx, "otel.rollup-service.op.count", v, old+int64(i*10), nil); err != nil {
+			t.Fatalf("InsertMetric() error = %v", err)
+		}
+	}
+
+	exp.config.Rollup = RollupConfig{Interval: time.Minute, MinuteAfter: time.Hour, HourAfter: 24 * time.Hour}
+	exp.rollupMetrics(now)
+
+	if got := exp.metricResolution(timeRange{from: now.Add(-30 * time.Minute)}, now); got != 0 {
+		t.Errorf("Expected raw resolution for the last 30m, got %v", got)
+	}
+	if got := exp.metricResolution(timeRange{from: now.Add(-7 * 24 * time.Hour)}, now); got != time.Hour {
+		t.Errorf("Expected hourly resolution for the last 7d, got %v", got)
+	}
+
+	req := httptest.NewRequest("GET", "/render?target=otel.rollup-service.*.count&from=-6h", nil)
+	w := httptest.NewRecorder()
+	exp.handleRenderMetrics(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result []struct {
+		Target     string      `json:"target"`
+		Datapoints [][]float64 `json:"datapoints"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode render response: %v", err)
+	}
+	if len(result) != 1 || len(result[0].Datapoints) != 1 {
+		t.Fatalf("Expected one rolled-up datapoint, got %+v", result)
+	}
+	if dp := result[0].Datapoints[0]; dp[0] != 2 || int64(dp[1]) != old {
+		t.Errorf("Expected the minute average 2 at %d, got %v", old, dp)
+	}
+}
+
+func TestTraceCompaction(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+	traceID := "0102030405060708090a0b0c0d0e0f10"
+
+	cfg := &Config{DBPath: "x.db", TraceCompaction: TraceCompactionConfig{Interval: time.Minute}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if cfg.TraceCompaction.After != defaultTraceCompactionAfter || cfg.TraceCompaction.BatchSize != defaultTraceCompactionBatchSize {
+		t.Errorf("Expected default trace_compaction settings, got %+v", cfg.TraceCompaction)
+	}
+	cfg.TraceCompaction.After = -time.Hour
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected negative after to be rejected")
+	}
+
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(5)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	// Too recent to compact
+	exp.config.TraceCompaction = TraceCompactionConfig{Interval: time.Minute, After: time.Hour, BatchSize: 2}
+	exp.compactTraces(time.Now())
+	if stats, _ := exp.store.Stats(ctx); stats.CompactedTraceCount != 0 {
+		t.Fatalf("Expected no compaction within after, got %+v", stats)
+	}
+
+	exp.compactTraces(time.Now().Add(2 * time.Hour))
+	stats, _ := exp.store.Stats(ctx)
+	if stats.SpanCount != 0 || stats.CompactedTraceCount != 1 || stats.CompactedSpanCount != 5 {
+		t.Fatalf("Expected the trace compacted into one blob, got %+v", stats)
+	}
+
+	req := httptest.NewRequest("GET", "/api/traces/"+traceID, nil)
+	w := httptest.NewRecorder()
+	exp.handleGetTrace(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected compacted trace by ID, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "op-4") {
+		t.Errorf("Expected every span of the compacted trace, got %s", w.Body.String())
+	}
+}
+
+func TestRenderMetricsByService(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	now := time.Now().Unix()
+	for _, svc := range []string{"checkout", "payments"} {
+		if err := exp.store.InsertMetric(ctx, "otel."+svc+".get.count", 1, now, map[string]string{"service": svc}); err != nil {
+			t.Fatalf("InsertMetric() error = %v", err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/render?target=otel.*.get.count&from=-1h&service=payments", nil)
+	w := httptest.NewRecorder()
+	exp.handleRenderMetrics(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var result []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode render response: %v", err)
+	}
+	if len(result) != 1 || result[0]["target"] != "otel.payments.get.count" {
+		t.Errorf("Expected only the payments series, got %v", result)
+	}
+}
+
+func TestMaxDBSize(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	cfg := &Config{DBPath: "x.db", MaxDBSizeMiB: -1}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected negative max_db_size_mib to be rejected")
+	}
+
+	filler := strings.Repeat("x", 2048)
+	for i := 0; i < 800; i++ {
+		span := map[string]interface{}{
+			"trace_id":             fmt.Sprintf("size-%04d", i),
+			"span_id":              "span1",
+			"service_name":         "size-service",
+			"span_name":            "op",
+			"start_time_unix_nano": time.Now().UnixNano(),
+			"end_time_unix_nano":   time.Now().UnixNano(),
+			"attributes":           map[string]interface{}{"filler": filler},
+		}
+		spanJSON, _ := json.Marshal(span)
+		if err := exp.store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatalf("InsertSpan() error = %v", err)
+		}
+	}
+	if used, _, _ := exp.store.UsedBytes(ctx); used <= 1<<20 {
+		t.Fatalf("Expected over 1 MiB of data, got %d bytes", used)
+	}
+
+	exp.config.MaxDBSizeMiB = 1
+	exp.enforceSizeLimit()
+
+	used, _, err := exp.store.UsedBytes(ctx)
+	if err != nil {
+		t.Fatalf("UsedBytes() error = %v", err)
+	}
+	if lowWater := int64(float64(1<<20) * dbSizeLowWaterRatio); used > lowWater {
+		t.Errorf("Expected at most %d bytes in use, got %d", lowWater, used)
+	}
+	stats, _ := exp.store.Stats(ctx)
+	if stats.SpanCount == 0 || stats.SpanCount >= 800 {
+		t.Errorf("Expected some of the newest spans kept, got %d", stats.SpanCount)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpFile.Name()) })
+	tmpFile.Close()
+
+	cfg := &Config{DBPath: tmpFile.Name(), SendMetrics: true, StoreTraces: true, DryRun: true}
+	exp, err := newSQLiteExporter(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("newSQLiteExporter() error = %v", err)
+	}
+	if err := exp.start(ctx, nil); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	defer exp.shutdown(ctx)
+
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(5)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+
+	stats, err := exp.store.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.SpanCount != 0 || stats.MetricCount != 0 {
+		t.Errorf("Expected nothing stored, got %d spans and %d metrics", stats.SpanCount, stats.MetricCount)
+	}
+	volume := exp.dryRun.snapshot()
+	if volume["spans"].Rows != 5 || volume["spans"].Bytes == 0 || volume["metrics"].Rows == 0 {
+		t.Errorf("Expected 5 spans and some metrics counted, got %+v", volume)
+	}
+	if services, _ := exp.catalog.services(); len(services) != 1 {
+		t.Errorf("Expected the service still cataloged, got %v", services)
+	}
+
+	req := httptest.NewRequest("GET", "/api/status", nil)
+	w := httptest.NewRecorder()
+	exp.handleStatus(w, req)
+	if !strings.Contains(w.Body.String(), `"dry_run":{`) {
+		t.Errorf("Expected dry_run totals in /api/status, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	exp.queryMetrics.handler().ServeHTTP(w, httptest.NewRequest("GET", "/internal/metrics", nil))
+	if !strings.Contains(w.Body.String(), `gotel_dry_run_rows_total{table="spans"} 5`) {
+		t.Errorf("Expected dry run counters in /internal/metrics, got %s", w.Body.String())
+	}
+}
+
+func TestSelfMetrics(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	cfg := &Config{DBPath: "x.db", SelfMetrics: SelfMetricsConfig{Interval: -time.Second}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected negative self_metrics.interval to be rejected")
+	}
+
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(5)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	exp.writeSelfMetrics(time.Now())
+
+	req := httptest.NewRequest("GET", "/metrics/find?query=otel.self.*", nil)
+	w := httptest.NewRecorder()
+	exp.handleFindMetrics(w, req)
+	if !strings.Contains(w.Body.String(), `"otel.self.spans_stored"`) || !strings.Contains(w.Body.String(), `"otel.self.goroutines"`) {
+		t.Errorf("Expected self metrics in /metrics/find, got %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/render?target=otel.self.spans_stored&from=-1h", nil)
+	w = httptest.NewRecorder()
+	exp.handleRenderMetrics(w, req)
+	var result []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode render response: %v", err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("Expected one spans_stored series, got %v", result)
+	}
+	points := result[0]["datapoints"].([]interface{})
+	if len(points) != 1 || points[0].([]interface{})[0] != float64(5) {
+		t.Errorf("Expected 5 spans stored, got %v", points)
+	}
+
+	// Counters restart after each write
+	for _, r := range exp.selfMetricRecords(time.Now()) {
+		if r.Name == "otel.self.spans_stored" && r.Value != 0 {
+			t.Errorf("Expected spans_stored reset after a write, got %v", r.Value)
+		}
+	}
+}
+
+func TestShedMetrics(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	filter, err := newSpanFilter(nil, []SpanMatchConfig{{SpanName: "op-0"}})
+	if err != nil {
+		t.Fatalf("newSpanFilter() error = %v", err)
+	}
+	exp.filter = filter
+	exp.shed = newShedCounters(&Config{SelfMetrics: SelfMetricsConfig{Interval: time.Minute}})
+	if err := exp.pushTraces(ctx, newStorageFormatTraces(5)); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	// A batch refused by backpressure
+	exp.shed.throttled(newStorageFormatTraces(5))
+
+	values := make(map[string]float64)
+	for _, r := range exp.selfMetricRecords(time.Now()) {
+		if strings.HasPrefix(r.Name, "otel.self.shed.") {
+			values[r.Name] = r.Value
+			if !strings.Contains(r.Tags, `"shed_service":"format-svc"`) {
+				t.Errorf("Expected the service in the tags of %s, got %s", r.Name, r.Tags)
+			}
+		}
+	}
+	want := map[string]float64{
+		"otel.self.shed.format-svc.spans_received":  10,
+		"otel.self.shed.format-svc.spans_excluded":  1,
+		"otel.self.shed.format-svc.spans_throttled": 5,
+		"otel.self.shed.format-svc.shed_percent":    60,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Shed metrics = %v, want %v", values, want)
+	}
+
+	// Counts restart after each write, and quiet services are not written
+	for _, r := range exp.selfMetricRecords(time.Now()) {
+		if strings.HasPrefix(r.Name, "otel.self.shed.") {
+			t.Errorf("Expected no shed metrics without traffic, got %s", r.Name)
+		}
+	}
+
+	if newShedCounters(&Config{}) != nil {
+		t.Error("Expected no shed counters without self metrics")
+	}
+}
+
+// recordingIngestHook tags spans with a team, counts them and records the
+// traces reported complete
+type recordingIngestHook struct {
+	completed map[string]int
+}
+
+func (h *recordingIngestHook) OnSpanIngest(ctx context.Context, span *IngestedSpan) {
+	span.Attributes["team"] = "storefront"
+	span.Attributes["http.method"] = "overwritten"
+	span.Metrics = append(span.Metrics, HookMetric{Name: "hooked_spans", Value: 1, Tags: map[string]string{"team": "storefront"}})
+}
+
+func (h *recordingIngestHook) OnTraceComplete(ctx context.Context, traceID string, spans []json.RawMessage) {
+	h.completed[traceID] = len(spans)
+}
+
+func TestIngestHooks(t *testing.T) {
+	ctx := context.Background()
+	exp := newTestExporter(t)
+	defer exp.shutdown(ctx)
+
+	cfg := &Config{DBPath: "x.db"}
+	if err := cfg.Validate(); err != nil || cfg.Hooks.TraceCompleteAfter != defaultHooksTraceCompleteAfter || cfg.Hooks.MaxPendingTraces != defaultHooksMaxPendingTraces {
+		t.Errorf("Expected default hooks settings, got %+v, %v", cfg.Hooks, err)
+	}
+	cfg.Hooks.MaxPendingTraces = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected negative hooks.max_pending_traces to be rejected")
+	}
+
+	hook := &recordingIngestHook{completed: make(map[string]int)}
+	exp.hooks = []namedIngestHook{{name: "recording", hook: hook}}
+	exp.pendingTraces = newPendingTraces(exp.config.Hooks.MaxPendingTraces)
+
+	td := newStorageFormatTraces(3)
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("pushTraces() error = %v", err)
+	}
+	if _, ok := td.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Attributes().Get("team"); ok {
+		t.Error("Expected the incoming batch left unmodified")
+	}
+
+	spans, err := exp.store.QueryTraceByID(ctx, "0102030405060708090a0b0c0d0e0f10")
+	if err != nil || len(spans) != 3 {
+		t.Fatalf("Expected 3 stored spans, got %d, %v", len(spans), err)
+	}
+	var doc map[string]interface{}
+	json.Unmarshal(spans[0], &doc)
+	attrs, _ := doc["attributes"].(map[string]interface{})
+	if attrs["team"] != "storefront" || attrs["http.method"] != "GET" {
+		t.Errorf("Expected team added without overwriting http.method, got %v", attrs)
+	}
+
+	metrics, err := exp.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{Name: "otel.format-svc.hooked_spans"})
+	if err != nil || len(metrics) != 3 {
+		t.Errorf("Expected 3 hooked_spans points, got %v, %v", metrics, err)
+	}
+
+	// Not quiet for trace_complete_after yet
+	exp.completeTraces(time.Now())
+	if len(hook.completed) != 0 {
+		t.Fatalf("Expected no completed traces yet, got %v", hook.completed)
+	}
+	exp.completeTraces(time.Now().Add(exp.config.Hooks.TraceCompleteAfter + time.Second))
+	if hook.completed["0102030405060708090a0b0c0d0e0f10"] != 3 {
+		t.Errorf("Expected the trace completed with 3 spans, got %v", hook.completed)
+	}
+
+	pending := newPendingTraces(1)
+	pending.observe([]string{"a", "b", "a"}, time.Now())
+	if ids, dropped := pending.complete(time.Now().Add(time.Second)); len(ids) != 1 || dropped != 1 {
+		t.Errorf("Expected one trace tracked and one dropped, got %v, %d", ids, dropped)
+	}
+}
+
+func TestIngestBus(t *testing.T) {
+	b := newIngestBus(zap.NewNop())
+	b.subscribe("storage", busInline, 0, func(_ context.Context, batch *ingestBatch) error {
+		if len(batch.spans) == 0 {
+			return errors.New("write failed")
+		}
+		return nil
+	})
+	var blocking []int
+	b.subscribe("tail", busBlock, 1, func(_ context.Context, batch *ingestBatch) error {
+		blocking = append(blocking, len(batch.spans))
+		return nil
+	})
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var dropping []int
+	b.subscribe("alerts", busDrop, 1, func(_ context.Context, batch *ingestBatch) error {
+		entered <- struct{}{}
+		<-release
+		dropping = append(dropping, len(batch.spans))
+		return nil
+	})
+	b.start()
+
+	ctx := context.Background()
+	batch := func(n int) *ingestBatch { return &ingestBatch{spans: make([]tracestore.EncodedSpan, n)} }
+	if err := b.publish(ctx, batch(0)); err == nil {
+		t.Error("Expected an inline consumer's error to fail the batch")
+	}
+	b.publish(ctx, batch(1))
+	<-entered // the alerts worker holds batch 1, so its queue has room for one
+	for n := 2; n <= 4; n++ {
+		b.publish(ctx, batch(n))
+	}
+	close(release)
+	b.stop(ctx)
+
+	if !reflect.DeepEqual(blocking, []int{1, 2, 3, 4}) {
+		t.Errorf("Expected the blocking consumer to see every stored batch, got %v", blocking)
+	}
+	if !reflect.DeepEqual(dropping, []int{1, 2}) {
+		t.Errorf("Expected the dropping consumer to see batches 1 and 2, got %v", dropping)
+	}
+	if dropped := b.consumers[2].dropped.Load(); dropped != 2 {
+		t.Errorf("Expected 2 dropped batches, got %d", dropped)
+	}
+	if err := b.publish(ctx, batch(5)); err != nil {
+		t.Errorf("Expected publish after stop to still run inline consumers, got %v", err)
+	}
+
+	// A publish waiting on a full busBlock queue neither holds up stop nor
+	// other publishes
+	entered, release = make(chan struct{}, 1), make(chan struct{})
+	b = newIngestBus(zap.NewNop())
+	b.subscribe("slow", busBlock, 1, func(_ context.Context, batch *ingestBatch) error {
+		entered <- struct{}{}
+		<-release
+		return nil
+	})
+	b.start()
+	b.publish(ctx, batch(1))
+	<-entered // the worker holds batch 1
+	b.publish(ctx, batch(2))
+	published := make(chan struct{})
+	go func() {
+		b.publish(ctx, batch(3))
+		close(published)
+	}()
+	stopCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	b.stop(stopCtx)
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a blocked publish to give up once the bus stops")
+	}
+	close(release)
+}
+
+func TestLivePush(t *testing.T) {
+	var bodies []string
+	var contentType, auth string
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		contentType, auth = r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	cfg := LivePushConfig{
+		Endpoint:           srv.URL,
+		Headers:            map[string]configopaque.String{"Authorization": "Bearer glsa"},
+		SlowTraceThreshold: time.Second,
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	if cfg.Format != livePushFormatInflux || cfg.Timeout != defaultLivePushTimeout || cfg.QueueSize != defaultLivePushQueueSize {
+		t.Errorf("Unexpected defaults: %+v", cfg)
+	}
+	p := newLivePusher(cfg)
+
+	// A slow root span failing with a timeout, a child failing the same
+	// way, a child failing without exception events and a fast root
+	batch := &ingestBatch{spans: []tracestore.EncodedSpan{
+		{Header: json.RawMessage(`{"trace_id":"t1","span_id":"s1","parent_span_id":"","service_name":"checkout","span_name":"POST /pay","start_time_unix_nano":1000000000,"end_time_unix_nano":3500000000,"status":{"code":2},"events":[{"name":"exception","timestamp":3000000000,"attributes":{"exception.type":"TimeoutError","exception.message":"upstream \"bank\" timed out"}}]}`)},
+		{Header: json.RawMessage(`{"trace_id":"t1","span_id":"s2","parent_span_id":"s1","service_name":"checkout","span_name":"POST /pay","start_time_unix_nano":1000000000,"end_time_unix_nano":1100000000,"status":{"code":2},"events":[{"name":"exception","attributes":{"exception.type":"TimeoutError"}}]}`)},
+		{Header: json.RawMessage(`{"trace_id":"t1","span_id":"s3","parent_span_id":"s1","service_name":"checkout","span_name":"db query","start_time_unix_nano":1000000000,"end_time_unix_nano":1100000000,"status":{"code":2,"message":"deadlock"}}`)},
+		{Header: json.RawMessage(`{"trace_id":"t2","span_id":"s4","parent_span_id":"0000000000000000","service_name":"checkout","span_name":"GET /","start_time_unix_nano":1000000000,"end_time_unix_nano":1200000000,"status":{"code":0}}`)},
+	}}
+	if err := p.push(context.Background(), batch); err != nil {
+		t.Fatalf("push() error = %v", err)
+	}
+	want := `exception,service=checkout,span=POST\ /pay,exception_type=TimeoutError trace_id="t1",span_id="s1",message="upstream \"bank\" timed out" 3000000000
+slow_trace,service=checkout,span=POST\ /pay trace_id="t1",span_id="s1",duration_ms=2500 1000000000
+exception,service=checkout,span=db\ query trace_id="t1",span_id="s3",message="deadlock" 1000000000
+`
+	if len(bodies) != 1 || bodies[0] != want {
+		t.Fatalf("Pushed %q, want %q", bodies, want)
+	}
+	if !strings.HasPrefix(contentType, "text/plain") || auth != "Bearer glsa" {
+		t.Errorf("Unexpected headers: Content-Type %q, Authorization %q", contentType, auth)
+	}
+
+	// Known exception groups are not pushed again; slow traces always are
+	p.config.Format = livePushFormatJSON
+	if err := p.push(context.Background(), batch); err != nil {
+		t.Fatalf("push() error = %v", err)
+	}
+	var events []livePushEvent
+	if err := json.Unmarshal([]byte(bodies[1]), &events); err != nil {
+		t.Fatalf("Failed to decode JSON push: %v", err)
+	}
+	if len(events) != 1 || events[0].Type != "slow_trace" || events[0].DurationMs != 2500 || contentType != "application/json" {
+		t.Errorf("Expected only the slow trace as JSON, got %+v (%s)", events, contentType)
+	}
+
+	// Nothing to report sends nothing; a refused push is an error
+	if err := p.push(context.Background(), &ingestBatch{spans: batch.spans[3:]}); err != nil || len(bodies) != 2 {
+		t.Errorf("Expected no request for an uneventful batch, got %d, %v", len(bodies), err)
+	}
+	status = http.StatusUnauthorized
+	if err := p.push(context.Background(), batch); err == nil {
+		t.Error("Expected an error for a refused push")
+	}
+
+	for _, bad := range []LivePushConfig{
+		{Endpoint: "grafana:3000/api/live/push/gotel"},
+		{Endpoint: srv.URL, Format: "xml"},
+		{Endpoint: srv.URL, SlowTraceThreshold: -time.Second},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestDefaultQueueConfig(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	if !cfg.QueueConfig.HasValue() {
+		t.Fatal("Expected sending_queue to be enabled by default")
+	}
+	queueCfg := cfg.QueueConfig.Get()
+	if queueCfg.NumConsumers != defaultQueueConsumers {
+		t.Errorf("Expected %d consumers, got %d", defaultQueueConsumers, queueCfg.NumConsumers)
+	}
+	if queueCfg.QueueSize <= 0 {
+		t.Errorf("Expected a positive default queue size, got %d", queueCfg.QueueSize)
+	}
+	if err := queueCfg.Validate(); err != nil {
+		t.Errorf("Default queue config is invalid: %v", err)
+	}
+}
+
+func TestWriteThrottle(t *testing.T) {
+	if newWriteThrottle(BackpressureConfig{}) != nil {
+		t.Error("Expected backpressure to be disabled without a threshold")
+	}
+	var disabled *writeThrottle
+	if err := disabled.check(); err != nil {
+		t.Errorf("Expected nil throttle to allow writes, got %v", err)
+	}
+
+	now := time.Unix(1000, 0)
+	throttle := newWriteThrottle(BackpressureConfig{LatencyThreshold: 100 * time.Millisecond, Cooldown: time.Second})
+	throttle.now = func() time.Time { return now }
+
+	if _, degraded := throttle.observe(20 * time.Millisecond); degraded {
+		t.Fatal("Expected fast write not to degrade")
+	}
+	if err := throttle.check(); err != nil {
+		t.Fatalf("Expected writes to be allowed, got %v", err)
+	}
+
+	// A single slow insert pushes the average over the threshold.
+	if _, degraded := throttle.observe(time.Second); !degraded {
+		t.Fatal("Expected slow write to degrade")
+	}
+	err := throttle.check()
+	if err == nil || !errors.Is(err, errWriteLatencyDegraded) {
+		t.Fatalf("Expected throttle error, got %v", err)
+	}
+	if consumererror.IsPermanent(err) {
+		t.Error("Expected throttle error to be retryable")
+	}
+
+	// After the cooldown a probe write is allowed, and fast probes recover.
+	now = now.Add(time.Second)
+	if err := throttle.check(); err != nil {
+		t.Fatalf("Expected probe after cooldown, got %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		throttle.observe(10 * time.Millisecond)
+	}
+	if avg, degraded := throttle.observe(10 * time.Millisecond); degraded {
+		t.Errorf("Expected recovery after fast probes, avg %v", avg)
+	}
+}
+
+func TestPushTracesBackpressure(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	exp.throttle = newWriteThrottle(BackpressureConfig{LatencyThreshold: time.Nanosecond, Cooldown: time.Hour})
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "slow-service")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{9}))
+	span.SetSpanID(pcommon.SpanID([8]byte{9}))
+	span.SetName("op")
+
+	ctx := context.Background()
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("First push should be written, got %v", err)
+	}
+	if err := exp.pushTraces(ctx, td); !errors.Is(err, errWriteLatencyDegraded) {
+		t.Fatalf("Expected second push to be refused, got %v", err)
+	}
+	stats, _ := exp.store.Stats(ctx)
+	if stats.SpanCount != 1 {
+		t.Errorf("Expected refused batch not to be stored, got %d spans", stats.SpanCount)
+	}
+}
+
+func TestDiskFull(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+	ctx := context.Background()
+
+	now := time.Unix(1000, 0)
+	exp.diskFull.now = func() time.Time { return now }
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		exp.handleReady(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+	if ready() != http.StatusOK {
+		t.Fatal("Expected ready before the disk fills up")
+	}
+
+	other := errors.New("failed to insert data: no such table: spans")
+	if err := exp.writeFailed(other); err != other || exp.diskFull.status() != nil {
+		t.Errorf("Expected other write errors to pass through, got %v", err)
+	}
+
+	full := fmt.Errorf("failed to insert data: %w", &os.PathError{Op: "write", Path: "gotel.db-wal", Err: syscall.ENOSPC})
+	err := exp.writeFailed(full)
+	if !errors.Is(err, errDiskFull) || consumererror.IsPermanent(err) {
+		t.Fatalf("Expected a retryable disk full error, got %v", err)
+	}
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "full-service")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{7}))
+	span.SetSpanID(pcommon.SpanID([8]byte{7}))
+	span.SetName("op")
+	if err := exp.pushTraces(ctx, td); !errors.Is(err, errDiskFull) {
+		t.Fatalf("Expected push to be refused while the disk is full, got %v", err)
+	}
+	if ready() != http.StatusServiceUnavailable {
+		t.Error("Expected /ready to report 503 while the disk is full")
+	}
+
+	w := httptest.NewRecorder()
+	exp.handleStatus(w, httptest.NewRequest("GET", "/api/status", nil))
+	var status struct {
+		DiskFull *diskFullStatus `json:"disk_full"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.DiskFull == nil || status.DiskFull.BatchesRefused != 1 || !strings.Contains(status.DiskFull.LastError, "no space") {
+		t.Errorf("Expected disk full state in /api/status, got %s", w.Body.String())
+	}
+
+	// After the retry interval a batch is written as a probe, and its
+	// success resumes ingest
+	now = now.Add(exp.config.DiskFull.RetryInterval)
+	if err := exp.pushTraces(ctx, td); err != nil {
+		t.Fatalf("Expected the probe batch to be written, got %v", err)
+	}
+	if exp.diskFull.status() != nil || ready() != http.StatusOK {
+		t.Error("Expected ingest to resume after a successful write")
+	}
+	if stats, _ := exp.store.Stats(ctx); stats.SpanCount != 1 {
+		t.Errorf("Expected only the probe batch to be stored, got %d spans", stats.SpanCount)
+	}
+
+	cfg := createDefaultConfig().(*Config)
+	cfg.DiskFull.EmergencyCleanupPercent = 100
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected emergency_cleanup_percent of 100 to be rejected")
+	}
+}
+
+func TestGrafanaDashboards(t *testing.T) {
+	e := &sqliteExporter{config: &Config{Prefix: "otel", Namespace: "prod"}, logger: zap.NewNop()}
+
+	req := httptest.NewRequest("GET", "/api/grafana/dashboards", nil)
+	w := httptest.NewRecorder()
+	e.handleGrafanaDashboards(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var list []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed to decode dashboards: %v", err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("Expected 3 dashboards, got %d", len(list))
+	}
+
+	req = httptest.NewRequest("GET", "/api/grafana/dashboards/gotel-service-overview", nil)
+	w = httptest.NewRecorder()
+	e.handleGrafanaDashboards(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "aliasByNode(otel.prod.$service.*.span_count, 3)") {
+		t.Errorf("Expected dashboard targets parameterized with prefix/namespace, got %s", body)
+	}
+
+	req = httptest.NewRequest("GET", "/api/grafana/dashboards/nope", nil)
+	w = httptest.NewRecorder()
+	e.handleGrafanaDashboards(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	cfg := &Config{DBPath: "x.db", BasePath: "/gotel/"}
+	if err := cfg.Validate(); err != nil || cfg.BasePath != "/gotel" {
+		t.Errorf("Expected base_path trimmed to /gotel, got %q, %v", cfg.BasePath, err)
+	}
+	cfg.BasePath = "gotel"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected base_path without a leading / to be rejected")
+	}
+
+	e := &sqliteExporter{config: &Config{Prefix: "otel", BasePath: "/gotel"}, logger: zap.NewNop()}
+	mux := http.NewServeMux()
+	var pattern string
+	mux.HandleFunc("/api/grafana/dashboards", func(w http.ResponseWriter, r *http.Request) {
+		pattern = r.Pattern
+		e.handleGrafanaDashboards(w, r)
+	})
+	handler := e.basePathMiddleware(mux)
+
+	for path, want := range map[string]int{
+		"/gotel/api/grafana/dashboards":  http.StatusOK,
+		"/api/grafana/dashboards":        http.StatusNotFound,
+		"/gotelx/api/grafana/dashboards": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("Expected status %d for %s, got %d", want, path, w.Code)
+		}
+		if want == http.StatusOK {
+			if pattern != "/api/grafana/dashboards" {
+				t.Errorf("Expected the route matched without the base path, got %q", pattern)
+			}
+			if !strings.Contains(w.Body.String(), `"url":"/gotel/api/grafana/dashboards/`) {
+				t.Errorf("Expected dashboard URLs under the base path, got %s", w.Body.String())
+			}
+		}
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "post-search-svc")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{9, 9, 9}))
+	span.SetSpanID(pcommon.SpanID([8]byte{9}))
+	span.SetName("post-search-op")
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+	exp.pushTraces(context.Background(), td)
+
+	for name, req := range map[string]*http.Request{
+		"json": httptest.NewRequest("POST", "/api/search", strings.NewReader(`{"service": "post-search-svc", "limit": 5}`)),
+		"form": httptest.NewRequest("POST", "/api/search", strings.NewReader("service=post-search-svc&limit=5")),
+	} {
+		if name == "json" {
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		exp.handleSearchTraces(w, req)
+		var result struct {
+			Traces []interface{} `json:"traces"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		if w.Code != http.StatusOK || len(result.Traces) != 1 {
+			t.Errorf("Expected one trace for a %s search body, got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+
+	exp.config.MaxRequestBodyBytes = 64
+	large := "target=" + strings.Repeat("a", 100)
+	for name, handler := range map[string]http.HandlerFunc{
+		"/render":       exp.handleRenderMetrics,
+		"/metrics/find": exp.handleFindMetrics,
+		"/api/search":   exp.handleSearchTraces,
+	} {
+		// Declared length over the limit is rejected before the handler runs
+		req := httptest.NewRequest("POST", name, strings.NewReader(large))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		exp.bodyLimitMiddleware(handler).ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413 for %s, got %d", name, w.Code)
+		}
+
+		// Unknown length (chunked) is cut off while the handler reads it
+		req = httptest.NewRequest("POST", name, strings.NewReader(large))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.ContentLength = -1
+		w = httptest.NewRecorder()
+		exp.bodyLimitMiddleware(handler).ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), `"code":"too_large"`) {
+			t.Errorf("Expected 413 too_large for a chunked %s body, got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+
+	cfg := &Config{DBPath: "x.db", MaxRequestBodyBytes: -1}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected negative max_request_body_bytes to be rejected")
+	}
+}
+
+func TestQueryServerTLS(t *testing.T) {
+	cfg := &Config{DBPath: "x.db", TLS: configoptional.Some(configtls.ServerConfig{})}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected tls without cert_file and key_file to be rejected")
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTLS := func(t *testing.T, serverTLS configtls.ServerConfig) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		cfg := &Config{
+			DBPath:      filepath.Join(t.TempDir(), "tls.db"),
+			Prefix:      "otel",
+			StoreTraces: true,
+			QueryPort:   port,
+			TLS:         configoptional.Some(serverTLS),
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		exp, err := newSQLiteExporter(cfg, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := exp.start(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { exp.shutdown(context.Background()) })
+		return fmt.Sprintf("127.0.0.1:%d", port)
+	}
+
+	// get retries until the server is listening
+	get := func(client *http.Client, target string) (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = client.Get(target); err == nil || !strings.Contains(err.Error(), "connection refused") {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return resp, err
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		addr := startTLS(t, configtls.ServerConfig{Config: configtls.Config{CertFile: certFile, KeyFile: keyFile}})
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		resp, err := get(client, "https://"+addr+"/api/services")
+		if err != nil {
+			t.Fatalf("HTTPS request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 over HTTPS, got %d", resp.StatusCode)
+		}
+
+		resp, err = http.Get("http://" + addr + "/api/services")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				t.Error("Expected plain HTTP to be refused on a TLS query server")
+			}
+		}
+	})
+
+	t.Run("mtls", func(t *testing.T) {
+		addr := startTLS(t, configtls.ServerConfig{
+			Config:       configtls.Config{CertFile: certFile, KeyFile: keyFile},
+			ClientCAFile: certFile,
+		})
+		anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		if resp, err := get(anonymous, "https://"+addr+"/api/services"); err == nil {
+			resp.Body.Close()
+			t.Error("Expected a client without a certificate to be rejected")
+		}
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{clientCert},
+		}}}
+		resp, err := get(client, "https://"+addr+"/api/services")
+		if err != nil {
+			t.Fatalf("mTLS request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 with a client certificate, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("bad certificate fails start", func(t *testing.T) {
+		cfg := &Config{
+			DBPath:    filepath.Join(t.TempDir(), "tls.db"),
+			Prefix:    "otel",
+			QueryPort: 1,
+			TLS:       configoptional.Some(configtls.ServerConfig{Config: configtls.Config{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile}}),
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		exp, err := newSQLiteExporter(cfg, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := exp.start(context.Background(), nil); err == nil {
+			exp.shutdown(context.Background())
+			t.Error("Expected start to fail with a missing certificate")
+		}
+	})
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 that
+// is also valid as its own CA and as a client certificate
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gotel-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestQueryAuth(t *testing.T) {
+	for _, auth := range []QueryAuthConfig{
+		{Type: "bearer"},
+		{Type: "basic", Username: "grafana"},
+		{Type: "digest", Token: "x"},
+	} {
+		cfg := &Config{DBPath: "x.db", QueryAuth: auth}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected query_auth %+v to be rejected", auth)
+		}
+	}
+
+	t.Setenv("GOTEL_QUERY_BEARER_TOKEN", "env-token")
+	cfg := &Config{}
+	if err := cfg.applyEnvironmentOverrides(); err != nil || cfg.QueryAuth.Type != "bearer" || cfg.QueryAuth.Token != "env-token" {
+		t.Errorf("Expected GOTEL_QUERY_BEARER_TOKEN to enable bearer auth, got %+v, %v", cfg.QueryAuth, err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name   string
+		auth   QueryAuthConfig
+		method string
+		path   string
+		setup  func(r *http.Request)
+		want   int
+	}{
+		{"disabled", QueryAuthConfig{}, "GET", "/api/services", func(r *http.Request) {}, http.StatusOK},
+		{"bearer", QueryAuthConfig{Type: "bearer", Token: "s3cret"}, "GET", "/api/services", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer s3cret")
+		}, http.StatusOK},
+		{"bearer wrong token", QueryAuthConfig{Type: "bearer", Token: "s3cret"}, "GET", "/api/services", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer nope")
+		}, http.StatusUnauthorized},
+		{"bearer missing", QueryAuthConfig{Type: "bearer", Token: "s3cret"}, "GET", "/render", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic", QueryAuthConfig{Type: "basic", Username: "grafana", Password: "pw"}, "GET", "/api/search", func(r *http.Request) {
+			r.SetBasicAuth("grafana", "pw")
+		}, http.StatusOK},
+		{"basic wrong password", QueryAuthConfig{Type: "basic", Username: "grafana", Password: "pw"}, "GET", "/api/search", func(r *http.Request) {
+			r.SetBasicAuth("grafana", "wrong")
+		}, http.StatusUnauthorized},
+		{"ready is exempt", QueryAuthConfig{Type: "bearer", Token: "s3cret"}, "GET", "/ready", func(r *http.Request) {}, http.StatusOK},
+		{"preflight is exempt", QueryAuthConfig{Type: "bearer", Token: "s3cret"}, "OPTIONS", "/api/search", func(r *http.Request) {}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &sqliteExporter{config: &Config{QueryAuth: tt.auth}, logger: zap.NewNop()}
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			tt.setup(req)
+			w := httptest.NewRecorder()
+			e.corsMiddleware(e.authMiddleware(ok)).ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusUnauthorized {
+				if w.Header().Get("WWW-Authenticate") == "" {
+					t.Error("Expected a WWW-Authenticate challenge")
+				}
+				if !strings.Contains(w.Body.String(), `"code":"unauthenticated"`) {
+					t.Errorf("Expected the unauthenticated error code, got %s", w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestTenancy(t *testing.T) {
+	if err := validateTenant("team-a.prod_(eu)"); err != nil {
+		t.Errorf("Expected a Tempo-style tenant to be valid, got %v", err)
+	}
+	for _, bad := range []string{"..", "team a", "team/a", strings.Repeat("x", 151)} {
+		if validateTenant(bad) == nil {
+			t.Errorf("Expected tenant %q to be rejected", bad)
+		}
+	}
+
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+	exp.config.Tenancy = TenancyConfig{Enabled: true, Header: "X-Scope-OrgID", ResourceAttribute: "tenant.id"}
+
+	push := func(ctx context.Context, traceByte byte, service, resourceTenant string) error {
+		td := ptrace.NewTraces()
+		rs := td.ResourceSpans().AppendEmpty()
+		rs.Resource().Attributes().PutStr("service.name", service)
+		if resourceTenant != "" {
+			rs.Resource().Attributes().PutStr("tenant.id", resourceTenant)
+		}
+		span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		span.SetTraceID(pcommon.TraceID([16]byte{traceByte}))
+		span.SetSpanID(pcommon.SpanID([8]byte{traceByte}))
+		span.SetName("GET /")
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+		return exp.pushTraces(ctx, td)
+	}
+	withHeader := func(tenant string) context.Context {
+		return client.NewContext(context.Background(), client.Info{
+			Metadata: client.NewMetadata(map[string][]string{"X-Scope-OrgID": {tenant}}),
+		})
+	}
+	if err := push(withHeader("team-a"), 0xa, "checkout", "team-b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := push(context.Background(), 0xb, "billing", "team-b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := push(context.Background(), 0xd, "legacy", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := push(withHeader("team a"), 0xe, "bad", ""); !consumererror.IsPermanent(err) {
+		t.Errorf("Expected an invalid tenant to be a permanent error, got %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/search", exp.handleSearchTraces)
+	mux.HandleFunc("/api/services", exp.handleListServices)
+	mux.HandleFunc("/api/dependencies", exp.handleDependencies)
+	mux.HandleFunc("/api/traces/", exp.handleGetTrace)
+	mux.HandleFunc("/api/status/slow-ingest", exp.handleSlowIngest)
+	mux.Handle("/metrics", exp.spanMetrics.handler())
+	handler := exp.tenantMiddleware(mux)
+	get := func(target, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if tenant != "" {
+			req.Header.Set("X-Scope-OrgID", tenant)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The header wins over the resource attribute
+	body := get("/api/search?all=true", "team-a").Body.String()
+	if !strings.Contains(body, "0a000000000000000000000000000000") || strings.Contains(body, "0b00") || strings.Contains(body, "0d00") {
+		t.Errorf("Expected only team-a's trace, got %s", body)
+	}
+	body = get("/api/search?all=true", "team-b").Body.String()
+	if !strings.Contains(body, "0b000000000000000000000000000000") || strings.Contains(body, "0a00") {
+		t.Errorf("Expected only team-b's trace, got %s", body)
+	}
+	if body := get("/api/services", "").Body.String(); !strings.Contains(body, "legacy") || strings.Contains(body, "checkout") {
+		t.Errorf("Expected the default tenant's services only, got %s", body)
+	}
+	if w := get("/api/services", "team a"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid tenant, got %d", w.Code)
+	}
+	if body := get("/api/traces/0b000000000000000000000000000000", "team-a").Body.String(); strings.Contains(body, "billing") {
+		t.Errorf("Expected team-b's trace to be hidden from team-a, got %s", body)
+	}
+	if body := get("/api/traces/0b000000000000000000000000000000", "team-b").Body.String(); !strings.Contains(body, "billing") {
+		t.Errorf("Expected team-b's trace, got %s", body)
+	}
+	for _, path := range []string{"/api/dependencies", "/api/status/slow-ingest"} {
+		if w := get(path, "team-a"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"code":"forbidden"`) {
+			t.Errorf("Expected %s to be forbidden, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	// /metrics serves the scraping tenant's series only
+	body = get("/metrics", "team-a").Body.String()
+	if !strings.Contains(body, `service="checkout"`) || strings.Contains(body, "billing") || strings.Contains(body, "legacy") {
+		t.Errorf("Expected only team-a's span metrics on /metrics, got %s", body)
+	}
+	body = get("/metrics", "").Body.String()
+	if !strings.Contains(body, `service="legacy"`) || strings.Contains(body, "checkout") || strings.Contains(body, "billing") {
+		t.Errorf("Expected only the default tenant's span metrics on /metrics, got %s", body)
+	}
+	if body := get("/metrics", "team-c").Body.String(); strings.Contains(body, "span_count_total") {
+		t.Errorf("Expected no span metrics for a tenant without data, got %s", body)
+	}
+
+	metrics, err := exp.store.QueryMetrics(tracestore.WithTenant(context.Background(), "team-a"), tracestore.MetricQueryOptions{Name: "otel.%", NamePattern: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) == 0 {
+		t.Fatal("Expected span metrics tagged with team-a")
+	}
+	for _, m := range metrics {
+		if !strings.Contains(m.Tags, `"tenant":"team-a"`) || !strings.Contains(m.Tags, "checkout") {
+			t.Errorf("Expected only team-a's span metrics, got %s %s", m.Name, m.Tags)
+		}
+	}
+}
+
+func TestAnonymizedExport(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+	exp.config.Tenancy = TenancyConfig{Enabled: true, Header: "X-Scope-OrgID", ResourceAttribute: "tenant.id"}
+	anon, err := newAnonymizer(exp.config.Anonymize, exp.config.Tenancy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp.anonymizer = anon
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "billing-internal")
+	rs.Resource().Attributes().PutStr("host.name", "db-prod-7")
+	rs.Resource().Attributes().PutStr("tenant.id", "acme-corp")
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pcommon.TraceID([16]byte{7, 7, 7}))
+	span.SetSpanID(pcommon.SpanID([8]byte{7}))
+	span.SetName("charge")
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(time.Now().Add(-time.Second)))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(time.Now()))
+	span.Attributes().PutStr("enduser.id", "alice@example.com")
+	span.Attributes().PutStr("url.full", "https://billing.internal/charge?card=4111")
+	span.Attributes().PutStr("http.request.method", "POST")
+	span.TraceState().FromRaw("vendor=session-9f2c")
+	span.Status().SetCode(ptrace.StatusCodeError)
+	span.Status().SetMessage("card 4111 declined for alice@example.com")
+	event := span.Events().AppendEmpty()
+	event.SetName("exception")
+	event.Attributes().PutStr("exception.type", "CardDeclined")
+	event.Attributes().PutStr("exception.message", "declined: alice@example.com")
+	exp.pushTraces(context.Background(), td)
+
+	traceURL := "/api/traces/07070700000000000000000000000000?anonymize=true"
+	get := func(target string, handler http.HandlerFunc) string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d: %s", target, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	body := get(traceURL, exp.handleGetTrace)
+	for _, secret := range []string{"billing-internal", "db-prod-7", "alice@example.com", "card=4111", "url.full"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Expected %q to be anonymized, got %s", secret, body)
+		}
+	}
+	if !strings.Contains(body, "http.request.method") || !strings.Contains(body, "charge") || !strings.Contains(body, "CardDeclined") {
+		t.Errorf("Expected other attributes and the span name to be kept, got %s", body)
+	}
+	if !strings.Contains(body, exp.anonymizer.hashValue("card 4111 declined for alice@example.com")) {
+		t.Errorf("Expected the status message hashed, got %s", body)
+	}
+	if get(traceURL, exp.handleGetTrace) != body {
+		t.Error("Expected anonymized exports to be stable")
+	}
+
+	spans := get("/api/spans?anonymize=true&format=csv", exp.handleListSpans)
+	if strings.Contains(spans, "billing-internal") {
+		t.Errorf("Expected the service name hashed in span exports, got %s", spans)
+	}
+	raw := get("/api/spans?anonymize=true", exp.handleListSpans)
+	for _, secret := range []string{"alice@example.com", "declined for", "session-9f2c", "acme-corp"} {
+		if strings.Contains(raw, secret) {
+			t.Errorf("Expected %q to be anonymized in span documents, got %s", secret, raw)
+		}
+	}
+	if strings.Contains(raw, "trace_state") || !strings.Contains(raw, exp.anonymizer.hashValue("acme-corp")) {
+		t.Errorf("Expected trace_state stripped and the tenant hashed, got %s", raw)
+	}
+	hashed := exp.anonymizer.hashValue("billing-internal")
+	if !strings.Contains(spans, hashed) || !strings.Contains(body, hashed) {
+		t.Errorf("Expected service %s hashed consistently across exports", hashed)
+	}
+
+	w := httptest.NewRecorder()
+	exp.handleGetTrace(w, httptest.NewRequest("GET", "/api/traces/07070700000000000000000000000000?anonymize=maybe", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid anonymize value, got %d", w.Code)
+	}
+}
+
+func TestWebUI(t *testing.T) {
+	e := &sqliteExporter{config: &Config{}, logger: zap.NewNop()}
+	ui := e.uiHandler()
+
+	w := httptest.NewRecorder()
+	ui.ServeHTTP(w, httptest.NewRequest("GET", "/ui", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "ui/" {
+		t.Errorf("Expected /ui to redirect to /ui/, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	for path, contentType := range map[string]string{
+		"/ui/":          "text/html",
+		"/ui/app.js":    "text/javascript",
+		"/ui/style.css": "text/css",
+	} {
+		w = httptest.NewRecorder()
+		ui.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), contentType) {
+			t.Errorf("Expected %s served as %s, got %d %q", path, contentType, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+
+	w = httptest.NewRecorder()
+	ui.ServeHTTP(w, httptest.NewRequest("POST", "/ui/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for POST, got %d", w.Code)
+	}
+}
+
+func TestParseTimeParam(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	sec := now.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"empty", "", time.Time{}, false},
+		{"now", "now", now, false},
+		{"epoch seconds", strconv.FormatInt(sec.Unix(), 10), sec, false},
+		{"epoch millis", strconv.FormatInt(sec.UnixMilli(), 10), sec, false},
+		{"epoch micros", strconv.FormatInt(sec.UnixMicro(), 10), sec, false},
+		{"epoch nanos", strconv.FormatInt(sec.UnixNano(), 10), sec, false},
+		{"fractional seconds", strconv.FormatInt(sec.Unix(), 10) + ".5", sec.Add(500 * time.Millisecond), false},
+		{"rfc3339", "2024-03-10T11:00:00Z", sec, false},
+		{"graphite absolute", "11:00_20240310", sec, false},
+		{"graphite date", "20240310", time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), false},
+		{"relative hours", "-1h", sec, false},
+		{"relative graphite units", "-60min", sec, false},
+		{"relative grafana", "now-1h", sec, false},
+		{"relative days", "-2d", now.Add(-48 * time.Hour), false},
+		{"relative months", "-1mon", now.Add(-30 * 24 * time.Hour), false},
+		{"relative grafana months", "now-3months", now.Add(-90 * 24 * time.Hour), false},
+		{"relative years", "-1y", now.Add(-365 * 24 * time.Hour), false},
+		{"relative grafana years", "now-2years", now.Add(-730 * 24 * time.Hour), false},
+		{"relative years overflow", "-300y", time.Time{}, true},
+		{"relative seconds overflow", "-9223372037s", time.Time{}, true},
+		{"unknown unit", "-1fortnight", time.Time{}, true},
+		{"garbage", "yesterday", time.Time{}, true},
+		{"negative epoch", "-5", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimeParam(tt.input, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimeParam(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseTimeParam(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	now := time.Now()
+
+	tr, err := parseTimeRange(url.Values{"from": {"-1h"}, "end": {"now"}}, now)
+	if err != nil {
+		t.Fatalf("parseTimeRange() error = %v", err)
+	}
+	if tr.startSeconds() != now.Add(-time.Hour).Unix() || tr.endNs() != now.UnixNano() {
+		t.Errorf("Unexpected range %+v", tr)
+	}
+
+	tr, err = parseTimeRange(url.Values{}, now)
+	if err != nil || tr.startNs() != 0 || tr.endSeconds() != 0 {
+		t.Errorf("Expected unbounded range, got %+v, %v", tr, err)
+	}
+
+	if _, err := parseTimeRange(url.Values{"start": {"now"}, "until": {"-1h"}}, now); err == nil {
+		t.Error("Expected error when end is before start")
+	}
+}
+
+func TestWithDefaultLookback(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	until := now.Add(-time.Hour)
+
+	tr, err := withDefaultLookback(timeRange{}, url.Values{}, time.Hour, now)
+	if err != nil || !tr.from.Equal(now.Add(-time.Hour)) {
+		t.Errorf("open range: from = %v, err = %v", tr.from, err)
+	}
+	tr, _ = withDefaultLookback(timeRange{until: until}, url.Values{}, time.Hour, now)
+	if !tr.from.Equal(until.Add(-time.Hour)) {
+		t.Errorf("Expected lookback from the end time, got %v", tr.from)
+	}
+	from := now.Add(-48 * time.Hour)
+	if tr, _ = withDefaultLookback(timeRange{from: from}, url.Values{}, time.Hour, now); !tr.from.Equal(from) {
+		t.Errorf("Expected explicit start kept, got %v", tr.from)
+	}
+	if tr, _ = withDefaultLookback(timeRange{}, url.Values{"all": {"true"}}, time.Hour, now); !tr.from.IsZero() {
+		t.Errorf("Expected all=true to leave the range open, got %v", tr.from)
+	}
+	if tr, _ = withDefaultLookback(timeRange{}, url.Values{}, 0, now); !tr.from.IsZero() {
+		t.Errorf("Expected zero lookback to leave the range open, got %v", tr.from)
+	}
+	if _, err := withDefaultLookback(timeRange{}, url.Values{"all": {"maybe"}}, time.Hour, now); err == nil {
+		t.Error("Expected error for invalid all value")
+	}
+}
+
+func TestQueryServerMetrics(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/traces/", exp.handleGetTrace)
+	mux.Handle("/internal/metrics", exp.queryMetrics.handler())
+	// As in the query server, with the tenant middleware passing on a new
+	// request between the metrics middleware and the mux
+	exp.config.Tenancy = TenancyConfig{Enabled: true, Header: "X-Scope-OrgID"}
+	handler := exp.metricsMiddleware(exp.tenantMiddleware(recordRoute(mux)))
+
+	for _, path := range []string{"/api/traces/abc", "/api/traces/def", "/api/traces/", "/nope"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Scope-OrgID", "team-a")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/internal/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`gotel_query_requests_total{code="200",method="GET",route="/api/traces/"} 2`,
+		`gotel_query_requests_total{code="400",method="GET",route="/api/traces/"} 1`,
+		`gotel_query_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`gotel_query_request_duration_seconds_count{code="200",method="GET",route="/api/traces/"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics output:\n%s", want, body)
+		}
+	}
+	// Raw paths must not leak into labels.
+	if strings.Contains(body, "/api/traces/abc") {
+		t.Error("Expected route label to use the mux pattern, not the request path")
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	exp := newTestExporter(t)
+	defer exp.shutdown(context.Background())
+
+	decode := func(t *testing.T, w *httptest.ResponseRecorder) apiError {
+		t.Helper()
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected application/json, got %q", ct)
+		}
+		var resp apiError
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Expected JSON error body, got %q: %v", w.Body.String(), err)
+		}
+		return resp
+	}
+
+	t.Run("invalid limit", func(t *testing.T) {
+		for _, path := range []string{"/api/spans?limit=abc", "/api/search?limit=-1"} {
+			req := httptest.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+			if strings.HasPrefix(path, "/api/spans") {
+				exp.handleListSpans(w, req)
+			} else {
+				exp.handleSearchTraces(w, req)
+			}
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("%s: expected status 400, got %d", path, w.Code)
+			}
+			resp := decode(t, w)
+			if resp.Code != "invalid_argument" || resp.Error != "invalid limit" || !strings.Contains(resp.Details, "limit") {
+				t.Errorf("%s: unexpected error envelope %+v", path, resp)
+			}
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		exp.handleNotFound(w, httptest.NewRequest("GET", "/nope", nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("Expected status 404, got %d", w.Code)
+		}
+		if resp := decode(t, w); resp.Code != "not_found" {
+			t.Errorf("Unexpected error envelope %+v", resp)
+		}
+	})
+
+	t.Run("server errors hide details", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		exp.writeError(w, "Failed to query spans", errors.New("disk I/O error"), http.StatusInternalServerError)
+		resp := decode(t, w)
+		if resp.Code != "internal" || resp.Details != "" {
+			t.Errorf("Unexpected error envelope %+v", resp)
+		}
+	})
+}
+
 func newTestExporter(t *testing.T) *sqliteExporter {
 	t.Helper()
 
@@ -2,10 +2,12 @@ package sqliteexporter
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/config/configoptional"
+	"go.opentelemetry.io/collector/config/configretry"
 	"go.opentelemetry.io/collector/exporter"
 	"go.opentelemetry.io/collector/exporter/exporterhelper"
 )
@@ -16,6 +18,65 @@ const (
 	defaultRetention       = 7 * 24 * time.Hour // 168h
 	defaultCleanupInterval = time.Hour
 	defaultQueryPort       = 3200
+	defaultQueueConsumers  = 1
+
+	defaultMaxRequestBodyBytes = 10 << 20 // 10 MiB
+
+	defaultTenancyHeader = "X-Scope-OrgID"
+
+	defaultStreamingQueryBatchSize = 100
+
+	defaultCatalogRefreshInterval = 30 * time.Second
+
+	// instanceLabelHostname makes instance_label resolve to os.Hostname()
+	instanceLabelHostname = "hostname"
+
+	defaultReplicationListenAddress = ":3201"
+	defaultReplicationSyncInterval  = 5 * time.Second
+	defaultReplicationBatchSize     = 1000
+
+	defaultFileIngestPollInterval = 10 * time.Second
+
+	defaultBackpressureLatencyThreshold = 2 * time.Second
+	defaultBackpressureCooldown         = time.Second
+	defaultDiskFullRetryInterval        = 30 * time.Second
+
+	defaultSlowIngestThreshold  = time.Second
+	defaultSlowIngestBufferSize = 20
+
+	defaultSpanJoinInterval  = 30 * time.Second
+	defaultSpanJoinBatchSize = 10000
+
+	defaultWriteBatchMaxRows = 10000
+
+	defaultIncidentsInterval  = time.Minute
+	defaultIncidentsMaxTraces = 500
+	defaultIncidentMinSpans   = 20
+
+	defaultWALCheckpointInterval  = time.Minute
+	defaultWALCheckpointMaxSizeMB = 64
+
+	// The size limit is checked often so bursts are caught between cleanups,
+	// and enforced down to a low-water mark so it does not trip every check
+	dbSizeCheckInterval = time.Minute
+	dbSizeLowWaterRatio = 0.9
+
+	defaultRollupMinuteAfter = time.Hour
+	defaultRollupHourAfter   = 24 * time.Hour
+
+	defaultTraceCompactionAfter     = 24 * time.Hour
+	defaultTraceCompactionBatchSize = 10000
+
+	defaultLivePushTimeout   = 5 * time.Second
+	defaultLivePushQueueSize = 100
+
+	// Carbon's own default for carbon.agents metrics
+	defaultSelfMetricsInterval = time.Minute
+
+	// Matches tail_sampling's default decision_wait
+	defaultHooksTraceCompleteAfter = 30 * time.Second
+	defaultHooksMaxPendingTraces   = 100000
+	traceHooksCheckInterval        = time.Second
 )
 
 // TypeStr is the component.Type for this exporter
@@ -27,21 +88,75 @@ func NewFactory() exporter.Factory {
 		TypeStr,
 		createDefaultConfig,
 		exporter.WithTraces(createTracesExporter, component.StabilityLevelDevelopment),
+		exporter.WithMetrics(createMetricsExporter, component.StabilityLevelDevelopment),
+		exporter.WithLogs(createLogsExporter, component.StabilityLevelDevelopment),
 	)
 }
 
 func createDefaultConfig() component.Config {
 	return &Config{
-		DBPath:          defaultDBPath,
-		Prefix:          defaultPrefix,
-		SendMetrics:     true,
-		StoreTraces:     true,
-		Retention:       defaultRetention,
-		CleanupInterval: defaultCleanupInterval,
-		QueryPort:       defaultQueryPort,
+		DBPath:                 defaultDBPath,
+		Prefix:                 defaultPrefix,
+		SendMetrics:            true,
+		StoreTraces:            true,
+		StorageFormat:          storageFormatJSON,
+		MetricTimestamp:        metricTimestampExport,
+		Retention:              defaultRetention,
+		CleanupInterval:        defaultCleanupInterval,
+		QueryPort:              defaultQueryPort,
+		MaxRequestBodyBytes:    defaultMaxRequestBodyBytes,
+		CatalogRefreshInterval: defaultCatalogRefreshInterval,
+		QueueConfig:            configoptional.Some(defaultQueueConfig()),
+		BackOffConfig:          configretry.NewDefaultBackOffConfig(),
+		Backpressure: BackpressureConfig{
+			LatencyThreshold: defaultBackpressureLatencyThreshold,
+			Cooldown:         defaultBackpressureCooldown,
+		},
+		DiskFull: DiskFullConfig{
+			RetryInterval: defaultDiskFullRetryInterval,
+		},
+		StreamingQuery: StreamingQueryConfig{
+			BatchSize: defaultStreamingQueryBatchSize,
+		},
+		SlowIngest: SlowIngestConfig{
+			Threshold:  defaultSlowIngestThreshold,
+			BufferSize: defaultSlowIngestBufferSize,
+		},
+		ServiceGraph: SpanJoinConfig{
+			Interval:  defaultSpanJoinInterval,
+			BatchSize: defaultSpanJoinBatchSize,
+		},
+		SelfTime: SpanJoinConfig{
+			Interval:  defaultSpanJoinInterval,
+			BatchSize: defaultSpanJoinBatchSize,
+		},
+		WriteBatch: WriteBatchConfig{
+			Enabled: true,
+			MaxRows: defaultWriteBatchMaxRows,
+		},
+		WALCheckpoint: WALCheckpointConfig{
+			Interval:  defaultWALCheckpointInterval,
+			MaxSizeMB: defaultWALCheckpointMaxSizeMB,
+		},
+		SelfMetrics: SelfMetricsConfig{
+			Interval: defaultSelfMetricsInterval,
+		},
+		Hooks: HooksConfig{
+			TraceCompleteAfter: defaultHooksTraceCompleteAfter,
+			MaxPendingTraces:   defaultHooksMaxPendingTraces,
+		},
 	}
 }
 
+// defaultQueueConfig uses a single consumer: SQLite has one writer, so extra
+// consumers only add lock contention unless inserts are slow to build or
+// write_batch coalesces their commits.
+func defaultQueueConfig() exporterhelper.QueueBatchConfig {
+	queueCfg := exporterhelper.NewDefaultQueueConfig()
+	queueCfg.NumConsumers = defaultQueueConsumers
+	return queueCfg
+}
+
 func createTracesExporter(
 	ctx context.Context,
 	set exporter.Settings,
@@ -49,14 +164,11 @@ func createTracesExporter(
 ) (exporter.Traces, error) {
 	expCfg := cfg.(*Config)
 
-	exp, err := newSQLiteExporter(expCfg, set.Logger)
+	exp, err := getSharedExporter(expCfg, set)
 	if err != nil {
 		return nil, err
 	}
 
-	queueCfg := exporterhelper.NewDefaultQueueConfig()
-	queueCfg.NumConsumers = 1
-
 	return exporterhelper.NewTraces(
 		ctx,
 		set,
@@ -64,6 +176,118 @@ func createTracesExporter(
 		exp.pushTraces,
 		exporterhelper.WithStart(exp.start),
 		exporterhelper.WithShutdown(exp.shutdown),
-		exporterhelper.WithQueue(configoptional.Some(queueCfg)),
+		exporterhelper.WithQueue(expCfg.QueueConfig),
+		exporterhelper.WithRetry(expCfg.BackOffConfig),
+	)
+}
+
+func createMetricsExporter(
+	ctx context.Context,
+	set exporter.Settings,
+	cfg component.Config,
+) (exporter.Metrics, error) {
+	expCfg := cfg.(*Config)
+
+	exp, err := getSharedExporter(expCfg, set)
+	if err != nil {
+		return nil, err
+	}
+
+	return exporterhelper.NewMetrics(
+		ctx,
+		set,
+		cfg,
+		exp.pushMetrics,
+		exporterhelper.WithStart(exp.start),
+		exporterhelper.WithShutdown(exp.shutdown),
+		exporterhelper.WithQueue(expCfg.QueueConfig),
+		exporterhelper.WithRetry(expCfg.BackOffConfig),
+	)
+}
+
+func createLogsExporter(
+	ctx context.Context,
+	set exporter.Settings,
+	cfg component.Config,
+) (exporter.Logs, error) {
+	expCfg := cfg.(*Config)
+
+	exp, err := getSharedExporter(expCfg, set)
+	if err != nil {
+		return nil, err
+	}
+
+	return exporterhelper.NewLogs(
+		ctx,
+		set,
+		cfg,
+		exp.pushLogs,
+		exporterhelper.WithStart(exp.start),
+		exporterhelper.WithShutdown(exp.shutdown),
+		exporterhelper.WithQueue(expCfg.QueueConfig),
+		exporterhelper.WithRetry(expCfg.BackOffConfig),
 	)
 }
+
+// sharedExporter lets the traces, metrics and logs exporters built from one
+// config use a single store and query server. The underlying exporter is
+// started by the first start and shut down by the last shutdown.
+type sharedExporter struct {
+	*sqliteExporter
+	cfg *Config
+
+	mu   sync.Mutex
+	refs int
+}
+
+var (
+	sharedExportersMu sync.Mutex
+	sharedExporters   = map[*Config]*sharedExporter{}
+)
+
+func getSharedExporter(cfg *Config, set exporter.Settings) (*sharedExporter, error) {
+	sharedExportersMu.Lock()
+	defer sharedExportersMu.Unlock()
+
+	if shared, ok := sharedExporters[cfg]; ok {
+		return shared, nil
+	}
+	exp, err := newSQLiteExporter(cfg, set.Logger)
+	if err != nil {
+		return nil, err
+	}
+	shared := &sharedExporter{sqliteExporter: exp, cfg: cfg}
+	sharedExporters[cfg] = shared
+	return shared, nil
+}
+
+func (s *sharedExporter) start(ctx context.Context, host component.Host) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs == 0 {
+		if err := s.sqliteExporter.start(ctx, host); err != nil {
+			return err
+		}
+	}
+	s.refs++
+	return nil
+}
+
+func (s *sharedExporter) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs == 0 {
+		return nil
+	}
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+
+	sharedExportersMu.Lock()
+	delete(sharedExporters, s.cfg)
+	sharedExportersMu.Unlock()
+	return s.sqliteExporter.shutdown(ctx)
+}
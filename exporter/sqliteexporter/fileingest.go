@@ -0,0 +1,164 @@
+package sqliteexporter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+// fileIngestFailedDir is the subdirectory unparseable files are moved to, so
+// they are not retried on every scan.
+const fileIngestFailedDir = "failed"
+
+// maxFileIngestLineBytes caps a single JSONL line.
+const maxFileIngestLineBytes = 64 * 1024 * 1024
+
+// prepareFileIngest checks the watched directory and creates the archive and
+// failed directories.
+func (e *sqliteExporter) prepareFileIngest() error {
+	fc := e.config.FileIngest
+	info, err := os.Stat(fc.Directory)
+	if err != nil {
+		return fmt.Errorf("file_ingest.directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("file_ingest.directory %s is not a directory", fc.Directory)
+	}
+	if err := os.MkdirAll(filepath.Join(fc.Directory, fileIngestFailedDir), 0o755); err != nil {
+		return fmt.Errorf("failed to create file_ingest failed directory: %w", err)
+	}
+	if fc.ArchiveDirectory != "" {
+		if err := os.MkdirAll(fc.ArchiveDirectory, 0o755); err != nil {
+			return fmt.Errorf("failed to create file_ingest.archive_directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// runFileIngest scans the watched directory until shutdown
+func (e *sqliteExporter) runFileIngest() {
+	defer e.wg.Done()
+
+	e.logger.Info("Watching directory for OTLP JSON files",
+		zap.String("directory", e.config.FileIngest.Directory),
+		zap.Duration("poll_interval", e.config.FileIngest.PollInterval))
+
+	ticker := time.NewTicker(e.config.FileIngest.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		e.ingestDirectory(e.cleanupCtx)
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ingestDirectory ingests every pending file in name order. Only *.json and
+// *.jsonl files are picked up, so writers should write under another name
+// (e.g. *.tmp) and rename when complete.
+func (e *sqliteExporter) ingestDirectory(ctx context.Context) {
+	dir := e.config.FileIngest.Directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		e.logger.Error("Failed to read file_ingest directory", zap.String("directory", dir), zap.Error(err))
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(name))
+		if ext != ".json" && ext != ".jsonl" {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		traces, err := readOTLPJSONFile(path, ext == ".jsonl")
+		if err != nil {
+			e.logger.Warn("Failed to parse OTLP JSON file, moving to failed", zap.String("file", path), zap.Error(err))
+			if err := os.Rename(path, filepath.Join(dir, fileIngestFailedDir, name)); err != nil {
+				e.logger.Error("Failed to move unparseable file", zap.String("file", path), zap.Error(err))
+			}
+			continue
+		}
+
+		if err := e.pushTraces(ctx, traces); err != nil {
+			// Leave the file in place; it is retried on the next scan.
+			e.logger.Error("Failed to ingest OTLP JSON file", zap.String("file", path), zap.Error(err))
+			continue
+		}
+		e.logger.Info("Ingested OTLP JSON file", zap.String("file", path), zap.Int("spans", traces.SpanCount()))
+		e.finishIngestedFile(path, name)
+	}
+}
+
+// finishIngestedFile archives or deletes a successfully ingested file.
+func (e *sqliteExporter) finishIngestedFile(path, name string) {
+	archive := e.config.FileIngest.ArchiveDirectory
+	if archive == "" {
+		if err := os.Remove(path); err != nil {
+			e.logger.Error("Failed to delete ingested file", zap.String("file", path), zap.Error(err))
+		}
+		return
+	}
+	// Prefix with the ingest time so re-used file names don't overwrite
+	// earlier archives.
+	dest := filepath.Join(archive, time.Now().UTC().Format("20060102T150405.000000000Z")+"-"+name)
+	if err := os.Rename(path, dest); err != nil {
+		e.logger.Error("Failed to archive ingested file", zap.String("file", path), zap.Error(err))
+	}
+}
+
+// readOTLPJSONFile parses a file holding one OTLP TracesData JSON document, or
+// one document per line when jsonLines is set, into a single ptrace.Traces.
+// Any unparseable document fails the whole file so it is never half-ingested.
+func readOTLPJSONFile(path string, jsonLines bool) (ptrace.Traces, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+
+	unmarshaler := &ptrace.JSONUnmarshaler{}
+	if !jsonLines {
+		return unmarshaler.UnmarshalTraces(data)
+	}
+
+	all := ptrace.NewTraces()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFileIngestLineBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		td, err := unmarshaler.UnmarshalTraces(raw)
+		if err != nil {
+			return ptrace.Traces{}, fmt.Errorf("line %d: %w", line, err)
+		}
+		td.ResourceSpans().MoveAndAppendTo(all.ResourceSpans())
+	}
+	if err := scanner.Err(); err != nil {
+		return ptrace.Traces{}, err
+	}
+	return all, nil
+}
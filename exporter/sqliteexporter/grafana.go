@@ -0,0 +1,187 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// grafanaDashboardBuilders maps dashboard UIDs to their builders.
+var grafanaDashboardBuilders = map[string]func(root string, rootDepth int) map[string]interface{}{
+	"gotel-service-overview": buildServiceOverviewDashboard,
+	"gotel-trace-search":     buildTraceSearchDashboard,
+	"gotel-exceptions":       buildExceptionsDashboard,
+}
+
+// handleGrafanaDashboards lists the bundled dashboards, or returns a single
+// dashboard's JSON when addressed as /api/grafana/dashboards/{uid}
+func (e *sqliteExporter) handleGrafanaDashboards(w http.ResponseWriter, r *http.Request) {
+	// aliasByNode needs the number of segments in front of the service node.
+	root := e.metricRoot()
+	depth := len(strings.Split(root, "."))
+
+	uid := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/grafana/dashboards"), "/")
+	if uid != "" {
+		build, ok := grafanaDashboardBuilders[uid]
+		if !ok {
+			e.writeError(w, "unknown dashboard", nil, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e.writeJSON(w, build(root, depth))
+		return
+	}
+
+	uids := make([]string, 0, len(grafanaDashboardBuilders))
+	for uid := range grafanaDashboardBuilders {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	list := make([]map[string]interface{}, 0, len(uids))
+	for _, uid := range uids {
+		dashboard := grafanaDashboardBuilders[uid](root, depth)
+		list = append(list, map[string]interface{}{
+			"uid":       uid,
+			"title":     dashboard["title"],
+			"url":       e.config.BasePath + "/api/grafana/dashboards/" + uid,
+			"dashboard": dashboard,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, list)
+}
+
+func grafanaDatasourceVariable(name, pluginType string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":  name,
+		"type":  "datasource",
+		"query": pluginType,
+		"hide":  0,
+	}
+}
+
+func grafanaServiceVariable(root string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       "service",
+		"label":      "Service",
+		"type":       "query",
+		"datasource": map[string]interface{}{"type": "graphite", "uid": "${graphite}"},
+		"query":      root + ".*",
+		"refresh":    2,
+		"includeAll": true,
+		"multi":      true,
+		"allValue":   "*",
+	}
+}
+
+// grafanaServiceTextVariable filters Tempo panels by raw service.name; the
+// Graphite service nodes are sanitized and cannot be reused in TraceQL.
+func grafanaServiceTextVariable() map[string]interface{} {
+	return map[string]interface{}{
+		"name":  "service",
+		"label": "Service (regex)",
+		"type":  "textbox",
+		"query": ".*",
+	}
+}
+
+func grafanaDashboard(uid, title string, variables []map[string]interface{}, panels []map[string]interface{}) map[string]interface{} {
+	for i, p := range panels {
+		p["id"] = i + 1
+	}
+	return map[string]interface{}{
+		"uid":           uid,
+		"title":         title,
+		"tags":          []string{"gotel"},
+		"schemaVersion": 39,
+		"editable":      true,
+		"time":          map[string]interface{}{"from": "now-6h", "to": "now"},
+		"refresh":       "30s",
+		"templating":    map[string]interface{}{"list": variables},
+		"panels":        panels,
+	}
+}
+
+func grafanaGraphitePanel(title string, x, y int, targets ...string) map[string]interface{} {
+	refs := make([]map[string]interface{}, 0, len(targets))
+	for i, t := range targets {
+		refs = append(refs, map[string]interface{}{
+			"refId":  string(rune('A' + i)),
+			"target": t,
+		})
+	}
+	return map[string]interface{}{
+		"type":       "timeseries",
+		"title":      title,
+		"datasource": map[string]interface{}{"type": "graphite", "uid": "${graphite}"},
+		"gridPos":    map[string]interface{}{"x": x, "y": y, "w": 12, "h": 8},
+		"targets":    refs,
+	}
+}
+
+func grafanaTempoTablePanel(title, traceQL string, y int) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "table",
+		"title":      title,
+		"datasource": map[string]interface{}{"type": "tempo", "uid": "${tempo}"},
+		"gridPos":    map[string]interface{}{"x": 0, "y": y, "w": 24, "h": 12},
+		"targets": []map[string]interface{}{
+			{
+				"refId":     "A",
+				"queryType": "traceql",
+				"query":     traceQL,
+				"limit":     50,
+			},
+		},
+	}
+}
+
+func buildServiceOverviewDashboard(root string, depth int) map[string]interface{} {
+	// Series are aliased to the span segment, which follows the service segment.
+	spanNode := depth + 1
+	series := func(metric string) string {
+		return fmt.Sprintf("aliasByNode(%s.$service.*.%s, %d)", root, metric, spanNode)
+	}
+	return grafanaDashboard("gotel-service-overview", "Gotel / Service Overview",
+		[]map[string]interface{}{
+			grafanaDatasourceVariable("graphite", "graphite"),
+			grafanaServiceVariable(root),
+		},
+		[]map[string]interface{}{
+			grafanaGraphitePanel("Span count", 0, 0, series("span_count")),
+			grafanaGraphitePanel("Average duration (ms)", 12, 0, series("duration_ms")),
+			grafanaGraphitePanel("Errors", 0, 8, series("error_count")),
+			grafanaGraphitePanel("Over latency budget", 12, 8, series("over_budget_count")),
+		})
+}
+
+func buildTraceSearchDashboard(root string, depth int) map[string]interface{} {
+	return grafanaDashboard("gotel-trace-search", "Gotel / Trace Search",
+		[]map[string]interface{}{
+			grafanaDatasourceVariable("tempo", "tempo"),
+			grafanaServiceTextVariable(),
+		},
+		[]map[string]interface{}{
+			grafanaTempoTablePanel("Recent traces", `{ resource.service.name =~ "$service" }`, 0),
+		})
+}
+
+func buildExceptionsDashboard(root string, depth int) map[string]interface{} {
+	serviceNode, spanNode := depth, depth+1
+	return grafanaDashboard("gotel-exceptions", "Gotel / Exceptions",
+		[]map[string]interface{}{
+			grafanaDatasourceVariable("graphite", "graphite"),
+			grafanaDatasourceVariable("tempo", "tempo"),
+			grafanaServiceTextVariable(),
+		},
+		[]map[string]interface{}{
+			grafanaGraphitePanel("Errors by operation", 0, 0,
+				fmt.Sprintf("aliasByNode(%s.*.*.error_count, %d, %d)", root, serviceNode, spanNode)),
+			grafanaGraphitePanel("Exceptions by operation", 12, 0,
+				fmt.Sprintf("aliasByNode(%s.*.*.exception_count, %d, %d)", root, serviceNode, spanNode)),
+			grafanaTempoTablePanel("Failing traces", `{ resource.service.name =~ "$service" && status = error }`, 8),
+		})
+}
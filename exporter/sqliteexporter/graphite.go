@@ -140,15 +140,23 @@ func extractServiceFromTags(tags string) string {
 	return ""
 }
 
-// traceQLServiceRe matches service.name in TraceQL expressions
-var traceQLServiceRe = regexp.MustCompile(`(?:resource\.)?service\.name\s*=\s*"([^"]+)"`)
-
-func extractServiceFromTraceQL(q string) string {
-	m := traceQLServiceRe.FindStringSubmatch(q)
-	if len(m) == 2 {
-		return m[1]
+// extractAttributeTags returns the span attribute filters of a Tempo tags
+// parameter: every key=value pair except the service name.
+func extractAttributeTags(tags string) map[string]string {
+	attrs := make(map[string]string)
+	for _, f := range strings.Fields(tags) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		val := strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		if key == "" || key == "service.name" || key == "resource.service.name" {
+			continue
+		}
+		attrs[key] = val
 	}
-	return ""
+	return attrs
 }
 
 func graphiteToLikePattern(query string) string {
@@ -0,0 +1,172 @@
+package sqliteexporter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// renderFormats are the /render output formats, as Graphite's format
+// parameter names them
+var renderFormats = map[string]bool{"json": true, "raw": true, "csv": true, "pickle": true}
+
+// regularSeries is a series laid out on a fixed step, as Graphite's raw and
+// pickle formats expect: values[i] is the point at start+i*step, or nil.
+type regularSeries struct {
+	name             string
+	start, end, step int64
+	values           []interface{}
+}
+
+// regularize lays sparse [value, timestamp] points out on a fixed step: the
+// smallest gap between them, or defaultStep for a single point. Every point
+// gets its own slot, since no two are closer than the step.
+func regularize(name string, datapoints []interface{}, defaultStep int64) regularSeries {
+	rs := regularSeries{name: name, step: defaultStep}
+	if len(datapoints) == 0 {
+		return rs
+	}
+	ts := func(i int) int64 { return datapoints[i].([]interface{})[1].(int64) }
+	var minGap int64
+	for i := 1; i < len(datapoints); i++ {
+		if gap := ts(i) - ts(i-1); gap > 0 && (minGap == 0 || gap < minGap) {
+			minGap = gap
+		}
+	}
+	if minGap > 0 {
+		rs.step = minGap
+	}
+	rs.start = ts(0)
+	rs.values = make([]interface{}, (ts(len(datapoints)-1)-rs.start)/rs.step+1)
+	for i, dp := range datapoints {
+		rs.values[(ts(i)-rs.start)/rs.step] = dp.([]interface{})[0]
+	}
+	rs.end = rs.start + int64(len(rs.values))*rs.step
+	return rs
+}
+
+// writeRenderResults writes /render results in the requested format:
+//   - json: [{"target", "datapoints": [[value, timestamp], ...]}]
+//   - raw: one line per series, name,start,end,step|v1,v2,... with None gaps
+//   - csv: one name,YYYY-MM-DD HH:MM:SS,value line per point, in UTC
+//   - pickle: the list of {name, start, end, step, values} dicts graphite-web
+//     federation reads
+func (e *sqliteExporter) writeRenderResults(w http.ResponseWriter, format string, results []map[string]interface{}, defaultStep int64) {
+	var buf bytes.Buffer
+	switch format {
+	case "raw":
+		for _, result := range results {
+			rs := regularize(result["target"].(string), result["datapoints"].([]interface{}), defaultStep)
+			fmt.Fprintf(&buf, "%s,%d,%d,%d|", rs.name, rs.start, rs.end, rs.step)
+			for i, v := range rs.values {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if v == nil {
+					buf.WriteString("None")
+				} else {
+					buf.WriteString(strconv.FormatFloat(v.(float64), 'g', -1, 64))
+				}
+			}
+			buf.WriteByte('\n')
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	case "csv":
+		cw := csv.NewWriter(&buf)
+		for _, result := range results {
+			name := result["target"].(string)
+			for _, dp := range result["datapoints"].([]interface{}) {
+				pair := dp.([]interface{})
+				cw.Write([]string{
+					name,
+					time.Unix(pair[1].(int64), 0).UTC().Format("2006-01-02 15:04:05"),
+					strconv.FormatFloat(pair[0].(float64), 'g', -1, 64),
+				})
+			}
+		}
+		cw.Flush()
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+
+	case "pickle":
+		series := make([]regularSeries, 0, len(results))
+		for _, result := range results {
+			series = append(series, regularize(result["target"].(string), result["datapoints"].([]interface{}), defaultStep))
+		}
+		writeRenderPickle(&buf, series)
+		w.Header().Set("Content-Type", "application/pickle")
+
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		e.writeJSON(w, results)
+		return
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		e.logger.Debug("Failed to write render response", zap.Error(err))
+	}
+}
+
+// writeRenderPickle encodes series as a protocol 2 Python pickle of
+// [{"name", "start", "end", "step", "values"}, ...], using only the opcodes
+// graphite-web's unpickler allows.
+func writeRenderPickle(buf *bytes.Buffer, series []regularSeries) {
+	buf.Write([]byte{0x80, 2}) // PROTO 2
+	buf.WriteByte(']')         // EMPTY_LIST
+	if len(series) > 0 {
+		buf.WriteByte('(') // MARK
+		for _, rs := range series {
+			buf.WriteByte('}') // EMPTY_DICT
+			buf.WriteByte('(') // MARK
+			pickleString(buf, "name")
+			pickleString(buf, rs.name)
+			pickleString(buf, "start")
+			pickleInt(buf, rs.start)
+			pickleString(buf, "end")
+			pickleInt(buf, rs.end)
+			pickleString(buf, "step")
+			pickleInt(buf, rs.step)
+			pickleString(buf, "values")
+			buf.WriteByte(']') // EMPTY_LIST
+			if len(rs.values) > 0 {
+				buf.WriteByte('(') // MARK
+				for _, v := range rs.values {
+					if v == nil {
+						buf.WriteByte('N') // NONE
+						continue
+					}
+					buf.WriteByte('G') // BINFLOAT
+					binary.Write(buf, binary.BigEndian, math.Float64bits(v.(float64)))
+				}
+				buf.WriteByte('e') // APPENDS
+			}
+			buf.WriteByte('u') // SETITEMS
+		}
+		buf.WriteByte('e') // APPENDS
+	}
+	buf.WriteByte('.') // STOP
+}
+
+func pickleString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('X') // BINUNICODE
+	binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func pickleInt(buf *bytes.Buffer, n int64) {
+	if n >= math.MinInt32 && n <= math.MaxInt32 {
+		buf.WriteByte('J') // BININT
+		binary.Write(buf, binary.LittleEndian, int32(n))
+		return
+	}
+	buf.WriteByte(0x8a) // LONG1
+	buf.WriteByte(8)
+	binary.Write(buf, binary.LittleEndian, n)
+}
@@ -0,0 +1,616 @@
+package sqliteexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errInvalidTarget marks /render targets that fail to parse or call a
+// function with bad arguments, which are reported as 400 rather than 500.
+var errInvalidTarget = errors.New("invalid target")
+
+// renderExpr is a parsed /render target: a metric path, a function call, or
+// a string or number argument.
+type renderExpr struct {
+	call   string // function name, when this is a call
+	args   []renderExpr
+	path   string // metric path, when this is a series reference
+	str    string
+	num    float64
+	isStr  bool
+	isNum  bool
+	source string // the expression as written, used as a default series name
+}
+
+// renderSeries is one evaluated series. Points are sorted by timestamp and
+// sparse: there are no null placeholders.
+type renderSeries struct {
+	name   string
+	points []renderPoint
+	// exemplars link points to traces. Only series read straight from
+	// storage have them; functions that derive new series drop them.
+	exemplars []renderExemplar
+}
+
+type renderPoint struct {
+	value float64
+	ts    int64
+}
+
+// parseRenderTarget parses a Graphite target expression such as
+// sumSeries(aliasByNode(otel.*.*.span_count, 1), otel.x.y.span_count).
+func parseRenderTarget(target string) (renderExpr, error) {
+	p := &renderParser{s: target}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return renderExpr{}, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return renderExpr{}, fmt.Errorf("%w: unexpected %q at offset %d", errInvalidTarget, p.s[p.pos:], p.pos)
+	}
+	return expr, nil
+}
+
+type renderParser struct {
+	s   string
+	pos int
+}
+
+func (p *renderParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *renderParser) parseExpr() (renderExpr, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.pos >= len(p.s) {
+		return renderExpr{}, fmt.Errorf("%w: unexpected end of target", errInvalidTarget)
+	}
+
+	if q := p.s[p.pos]; q == '\'' || q == '"' {
+		end := strings.IndexByte(p.s[p.pos+1:], q)
+		if end < 0 {
+			return renderExpr{}, fmt.Errorf("%w: unterminated string at offset %d", errInvalidTarget, p.pos)
+		}
+		str := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return renderExpr{str: str, isStr: true, source: p.s[start:p.pos]}, nil
+	}
+
+	// A bare token runs to the next top-level ',' or ')' or an opening '(';
+	// commas inside {a,b} globs belong to the path.
+	braces := 0
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '{' {
+			braces++
+		} else if c == '}' && braces > 0 {
+			braces--
+		} else if braces == 0 && (c == ',' || c == ')' || c == '(') {
+			break
+		}
+		p.pos++
+	}
+	token := strings.TrimSpace(p.s[start:p.pos])
+	if token == "" {
+		return renderExpr{}, fmt.Errorf("%w: missing expression at offset %d", errInvalidTarget, start)
+	}
+
+	if p.pos < len(p.s) && p.s[p.pos] == '(' {
+		p.pos++
+		call := renderExpr{call: token}
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == ')' {
+			p.pos++
+			call.source = p.s[start:p.pos]
+			return call, nil
+		}
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return renderExpr{}, err
+			}
+			call.args = append(call.args, arg)
+			p.skipSpace()
+			if p.pos >= len(p.s) {
+				return renderExpr{}, fmt.Errorf("%w: unclosed call to %s", errInvalidTarget, token)
+			}
+			if p.s[p.pos] == ')' {
+				p.pos++
+				break
+			}
+			if p.s[p.pos] != ',' {
+				return renderExpr{}, fmt.Errorf("%w: unexpected %q in call to %s", errInvalidTarget, p.s[p.pos], token)
+			}
+			p.pos++
+		}
+		call.source = p.s[start:p.pos]
+		return call, nil
+	}
+
+	if n, err := strconv.ParseFloat(token, 64); err == nil {
+		return renderExpr{num: n, isNum: true, source: token}, nil
+	}
+	if token == "true" || token == "false" {
+		return renderExpr{str: token, isStr: true, source: token}, nil
+	}
+	return renderExpr{path: token, source: token}, nil
+}
+
+// renderFunc evaluates a function call given its unevaluated arguments
+type renderFunc func(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error)
+
+// renderFuncs is the Graphite function library supported by /render. It is
+// filled in init since the evaluator and the functions refer to each other.
+var renderFuncs map[string]renderFunc
+
+func init() {
+	renderFuncs = map[string]renderFunc{
+		"alias":          renderAlias,
+		"aliasByNode":    renderAliasByNode,
+		"aliasByTags":    renderAliasByTags,
+		"aliasSub":       renderAliasSub,
+		"averageSeries":  combineSeriesFunc("averageSeries", aggregateAverage),
+		"avg":            combineSeriesFunc("averageSeries", aggregateAverage),
+		"groupByNode":    renderGroupByNode,
+		"highestCurrent": renderHighestCurrent,
+		"movingAverage":  renderMovingAverage,
+		"perSecond":      renderPerSecond,
+		"scale":          renderScale,
+		"seriesByTag":    renderSeriesByTag,
+		"sortByMaxima":   renderSortByMaxima,
+		"sum":            combineSeriesFunc("sumSeries", aggregateSum),
+		"sumSeries":      combineSeriesFunc("sumSeries", aggregateSum),
+		"summarize":      renderSummarize,
+	}
+}
+
+// evalRenderExpr evaluates a parsed target into series
+func (e *sqliteExporter) evalRenderExpr(ctx context.Context, expr renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	switch {
+	case expr.call != "":
+		fn, ok := renderFuncs[expr.call]
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported function %s", errInvalidTarget, expr.call)
+		}
+		return fn(ctx, e, expr, sq)
+	case expr.path != "":
+		grouped, err := e.queryMetricSeries(ctx, expr.path, sq)
+		if err != nil {
+			return nil, err
+		}
+		exemplars, err := e.renderExemplars(ctx, expr.path, sq)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]renderSeries, 0, len(grouped))
+		for name, datapoints := range grouped {
+			s := renderSeries{name: name, points: make([]renderPoint, 0, len(datapoints)), exemplars: exemplars[name]}
+			for _, dp := range datapoints {
+				pair := dp.([]interface{})
+				s.points = append(s.points, renderPoint{value: pair[0].(float64), ts: pair[1].(int64)})
+			}
+			out = append(out, s)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+		return out, nil
+	default:
+		return nil, fmt.Errorf("%w: %s is not a series", errInvalidTarget, expr.source)
+	}
+}
+
+// seriesArg evaluates the i-th argument of a call, which must be a series list
+func (e *sqliteExporter) seriesArg(ctx context.Context, call renderExpr, i int, sq seriesQuery) ([]renderSeries, error) {
+	if i >= len(call.args) {
+		return nil, fmt.Errorf("%w: %s needs a series argument", errInvalidTarget, call.call)
+	}
+	return e.evalRenderExpr(ctx, call.args[i], sq)
+}
+
+func intArg(call renderExpr, i int) (int, error) {
+	if i >= len(call.args) || !call.args[i].isNum || call.args[i].num != math.Trunc(call.args[i].num) {
+		return 0, fmt.Errorf("%w: %s argument %d must be an integer", errInvalidTarget, call.call, i+1)
+	}
+	return int(call.args[i].num), nil
+}
+
+func numArg(call renderExpr, i int) (float64, error) {
+	if i >= len(call.args) || !call.args[i].isNum {
+		return 0, fmt.Errorf("%w: %s argument %d must be a number", errInvalidTarget, call.call, i+1)
+	}
+	return call.args[i].num, nil
+}
+
+// strArg returns the i-th argument as a string, or def when it is absent
+func strArg(call renderExpr, i int, def string) (string, error) {
+	if i >= len(call.args) {
+		return def, nil
+	}
+	if !call.args[i].isStr {
+		return "", fmt.Errorf("%w: %s argument %d must be a string", errInvalidTarget, call.call, i+1)
+	}
+	return call.args[i].str, nil
+}
+
+// intervalArg parses a Graphite interval string such as "1h" or "5min"
+func intervalArg(call renderExpr, i int) (time.Duration, error) {
+	s, err := strArg(call, i, "")
+	if err != nil {
+		return 0, err
+	}
+	d, err := parseRelativeDuration(strings.TrimPrefix(s, "-"))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: %s interval %q is invalid", errInvalidTarget, call.call, s)
+	}
+	return d, nil
+}
+
+// aggregators reduce the values that share a timestamp or bucket
+type aggregator func(values []float64) float64
+
+func aggregateSum(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func aggregateAverage(values []float64) float64 {
+	return aggregateSum(values) / float64(len(values))
+}
+
+var aggregators = map[string]aggregator{
+	"sum":     aggregateSum,
+	"total":   aggregateSum,
+	"average": aggregateAverage,
+	"avg":     aggregateAverage,
+	"min": func(values []float64) float64 {
+		m := values[0]
+		for _, v := range values[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	},
+	"max": func(values []float64) float64 {
+		m := values[0]
+		for _, v := range values[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	},
+	"last":  func(values []float64) float64 { return values[len(values)-1] },
+	"count": func(values []float64) float64 { return float64(len(values)) },
+}
+
+func aggregatorArg(call renderExpr, i int, def string) (aggregator, error) {
+	name, err := strArg(call, i, def)
+	if err != nil {
+		return nil, err
+	}
+	agg, ok := aggregators[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has unknown aggregation %q", errInvalidTarget, call.call, name)
+	}
+	return agg, nil
+}
+
+// combineSeries merges series point by point on matching timestamps
+func combineSeries(name string, series []renderSeries, agg aggregator) renderSeries {
+	byTS := make(map[int64][]float64)
+	for _, s := range series {
+		for _, p := range s.points {
+			byTS[p.ts] = append(byTS[p.ts], p.value)
+		}
+	}
+	out := renderSeries{name: name, points: make([]renderPoint, 0, len(byTS))}
+	for ts, values := range byTS {
+		out.points = append(out.points, renderPoint{value: agg(values), ts: ts})
+	}
+	sort.Slice(out.points, func(i, j int) bool { return out.points[i].ts < out.points[j].ts })
+	return out
+}
+
+// combineSeriesFunc builds sumSeries-style functions, which take any number
+// of series lists and return a single series named after the call
+func combineSeriesFunc(name string, agg aggregator) renderFunc {
+	return func(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+		var all []renderSeries
+		for i := range call.args {
+			series, err := e.seriesArg(ctx, call, i, sq)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, series...)
+		}
+		if len(all) == 0 {
+			return nil, nil
+		}
+		args := make([]string, len(call.args))
+		for i, a := range call.args {
+			args[i] = a.source
+		}
+		return []renderSeries{combineSeries(name+"("+strings.Join(args, ",")+")", all, agg)}, nil
+	}
+}
+
+func renderAlias(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	name, err := strArg(call, 1, "")
+	if err != nil || len(call.args) != 2 {
+		return nil, fmt.Errorf("%w: alias needs a series and a name", errInvalidTarget)
+	}
+	for i := range series {
+		series[i].name = name
+	}
+	return series, nil
+}
+
+func renderAliasByNode(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	if len(call.args) < 2 {
+		return nil, fmt.Errorf("%w: aliasByNode needs at least one node", errInvalidTarget)
+	}
+	idxs := make([]int, 0, len(call.args)-1)
+	for i := 1; i < len(call.args); i++ {
+		idx, err := intArg(call, i)
+		if err != nil {
+			return nil, err
+		}
+		idxs = append(idxs, idx)
+	}
+	for i := range series {
+		series[i].name = aliasByNode(series[i].name, idxs)
+	}
+	return series, nil
+}
+
+func renderAliasSub(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	search, err := strArg(call, 1, "")
+	if err != nil {
+		return nil, err
+	}
+	replace, err := strArg(call, 2, "")
+	if err != nil || len(call.args) != 3 {
+		return nil, fmt.Errorf("%w: aliasSub needs a series, a search and a replacement", errInvalidTarget)
+	}
+	for i := range series {
+		series[i].name = aliasSub(series[i].name, search, replace)
+	}
+	return series, nil
+}
+
+// renderGroupByNode groups series by one node of their name and combines each
+// group with the callback (default average), naming it after the node.
+func renderGroupByNode(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	node, err := intArg(call, 1)
+	if err != nil {
+		return nil, err
+	}
+	agg, err := aggregatorArg(call, 2, "average")
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]renderSeries)
+	var keys []string
+	for _, s := range series {
+		key := aliasByNode(s.name, []int{node})
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], s)
+	}
+	sort.Strings(keys)
+	out := make([]renderSeries, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, combineSeries(key, groups[key], agg))
+	}
+	return out, nil
+}
+
+// renderSummarize buckets each series into intervals aligned to the epoch
+// (or to the range start with alignToFrom) and reduces each bucket with the
+// function (default sum). Empty buckets are left out.
+func renderSummarize(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := intervalArg(call, 1)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := strArg(call, 2, "sum")
+	if err != nil {
+		return nil, err
+	}
+	agg, ok := aggregators[fn]
+	if !ok {
+		return nil, fmt.Errorf("%w: summarize has unknown function %q", errInvalidTarget, fn)
+	}
+	alignToFrom := len(call.args) > 3 && call.args[3].str == "true"
+
+	step := int64(interval / time.Second)
+	var origin int64
+	if alignToFrom && !sq.tr.from.IsZero() {
+		origin = sq.tr.from.Unix()
+	}
+	for i, s := range series {
+		var points []renderPoint
+		var values []float64
+		bucket := int64(math.MinInt64)
+		flush := func() {
+			if len(values) > 0 {
+				points = append(points, renderPoint{value: agg(values), ts: bucket})
+			}
+			values = values[:0]
+		}
+		for _, p := range s.points {
+			b := origin + floorDiv(p.ts-origin, step)*step
+			if b != bucket {
+				flush()
+				bucket = b
+			}
+			values = append(values, p.value)
+		}
+		flush()
+		series[i] = renderSeries{
+			name:   fmt.Sprintf("summarize(%s, %q, %q)", s.name, call.args[1].str, fn),
+			points: points,
+		}
+	}
+	return series, nil
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// renderMovingAverage averages each point with those before it in a window of
+// a number of points, or of a time interval such as "5min".
+func renderMovingAverage(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	if len(call.args) != 2 {
+		return nil, fmt.Errorf("%w: movingAverage needs a series and a window", errInvalidTarget)
+	}
+	var points int
+	var window time.Duration
+	if call.args[1].isNum {
+		if points, err = intArg(call, 1); err != nil || points <= 0 {
+			return nil, fmt.Errorf("%w: movingAverage window must be a positive integer", errInvalidTarget)
+		}
+	} else if window, err = intervalArg(call, 1); err != nil {
+		return nil, err
+	}
+
+	for i, s := range series {
+		out := make([]renderPoint, len(s.points))
+		var sum float64
+		start := 0
+		for j, p := range s.points {
+			sum += p.value
+			for (points > 0 && j-start+1 > points) ||
+				(window > 0 && p.ts-s.points[start].ts >= int64(window/time.Second)) {
+				sum -= s.points[start].value
+				start++
+			}
+			out[j] = renderPoint{value: sum / float64(j-start+1), ts: p.ts}
+		}
+		series[i] = renderSeries{name: "movingAverage(" + s.name + "," + call.args[1].source + ")", points: out}
+	}
+	return series, nil
+}
+
+// renderPerSecond turns counters into per-second rates. A point whose value
+// dropped (a counter reset) yields no rate.
+func renderPerSecond(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range series {
+		var out []renderPoint
+		for j := 1; j < len(s.points); j++ {
+			prev, cur := s.points[j-1], s.points[j]
+			if cur.ts <= prev.ts || cur.value < prev.value {
+				continue
+			}
+			out = append(out, renderPoint{value: (cur.value - prev.value) / float64(cur.ts-prev.ts), ts: cur.ts})
+		}
+		series[i] = renderSeries{name: "perSecond(" + s.name + ")", points: out}
+	}
+	return series, nil
+}
+
+func renderScale(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	factor, err := numArg(call, 1)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range series {
+		out := make([]renderPoint, len(s.points))
+		for j, p := range s.points {
+			out[j] = renderPoint{value: p.value * factor, ts: p.ts}
+		}
+		series[i] = renderSeries{name: "scale(" + s.name + "," + call.args[1].source + ")", points: out}
+	}
+	return series, nil
+}
+
+func maxValue(s renderSeries) float64 {
+	m := math.Inf(-1)
+	for _, p := range s.points {
+		m = math.Max(m, p.value)
+	}
+	return m
+}
+
+func currentValue(s renderSeries) float64 {
+	if len(s.points) == 0 {
+		return math.Inf(-1)
+	}
+	return s.points[len(s.points)-1].value
+}
+
+// renderSortByMaxima orders series by their highest value, largest first
+func renderSortByMaxima(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(series, func(i, j int) bool { return maxValue(series[i]) > maxValue(series[j]) })
+	return series, nil
+}
+
+// renderHighestCurrent keeps the n series whose last value is highest
+func renderHighestCurrent(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	n := 1
+	if len(call.args) > 1 {
+		if n, err = intArg(call, 1); err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: highestCurrent count must be a non-negative integer", errInvalidTarget)
+		}
+	}
+	sort.SliceStable(series, func(i, j int) bool { return currentValue(series[i]) > currentValue(series[j]) })
+	if len(series) > n {
+		series = series[:n]
+	}
+	return series, nil
+}
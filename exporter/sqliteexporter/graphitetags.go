@@ -0,0 +1,372 @@
+package sqliteexporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// tagExpr is one seriesByTag expression, such as service=checkout or
+// http.route!=~/health.*. The metric name is matched as the tag "name".
+type tagExpr struct {
+	key   string
+	op    string // =, !=, =~ or !=~
+	value string
+	re    *regexp.Regexp
+}
+
+// parseTagExpr parses a Graphite tag expression. As in Graphite, regexes are
+// anchored at the start of the value, and a missing tag has the value "".
+func parseTagExpr(s string) (tagExpr, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return tagExpr{}, fmt.Errorf("%w: tag expression %q has no operator", errInvalidTarget, s)
+	}
+	te := tagExpr{key: s[:i], op: "=", value: s[i+1:]}
+	if strings.HasSuffix(te.key, "!") {
+		te.key, te.op = te.key[:len(te.key)-1], "!="
+	}
+	if strings.HasPrefix(te.value, "~") {
+		te.op, te.value = te.op+"~", te.value[1:]
+		if len(te.value) > aliasSubMaxLen {
+			return tagExpr{}, fmt.Errorf("%w: regex in %q is too long", errInvalidTarget, s)
+		}
+		re, err := regexp.Compile("^(?:" + te.value + ")")
+		if err != nil {
+			return tagExpr{}, fmt.Errorf("%w: %v", errInvalidTarget, err)
+		}
+		te.re = re
+	}
+	if te.key == "" {
+		return tagExpr{}, fmt.Errorf("%w: tag expression %q has no tag", errInvalidTarget, s)
+	}
+	return te, nil
+}
+
+// parseTagExprs parses the expressions of a seriesByTag call or tag API
+// request. At least one must select series positively (= with a value, or
+// =~ with a regex that does not match ""), so a query cannot list everything.
+func parseTagExprs(exprs []string) ([]tagExpr, error) {
+	out := make([]tagExpr, 0, len(exprs))
+	positive := false
+	for _, s := range exprs {
+		te, err := parseTagExpr(s)
+		if err != nil {
+			return nil, err
+		}
+		if (te.op == "=" && te.value != "") || (te.op == "=~" && !te.re.MatchString("")) {
+			positive = true
+		}
+		out = append(out, te)
+	}
+	if len(out) > 0 && !positive {
+		return nil, fmt.Errorf("%w: at least one tag expression must match a non-empty value", errInvalidTarget)
+	}
+	return out, nil
+}
+
+func (te tagExpr) matches(name string, tags map[string]string) bool {
+	v := tags[te.key]
+	if te.key == "name" {
+		v = name
+	}
+	switch te.op {
+	case "=":
+		return v == te.value
+	case "!=":
+		return v != te.value
+	case "=~":
+		return te.re.MatchString(v)
+	default:
+		return !te.re.MatchString(v)
+	}
+}
+
+// taggedSeries is a metric series with its decoded tags
+type taggedSeries struct {
+	name    string
+	rawTags string
+	tags    map[string]string
+}
+
+// taggedName is the Graphite name of a tagged series:
+// name;tag1=value1;tag2=value2, with tags sorted.
+func (ts taggedSeries) taggedName() string {
+	keys := make([]string, 0, len(ts.tags))
+	for k := range ts.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(ts.name)
+	for _, k := range keys {
+		b.WriteString(";" + k + "=" + ts.tags[k])
+	}
+	return b.String()
+}
+
+// parseTaggedName splits name;tag1=value1;... back into a name and tags
+func parseTaggedName(s string) (string, map[string]string) {
+	parts := strings.Split(s, ";")
+	tags := make(map[string]string, len(parts)-1)
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			tags[k] = v
+		}
+	}
+	return parts[0], tags
+}
+
+// matchTaggedSeries returns the series with points in tr that match every
+// expression. Exact name and tag matches are filtered in SQLite; negations
+// and regexes are applied here.
+func (e *sqliteExporter) matchTaggedSeries(ctx context.Context, exprs []tagExpr, tr timeRange) ([]taggedSeries, error) {
+	opts := tracestore.MetricSeriesOptions{
+		TagEquals: make(map[string]string),
+		MinTime:   tr.startSeconds(),
+		MaxTime:   tr.endSeconds(),
+	}
+	for _, te := range exprs {
+		if te.op != "=" || te.value == "" {
+			continue
+		}
+		if te.key == "name" {
+			opts.Name = te.value
+		} else {
+			opts.TagEquals[te.key] = te.value
+		}
+	}
+	series, err := e.store.ListMetricSeries(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]taggedSeries, 0, len(series))
+	for _, s := range series {
+		ts := taggedSeries{name: s.Name, rawTags: s.Tags, tags: decodeMetricTags(s.Tags)}
+		matched := true
+		for _, te := range exprs {
+			if !te.matches(ts.name, ts.tags) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			out = append(out, ts)
+		}
+	}
+	return out, nil
+}
+
+// decodeMetricTags decodes a metric's tags column, keeping string values only
+func decodeMetricTags(raw string) map[string]string {
+	var decoded map[string]interface{}
+	json.Unmarshal([]byte(raw), &decoded)
+	tags := make(map[string]string, len(decoded))
+	for k, v := range decoded {
+		if s, ok := v.(string); ok {
+			tags[k] = s
+		}
+	}
+	return tags
+}
+
+// renderSeriesByTag returns the series matching every tag expression, named
+// name;tag=value;... as Graphite names tagged series.
+func renderSeriesByTag(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	if len(call.args) == 0 {
+		return nil, fmt.Errorf("%w: seriesByTag needs at least one tag expression", errInvalidTarget)
+	}
+	raw := make([]string, len(call.args))
+	for i := range call.args {
+		s, err := strArg(call, i, "")
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = s
+	}
+	exprs, err := parseTagExprs(raw)
+	if err != nil {
+		return nil, err
+	}
+	matched, err := e.matchTaggedSeries(ctx, exprs, sq.tr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Points are read per metric name and split by tag set
+	byName := make(map[string]map[string]taggedSeries)
+	var names []string
+	for _, ts := range matched {
+		if byName[ts.name] == nil {
+			byName[ts.name] = make(map[string]taggedSeries)
+			names = append(names, ts.name)
+		}
+		byName[ts.name][ts.rawTags] = ts
+	}
+
+	var out []renderSeries
+	for _, name := range names {
+		metrics, err := e.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{
+			Name:       name,
+			Service:    sq.service,
+			MinTime:    sq.tr.startSeconds(),
+			MaxTime:    sq.tr.endSeconds(),
+			Resolution: e.seriesResolution(sq, time.Now()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		exemplars, err := e.taggedExemplars(ctx, name, sq)
+		if err != nil {
+			return nil, err
+		}
+		points := make(map[string][]renderPoint)
+		for _, m := range metrics {
+			if _, ok := byName[name][m.Tags]; ok {
+				points[m.Tags] = append(points[m.Tags], renderPoint{value: m.Value, ts: m.Timestamp})
+			}
+		}
+		for rawTags, pts := range points {
+			out = append(out, renderSeries{name: byName[name][rawTags].taggedName(), points: pts, exemplars: exemplars[rawTags]})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+// renderAliasByTags names tagged series by the given tags, joined with dots.
+// Numbers select nodes of the metric name, as in aliasByNode.
+func renderAliasByTags(ctx context.Context, e *sqliteExporter, call renderExpr, sq seriesQuery) ([]renderSeries, error) {
+	series, err := e.seriesArg(ctx, call, 0, sq)
+	if err != nil {
+		return nil, err
+	}
+	if len(call.args) < 2 {
+		return nil, fmt.Errorf("%w: aliasByTags needs at least one tag", errInvalidTarget)
+	}
+	for i := range series {
+		name, tags := parseTaggedName(series[i].name)
+		parts := make([]string, 0, len(call.args)-1)
+		for _, arg := range call.args[1:] {
+			switch {
+			case arg.isNum:
+				parts = append(parts, aliasByNode(name, []int{int(arg.num)}))
+			case arg.str == "name":
+				parts = append(parts, name)
+			case arg.isStr:
+				parts = append(parts, tags[arg.str])
+			default:
+				return nil, fmt.Errorf("%w: aliasByTags takes tag names or node numbers", errInvalidTarget)
+			}
+		}
+		series[i].name = strings.Join(parts, ".")
+	}
+	return series, nil
+}
+
+// tagAPIRequest holds the parameters shared by the /tags/autoComplete
+// endpoints: the expressions narrowing the series, their time range and the
+// result limit (default 100).
+func (e *sqliteExporter) tagAPIRequest(w http.ResponseWriter, r *http.Request) ([]taggedSeries, []tagExpr, int, bool) {
+	q := r.URL.Query()
+	limit, err := parseLimit(q, 100)
+	if err != nil {
+		e.writeError(w, "invalid limit", err, http.StatusBadRequest)
+		return nil, nil, 0, false
+	}
+	now := time.Now()
+	tr, err := parseTimeRange(q, now)
+	if err == nil {
+		tr, err = withDefaultLookback(tr, q, e.config.DefaultLookback, now)
+	}
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return nil, nil, 0, false
+	}
+	exprs, err := parseTagExprs(q["expr"])
+	if err != nil {
+		e.writeError(w, "invalid expr", err, http.StatusBadRequest)
+		return nil, nil, 0, false
+	}
+	series, err := e.matchTaggedSeries(r.Context(), exprs, tr)
+	if err != nil {
+		e.writeError(w, "Failed to query metric tags", err, http.StatusInternalServerError)
+		return nil, nil, 0, false
+	}
+	return series, exprs, limit, true
+}
+
+// sortedPrefixed returns the set's members starting with prefix, sorted and
+// cut to limit
+func sortedPrefixed(set map[string]struct{}, prefix string, limit int) []string {
+	out := make([]string, 0, len(set))
+	for v := range set {
+		if strings.HasPrefix(v, prefix) {
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// handleTagsAutoCompleteTags lists tag names for Grafana's Graphite tag
+// editor (/tags/autoComplete/tags?tagPrefix=&expr=). Tags already used in
+// expr are left out, as in Graphite.
+func (e *sqliteExporter) handleTagsAutoCompleteTags(w http.ResponseWriter, r *http.Request) {
+	series, exprs, limit, ok := e.tagAPIRequest(w, r)
+	if !ok {
+		return
+	}
+	used := make(map[string]bool, len(exprs))
+	for _, te := range exprs {
+		used[te.key] = true
+	}
+	keys := make(map[string]struct{})
+	if len(series) > 0 && !used["name"] {
+		keys["name"] = struct{}{}
+	}
+	for _, ts := range series {
+		for k := range ts.tags {
+			if !used[k] {
+				keys[k] = struct{}{}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, sortedPrefixed(keys, r.URL.Query().Get("tagPrefix"), limit))
+}
+
+// handleTagsAutoCompleteValues lists the values of one tag
+// (/tags/autoComplete/values?tag=&valuePrefix=&expr=)
+func (e *sqliteExporter) handleTagsAutoCompleteValues(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimSpace(r.URL.Query().Get("tag"))
+	if tag == "" {
+		e.writeError(w, "missing tag", fmt.Errorf("tag is required"), http.StatusBadRequest)
+		return
+	}
+	series, _, limit, ok := e.tagAPIRequest(w, r)
+	if !ok {
+		return
+	}
+	values := make(map[string]struct{})
+	for _, ts := range series {
+		if tag == "name" {
+			values[ts.name] = struct{}{}
+		} else if v, ok := ts.tags[tag]; ok {
+			values[v] = struct{}{}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, sortedPrefixed(values, r.URL.Query().Get("valuePrefix"), limit))
+}
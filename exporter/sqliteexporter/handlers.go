@@ -4,22 +4,41 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
-	"github.com/gotel/storage/sqlite"
+	"github.com/gotel/internal/memlimit"
+	"github.com/gotel/pkg/tracestore"
 )
 
 // maxQueryLimit is the maximum number of results returned by query endpoints.
 const maxQueryLimit = 10000
 
+// maxTotalCount caps the rows counted for X-Total-Count; larger result sets
+// report the cap with X-Total-Count-Exact: false.
+const maxTotalCount = 10000
+
+// maxBatchGetTraces caps the number of trace IDs accepted by /api/traces:batchGet.
+const maxBatchGetTraces = 500
+
+// tagValuesScanLimit bounds the spans read to list the values of an
+// attribute that is not indexed, most recent first
+const tagValuesScanLimit = 100000
+
+// tagValuesLimit caps the values listed for one tag
+const tagValuesLimit = 1000
+
 // maxLoggedBodyBytes caps request body logging to avoid large allocations.
 const maxLoggedBodyBytes = 64 * 1024
 
@@ -41,6 +60,79 @@ func (e *sqliteExporter) writeJSON(w http.ResponseWriter, payload interface{}) {
 	}
 }
 
+// parseLimit reads the "limit" query parameter, returning defaultLimit when it
+// is absent and an error when it is not a positive integer. Values above
+// maxQueryLimit are clamped.
+func parseLimit(q url.Values, defaultLimit int) (int, error) {
+	v := strings.TrimSpace(q.Get("limit"))
+	if v == "" {
+		return defaultLimit, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("limit must be a positive integer, got %q", v)
+	}
+	return clampLimit(n, defaultLimit), nil
+}
+
+// parseOffset reads the "offset" query parameter, returning 0 when it is
+// absent and an error when it is not a non-negative integer.
+func parseOffset(q url.Values) (int, error) {
+	v := strings.TrimSpace(q.Get("offset"))
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("offset must be a non-negative integer, got %q", v)
+	}
+	return n, nil
+}
+
+// setTotalCount reports the unpaged result count in response headers.
+func setTotalCount(w http.ResponseWriter, count int64, exact bool) {
+	w.Header().Set("X-Total-Count", strconv.FormatInt(count, 10))
+	w.Header().Set("X-Total-Count-Exact", strconv.FormatBool(exact))
+}
+
+// apiError is the JSON envelope returned by every failing endpoint. Code is a
+// stable machine-readable value derived from the HTTP status; Details carries
+// the underlying validation error for 4xx responses only, so server internals
+// are not leaked on 5xx.
+type apiError struct {
+	Error   string `json:"error"`
+	Code    string `json:"code"`
+	Details string `json:"details,omitempty"`
+}
+
+// errorCode maps an HTTP status to the apiError code.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_argument"
+	case http.StatusUnauthorized:
+		return "unauthenticated"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusRequestEntityTooLarge:
+		return "too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	if status >= http.StatusInternalServerError {
+		return "internal"
+	}
+	return "error"
+}
+
 func (e *sqliteExporter) writeError(w http.ResponseWriter, msg string, err error, status int) {
 	if status >= http.StatusInternalServerError {
 		if err != nil {
@@ -55,7 +147,20 @@ func (e *sqliteExporter) writeError(w http.ResponseWriter, msg string, err error
 			e.logger.Warn(msg)
 		}
 	}
-	http.Error(w, msg, status)
+	resp := apiError{Error: msg, Code: errorCode(status)}
+	if err != nil && status < http.StatusInternalServerError {
+		resp.Details = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	e.writeJSON(w, resp)
+}
+
+// readCloser pairs a reader with the Closer of the body it reads from
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
 
 // responseWriter wraps http.ResponseWriter to capture status code
@@ -69,16 +174,28 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush passes flushes through, so streamed responses (the gRPC streaming
+// query service) are sent as they are written
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // corsMiddleware adds CORS headers to all responses.
 // NOTE: The wildcard origin is intentional for dev/internal use and Grafana
 // datasource compatibility. For production deployments exposed to the internet,
 // consider restricting Access-Control-Allow-Origin via a reverse proxy or by
 // adding a cors_allowed_origins config option.
 func (e *sqliteExporter) corsMiddleware(next http.Handler) http.Handler {
+	allowHeaders := "Content-Type, Authorization"
+	if e.config.Tenancy.Enabled {
+		allowHeaders += ", " + e.config.Tenancy.Header
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
@@ -89,6 +206,61 @@ func (e *sqliteExporter) corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// basePathMiddleware strips base_path from request paths, so handlers and
+// route metrics see the same paths as without it. Paths outside base_path
+// are not found.
+func (e *sqliteExporter) basePathMiddleware(next http.Handler) http.Handler {
+	base := e.config.BasePath
+	if base == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, base)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			e.writeError(w, "not found", nil, http.StatusNotFound)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// bodyLimitMiddleware caps request bodies at max_request_body_bytes.
+// Requests that declare a larger Content-Length are rejected up front;
+// otherwise handlers see a *http.MaxBytesError once they read past the limit
+// (see writeBodyError).
+func (e *sqliteExporter) bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			if r.ContentLength > e.config.MaxRequestBodyBytes {
+				e.writeError(w, "request body too large",
+					fmt.Errorf("body is %d bytes, limit is %d", r.ContentLength, e.config.MaxRequestBodyBytes),
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, e.config.MaxRequestBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeBodyError reports a failure to read or parse a request body: 413 if
+// it went past max_request_body_bytes, otherwise 400 with msg
+func (e *sqliteExporter) writeBodyError(w http.ResponseWriter, msg string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		e.writeError(w, "request body too large",
+			fmt.Errorf("limit is %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	e.writeError(w, msg, err, http.StatusBadRequest)
+}
+
 // loggingMiddleware logs all HTTP requests
 func (e *sqliteExporter) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -106,7 +278,8 @@ func (e *sqliteExporter) loggingMiddleware(next http.Handler) http.Handler {
 				} else {
 					bodyStr = string(bodyBytes)
 				}
-				r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+				// Handlers still see the whole body, not just the logged part
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(bodyBytes), r.Body), r.Body}
 			}
 		}
 
@@ -143,6 +316,7 @@ func (e *sqliteExporter) startQueryServer() {
 	// Tempo-compatible endpoints (subset used by Grafana)
 	mux.HandleFunc("/api/echo", e.handleEcho)
 	mux.HandleFunc("/api/traces/", e.handleGetTrace)
+	mux.HandleFunc("/api/traces:batchGet", e.handleBatchGetTraces)
 	mux.HandleFunc("/api/v2/traces/", e.handleGetTrace)
 	mux.HandleFunc("/api/search", e.handleSearchTraces)
 	mux.HandleFunc("/api/v2/search", e.handleSearchTraces)
@@ -150,6 +324,11 @@ func (e *sqliteExporter) startQueryServer() {
 	mux.HandleFunc("/api/v2/search/tags", e.handleSearchTagsV2)
 	mux.HandleFunc("/api/search/tag/", e.handleSearchTagValues)
 	mux.HandleFunc("/api/v2/search/tag/", e.handleSearchTagValuesV2)
+	mux.HandleFunc("/api/metrics/query_range", e.handleTraceQLMetricsRange)
+	if e.queryGRPC != nil {
+		// Tempo's streaming gRPC API, served over HTTP/2 on the same port
+		mux.Handle("/tempopb.StreamingQuerier/", e.queryGRPC)
+	}
 
 	// Kept for backwards compatibility with earlier experiments
 	mux.HandleFunc("/api/services", e.handleListServices)
@@ -159,26 +338,90 @@ func (e *sqliteExporter) startQueryServer() {
 	mux.HandleFunc("/api/spans", e.handleListSpans)
 	mux.HandleFunc("/api/exceptions", e.handleListExceptions)
 
+	// Jaeger-compatible service dependency graph
+	mux.HandleFunc("/api/dependencies", e.handleDependencies)
+
+	// Operations ranked by self-time
+	mux.HandleFunc("/api/self-time", e.handleSelfTime)
+	mux.HandleFunc("/api/metrics/summary", e.handleMetricsSummary)
+
+	// Full-text search over span names, status messages and exceptions
+	mux.HandleFunc("/api/search/text", e.handleTextSearch)
+
+	// Threshold-triggered trace snapshots
+	mux.HandleFunc("/api/incidents", e.handleIncidents)
+
 	// Graphite-compatible endpoints
 	mux.HandleFunc("/render", e.handleRenderMetrics)
 	mux.HandleFunc("/metrics/find", e.handleFindMetrics)
+	mux.HandleFunc("/tags/autoComplete/tags", e.handleTagsAutoCompleteTags)
+	mux.HandleFunc("/tags/autoComplete/values", e.handleTagsAutoCompleteValues)
+
+	// Loki-compatible log endpoints (subset used by Grafana)
+	mux.HandleFunc("/loki/api/v1/query_range", e.handleLokiQueryRange)
+	mux.HandleFunc("/loki/api/v1/labels", e.handleLokiLabels)
+	mux.HandleFunc("/loki/api/v1/label/", e.handleLokiLabelValues)
+
+	// Grafana dashboard provisioning
+	mux.HandleFunc("/api/grafana/dashboards", e.handleGrafanaDashboards)
+	mux.HandleFunc("/api/grafana/dashboards/", e.handleGrafanaDashboards)
 
 	// Status endpoints
 	mux.HandleFunc("/api/status", e.handleStatus)
+	mux.HandleFunc("/api/status/slow-ingest", e.handleSlowIngest)
 	mux.HandleFunc("/ready", e.handleReady)
 
-	// Wrap mux with CORS and logging middleware
-	handler := e.loggingMiddleware(e.corsMiddleware(mux))
+	// Replication endpoints
+	mux.HandleFunc("/api/replication/status", e.handleReplicationStatus)
+	mux.HandleFunc("/api/replication/promote", e.handleReplicationPromote)
+
+	// Embedded trace browser
+	ui := e.uiHandler()
+	mux.Handle("/ui", ui)
+	mux.Handle("/ui/", ui)
+
+	// Query-server telemetry (Prometheus text format)
+	mux.Handle("/internal/metrics", e.queryMetrics.handler())
+
+	// Derived span metrics for Prometheus scrapes
+	mux.Handle("/metrics", e.spanMetrics.handler())
+
+	// Unknown paths get the same JSON error envelope as everything else
+	mux.HandleFunc("/", e.handleNotFound)
+
+	// Wrap mux with auth, CORS, body limit, metrics, base path and logging
+	// middleware
+	handler := e.loggingMiddleware(e.basePathMiddleware(e.metricsMiddleware(e.bodyLimitMiddleware(e.corsMiddleware(e.authMiddleware(e.tenantMiddleware(recordRoute(mux))))))))
+
+	if e.queryGRPC != nil && e.server.TLSConfig == nil {
+		// gRPC needs HTTP/2, which plain-text clients speak as h2c; over TLS
+		// it is negotiated by the server
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
 
 	e.server.Handler = handler
 
-	e.logger.Info("Starting query server", zap.Int("port", e.config.QueryPort))
+	e.logger.Info("Starting query server",
+		zap.Int("port", e.config.QueryPort),
+		zap.Bool("tls", e.server.TLSConfig != nil))
 
-	if err := e.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	var err error
+	if e.server.TLSConfig != nil {
+		// Certificates come from TLSConfig, loaded in start
+		err = e.server.ListenAndServeTLS("", "")
+	} else {
+		err = e.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		e.logger.Error("Query server error", zap.Error(err))
 	}
 }
 
+// handleNotFound answers requests that match no registered endpoint
+func (e *sqliteExporter) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	e.writeError(w, "not found", nil, http.StatusNotFound)
+}
+
 // handleGetTrace returns a single trace by ID
 func (e *sqliteExporter) handleGetTrace(w http.ResponseWriter, r *http.Request) {
 	traceID := strings.TrimPrefix(r.URL.Path, "/api/traces/")
@@ -187,16 +430,55 @@ func (e *sqliteExporter) handleGetTrace(w http.ResponseWriter, r *http.Request)
 		traceID = strings.TrimPrefix(r.URL.Path, "/api/v2/traces/")
 		isV2 = true
 	}
-	if traceID == "" {
+	if strings.TrimSpace(traceID) == "" {
 		e.writeError(w, "trace_id required", nil, http.StatusBadRequest)
 		return
 	}
+	if id, ok := strings.CutSuffix(traceID, "/tree"); ok && !isV2 {
+		e.handleTraceTree(w, r, id)
+		return
+	}
+	traceID, err := normalizeTraceID(traceID)
+	if err != nil {
+		e.writeError(w, "invalid trace_id", err, http.StatusBadRequest)
+		return
+	}
+	anonymize, err := wantsAnonymized(r)
+	if err != nil {
+		e.writeError(w, "invalid anonymize value", err, http.StatusBadRequest)
+		return
+	}
+
+	// The body depends on Accept, so caches must key on it
+	w.Header().Add("Vary", "Accept")
+	if wantsProtobuf(r) {
+		if anonymize {
+			e.writeError(w, "anonymize is only supported for JSON", nil, http.StatusBadRequest)
+			return
+		}
+		body, err := e.traceProtobuf(r.Context(), traceID)
+		if err != nil {
+			e.writeError(w, "Failed to load trace", err, http.StatusInternalServerError)
+			return
+		}
+		if isV2 {
+			body = wrapProtobufField1(body)
+		}
+		w.Header().Set("Content-Type", "application/protobuf")
+		if _, err := w.Write(body); err != nil {
+			e.logger.Debug("Failed to write protobuf response", zap.Error(err))
+		}
+		return
+	}
 
 	spans, err := e.store.QueryTraceByID(r.Context(), traceID)
 	if err != nil {
 		e.writeError(w, "Failed to load trace", err, http.StatusInternalServerError)
 		return
 	}
+	if anonymize {
+		spans = e.anonymizer.spans(spans)
+	}
 
 	// Tempo returns OTLP JSON by default. We produce a best-effort OTLP-ish JSON
 	// shape using the fields we persist.
@@ -218,17 +500,166 @@ func (e *sqliteExporter) handleGetTrace(w http.ResponseWriter, r *http.Request)
 	e.writeJSON(w, resp)
 }
 
+// normalizeTraceID turns a trace ID as pasted from logs or other tools into
+// the stored form: surrounding whitespace and a 0x prefix are dropped, hex
+// digits are lowercased and, as in Tempo, IDs shorter than 32 digits (such as
+// 64-bit Zipkin and Jaeger IDs) are left-padded with zeros.
+func normalizeTraceID(s string) (string, error) {
+	id := strings.TrimSpace(s)
+	if strings.HasPrefix(id, "0x") || strings.HasPrefix(id, "0X") {
+		id = id[2:]
+	}
+	valid := id != "" && len(id) <= 32
+	for _, c := range id {
+		valid = valid && ('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F')
+	}
+	if !valid {
+		return "", fmt.Errorf("%q: expected up to 32 hex digits, e.g. 4bf92f3577b34da6a3ce929d0e0e4736", s)
+	}
+	return strings.Repeat("0", 32-len(id)) + strings.ToLower(id), nil
+}
+
+// handleBatchGetTraces returns several traces in one response, in request order
+func (e *sqliteExporter) handleBatchGetTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		e.writeError(w, "method not allowed", nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		TraceIDs []string `json:"traceIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		e.writeBodyError(w, "invalid request body", err)
+		return
+	}
+	if len(req.TraceIDs) == 0 {
+		e.writeError(w, "traceIds required", nil, http.StatusBadRequest)
+		return
+	}
+	if len(req.TraceIDs) > maxBatchGetTraces {
+		e.writeError(w, fmt.Sprintf("too many traceIds (max %d)", maxBatchGetTraces), nil, http.StatusBadRequest)
+		return
+	}
+
+	// Drop blanks and duplicates while keeping the caller's order.
+	seen := make(map[string]bool, len(req.TraceIDs))
+	traceIDs := make([]string, 0, len(req.TraceIDs))
+	for _, id := range req.TraceIDs {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		traceIDs = append(traceIDs, id)
+	}
+
+	found, err := e.store.QueryTracesByIDs(r.Context(), traceIDs)
+	if err != nil {
+		e.writeError(w, "Failed to load traces", err, http.StatusInternalServerError)
+		return
+	}
+
+	traces := make([]map[string]interface{}, 0, len(found))
+	missing := []string{}
+	for _, id := range traceIDs {
+		spans, ok := found[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		resourceSpans := groupSpansAsOTLPResourceSpans(spans)
+		traces = append(traces, map[string]interface{}{
+			"traceId":       id,
+			"resourceSpans": resourceSpans,
+			"batches":       resourceSpans,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, map[string]interface{}{
+		"traces":  traces,
+		"missing": missing,
+	})
+}
+
+// searchParams returns the parameters of a search request. POST and PUT
+// bodies carry the same parameters as the query string, either form-encoded
+// or as a JSON object; body values take precedence over query values.
+func searchParams(r *http.Request) (url.Values, error) {
+	q := r.URL.Query()
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		return q, nil
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.Form, nil
+	}
+
+	var body map[string]interface{}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for key, v := range body {
+		var values []string
+		switch v := v.(type) {
+		case []interface{}:
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+		case map[string]interface{}:
+			// tags may be given as an object instead of logfmt
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			pairs := make([]string, 0, len(keys))
+			for _, k := range keys {
+				pairs = append(pairs, k+"="+fmt.Sprint(v[k]))
+			}
+			values = []string{strings.Join(pairs, " ")}
+		case nil:
+			continue
+		default:
+			values = []string{fmt.Sprint(v)}
+		}
+		q[key] = values
+	}
+	return q, nil
+}
+
 // handleSearchTraces searches for traces
 func (e *sqliteExporter) handleSearchTraces(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
+	q, err := searchParams(r)
+	if err != nil {
+		e.writeBodyError(w, "invalid request body", err)
+		return
+	}
 
-	limit := 20
-	if v := q.Get("limit"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			limit = n
+	limit, err := parseLimit(q, 20)
+	if err != nil {
+		e.writeError(w, "invalid limit", err, http.StatusBadRequest)
+		return
+	}
+	offset, err := parseOffset(q)
+	if err != nil {
+		e.writeError(w, "invalid offset", err, http.StatusBadRequest)
+		return
+	}
+	// spss caps the matched spans returned per trace in spanSets
+	perTrace := defaultSpansPerSpanSet
+	if v := strings.TrimSpace(q.Get("spss")); v != "" {
+		if perTrace, err = strconv.Atoi(v); err != nil || perTrace <= 0 {
+			e.writeError(w, "invalid spss", fmt.Errorf("spss must be a positive integer, got %q", v), http.StatusBadRequest)
+			return
 		}
+		perTrace = clampLimit(perTrace, defaultSpansPerSpanSet)
 	}
-	limit = clampLimit(limit, 20)
 
 	serviceName := strings.TrimSpace(q.Get("service"))
 	spanName := strings.TrimSpace(q.Get("operation"))
@@ -242,66 +673,172 @@ func (e *sqliteExporter) handleSearchTraces(w http.ResponseWriter, r *http.Reque
 		spanName = ""
 	}
 
-	// Tempo tag search uses logfmt encoding.
-	if serviceName == "" {
-		if tags := q.Get("tags"); tags != "" {
-			if s := extractServiceFromTags(tags); s != "" {
-				serviceName = s
+	// Tempo tag search uses logfmt encoding. Tags other than the service
+	// name filter on span attributes.
+	var attributes map[string]string
+	if tags := q.Get("tags"); tags != "" {
+		if s := extractServiceFromTags(tags); s != "" && serviceName == "" {
+			serviceName = s
+		}
+		attributes = extractAttributeTags(tags)
+		for key := range attributes {
+			if strings.ContainsAny(key, `"\`) {
+				e.writeError(w, "invalid tags", fmt.Errorf("invalid attribute key %q", key), http.StatusBadRequest)
+				return
 			}
 		}
 	}
 
-	// TraceQL search uses the q parameter. We only extract the common
-	// resource.service.name / service.name matcher for now.
-	if serviceName == "" {
-		if traceQL := q.Get("q"); traceQL != "" {
-			if s := extractServiceFromTraceQL(traceQL); s != "" {
-				serviceName = s
-			}
+	// Status filters on the trace's overall status. Grafana's search builder
+	// sends it as a status tag, so that is accepted too.
+	statusParam := q.Get("status")
+	if v, ok := attributes["status"]; ok {
+		delete(attributes, "status")
+		if statusParam == "" {
+			statusParam = v
 		}
 	}
+	status, err := parseTraceStatus(statusParam)
+	if err != nil {
+		e.writeError(w, "invalid status", err, http.StatusBadRequest)
+		return
+	}
 
-	minStartNs := int64(0)
-	maxStartNs := int64(0)
-	// Tempo search uses start/end as unix epoch seconds.
-	if v := q.Get("start"); v != "" {
-		if sec, err := strconv.ParseInt(v, 10, 64); err == nil && sec > 0 {
-			minStartNs = sec * int64(time.Second)
+	// Each tracestate parameter holds comma-separated key=value or key
+	// entries, all of which must be present.
+	var traceState []tracestore.TraceStateEntry
+	for _, v := range q["tracestate"] {
+		entries, err := parseTraceStateFilter(v)
+		if err != nil {
+			e.writeError(w, "invalid tracestate filter", err, http.StatusBadRequest)
+			return
 		}
+		traceState = append(traceState, entries...)
 	}
-	if v := q.Get("end"); v != "" {
-		if sec, err := strconv.ParseInt(v, 10, 64); err == nil && sec > 0 {
-			maxStartNs = sec * int64(time.Second)
+
+	// TraceQL search uses the q parameter (see parseTraceQL).
+	var filter *tracestore.TraceFilter
+	if traceQL := strings.TrimSpace(q.Get("q")); traceQL != "" {
+		if filter, err = parseTraceQL(traceQL); err != nil {
+			e.writeError(w, "invalid TraceQL query", err, http.StatusBadRequest)
+			return
 		}
 	}
 
-	traces, err := e.store.SearchTraces(r.Context(), sqlite.TraceSearchOptions{
-		ServiceName:  serviceName,
-		SpanName:     spanName,
-		MinStartTime: minStartNs,
-		MaxStartTime: maxStartNs,
-		Limit:        limit,
-	})
+	// Tempo search sends start/end as unix epoch seconds; other formats are
+	// accepted too (see parseTimeParam).
+	now := time.Now()
+	tr, err := parseTimeRange(q, now)
+	if err == nil {
+		tr, err = withDefaultLookback(tr, q, e.config.DefaultLookback, now)
+	}
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+
+	// minDuration and maxDuration bound the trace duration, as Tempo
+	// durations such as 100ms or 1.5s
+	minDuration, err := parseSearchDuration(q.Get("minDuration"))
+	if err != nil {
+		e.writeError(w, "invalid minDuration", err, http.StatusBadRequest)
+		return
+	}
+	maxDuration, err := parseSearchDuration(q.Get("maxDuration"))
+	if err != nil {
+		e.writeError(w, "invalid maxDuration", err, http.StatusBadRequest)
+		return
+	}
+	if minDuration > 0 && maxDuration > 0 && maxDuration < minDuration {
+		e.writeError(w, "invalid maxDuration", fmt.Errorf("maxDuration %s is below minDuration %s", maxDuration, minDuration), http.StatusBadRequest)
+		return
+	}
+
+	var overBudget []tracestore.LatencyBudget
+	if v := q.Get("overBudget"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			e.writeError(w, "invalid overBudget value", err, http.StatusBadRequest)
+			return
+		}
+		if enabled {
+			if len(e.config.LatencyBudgets) == 0 {
+				e.writeError(w, "no latency budgets configured", nil, http.StatusBadRequest)
+				return
+			}
+			for _, b := range e.config.LatencyBudgets {
+				overBudget = append(overBudget, tracestore.LatencyBudget{
+					ServiceName:   b.Service,
+					SpanName:      b.Operation,
+					MaxDurationNs: b.Budget.Nanoseconds(),
+				})
+			}
+		}
+	}
+
+	opts := tracestore.TraceSearchOptions{
+		ServiceName:   serviceName,
+		SpanName:      spanName,
+		MinStartTime:  tr.startNs(),
+		MaxStartTime:  tr.endNs(),
+		Limit:         limit,
+		Offset:        offset,
+		Attributes:    attributes,
+		TraceState:    traceState,
+		Filter:        filter,
+		OverBudget:    overBudget,
+		Status:        status,
+		MinDurationNs: minDuration.Nanoseconds(),
+		MaxDurationNs: maxDuration.Nanoseconds(),
+	}
+	traces, err := e.store.SearchTraces(r.Context(), opts)
 	if err != nil {
 		e.writeError(w, "Failed to search traces", err, http.StatusInternalServerError)
 		return
 	}
+	total, exact, err := e.store.CountTraces(r.Context(), opts, maxTotalCount)
+	if err != nil {
+		e.writeError(w, "Failed to count traces", err, http.StatusInternalServerError)
+		return
+	}
+
+	spanSets, err := e.searchSpanSets(r.Context(), newSpanSetQuery(filter, serviceName, spanName, perTrace), traces, tr)
+	if err != nil {
+		e.writeError(w, "Failed to match spans", err, http.StatusInternalServerError)
+		return
+	}
 
 	results := make([]map[string]interface{}, 0, len(traces))
 	for _, t := range traces {
-		results = append(results, map[string]interface{}{
+		result := map[string]interface{}{
 			"traceID":           t.TraceID,
 			"rootServiceName":   t.RootServiceName,
 			"rootTraceName":     t.RootTraceName,
 			"startTimeUnixNano": fmt.Sprintf("%d", t.StartTimeUnixNano),
 			"durationMs":        t.DurationMs,
-		})
+			"durationNanos":     strconv.FormatInt(t.DurationNanos, 10),
+			"spanCount":         t.SpanCount,
+			"errorCount":        t.ErrorCount,
+		}
+		// spanSet is the deprecated single form, still read by older Grafana
+		if sets := spanSets[t.TraceID]; len(sets) > 0 {
+			result["spanSets"] = sets
+			result["spanSet"] = sets[0]
+		}
+		results = append(results, result)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	setTotalCount(w, total, exact)
 	e.writeJSON(w, map[string]interface{}{
 		"traces":  results,
 		"metrics": map[string]interface{}{},
+		"pagination": map[string]interface{}{
+			"total":  total,
+			"exact":  exact,
+			"offset": offset,
+			"limit":  limit,
+		},
 	})
 }
 
@@ -336,21 +873,25 @@ func (e *sqliteExporter) handleSearchTagValues(w http.ResponseWriter, r *http.Re
 	tag = strings.TrimSuffix(tag, "/values")
 	tag = strings.TrimPrefix(tag, ".")
 
-	// Only support service.name for now.
-	if tag != "service.name" && tag != "resource.service.name" {
-		e.writeError(w, "unsupported tag", nil, http.StatusNotFound)
+	tr, err := parseTimeRange(r.URL.Query(), time.Now())
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
 		return
 	}
 
-	services, err := e.store.ListServices(r.Context())
+	values, ok, err := e.tagValues(r.Context(), tag, r.URL.Query().Get("service"), tr)
+	if !ok {
+		e.writeError(w, "unsupported tag", nil, http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		e.writeError(w, "Failed to list services", err, http.StatusInternalServerError)
+		e.writeError(w, "Failed to list tag values", err, http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	e.writeJSON(w, map[string]interface{}{
-		"tagValues": services,
+		"tagValues": values,
 		"metrics":   map[string]interface{}{},
 	})
 }
@@ -360,19 +901,24 @@ func (e *sqliteExporter) handleSearchTagValuesV2(w http.ResponseWriter, r *http.
 	tag = strings.TrimSuffix(tag, "/values")
 	tag = strings.TrimPrefix(tag, ".")
 
-	if tag != "service.name" && tag != "resource.service.name" {
-		e.writeError(w, "unsupported tag", nil, http.StatusNotFound)
+	tr, err := parseTimeRange(r.URL.Query(), time.Now())
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
 		return
 	}
 
-	services, err := e.store.ListServices(r.Context())
+	names, ok, err := e.tagValues(r.Context(), tag, r.URL.Query().Get("service"), tr)
+	if !ok {
+		e.writeError(w, "unsupported tag", nil, http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		e.writeError(w, "Failed to list services", err, http.StatusInternalServerError)
+		e.writeError(w, "Failed to list tag values", err, http.StatusInternalServerError)
 		return
 	}
 
-	values := make([]map[string]interface{}, 0, len(services))
-	for _, s := range services {
+	values := make([]map[string]interface{}, 0, len(names))
+	for _, s := range names {
 		values = append(values, map[string]interface{}{"type": "string", "value": s})
 	}
 
@@ -383,9 +929,75 @@ func (e *sqliteExporter) handleSearchTagValuesV2(w http.ResponseWriter, r *http.
 	})
 }
 
+// tagValues lists the values of a tag: service names, or span names
+// (optionally limited to ?service=) from the catalog, and other span or
+// resource attributes and intrinsics from the stored spans (see
+// attributeTagValues). When tr is bounded (Tempo's start/end parameters)
+// only values with spans in that window are listed. ok is false for tags that
+// cannot be listed.
+func (e *sqliteExporter) tagValues(ctx context.Context, tag, service string, tr timeRange) ([]string, bool, error) {
+	switch tag {
+	case "service.name", "resource.service.name", "name", "span.name":
+	case "status":
+		return []string{"error", "ok", "unset"}, true, nil
+	default:
+		return e.attributeTagValues(ctx, tag, service, tr)
+	}
+
+	spanNames := tag == "name" || tag == "span.name"
+
+	if tr.from.IsZero() && tr.until.IsZero() {
+		if spanNames {
+			names, err := e.listSpanNames(ctx, service)
+			return names, true, err
+		}
+		services, err := e.listServices(ctx)
+		return services, true, err
+	}
+
+	ops, err := e.store.ListServiceOperationsBetween(ctx, tr.startNs(), tr.endNs())
+	if err != nil {
+		return nil, true, err
+	}
+	window := &serviceCatalog{operations: ops, loaded: true}
+	if spanNames {
+		names, _ := window.spanNames(service)
+		return names, true, nil
+	}
+	services, _ := window.services()
+	return services, true, nil
+}
+
+// attributeTagValues lists the values of an attribute or intrinsic tag. A
+// tag is scoped as in TraceQL (span.http.method, resource.host.name, kind);
+// a bare attribute key (http.method) matches span then resource attributes.
+// Unindexed attributes are read from the most recent tagValuesScanLimit
+// spans.
+func (e *sqliteExporter) attributeTagValues(ctx context.Context, tag, service string, tr timeRange) ([]string, bool, error) {
+	field, err := parseTraceQLField(tag)
+	if err != nil {
+		field, err = parseTraceQLField("." + tag)
+	}
+	if err != nil || field.Name == "" || strings.ContainsAny(field.Name, `"\`) {
+		return nil, false, nil
+	}
+	if field.Scope == tracestore.ScopeIntrinsic && field.Name == "duration" {
+		return nil, false, nil
+	}
+	values, err := e.store.AttributeValues(ctx, tracestore.AttributeValuesOptions{
+		Field:        field,
+		ServiceName:  service,
+		MinStartTime: tr.startNs(),
+		MaxStartTime: tr.endNs(),
+		ScanLimit:    tagValuesScanLimit,
+		Limit:        tagValuesLimit,
+	})
+	return values, true, err
+}
+
 // handleListServices lists available services
 func (e *sqliteExporter) handleListServices(w http.ResponseWriter, r *http.Request) {
-	services, err := e.store.ListServices(r.Context())
+	services, err := e.listServices(r.Context())
 	if err != nil {
 		e.writeError(w, "Failed to list services", err, http.StatusInternalServerError)
 		return
@@ -398,23 +1010,49 @@ func (e *sqliteExporter) handleListServices(w http.ResponseWriter, r *http.Reque
 // handleRenderMetrics returns metric data (Graphite-compatible)
 func (e *sqliteExporter) handleRenderMetrics(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		// Grafana posts target/from/until as form fields; r.Form also
+		// carries the URL query values.
+		if err := r.ParseForm(); err != nil {
+			e.writeBodyError(w, "invalid form data", err)
+			return
+		}
+		q = r.Form
+	}
 	targets := q["target"]
 	if len(targets) == 0 {
 		if v := strings.TrimSpace(q.Get("target")); v != "" {
 			targets = []string{v}
 		}
 	}
-	if len(targets) == 0 && (r.Method == http.MethodPost || r.Method == http.MethodPut) {
-		if err := r.ParseForm(); err != nil {
-			e.writeError(w, "invalid form data", err, http.StatusBadRequest)
+
+	now := time.Now()
+	tr, err := parseTimeRange(q, now)
+	if err == nil {
+		tr, err = withDefaultLookback(tr, q, e.config.DefaultLookback, now)
+	}
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+	// service restricts every target to points tagged with that service
+	sq := seriesQuery{tr: tr, service: strings.TrimSpace(q.Get("service"))}
+	format := strings.ToLower(strings.TrimSpace(q.Get("format")))
+	if format == "" {
+		format = "json"
+	}
+	if !renderFormats[format] {
+		e.writeError(w, "invalid format", fmt.Errorf("format must be json, raw, csv or pickle, got %q", format), http.StatusBadRequest)
+		return
+	}
+	sq.exemplars = format == "json"
+	if v := strings.TrimSpace(q.Get("maxDataPoints")); v != "" {
+		if sq.maxDataPoints, err = strconv.Atoi(v); err != nil || sq.maxDataPoints <= 0 {
+			e.writeError(w, "invalid maxDataPoints", err, http.StatusBadRequest)
 			return
 		}
-		if vs := r.Form["target"]; len(vs) > 0 {
-			targets = append([]string(nil), vs...)
-		} else if v := strings.TrimSpace(r.FormValue("target")); v != "" {
-			targets = []string{v}
-		}
 	}
+
 	allResults := make([]map[string]interface{}, 0)
 
 	for _, target := range targets {
@@ -423,89 +1061,50 @@ func (e *sqliteExporter) handleRenderMetrics(w http.ResponseWriter, r *http.Requ
 			continue
 		}
 
-		// Support a small subset of Graphite functions used in dashboards.
-		// Handle nested functions by resolving inner functions first.
-		var finalResults []map[string]interface{}
-		var handled bool
-
-		// Try aliasSub first (outer function)
-		if inner, search, replace, ok := parseAliasSub(target); ok {
-			// The inner part might itself be a function call
-			var innerSeries map[string][]interface{}
-			var err error
-
-			// Check if inner is another function call
-			if innerInner, idxs, ok2 := parseAliasByNode(inner); ok2 {
-				innerSeries, err = e.queryMetricSeries(r.Context(), innerInner)
-				if err != nil {
-					e.writeError(w, "Failed to query metrics", err, http.StatusInternalServerError)
-					return
-				}
-				// Apply aliasByNode first, then aliasSub
-				for name, datapoints := range innerSeries {
-					aliasedName := aliasByNode(name, idxs)
-					finalName := aliasSub(aliasedName, search, replace)
-					finalResults = append(finalResults, map[string]interface{}{
-						"target":     finalName,
-						"datapoints": datapoints,
-					})
-				}
-			} else {
-				// Inner is a regular metric pattern
-				innerSeries, err = e.queryMetricSeries(r.Context(), inner)
-				if err != nil {
-					e.writeError(w, "Failed to query metrics", err, http.StatusInternalServerError)
-					return
-				}
-				// Apply aliasSub directly
-				for name, datapoints := range innerSeries {
-					finalResults = append(finalResults, map[string]interface{}{
-						"target":     aliasSub(name, search, replace),
-						"datapoints": datapoints,
-					})
-				}
-			}
-			handled = true
-		}
-
-		// Try aliasByNode if not handled by aliasSub
-		if !handled {
-			if inner, idxs, ok := parseAliasByNode(target); ok {
-				series, err := e.queryMetricSeries(r.Context(), inner)
-				if err != nil {
-					e.writeError(w, "Failed to query metrics", err, http.StatusInternalServerError)
-					return
-				}
-				for name, datapoints := range series {
-					finalResults = append(finalResults, map[string]interface{}{
-						"target":     aliasByNode(name, idxs),
-						"datapoints": datapoints,
-					})
-				}
-				handled = true
-			}
+		// Targets are Graphite expressions: a metric path, or functions
+		// nested around one (see renderFuncs)
+		expr, err := parseRenderTarget(target)
+		if err != nil {
+			e.writeError(w, "invalid target", err, http.StatusBadRequest)
+			return
 		}
-
-		if handled {
-			allResults = append(allResults, finalResults...)
-			continue
+		series, err := e.evalRenderExpr(r.Context(), expr, sq)
+		if errors.Is(err, errInvalidTarget) {
+			e.writeError(w, "invalid target", err, http.StatusBadRequest)
+			return
 		}
-
-		series, err := e.queryMetricSeries(r.Context(), target)
 		if err != nil {
 			e.writeError(w, "Failed to query metrics", err, http.StatusInternalServerError)
 			return
 		}
-		for name, datapoints := range series {
-			allResults = append(allResults, map[string]interface{}{
-				"target":     name,
+		for _, s := range series {
+			datapoints := make([]interface{}, 0, len(s.points))
+			for _, p := range s.points {
+				datapoints = append(datapoints, []interface{}{p.value, p.ts})
+			}
+			result := map[string]interface{}{
+				"target":     s.name,
 				"datapoints": datapoints,
-			})
+			}
+			if len(s.exemplars) > 0 {
+				result["meta"] = map[string]interface{}{"exemplars": s.exemplars}
+			}
+			allResults = append(allResults, result)
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	e.writeJSON(w, allResults)
+	if sq.maxDataPoints > 0 {
+		for _, result := range allResults {
+			result["datapoints"] = consolidateDatapoints(result["datapoints"].([]interface{}), sq.maxDataPoints)
+		}
+	}
+
+	// raw and pickle need a step for series with a single point
+	step := int64(e.seriesResolution(sq, now) / time.Second)
+	if step <= 0 {
+		step = 60
+	}
+	e.writeRenderResults(w, format, allResults, step)
 }
 
 // handleFindMetrics finds metric names (Graphite-compatible)
@@ -517,7 +1116,7 @@ func (e *sqliteExporter) handleFindMetrics(w http.ResponseWriter, r *http.Reques
 	}
 	if query == "" && (r.Method == http.MethodPost || r.Method == http.MethodPut) {
 		if err := r.ParseForm(); err != nil {
-			e.writeError(w, "invalid form data", err, http.StatusBadRequest)
+			e.writeBodyError(w, "invalid form data", err)
 			return
 		}
 		query = strings.TrimSpace(r.FormValue("query"))
@@ -638,12 +1237,39 @@ func (e *sqliteExporter) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var dryRun map[string]DryRunTable
+	if e.dryRun != nil {
+		dryRun = e.dryRun.snapshot()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, struct {
+		tracestore.StorageStats
+		Memory   memlimit.Settings      `json:"memory"`
+		DryRun   map[string]DryRunTable `json:"dry_run,omitempty"`
+		DiskFull *diskFullStatus        `json:"disk_full,omitempty"`
+	}{stats, memlimit.Current(), dryRun, e.diskFull.status()})
+}
+
+// handleSlowIngest returns the most recent slow trace batches
+func (e *sqliteExporter) handleSlowIngest(w http.ResponseWriter, r *http.Request) {
+	batches, total := e.slowIngest.recent()
 	w.Header().Set("Content-Type", "application/json")
-	e.writeJSON(w, stats)
+	e.writeJSON(w, map[string]interface{}{
+		"threshold_ms": float64(e.config.SlowIngest.Threshold.Microseconds()) / 1000,
+		"total":        total,
+		"batches":      batches,
+	})
 }
 
-// handleReady returns ready status
+// handleReady returns ready status, or 503 while ingest is paused on a full
+// disk
 func (e *sqliteExporter) handleReady(w http.ResponseWriter, r *http.Request) {
+	if e.diskFull.status() != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("disk full"))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ready"))
 }
@@ -652,9 +1278,22 @@ func (e *sqliteExporter) handleReady(w http.ResponseWriter, r *http.Request) {
 func (e *sqliteExporter) handleListTraces(w http.ResponseWriter, r *http.Request) {
 	e.logger.Debug("Handling request for traces list")
 
+	q := r.URL.Query()
+	now := time.Now()
+	tr, err := parseTimeRange(q, now)
+	if err == nil {
+		tr, err = withDefaultLookback(tr, q, e.config.DefaultLookback, now)
+	}
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+
 	// Use SearchTraces to get aggregated trace summaries from the database
-	traces, err := e.store.SearchTraces(r.Context(), sqlite.TraceSearchOptions{
-		Limit: clampLimit(0, 1000),
+	traces, err := e.store.SearchTraces(r.Context(), tracestore.TraceSearchOptions{
+		Limit:        clampLimit(0, 1000),
+		MinStartTime: tr.startNs(),
+		MaxStartTime: tr.endNs(),
 	})
 	if err != nil {
 		e.writeError(w, "Failed to query traces", err, http.StatusInternalServerError)
@@ -665,16 +1304,22 @@ func (e *sqliteExporter) handleListTraces(w http.ResponseWriter, r *http.Request
 	traceList := make([]map[string]interface{}, 0, len(traces))
 	for _, t := range traces {
 		traceList = append(traceList, map[string]interface{}{
-			"trace_id":     t.TraceID,
-			"span_name":    t.RootTraceName,
-			"service_name": t.RootServiceName,
-			"duration_ms":  t.DurationMs,
-			"status_code":  t.StatusCode,
-			"span_count":   t.SpanCount,
-			"start_time":   t.StartTimeUnixNano,
+			"trace_id":       t.TraceID,
+			"span_name":      t.RootTraceName,
+			"service_name":   t.RootServiceName,
+			"duration_ms":    float64(t.DurationNanos) / 1e6,
+			"duration_nanos": t.DurationNanos,
+			"status_code":    t.StatusCode,
+			"span_count":     t.SpanCount,
+			"start_time":     t.StartTimeUnixNano,
 		})
 	}
 
+	if wantsCSV(r) {
+		e.writeCSV(w, "traces", traceCSVColumns, traceList)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	e.writeJSON(w, traceList)
 }
@@ -684,28 +1329,74 @@ func (e *sqliteExporter) handleListSpans(w http.ResponseWriter, r *http.Request)
 	e.logger.Debug("Handling request for spans list")
 
 	// Parse query parameters
-	queryOptions := sqlite.SpanQueryOptions{
-		Limit: 1000,
+	limit, err := parseLimit(r.URL.Query(), 1000)
+	if err != nil {
+		e.writeError(w, "invalid limit", err, http.StatusBadRequest)
+		return
+	}
+	offset, err := parseOffset(r.URL.Query())
+	if err != nil {
+		e.writeError(w, "invalid offset", err, http.StatusBadRequest)
+		return
+	}
+	anonymize, err := wantsAnonymized(r)
+	if err != nil {
+		e.writeError(w, "invalid anonymize value", err, http.StatusBadRequest)
+		return
+	}
+	queryOptions := tracestore.SpanQueryOptions{
+		Limit:  limit,
+		Offset: offset,
 	}
 
 	if serviceName := r.URL.Query().Get("service"); serviceName != "" {
 		queryOptions.ServiceName = serviceName
 	}
 
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		if limit, err := strconv.Atoi(limitStr); err == nil {
-			queryOptions.Limit = clampLimit(limit, 1000)
+	// Attribute filters use the same logfmt tags as /api/search
+	if tags := r.URL.Query().Get("tags"); tags != "" {
+		if s := extractServiceFromTags(tags); s != "" && queryOptions.ServiceName == "" {
+			queryOptions.ServiceName = s
+		}
+		queryOptions.Attributes = extractAttributeTags(tags)
+		for key := range queryOptions.Attributes {
+			if strings.ContainsAny(key, `"\`) {
+				e.writeError(w, "invalid tags", fmt.Errorf("invalid attribute key %q", key), http.StatusBadRequest)
+				return
+			}
 		}
 	}
 
+	tr, err := parseTimeRange(r.URL.Query(), time.Now())
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+	queryOptions.MinStartTime = tr.startNs()
+	queryOptions.MaxStartTime = tr.endNs()
+
 	spans, err := e.store.QuerySpans(r.Context(), queryOptions)
 	if err != nil {
 		e.writeError(w, "Failed to query spans", err, http.StatusInternalServerError)
 		return
 	}
+	if anonymize {
+		spans = e.anonymizer.spans(spans)
+	}
 	if spans == nil {
 		spans = []json.RawMessage{}
 	}
+	total, exact, err := e.store.CountSpans(r.Context(), queryOptions, maxTotalCount)
+	if err != nil {
+		e.writeError(w, "Failed to count spans", err, http.StatusInternalServerError)
+		return
+	}
+	setTotalCount(w, total, exact)
+
+	if wantsCSV(r) {
+		e.writeCSV(w, "spans", spanCSVColumns, rawSpansToRows(spans))
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	e.writeJSON(w, spans)
@@ -715,16 +1406,43 @@ func (e *sqliteExporter) handleListSpans(w http.ResponseWriter, r *http.Request)
 func (e *sqliteExporter) handleListExceptions(w http.ResponseWriter, r *http.Request) {
 	e.logger.Debug("Handling request for exceptions list")
 
-	// Query spans with error status
+	tr, err := parseTimeRange(r.URL.Query(), time.Now())
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query(), 1000)
+	if err != nil {
+		e.writeError(w, "invalid limit", err, http.StatusBadRequest)
+		return
+	}
+	offset, err := parseOffset(r.URL.Query())
+	if err != nil {
+		e.writeError(w, "invalid offset", err, http.StatusBadRequest)
+		return
+	}
+
+	// Query spans with error status; limit, offset and the total count all
+	// apply to error spans, each of which yields one or more exceptions.
 	errorCode := 2
-	errorSpans, err := e.store.QuerySpans(r.Context(), sqlite.SpanQueryOptions{
-		StatusCode: &errorCode,
-		Limit:      clampLimit(0, 1000),
-	})
+	queryOptions := tracestore.SpanQueryOptions{
+		StatusCode:   &errorCode,
+		MinStartTime: tr.startNs(),
+		MaxStartTime: tr.endNs(),
+		Limit:        limit,
+		Offset:       offset,
+	}
+	errorSpans, err := e.store.QuerySpans(r.Context(), queryOptions)
 	if err != nil {
 		e.writeError(w, "Failed to query error spans", err, http.StatusInternalServerError)
 		return
 	}
+	total, exact, err := e.store.CountSpans(r.Context(), queryOptions, maxTotalCount)
+	if err != nil {
+		e.writeError(w, "Failed to count error spans", err, http.StatusInternalServerError)
+		return
+	}
+	setTotalCount(w, total, exact)
 
 	// Convert error spans to exception format
 	exceptions := make([]map[string]interface{}, 0)
@@ -811,11 +1529,67 @@ func (e *sqliteExporter) handleListExceptions(w http.ResponseWriter, r *http.Req
 		}
 	}
 
+	if wantsCSV(r) {
+		e.writeCSV(w, "exceptions", exceptionCSVColumns, exceptions)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	e.writeJSON(w, exceptions)
 }
 
-func (e *sqliteExporter) queryMetricSeries(ctx context.Context, target string) (map[string][]interface{}, error) {
+// seriesQuery holds the /render parameters shared by every target
+type seriesQuery struct {
+	tr            timeRange
+	service       string
+	maxDataPoints int
+	// exemplars reads the trace IDs linked to the points as well, for the
+	// json format's meta
+	exemplars bool
+}
+
+// seriesResolution is the bucket size a /render query reads at: the rollup
+// resolution for the range's age, or coarser when maxDataPoints asks for
+// fewer points, so long ranges are averaged in SQLite rather than sent over
+// point by point.
+func (e *sqliteExporter) seriesResolution(sq seriesQuery, now time.Time) time.Duration {
+	resolution := e.metricResolution(sq.tr, now)
+	if sq.maxDataPoints <= 0 || sq.tr.from.IsZero() {
+		return resolution
+	}
+	until := sq.tr.until
+	if until.IsZero() {
+		until = now
+	}
+	step := (until.Sub(sq.tr.from) / time.Duration(sq.maxDataPoints)).Truncate(time.Second)
+	if step > time.Second && step > resolution {
+		return step
+	}
+	return resolution
+}
+
+// consolidateDatapoints averages runs of consecutive [value, timestamp]
+// points so a series has at most maxPoints, as Graphite does for
+// maxDataPoints. Each run is stamped with its first timestamp.
+func consolidateDatapoints(points []interface{}, maxPoints int) []interface{} {
+	if len(points) <= maxPoints {
+		return points
+	}
+	size := (len(points) + maxPoints - 1) / maxPoints
+	out := make([]interface{}, 0, maxPoints)
+	for i := 0; i < len(points); i += size {
+		run := points[i:min(i+size, len(points))]
+		var sum float64
+		for _, p := range run {
+			sum += p.([]interface{})[0].(float64)
+		}
+		out = append(out, []interface{}{sum / float64(len(run)), run[0].([]interface{})[1]})
+	}
+	return out
+}
+
+func (e *sqliteExporter) queryMetricSeries(ctx context.Context, target string, sq seriesQuery) (map[string][]interface{}, error) {
+	tr := sq.tr
 	pattern := target
 	namePattern := strings.Contains(pattern, "*") || strings.Contains(pattern, "?")
 
@@ -831,9 +1605,13 @@ func (e *sqliteExporter) queryMetricSeries(ctx context.Context, target string) (
 		pattern = graphiteToLikePattern(pattern)
 	}
 
-	metrics, err := e.store.QueryMetrics(ctx, sqlite.MetricQueryOptions{
+	metrics, err := e.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{
 		Name:        pattern,
 		NamePattern: namePattern,
+		Service:     sq.service,
+		MinTime:     tr.startSeconds(),
+		MaxTime:     tr.endSeconds(),
+		Resolution:  e.seriesResolution(sq, time.Now()),
 	})
 	if err != nil {
 		return nil, err
@@ -853,10 +1631,12 @@ func (e *sqliteExporter) queryMetricSeries(ctx context.Context, target string) (
 
 func (e *sqliteExporter) findMetricNodes(ctx context.Context, query string) ([]string, error) {
 	pattern := graphiteToLikePattern(query)
-	metrics, err := e.store.QueryMetrics(ctx, sqlite.MetricQueryOptions{
+	metrics, err := e.store.QueryMetrics(ctx, tracestore.MetricQueryOptions{
 		Name:        pattern,
 		NamePattern: true,
 		Limit:       2000,
+		// Include names that only rolled-up points still carry
+		Resolution: e.metricResolution(timeRange{}, time.Now()),
 	})
 	if err != nil {
 		return nil, err
@@ -881,3 +1661,80 @@ func (e *sqliteExporter) findMetricNodes(ctx context.Context, query string) ([]s
 	sort.Strings(out)
 	return out, nil
 }
+
+// parseTraceStateFilter parses comma-separated tracestate entries, each either
+// key=value or a bare key matching any value. Keys follow the W3C Trace
+// Context syntax.
+func parseTraceStateFilter(s string) ([]tracestore.TraceStateEntry, error) {
+	var entries []tracestore.TraceStateEntry
+	for _, member := range strings.Split(s, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(member, "=")
+		if !validTraceStateKey(key) {
+			return nil, fmt.Errorf("invalid tracestate key %q", key)
+		}
+		for _, r := range value {
+			if r < 0x20 || r > 0x7e || r == '=' {
+				return nil, fmt.Errorf("invalid tracestate value %q", value)
+			}
+		}
+		entries = append(entries, tracestore.TraceStateEntry{Key: key, Value: strings.TrimRight(value, " ")})
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("empty tracestate filter")
+	}
+	return entries, nil
+}
+
+// validTraceStateKey reports whether key is a W3C tracestate key: lowercase
+// letters, digits and _-*/ with an optional tenant@system form.
+func validTraceStateKey(key string) bool {
+	if key == "" || len(key) > 256 {
+		return false
+	}
+	for _, part := range strings.SplitN(key, "@", 2) {
+		if part == "" {
+			return false
+		}
+		for _, r := range part {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("_-*/", r)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// traceStatusCodes maps the status search values to OTLP status codes
+var traceStatusCodes = map[string]int{"unset": 0, "ok": 1, "error": 2}
+
+// parseSearchDuration parses a Tempo search duration bound, returning 0 when
+// it is absent
+func parseSearchDuration(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("expected a duration such as 100ms, got %q", v)
+	}
+	return d, nil
+}
+
+// parseTraceStatus reads a status search value (error, ok or unset, any
+// case). Empty and the Grafana "all" values return nil.
+func parseTraceStatus(v string) (*int, error) {
+	v = strings.ToLower(strings.Trim(strings.TrimSpace(v), `"`))
+	if v == "" || v == "*" || v == ".*" {
+		return nil, nil
+	}
+	code, ok := traceStatusCodes[v]
+	if !ok {
+		return nil, fmt.Errorf("status must be error, ok or unset, got %q", v)
+	}
+	return &code, nil
+}
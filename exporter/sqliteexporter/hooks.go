@@ -0,0 +1,226 @@
+package sqliteexporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// IngestHook extends trace ingest in custom builds without changes to the
+// exporter. Hooks are registered with RegisterIngestHook, usually from an
+// init function, and run in every sqlite exporter created afterwards.
+type IngestHook interface {
+	// OnSpanIngest is called for each span kept by include/exclude, before
+	// it is stored. The span must not be modified; attributes and metrics
+	// are added through IngestedSpan instead.
+	OnSpanIngest(ctx context.Context, span *IngestedSpan)
+
+	// OnTraceComplete is called once a stored trace has had no new spans
+	// for hooks.trace_complete_after, with its spans as /api/spans serves
+	// them. Spans arriving later start the wait again, so a trace can be
+	// reported more than once.
+	OnTraceComplete(ctx context.Context, traceID string, spans []json.RawMessage)
+}
+
+// IngestedSpan is the span passed to OnSpanIngest
+type IngestedSpan struct {
+	Span        ptrace.Span
+	Resource    pcommon.Resource
+	Scope       pcommon.InstrumentationScope
+	ServiceName string
+
+	// Attributes are stored with the span. As with enrichment, existing
+	// span attributes are never overwritten.
+	Attributes map[string]string
+
+	// Metrics are stored with the batch's span metrics
+	Metrics []HookMetric
+}
+
+// HookMetric is a metric point added by a hook. It is stored as
+// <prefix>.<service>.<Name>, tagged with the service and Tags.
+type HookMetric struct {
+	Name  string
+	Value float64
+	Tags  map[string]string
+}
+
+type namedIngestHook struct {
+	name string
+	hook IngestHook
+}
+
+var (
+	ingestHooksMu sync.Mutex
+	ingestHooks   []namedIngestHook
+)
+
+// RegisterIngestHook adds a hook to every sqlite exporter created after the
+// call. Hooks run in registration order; name identifies the hook in logs.
+func RegisterIngestHook(name string, hook IngestHook) {
+	ingestHooksMu.Lock()
+	defer ingestHooksMu.Unlock()
+	ingestHooks = append(ingestHooks, namedIngestHook{name: name, hook: hook})
+}
+
+// registeredIngestHooks returns the hooks registered so far
+func registeredIngestHooks() []namedIngestHook {
+	ingestHooksMu.Lock()
+	defer ingestHooksMu.Unlock()
+	return append([]namedIngestHook(nil), ingestHooks...)
+}
+
+// runSpanHooks calls OnSpanIngest on every hook. It returns the span to
+// store: the original, or a copy carrying the attributes the hooks added.
+func (e *sqliteExporter) runSpanHooks(ctx context.Context, span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope, serviceName string) (ptrace.Span, []HookMetric) {
+	in := &IngestedSpan{
+		Span:        span,
+		Resource:    resource,
+		Scope:       scope,
+		ServiceName: serviceName,
+		Attributes:  make(map[string]string),
+	}
+	for _, h := range e.hooks {
+		h.hook.OnSpanIngest(ctx, in)
+	}
+	if len(in.Attributes) == 0 {
+		return span, in.Metrics
+	}
+
+	// The batch may be shared with other exporters, so attributes go on a copy
+	stored := ptrace.NewSpan()
+	span.CopyTo(stored)
+	for k, v := range in.Attributes {
+		if _, exists := stored.Attributes().Get(k); !exists {
+			stored.Attributes().PutStr(k, v)
+		}
+	}
+	return stored, in.Metrics
+}
+
+// hookMetricRecords converts the metrics hooks added for one service
+func (e *sqliteExporter) hookMetricRecords(serviceName, tenant string, metrics []HookMetric, timestamp int64) []tracestore.MetricRecord {
+	records := make([]tracestore.MetricRecord, 0, len(metrics))
+	for _, m := range metrics {
+		tags := map[string]string{"service": serviceName}
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+		if e.config.InstanceLabel != "" {
+			tags["instance"] = e.config.InstanceLabel
+		}
+		e.tagTenant(tags, tenant)
+		tagsJSON, err := json.Marshal(tags)
+		if err != nil {
+			e.logger.Error("Failed to marshal metric tags", zap.Error(err))
+			continue
+		}
+		records = append(records, tracestore.MetricRecord{
+			Name:      fmt.Sprintf("%s.%s.%s", e.metricRoot(), sanitizeMetricName(serviceName), m.Name),
+			Value:     m.Value,
+			Timestamp: timestamp,
+			Tags:      string(tagsJSON),
+		})
+	}
+	return records
+}
+
+// pendingTraces tracks when stored traces last received a span, so
+// OnTraceComplete can be called once they go quiet
+type pendingTraces struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	max      int
+	dropped  int64
+}
+
+func newPendingTraces(max int) *pendingTraces {
+	return &pendingTraces{lastSeen: make(map[string]time.Time), max: max}
+}
+
+// observe records that the traces received spans at now. New traces past
+// max_pending_traces are not tracked, and are counted as dropped.
+func (p *pendingTraces) observe(traceIDs []string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range traceIDs {
+		if _, ok := p.lastSeen[id]; !ok && len(p.lastSeen) >= p.max {
+			p.dropped++
+			continue
+		}
+		p.lastSeen[id] = now
+	}
+}
+
+// complete removes and returns the traces quiet since before cutoff, oldest
+// first, with the number dropped since the last call
+func (p *pendingTraces) complete(cutoff time.Time) ([]string, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ids []string
+	for id, seen := range p.lastSeen {
+		if seen.Before(cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return p.lastSeen[ids[i]].Before(p.lastSeen[ids[j]]) })
+	for _, id := range ids {
+		delete(p.lastSeen, id)
+	}
+	dropped := p.dropped
+	p.dropped = 0
+	return ids, dropped
+}
+
+// runTraceHooks reports completed traces to the hooks
+func (e *sqliteExporter) runTraceHooks() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(traceHooksCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case now := <-ticker.C:
+			e.completeTraces(now)
+		}
+	}
+}
+
+// completeTraces calls OnTraceComplete for every trace quiet for
+// trace_complete_after
+func (e *sqliteExporter) completeTraces(now time.Time) {
+	ids, dropped := e.pendingTraces.complete(now.Add(-e.config.Hooks.TraceCompleteAfter))
+	if dropped > 0 {
+		e.logger.Warn("Too many pending traces, some will not be reported to ingest hooks",
+			zap.Int64("dropped", dropped),
+			zap.Int("max_pending_traces", e.config.Hooks.MaxPendingTraces))
+	}
+	for _, id := range ids {
+		spans, err := e.store.QueryTraceByID(e.cleanupCtx, id)
+		if err != nil {
+			if e.cleanupCtx.Err() == nil {
+				e.logger.Warn("Failed to load completed trace", zap.String("trace_id", id), zap.Error(err))
+			}
+			continue
+		}
+		if len(spans) == 0 {
+			// Deleted by cleanup or the size limit in the meantime
+			continue
+		}
+		for _, h := range e.hooks {
+			h.hook.OnTraceComplete(e.cleanupCtx, id, spans)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// runIncidents evaluates the incident rules every interval
+func (e *sqliteExporter) runIncidents() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.config.Incidents.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case now := <-ticker.C:
+			e.evaluateIncidents(now)
+		}
+	}
+}
+
+// evaluateIncidents checks every service's spans that started in the
+// interval before now and snapshots the traces of those over a threshold.
+func (e *sqliteExporter) evaluateIncidents(now time.Time) {
+	cfg := e.config.Incidents
+	windowEnd := now.UnixNano()
+	windowStart := now.Add(-cfg.Interval).UnixNano()
+
+	stats, err := e.store.ServiceWindowStats(e.cleanupCtx, windowStart, windowEnd)
+	if err != nil {
+		if e.cleanupCtx.Err() == nil {
+			e.logger.Warn("Failed to evaluate incident rules", zap.Error(err))
+		}
+		return
+	}
+
+	for _, st := range stats {
+		reason := incidentReason(cfg.Rules, st)
+		if reason == "" {
+			continue
+		}
+		inc, err := e.store.SnapshotIncident(e.cleanupCtx, cfg.DBPath, tracestore.Incident{
+			ServiceName:   st.ServiceName,
+			Reason:        reason,
+			DetectedAt:    now,
+			WindowStart:   windowStart,
+			WindowEnd:     windowEnd,
+			SpanCount:     st.SpanCount,
+			ErrorCount:    st.ErrorCount,
+			P95DurationNs: st.P95DurationNs,
+		}, cfg.MaxTraces)
+		if err != nil {
+			e.logger.Error("Failed to snapshot incident traces", zap.String("service", st.ServiceName), zap.Error(err))
+			continue
+		}
+		e.logger.Warn("Incident detected, traces copied to incidents database",
+			zap.String("service", inc.ServiceName),
+			zap.String("reason", inc.Reason),
+			zap.Int64("traces", inc.TraceCount),
+			zap.Int64("copied_spans", inc.CopiedSpans),
+			zap.String("db_path", cfg.DBPath))
+	}
+}
+
+// incidentReason describes the threshold a service's window breaches under
+// the first matching rule, or returns "" when it breaches none.
+func incidentReason(rules []IncidentRule, st tracestore.ServiceWindowStats) string {
+	for _, r := range rules {
+		if r.Service != "*" && r.Service != st.ServiceName {
+			continue
+		}
+		if st.SpanCount < r.MinSpans {
+			return ""
+		}
+		if rate := float64(st.ErrorCount) / float64(st.SpanCount); r.ErrorRate > 0 && rate >= r.ErrorRate {
+			return fmt.Sprintf("error rate %.1f%% >= %.1f%%", rate*100, r.ErrorRate*100)
+		}
+		if p95 := time.Duration(st.P95DurationNs); r.P95Latency > 0 && p95 >= r.P95Latency {
+			return fmt.Sprintf("p95 latency %s >= %s", p95, r.P95Latency)
+		}
+		return ""
+	}
+	return ""
+}
+
+// handleIncidents lists the incidents recorded in the incidents database,
+// newest first.
+func (e *sqliteExporter) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	if e.incidents == nil {
+		e.writeError(w, "Incidents disabled", fmt.Errorf("incidents.db_path is not configured"), http.StatusNotFound)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query(), 100)
+	if err != nil {
+		e.writeError(w, "invalid limit", err, http.StatusBadRequest)
+		return
+	}
+
+	incidents, err := e.incidents.ListIncidents(r.Context(), limit)
+	if err != nil {
+		e.writeError(w, "Failed to list incidents", err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, incidents)
+}
@@ -0,0 +1,232 @@
+package sqliteexporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	livePushFormatInflux = "influx"
+	livePushFormatJSON   = "json"
+
+	// livePushMaxGroups bounds the exception groups remembered as seen; past
+	// it the set starts over, so old groups may be announced again
+	livePushMaxGroups = 10000
+)
+
+// livePushEvent is one notification: a newly seen exception group or a
+// slow trace
+type livePushEvent struct {
+	// Type is "exception" or "slow_trace"
+	Type          string  `json:"type"`
+	ServiceName   string  `json:"service_name"`
+	SpanName      string  `json:"span_name"`
+	ExceptionType string  `json:"exception_type,omitempty"`
+	Message       string  `json:"message,omitempty"`
+	DurationMs    float64 `json:"duration_ms,omitempty"`
+	TraceID       string  `json:"trace_id"`
+	SpanID        string  `json:"span_id"`
+	Tenant        string  `json:"tenant,omitempty"`
+	// Timestamp is in nanoseconds since the epoch
+	Timestamp int64 `json:"timestamp"`
+}
+
+// livePusher is the live_push ingest consumer. It runs on the bus's single
+// worker for its queue, so seen needs no lock.
+type livePusher struct {
+	config LivePushConfig
+	client *http.Client
+	// seen holds the exception groups already pushed
+	seen map[string]bool
+}
+
+func newLivePusher(config LivePushConfig) *livePusher {
+	return &livePusher{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		seen:   make(map[string]bool),
+	}
+}
+
+// push sends the batch's new exception groups and slow traces in one
+// request. A failed request is not retried: its exception groups count as
+// seen, and the error is logged by the bus.
+func (p *livePusher) push(ctx context.Context, batch *ingestBatch) error {
+	events := p.events(batch)
+	if len(events) == 0 {
+		return nil
+	}
+
+	body, contentType, err := p.encode(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range p.config.Headers {
+		req.Header.Set(k, string(v))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("live push failed: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("live push to %s returned %s", p.config.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+// events picks the error spans of exception groups not seen before, and the
+// root spans at or over slow_trace_threshold, whose duration stands for the
+// trace's. Both storage formats keep the fields it reads in the header.
+func (p *livePusher) events(batch *ingestBatch) []livePushEvent {
+	var events []livePushEvent
+	for _, stored := range batch.spans {
+		var span struct {
+			TraceID           string `json:"trace_id"`
+			SpanID            string `json:"span_id"`
+			ParentSpanID      string `json:"parent_span_id"`
+			ServiceName       string `json:"service_name"`
+			SpanName          string `json:"span_name"`
+			Tenant            string `json:"tenant"`
+			StartTimeUnixNano int64  `json:"start_time_unix_nano"`
+			EndTimeUnixNano   int64  `json:"end_time_unix_nano"`
+			Status            struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"status"`
+			Events []struct {
+				Name       string                 `json:"name"`
+				Timestamp  int64                  `json:"timestamp"`
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"events"`
+		}
+		if err := json.Unmarshal(stored.Header, &span); err != nil {
+			continue
+		}
+		base := livePushEvent{
+			ServiceName: span.ServiceName,
+			SpanName:    span.SpanName,
+			TraceID:     span.TraceID,
+			SpanID:      span.SpanID,
+			Tenant:      span.Tenant,
+			Timestamp:   span.StartTimeUnixNano,
+		}
+
+		if span.Status.Code == 2 {
+			found := false
+			for _, ev := range span.Events {
+				if !strings.Contains(strings.ToLower(ev.Name), "exception") {
+					continue
+				}
+				found = true
+				excType, _ := ev.Attributes["exception.type"].(string)
+				message, _ := ev.Attributes["exception.message"].(string)
+				if event, ok := p.newException(base, excType, message, ev.Timestamp); ok {
+					events = append(events, event)
+				}
+			}
+			if !found {
+				if event, ok := p.newException(base, "", span.Status.Message, 0); ok {
+					events = append(events, event)
+				}
+			}
+		}
+
+		root := span.ParentSpanID == "" || span.ParentSpanID == "0000000000000000"
+		duration := span.EndTimeUnixNano - span.StartTimeUnixNano
+		if threshold := p.config.SlowTraceThreshold; root && threshold > 0 && duration >= threshold.Nanoseconds() {
+			event := base
+			event.Type = "slow_trace"
+			event.DurationMs = float64(duration) / 1e6
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// newException returns the event for an exception unless its group (tenant,
+// service, span name and exception type) was pushed before
+func (p *livePusher) newException(base livePushEvent, excType, message string, timestamp int64) (livePushEvent, bool) {
+	group := strings.Join([]string{base.Tenant, base.ServiceName, base.SpanName, excType}, "\x00")
+	if p.seen[group] {
+		return livePushEvent{}, false
+	}
+	if len(p.seen) >= livePushMaxGroups {
+		p.seen = make(map[string]bool)
+	}
+	p.seen[group] = true
+
+	event := base
+	event.Type = "exception"
+	event.ExceptionType = excType
+	event.Message = message
+	if timestamp > 0 {
+		event.Timestamp = timestamp
+	}
+	return event, true
+}
+
+// encode renders events as InfluxDB line protocol, which Grafana Live's push
+// endpoint accepts (one measurement per event type), or as a JSON array
+func (p *livePusher) encode(events []livePushEvent) ([]byte, string, error) {
+	if p.config.Format == livePushFormatJSON {
+		body, err := json.Marshal(events)
+		return body, "application/json", err
+	}
+
+	var buf bytes.Buffer
+	for _, ev := range events {
+		buf.WriteString(ev.Type)
+		writeInfluxTag(&buf, "service", ev.ServiceName)
+		writeInfluxTag(&buf, "span", ev.SpanName)
+		writeInfluxTag(&buf, "exception_type", ev.ExceptionType)
+		writeInfluxTag(&buf, "tenant", ev.Tenant)
+		buf.WriteString(" trace_id=")
+		buf.WriteString(influxString(ev.TraceID))
+		buf.WriteString(",span_id=")
+		buf.WriteString(influxString(ev.SpanID))
+		if ev.Type == "slow_trace" {
+			buf.WriteString(",duration_ms=")
+			buf.WriteString(strconv.FormatFloat(ev.DurationMs, 'f', -1, 64))
+		} else {
+			buf.WriteString(",message=")
+			buf.WriteString(influxString(ev.Message))
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(ev.Timestamp, 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), "text/plain; charset=utf-8", nil
+}
+
+// influxTagEscaper escapes line protocol tag keys and values
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// writeInfluxTag appends ,key=value, leaving out empty values, which line
+// protocol does not allow
+func writeInfluxTag(buf *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+	buf.WriteByte(',')
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	buf.WriteString(influxTagEscaper.Replace(value))
+}
+
+// influxString quotes a line protocol string field value
+func influxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,418 @@
+package sqliteexporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.uber.org/zap"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// defaultLokiLimit matches Loki's default number of returned lines
+const defaultLokiLimit = 100
+
+// pushLogs stores OTLP log records in the logs table
+func (e *sqliteExporter) pushLogs(ctx context.Context, ld plog.Logs) error {
+	if e.replication != nil && e.replication.isStandby() {
+		return consumererror.NewPermanent(errStandbyReadOnly)
+	}
+	if err := e.admit(); err != nil {
+		e.ingest.batchesRejected.Add(1)
+		return err
+	}
+
+	var logs [][]byte
+	resourceLogs := ld.ResourceLogs()
+	for i := 0; i < resourceLogs.Len(); i++ {
+		rl := resourceLogs.At(i)
+		scopeLogs := rl.ScopeLogs()
+		for j := 0; j < scopeLogs.Len(); j++ {
+			sl := scopeLogs.At(j)
+			records := sl.LogRecords()
+			for k := 0; k < records.Len(); k++ {
+				data, err := json.Marshal(logDocument(records.At(k), rl.Resource(), sl.Scope()))
+				if err != nil {
+					e.logger.Warn("Failed to marshal log record", zap.Error(err))
+					continue
+				}
+				logs = append(logs, data)
+			}
+		}
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+	if e.dryRun != nil {
+		e.dryRun.addLogs(logs)
+		return nil
+	}
+
+	start := time.Now()
+	if err := e.store.InsertLogs(ctx, logs); err != nil {
+		e.ingest.writeErrors.Add(1)
+		return e.writeFailed(fmt.Errorf("failed to insert logs: %w", err))
+	}
+	e.writeSucceeded()
+	e.ingest.logsStored.Add(int64(len(logs)))
+	if avg, degraded := e.throttle.observe(time.Since(start)); degraded {
+		e.logger.Warn("SQLite write latency over threshold, refusing batches",
+			zap.Duration("avg_latency", avg),
+			zap.Duration("threshold", e.config.Backpressure.LatencyThreshold),
+			zap.Duration("cooldown", e.config.Backpressure.Cooldown))
+	}
+
+	e.logger.Debug("Stored logs", zap.Int("records", len(logs)))
+	return nil
+}
+
+// logDocument builds the stored JSON document for a log record
+func logDocument(lr plog.LogRecord, resource pcommon.Resource, scope pcommon.InstrumentationScope) map[string]interface{} {
+	// Records without a timestamp are placed at the time they were observed
+	ts := lr.Timestamp()
+	if ts == 0 {
+		ts = lr.ObservedTimestamp()
+	}
+
+	severityText := lr.SeverityText()
+	if severityText == "" && lr.SeverityNumber() != plog.SeverityNumberUnspecified {
+		severityText = strings.ToUpper(severityLevel(int(lr.SeverityNumber()), ""))
+	}
+
+	data := map[string]interface{}{
+		"timestamp_unix_nano":          ts.AsTime().UnixNano(),
+		"observed_timestamp_unix_nano": lr.ObservedTimestamp().AsTime().UnixNano(),
+		"severity_number":              int(lr.SeverityNumber()),
+		"severity_text":                severityText,
+		"service_name":                 spanServiceName(resource),
+		"body":                         lr.Body().AsRaw(),
+	}
+	if !lr.TraceID().IsEmpty() {
+		data["trace_id"] = lr.TraceID().String()
+	}
+	if !lr.SpanID().IsEmpty() {
+		data["span_id"] = lr.SpanID().String()
+	}
+	if lr.Flags() != 0 {
+		data["flags"] = uint32(lr.Flags())
+	}
+	if lr.Attributes().Len() > 0 {
+		data["attributes"] = lr.Attributes().AsRaw()
+	}
+	if resource.Attributes().Len() > 0 {
+		data["resource"] = resource.Attributes().AsRaw()
+	}
+	if scope.Name() != "" {
+		scopeData := map[string]interface{}{
+			"name": scope.Name(),
+		}
+		if scope.Version() != "" {
+			scopeData["version"] = scope.Version()
+		}
+		data["scope"] = scopeData
+	}
+	return data
+}
+
+// severityLevels are the Loki level names for each block of four OTLP
+// severity numbers, starting at 1 (TRACE).
+var severityLevels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+// severityLevel returns the Loki level for a record: from its severity number
+// when set, otherwise from its severity text.
+func severityLevel(number int, text string) string {
+	if number >= 1 && number <= 24 {
+		return severityLevels[(number-1)/4]
+	}
+	lower := strings.ToLower(text)
+	for _, level := range severityLevels {
+		if strings.HasPrefix(lower, level) {
+			return level
+		}
+	}
+	switch {
+	case strings.HasPrefix(lower, "err"):
+		return "error"
+	case strings.HasPrefix(lower, "crit"), strings.HasPrefix(lower, "panic"):
+		return "fatal"
+	}
+	return "unknown"
+}
+
+// severityRange returns the OTLP severity numbers of a Loki level
+func severityRange(level string) (int, int, bool) {
+	for i, l := range severityLevels {
+		if l == level {
+			return i*4 + 1, i*4 + 4, true
+		}
+	}
+	return 0, 0, false
+}
+
+var traceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// parseLogQL translates the subset of LogQL gotel supports into store
+// filters: a stream selector with "=" matchers on service_name (or service,
+// job), level (or detected_level, severity_text), trace_id and span_id,
+// followed by any number of |= line filters. A line filter on a 32-digit hex
+// value matches the record's trace ID, which is how Grafana looks up the
+// logs of a trace.
+func parseLogQL(query string) (tracestore.LogQueryOptions, error) {
+	var opts tracestore.LogQueryOptions
+
+	rest := strings.TrimSpace(query)
+	if !strings.HasPrefix(rest, "{") {
+		return opts, fmt.Errorf("query must start with a stream selector")
+	}
+	rest = rest[1:]
+
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if strings.HasPrefix(rest, "}") {
+			rest = rest[1:]
+			break
+		}
+		if rest == "" {
+			return opts, fmt.Errorf("unterminated stream selector")
+		}
+
+		end := strings.IndexAny(rest, "=!~")
+		if end <= 0 {
+			return opts, fmt.Errorf("invalid matcher in stream selector")
+		}
+		label := strings.TrimSpace(rest[:end])
+		rest = rest[end:]
+		if !strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, "=~") {
+			return opts, fmt.Errorf("label %q: only = matchers are supported", label)
+		}
+		value, remaining, err := unquoteLogQL(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return opts, fmt.Errorf("label %q: %w", label, err)
+		}
+		rest = remaining
+
+		switch label {
+		case "service_name", "service", "job":
+			opts.ServiceName = value
+		case "level", "detected_level":
+			minSev, maxSev, ok := severityRange(strings.ToLower(value))
+			if !ok {
+				opts.SeverityText = value
+				break
+			}
+			opts.MinSeverity, opts.MaxSeverity = minSev, maxSev
+		case "severity_text":
+			opts.SeverityText = value
+		case "trace_id":
+			opts.TraceID = value
+		case "span_id":
+			opts.SpanID = value
+		default:
+			return opts, fmt.Errorf("unsupported label %q", label)
+		}
+	}
+
+	for {
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			break
+		}
+		if !strings.HasPrefix(rest, "|=") {
+			return opts, fmt.Errorf("only |= line filters are supported")
+		}
+		value, remaining, err := unquoteLogQL(strings.TrimSpace(rest[2:]))
+		if err != nil {
+			return opts, fmt.Errorf("line filter: %w", err)
+		}
+		rest = remaining
+
+		if traceIDPattern.MatchString(value) && opts.TraceID == "" {
+			opts.TraceID = value
+		} else if value != "" {
+			opts.Contains = append(opts.Contains, value)
+		}
+	}
+
+	return opts, nil
+}
+
+// unquoteLogQL reads a double-quoted or backtick string from the start of s
+// and returns it with the remaining input.
+func unquoteLogQL(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '`') {
+		return "", "", fmt.Errorf("expected quoted string")
+	}
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		if quote == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			value, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", err
+			}
+			return value, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// lokiStream is one entry of a Loki "streams" result
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// logLine renders a stored record as a Loki log line: the body, followed by
+// trace_id= and span_id= fields so Grafana derived fields can link to traces.
+func logLine(doc map[string]interface{}) string {
+	var line string
+	switch body := doc["body"].(type) {
+	case string:
+		line = body
+	case nil:
+	default:
+		b, _ := json.Marshal(body)
+		line = string(b)
+	}
+	for _, key := range []string{"trace_id", "span_id"} {
+		if id, ok := doc[key].(string); ok && id != "" {
+			line += " " + key + "=" + id
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+// handleLokiQueryRange implements Loki's /loki/api/v1/query_range for log
+// queries, grouping records into streams by service_name and level.
+func (e *sqliteExporter) handleLokiQueryRange(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	opts, err := parseLogQL(q.Get("query"))
+	if err != nil {
+		e.writeError(w, "invalid query", err, http.StatusBadRequest)
+		return
+	}
+	if opts.Limit, err = parseLimit(q, defaultLokiLimit); err != nil {
+		e.writeError(w, "invalid limit", err, http.StatusBadRequest)
+		return
+	}
+	tr, err := parseTimeRange(q, time.Now())
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+	opts.MinTimestamp = tr.startNs()
+	opts.MaxTimestamp = tr.endNs()
+	switch q.Get("direction") {
+	case "", "backward":
+	case "forward":
+		opts.Ascending = true
+	default:
+		e.writeError(w, "invalid direction", fmt.Errorf("direction must be forward or backward, got %q", q.Get("direction")), http.StatusBadRequest)
+		return
+	}
+
+	records, err := e.store.QueryLogs(r.Context(), opts)
+	if err != nil {
+		e.writeError(w, "Failed to query logs", err, http.StatusInternalServerError)
+		return
+	}
+
+	streams := []*lokiStream{}
+	byKey := make(map[string]*lokiStream)
+	for _, rec := range records {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(rec.Data, &doc); err != nil {
+			continue
+		}
+		service, _ := doc["service_name"].(string)
+		severityNumber, _ := doc["severity_number"].(float64)
+		severityText, _ := doc["severity_text"].(string)
+		level := severityLevel(int(severityNumber), severityText)
+
+		key := service + "\x00" + level
+		stream, ok := byKey[key]
+		if !ok {
+			stream = &lokiStream{Stream: map[string]string{"service_name": service, "level": level}}
+			byKey[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(rec.Timestamp, 10), logLine(doc)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": "streams",
+			"result":     streams,
+			"stats":      map[string]interface{}{},
+		},
+	})
+}
+
+// handleLokiLabels lists the stream labels of stored logs
+func (e *sqliteExporter) handleLokiLabels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, map[string]interface{}{
+		"status": "success",
+		"data":   []string{"level", "service_name"},
+	})
+}
+
+// handleLokiLabelValues lists the values of a stream label,
+// /loki/api/v1/label/{name}/values
+func (e *sqliteExporter) handleLokiLabelValues(w http.ResponseWriter, r *http.Request) {
+	label := strings.TrimPrefix(r.URL.Path, "/loki/api/v1/label/")
+	label = strings.TrimSuffix(label, "/values")
+
+	var values []string
+	switch label {
+	case "service_name":
+		services, err := e.store.ListLogLabelValues(r.Context(), "service_name")
+		if err != nil {
+			e.writeError(w, "Failed to list label values", err, http.StatusInternalServerError)
+			return
+		}
+		values = services
+	case "level":
+		texts, err := e.store.ListLogLabelValues(r.Context(), "severity_text")
+		if err != nil {
+			e.writeError(w, "Failed to list label values", err, http.StatusInternalServerError)
+			return
+		}
+		seen := make(map[string]bool)
+		for _, t := range texts {
+			if level := severityLevel(0, t); !seen[level] {
+				seen[level] = true
+				values = append(values, level)
+			}
+		}
+		sort.Strings(values)
+	default:
+		e.writeError(w, "unsupported label", nil, http.StatusNotFound)
+		return
+	}
+	if values == nil {
+		values = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, map[string]interface{}{
+		"status": "success",
+		"data":   values,
+	})
+}
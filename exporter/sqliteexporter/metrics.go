@@ -0,0 +1,249 @@
+package sqliteexporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// pushMetrics stores OTLP gauges, sums and histograms in the metrics table,
+// next to the span-derived metrics, so they can be queried through /render.
+//
+// Each data point becomes one row named
+//
+//	<prefix>.<namespace>.<instance>.<service>.<metric name>[.<key>-<value>...]
+//
+// with one segment per data point attribute, sorted by key, so points with
+// different attributes stay separate series. Histograms are stored as .count,
+// .sum, .min and .max rows plus cumulative .bucket.le_<bound> rows for
+// explicit buckets. Summaries are not supported and are dropped.
+func (e *sqliteExporter) pushMetrics(ctx context.Context, md pmetric.Metrics) error {
+	if e.replication != nil && e.replication.isStandby() {
+		return consumererror.NewPermanent(errStandbyReadOnly)
+	}
+	if err := e.admit(); err != nil {
+		e.ingest.batchesRejected.Add(1)
+		return err
+	}
+
+	now := time.Now().Unix()
+	var records []tracestore.MetricRecord
+	dropped := 0
+	headerTenant := e.metadataTenant(ctx)
+
+	resourceMetrics := md.ResourceMetrics()
+	for i := 0; i < resourceMetrics.Len(); i++ {
+		rm := resourceMetrics.At(i)
+		serviceName := spanServiceName(rm.Resource())
+		root := e.metricRoot() + "." + sanitizeMetricName(serviceName)
+		tenant, err := e.resourceTenant(headerTenant, rm.Resource())
+		if err != nil {
+			return consumererror.NewPermanent(err)
+		}
+
+		scopeMetrics := rm.ScopeMetrics()
+		for j := 0; j < scopeMetrics.Len(); j++ {
+			metrics := scopeMetrics.At(j).Metrics()
+			for k := 0; k < metrics.Len(); k++ {
+				m := metrics.At(k)
+				w := otlpMetricWriter{
+					exporter: e,
+					base:     root + "." + otlpMetricPath(m.Name()),
+					service:  serviceName,
+					tenant:   tenant,
+					metric:   m.Name(),
+					now:      now,
+				}
+				switch m.Type() {
+				case pmetric.MetricTypeGauge:
+					w.numberPoints(m.Gauge().DataPoints(), &records)
+				case pmetric.MetricTypeSum:
+					w.numberPoints(m.Sum().DataPoints(), &records)
+				case pmetric.MetricTypeHistogram:
+					w.histogramPoints(m.Histogram().DataPoints(), &records)
+				case pmetric.MetricTypeExponentialHistogram:
+					w.exponentialHistogramPoints(m.ExponentialHistogram().DataPoints(), &records)
+				default:
+					dropped++
+				}
+			}
+		}
+	}
+
+	if dropped > 0 {
+		e.logger.Debug("Dropped unsupported OTLP metrics", zap.Int("metrics", dropped))
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if e.dryRun != nil {
+		e.dryRun.addMetrics(records)
+		return nil
+	}
+
+	start := time.Now()
+	if err := e.store.InsertData(ctx, nil, records); err != nil {
+		e.ingest.writeErrors.Add(1)
+		return e.writeFailed(fmt.Errorf("failed to insert metrics: %w", err))
+	}
+	e.writeSucceeded()
+	e.ingest.pointsStored.Add(int64(len(records)))
+	if avg, degraded := e.throttle.observe(time.Since(start)); degraded {
+		e.logger.Warn("SQLite write latency over threshold, refusing batches",
+			zap.Duration("avg_latency", avg),
+			zap.Duration("threshold", e.config.Backpressure.LatencyThreshold),
+			zap.Duration("cooldown", e.config.Backpressure.Cooldown))
+	}
+
+	e.logger.Debug("Stored OTLP metrics", zap.Int("rows", len(records)))
+	return nil
+}
+
+// otlpMetricPath keeps the dots of an OTLP metric name as Graphite segments
+// and sanitizes each segment.
+func otlpMetricPath(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = sanitizeMetricName(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// otlpMetricWriter turns the data points of one OTLP metric into rows
+type otlpMetricWriter struct {
+	exporter *sqliteExporter
+	base     string
+	service  string
+	tenant   string
+	metric   string
+	now      int64
+}
+
+// point returns the series name and tags for a data point's attributes
+func (w otlpMetricWriter) point(attrs pcommon.Map) (string, string) {
+	tags := map[string]string{"service": w.service, "metric": w.metric}
+	if w.exporter.config.InstanceLabel != "" {
+		tags["instance"] = w.exporter.config.InstanceLabel
+	}
+
+	keys := make([]string, 0, attrs.Len())
+	attrs.Range(func(k string, v pcommon.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sort.Strings(keys)
+
+	name := w.base
+	for _, k := range keys {
+		v, _ := attrs.Get(k)
+		value := v.AsString()
+		tags[k] = value
+		name += "." + sanitizeMetricName(k) + "-" + sanitizeMetricName(value)
+	}
+	w.exporter.tagTenant(tags, w.tenant)
+
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		tagsJSON = []byte("{}")
+	}
+	return name, string(tagsJSON)
+}
+
+func (w otlpMetricWriter) timestamp(ts pcommon.Timestamp) int64 {
+	if ts == 0 {
+		return w.now
+	}
+	return ts.AsTime().Unix()
+}
+
+func (w otlpMetricWriter) numberPoints(points pmetric.NumberDataPointSlice, out *[]tracestore.MetricRecord) {
+	for i := 0; i < points.Len(); i++ {
+		dp := points.At(i)
+		if dp.Flags().NoRecordedValue() {
+			continue
+		}
+		value := dp.DoubleValue()
+		if dp.ValueType() == pmetric.NumberDataPointValueTypeInt {
+			value = float64(dp.IntValue())
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		name, tags := w.point(dp.Attributes())
+		*out = append(*out, tracestore.MetricRecord{Name: name, Value: value, Timestamp: w.timestamp(dp.Timestamp()), Tags: tags})
+	}
+}
+
+func (w otlpMetricWriter) histogramPoints(points pmetric.HistogramDataPointSlice, out *[]tracestore.MetricRecord) {
+	for i := 0; i < points.Len(); i++ {
+		dp := points.At(i)
+		if dp.Flags().NoRecordedValue() {
+			continue
+		}
+		name, tags := w.point(dp.Attributes())
+		ts := w.timestamp(dp.Timestamp())
+		add := func(suffix string, value float64) {
+			*out = append(*out, tracestore.MetricRecord{Name: name + "." + suffix, Value: value, Timestamp: ts, Tags: tags})
+		}
+
+		add("count", float64(dp.Count()))
+		if dp.HasSum() {
+			add("sum", dp.Sum())
+		}
+		if dp.HasMin() {
+			add("min", dp.Min())
+		}
+		if dp.HasMax() {
+			add("max", dp.Max())
+		}
+
+		bounds := dp.ExplicitBounds()
+		counts := dp.BucketCounts()
+		var cumulative uint64
+		for b := 0; b < counts.Len(); b++ {
+			cumulative += counts.At(b)
+			bound := "inf"
+			if b < bounds.Len() {
+				bound = sanitizeMetricName(strconv.FormatFloat(bounds.At(b), 'f', -1, 64))
+			}
+			add("bucket.le_"+bound, float64(cumulative))
+		}
+	}
+}
+
+func (w otlpMetricWriter) exponentialHistogramPoints(points pmetric.ExponentialHistogramDataPointSlice, out *[]tracestore.MetricRecord) {
+	for i := 0; i < points.Len(); i++ {
+		dp := points.At(i)
+		if dp.Flags().NoRecordedValue() {
+			continue
+		}
+		name, tags := w.point(dp.Attributes())
+		ts := w.timestamp(dp.Timestamp())
+		add := func(suffix string, value float64) {
+			*out = append(*out, tracestore.MetricRecord{Name: name + "." + suffix, Value: value, Timestamp: ts, Tags: tags})
+		}
+
+		add("count", float64(dp.Count()))
+		if dp.HasSum() {
+			add("sum", dp.Sum())
+		}
+		if dp.HasMin() {
+			add("min", dp.Min())
+		}
+		if dp.HasMax() {
+			add("max", dp.Max())
+		}
+	}
+}
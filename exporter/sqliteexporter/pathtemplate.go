@@ -0,0 +1,106 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+// pathTemplateMetric is the placeholder a path_template must end with
+const pathTemplateMetric = ".{metric}"
+
+// pathPart is literal text, or a placeholder when key is set
+type pathPart struct {
+	literal string
+	key     string
+}
+
+// metricPathTemplate is a compiled path_template: the path in front of each
+// span metric's name
+type metricPathTemplate []pathPart
+
+// compileMetricPathTemplate parses a path_template, returning nil for an
+// empty one
+func compileMetricPathTemplate(tmpl string) (metricPathTemplate, error) {
+	if tmpl == "" {
+		return nil, nil
+	}
+	body, ok := strings.CutSuffix(tmpl, pathTemplateMetric)
+	if !ok {
+		return nil, fmt.Errorf("must end with %s", pathTemplateMetric)
+	}
+
+	var parts metricPathTemplate
+	keys := make(map[string]bool)
+	for rest := body; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			if strings.ContainsRune(rest, '}') {
+				return nil, fmt.Errorf("unmatched } in %q", tmpl)
+			}
+			parts = append(parts, pathPart{literal: rest})
+			break
+		}
+		if open > 0 {
+			if strings.ContainsRune(rest[:open], '}') {
+				return nil, fmt.Errorf("unmatched } in %q", tmpl)
+			}
+			parts = append(parts, pathPart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { in %q", tmpl)
+		}
+		key := rest[open+1 : open+end]
+		switch {
+		case key == "" || strings.ContainsRune(key, '{'):
+			return nil, fmt.Errorf("invalid placeholder {%s}", key)
+		case key == "metric":
+			return nil, fmt.Errorf("{metric} must only appear at the end")
+		}
+		keys[key] = true
+		parts = append(parts, pathPart{key: key})
+		rest = rest[open+end+1:]
+	}
+	// Without them, different services or operations would share series
+	if !keys["service"] || !keys["span"] {
+		return nil, fmt.Errorf("must contain {service} and {span}")
+	}
+	return parts, nil
+}
+
+// render builds the path for a service's operation. root replaces {prefix};
+// resource attributes are sanitized like service and span names, and missing
+// ones render as "unknown".
+func (t metricPathTemplate) render(root, service, span string, resource pcommon.Resource) string {
+	var b strings.Builder
+	for _, p := range t {
+		switch p.key {
+		case "":
+			b.WriteString(p.literal)
+		case "prefix":
+			b.WriteString(root)
+		case "service":
+			b.WriteString(service)
+		case "span":
+			b.WriteString(span)
+		default:
+			value := "unknown"
+			if v, ok := resource.Attributes().Get(p.key); ok && v.AsString() != "" {
+				value = sanitizeMetricName(v.AsString())
+			}
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// spanMetricPrefix is the path in front of a span metric's name: buildPrefix,
+// or path_template when one is configured. service and span are sanitized.
+func (e *sqliteExporter) spanMetricPrefix(service, span string, resource pcommon.Resource) string {
+	if e.pathTemplate == nil {
+		return e.buildPrefix(service, span)
+	}
+	return e.pathTemplate.render(e.metricRoot(), service, span, resource)
+}
@@ -0,0 +1,63 @@
+package sqliteexporter
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const (
+	queryAuthBearer = "bearer"
+	queryAuthBasic  = "basic"
+)
+
+// queryAuthExempt lists paths served without credentials, so load balancer
+// and Kubernetes probes keep working
+var queryAuthExempt = map[string]bool{
+	"/ready": true,
+}
+
+// authMiddleware rejects query API requests without the credentials
+// query_auth requires. It runs inside corsMiddleware, so CORS preflights
+// (which never carry credentials) are answered before it.
+func (e *sqliteExporter) authMiddleware(next http.Handler) http.Handler {
+	auth := e.config.QueryAuth
+	if auth.Type == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if queryAuthExempt[r.URL.Path] || e.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if auth.Type == queryAuthBasic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gotel", charset="UTF-8"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gotel"`)
+		}
+		e.writeError(w, "unauthorized", nil, http.StatusUnauthorized)
+	})
+}
+
+// authorized checks the request's credentials in constant time
+func (e *sqliteExporter) authorized(r *http.Request) bool {
+	auth := e.config.QueryAuth
+	switch auth.Type {
+	case queryAuthBearer:
+		header := r.Header.Get("Authorization")
+		if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+			return false
+		}
+		token := strings.TrimSpace(header[len("Bearer "):])
+		return subtle.ConstantTimeCompare([]byte(token), []byte(auth.Token)) == 1
+	case queryAuthBasic:
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return false
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) == 1
+		return userOK && passOK
+	}
+	return false
+}
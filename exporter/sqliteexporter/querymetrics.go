@@ -0,0 +1,89 @@
+package sqliteexporter
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// queryServerMetrics instruments the query API. It uses its own registry so
+// /internal/metrics only exposes gotel's own telemetry (query-server metrics
+// and, in dry_run mode, the would-be storage volume), separate from the
+// derived span metrics and the collector's own telemetry.
+type queryServerMetrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newQueryServerMetrics() *queryServerMetrics {
+	m := &queryServerMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gotel_query_requests_total",
+			Help: "Query API requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gotel_query_request_duration_seconds",
+			Help:    "Query API request latency by route, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+	}
+	m.registry.MustRegister(m.requests, m.duration)
+	return m
+}
+
+// observe records one request. route is the ServeMux pattern that matched,
+// never the raw path, to keep label cardinality bounded; the "/" catch-all
+// counts as unmatched.
+func (m *queryServerMetrics) observe(route, method string, code int, elapsed time.Duration) {
+	if route == "" || route == "/" {
+		route = "unmatched"
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+	default:
+		method = "other"
+	}
+	labels := prometheus.Labels{"route": route, "method": method, "code": strconv.Itoa(code)}
+	m.requests.With(labels).Inc()
+	m.duration.With(labels).Observe(elapsed.Seconds())
+}
+
+func (m *queryServerMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// routeKey is the context key of the *string recordRoute writes the matched
+// route to
+type routeKey struct{}
+
+// metricsMiddleware records request count and latency for every handler.
+// The route comes from recordRoute, which wraps the ServeMux: middleware in
+// between may pass on a new request (tenantMiddleware does, to scope its
+// context), so the r.Pattern ServeMux sets is not on this request.
+func (e *sqliteExporter) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		var route string
+
+		next.ServeHTTP(wrapped, r.WithContext(context.WithValue(r.Context(), routeKey{}, &route)))
+
+		e.queryMetrics.observe(route, r.Method, wrapped.statusCode, time.Since(start))
+	})
+}
+
+// recordRoute passes the pattern mux matched back to metricsMiddleware
+func recordRoute(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+			*route = r.Pattern
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// redSummaryWindow is the range /api/metrics/summary covers when neither the
+// request nor default_lookback bounds its start
+const redSummaryWindow = time.Hour
+
+// redSpanKinds maps the kind parameter to span kinds as stored
+var redSpanKinds = map[string]string{
+	"server":   ptrace.SpanKindServer.String(),
+	"client":   ptrace.SpanKindClient.String(),
+	"producer": ptrace.SpanKindProducer.String(),
+	"consumer": ptrace.SpanKindConsumer.String(),
+	"internal": ptrace.SpanKindInternal.String(),
+}
+
+// handleMetricsSummary returns RED metrics (request rate, error rate and
+// latency percentiles) computed from the spans in a time range: overall, and
+// per service or, for one service, per operation.
+func (e *sqliteExporter) handleMetricsSummary(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now()
+	tr, err := parseTimeRange(q, now)
+	if err == nil {
+		tr, err = withDefaultLookback(tr, q, e.config.DefaultLookback, now)
+	}
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+	if tr.until.IsZero() {
+		tr.until = now
+	}
+	if tr.from.IsZero() {
+		tr.from = tr.until.Add(-redSummaryWindow)
+	}
+
+	opts := tracestore.REDQueryOptions{
+		ServiceName:  strings.TrimSpace(q.Get("service")),
+		MinStartTime: tr.startNs(),
+		MaxStartTime: tr.endNs(),
+	}
+	if v := strings.ToLower(strings.TrimSpace(q.Get("kind"))); v != "" {
+		kind, ok := redSpanKinds[v]
+		if !ok {
+			e.writeError(w, "invalid kind", fmt.Errorf("kind must be server, client, producer, consumer or internal, got %q", v), http.StatusBadRequest)
+			return
+		}
+		opts.Kind = kind
+	}
+	groupBy := strings.TrimSpace(q.Get("group_by"))
+	switch {
+	case groupBy == "" && opts.ServiceName != "":
+		groupBy = tracestore.REDGroupOperation
+	case groupBy == "":
+		groupBy = tracestore.REDGroupService
+	case groupBy != tracestore.REDGroupService && groupBy != tracestore.REDGroupOperation:
+		e.writeError(w, "invalid group_by", fmt.Errorf("group_by must be service or operation, got %q", groupBy), http.StatusBadRequest)
+		return
+	}
+
+	total, err := e.store.REDSummaries(r.Context(), opts)
+	if err != nil {
+		e.writeError(w, "Failed to query RED metrics", err, http.StatusInternalServerError)
+		return
+	}
+	opts.GroupBy = groupBy
+	groups, err := e.store.REDSummaries(r.Context(), opts)
+	if err != nil {
+		e.writeError(w, "Failed to query RED metrics", err, http.StatusInternalServerError)
+		return
+	}
+
+	window := tr.until.Sub(tr.from)
+	var overall tracestore.REDSummary
+	if len(total) > 0 {
+		overall = total[0]
+	}
+	result := redFields(overall, window)
+	result["from"] = tr.from.Unix()
+	result["to"] = tr.until.Unix()
+	result["window_seconds"] = window.Seconds()
+	result["group_by"] = groupBy
+	if opts.ServiceName != "" {
+		result["service"] = opts.ServiceName
+	}
+	rows := make([]map[string]interface{}, 0, len(groups))
+	for _, g := range groups {
+		row := redFields(g, window)
+		row["name"] = g.Group
+		rows = append(rows, row)
+	}
+	result["groups"] = rows
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, result)
+}
+
+// redFields renders one summary: rates per second over window, the error
+// ratio, and latencies in milliseconds
+func redFields(s tracestore.REDSummary, window time.Duration) map[string]interface{} {
+	fields := map[string]interface{}{
+		"requests":     s.Requests,
+		"errors":       s.Errors,
+		"request_rate": float64(s.Requests) / window.Seconds(),
+		"error_rate":   float64(s.Errors) / window.Seconds(),
+		"error_ratio":  0.0,
+	}
+	latency := map[string]interface{}{"avg": 0.0, "p50": 0.0, "p90": 0.0, "p95": 0.0, "p99": 0.0, "max": 0.0}
+	if s.Requests > 0 {
+		fields["error_ratio"] = float64(s.Errors) / float64(s.Requests)
+		latency = map[string]interface{}{
+			"avg": float64(s.DurationNsSum) / float64(s.Requests) / 1e6,
+			"p50": float64(s.P50Ns) / 1e6,
+			"p90": float64(s.P90Ns) / 1e6,
+			"p95": float64(s.P95Ns) / 1e6,
+			"p99": float64(s.P99Ns) / 1e6,
+			"max": float64(s.DurationNsMax) / 1e6,
+		}
+	}
+	fields["latency_ms"] = latency
+	return fields
+}
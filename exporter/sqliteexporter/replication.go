@@ -0,0 +1,445 @@
+package sqliteexporter
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+const (
+	replicationRolePrimary = "primary"
+	replicationRoleStandby = "standby"
+
+	replicationSubscribeMethod = "/gotel.replication.v1.Replication/Subscribe"
+)
+
+// errStandbyReadOnly is returned for ingest while the node follows a primary.
+var errStandbyReadOnly = errors.New("node is a replication standby and does not accept writes")
+
+// replicationRequest opens a subscription from the given primary row IDs.
+type replicationRequest struct {
+	AfterSpanID   int64 `json:"after_span_id"`
+	AfterMetricID int64 `json:"after_metric_id"`
+	AfterLogID    int64 `json:"after_log_id"`
+}
+
+// replicationCodec carries replication messages as JSON so the service does
+// not need generated protobuf stubs.
+type replicationCodec struct{}
+
+func (replicationCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (replicationCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (replicationCodec) Name() string                               { return "json" }
+
+// replicationService is implemented by the primary side of replication.
+type replicationService interface {
+	Subscribe(req *replicationRequest, stream grpc.ServerStream) error
+}
+
+var replicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gotel.replication.v1.Replication",
+	HandlerType: (*replicationService)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       replicationSubscribeHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+func replicationSubscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(replicationRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(replicationService).Subscribe(req, stream)
+}
+
+// replicator streams committed rows to standbys when acting as primary, and
+// follows a primary when acting as standby.
+type replicator struct {
+	cfg    ReplicationConfig
+	store  *tracestore.Store
+	logger *zap.Logger
+
+	standby atomic.Bool
+	wg      sync.WaitGroup
+
+	// serverMu serializes promotion with stop and guards server and cancel
+	serverMu sync.Mutex
+	server   *grpc.Server
+	cancel   context.CancelFunc
+
+	mu       sync.Mutex
+	lastSync time.Time
+	lastErr  string
+}
+
+func newReplicator(cfg ReplicationConfig, store *tracestore.Store, logger *zap.Logger) *replicator {
+	r := &replicator{
+		cfg:    cfg,
+		store:  store,
+		logger: logger.With(zap.String("replication_role", cfg.Role)),
+	}
+	r.standby.Store(cfg.Role == replicationRoleStandby)
+	return r
+}
+
+// start begins serving (primary) or following (standby).
+func (r *replicator) start() error {
+	r.serverMu.Lock()
+	defer r.serverMu.Unlock()
+	if !r.standby.Load() {
+		return r.serve()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.wg.Add(1)
+	go r.follow(ctx)
+	return nil
+}
+
+// stop shuts down the gRPC server and the follower loop.
+func (r *replicator) stop() {
+	r.serverMu.Lock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.server != nil {
+		r.server.Stop()
+	}
+	r.serverMu.Unlock()
+	r.wg.Wait()
+}
+
+// isStandby reports whether the node is currently following a primary.
+func (r *replicator) isStandby() bool {
+	return r.standby.Load()
+}
+
+// promote stops following the primary and starts serving replication so the
+// node can take over as primary. The server is started first, so a node
+// that cannot listen stays a standby and keeps following.
+func (r *replicator) promote() error {
+	r.serverMu.Lock()
+	defer r.serverMu.Unlock()
+	if !r.standby.Load() {
+		return fmt.Errorf("node is already primary")
+	}
+	if err := r.serve(); err != nil {
+		return err
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.standby.Store(false)
+	r.logger.Info("Promoted replication standby to primary")
+	return nil
+}
+
+// serve starts the replication server. The caller holds serverMu.
+func (r *replicator) serve() error {
+	lis, err := net.Listen("tcp", r.cfg.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen for replication on %s: %w", r.cfg.ListenAddress, err)
+	}
+
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(replicationCodec{}), grpc.StreamInterceptor(r.authenticate)}
+	if r.cfg.TLS.HasValue() {
+		tlsConfig, err := r.cfg.TLS.Get().LoadTLSConfig(context.Background())
+		if err != nil {
+			lis.Close()
+			return fmt.Errorf("failed to load replication TLS config: %w", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&replicationServiceDesc, r)
+	r.server = server
+
+	r.logger.Info("Starting replication server",
+		zap.String("listen_address", r.cfg.ListenAddress),
+		zap.Bool("tls", r.cfg.TLS.HasValue()))
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if err := server.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			r.logger.Error("Replication server error", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// authenticate refuses streams without the configured token
+func (r *replicator) authenticate(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if r.cfg.Token == "" {
+		return handler(srv, stream)
+	}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), []byte("Bearer "+string(r.cfg.Token))) == 1 {
+			return handler(srv, stream)
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid replication token")
+}
+
+// Subscribe streams change sets committed after the requested cursor until
+// the standby disconnects.
+func (r *replicator) Subscribe(req *replicationRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	spanCursor, metricCursor, logCursor := req.AfterSpanID, req.AfterMetricID, req.AfterLogID
+
+	r.logger.Info("Replication standby subscribed",
+		zap.Int64("after_span_id", spanCursor),
+		zap.Int64("after_metric_id", metricCursor),
+		zap.Int64("after_log_id", logCursor))
+
+	ticker := time.NewTicker(r.cfg.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		changes, err := r.store.ChangesSince(ctx, spanCursor, metricCursor, logCursor, r.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+		if !changes.Empty() {
+			if err := stream.SendMsg(&changes); err != nil {
+				return err
+			}
+			if id := changes.LastSpanID(); id > 0 {
+				spanCursor = id
+			}
+			if id := changes.LastMetricID(); id > 0 {
+				metricCursor = id
+			}
+			if id := changes.LastLogID(); id > 0 {
+				logCursor = id
+			}
+			// Keep draining without waiting while there is a backlog
+			if len(changes.Spans) == r.cfg.BatchSize || len(changes.Metrics) == r.cfg.BatchSize || len(changes.Logs) == r.cfg.BatchSize {
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// follow keeps a subscription to the primary open, reconnecting after
+// failures, until ctx is cancelled.
+func (r *replicator) follow(ctx context.Context) {
+	defer r.wg.Done()
+
+	for {
+		err := r.followOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.setError(err)
+			r.logger.Warn("Replication stream interrupted", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.cfg.SyncInterval):
+		}
+	}
+}
+
+func (r *replicator) followOnce(ctx context.Context) error {
+	spanCursor, metricCursor, logCursor, err := r.store.ReplicationCursor(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read replication cursor: %w", err)
+	}
+
+	creds := insecure.NewCredentials()
+	if r.cfg.PrimaryTLS.HasValue() {
+		tlsConfig, err := r.cfg.PrimaryTLS.Get().LoadTLSConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load replication primary_tls config: %w", err)
+		}
+		// insecure: true leaves tlsConfig nil
+		if tlsConfig != nil {
+			creds = credentials.NewTLS(tlsConfig)
+		}
+	}
+	conn, err := grpc.NewClient(r.cfg.PrimaryEndpoint,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(replicationCodec{})))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	streamCtx := ctx
+	if r.cfg.Token != "" {
+		streamCtx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+string(r.cfg.Token))
+	}
+	stream, err := conn.NewStream(streamCtx, &replicationServiceDesc.Streams[0], replicationSubscribeMethod)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&replicationRequest{AfterSpanID: spanCursor, AfterMetricID: metricCursor, AfterLogID: logCursor}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	r.logger.Info("Following replication primary",
+		zap.String("primary_endpoint", r.cfg.PrimaryEndpoint),
+		zap.Int64("after_span_id", spanCursor),
+		zap.Int64("after_metric_id", metricCursor),
+		zap.Int64("after_log_id", logCursor))
+
+	for {
+		var changes tracestore.ChangeSet
+		if err := stream.RecvMsg(&changes); err != nil {
+			return err
+		}
+		if err := r.store.ApplyChanges(ctx, changes); err != nil {
+			return fmt.Errorf("failed to apply replicated changes: %w", err)
+		}
+		r.markSynced()
+		r.logger.Debug("Applied replicated changes",
+			zap.Int("spans", len(changes.Spans)),
+			zap.Int("metrics", len(changes.Metrics)),
+			zap.Int("logs", len(changes.Logs)))
+	}
+}
+
+func (r *replicator) markSynced() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastSync = time.Now()
+	r.lastErr = ""
+}
+
+func (r *replicator) setError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastErr = err.Error()
+}
+
+// status describes the replication state for /api/replication/status.
+func (r *replicator) status(ctx context.Context) (map[string]interface{}, error) {
+	role := replicationRolePrimary
+	if r.isStandby() {
+		role = replicationRoleStandby
+	}
+	out := map[string]interface{}{
+		"role": role,
+	}
+	if r.cfg.Role != replicationRoleStandby {
+		out["listen_address"] = r.cfg.ListenAddress
+		return out, nil
+	}
+
+	spanCursor, metricCursor, logCursor, err := r.store.ReplicationCursor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out["primary_endpoint"] = r.cfg.PrimaryEndpoint
+	out["span_cursor"] = spanCursor
+	out["metric_cursor"] = metricCursor
+	out["log_cursor"] = logCursor
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastSync.IsZero() {
+		out["last_sync"] = r.lastSync.UTC().Format(time.RFC3339)
+	}
+	if r.lastErr != "" {
+		out["last_error"] = r.lastErr
+	}
+	return out, nil
+}
+
+// replicationTokenHeader carries the replication token to the HTTP
+// replication endpoints, since Authorization belongs to query_auth
+const replicationTokenHeader = "X-Replication-Token"
+
+// authorizeReplication refuses replication endpoint requests that do not
+// carry the replication token, and all of them when no token is configured:
+// the endpoints control and describe the node as a whole, so query API
+// access (or a tenant) is not enough. It reports whether r may proceed.
+func (e *sqliteExporter) authorizeReplication(w http.ResponseWriter, r *http.Request) bool {
+	token := string(e.replication.cfg.Token)
+	if token == "" {
+		e.writeError(w, "replication endpoints require replication.token", nil, http.StatusForbidden)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(replicationTokenHeader)), []byte(token)) != 1 {
+		e.writeError(w, "missing or invalid replication token", nil, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleReplicationStatus reports the node's replication role and progress
+func (e *sqliteExporter) handleReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	if e.replication == nil {
+		e.writeError(w, "replication is not enabled", nil, http.StatusNotFound)
+		return
+	}
+	if !e.authorizeReplication(w, r) {
+		return
+	}
+
+	status, err := e.replication.status(r.Context())
+	if err != nil {
+		e.writeError(w, "Failed to load replication status", err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, status)
+}
+
+// handleReplicationPromote turns a standby into a primary
+func (e *sqliteExporter) handleReplicationPromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		e.writeError(w, "method not allowed", nil, http.StatusMethodNotAllowed)
+		return
+	}
+	if e.replication == nil {
+		e.writeError(w, "replication is not enabled", nil, http.StatusNotFound)
+		return
+	}
+	if !e.authorizeReplication(w, r) {
+		return
+	}
+	if err := e.replication.promote(); err != nil {
+		e.writeError(w, "Failed to promote standby", err, http.StatusConflict)
+		return
+	}
+
+	e.handleReplicationStatus(w, r)
+}
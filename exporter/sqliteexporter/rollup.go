@@ -0,0 +1,65 @@
+package sqliteexporter
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runRollup rolls aged metric points up every rollup.interval
+func (e *sqliteExporter) runRollup() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.config.Rollup.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+			e.rollupMetrics(time.Now())
+		}
+	}
+}
+
+// rollupMetrics runs one rollup pass and logs what it moved
+func (e *sqliteExporter) rollupMetrics(now time.Time) {
+	start := time.Now()
+	result, err := e.store.RollupMetrics(e.cleanupCtx, now, e.config.Rollup.MinuteAfter, e.config.Rollup.HourAfter)
+	if err != nil {
+		if e.cleanupCtx.Err() == nil {
+			e.logger.Warn("Metric rollup failed", zap.Error(err))
+		}
+		return
+	}
+	if result.RawPoints > 0 || result.MinutePoints > 0 {
+		e.logger.Debug("Metrics rolled up",
+			zap.Int64("raw_points", result.RawPoints),
+			zap.Int64("minute_points", result.MinutePoints),
+			zap.Duration("duration", time.Since(start)))
+	}
+}
+
+// metricResolution picks the resolution /render reads a time range at. Raw
+// points only cover the last rollup.minute_after, so a range starting
+// earlier is read at one-minute resolution, and one starting before
+// rollup.hour_after at one-hour resolution. An unbounded start reaches the
+// oldest, hourly, data.
+func (e *sqliteExporter) metricResolution(tr timeRange, now time.Time) time.Duration {
+	if e.config.Rollup.Interval <= 0 {
+		return 0
+	}
+	if tr.from.IsZero() {
+		return time.Hour
+	}
+	age := now.Sub(tr.from)
+	switch {
+	case age <= e.config.Rollup.MinuteAfter:
+		return 0
+	case age <= e.config.Rollup.HourAfter:
+		return time.Minute
+	default:
+		return time.Hour
+	}
+}
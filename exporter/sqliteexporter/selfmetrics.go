@@ -0,0 +1,99 @@
+package sqliteexporter
+
+import (
+	"encoding/json"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// selfMetricsNode is the path segment under the metric root that holds the
+// collector's own metrics, in the place of a service name
+const selfMetricsNode = "self"
+
+// ingestCounters counts what the exporter stored and refused since the last
+// self-metrics write
+type ingestCounters struct {
+	spansStored     atomic.Int64
+	pointsStored    atomic.Int64
+	logsStored      atomic.Int64
+	writeErrors     atomic.Int64
+	batchesRejected atomic.Int64
+}
+
+// runSelfMetrics writes the exporter's own stats every self_metrics.interval
+func (e *sqliteExporter) runSelfMetrics() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.config.SelfMetrics.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case now := <-ticker.C:
+			e.writeSelfMetrics(now)
+		}
+	}
+}
+
+// selfMetric is one value written under <root>.self
+type selfMetric struct {
+	name  string
+	value int64
+}
+
+// selfMetricRecords builds one row per self metric under <root>.self, as
+// carbon reports itself under carbon.agents. Counters are the totals since
+// the previous write, so a row is a per-interval rate like carbon's
+// metricsReceived; the rest are gauges. The per-service shedding metrics
+// (see shedMetricRecords) follow.
+func (e *sqliteExporter) selfMetricRecords(now time.Time) []tracestore.MetricRecord {
+	values := []selfMetric{
+		{"spans_stored", e.ingest.spansStored.Swap(0)},
+		{"points_stored", e.ingest.pointsStored.Swap(0)},
+		{"logs_stored", e.ingest.logsStored.Swap(0)},
+		{"write_errors", e.ingest.writeErrors.Swap(0)},
+		{"batches_rejected", e.ingest.batchesRejected.Swap(0)},
+	}
+	if used, file, err := e.store.UsedBytes(e.cleanupCtx); err == nil {
+		values = append(values, selfMetric{"db_used_bytes", used}, selfMetric{"db_file_bytes", file})
+	}
+	if wal, err := e.store.WALSize(); err == nil {
+		values = append(values, selfMetric{"wal_bytes", wal})
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	values = append(values,
+		selfMetric{"mem_heap_bytes", int64(mem.HeapAlloc)},
+		selfMetric{"goroutines", int64(runtime.NumGoroutine())})
+
+	root := e.metricRoot() + "." + selfMetricsNode + "."
+	records := make([]tracestore.MetricRecord, 0, len(values))
+	for _, v := range values {
+		tags := map[string]string{"service": selfMetricsNode, "metric": v.name}
+		if e.config.InstanceLabel != "" {
+			tags["instance"] = e.config.InstanceLabel
+		}
+		tagsJSON, _ := json.Marshal(tags)
+		records = append(records, tracestore.MetricRecord{
+			Name:      root + v.name,
+			Value:     float64(v.value),
+			Timestamp: now.Unix(),
+			Tags:      string(tagsJSON),
+		})
+	}
+	return append(records, e.shedMetricRecords(now)...)
+}
+
+// writeSelfMetrics stores one set of self metrics
+func (e *sqliteExporter) writeSelfMetrics(now time.Time) {
+	if err := e.store.InsertData(e.cleanupCtx, nil, e.selfMetricRecords(now)); err != nil && e.cleanupCtx.Err() == nil {
+		e.logger.Warn("Failed to write self metrics", zap.Error(err))
+	}
+}
@@ -0,0 +1,59 @@
+package sqliteexporter
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// handleSelfTime ranks operations by the time their spans spent in their own
+// code rather than waiting on child spans, highest total first.
+func (e *sqliteExporter) handleSelfTime(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit, err := parseLimit(q, 20)
+	if err != nil {
+		e.writeError(w, "invalid limit", err, http.StatusBadRequest)
+		return
+	}
+	tr, err := parseTimeRange(q, time.Now())
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+
+	ops, err := e.store.OperationSelfTimes(r.Context(), tracestore.SelfTimeQueryOptions{
+		ServiceName:  strings.TrimSpace(q.Get("service")),
+		MinStartTime: tr.startNs(),
+		MaxStartTime: tr.endNs(),
+		Limit:        limit,
+	})
+	if err != nil {
+		e.writeError(w, "Failed to query self-time", err, http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(ops))
+	for _, op := range ops {
+		selfMs := float64(op.SelfTimeNsSum) / 1e6
+		result := map[string]interface{}{
+			"service":          op.ServiceName,
+			"operation":        op.SpanName,
+			"span_count":       op.SpanCount,
+			"self_time_ms":     selfMs,
+			"avg_self_time_ms": selfMs / float64(op.SpanCount),
+			"duration_ms":      float64(op.DurationNsSum) / 1e6,
+			"self_time_nanos":  op.SelfTimeNsSum,
+			"duration_nanos":   op.DurationNsSum,
+		}
+		if op.DurationNsSum > 0 {
+			result["self_time_ratio"] = float64(op.SelfTimeNsSum) / float64(op.DurationNsSum)
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, results)
+}
@@ -0,0 +1,128 @@
+package sqliteexporter
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// shedMetricsNode is the path segment under <root>.self that holds the
+// per-service shedding metrics
+const shedMetricsNode = "shed"
+
+// shedCount is what one service sent since the last self-metrics write
+type shedCount struct {
+	// received counts every span the service sent, stored or not
+	received int64
+	// excluded counts spans dropped by the include/exclude rules
+	excluded int64
+	// throttled counts spans in batches refused by backpressure
+	throttled int64
+}
+
+// shedCounters counts, per service, the spans the exporter did not store, so
+// SDK owners can see when and why their data is shed. A nil *shedCounters
+// counts nothing.
+type shedCounters struct {
+	mu       sync.Mutex
+	services map[string]*shedCount
+}
+
+// newShedCounters returns nil when self metrics, which report the counts,
+// are not written
+func newShedCounters(config *Config) *shedCounters {
+	if config.SelfMetrics.Interval <= 0 || config.DryRun {
+		return nil
+	}
+	return &shedCounters{services: make(map[string]*shedCount)}
+}
+
+func (c *shedCounters) add(service string, n shedCount) {
+	if c == nil || n.received == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sc, ok := c.services[service]
+	if !ok {
+		sc = &shedCount{}
+		c.services[service] = sc
+	}
+	sc.received += n.received
+	sc.excluded += n.excluded
+	sc.throttled += n.throttled
+}
+
+// throttled counts every span of a batch refused by backpressure
+func (c *shedCounters) throttled(td ptrace.Traces) {
+	if c == nil {
+		return
+	}
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		rs := td.ResourceSpans().At(i)
+		var n int64
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			n += int64(rs.ScopeSpans().At(j).Spans().Len())
+		}
+		c.add(spanServiceName(rs.Resource()), shedCount{received: n, throttled: n})
+	}
+}
+
+// swap returns the counts since the last call and starts over
+func (c *shedCounters) swap() map[string]*shedCount {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.services
+	c.services = make(map[string]*shedCount)
+	return counts
+}
+
+// shedMetricRecords builds, for every service that sent spans since the last
+// write, <root>.self.shed.<service>.{spans_received, spans_excluded,
+// spans_throttled, shed_percent}. Points carry the service in a
+// shed_service tag.
+func (e *sqliteExporter) shedMetricRecords(now time.Time) []tracestore.MetricRecord {
+	counts := e.shed.swap()
+	services := make([]string, 0, len(counts))
+	for service := range counts {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var records []tracestore.MetricRecord
+	for _, service := range services {
+		sc := counts[service]
+		values := []struct {
+			name  string
+			value float64
+		}{
+			{"spans_received", float64(sc.received)},
+			{"spans_excluded", float64(sc.excluded)},
+			{"spans_throttled", float64(sc.throttled)},
+			{"shed_percent", float64(sc.excluded+sc.throttled) * 100 / float64(sc.received)},
+		}
+		root := e.metricRoot() + "." + selfMetricsNode + "." + shedMetricsNode + "." + sanitizeMetricName(service) + "."
+		for _, v := range values {
+			tags := map[string]string{"service": selfMetricsNode, "metric": v.name, "shed_service": service}
+			if e.config.InstanceLabel != "" {
+				tags["instance"] = e.config.InstanceLabel
+			}
+			tagsJSON, _ := json.Marshal(tags)
+			records = append(records, tracestore.MetricRecord{
+				Name:      root + v.name,
+				Value:     v.value,
+				Timestamp: now.Unix(),
+				Tags:      string(tagsJSON),
+			})
+		}
+	}
+	return records
+}
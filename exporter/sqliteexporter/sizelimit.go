@@ -0,0 +1,61 @@
+package sqliteexporter
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runSizeLimit checks the database size every dbSizeCheckInterval and trims
+// it once it is over max_db_size_mib.
+func (e *sqliteExporter) runSizeLimit() {
+	defer e.wg.Done()
+
+	// VACUUM is not run here: it locks the database for as long as it takes
+	// to rewrite the file and needs as much free disk again, which a size
+	// limit is usually set for lack of
+	if ok, err := e.store.IncrementalAutoVacuum(e.cleanupCtx); err != nil {
+		e.logger.Warn("Failed to read the database auto-vacuum mode", zap.Error(err))
+	} else if !ok {
+		e.logger.Warn("Database is not in incremental auto-vacuum mode, so max_db_size_mib frees space for reuse but cannot shrink the file; "+
+			"run `gotel db dedupe --vacuum` while gotel is stopped to switch it over",
+			zap.String("db_path", e.config.DBPath))
+	}
+
+	ticker := time.NewTicker(dbSizeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+			e.enforceSizeLimit()
+		}
+	}
+}
+
+// enforceSizeLimit runs one size check and logs what was deleted
+func (e *sqliteExporter) enforceSizeLimit() {
+	start := time.Now()
+	maxBytes := e.config.MaxDBSizeMiB << 20
+	result, err := e.store.EnforceSizeLimit(e.cleanupCtx, maxBytes, int64(float64(maxBytes)*dbSizeLowWaterRatio))
+	if err != nil {
+		if e.cleanupCtx.Err() == nil {
+			e.logger.Warn("Database size limit enforcement failed", zap.Error(err))
+		}
+		return
+	}
+	if result == nil {
+		return
+	}
+
+	e.logger.Warn("Database over max_db_size_mib, deleted oldest data",
+		zap.Int64("used_bytes_before", result.UsedBytesBefore),
+		zap.Int64("used_bytes_after", result.UsedBytesAfter),
+		zap.Int64("file_bytes_after", result.FileBytesAfter),
+		zap.Int64("spans_deleted", result.SpansDeleted),
+		zap.Int64("metrics_deleted", result.MetricsDeleted),
+		zap.Int64("logs_deleted", result.LogsDeleted),
+		zap.Duration("duration", time.Since(start)))
+}
@@ -0,0 +1,120 @@
+package sqliteexporter
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// slowIngestSampleSize caps the span names kept per slow batch.
+const slowIngestSampleSize = 10
+
+// slowBatch describes one pushTraces call that exceeded the threshold.
+type slowBatch struct {
+	Time       time.Time `json:"time"`
+	DurationMs float64   `json:"duration_ms"`
+	Spans      int       `json:"spans"`
+	Bytes      int       `json:"bytes"`
+	Services   []string  `json:"services"`
+	SpanNames  []string  `json:"span_names"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// slowIngestLog keeps the most recent slow batches in a ring buffer.
+type slowIngestLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	batches []slowBatch
+	next    int
+	total   int64
+}
+
+// newSlowIngestLog returns nil when slow ingest logging is disabled; a nil
+// log records nothing.
+func newSlowIngestLog(cfg SlowIngestConfig) *slowIngestLog {
+	if cfg.Threshold <= 0 {
+		return nil
+	}
+	return &slowIngestLog{
+		threshold: cfg.Threshold,
+		batches:   make([]slowBatch, 0, cfg.BufferSize),
+	}
+}
+
+// observe records td if elapsed is over the threshold and returns the
+// recorded batch.
+func (l *slowIngestLog) observe(td ptrace.Traces, elapsed time.Duration, err error) (slowBatch, bool) {
+	if l == nil || elapsed <= l.threshold {
+		return slowBatch{}, false
+	}
+	b := describeBatch(td)
+	b.Time = time.Now()
+	b.DurationMs = float64(elapsed.Microseconds()) / 1000
+	if err != nil {
+		b.Error = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total++
+	if len(l.batches) < cap(l.batches) {
+		l.batches = append(l.batches, b)
+	} else {
+		l.batches[l.next] = b
+		l.next = (l.next + 1) % len(l.batches)
+	}
+	return b, true
+}
+
+// recent returns the buffered batches, newest first, and the number of slow
+// batches seen since startup.
+func (l *slowIngestLog) recent() ([]slowBatch, int64) {
+	if l == nil {
+		return []slowBatch{}, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]slowBatch, 0, len(l.batches))
+	for i := 0; i < len(l.batches); i++ {
+		idx := (l.next - 1 - i + 2*len(l.batches)) % len(l.batches)
+		out = append(out, l.batches[idx])
+	}
+	return out, l.total
+}
+
+// describeBatch counts spans and collects the services and a sample of
+// distinct span names in td.
+func describeBatch(td ptrace.Traces) slowBatch {
+	b := slowBatch{
+		Spans:     td.SpanCount(),
+		Bytes:     (&ptrace.ProtoMarshaler{}).TracesSize(td),
+		Services:  []string{},
+		SpanNames: []string{},
+	}
+	seenServices := make(map[string]bool)
+	seenNames := make(map[string]bool)
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		rs := td.ResourceSpans().At(i)
+		service := "unknown"
+		if v, ok := rs.Resource().Attributes().Get("service.name"); ok {
+			service = v.Str()
+		}
+		if !seenServices[service] {
+			seenServices[service] = true
+			b.Services = append(b.Services, service)
+		}
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			spans := rs.ScopeSpans().At(j).Spans()
+			for k := 0; k < spans.Len() && len(b.SpanNames) < slowIngestSampleSize; k++ {
+				name := spans.At(k).Name()
+				if !seenNames[name] {
+					seenNames[name] = true
+					b.SpanNames = append(b.SpanNames, name)
+				}
+			}
+		}
+	}
+	return b
+}
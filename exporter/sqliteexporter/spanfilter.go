@@ -0,0 +1,156 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	spanMatchGlob   = "glob"
+	spanMatchRegexp = "regexp"
+)
+
+// spanFilter applies the include and exclude rules. A nil filter keeps
+// every span.
+type spanFilter struct {
+	include []spanMatcher
+	exclude []spanMatcher
+}
+
+// spanMatcher is a compiled SpanMatchConfig; nil patterns match anything
+type spanMatcher struct {
+	service    *regexp.Regexp
+	spanName   *regexp.Regexp
+	attributes map[string]*regexp.Regexp
+}
+
+// newSpanFilter returns nil when no rules are configured
+func newSpanFilter(include, exclude []SpanMatchConfig) (*spanFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &spanFilter{}
+	for i, c := range include {
+		m, err := compileSpanMatcher(c)
+		if err != nil {
+			return nil, fmt.Errorf("include[%d]: %w", i, err)
+		}
+		f.include = append(f.include, m)
+	}
+	for i, c := range exclude {
+		m, err := compileSpanMatcher(c)
+		if err != nil {
+			return nil, fmt.Errorf("exclude[%d]: %w", i, err)
+		}
+		f.exclude = append(f.exclude, m)
+	}
+	return f, nil
+}
+
+func compileSpanMatcher(c SpanMatchConfig) (spanMatcher, error) {
+	var m spanMatcher
+	if c.Service == "" && c.SpanName == "" && len(c.Attributes) == 0 {
+		return m, fmt.Errorf("rule must set service, span_name or attributes")
+	}
+	compile := func(pattern string) (*regexp.Regexp, error) {
+		switch c.MatchType {
+		case "", spanMatchGlob:
+			return regexp.Compile(globToRegexp(pattern))
+		case spanMatchRegexp:
+			return regexp.Compile(pattern)
+		default:
+			return nil, fmt.Errorf("match_type must be %s or %s, got %q", spanMatchGlob, spanMatchRegexp, c.MatchType)
+		}
+	}
+
+	var err error
+	if c.Service != "" {
+		if m.service, err = compile(c.Service); err != nil {
+			return m, fmt.Errorf("service: %w", err)
+		}
+	}
+	if c.SpanName != "" {
+		if m.spanName, err = compile(c.SpanName); err != nil {
+			return m, fmt.Errorf("span_name: %w", err)
+		}
+	}
+	if len(c.Attributes) > 0 {
+		m.attributes = make(map[string]*regexp.Regexp, len(c.Attributes))
+		for key, pattern := range c.Attributes {
+			if m.attributes[key], err = compile(pattern); err != nil {
+				return m, fmt.Errorf("attributes[%s]: %w", key, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+// keep reports whether a span is stored and counted
+func (f *spanFilter) keep(service string, span ptrace.Span, resource pcommon.Resource) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 {
+		included := false
+		for _, m := range f.include {
+			if m.matches(service, span, resource) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, m := range f.exclude {
+		if m.matches(service, span, resource) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m spanMatcher) matches(service string, span ptrace.Span, resource pcommon.Resource) bool {
+	if m.service != nil && !m.service.MatchString(service) {
+		return false
+	}
+	if m.spanName != nil && !m.spanName.MatchString(span.Name()) {
+		return false
+	}
+	for key, re := range m.attributes {
+		v, ok := span.Attributes().Get(key)
+		if !ok {
+			if v, ok = resource.Attributes().Get(key); !ok {
+				return false
+			}
+		}
+		if !re.MatchString(v.AsString()) {
+			return false
+		}
+	}
+	return true
+}
+
+// globToRegexp turns a glob with * and ? wildcards into an anchored regexp.
+// Unlike path.Match, * also matches "/", so "GET /health*" covers
+// "GET /health/live".
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
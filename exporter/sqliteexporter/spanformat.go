@@ -0,0 +1,488 @@
+package sqliteexporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+const (
+	storageFormatJSON     = "json"
+	storageFormatProtobuf = "protobuf"
+
+	// storageMigrationBatchSize is the number of rows rewritten per
+	// transaction, so ingest is not blocked for long during a migration.
+	storageMigrationBatchSize = 500
+)
+
+// storeSpan encodes a span in the configured storage format
+func (e *sqliteExporter) storeSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope, tenant string) (tracestore.EncodedSpan, error) {
+	if e.config.StorageFormat != storageFormatProtobuf {
+		spanJSON, err := e.spanToJSON(span, resource, scope, tenant)
+		return tracestore.EncodedSpan{Header: spanJSON}, err
+	}
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	resource.CopyTo(rs.Resource())
+	ss := rs.ScopeSpans().AppendEmpty()
+	scope.CopyTo(ss.Scope())
+	stored := ss.Spans().AppendEmpty()
+	span.CopyTo(stored)
+	enrichSpanAttributes(e.enrichers, stored.Attributes(), rs.Resource().Attributes())
+	return encodeSingleSpan(td, e.config.IndexedAttributes, tenant)
+}
+
+// enrichSpanAttributes applies enrichers to pdata attributes. Looked-up
+// values are strings and existing attributes are never overwritten.
+func enrichSpanAttributes(enrichers []spanEnricher, attrs, resourceAttrs pcommon.Map) {
+	if len(enrichers) == 0 {
+		return
+	}
+	raw := attrs.AsRaw()
+	enrichAttributes(enrichers, raw, resourceAttrs.AsRaw())
+	for k, v := range raw {
+		if _, exists := attrs.Get(k); !exists {
+			attrs.PutStr(k, fmt.Sprint(v))
+		}
+	}
+}
+
+// singleSpan returns the only span of td with its resource and scope
+func singleSpan(td ptrace.Traces) (ptrace.Span, pcommon.Resource, pcommon.InstrumentationScope, error) {
+	if td.SpanCount() != 1 {
+		return ptrace.Span{}, pcommon.Resource{}, pcommon.InstrumentationScope{}, fmt.Errorf("expected 1 span, got %d", td.SpanCount())
+	}
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		rs := td.ResourceSpans().At(i)
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			ss := rs.ScopeSpans().At(j)
+			if ss.Spans().Len() == 1 {
+				return ss.Spans().At(0), rs.Resource(), ss.Scope(), nil
+			}
+		}
+	}
+	return ptrace.Span{}, pcommon.Resource{}, pcommon.InstrumentationScope{}, fmt.Errorf("span not found")
+}
+
+// encodeSingleSpan stores a one-span TracesData as OTLP protobuf, with a JSON
+// header holding just the fields the indexed columns are extracted from and
+// the span's indexedAttrs, which the attribute index is built from. Queries
+// on other fields decode the payload.
+func encodeSingleSpan(td ptrace.Traces, indexedAttrs []string, tenant string) (tracestore.EncodedSpan, error) {
+	span, resource, scope, err := singleSpan(td)
+	if err != nil {
+		return tracestore.EncodedSpan{}, err
+	}
+
+	header := map[string]interface{}{
+		"trace_id":             span.TraceID().String(),
+		"span_id":              span.SpanID().String(),
+		"parent_span_id":       span.ParentSpanID().String(),
+		"service_name":         spanServiceName(resource),
+		"span_name":            span.Name(),
+		"start_time_unix_nano": span.StartTimestamp().AsTime().UnixNano(),
+		"end_time_unix_nano":   span.EndTimestamp().AsTime().UnixNano(),
+		"status":               map[string]interface{}{"code": int(span.Status().Code())},
+	}
+	indexedResource := make(map[string]interface{})
+	for _, key := range []string{"service.version", "deployment.environment"} {
+		if v, ok := resource.Attributes().Get(key); ok {
+			indexedResource[key] = v.AsRaw()
+		}
+	}
+	if len(indexedResource) > 0 {
+		header["resource"] = indexedResource
+	}
+	if scope.Name() != "" {
+		header["scope"] = map[string]interface{}{"name": scope.Name()}
+	}
+	if traceState := span.TraceState().AsRaw(); traceState != "" {
+		header["trace_state"] = traceState
+	}
+	if tenant != "" {
+		header["tenant"] = tenant
+	}
+	// The full-text index reads the status message and exception events
+	// from the header.
+	if msg := span.Status().Message(); msg != "" {
+		header["status"].(map[string]interface{})["message"] = msg
+	}
+	var exceptions []interface{}
+	for i := 0; i < span.Events().Len(); i++ {
+		ev := span.Events().At(i)
+		if ev.Name() != "exception" {
+			continue
+		}
+		evAttrs := make(map[string]interface{})
+		for _, key := range []string{"exception.type", "exception.message", "exception.stacktrace"} {
+			if v, ok := ev.Attributes().Get(key); ok {
+				evAttrs[key] = v.AsString()
+			}
+		}
+		exceptions = append(exceptions, map[string]interface{}{"name": ev.Name(), "attributes": evAttrs})
+	}
+	if len(exceptions) > 0 {
+		header["events"] = exceptions
+	}
+	attrs := make(map[string]interface{})
+	for _, key := range indexedAttrs {
+		if v, ok := span.Attributes().Get(key); ok {
+			attrs[key] = v.AsRaw()
+		}
+	}
+	if len(attrs) > 0 {
+		header["attributes"] = attrs
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return tracestore.EncodedSpan{}, err
+	}
+	payload, err := (&ptrace.ProtoMarshaler{}).MarshalTraces(td)
+	if err != nil {
+		return tracestore.EncodedSpan{}, err
+	}
+	return tracestore.EncodedSpan{Header: headerJSON, Payload: payload}, nil
+}
+
+// decodeSpanPayload is the store's SpanDecoder: it rebuilds the JSON
+// document spanToJSON would have stored. Enrichment was applied before
+// encoding, so it is not repeated.
+func decodeSpanPayload(_ json.RawMessage, payload []byte) (json.RawMessage, error) {
+	td, err := (&ptrace.ProtoUnmarshaler{}).UnmarshalTraces(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode span payload: %w", err)
+	}
+	span, resource, scope, err := singleSpan(td)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode span payload: %w", err)
+	}
+	return json.Marshal(spanDocument(span, resource, scope, nil))
+}
+
+// spanFromDocument rebuilds a one-span ptrace.Traces from a stored JSON
+// document. Attribute types follow JSON, so a whole-number double comes back
+// as an int.
+func spanFromDocument(raw json.RawMessage) (ptrace.Traces, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return ptrace.Traces{}, err
+	}
+
+	td := ptrace.NewTraces()
+	rs := td.ResourceSpans().AppendEmpty()
+	ss := rs.ScopeSpans().AppendEmpty()
+	span := ss.Spans().AppendEmpty()
+
+	traceID, err := parseTraceID(docString(doc, "trace_id"))
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+	span.SetTraceID(traceID)
+	spanID, err := parseSpanID(docString(doc, "span_id"))
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+	span.SetSpanID(spanID)
+	if parent := docString(doc, "parent_span_id"); parent != "" {
+		parentID, err := parseSpanID(parent)
+		if err != nil {
+			return ptrace.Traces{}, err
+		}
+		span.SetParentSpanID(parentID)
+	}
+	span.SetName(docString(doc, "span_name"))
+	span.SetKind(parseSpanKind(docString(doc, "kind")))
+	span.SetStartTimestamp(pcommon.Timestamp(docInt(doc["start_time_unix_nano"])))
+	span.SetEndTimestamp(pcommon.Timestamp(docInt(doc["end_time_unix_nano"])))
+	span.TraceState().FromRaw(docString(doc, "trace_state"))
+	if status, ok := doc["status"].(map[string]interface{}); ok {
+		span.Status().SetCode(ptrace.StatusCode(docInt(status["code"])))
+		if msg, ok := status["message"].(string); ok {
+			span.Status().SetMessage(msg)
+		}
+	}
+
+	if err := putDocAttributes(rs.Resource().Attributes(), doc["resource"]); err != nil {
+		return ptrace.Traces{}, err
+	}
+	if scope, ok := doc["scope"].(map[string]interface{}); ok {
+		ss.Scope().SetName(docString(scope, "name"))
+		ss.Scope().SetVersion(docString(scope, "version"))
+	}
+	if err := putDocAttributes(span.Attributes(), doc["attributes"]); err != nil {
+		return ptrace.Traces{}, err
+	}
+
+	if links, ok := doc["links"].([]interface{}); ok {
+		for _, l := range links {
+			lm, ok := l.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			link := span.Links().AppendEmpty()
+			if id, err := parseTraceID(docString(lm, "trace_id")); err == nil {
+				link.SetTraceID(id)
+			}
+			if id, err := parseSpanID(docString(lm, "span_id")); err == nil {
+				link.SetSpanID(id)
+			}
+			link.TraceState().FromRaw(docString(lm, "trace_state"))
+			if err := putDocAttributes(link.Attributes(), lm["attributes"]); err != nil {
+				return ptrace.Traces{}, err
+			}
+		}
+	}
+	if events, ok := doc["events"].([]interface{}); ok {
+		for _, ev := range events {
+			em, ok := ev.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			event := span.Events().AppendEmpty()
+			event.SetName(docString(em, "name"))
+			event.SetTimestamp(pcommon.Timestamp(docInt(em["timestamp"])))
+			if err := putDocAttributes(event.Attributes(), em["attributes"]); err != nil {
+				return ptrace.Traces{}, err
+			}
+		}
+	}
+	return td, nil
+}
+
+func docString(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func docInt(v interface{}) int64 {
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		if f, err := n.Float64(); err == nil {
+			return int64(f)
+		}
+	}
+	return 0
+}
+
+func putDocAttributes(dest pcommon.Map, v interface{}) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return dest.FromRaw(normalizeDocValue(m).(map[string]interface{}))
+}
+
+// normalizeDocValue converts json.Number values into the int64/float64 types
+// pcommon accepts.
+func normalizeDocValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = normalizeDocValue(item)
+		}
+		return t
+	case []interface{}:
+		for i, item := range t {
+			t[i] = normalizeDocValue(item)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func parseTraceID(s string) (pcommon.TraceID, error) {
+	var id pcommon.TraceID
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil || len(s) != 2*len(id) {
+		return id, fmt.Errorf("invalid trace_id %q", s)
+	}
+	return id, nil
+}
+
+func parseSpanID(s string) (pcommon.SpanID, error) {
+	var id pcommon.SpanID
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil || len(s) != 2*len(id) {
+		return id, fmt.Errorf("invalid span_id %q", s)
+	}
+	return id, nil
+}
+
+// parseSpanKind is the inverse of ptrace.SpanKind.String
+func parseSpanKind(s string) ptrace.SpanKind {
+	switch strings.ToLower(s) {
+	case "internal":
+		return ptrace.SpanKindInternal
+	case "server":
+		return ptrace.SpanKindServer
+	case "client":
+		return ptrace.SpanKindClient
+	case "producer":
+		return ptrace.SpanKindProducer
+	case "consumer":
+		return ptrace.SpanKindConsumer
+	default:
+		return ptrace.SpanKindUnspecified
+	}
+}
+
+// convertSpanToProtobuf rewrites a JSON span row in the protobuf format
+func (e *sqliteExporter) convertSpanToProtobuf(span tracestore.EncodedSpan) (tracestore.EncodedSpan, error) {
+	td, err := spanFromDocument(span.Header)
+	if err != nil {
+		return tracestore.EncodedSpan{}, err
+	}
+	return encodeSingleSpan(td, e.config.IndexedAttributes, spanTenant(span.Header))
+}
+
+// convertSpanToJSON rewrites a protobuf span row as a JSON document
+func convertSpanToJSON(span tracestore.EncodedSpan) (tracestore.EncodedSpan, error) {
+	td, err := (&ptrace.ProtoUnmarshaler{}).UnmarshalTraces(span.Payload)
+	if err != nil {
+		return tracestore.EncodedSpan{}, fmt.Errorf("failed to decode span payload: %w", err)
+	}
+	stored, resource, scope, err := singleSpan(td)
+	if err != nil {
+		return tracestore.EncodedSpan{}, fmt.Errorf("failed to decode span payload: %w", err)
+	}
+	doc := spanDocument(stored, resource, scope, nil)
+	if tenant := spanTenant(span.Header); tenant != "" {
+		doc["tenant"] = tenant
+	}
+	b, err := json.Marshal(doc)
+	return tracestore.EncodedSpan{Header: b}, err
+}
+
+// spanTenant returns the tenant recorded in a stored span's header, which
+// the payload does not carry
+func spanTenant(header json.RawMessage) string {
+	var h struct {
+		Tenant string `json:"tenant"`
+	}
+	_ = json.Unmarshal(header, &h)
+	return h.Tenant
+}
+
+// runStorageMigration rewrites spans stored in the other format into the
+// configured one, in batches, until done or shutdown.
+func (e *sqliteExporter) runStorageMigration() {
+	defer e.wg.Done()
+
+	toProtobuf := e.config.StorageFormat == storageFormatProtobuf
+	convert := convertSpanToJSON
+	if toProtobuf {
+		convert = e.convertSpanToProtobuf
+	}
+
+	start := time.Now()
+	var afterID int64
+	var converted, skipped int
+	for e.cleanupCtx.Err() == nil {
+		res, err := e.store.ConvertSpans(e.cleanupCtx, toProtobuf, afterID, storageMigrationBatchSize, convert)
+		if err != nil {
+			if e.cleanupCtx.Err() == nil {
+				e.logger.Error("Storage format migration failed", zap.Error(err))
+			}
+			return
+		}
+		if res.LastID == afterID {
+			e.logger.Info("Storage format migration complete",
+				zap.String("format", e.config.StorageFormat),
+				zap.Int("converted", converted),
+				zap.Int("skipped", skipped),
+				zap.Duration("elapsed", time.Since(start)))
+			return
+		}
+		afterID = res.LastID
+		converted += res.Converted
+		skipped += res.Skipped
+	}
+}
+
+// wantsProtobuf reports whether the client asks for an OTLP protobuf body:
+// application/protobuf (or application/x-protobuf) is accepted with a
+// nonzero quality at least that of JSON (application/json or a wildcard)
+func wantsProtobuf(r *http.Request) bool {
+	var protoQ, jsonQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/protobuf", "application/x-protobuf":
+			protoQ = max(protoQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return protoQ > 0 && protoQ >= jsonQ
+}
+
+// traceProtobuf returns a trace as a protobuf TracesData (wire-compatible
+// with Tempo's Trace message). Serialized messages concatenate into their
+// merged message, so protobuf rows are copied as-is and only JSON rows are
+// converted.
+func (e *sqliteExporter) traceProtobuf(ctx context.Context, traceID string) ([]byte, error) {
+	rows, err := e.store.QueryEncodedTrace(ctx, traceID)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	for _, row := range rows {
+		if row.Payload != nil {
+			body = append(body, row.Payload...)
+			continue
+		}
+		td, err := spanFromDocument(row.Header)
+		if err != nil {
+			e.logger.Debug("Skipping unconvertible span", zap.String("trace_id", traceID), zap.Error(err))
+			continue
+		}
+		encoded, err := (&ptrace.ProtoMarshaler{}).MarshalTraces(td)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, encoded...)
+	}
+	return body, nil
+}
+
+// wrapProtobufField1 embeds msg as field 1 of an enclosing message, e.g. a
+// Trace inside Tempo's TraceByIDResponse.
+func wrapProtobufField1(msg []byte) []byte {
+	out := []byte{0x0a} // field 1, wire type 2 (length-delimited)
+	out = binary.AppendUvarint(out, uint64(len(msg)))
+	return append(out, msg...)
+}
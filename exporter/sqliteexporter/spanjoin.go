@@ -0,0 +1,40 @@
+package sqliteexporter
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runSpanJoin runs a store job that joins newly stored spans with their
+// parents and children until shutdown. Parent and child spans usually arrive
+// in different batches, often from different services, so these joins run
+// against the store rather than at ingest. Each tick repeats the job until it
+// has caught up.
+func (e *sqliteExporter) runSpanJoin(name string, cfg SpanJoinConfig, job func(context.Context, int) (int64, error)) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+			for {
+				n, err := job(e.cleanupCtx, cfg.BatchSize)
+				if err != nil {
+					if e.cleanupCtx.Err() == nil {
+						e.logger.Warn("Span join failed", zap.String("job", name), zap.Error(err))
+					}
+					break
+				}
+				if n < int64(cfg.BatchSize) {
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package sqliteexporter
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+var prometheusLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// spanMetricsCollector keeps cumulative counters for the derived span
+// metrics, served in Prometheus text format at /metrics. Each pushTraces
+// batch adds its per-operation aggregation, so the counters cover everything
+// ingested since startup regardless of retention. Each tenant has its own
+// registry, keyed by the series' tenant tag, and a scrape only sees the
+// tenant of its request; without tenancy everything is in the default
+// tenant "".
+type spanMetricsCollector struct {
+	name       string   // metric name prefix
+	tagKeys    []string // tag key for each label, in label order
+	labelNames []string
+
+	mu      sync.Mutex
+	tenants map[string]*spanMetricsSet
+	empty   http.Handler // served to tenants with no series yet
+}
+
+// spanMetricsSet is one tenant's counters
+type spanMetricsSet struct {
+	handler http.Handler
+
+	spans       *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	exceptions  *prometheus.CounterVec
+	overBudget  *prometheus.CounterVec
+	durationSum *prometheus.CounterVec
+}
+
+// newSpanMetricsCollector names the counters after the metric root (prefix
+// and namespace) and labels them according to labels, a tag key to label
+// name map.
+func newSpanMetricsCollector(root string, labels map[string]string) *spanMetricsCollector {
+	tagKeys := make([]string, 0, len(labels))
+	for key := range labels {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	labelNames := make([]string, len(tagKeys))
+	for i, key := range tagKeys {
+		labelNames[i] = labels[key]
+	}
+
+	return &spanMetricsCollector{
+		name:       prometheusMetricPrefix(root),
+		tagKeys:    tagKeys,
+		labelNames: labelNames,
+		tenants:    make(map[string]*spanMetricsSet),
+		empty:      promhttp.HandlerFor(prometheus.NewRegistry(), promhttp.HandlerOpts{}),
+	}
+}
+
+// newSet registers a tenant's counters in a registry of their own
+func (c *spanMetricsCollector) newSet() *spanMetricsSet {
+	registry := prometheus.NewRegistry()
+	set := &spanMetricsSet{
+		handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		spans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: c.name + "span_count_total",
+			Help: "Spans ingested per service and operation.",
+		}, c.labelNames),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: c.name + "error_count_total",
+			Help: "Spans with an error status per service and operation.",
+		}, c.labelNames),
+		exceptions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: c.name + "exception_count_total",
+			Help: "Exception events recorded per service and operation, whatever the span status.",
+		}, c.labelNames),
+		overBudget: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: c.name + "over_budget_count_total",
+			Help: "Spans exceeding their latency budget per service and operation.",
+		}, c.labelNames),
+		durationSum: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: c.name + "duration_ms_sum",
+			Help: "Total span duration in milliseconds per service and operation; divide by span_count_total for the average.",
+		}, c.labelNames),
+	}
+	registry.MustRegister(set.spans, set.errors, set.exceptions, set.overBudget, set.durationSum)
+	return set
+}
+
+// observe adds one batch's aggregation for the series identified by tags,
+// in the registry of their tenant tag
+func (c *spanMetricsCollector) observe(tags map[string]string, agg *spanAggregation) {
+	c.mu.Lock()
+	set, ok := c.tenants[tags["tenant"]]
+	if !ok {
+		set = c.newSet()
+		c.tenants[tags["tenant"]] = set
+	}
+	c.mu.Unlock()
+
+	values := make([]string, len(c.tagKeys))
+	for i, key := range c.tagKeys {
+		values[i] = tags[key]
+	}
+	set.spans.WithLabelValues(values...).Add(float64(agg.count))
+	set.errors.WithLabelValues(values...).Add(float64(agg.errorCount))
+	set.exceptions.WithLabelValues(values...).Add(float64(agg.exceptionCount))
+	set.overBudget.WithLabelValues(values...).Add(float64(agg.overBudget))
+	set.durationSum.WithLabelValues(values...).Add(agg.totalDuration)
+}
+
+// handler serves the counters of the request's tenant, as set by
+// tenantMiddleware
+func (c *spanMetricsCollector) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, _ := tracestore.TenantFromContext(r.Context())
+		c.mu.Lock()
+		set, ok := c.tenants[tenant]
+		c.mu.Unlock()
+		if !ok {
+			c.empty.ServeHTTP(w, r)
+			return
+		}
+		set.handler.ServeHTTP(w, r)
+	})
+}
+
+// prometheusMetricPrefix turns a dotted metric root such as "otel.prod" into
+// a Prometheus name prefix such as "otel_prod_".
+func prometheusMetricPrefix(root string) string {
+	var b strings.Builder
+	for i, r := range root {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return b.String() + "_"
+}
@@ -0,0 +1,164 @@
+package sqliteexporter
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// defaultSpansPerSpanSet is the number of matched spans returned per trace
+// when the spss parameter is absent, as in Tempo
+const defaultSpansPerSpanSet = 3
+
+// spanSetQuery describes the spans reported in each search result's spanSets
+type spanSetQuery struct {
+	condition *tracestore.SpanCondition
+	fields    []tracestore.SpanField
+	// keys are the attribute keys fields are reported under
+	keys     []string
+	perTrace int
+}
+
+// newSpanSetQuery builds the span set query for a search. A TraceQL filter
+// selects the spans matching any of its spansets and reports the attributes
+// it refers to; otherwise spans match the service and operation searched
+// for, if any. service.name is reported for every span.
+func newSpanSetQuery(filter *tracestore.TraceFilter, serviceName, spanName string, perTrace int) spanSetQuery {
+	sq := spanSetQuery{perTrace: perTrace}
+	seen := map[string]bool{"service.name": true}
+	sq.fields = append(sq.fields, tracestore.SpanField{Scope: tracestore.ScopeResource, Name: "service.name"})
+	sq.keys = append(sq.keys, "service.name")
+	if filter != nil {
+		sq.condition = spanSetCondition(filter)
+		forEachSpanField(filter, func(field tracestore.SpanField) {
+			if field.Scope == tracestore.ScopeIntrinsic && (field.Name == "name" || field.Name == "duration") {
+				return
+			}
+			if !seen[field.Name] {
+				seen[field.Name] = true
+				sq.fields = append(sq.fields, field)
+				sq.keys = append(sq.keys, field.Name)
+			}
+		})
+		return sq
+	}
+
+	eq := func(scope tracestore.FieldScope, name, value string) *tracestore.SpanCondition {
+		return &tracestore.SpanCondition{Field: tracestore.SpanField{Scope: scope, Name: name}, Compare: tracestore.CompareEq, Value: value}
+	}
+	switch {
+	case serviceName != "" && spanName != "":
+		sq.condition = &tracestore.SpanCondition{Op: tracestore.OpAnd,
+			Left:  eq(tracestore.ScopeResource, "service.name", serviceName),
+			Right: eq(tracestore.ScopeIntrinsic, "name", spanName)}
+	case serviceName != "":
+		sq.condition = eq(tracestore.ScopeResource, "service.name", serviceName)
+	case spanName != "":
+		sq.condition = eq(tracestore.ScopeIntrinsic, "name", spanName)
+	}
+	return sq
+}
+
+// spanSetCondition returns a condition matching the spans that satisfy any
+// spanset of f, or nil when one of them matches every span
+func spanSetCondition(f *tracestore.TraceFilter) *tracestore.SpanCondition {
+	if f.Op == "" {
+		return f.Spanset
+	}
+	left, right := spanSetCondition(f.Left), spanSetCondition(f.Right)
+	if left == nil || right == nil {
+		return nil
+	}
+	return &tracestore.SpanCondition{Op: tracestore.OpOr, Left: left, Right: right}
+}
+
+// forEachSpanField calls fn for every field compared in f, in query order
+func forEachSpanField(f *tracestore.TraceFilter, fn func(tracestore.SpanField)) {
+	var walk func(c *tracestore.SpanCondition)
+	walk = func(c *tracestore.SpanCondition) {
+		if c == nil {
+			return
+		}
+		if c.Op != "" {
+			walk(c.Left)
+			walk(c.Right)
+			return
+		}
+		fn(c.Field)
+	}
+	if f.Op != "" {
+		forEachSpanField(f.Left, fn)
+		forEachSpanField(f.Right, fn)
+		return
+	}
+	walk(f.Spanset)
+}
+
+// matchSpanSets returns the spans of each trace in traces matching sq,
+// keyed by trace ID
+func (e *sqliteExporter) matchSpanSets(ctx context.Context, sq spanSetQuery, traces []tracestore.TraceSummary, tr timeRange) (map[string]*tracestore.SpanSet, error) {
+	ids := make([]string, 0, len(traces))
+	for _, t := range traces {
+		ids = append(ids, t.TraceID)
+	}
+	return e.store.MatchSpanSets(ctx, tracestore.SpanSetOptions{
+		TraceIDs:     ids,
+		Condition:    sq.condition,
+		Fields:       sq.fields,
+		MinStartTime: tr.startNs(),
+		MaxStartTime: tr.endNs(),
+		PerTrace:     sq.perTrace,
+	})
+}
+
+// searchSpanSets returns the Tempo spanSets of each trace in traces, keyed by
+// trace ID
+func (e *sqliteExporter) searchSpanSets(ctx context.Context, sq spanSetQuery, traces []tracestore.TraceSummary, tr timeRange) (map[string][]map[string]interface{}, error) {
+	sets, err := e.matchSpanSets(ctx, sq, traces, tr)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string][]map[string]interface{}, len(sets))
+	for traceID, set := range sets {
+		spans := make([]map[string]interface{}, 0, len(set.Spans))
+		for _, s := range set.Spans {
+			attributes := make([]map[string]interface{}, 0, len(s.Values))
+			for i, v := range s.Values {
+				if v == nil {
+					continue
+				}
+				attributes = append(attributes, map[string]interface{}{"key": sq.keys[i], "value": spanSetValue(sq.fields[i], v)})
+			}
+			spans = append(spans, map[string]interface{}{
+				"spanID":            s.SpanID,
+				"name":              s.Name,
+				"startTimeUnixNano": strconv.FormatInt(s.StartTimeUnixNano, 10),
+				"durationNanos":     strconv.FormatInt(s.DurationNanos, 10),
+				"attributes":        attributes,
+			})
+		}
+		out[traceID] = []map[string]interface{}{{"spans": spans, "matched": set.Matched}}
+	}
+	return out, nil
+}
+
+// spanSetValue renders a span set attribute value as an OTLP AnyValue in
+// JSON
+func spanSetValue(field tracestore.SpanField, v interface{}) map[string]interface{} {
+	return traceQLLabel{value: spanSetAttribute(field, v)}.anyValue()
+}
+
+// spanSetAttribute returns the value reported for a span set attribute; the
+// status intrinsic is reported by name, as in TraceQL
+func spanSetAttribute(field tracestore.SpanField, v interface{}) interface{} {
+	if code, ok := v.(int64); ok && field.Scope == tracestore.ScopeIntrinsic && field.Name == "status" {
+		for name, c := range traceQLStatuses {
+			if c == code {
+				return name
+			}
+		}
+	}
+	return v
+}
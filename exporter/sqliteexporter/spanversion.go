@@ -0,0 +1,117 @@
+package sqliteexporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// spanDocVersion is the generation of the span document spanDocument
+// builds, stored in its "v" field. Documents without one are generation 0.
+// Bump it together with a new spanDocUpgrades step whenever the document
+// changes shape, so existing databases keep reading correctly.
+const spanDocVersion = 1
+
+// spanUpgradeBatchSize is the number of span rows examined per transaction
+// by the background rewriter.
+const spanUpgradeBatchSize = 500
+
+// spanDocUpgrades[i] upgrades a generation i document to generation i+1.
+var spanDocUpgrades = []func(doc map[string]interface{}){
+	upgradeSpanDocV0,
+}
+
+// upgradeSpanDocV0 fills in the fields spanDocument always writes but
+// unversioned documents may lack (rows from older importers or hand-built
+// ones), which readers and the span filters' json_extract expressions
+// expect to be there.
+func upgradeSpanDocV0(doc map[string]interface{}) {
+	if _, ok := doc["kind"]; !ok {
+		doc["kind"] = "Unspecified"
+	}
+	status, ok := doc["status"].(map[string]interface{})
+	if !ok {
+		status = make(map[string]interface{})
+		doc["status"] = status
+	}
+	if _, ok := status["code"]; !ok {
+		status["code"] = 0
+	}
+	if _, ok := status["message"]; !ok {
+		status["message"] = ""
+	}
+	if _, ok := doc["duration_ms"]; !ok {
+		durationMs := float64(docInt(doc["end_time_unix_nano"])-docInt(doc["start_time_unix_nano"])) / 1e6
+		if durationMs < 0 {
+			durationMs = 0
+		}
+		doc["duration_ms"] = durationMs
+	}
+}
+
+// upgradeSpanDocument is the store's SpanUpgrader: it runs the upgrade steps
+// from the document's generation up to spanDocVersion. Documents from a newer
+// generation are returned as they are, since readers ignore fields they do
+// not know.
+func upgradeSpanDocument(raw json.RawMessage) (json.RawMessage, bool, error) {
+	var version struct {
+		V int `json:"v"`
+	}
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return raw, false, err
+	}
+	if version.V >= spanDocVersion {
+		return raw, false, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return raw, false, err
+	}
+	for _, upgrade := range spanDocUpgrades[version.V:] {
+		upgrade(doc)
+	}
+	doc["v"] = spanDocVersion
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return raw, false, err
+	}
+	return upgraded, true, nil
+}
+
+// runSpanUpgrade rewrites span documents from older generations in the
+// background, in batches, until it has caught up or shutdown. Old documents
+// read before then are upgraded on the fly.
+func (e *sqliteExporter) runSpanUpgrade() {
+	defer e.wg.Done()
+
+	start := time.Now()
+	lastID := int64(-1)
+	var upgraded, skipped int
+	for e.cleanupCtx.Err() == nil {
+		res, err := e.store.UpgradeSpans(e.cleanupCtx, spanDocVersion, spanUpgradeBatchSize)
+		if err != nil {
+			if e.cleanupCtx.Err() == nil {
+				e.logger.Error("Span document upgrade failed", zap.Error(err))
+			}
+			return
+		}
+		if res.LastID == lastID {
+			if upgraded > 0 || skipped > 0 {
+				e.logger.Info("Span document upgrade complete",
+					zap.Int("version", spanDocVersion),
+					zap.Int("upgraded", upgraded),
+					zap.Int("skipped", skipped),
+					zap.Duration("elapsed", time.Since(start)))
+			}
+			return
+		}
+		lastID = res.LastID
+		upgraded += res.Converted
+		skipped += res.Skipped
+	}
+}
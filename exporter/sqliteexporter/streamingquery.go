@@ -0,0 +1,298 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// streamingQuerier is the subset of Tempo's tempopb.StreamingQuerier gotel
+// implements: search and tag value listing, each streamed in batches.
+type streamingQuerier interface {
+	Search(req *tempoSearchRequest, stream grpc.ServerStream) error
+	SearchTagValues(req *tempoSearchTagValuesRequest, stream grpc.ServerStream) error
+	SearchTagValuesV2(req *tempoSearchTagValuesRequest, stream grpc.ServerStream) error
+}
+
+var streamingQuerierServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tempopb.StreamingQuerier",
+	HandlerType: (*streamingQuerier)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Search",
+			Handler:       streamingSearchHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SearchTagValues",
+			Handler:       streamingSearchTagValuesHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SearchTagValuesV2",
+			Handler:       streamingSearchTagValuesV2Handler,
+			ServerStreams: true,
+		},
+	},
+}
+
+func streamingSearchHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(tempoSearchRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(streamingQuerier).Search(req, stream)
+}
+
+func streamingSearchTagValuesHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(tempoSearchTagValuesRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(streamingQuerier).SearchTagValues(req, stream)
+}
+
+func streamingSearchTagValuesV2Handler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(tempoSearchTagValuesRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(streamingQuerier).SearchTagValuesV2(req, stream)
+}
+
+// streamingQueryService serves the streaming query API from the exporter's
+// store. It is mounted on the query server's mux, behind the same auth and
+// tenant middleware as the HTTP API; the tenant travels in the stream's
+// context.
+type streamingQueryService struct {
+	e *sqliteExporter
+}
+
+// newStreamingQueryServer returns the gRPC server mounted on the query port
+// when streaming_query is enabled
+func newStreamingQueryServer(e *sqliteExporter) *grpc.Server {
+	server := grpc.NewServer(grpc.ForceServerCodec(tempoCodec{}))
+	server.RegisterService(&streamingQuerierServiceDesc, &streamingQueryService{e: e})
+	return server
+}
+
+// Search pages through the matching traces batch_size at a time, sending
+// each page as it is read. Every message carries only traces not sent
+// before, as Tempo's streaming search does, with metrics counting the traces
+// sent so far.
+func (s *streamingQueryService) Search(req *tempoSearchRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	opts, sq, tr, err := s.e.streamingSearchOptions(req)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	limit := opts.Limit
+	batch := s.e.config.StreamingQuery.BatchSize
+	var jobs uint32
+	// Traces arriving while the search runs shift later pages, so a trace
+	// can be read twice
+	sent := make(map[string]bool)
+	for offset := 0; ; offset += batch {
+		opts.Offset = offset
+		opts.Limit = min(batch, limit-offset)
+		traces, err := s.e.store.SearchTraces(ctx, opts)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to search traces: %v", err)
+		}
+		sets, err := s.e.matchSpanSets(ctx, sq, traces, tr)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to match spans: %v", err)
+		}
+
+		resp := &tempoSearchResponse{}
+		for _, t := range traces {
+			if sent[t.TraceID] {
+				continue
+			}
+			sent[t.TraceID] = true
+			resp.Traces = append(resp.Traces, streamingSearchMetadata(t, sets[t.TraceID], sq))
+		}
+		done := len(traces) < opts.Limit || offset+opts.Limit >= limit
+		jobs++
+		resp.Metrics = &tempoSearchMetrics{InspectedTraces: uint32(len(sent)), CompletedJobs: jobs, TotalJobs: jobs}
+		if !done {
+			resp.Metrics.TotalJobs++
+		}
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// streamingSearchOptions reads a search request as handleSearchTraces reads
+// its parameters: the service.name and status tags filter on the trace,
+// other tags on span attributes, and Query is TraceQL.
+func (e *sqliteExporter) streamingSearchOptions(req *tempoSearchRequest) (tracestore.TraceSearchOptions, spanSetQuery, timeRange, error) {
+	var opts tracestore.TraceSearchOptions
+	var tr timeRange
+
+	var statusTag string
+	for key, value := range req.Tags {
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch key {
+		case "service.name", "resource.service.name":
+			if value != "*" && value != ".*" {
+				opts.ServiceName = value
+			}
+		case "status":
+			statusTag = value
+		default:
+			if strings.ContainsAny(key, `"\`) {
+				return opts, spanSetQuery{}, tr, fmt.Errorf("invalid attribute key %q", key)
+			}
+			if opts.Attributes == nil {
+				opts.Attributes = make(map[string]string)
+			}
+			opts.Attributes[key] = value
+		}
+	}
+	traceStatus, err := parseTraceStatus(statusTag)
+	if err != nil {
+		return opts, spanSetQuery{}, tr, err
+	}
+	opts.Status = traceStatus
+
+	if query := strings.TrimSpace(req.Query); query != "" {
+		if opts.Filter, err = parseTraceQL(query); err != nil {
+			return opts, spanSetQuery{}, tr, fmt.Errorf("invalid TraceQL query: %w", err)
+		}
+	}
+
+	if req.MinDurationMs > 0 && req.MaxDurationMs > 0 && req.MaxDurationMs < req.MinDurationMs {
+		return opts, spanSetQuery{}, tr, fmt.Errorf("MaxDurationMs %d is below MinDurationMs %d", req.MaxDurationMs, req.MinDurationMs)
+	}
+	opts.MinDurationNs = int64(req.MinDurationMs) * int64(time.Millisecond)
+	opts.MaxDurationNs = int64(req.MaxDurationMs) * int64(time.Millisecond)
+
+	if req.Start > 0 {
+		tr.from = time.Unix(int64(req.Start), 0)
+	}
+	if req.End > 0 {
+		tr.until = time.Unix(int64(req.End), 0)
+	}
+	if tr, err = withDefaultLookback(tr, url.Values{}, e.config.DefaultLookback, time.Now()); err != nil {
+		return opts, spanSetQuery{}, tr, err
+	}
+	opts.MinStartTime, opts.MaxStartTime = tr.startNs(), tr.endNs()
+
+	opts.Limit = clampLimit(int(req.Limit), 20)
+	perTrace := clampLimit(int(req.SpansPerSpanSet), defaultSpansPerSpanSet)
+	return opts, newSpanSetQuery(opts.Filter, opts.ServiceName, "", perTrace), tr, nil
+}
+
+// streamingSearchMetadata converts a search result and its matched spans to
+// tempopb.TraceSearchMetadata
+func streamingSearchMetadata(t tracestore.TraceSummary, set *tracestore.SpanSet, sq spanSetQuery) *tempoTraceSearchMetadata {
+	meta := &tempoTraceSearchMetadata{
+		TraceID:           t.TraceID,
+		RootServiceName:   t.RootServiceName,
+		RootTraceName:     t.RootTraceName,
+		StartTimeUnixNano: uint64(t.StartTimeUnixNano),
+		DurationMs:        uint32(t.DurationMs),
+	}
+	if set == nil {
+		return meta
+	}
+	spanSet := &tempoSpanSet{Matched: uint32(set.Matched)}
+	for _, s := range set.Spans {
+		span := &tempoSpan{
+			SpanID:            s.SpanID,
+			Name:              s.Name,
+			StartTimeUnixNano: uint64(s.StartTimeUnixNano),
+			DurationNanos:     uint64(s.DurationNanos),
+		}
+		for i, v := range s.Values {
+			if v != nil {
+				span.Attributes = append(span.Attributes, tempoKeyValue{Key: sq.keys[i], Value: spanSetAttribute(sq.fields[i], v)})
+			}
+		}
+		spanSet.Spans = append(spanSet.Spans, span)
+	}
+	meta.SpanSets = []*tempoSpanSet{spanSet}
+	return meta
+}
+
+// SearchTagValues streams the values of a tag, batch_size per message
+func (s *streamingQueryService) SearchTagValues(req *tempoSearchTagValuesRequest, stream grpc.ServerStream) error {
+	return s.streamTagValues(req, stream, func(values []string) interface{} {
+		return &tempoSearchTagValuesResponse{TagValues: values}
+	})
+}
+
+// SearchTagValuesV2 streams the values of a tag as typed values, batch_size
+// per message
+func (s *streamingQueryService) SearchTagValuesV2(req *tempoSearchTagValuesRequest, stream grpc.ServerStream) error {
+	return s.streamTagValues(req, stream, func(values []string) interface{} {
+		typed := make([]tempoTagValue, 0, len(values))
+		for _, v := range values {
+			typed = append(typed, tempoTagValue{Type: "string", Value: v})
+		}
+		return &tempoSearchTagValuesV2Response{TagValues: typed}
+	})
+}
+
+// streamTagValues lists the values of req.TagName as the HTTP tag values
+// endpoints do (see tagValues) and sends them in batches built by message.
+// A query of the form { resource.service.name = "x" } limits span names to
+// service x, like the HTTP endpoints' service parameter.
+func (s *streamingQueryService) streamTagValues(req *tempoSearchTagValuesRequest, stream grpc.ServerStream, message func([]string) interface{}) error {
+	var tr timeRange
+	if req.Start > 0 {
+		tr.from = time.Unix(int64(req.Start), 0)
+	}
+	if req.End > 0 {
+		tr.until = time.Unix(int64(req.End), 0)
+	}
+	tag := strings.TrimPrefix(req.TagName, ".")
+	values, ok, err := s.e.tagValues(stream.Context(), tag, streamingTagValuesService(req.Query), tr)
+	if !ok {
+		return status.Errorf(codes.NotFound, "unsupported tag %q", req.TagName)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list tag values: %v", err)
+	}
+
+	batch := s.e.config.StreamingQuery.BatchSize
+	for start := 0; start == 0 || start < len(values); start += batch {
+		end := min(start+batch, len(values))
+		if err := stream.SendMsg(message(values[start:end])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamingTagValuesService returns the service a tag values query is
+// limited to, if it compares only the service name for equality
+func streamingTagValuesService(query string) string {
+	if strings.TrimSpace(query) == "" {
+		return ""
+	}
+	filter, err := parseTraceQL(query)
+	if err != nil || filter.Op != "" || filter.Spanset == nil {
+		return ""
+	}
+	c := filter.Spanset
+	if c.Op != "" || c.Compare != tracestore.CompareEq || c.Field.Name != "service.name" ||
+		(c.Field.Scope != tracestore.ScopeResource && c.Field.Scope != tracestore.ScopeAny) {
+		return ""
+	}
+	service, _ := c.Value.(string)
+	return service
+}
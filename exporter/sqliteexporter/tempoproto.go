@@ -0,0 +1,337 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Tempo's streaming query messages, encoded with protowire so the service
+// does not need generated tempopb stubs. Field numbers follow Tempo's
+// pkg/tempopb/tempo.proto; fields gotel does not read are skipped and fields
+// it does not fill are left out.
+
+// tempoCodec is the gRPC codec of the streaming query service. It takes the
+// proto name so clients using generated stubs interoperate.
+type tempoCodec struct{}
+
+func (tempoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(protoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return m.appendProto(nil), nil
+}
+
+func (tempoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(protoUnmarshaler)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T", v)
+	}
+	return m.unmarshalProto(data)
+}
+
+func (tempoCodec) Name() string { return "proto" }
+
+type protoMarshaler interface {
+	appendProto(b []byte) []byte
+}
+
+type protoUnmarshaler interface {
+	unmarshalProto(b []byte) error
+}
+
+// tempoSearchRequest is tempopb.SearchRequest. Start and End are Unix
+// seconds.
+type tempoSearchRequest struct {
+	Tags            map[string]string
+	MinDurationMs   uint32
+	MaxDurationMs   uint32
+	Limit           uint32
+	Start           uint32
+	End             uint32
+	Query           string
+	SpansPerSpanSet uint32
+}
+
+func (m *tempoSearchRequest) unmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			var key, value string
+			err := consumeProtoFields(f.bytes, func(entry protoField) error {
+				if entry.typ == protowire.BytesType && entry.num == 1 {
+					key = string(entry.bytes)
+				} else if entry.typ == protowire.BytesType && entry.num == 2 {
+					value = string(entry.bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if m.Tags == nil {
+				m.Tags = make(map[string]string)
+			}
+			m.Tags[key] = value
+		case f.num == 8 && f.typ == protowire.BytesType:
+			m.Query = string(f.bytes)
+		case f.typ == protowire.VarintType:
+			switch f.num {
+			case 2:
+				m.MinDurationMs = uint32(f.varint)
+			case 3:
+				m.MaxDurationMs = uint32(f.varint)
+			case 4:
+				m.Limit = uint32(f.varint)
+			case 5:
+				m.Start = uint32(f.varint)
+			case 6:
+				m.End = uint32(f.varint)
+			case 9:
+				m.SpansPerSpanSet = uint32(f.varint)
+			}
+		}
+		return nil
+	})
+}
+
+// tempoSearchResponse is tempopb.SearchResponse
+type tempoSearchResponse struct {
+	Traces  []*tempoTraceSearchMetadata
+	Metrics *tempoSearchMetrics
+}
+
+func (m *tempoSearchResponse) appendProto(b []byte) []byte {
+	for _, t := range m.Traces {
+		b = appendProtoMessage(b, 1, t)
+	}
+	if m.Metrics != nil {
+		b = appendProtoMessage(b, 2, m.Metrics)
+	}
+	return b
+}
+
+// tempoTraceSearchMetadata is tempopb.TraceSearchMetadata
+type tempoTraceSearchMetadata struct {
+	TraceID           string
+	RootServiceName   string
+	RootTraceName     string
+	StartTimeUnixNano uint64
+	DurationMs        uint32
+	SpanSets          []*tempoSpanSet
+}
+
+func (m *tempoTraceSearchMetadata) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, m.TraceID)
+	b = appendProtoString(b, 2, m.RootServiceName)
+	b = appendProtoString(b, 3, m.RootTraceName)
+	b = appendProtoVarint(b, 4, m.StartTimeUnixNano)
+	b = appendProtoVarint(b, 5, uint64(m.DurationMs))
+	// spanSet (6) is the deprecated single form, still read by older Grafana
+	if len(m.SpanSets) > 0 {
+		b = appendProtoMessage(b, 6, m.SpanSets[0])
+	}
+	for _, s := range m.SpanSets {
+		b = appendProtoMessage(b, 7, s)
+	}
+	return b
+}
+
+// tempoSpanSet is tempopb.SpanSet
+type tempoSpanSet struct {
+	Spans   []*tempoSpan
+	Matched uint32
+}
+
+func (m *tempoSpanSet) appendProto(b []byte) []byte {
+	for _, s := range m.Spans {
+		b = appendProtoMessage(b, 1, s)
+	}
+	return appendProtoVarint(b, 2, uint64(m.Matched))
+}
+
+// tempoSpan is tempopb.Span
+type tempoSpan struct {
+	SpanID            string
+	Name              string
+	StartTimeUnixNano uint64
+	DurationNanos     uint64
+	Attributes        []tempoKeyValue
+}
+
+func (m *tempoSpan) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, m.SpanID)
+	b = appendProtoString(b, 2, m.Name)
+	b = appendProtoVarint(b, 3, m.StartTimeUnixNano)
+	b = appendProtoVarint(b, 4, m.DurationNanos)
+	for i := range m.Attributes {
+		b = appendProtoMessage(b, 5, &m.Attributes[i])
+	}
+	return b
+}
+
+// tempoKeyValue is an OTLP KeyValue; Value is a string, int64, float64 or
+// bool
+type tempoKeyValue struct {
+	Key   string
+	Value interface{}
+}
+
+func (m *tempoKeyValue) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, m.Key)
+	var value []byte
+	switch v := m.Value.(type) {
+	case int64:
+		value = protowire.AppendTag(value, 3, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(v))
+	case float64:
+		value = protowire.AppendTag(value, 4, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(v))
+	case bool:
+		value = protowire.AppendTag(value, 2, protowire.VarintType)
+		value = protowire.AppendVarint(value, protowire.EncodeBool(v))
+	default:
+		value = protowire.AppendTag(value, 1, protowire.BytesType)
+		value = protowire.AppendString(value, fmt.Sprint(v))
+	}
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// tempoSearchMetrics is tempopb.SearchMetrics
+type tempoSearchMetrics struct {
+	InspectedTraces uint32
+	CompletedJobs   uint32
+	TotalJobs       uint32
+}
+
+func (m *tempoSearchMetrics) appendProto(b []byte) []byte {
+	b = appendProtoVarint(b, 1, uint64(m.InspectedTraces))
+	b = appendProtoVarint(b, 4, uint64(m.CompletedJobs))
+	return appendProtoVarint(b, 5, uint64(m.TotalJobs))
+}
+
+// tempoSearchTagValuesRequest is tempopb.SearchTagValuesRequest. Start and
+// End are Unix seconds.
+type tempoSearchTagValuesRequest struct {
+	TagName string
+	Query   string
+	Start   uint32
+	End     uint32
+}
+
+func (m *tempoSearchTagValuesRequest) unmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			m.TagName = string(f.bytes)
+		case f.num == 2 && f.typ == protowire.BytesType:
+			m.Query = string(f.bytes)
+		case f.num == 4 && f.typ == protowire.VarintType:
+			m.Start = uint32(f.varint)
+		case f.num == 5 && f.typ == protowire.VarintType:
+			m.End = uint32(f.varint)
+		}
+		return nil
+	})
+}
+
+// tempoSearchTagValuesResponse is tempopb.SearchTagValuesResponse
+type tempoSearchTagValuesResponse struct {
+	TagValues []string
+}
+
+func (m *tempoSearchTagValuesResponse) appendProto(b []byte) []byte {
+	for _, v := range m.TagValues {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+// tempoSearchTagValuesV2Response is tempopb.SearchTagValuesV2Response
+type tempoSearchTagValuesV2Response struct {
+	TagValues []tempoTagValue
+}
+
+func (m *tempoSearchTagValuesV2Response) appendProto(b []byte) []byte {
+	for i := range m.TagValues {
+		b = appendProtoMessage(b, 1, &m.TagValues[i])
+	}
+	return b
+}
+
+// tempoTagValue is tempopb.TagValue
+type tempoTagValue struct {
+	Type  string
+	Value string
+}
+
+func (m *tempoTagValue) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, m.Type)
+	return appendProtoString(b, 2, m.Value)
+}
+
+// protoField is one field read by consumeProtoFields: varint holds varint
+// values and bytes length-delimited ones
+type protoField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	bytes  []byte
+}
+
+// consumeProtoFields calls fn for each field of the encoded message b
+func consumeProtoFields(b []byte, fn func(protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendProtoString appends a string field, omitted when empty as proto3
+// does
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendProtoVarint appends a varint field, omitted when zero as proto3 does
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendProtoMessage appends m as an embedded message field
+func appendProtoMessage(b []byte, num protowire.Number, m protoMarshaler) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.appendProto(nil))
+}
@@ -0,0 +1,134 @@
+package sqliteexporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/collector/client"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// maxTenantLength bounds tenant IDs, as in Cortex and Tempo
+const maxTenantLength = 150
+
+// tenantUnaware lists query API paths backed by data that is not stored per
+// tenant (service graph edges, self-time rollups, incidents, logs and the
+// slow batch log, whose batches can mix tenants). With tenancy enabled they
+// are refused rather than showing every tenant's data. Paths ending in "/"
+// cover everything below them; the others are matched exactly.
+var tenantUnaware = []string{
+	"/api/dependencies",
+	"/api/self-time",
+	"/api/incidents",
+	"/api/status/slow-ingest",
+	"/loki/",
+}
+
+// isTenantUnaware reports whether path is one of tenantUnaware
+func isTenantUnaware(path string) bool {
+	for _, p := range tenantUnaware {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTenant accepts the tenant IDs Tempo does: up to 150 letters,
+// digits and !-_.*'() characters, other than "." and ".."
+func validateTenant(tenant string) error {
+	if len(tenant) > maxTenantLength {
+		return fmt.Errorf("tenant is longer than %d characters", maxTenantLength)
+	}
+	if tenant == "." || tenant == ".." {
+		return fmt.Errorf("tenant %q is not allowed", tenant)
+	}
+	for _, r := range tenant {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!-_.*'()", r):
+		default:
+			return fmt.Errorf("tenant %q has invalid character %q", tenant, r)
+		}
+	}
+	return nil
+}
+
+// metadataTenant returns the tenant header of the OTLP request that
+// delivered ctx's batch. The receiver only passes headers on with
+// include_metadata, and processors that regroup batches drop them unless
+// configured to keep the header (see docs/configuration.md).
+func (e *sqliteExporter) metadataTenant(ctx context.Context) string {
+	if !e.config.Tenancy.Enabled {
+		return ""
+	}
+	if values := client.FromContext(ctx).Metadata.Get(e.config.Tenancy.Header); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// resourceTenant returns the tenant of a resource's telemetry: the request
+// header if there was one, otherwise the resource_attribute value, otherwise
+// the default tenant ""
+func (e *sqliteExporter) resourceTenant(headerTenant string, resource pcommon.Resource) (string, error) {
+	if !e.config.Tenancy.Enabled {
+		return "", nil
+	}
+	tenant := headerTenant
+	if tenant == "" && e.config.Tenancy.ResourceAttribute != "" {
+		if v, ok := resource.Attributes().Get(e.config.Tenancy.ResourceAttribute); ok {
+			tenant = v.AsString()
+		}
+	}
+	if err := validateTenant(tenant); err != nil {
+		return "", err
+	}
+	return tenant, nil
+}
+
+// tagTenant sets the tenant tag of a metric point. With tenancy enabled it
+// always overrides a tenant attribute or hook tag, so telemetry cannot
+// place points in another tenant.
+func (e *sqliteExporter) tagTenant(tags map[string]string, tenant string) {
+	if !e.config.Tenancy.Enabled {
+		return
+	}
+	if tenant == "" {
+		delete(tags, "tenant")
+	} else {
+		tags["tenant"] = tenant
+	}
+}
+
+// tenantMiddleware scopes query API requests to the tenant in their header,
+// or to the default tenant without one. It runs inside authMiddleware, so
+// the header is only trusted once the request is authenticated.
+func (e *sqliteExporter) tenantMiddleware(next http.Handler) http.Handler {
+	if !e.config.Tenancy.Enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTenantUnaware(r.URL.Path) {
+			e.writeError(w, "not available with tenancy enabled", nil, http.StatusForbidden)
+			return
+		}
+		tenant := r.Header.Get(e.config.Tenancy.Header)
+		if err := validateTenant(tenant); err != nil {
+			e.writeError(w, "invalid tenant", err, http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(tracestore.WithTenant(r.Context(), tenant)))
+	})
+}
+
+// tenantScoped reports whether ctx reads a single tenant's data, in which
+// case the service catalog, which covers every tenant, is bypassed
+func tenantScoped(ctx context.Context) bool {
+	_, ok := tracestore.TenantFromContext(ctx)
+	return ok
+}
@@ -0,0 +1,65 @@
+package sqliteexporter
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// handleTextSearch greps span names, status messages and exception events
+// for the phrase in q, newest first. Returns 501 when the binary was built
+// without FTS5.
+func (e *sqliteExporter) handleTextSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	text := strings.TrimSpace(q.Get("q"))
+	if text == "" {
+		e.writeError(w, "missing q", errors.New("q is required"), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimit(q, 100)
+	if err != nil {
+		e.writeError(w, "invalid limit", err, http.StatusBadRequest)
+		return
+	}
+	tr, err := parseTimeRange(q, time.Now())
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+
+	matches, err := e.store.SearchText(r.Context(), tracestore.TextSearchOptions{
+		Query:        text,
+		ServiceName:  strings.TrimSpace(q.Get("service")),
+		MinStartTime: tr.startNs(),
+		MaxStartTime: tr.endNs(),
+		Limit:        limit,
+	})
+	if errors.Is(err, tracestore.ErrTextSearchUnavailable) {
+		e.writeError(w, "Full-text search unavailable", err, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		e.writeError(w, "Failed to search text", err, http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(matches))
+	for _, m := range matches {
+		results = append(results, map[string]interface{}{
+			"trace_id":             m.TraceID,
+			"span_id":              m.SpanID,
+			"service":              m.ServiceName,
+			"span_name":            m.SpanName,
+			"start_time_unix_nano": m.StartTimeUnixNano,
+			"status_code":          m.StatusCode,
+			"snippet":              m.Snippet,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, results)
+}
@@ -0,0 +1,209 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeRange is an optional [from, until] window parsed from query parameters.
+// A zero bound means "unbounded" on that side.
+type timeRange struct {
+	from  time.Time
+	until time.Time
+}
+
+// startNs returns the lower bound in unix nanoseconds, or 0 when unbounded.
+func (tr timeRange) startNs() int64 {
+	if tr.from.IsZero() {
+		return 0
+	}
+	return tr.from.UnixNano()
+}
+
+// endNs returns the upper bound in unix nanoseconds, or 0 when unbounded.
+func (tr timeRange) endNs() int64 {
+	if tr.until.IsZero() {
+		return 0
+	}
+	return tr.until.UnixNano()
+}
+
+// startSeconds returns the lower bound in unix seconds, or 0 when unbounded.
+func (tr timeRange) startSeconds() int64 {
+	if tr.from.IsZero() {
+		return 0
+	}
+	return tr.from.Unix()
+}
+
+// endSeconds returns the upper bound in unix seconds, or 0 when unbounded.
+func (tr timeRange) endSeconds() int64 {
+	if tr.until.IsZero() {
+		return 0
+	}
+	return tr.until.Unix()
+}
+
+// parseTimeRange reads the lower bound from "from" or "start" and the upper
+// bound from "until", "end" or "to", so Graphite and Tempo style parameters
+// are accepted on every endpoint. See parseTimeParam for the accepted formats.
+func parseTimeRange(q url.Values, now time.Time) (timeRange, error) {
+	var tr timeRange
+	var err error
+	if tr.from, err = parseTimeParam(firstNonEmpty(q, "from", "start"), now); err != nil {
+		return tr, fmt.Errorf("invalid start time: %w", err)
+	}
+	if tr.until, err = parseTimeParam(firstNonEmpty(q, "until", "end", "to"), now); err != nil {
+		return tr, fmt.Errorf("invalid end time: %w", err)
+	}
+	if !tr.from.IsZero() && !tr.until.IsZero() && tr.until.Before(tr.from) {
+		return tr, fmt.Errorf("end time is before start time")
+	}
+	return tr, nil
+}
+
+// withDefaultLookback bounds a range with no start to lookback before its
+// end, or before now when it has none. A request can opt out with all=true.
+// A zero lookback leaves the range as it is.
+func withDefaultLookback(tr timeRange, q url.Values, lookback time.Duration, now time.Time) (timeRange, error) {
+	if v := strings.TrimSpace(q.Get("all")); v != "" {
+		all, err := strconv.ParseBool(v)
+		if err != nil {
+			return tr, fmt.Errorf("invalid all value: %w", err)
+		}
+		if all {
+			return tr, nil
+		}
+	}
+	if lookback <= 0 || !tr.from.IsZero() {
+		return tr, nil
+	}
+	end := tr.until
+	if end.IsZero() {
+		end = now
+	}
+	tr.from = end.Add(-lookback)
+	return tr, nil
+}
+
+func firstNonEmpty(q url.Values, keys ...string) string {
+	for _, k := range keys {
+		if v := strings.TrimSpace(q.Get(k)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseTimeParam parses a single time value. Accepted formats:
+//   - unix epoch in seconds, milliseconds, microseconds or nanoseconds, told
+//     apart by magnitude (fractional seconds are allowed)
+//   - RFC3339, e.g. 2024-01-02T15:04:05Z
+//   - Graphite's HH:MM_YYYYMMDD or YYYYMMDD, in UTC
+//   - "now", or a relative offset such as -1h, -30min, -7d, now-15m
+//
+// An empty value returns the zero time.
+func parseTimeParam(v string, now time.Time) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if v == "now" {
+		return now, nil
+	}
+
+	rel := strings.TrimPrefix(v, "now")
+	if strings.HasPrefix(rel, "-") || strings.HasPrefix(rel, "+") {
+		d, err := parseRelativeDuration(rel[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if rel[0] == '-' {
+			d = -d
+		}
+		return now.Add(d), nil
+	}
+
+	// Graphite absolute times, HH:MM_YYYYMMDD or YYYYMMDD, in UTC. As in
+	// Graphite, eight digits forming a date are a date, not an epoch (which
+	// would fall in 1970-73).
+	for _, layout := range []string{"15:04_20060102", "20060102"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if n <= 0 {
+			return time.Time{}, fmt.Errorf("%q is not a positive timestamp", v)
+		}
+		return epochToTime(n), nil
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		if f <= 0 {
+			return time.Time{}, fmt.Errorf("%q is not a positive timestamp", v)
+		}
+		return time.Unix(0, int64(f*float64(time.Second))), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", v)
+}
+
+// epochToTime interprets n as seconds, milliseconds, microseconds or
+// nanoseconds depending on its magnitude. Any value below 1e11 is seconds
+// (up to year 5138); the larger units follow at factors of 1000.
+func epochToTime(n int64) time.Time {
+	switch {
+	case n < 1e11:
+		return time.Unix(n, 0)
+	case n < 1e14:
+		return time.UnixMilli(n)
+	case n < 1e17:
+		return time.UnixMicro(n)
+	default:
+		return time.Unix(0, n)
+	}
+}
+
+// relativeUnits maps Graphite/Grafana style unit suffixes to durations.
+// As in Graphite, "m" is minutes, months are "mon" and count 30 days, and
+// years count 365 days.
+var relativeUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	"mon": 30 * 24 * time.Hour, "month": 30 * 24 * time.Hour, "months": 30 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour, "year": 365 * 24 * time.Hour, "years": 365 * 24 * time.Hour,
+}
+
+// parseRelativeDuration parses "<n><unit>", e.g. 15m, 1hours, 7d.
+func parseRelativeDuration(s string) (time.Duration, error) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("relative time %q has no amount", s)
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, err
+	}
+	unit, ok := relativeUnits[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("relative time %q has unknown unit %q", s, s[i:])
+	}
+	if int64(n) > math.MaxInt64/int64(unit) {
+		return 0, fmt.Errorf("relative time %q is out of range", s)
+	}
+	return time.Duration(n) * unit, nil
+}
@@ -0,0 +1,372 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+// parseTraceQL translates a TraceQL query into a store filter. Supported:
+//
+//   - spansets { ... } joined with && and ||, and grouped with parentheses
+//   - inside a spanset, comparisons joined with && and || and parentheses
+//   - intrinsics name, status, duration, kind and statusMessage
+//   - span.<attr>, resource.<attr> and unscoped .<attr> attributes
+//   - operators = != > >= < <= =~ !~ (regexes match the whole value)
+//   - string, integer, float, boolean, duration (100ms, 1.5s) and
+//     status/kind enum values
+//
+// Structural operators (>>, >, ~), pipelines (| count() > 1) and aggregates
+// are rejected. An empty query matches every trace.
+func parseTraceQL(query string) (*tracestore.TraceFilter, error) {
+	tokens, err := lexTraceQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &traceQLParser{tokens: tokens}
+	if p.peek().kind == tqlEOF {
+		return &tracestore.TraceFilter{}, nil
+	}
+	filter, err := p.traceExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tqlEOF {
+		if tok.text == "|" {
+			return nil, fmt.Errorf("TraceQL pipelines are not supported")
+		}
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return filter, nil
+}
+
+type traceQLTokenKind int
+
+const (
+	tqlEOF traceQLTokenKind = iota
+	tqlPunct
+	tqlIdent
+	tqlString
+	tqlNumber
+)
+
+type traceQLToken struct {
+	kind traceQLTokenKind
+	text string
+	pos  int
+}
+
+// traceQLPunct lists operators and delimiters, longest first
+var traceQLPunct = []string{"&&", "||", ">=", "<=", "!=", "=~", "!~", ">>", "{", "}", "(", ")", "=", ">", "<", "|", "~", "!", ","}
+
+func lexTraceQL(query string) ([]traceQLToken, error) {
+	var tokens []traceQLToken
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '`':
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if c == '"' && query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			value, err := strconv.Unquote(query[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %w", i, err)
+			}
+			tokens = append(tokens, traceQLToken{kind: tqlString, text: value, pos: i})
+			i = end + 1
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(query) && (isTraceQLIdentChar(query[end]) || query[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, traceQLToken{kind: tqlNumber, text: query[i:end], pos: i})
+			i = end
+		case c == '.' || c == '_' || unicode.IsLetter(rune(c)):
+			end := i + 1
+			for end < len(query) && (isTraceQLIdentChar(query[end]) || query[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, traceQLToken{kind: tqlIdent, text: query[i:end], pos: i})
+			i = end
+		default:
+			matched := false
+			for _, p := range traceQLPunct {
+				if strings.HasPrefix(query[i:], p) {
+					tokens = append(tokens, traceQLToken{kind: tqlPunct, text: p, pos: i})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(tokens, traceQLToken{kind: tqlEOF, pos: len(query)}), nil
+}
+
+func isTraceQLIdentChar(c byte) bool {
+	return c == '_' || c == '-' || c == '/' || c == ':' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type traceQLParser struct {
+	tokens []traceQLToken
+	pos    int
+}
+
+func (p *traceQLParser) peek() traceQLToken {
+	return p.tokens[p.pos]
+}
+
+func (p *traceQLParser) next() traceQLToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tqlEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is the punctuation text
+func (p *traceQLParser) accept(text string) bool {
+	if tok := p.peek(); tok.kind == tqlPunct && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *traceQLParser) expect(text string) error {
+	if p.accept(text) {
+		return nil
+	}
+	tok := p.peek()
+	if tok.kind == tqlEOF {
+		return fmt.Errorf("expected %q at end of query", text)
+	}
+	if tok.kind == tqlPunct && (tok.text == ">>" || tok.text == ">" || tok.text == "~") {
+		return fmt.Errorf("structural operator %q is not supported", tok.text)
+	}
+	return fmt.Errorf("expected %q at offset %d, got %q", text, tok.pos, tok.text)
+}
+
+// traceExpr := traceTerm ('||' traceTerm)*
+func (p *traceQLParser) traceExpr() (*tracestore.TraceFilter, error) {
+	left, err := p.traceTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.traceTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &tracestore.TraceFilter{Op: tracestore.OpOr, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// traceTerm := traceFactor ('&&' traceFactor)*
+func (p *traceQLParser) traceTerm() (*tracestore.TraceFilter, error) {
+	left, err := p.traceFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.traceFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &tracestore.TraceFilter{Op: tracestore.OpAnd, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// traceFactor := '{' [spanExpr] '}' | '(' traceExpr ')'
+func (p *traceQLParser) traceFactor() (*tracestore.TraceFilter, error) {
+	if p.accept("(") {
+		f, err := p.traceExpr()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if p.accept("}") {
+		return &tracestore.TraceFilter{}, nil
+	}
+	cond, err := p.spanExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &tracestore.TraceFilter{Spanset: cond}, p.expect("}")
+}
+
+// spanExpr := spanTerm ('||' spanTerm)*
+func (p *traceQLParser) spanExpr() (*tracestore.SpanCondition, error) {
+	left, err := p.spanTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.spanTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &tracestore.SpanCondition{Op: tracestore.OpOr, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// spanTerm := spanFactor ('&&' spanFactor)*
+func (p *traceQLParser) spanTerm() (*tracestore.SpanCondition, error) {
+	left, err := p.spanFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.spanFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &tracestore.SpanCondition{Op: tracestore.OpAnd, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// spanFactor := '(' spanExpr ')' | field op value
+func (p *traceQLParser) spanFactor() (*tracestore.SpanCondition, error) {
+	if p.accept("(") {
+		c, err := p.spanExpr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	}
+
+	tok := p.next()
+	if tok.kind != tqlIdent {
+		return nil, fmt.Errorf("expected a field at offset %d, got %q", tok.pos, tok.text)
+	}
+	field, err := parseTraceQLField(tok.text)
+	if err != nil {
+		return nil, err
+	}
+
+	opTok := p.next()
+	op := tracestore.CompareOp(opTok.text)
+	switch op {
+	case tracestore.CompareEq, tracestore.CompareNeq, tracestore.CompareGt, tracestore.CompareGte,
+		tracestore.CompareLt, tracestore.CompareLte, tracestore.CompareRegex, tracestore.CompareNotRegex:
+	default:
+		return nil, fmt.Errorf("expected a comparison after %q at offset %d", tok.text, opTok.pos)
+	}
+
+	value, err := p.traceQLValue(field)
+	if err != nil {
+		return nil, err
+	}
+	if op == tracestore.CompareRegex || op == tracestore.CompareNotRegex {
+		if _, ok := value.(string); !ok {
+			return nil, fmt.Errorf("%s needs a string pattern for %q", op, tok.text)
+		}
+	}
+	return &tracestore.SpanCondition{Field: field, Compare: op, Value: value}, nil
+}
+
+// traceQLStatuses maps TraceQL status values to OTLP status codes
+var traceQLStatuses = map[string]int64{"unset": 0, "ok": 1, "error": 2}
+
+// traceQLKinds are the TraceQL span kind values, as stored lowercased
+var traceQLKinds = map[string]bool{
+	"unspecified": true, "internal": true, "server": true, "client": true, "producer": true, "consumer": true,
+}
+
+// parseTraceQLField resolves an identifier to an intrinsic or attribute
+func parseTraceQLField(ident string) (tracestore.SpanField, error) {
+	switch {
+	case strings.HasPrefix(ident, "span."):
+		return tracestore.SpanField{Scope: tracestore.ScopeSpan, Name: ident[len("span."):]}, nil
+	case strings.HasPrefix(ident, "resource."):
+		return tracestore.SpanField{Scope: tracestore.ScopeResource, Name: ident[len("resource."):]}, nil
+	case strings.HasPrefix(ident, "."):
+		return tracestore.SpanField{Scope: tracestore.ScopeAny, Name: ident[1:]}, nil
+	}
+	switch ident {
+	case "name", "status", "duration", "kind", "statusMessage":
+		return tracestore.SpanField{Scope: tracestore.ScopeIntrinsic, Name: ident}, nil
+	case "span:name", "span:status", "span:duration", "span:kind", "span:statusMessage":
+		return tracestore.SpanField{Scope: tracestore.ScopeIntrinsic, Name: ident[len("span:"):]}, nil
+	}
+	return tracestore.SpanField{}, fmt.Errorf("unsupported field %q", ident)
+}
+
+// traceQLValue reads a comparison value, typed for the field it is compared with
+func (p *traceQLParser) traceQLValue(field tracestore.SpanField) (interface{}, error) {
+	tok := p.next()
+	intrinsic := field.Scope == tracestore.ScopeIntrinsic
+
+	switch {
+	case intrinsic && field.Name == "status":
+		code, ok := traceQLStatuses[tok.text]
+		if tok.kind != tqlIdent || !ok {
+			return nil, fmt.Errorf("status must be error, ok or unset, got %q", tok.text)
+		}
+		return code, nil
+	case intrinsic && field.Name == "kind":
+		if tok.kind != tqlIdent || !traceQLKinds[tok.text] {
+			return nil, fmt.Errorf("invalid span kind %q", tok.text)
+		}
+		return tok.text, nil
+	case intrinsic && field.Name == "duration":
+		if tok.kind != tqlNumber {
+			return nil, fmt.Errorf("duration must be compared with a duration such as 100ms, got %q", tok.text)
+		}
+		d, err := time.ParseDuration(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q: %w", tok.text, err)
+		}
+		return d.Nanoseconds(), nil
+	}
+
+	switch tok.kind {
+	case tqlString:
+		return tok.text, nil
+	case tqlNumber:
+		if n, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(tok.text, 64); err == nil {
+			return f, nil
+		}
+		if d, err := time.ParseDuration(tok.text); err == nil {
+			return d.Nanoseconds(), nil
+		}
+		return nil, fmt.Errorf("invalid number %q", tok.text)
+	case tqlIdent:
+		switch tok.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return nil, fmt.Errorf("expected a value at offset %d, got %q", tok.pos, tok.text)
+}
@@ -0,0 +1,317 @@
+package sqliteexporter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotel/pkg/tracestore"
+)
+
+const (
+	// traceQLMetricsWindow is the range a metrics query covers when neither
+	// the request nor default_lookback bounds its start
+	traceQLMetricsWindow = time.Hour
+	// traceQLMetricsPoints is the number of buckets the default step aims for
+	traceQLMetricsPoints = 100
+	// traceQLMetricsMaxPoints caps the buckets of one query, as Prometheus does
+	traceQLMetricsMaxPoints = 11000
+)
+
+// traceQLMetricsQuery is a parsed TraceQL metrics query:
+// { spanset } | function(args) [by (field, ...)]
+type traceQLMetricsQuery struct {
+	spanset   *tracestore.SpanCondition
+	function  string
+	quantiles []float64
+	by        []tracestore.SpanField
+	// byLabels are the group-by fields as written, used as series labels
+	byLabels []string
+}
+
+// parseTraceQLMetrics parses a TraceQL metrics query. Supported functions are
+// rate(), count_over_time() and quantile_over_time(duration, q, ...), over a
+// single spanset (see parseTraceQL), optionally grouped with by(...).
+func parseTraceQLMetrics(query string) (*traceQLMetricsQuery, error) {
+	tokens, err := lexTraceQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &traceQLParser{tokens: tokens}
+	filter, err := p.traceExpr()
+	if err != nil {
+		return nil, err
+	}
+	if filter.Op != "" {
+		return nil, fmt.Errorf("metrics queries take a single spanset")
+	}
+	m := &traceQLMetricsQuery{spanset: filter.Spanset}
+
+	if err := p.expect("|"); err != nil {
+		return nil, err
+	}
+	fn := p.next()
+	if fn.kind != tqlIdent {
+		return nil, fmt.Errorf("expected a metrics function at offset %d, got %q", fn.pos, fn.text)
+	}
+	m.function = fn.text
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	switch fn.text {
+	case "rate", "count_over_time":
+	case "quantile_over_time":
+		if tok := p.next(); tok.text != "duration" && tok.text != "span:duration" {
+			return nil, fmt.Errorf("quantile_over_time supports duration only, got %q", tok.text)
+		}
+		for p.accept(",") {
+			tok := p.next()
+			q, err := strconv.ParseFloat(tok.text, 64)
+			if (tok.kind != tqlNumber && tok.kind != tqlIdent) || err != nil || q < 0 || q > 1 {
+				return nil, fmt.Errorf("quantile must be a number between 0 and 1, got %q", tok.text)
+			}
+			m.quantiles = append(m.quantiles, q)
+		}
+		if len(m.quantiles) == 0 {
+			return nil, fmt.Errorf("quantile_over_time needs at least one quantile")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported metrics function %q", fn.text)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind == tqlIdent && tok.text == "by" {
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			tok := p.next()
+			if tok.kind != tqlIdent {
+				return nil, fmt.Errorf("expected a field at offset %d, got %q", tok.pos, tok.text)
+			}
+			field, err := parseTraceQLField(tok.text)
+			if err != nil {
+				return nil, err
+			}
+			m.by = append(m.by, field)
+			m.byLabels = append(m.byLabels, tok.text)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if tok := p.peek(); tok.kind != tqlEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return m, nil
+}
+
+// handleTraceQLMetricsRange implements Tempo's /api/metrics/query_range:
+// the q parameter holds a TraceQL metrics query, evaluated over spans
+// starting between start and end in buckets of step.
+func (e *sqliteExporter) handleTraceQLMetricsRange(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := strings.TrimSpace(firstNonEmpty(q, "q", "query"))
+	if query == "" {
+		e.writeError(w, "missing query", fmt.Errorf("the q parameter is required"), http.StatusBadRequest)
+		return
+	}
+	mq, err := parseTraceQLMetrics(query)
+	if err != nil {
+		e.writeError(w, "invalid TraceQL query", err, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	tr, err := parseTimeRange(q, now)
+	if err == nil {
+		tr, err = withDefaultLookback(tr, q, e.config.DefaultLookback, now)
+	}
+	if err != nil {
+		e.writeError(w, "invalid time range", err, http.StatusBadRequest)
+		return
+	}
+	if tr.until.IsZero() {
+		tr.until = now
+	}
+	if tr.from.IsZero() {
+		tr.from = tr.until.Add(-traceQLMetricsWindow)
+	}
+	step, err := parseTraceQLStep(q.Get("step"), tr.until.Sub(tr.from))
+	if err != nil {
+		e.writeError(w, "invalid step", err, http.StatusBadRequest)
+		return
+	}
+	if tr.until.Sub(tr.from)/step > traceQLMetricsMaxPoints {
+		e.writeError(w, "invalid step", fmt.Errorf("step %s gives more than %d points", step, traceQLMetricsMaxPoints), http.StatusBadRequest)
+		return
+	}
+
+	// Buckets are aligned to multiples of step, as in Tempo
+	startNs := tr.startNs() - tr.startNs()%step.Nanoseconds()
+	points, err := e.store.SpanRange(r.Context(), tracestore.SpanRangeOptions{
+		Spanset:      mq.spanset,
+		MinStartTime: startNs,
+		MaxStartTime: tr.endNs(),
+		StepNs:       step.Nanoseconds(),
+		GroupBy:      mq.by,
+		Quantiles:    mq.quantiles,
+	})
+	if err != nil {
+		e.writeError(w, "Failed to query span metrics", err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, map[string]interface{}{
+		"series":  traceQLMetricsSeries(mq, points, startNs, tr.endNs(), step),
+		"metrics": map[string]interface{}{},
+	})
+}
+
+// parseTraceQLStep reads step as a duration (30s) or a number of seconds. An
+// empty step gives about traceQLMetricsPoints buckets over the range, in
+// whole seconds.
+func parseTraceQLStep(v string, window time.Duration) (time.Duration, error) {
+	if v == "" {
+		step := (window/traceQLMetricsPoints + time.Second - 1).Truncate(time.Second)
+		if step < time.Second {
+			step = time.Second
+		}
+		return step, nil
+	}
+	step, err := time.ParseDuration(v)
+	if err != nil {
+		secs, ferr := strconv.ParseFloat(v, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("%q is not a duration", v)
+		}
+		step = time.Duration(secs * float64(time.Second))
+	}
+	if step < time.Millisecond {
+		return 0, fmt.Errorf("step must be at least 1ms, got %q", v)
+	}
+	return step, nil
+}
+
+// traceQLMetricsSeries shapes points as Tempo's query range series. rate()
+// and count_over_time() series have a sample for every bucket, zero where no
+// span matched; quantile_over_time() gives one series per quantile, labelled
+// p, in seconds, and only for buckets with spans.
+func traceQLMetricsSeries(mq *traceQLMetricsQuery, points []tracestore.SpanRangePoint, startNs, endNs int64, step time.Duration) []map[string]interface{} {
+	type series struct {
+		labels  []traceQLLabel
+		samples map[int64]float64
+	}
+	var out []*series
+	index := make(map[string]*series)
+	add := func(labels []traceQLLabel, bucket int64, value float64) {
+		key := traceQLPromLabels(labels)
+		s, ok := index[key]
+		if !ok {
+			s = &series{labels: labels, samples: make(map[int64]float64)}
+			index[key] = s
+			out = append(out, s)
+		}
+		s.samples[bucket] = value
+	}
+
+	for _, p := range points {
+		var labels []traceQLLabel
+		for i, v := range p.Group {
+			if v != nil {
+				labels = append(labels, traceQLLabel{key: mq.byLabels[i], value: v})
+			}
+		}
+		switch mq.function {
+		case "quantile_over_time":
+			for i, q := range mq.quantiles {
+				withP := append(append([]traceQLLabel(nil), labels...), traceQLLabel{key: "p", value: q})
+				add(withP, p.BucketStart, float64(p.QuantileNs[i])/float64(time.Second))
+			}
+		case "rate":
+			add(traceQLNameLabel(labels, "rate"), p.BucketStart, float64(p.Count)/step.Seconds())
+		default:
+			add(traceQLNameLabel(labels, mq.function), p.BucketStart, float64(p.Count))
+		}
+	}
+
+	result := make([]map[string]interface{}, 0, len(out))
+	for _, s := range out {
+		var buckets []int64
+		if mq.function == "quantile_over_time" {
+			for b := range s.samples {
+				buckets = append(buckets, b)
+			}
+			sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+		} else {
+			for b := startNs; b <= endNs; b += step.Nanoseconds() {
+				buckets = append(buckets, b)
+			}
+		}
+		samples := make([]map[string]interface{}, 0, len(buckets))
+		for _, b := range buckets {
+			samples = append(samples, map[string]interface{}{
+				"timestampMs": strconv.FormatInt(b/int64(time.Millisecond), 10),
+				"value":       s.samples[b],
+			})
+		}
+		labels := make([]map[string]interface{}, 0, len(s.labels))
+		for _, l := range s.labels {
+			labels = append(labels, map[string]interface{}{"key": l.key, "value": l.anyValue()})
+		}
+		result = append(result, map[string]interface{}{
+			"labels":     labels,
+			"samples":    samples,
+			"promLabels": traceQLPromLabels(s.labels),
+		})
+	}
+	return result
+}
+
+// traceQLLabel is a series label; value is a string, int64, float64 or bool
+type traceQLLabel struct {
+	key   string
+	value interface{}
+}
+
+// traceQLNameLabel labels an ungrouped series with the function name, as
+// Tempo does
+func traceQLNameLabel(labels []traceQLLabel, name string) []traceQLLabel {
+	if len(labels) > 0 {
+		return labels
+	}
+	return []traceQLLabel{{key: "__name__", value: name}}
+}
+
+// anyValue renders the label value as an OTLP AnyValue in JSON
+func (l traceQLLabel) anyValue() map[string]interface{} {
+	switch v := l.value.(type) {
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+// traceQLPromLabels renders labels in Prometheus notation, {key="value", ...}
+func traceQLPromLabels(labels []traceQLLabel) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.key+"="+strconv.Quote(fmt.Sprint(l.value)))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
@@ -0,0 +1,197 @@
+package sqliteexporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// traceTreeSpan is one span of /api/traces/{id}/tree, with its children
+// nested under it
+type traceTreeSpan struct {
+	SpanID            string                 `json:"span_id"`
+	ParentSpanID      string                 `json:"parent_span_id,omitempty"`
+	ServiceName       string                 `json:"service_name"`
+	SpanName          string                 `json:"span_name"`
+	Kind              string                 `json:"kind"`
+	StartTimeUnixNano int64                  `json:"start_time_unix_nano"`
+	EndTimeUnixNano   int64                  `json:"end_time_unix_nano"`
+	DurationMs        float64                `json:"duration_ms"`
+	DurationNanos     int64                  `json:"duration_nanos"`
+	SelfTimeMs        float64                `json:"self_time_ms"`
+	SelfTimeNanos     int64                  `json:"self_time_nanos"`
+	StartOffsetMs     float64                `json:"start_offset_ms"`
+	Depth             int                    `json:"depth"`
+	StatusCode        int                    `json:"status_code"`
+	StatusMessage     string                 `json:"status_message,omitempty"`
+	CriticalPath      bool                   `json:"critical_path"`
+	Attributes        map[string]interface{} `json:"attributes,omitempty"`
+	Events            []interface{}          `json:"events,omitempty"`
+	Children          []*traceTreeSpan       `json:"children"`
+}
+
+// traceTree is the response of /api/traces/{id}/tree. Spans whose parent
+// was not stored are roots alongside the real root, but never on the
+// critical path.
+type traceTree struct {
+	TraceID           string           `json:"trace_id"`
+	StartTimeUnixNano int64            `json:"start_time_unix_nano"`
+	EndTimeUnixNano   int64            `json:"end_time_unix_nano"`
+	DurationMs        float64          `json:"duration_ms"`
+	DurationNanos     int64            `json:"duration_nanos"`
+	SpanCount         int              `json:"span_count"`
+	Services          []string         `json:"services"`
+	Roots             []*traceTreeSpan `json:"roots"`
+}
+
+// handleTraceTree returns a trace as a span tree with depth, self-time and
+// the critical path computed, so clients can draw a waterfall directly
+func (e *sqliteExporter) handleTraceTree(w http.ResponseWriter, r *http.Request, traceID string) {
+	traceID, err := normalizeTraceID(traceID)
+	if err != nil {
+		e.writeError(w, "invalid trace_id", err, http.StatusBadRequest)
+		return
+	}
+	spans, err := e.store.QueryTraceByID(r.Context(), traceID)
+	if err != nil {
+		e.writeError(w, "Failed to load trace", err, http.StatusInternalServerError)
+		return
+	}
+	if len(spans) == 0 {
+		e.writeError(w, "trace not found", nil, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e.writeJSON(w, buildTraceTree(traceID, spans))
+}
+
+// buildTraceTree nests stored spans under their parents. Self-time is a
+// span's duration minus its direct children's, clamped at zero as in
+// /api/self-time.
+func buildTraceTree(traceID string, spans []json.RawMessage) traceTree {
+	tree := traceTree{TraceID: traceID}
+	nodes := make([]*traceTreeSpan, 0, len(spans))
+	byID := make(map[string]*traceTreeSpan, len(spans))
+	services := make(map[string]struct{})
+	for _, raw := range spans {
+		var doc struct {
+			SpanID            string                 `json:"span_id"`
+			ParentSpanID      string                 `json:"parent_span_id"`
+			ServiceName       string                 `json:"service_name"`
+			SpanName          string                 `json:"span_name"`
+			Kind              string                 `json:"kind"`
+			StartTimeUnixNano int64                  `json:"start_time_unix_nano"`
+			EndTimeUnixNano   int64                  `json:"end_time_unix_nano"`
+			Attributes        map[string]interface{} `json:"attributes"`
+			Events            []interface{}          `json:"events"`
+			Status            struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"status"`
+		}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			continue
+		}
+		if doc.ParentSpanID == "0000000000000000" {
+			doc.ParentSpanID = ""
+		}
+		end := doc.EndTimeUnixNano
+		if end < doc.StartTimeUnixNano {
+			end = doc.StartTimeUnixNano
+		}
+		n := &traceTreeSpan{
+			SpanID:            doc.SpanID,
+			ParentSpanID:      doc.ParentSpanID,
+			ServiceName:       doc.ServiceName,
+			SpanName:          doc.SpanName,
+			Kind:              doc.Kind,
+			StartTimeUnixNano: doc.StartTimeUnixNano,
+			EndTimeUnixNano:   end,
+			DurationMs:        float64(end-doc.StartTimeUnixNano) / 1e6,
+			DurationNanos:     end - doc.StartTimeUnixNano,
+			StatusCode:        doc.Status.Code,
+			StatusMessage:     doc.Status.Message,
+			Attributes:        doc.Attributes,
+			Events:            doc.Events,
+			Children:          []*traceTreeSpan{},
+		}
+		nodes = append(nodes, n)
+		byID[n.SpanID] = n
+		services[n.ServiceName] = struct{}{}
+		if len(nodes) == 1 || n.StartTimeUnixNano < tree.StartTimeUnixNano {
+			tree.StartTimeUnixNano = n.StartTimeUnixNano
+		}
+		if n.EndTimeUnixNano > tree.EndTimeUnixNano {
+			tree.EndTimeUnixNano = n.EndTimeUnixNano
+		}
+	}
+
+	tree.Roots = []*traceTreeSpan{}
+	for _, n := range nodes {
+		if parent, ok := byID[n.ParentSpanID]; ok && parent != n {
+			parent.Children = append(parent.Children, n)
+		} else {
+			tree.Roots = append(tree.Roots, n)
+		}
+	}
+	sortByStart(tree.Roots)
+	for _, root := range tree.Roots {
+		layoutTraceTree(root, 0, tree.StartTimeUnixNano)
+		// Orphans are left off the critical path; it runs through real roots
+		if root.ParentSpanID == "" {
+			markCriticalPath(root, root.EndTimeUnixNano)
+		}
+	}
+
+	tree.SpanCount = len(nodes)
+	tree.DurationNanos = tree.EndTimeUnixNano - tree.StartTimeUnixNano
+	tree.DurationMs = float64(tree.DurationNanos) / 1e6
+	tree.Services = make([]string, 0, len(services))
+	for s := range services {
+		tree.Services = append(tree.Services, s)
+	}
+	sort.Strings(tree.Services)
+	return tree
+}
+
+func sortByStart(spans []*traceTreeSpan) {
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].StartTimeUnixNano < spans[j].StartTimeUnixNano })
+}
+
+// layoutTraceTree sets depth, start offset and self-time below n
+func layoutTraceTree(n *traceTreeSpan, depth int, traceStart int64) {
+	n.Depth = depth
+	n.StartOffsetMs = float64(n.StartTimeUnixNano-traceStart) / 1e6
+	sortByStart(n.Children)
+	var childNs int64
+	for _, c := range n.Children {
+		layoutTraceTree(c, depth+1, traceStart)
+		childNs += c.DurationNanos
+	}
+	n.SelfTimeNanos = n.DurationNanos - childNs
+	if n.SelfTimeNanos < 0 {
+		n.SelfTimeNanos = 0
+	}
+	n.SelfTimeMs = float64(n.SelfTimeNanos) / 1e6
+}
+
+// markCriticalPath marks the spans the end of n waited on: walking back from
+// until, the child that finished last before it is on the path, then the
+// one that finished last before that child started, and so on.
+func markCriticalPath(n *traceTreeSpan, until int64) {
+	n.CriticalPath = true
+	children := append([]*traceTreeSpan(nil), n.Children...)
+	sort.SliceStable(children, func(i, j int) bool { return children[i].EndTimeUnixNano > children[j].EndTimeUnixNano })
+	cursor := until
+	if n.EndTimeUnixNano < cursor {
+		cursor = n.EndTimeUnixNano
+	}
+	for _, c := range children {
+		if c.StartTimeUnixNano >= cursor {
+			continue
+		}
+		markCriticalPath(c, cursor)
+		cursor = c.StartTimeUnixNano
+	}
+}
@@ -0,0 +1,25 @@
+package sqliteexporter
+
+import (
+	"embed"
+	"net/http"
+)
+
+// uiFiles is the single-page trace browser served at /ui/. It only uses the
+// query API's own endpoints, so gotel is usable without Grafana.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiHandler serves the embedded UI. Request paths map directly onto the
+// embedded ui/ directory, and /ui is redirected to /ui/.
+func (e *sqliteExporter) uiHandler() http.Handler {
+	files := http.FileServer(http.FS(uiFiles))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			e.writeError(w, "method not allowed", nil, http.StatusMethodNotAllowed)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,282 @@
+// gotel trace browser: services, recent traces, a waterfall trace view and
+// the exceptions feed, read from the query API it is served by.
+(function () {
+    "use strict";
+
+    var state = { service: "", traces: [], exceptions: [] };
+    var view = document.getElementById("view");
+    var status = document.getElementById("status");
+    var range = document.getElementById("range");
+
+    // el builds an element; text is always set as textContent, never HTML
+    function el(tag, attrs, children) {
+        var node = document.createElement(tag);
+        Object.keys(attrs || {}).forEach(function (k) {
+            if (k === "text") {
+                node.textContent = attrs[k];
+            } else if (k === "onclick") {
+                node.addEventListener("click", attrs[k]);
+            } else {
+                node.setAttribute(k, attrs[k]);
+            }
+        });
+        (children || []).forEach(function (c) { node.appendChild(c); });
+        return node;
+    }
+
+    // API paths are relative to /ui/, so the UI also works under base_path
+    function getJSON(path) {
+        return fetch(path).then(function (resp) {
+            return resp.json().then(function (body) {
+                if (!resp.ok) {
+                    throw new Error((body && body.error) || resp.statusText);
+                }
+                return body;
+            });
+        });
+    }
+
+    function setStatus(msg, isError) {
+        status.textContent = msg || "";
+        status.className = isError ? "error" : "";
+    }
+
+    function fromParam() {
+        return "from=-" + encodeURIComponent(range.value);
+    }
+
+    function formatDuration(ms) {
+        if (ms < 1) {
+            return (ms * 1000).toFixed(0) + " µs";
+        }
+        if (ms < 1000) {
+            return ms.toFixed(ms < 10 ? 2 : 0) + " ms";
+        }
+        return (ms / 1000).toFixed(2) + " s";
+    }
+
+    function formatTime(ms) {
+        return new Date(ms).toLocaleString();
+    }
+
+    // Services
+
+    function loadServices() {
+        return getJSON("../api/services").then(function (services) {
+            var list = document.getElementById("services");
+            list.replaceChildren();
+            [""].concat(services || []).forEach(function (name) {
+                var link = el("a", {
+                    href: "#/traces",
+                    text: name || "All services",
+                    onclick: function () {
+                        state.service = name;
+                        renderServices();
+                        if (currentView() === "traces") {
+                            renderTraces();
+                        }
+                    }
+                });
+                link.dataset.service = name;
+                list.appendChild(el("li", {}, [link]));
+            });
+            renderServices();
+        });
+    }
+
+    function renderServices() {
+        document.querySelectorAll("#services a").forEach(function (a) {
+            a.classList.toggle("active", a.dataset.service === state.service);
+        });
+    }
+
+    // Recent traces
+
+    function loadTraces() {
+        setStatus("Loading traces…");
+        return getJSON("../api/traces?" + fromParam()).then(function (traces) {
+            state.traces = traces || [];
+            setStatus(state.traces.length + " traces");
+            renderTraces();
+        });
+    }
+
+    function renderTraces() {
+        var rows = state.traces.filter(function (t) {
+            return !state.service || t.service_name === state.service;
+        });
+        if (rows.length === 0) {
+            view.replaceChildren(el("p", { class: "empty", text: "No traces in this time range." }));
+            return;
+        }
+        var body = el("tbody", {}, rows.map(function (t) {
+            return el("tr", {
+                class: t.status_code === 2 ? "error" : "",
+                onclick: function () { location.hash = "#/trace/" + t.trace_id; }
+            }, [
+                el("td", { text: formatTime(t.start_time / 1e6) }),
+                el("td", { text: t.service_name }),
+                el("td", { text: t.span_name }),
+                el("td", { class: "num", text: formatDuration(t.duration_ms) }),
+                el("td", { class: "num", text: String(t.span_count) }),
+                el("td", { class: "mono", text: t.trace_id })
+            ]);
+        }));
+        view.replaceChildren(el("table", {}, [
+            el("thead", {}, [el("tr", {}, ["Start", "Service", "Root span", "Duration", "Spans", "Trace ID"].map(function (h) {
+                return el("th", { text: h });
+            }))]),
+            body
+        ]));
+    }
+
+    // Trace waterfall, from the tree /api/traces/{id}/tree computes
+
+    // flattenTree lists spans depth-first, as the server orders children
+    function flattenTree(roots) {
+        var out = [];
+        function walk(s) {
+            out.push(s);
+            s.children.forEach(walk);
+        }
+        roots.forEach(walk);
+        return out;
+    }
+
+    function spanDetails(s) {
+        var rows = [
+            ["service", s.service_name],
+            ["kind", s.kind],
+            ["duration", formatDuration(s.duration_ms)],
+            ["self time", formatDuration(s.self_time_ms)],
+            ["span_id", s.span_id]
+        ];
+        if (s.status_message) {
+            rows.push(["status", s.status_message]);
+        }
+        Object.keys(s.attributes || {}).sort().forEach(function (k) { rows.push([k, String(s.attributes[k])]); });
+        var table = el("table", { class: "details" }, rows.map(function (r) {
+            return el("tr", {}, [el("th", { text: r[0] }), el("td", { text: r[1] })]);
+        }));
+        var parts = [el("h3", { text: s.span_name }), table];
+        (s.events || []).forEach(function (ev) {
+            var attrs = ev.attributes || {};
+            parts.push(el("h4", { text: ev.name }));
+            parts.push(el("table", { class: "details" }, Object.keys(attrs).sort().map(function (k) {
+                return el("tr", {}, [el("th", { text: k }), el("td", {}, [el("pre", { text: String(attrs[k]) })])]);
+            })));
+        });
+        return el("div", { class: "span-details" }, parts);
+    }
+
+    function loadTrace(traceID) {
+        setStatus("Loading trace…");
+        return getJSON("../api/traces/" + encodeURIComponent(traceID) + "/tree").then(function (tree) {
+            var spans = flattenTree(tree.roots);
+            var total = Math.max(tree.duration_ms, 0.001);
+            setStatus(tree.span_count + " spans, " + formatDuration(tree.duration_ms) + ", " + tree.services.join(", "));
+
+            var details = el("div", { class: "span-details empty", text: "Select a span to see its attributes. Spans on the critical path are outlined." });
+            var rows = spans.map(function (s) {
+                var bar = el("div", { class: "bar" + (s.status_code === 2 ? " error" : "") + (s.critical_path ? " critical" : "") });
+                bar.style.left = (s.start_offset_ms / total * 100) + "%";
+                bar.style.width = Math.max(s.duration_ms / total * 100, 0.2) + "%";
+                var label = el("div", { class: "label" }, [
+                    el("span", { class: "service", text: s.service_name }),
+                    el("span", { text: " " + s.span_name })
+                ]);
+                label.style.paddingLeft = (s.depth * 14 + 4) + "px";
+                var row = el("div", {
+                    class: "waterfall-row",
+                    title: s.span_name + " (" + formatDuration(s.duration_ms) + ", self " + formatDuration(s.self_time_ms) + ")",
+                    onclick: function () {
+                        view.querySelectorAll(".waterfall-row.selected").forEach(function (r) { r.classList.remove("selected"); });
+                        row.classList.add("selected");
+                        details.replaceWith(details = spanDetails(s));
+                    }
+                }, [label, el("div", { class: "track" }, [bar, el("span", { class: "duration", text: formatDuration(s.duration_ms) })])]);
+                return row;
+            });
+            view.replaceChildren(
+                el("h2", { class: "mono", text: tree.trace_id }),
+                el("div", { class: "waterfall" }, rows),
+                details
+            );
+        });
+    }
+
+    // Exceptions feed
+
+    function loadExceptions() {
+        setStatus("Loading exceptions…");
+        return getJSON("../api/exceptions?limit=200&" + fromParam()).then(function (exceptions) {
+            state.exceptions = exceptions || [];
+            setStatus(state.exceptions.length + " exceptions");
+            renderExceptions();
+        });
+    }
+
+    function renderExceptions() {
+        var rows = state.exceptions.filter(function (x) {
+            return !state.service || x.service_name === state.service;
+        });
+        if (rows.length === 0) {
+            view.replaceChildren(el("p", { class: "empty", text: "No exceptions in this time range." }));
+            return;
+        }
+        view.replaceChildren(el("ul", { class: "exceptions" }, rows.map(function (x) {
+            var item = el("li", {}, [
+                el("div", { class: "exception-head" }, [
+                    el("strong", { text: x.exception_type || "Error" }),
+                    el("span", { text: " " + (x.message || "") }),
+                    el("a", { href: "#/trace/" + x.trace_id, class: "mono", text: x.trace_id })
+                ]),
+                el("div", { class: "exception-meta", text: formatTime(x.timestamp) + " · " + x.service_name + " · " + x.span_name })
+            ]);
+            if (x.stack_trace) {
+                item.appendChild(el("details", {}, [el("summary", { text: "Stack trace" }), el("pre", { text: x.stack_trace })]));
+            }
+            return item;
+        })));
+    }
+
+    // Routing: #/traces, #/exceptions and #/trace/<id>
+
+    function currentView() {
+        var hash = location.hash.replace(/^#\//, "");
+        if (hash.indexOf("trace/") === 0) {
+            return "trace";
+        }
+        return hash === "exceptions" ? "exceptions" : "traces";
+    }
+
+    function route() {
+        var name = currentView();
+        document.querySelectorAll("nav a").forEach(function (a) {
+            a.classList.toggle("active", a.dataset.view === name || (name === "trace" && a.dataset.view === "traces"));
+        });
+        var load;
+        if (name === "trace") {
+            load = loadTrace(decodeURIComponent(location.hash.slice("#/trace/".length)));
+        } else if (name === "exceptions") {
+            load = loadExceptions();
+        } else {
+            load = loadTraces();
+        }
+        load.catch(function (err) { setStatus(err.message, true); });
+    }
+
+    document.getElementById("lookup").addEventListener("submit", function (ev) {
+        ev.preventDefault();
+        var id = document.getElementById("lookup-id").value.trim();
+        if (id) {
+            location.hash = "#/trace/" + id;
+        }
+    });
+    document.getElementById("refresh").addEventListener("click", route);
+    range.addEventListener("change", route);
+    window.addEventListener("hashchange", route);
+
+    loadServices().catch(function (err) { setStatus(err.message, true); });
+    route();
+})();
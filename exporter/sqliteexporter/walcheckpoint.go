@@ -0,0 +1,53 @@
+package sqliteexporter
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runWALCheckpoint checks the -wal file size every interval and checkpoints
+// it once it is over wal_checkpoint.max_size_mb.
+func (e *sqliteExporter) runWALCheckpoint() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.config.WALCheckpoint.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.cleanupCtx.Done():
+			return
+		case <-ticker.C:
+			e.checkpointWAL()
+		}
+	}
+}
+
+// checkpointWAL runs one size check and logs the checkpoint if one ran
+func (e *sqliteExporter) checkpointWAL() {
+	start := time.Now()
+	result, err := e.store.CheckpointWAL(e.cleanupCtx, e.config.WALCheckpoint.MaxSizeMB<<20)
+	if err != nil {
+		if e.cleanupCtx.Err() == nil {
+			e.logger.Warn("WAL checkpoint failed", zap.Error(err))
+		}
+		return
+	}
+	if result == nil {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.Int64("wal_bytes_before", result.WALBytesBefore),
+		zap.Int64("wal_bytes_after", result.WALBytesAfter),
+		zap.Int64("log_frames", result.LogFrames),
+		zap.Int64("checkpointed_frames", result.CheckpointedFrames),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if result.Busy {
+		e.logger.Warn("WAL checkpoint could not truncate the WAL, will retry", fields...)
+		return
+	}
+	e.logger.Info("WAL checkpointed", fields...)
+}
@@ -0,0 +1,124 @@
+// Package memlimit derives Go runtime and memory_limiter settings from the
+// container (cgroup) memory limit, and records what was applied so it can be
+// reported at runtime.
+package memlimit
+
+import (
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// GoMemLimitPercent is the share of the container limit given to
+	// GOMEMLIMIT, leaving headroom for non-heap memory before the OOM killer.
+	GoMemLimitPercent = 90
+
+	// LimiterPercent and LimiterSpikePercent are the memory_limiter defaults.
+	// The limiter's soft limit (80% - 20% = 60%) stays below GOMEMLIMIT so
+	// data is refused before the GC starts thrashing.
+	LimiterPercent      = 80
+	LimiterSpikePercent = 20
+
+	// Source values reported in Settings.GoMemLimitSource
+	SourceEnv    = "env"
+	SourceCgroup = "cgroup"
+	SourceNone   = "none"
+)
+
+// cgroup limit files, v2 first. Variables so tests can point them elsewhere.
+var (
+	cgroupV2MemoryMax = "/sys/fs/cgroup/memory.max"
+	cgroupV1Limit     = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+)
+
+// cgroupV1Unlimited is the smallest value treated as "no limit" under cgroup
+// v1, which reports unlimited as a huge page-aligned number.
+const cgroupV1Unlimited = int64(1) << 60
+
+// Settings describes the memory configuration in effect.
+type Settings struct {
+	CgroupLimitBytes         int64  `json:"cgroup_limit_bytes"`
+	GoMemLimitBytes          int64  `json:"gomemlimit_bytes"`
+	GoMemLimitSource         string `json:"gomemlimit_source"`
+	LimiterPercentage        int    `json:"memory_limiter_limit_percentage"`
+	LimiterSpikePercentage   int    `json:"memory_limiter_spike_limit_percentage"`
+	LimiterEffectiveLimitMiB int64  `json:"memory_limiter_effective_limit_mib,omitempty"`
+	LimiterEffectiveSpikeMiB int64  `json:"memory_limiter_effective_spike_limit_mib,omitempty"`
+}
+
+var (
+	mu      sync.Mutex
+	applied Settings
+)
+
+// Configure sets GOMEMLIMIT from the cgroup limit unless the GOMEMLIMIT
+// environment variable is already set (the runtime honours it itself), and
+// records the resulting settings.
+func Configure() Settings {
+	s := Settings{
+		GoMemLimitSource:       SourceNone,
+		LimiterPercentage:      LimiterPercent,
+		LimiterSpikePercentage: LimiterSpikePercent,
+	}
+	if limit, ok := CgroupLimit(); ok {
+		s.CgroupLimitBytes = limit
+		s.LimiterEffectiveLimitMiB = limit * LimiterPercent / 100 >> 20
+		s.LimiterEffectiveSpikeMiB = limit * LimiterSpikePercent / 100 >> 20
+	}
+
+	switch {
+	case strings.TrimSpace(os.Getenv("GOMEMLIMIT")) != "":
+		s.GoMemLimitSource = SourceEnv
+	case s.CgroupLimitBytes > 0:
+		debug.SetMemoryLimit(s.CgroupLimitBytes * GoMemLimitPercent / 100)
+		s.GoMemLimitSource = SourceCgroup
+	}
+	s.GoMemLimitBytes = currentGoMemLimit()
+
+	mu.Lock()
+	applied = s
+	mu.Unlock()
+	return s
+}
+
+// Current returns the settings recorded by Configure, with GOMEMLIMIT read
+// back from the runtime. Before Configure runs only the runtime value is set.
+func Current() Settings {
+	mu.Lock()
+	s := applied
+	mu.Unlock()
+	if s.GoMemLimitSource == "" {
+		s.GoMemLimitSource = SourceNone
+	}
+	s.GoMemLimitBytes = currentGoMemLimit()
+	return s
+}
+
+// currentGoMemLimit returns the runtime memory limit, or 0 when unlimited.
+func currentGoMemLimit() int64 {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == int64(^uint64(0)>>1) {
+		return 0
+	}
+	return limit
+}
+
+// CgroupLimit returns the container memory limit in bytes, if one is set.
+func CgroupLimit() (int64, bool) {
+	if raw, err := os.ReadFile(cgroupV2MemoryMax); err == nil {
+		v := strings.TrimSpace(string(raw))
+		if v == "max" {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil && n > 0
+	}
+	if raw, err := os.ReadFile(cgroupV1Limit); err == nil {
+		n, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+		return n, err == nil && n > 0 && n < cgroupV1Unlimited
+	}
+	return 0, false
+}
@@ -0,0 +1,80 @@
+package memlimit
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func withCgroupFiles(t *testing.T, v2, v1 string) {
+	t.Helper()
+	dir := t.TempDir()
+	oldV2, oldV1 := cgroupV2MemoryMax, cgroupV1Limit
+	cgroupV2MemoryMax = filepath.Join(dir, "memory.max")
+	cgroupV1Limit = filepath.Join(dir, "memory.limit_in_bytes")
+	if v2 != "" {
+		os.WriteFile(cgroupV2MemoryMax, []byte(v2), 0o644)
+	}
+	if v1 != "" {
+		os.WriteFile(cgroupV1Limit, []byte(v1), 0o644)
+	}
+	t.Cleanup(func() { cgroupV2MemoryMax, cgroupV1Limit = oldV2, oldV1 })
+}
+
+func TestCgroupLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		v2, v1 string
+		want   int64
+		wantOK bool
+	}{
+		{"v2 limit", "1073741824\n", "", 1 << 30, true},
+		{"v2 unlimited", "max\n", "", 0, false},
+		{"v1 limit", "", "536870912\n", 512 << 20, true},
+		{"v1 unlimited", "", "9223372036854771712\n", 0, false},
+		{"no cgroup", "", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCgroupFiles(t, tt.v2, tt.v1)
+			got, ok := CgroupLimit()
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("CgroupLimit() = %d, %v; want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	prev := debug.SetMemoryLimit(-1)
+	t.Cleanup(func() { debug.SetMemoryLimit(prev) })
+
+	t.Run("from cgroup", func(t *testing.T) {
+		t.Setenv("GOMEMLIMIT", "")
+		withCgroupFiles(t, "1073741824", "")
+		s := Configure()
+		if s.GoMemLimitSource != SourceCgroup {
+			t.Errorf("Expected source %q, got %q", SourceCgroup, s.GoMemLimitSource)
+		}
+		if want := int64(1<<30) * GoMemLimitPercent / 100; s.GoMemLimitBytes != want {
+			t.Errorf("Expected GOMEMLIMIT %d, got %d", want, s.GoMemLimitBytes)
+		}
+		if s.LimiterEffectiveLimitMiB != 819 || s.LimiterEffectiveSpikeMiB != 204 {
+			t.Errorf("Unexpected limiter values %d/%d MiB", s.LimiterEffectiveLimitMiB, s.LimiterEffectiveSpikeMiB)
+		}
+		if Current().CgroupLimitBytes != 1<<30 {
+			t.Errorf("Expected Current() to report the applied settings")
+		}
+	})
+
+	t.Run("env wins", func(t *testing.T) {
+		t.Setenv("GOMEMLIMIT", "256MiB")
+		withCgroupFiles(t, "1073741824", "")
+		debug.SetMemoryLimit(256 << 20)
+		s := Configure()
+		if s.GoMemLimitSource != SourceEnv || s.GoMemLimitBytes != 256<<20 {
+			t.Errorf("Expected env GOMEMLIMIT to be kept, got %+v", s)
+		}
+	})
+}
@@ -6,7 +6,11 @@ import (
 	"strings"
 
 	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/connector"
 	"go.opentelemetry.io/collector/exporter"
+	"go.opentelemetry.io/collector/exporter/otlpexporter"
+	"go.opentelemetry.io/collector/exporter/otlphttpexporter"
+	"go.opentelemetry.io/collector/extension"
 	"go.opentelemetry.io/collector/otelcol"
 	"go.opentelemetry.io/collector/processor"
 	"go.opentelemetry.io/collector/processor/batchprocessor"
@@ -14,7 +18,26 @@ import (
 	"go.opentelemetry.io/collector/receiver"
 	"go.opentelemetry.io/collector/receiver/otlpreceiver"
 
+	"github.com/open-telemetry/opentelemetry-collector-contrib/connector/failoverconnector"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/connector/spanmetricsconnector"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/exporter/fileexporter"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/exporter/prometheusremotewriteexporter"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/extension/bearertokenauthextension"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/extension/observer/dockerobserver"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/extension/observer/hostobserver"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/extension/observer/k8sobserver"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/extension/storage/filestorage"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/processor/k8sattributesprocessor"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/processor/resourcedetectionprocessor"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/processor/tailsamplingprocessor"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/receiver/carbonreceiver"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/receiver/jaegerreceiver"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/receiver/receivercreator"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/receiver/statsdreceiver"
+	"github.com/open-telemetry/opentelemetry-collector-contrib/receiver/zipkinreceiver"
+
 	"github.com/gotel/exporter/sqliteexporter"
+	"github.com/gotel/internal/memlimit"
 )
 
 // Version and BuildTime are injected via -ldflags
@@ -31,6 +54,34 @@ const defaultConfigYAML = "" +
 	"        endpoint: 0.0.0.0:4317\n" +
 	"      http:\n" +
 	"        endpoint: 0.0.0.0:4318\n" +
+	"        # gzip and zstd request bodies; \"\" keeps uncompressed requests\n" +
+	"        # working. gRPC accepts gzip and zstd without configuration.\n" +
+	"        compression_algorithms: [\"\", gzip, zstd]\n" +
+	"  jaeger:\n" +
+	"    protocols:\n" +
+	"      grpc:\n" +
+	"        endpoint: 0.0.0.0:14250\n" +
+	"      thrift_http:\n" +
+	"        endpoint: 0.0.0.0:14268\n" +
+	"  # Zipkin JSON/protobuf on :9411; add zipkin to the traces pipeline's\n" +
+	"  # receivers to enable it:\n" +
+	"  #   receivers: [otlp, jaeger, zipkin]\n" +
+	"  # zipkin:\n" +
+	"  #   endpoint: 0.0.0.0:9411\n" +
+	"  # Graphite plaintext (carbon) on :2003; add a metrics pipeline with\n" +
+	"  # receivers: [carbon] and exporters: [sqlite] to enable it:\n" +
+	"  # carbon:\n" +
+	"  #   endpoint: 0.0.0.0:2003\n" +
+	"  #   transport: tcp\n" +
+	"  #   parser:\n" +
+	"  #     type: plaintext\n" +
+	"  # StatsD on UDP 8125, also routed into the metrics pipeline:\n" +
+	"  # statsd:\n" +
+	"  #   endpoint: 0.0.0.0:8125\n" +
+	"  #   aggregation_interval: 60s\n" +
+	"  #   timer_histogram_mapping:\n" +
+	"  #     - statsd_type: timing\n" +
+	"  #       observer_type: histogram\n" +
 	"\n" +
 	"processors:\n" +
 	"  batch:\n" +
@@ -38,8 +89,8 @@ const defaultConfigYAML = "" +
 	"    send_batch_size: 1000\n" +
 	"  memory_limiter:\n" +
 	"    check_interval: 1s\n" +
-	"    limit_mib: 512\n" +
-	"    spike_limit_mib: 128\n" +
+	"    limit_percentage: 80\n" +
+	"    spike_limit_percentage: 20\n" +
 	"\n" +
 	"exporters:\n" +
 	"  sqlite:\n" +
@@ -51,15 +102,60 @@ const defaultConfigYAML = "" +
 	"    retention: 168h\n" +
 	"    cleanup_interval: 1h\n" +
 	"    query_port: 3200\n" +
+	"  # Raw OTLP archive next to SQLite; add file/archive to a pipeline's\n" +
+	"  # exporters to enable it:\n" +
+	"  #   exporters: [sqlite, file/archive]\n" +
+	"  # file/archive:\n" +
+	"  #   path: ./archive/otlp.jsonl\n" +
+	"  #   rotation:\n" +
+	"  #     max_megabytes: 100\n" +
+	"  #     max_days: 7\n" +
+	"  #     max_backups: 20\n" +
 	"\n" +
 	"service:\n" +
 	"  pipelines:\n" +
 	"    traces:\n" +
+	"      receivers: [otlp, jaeger]\n" +
+	"      processors: [memory_limiter, batch]\n" +
+	"      exporters: [sqlite]\n" +
+	"    logs:\n" +
 	"      receivers: [otlp]\n" +
 	"      processors: [memory_limiter, batch]\n" +
 	"      exporters: [sqlite]\n"
 
+// otlpAuthEnv holds the bearer token OTLP clients must send. When it is set
+// and the embedded config is in use, otlpAuthConfigYAML is merged over it.
+const otlpAuthEnv = "GOTEL_OTLP_BEARER_TOKEN"
+
+// otlpAuthConfigYAML requires "Authorization: Bearer <token>" on both OTLP
+// protocols. The token is read from the environment by the collector, so it
+// never appears in the command line.
+const otlpAuthConfigYAML = "" +
+	"extensions:\n" +
+	"  bearertokenauth/otlp:\n" +
+	"    scheme: Bearer\n" +
+	"    token: ${env:" + otlpAuthEnv + "}\n" +
+	"\n" +
+	"receivers:\n" +
+	"  otlp:\n" +
+	"    protocols:\n" +
+	"      grpc:\n" +
+	"        auth:\n" +
+	"          authenticator: bearertokenauth/otlp\n" +
+	"      http:\n" +
+	"        auth:\n" +
+	"          authenticator: bearertokenauth/otlp\n" +
+	"\n" +
+	"service:\n" +
+	"  extensions: [bearertokenauth/otlp]\n"
+
 func main() {
+	// Size GOMEMLIMIT from the container limit before the collector allocates.
+	mem := memlimit.Configure()
+	if mem.GoMemLimitSource == memlimit.SourceCgroup {
+		log.Printf("GOMEMLIMIT set to %d MiB (%d%% of cgroup limit)", mem.GoMemLimitBytes>>20, memlimit.GoMemLimitPercent)
+	}
+
 	info := component.BuildInfo{
 		Command:     "gotel",
 		Description: "Self-contained OpenTelemetry Collector with SQLite storage",
@@ -72,25 +168,20 @@ func main() {
 	}
 
 	args := os.Args[1:]
-	if !hasConfigArg(args) {
-		configFile := os.Getenv("GOTEL_CONFIG")
-		if configFile == "" {
-			configFile = os.Getenv("OTEL_CONFIG_FILE")
-		}
-		if configFile == "" {
-			configFile = "config.yaml"
-		}
-
+	if !hasConfigArg(args) && !isLocalSubcommand(args) {
+		configFile := defaultConfigFile()
 		if _, err := os.Stat(configFile); err == nil {
 			args = append([]string{"--config", configFile}, args...)
 		} else if os.IsNotExist(err) {
 			// Use an in-memory embedded config via the Collector's built-in `yaml:` provider.
 			// This avoids writing a temporary config file.
-			args = append([]string{"--config", "yaml:" + defaultConfigYAML}, args...)
+			args = append(defaultConfigArgs(os.Getenv(otlpAuthEnv) != ""), args...)
 		}
 	}
 
 	cmd := otelcol.NewCommand(params)
+	cmd.AddCommand(newDBCommand())
+	cmd.AddCommand(newDoctorCommand(params))
 	if len(args) > 0 {
 		cmd.SetArgs(args)
 	}
@@ -100,6 +191,28 @@ func main() {
 	}
 }
 
+// defaultConfigFile is the config file used when no --config is given:
+// GOTEL_CONFIG, then OTEL_CONFIG_FILE, then config.yaml.
+func defaultConfigFile() string {
+	if f := os.Getenv("GOTEL_CONFIG"); f != "" {
+		return f
+	}
+	if f := os.Getenv("OTEL_CONFIG_FILE"); f != "" {
+		return f
+	}
+	return "config.yaml"
+}
+
+// defaultConfigArgs returns the --config flags for the embedded config. Later
+// configs are merged over earlier ones, so auth only adds to the defaults.
+func defaultConfigArgs(auth bool) []string {
+	args := []string{"--config", "yaml:" + defaultConfigYAML}
+	if auth {
+		args = append(args, "--config", "yaml:"+otlpAuthConfigYAML)
+	}
+	return args
+}
+
 func hasConfigArg(args []string) bool {
 	for _, a := range args {
 		if a == "--config" || a == "-c" {
@@ -114,20 +227,71 @@ func hasConfigArg(args []string) bool {
 
 func components() (otelcol.Factories, error) {
 	otlpReceiverFactory := otlpreceiver.NewFactory()
+	jaegerReceiverFactory := jaegerreceiver.NewFactory()
+	zipkinReceiverFactory := zipkinreceiver.NewFactory()
+	carbonReceiverFactory := carbonreceiver.NewFactory()
+	statsdReceiverFactory := statsdreceiver.NewFactory()
+	receiverCreatorFactory := receivercreator.NewFactory()
 	batchProcessorFactory := batchprocessor.NewFactory()
 	memoryLimiterFactory := memorylimiterprocessor.NewFactory()
+	k8sAttributesFactory := k8sattributesprocessor.NewFactory()
+	resourceDetectionFactory := resourcedetectionprocessor.NewFactory()
+	tailSamplingFactory := tailsamplingprocessor.NewFactory()
 	sqliteFactory := sqliteexporter.NewFactory()
+	otlpExporterFactory := otlpexporter.NewFactory()
+	otlpHTTPExporterFactory := otlphttpexporter.NewFactory()
+	fileExporterFactory := fileexporter.NewFactory()
+	promRemoteWriteFactory := prometheusremotewriteexporter.NewFactory()
+	spanMetricsFactory := spanmetricsconnector.NewFactory()
+	failoverFactory := failoverconnector.NewFactory()
+	fileStorageFactory := filestorage.NewFactory()
+	hostObserverFactory := hostobserver.NewFactory()
+	dockerObserverFactory := dockerobserver.NewFactory()
+	k8sObserverFactory := k8sobserver.NewFactory()
+	bearerTokenAuthFactory := bearertokenauthextension.NewFactory()
 
 	factories := otelcol.Factories{
+		// Observers discover endpoints (host ports, containers, pods) for
+		// receiver_creator, which starts receivers from templates as they
+		// appear. bearertokenauth checks the token OTLP clients send.
+		Extensions: map[component.Type]extension.Factory{
+			fileStorageFactory.Type():     fileStorageFactory,
+			hostObserverFactory.Type():    hostObserverFactory,
+			dockerObserverFactory.Type():  dockerObserverFactory,
+			k8sObserverFactory.Type():     k8sObserverFactory,
+			bearerTokenAuthFactory.Type(): bearerTokenAuthFactory,
+		},
 		Receivers: map[component.Type]receiver.Factory{
-			otlpReceiverFactory.Type(): otlpReceiverFactory,
+			otlpReceiverFactory.Type():    otlpReceiverFactory,
+			jaegerReceiverFactory.Type():  jaegerReceiverFactory,
+			zipkinReceiverFactory.Type():  zipkinReceiverFactory,
+			carbonReceiverFactory.Type():  carbonReceiverFactory,
+			statsdReceiverFactory.Type():  statsdReceiverFactory,
+			receiverCreatorFactory.Type(): receiverCreatorFactory,
 		},
+		// tail_sampling decides per trace once it is complete, e.g. keeping
+		// every error trace and a percentage of the rest.
 		Processors: map[component.Type]processor.Factory{
-			batchProcessorFactory.Type(): batchProcessorFactory,
-			memoryLimiterFactory.Type():  memoryLimiterFactory,
+			batchProcessorFactory.Type():    batchProcessorFactory,
+			memoryLimiterFactory.Type():     memoryLimiterFactory,
+			k8sAttributesFactory.Type():     k8sAttributesFactory,
+			resourceDetectionFactory.Type(): resourceDetectionFactory,
+			tailSamplingFactory.Type():      tailSamplingFactory,
 		},
 		Exporters: map[component.Type]exporter.Factory{
-			sqliteFactory.Type(): sqliteFactory,
+			sqliteFactory.Type():           sqliteFactory,
+			otlpExporterFactory.Type():     otlpExporterFactory,
+			otlpHTTPExporterFactory.Type(): otlpHTTPExporterFactory,
+			fileExporterFactory.Type():     fileExporterFactory,
+			promRemoteWriteFactory.Type():  promRemoteWriteFactory,
+		},
+		// spanmetrics turns traces into duration histograms for a metrics
+		// pipeline, e.g. exponential histograms shipped over OTLP. failover
+		// forwards to the first healthy pipeline in priority order, e.g. a
+		// primary Tempo with a second Tempo or a local file as fallback.
+		Connectors: map[component.Type]connector.Factory{
+			spanMetricsFactory.Type(): spanMetricsFactory,
+			failoverFactory.Type():    failoverFactory,
 		},
 	}
 	return factories, nil
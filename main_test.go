@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
 
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/otelcol"
+
 	"github.com/gotel/exporter/sqliteexporter"
+	"github.com/gotel/pkg/tracestore"
 )
 
 func TestHasConfigArg(t *testing.T) {
@@ -61,24 +71,62 @@ func TestComponents(t *testing.T) {
 		t.Fatalf("components() error = %v", err)
 	}
 
-	// Verify receivers
-	if len(factories.Receivers) != 1 {
-		t.Errorf("Expected 1 receiver, got %d", len(factories.Receivers))
+	// Verify OTLP, Jaeger, Zipkin, carbon and StatsD receivers and receiver_creator
+	if len(factories.Receivers) != 6 {
+		t.Errorf("Expected 6 receivers, got %d", len(factories.Receivers))
+	}
+	for _, name := range []string{"otlp", "jaeger", "zipkin", "carbon", "statsd", "receiver_creator"} {
+		if _, ok := factories.Receivers[component.MustNewType(name)]; !ok {
+			t.Errorf("%s receiver not registered", name)
+		}
 	}
 
 	// Verify processors
-	if len(factories.Processors) != 2 {
-		t.Errorf("Expected 2 processors, got %d", len(factories.Processors))
+	if len(factories.Processors) != 5 {
+		t.Errorf("Expected 5 processors, got %d", len(factories.Processors))
+	}
+	for _, name := range []string{"batch", "memory_limiter", "k8sattributes", "resourcedetection", "tail_sampling"} {
+		if _, ok := factories.Processors[component.MustNewType(name)]; !ok {
+			t.Errorf("%s processor not registered", name)
+		}
+	}
+
+	// Verify file_storage is available for persistent sending queues
+	if _, ok := factories.Extensions[component.MustNewType("file_storage")]; !ok {
+		t.Errorf("file_storage extension not registered")
+	}
+
+	// Verify observers are available for receiver_creator discovery, and
+	// bearertokenauth for OTLP ingest auth
+	for _, name := range []string{"host_observer", "docker_observer", "k8s_observer", "bearertokenauth"} {
+		if _, ok := factories.Extensions[component.MustNewType(name)]; !ok {
+			t.Errorf("%s extension not registered", name)
+		}
 	}
 
-	// Verify SQLite exporter is registered
-	if len(factories.Exporters) != 1 {
-		t.Errorf("Expected 1 exporter, got %d", len(factories.Exporters))
+	// Verify SQLite, OTLP, file and remote-write exporters are registered
+	if len(factories.Exporters) != 5 {
+		t.Errorf("Expected 5 exporters, got %d", len(factories.Exporters))
 	}
 
 	if _, ok := factories.Exporters[sqliteexporter.TypeStr]; !ok {
 		t.Errorf("sqlite exporter not registered")
 	}
+	for _, name := range []string{"otlp", "otlphttp", "file", "prometheusremotewrite"} {
+		if _, ok := factories.Exporters[component.MustNewType(name)]; !ok {
+			t.Errorf("%s exporter not registered", name)
+		}
+	}
+
+	// Verify spanmetrics is available to feed duration histograms to metrics pipelines
+	if _, ok := factories.Connectors[component.MustNewType("spanmetrics")]; !ok {
+		t.Errorf("spanmetrics connector not registered")
+	}
+
+	// Verify failover is available for primary/fallback export pipelines
+	if _, ok := factories.Connectors[component.MustNewType("failover")]; !ok {
+		t.Errorf("failover connector not registered")
+	}
 }
 
 func TestDefaultConfigYAMLIncludesSQLiteExporter(t *testing.T) {
@@ -98,3 +146,133 @@ func TestDefaultConfigYAMLIncludesSQLiteExporter(t *testing.T) {
 		t.Fatalf("defaultConfigYAML missing sqlite in exporters list")
 	}
 }
+
+func TestDefaultConfigArgs(t *testing.T) {
+	args := defaultConfigArgs(false)
+	if len(args) != 2 || args[1] != "yaml:"+defaultConfigYAML {
+		t.Fatalf("defaultConfigArgs(false) = %q, want the embedded config only", args)
+	}
+	if !strings.Contains(defaultConfigYAML, `compression_algorithms: ["", gzip, zstd]`) {
+		t.Errorf("defaultConfigYAML missing OTLP compression algorithms")
+	}
+
+	args = defaultConfigArgs(true)
+	if len(args) != 4 || args[2] != "--config" || args[3] != "yaml:"+otlpAuthConfigYAML {
+		t.Fatalf("defaultConfigArgs(true) = %q, want the auth config merged last", args)
+	}
+	if strings.Contains(otlpAuthConfigYAML, "\t") {
+		t.Fatalf("otlpAuthConfigYAML must not contain tabs")
+	}
+	if !strings.Contains(otlpAuthConfigYAML, "${env:"+otlpAuthEnv+"}") {
+		t.Errorf("otlpAuthConfigYAML must read the token from %s", otlpAuthEnv)
+	}
+}
+
+func TestIsLocalSubcommand(t *testing.T) {
+	if !isLocalSubcommand([]string{"db", "dedupe"}) {
+		t.Error("Expected db to be a local subcommand")
+	}
+	if isLocalSubcommand([]string{"--config", "config.yaml"}) {
+		t.Error("Expected collector args not to be a local subcommand")
+	}
+	if isLocalSubcommand(nil) {
+		t.Error("Expected no args not to be a local subcommand")
+	}
+}
+
+func TestDBDedupeCommand(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpFile.Name()) })
+	tmpFile.Close()
+
+	store, err := tracestore.New(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("tracestore.New() error = %v", err)
+	}
+	spanJSON, _ := json.Marshal(map[string]interface{}{
+		"trace_id":     "dup-trace",
+		"span_id":      "dup-span",
+		"service_name": "dup-service",
+		"span_name":    "dup-op",
+	})
+	for i := 0; i < 2; i++ {
+		store.InsertSpan(context.Background(), spanJSON)
+	}
+	store.Close()
+
+	cmd := newDBCommand()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"dedupe", "--db-path", tmpFile.Name()})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("db dedupe error = %v", err)
+	}
+	if !strings.Contains(out.String(), "Duplicate spans removed: 1") {
+		t.Errorf("Unexpected output: %s", out.String())
+	}
+}
+
+func TestDBDedupeCommandMissingDatabase(t *testing.T) {
+	cmd := newDBCommand()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetErr(&bytes.Buffer{})
+	cmd.SetArgs([]string{"dedupe", "--db-path", "does-not-exist.db"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatal("Expected error for missing database")
+	}
+	if _, err := os.Stat("does-not-exist.db"); err == nil {
+		os.Remove("does-not-exist.db")
+		t.Error("dedupe must not create a new database file")
+	}
+}
+
+func TestDoctorCommand(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpFile.Name()) })
+	tmpFile.Close()
+	store, err := tracestore.New(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("tracestore.New() error = %v", err)
+	}
+	store.Close()
+
+	// A port someone else holds is reported, not failed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	set := otelcol.CollectorSettings{BuildInfo: component.NewDefaultBuildInfo(), Factories: components}
+	run := func(args ...string) (string, error) {
+		cmd := newDoctorCommand(set)
+		var out bytes.Buffer
+		cmd.SetOut(&out)
+		cmd.SetErr(&bytes.Buffer{})
+		cmd.SetArgs(append([]string{"--db-path", tmpFile.Name(), "--ports", port}, args...))
+		err := cmd.Execute()
+		return out.String(), err
+	}
+
+	out, err := run("--config", "yaml:"+defaultConfigYAML, "--endpoint", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("doctor error = %v\n%s", err, out)
+	}
+	for _, want := range []string{"[OK]   config", "schema is up to date", "passed the integrity check", "[WARN] port", "is reachable"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in doctor output:\n%s", want, out)
+		}
+	}
+
+	out, err = run("--config", "does-not-exist.yaml")
+	if err == nil || !strings.Contains(out, "[FAIL] config") {
+		t.Errorf("Expected a missing config to fail, got %v:\n%s", err, out)
+	}
+}
@@ -0,0 +1,130 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// AttachedDatabase is another gotel database opened read-only alongside the
+// main one, e.g. a rotated file or a replica from another node.
+type AttachedDatabase struct {
+	// Name is the schema name the database is attached as. It must be a
+	// plain identifier and not "main" or "temp".
+	Name string
+	// Path is the database file. It must already exist.
+	Path string
+}
+
+var attachNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Columns read through the union of the main and attached databases. Only
+// columns present in every schema version are listed, so older files can
+// still be attached; payload is read as NULL from files that predate it.
+const (
+	spanSourceColumns   = "id, data, payload, trace_id, span_id, parent_span_id, service_name, span_name, start_time_unix_nano, end_time_unix_nano, duration_ns, status_code"
+	metricSourceColumns = "id, name, value, timestamp, tags, service"
+)
+
+func validateAttached(attached []AttachedDatabase) error {
+	seen := make(map[string]bool, len(attached))
+	for _, a := range attached {
+		if !attachNamePattern.MatchString(a.Name) {
+			return fmt.Errorf("invalid attached database name %q", a.Name)
+		}
+		lower := strings.ToLower(a.Name)
+		if lower == "main" || lower == "temp" {
+			return fmt.Errorf("attached database name %q is reserved", a.Name)
+		}
+		if seen[lower] {
+			return fmt.Errorf("duplicate attached database name %q", a.Name)
+		}
+		seen[lower] = true
+		if a.Path == "" {
+			return fmt.Errorf("attached database %q: path is required", a.Name)
+		}
+	}
+	return nil
+}
+
+// readOnlyURI returns a SQLite URI filename that opens path read-only
+func readOnlyURI(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: "mode=ro"}
+	return u.String(), nil
+}
+
+// storeConnector opens connections with the regexp and span_document SQL
+// functions registered and the attached databases available. These only apply
+// to the connection they run on, so they are repeated for every connection
+// the pool opens.
+type storeConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func newStoreConnector(dsn string, attached []AttachedDatabase, spanDocument func(data string, payload []byte) (string, error)) (*storeConnector, error) {
+	uris := make([]string, len(attached))
+	for i, a := range attached {
+		uri, err := readOnlyURI(a.Path)
+		if err != nil {
+			return nil, fmt.Errorf("attached database %q: %w", a.Name, err)
+		}
+		uris[i] = uri
+	}
+	hook := func(conn *sqlite3.SQLiteConn) error {
+		if err := conn.RegisterFunc("regexp", sqlRegexp, true); err != nil {
+			return fmt.Errorf("failed to register regexp function: %w", err)
+		}
+		if err := conn.RegisterFunc("span_document", spanDocument, true); err != nil {
+			return fmt.Errorf("failed to register span_document function: %w", err)
+		}
+		for i, a := range attached {
+			if _, err := conn.Exec(`ATTACH DATABASE ? AS "`+a.Name+`"`, []driver.Value{uris[i]}); err != nil {
+				return fmt.Errorf("failed to attach %s as %q: %w", a.Path, a.Name, err)
+			}
+		}
+		return nil
+	}
+	return &storeConnector{dsn: dsn, driver: &sqlite3.SQLiteDriver{ConnectHook: hook}}, nil
+}
+
+func (c *storeConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *storeConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// source returns the FROM target for reading table: the table itself, or a
+// UNION ALL of the table in the main and every attached database.
+func (s *Store) source(table, columns string) string {
+	if len(s.attached) == 0 {
+		return table
+	}
+	parts := make([]string, 0, len(s.attached)+1)
+	parts = append(parts, "SELECT "+columns+" FROM main."+table)
+	for _, a := range s.attached {
+		cols := columns
+		if s.noPayload[a.Name] {
+			cols = strings.Replace(cols, "payload", "NULL AS payload", 1)
+		}
+		parts = append(parts, "SELECT "+cols+` FROM "`+a.Name+`".`+table)
+	}
+	return "(" + strings.Join(parts, " UNION ALL ") + ")"
+}
+
+// Attached returns the databases attached read-only to the store
+func (s *Store) Attached() []AttachedDatabase {
+	return append([]AttachedDatabase(nil), s.attached...)
+}
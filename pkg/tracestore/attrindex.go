@@ -0,0 +1,242 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// attrIndexSchema is an inverted index of selected span attributes. Triggers
+// keep it in step with the spans table on every insert path (including
+// replication), on rewrites and on deletes; span_attribute_keys holds the
+// attribute keys being indexed.
+const attrIndexSchema = `
+	CREATE TABLE IF NOT EXISTS span_attribute_keys (
+		attr_key TEXT PRIMARY KEY
+	);
+
+	CREATE TABLE IF NOT EXISTS span_attributes (
+		attr_key TEXT NOT NULL,
+		attr_value TEXT,
+		span_rowid INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_span_attributes_lookup ON span_attributes(attr_key, attr_value);
+	CREATE INDEX IF NOT EXISTS idx_span_attributes_span ON span_attributes(span_rowid);
+
+	CREATE TRIGGER IF NOT EXISTS span_attributes_insert AFTER INSERT ON spans
+	WHEN EXISTS (SELECT 1 FROM span_attribute_keys)
+	BEGIN
+		INSERT INTO span_attributes (attr_key, attr_value, span_rowid)
+		SELECT j.key, ` + attrIndexValue + `, NEW.id
+		FROM json_each(NEW.data, '$.attributes') j
+		WHERE j.key IN (SELECT attr_key FROM span_attribute_keys);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS span_attributes_update AFTER UPDATE OF data ON spans
+	WHEN EXISTS (SELECT 1 FROM span_attribute_keys)
+	BEGIN
+		DELETE FROM span_attributes WHERE span_rowid = OLD.id;
+		INSERT INTO span_attributes (attr_key, attr_value, span_rowid)
+		SELECT j.key, ` + attrIndexValue + `, NEW.id
+		FROM json_each(NEW.data, '$.attributes') j
+		WHERE j.key IN (SELECT attr_key FROM span_attribute_keys);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS span_attributes_delete AFTER DELETE ON spans
+	BEGIN
+		DELETE FROM span_attributes WHERE span_rowid = OLD.id;
+	END;
+	`
+
+// attrIndexValue renders a json_each value as the text attribute lookups
+// compare against. Booleans would otherwise be stored as 1 and 0.
+const attrIndexValue = `CASE j.type WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE CAST(j.value AS TEXT) END`
+
+// SetIndexedAttributes sets the span attribute keys kept in the attribute
+// index. Keys that were not indexed before are backfilled from the stored
+// spans, which scans the spans table once per new key; keys no longer listed
+// are dropped from the index. Traces compacted before a key was added are not
+// found by it. The backfill decodes spans stored in the compact format; from
+// then on the insert triggers index them from their header, so their writer
+// must put the indexed keys there.
+func (s *Store) SetIndexedAttributes(ctx context.Context, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if k == "" || strings.ContainsAny(k, `"\`) {
+			return fmt.Errorf("invalid attribute key %q", k)
+		}
+		want[k] = true
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	have, err := indexedAttributeKeys(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for k := range have {
+		if want[k] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM span_attributes WHERE attr_key = ?", k); err != nil {
+			return fmt.Errorf("failed to drop attribute index for %q: %w", k, err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM trace_summary_attributes WHERE attr_key = ?", k); err != nil {
+			return fmt.Errorf("failed to drop trace attributes for %q: %w", k, err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM span_attribute_keys WHERE attr_key = ?", k); err != nil {
+			return err
+		}
+	}
+	for k := range want {
+		if have[k] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO span_attribute_keys (attr_key) VALUES (?)", k); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO span_attributes (attr_key, attr_value, span_rowid)
+			SELECT j.key, `+attrIndexValue+`, s.id
+			FROM spans s, json_each(`+spanDocumentExpr+`, '$.attributes') j
+			WHERE j.key = ?`, k)
+		if err != nil {
+			return fmt.Errorf("failed to backfill attribute index for %q: %w", k, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.indexedAttrs = want
+	return nil
+}
+
+// loadIndexedAttributes reads the indexed keys recorded in the database, so
+// lookups use the index before SetIndexedAttributes is called.
+func (s *Store) loadIndexedAttributes() error {
+	keys, err := indexedAttributeKeys(context.Background(), s.db)
+	if err != nil {
+		return err
+	}
+	s.indexedAttrs = keys
+	return nil
+}
+
+func indexedAttributeKeys(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}) (map[string]bool, error) {
+	rows, err := q.QueryContext(ctx, "SELECT attr_key FROM span_attribute_keys")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys[k] = true
+	}
+	return keys, rows.Err()
+}
+
+// IndexedAttributes returns the span attribute keys kept in the attribute index
+func (s *Store) IndexedAttributes() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.indexedAttrs))
+	for k := range s.indexedAttrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// attrDocumentValue is attrIndexValue for an attribute read from the span
+// document doc; both placeholders take the attribute's JSON path.
+func attrDocumentValue(doc string) string {
+	return `CASE json_type(` + doc + `, ?) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE CAST(json_extract(` + doc + `, ?) AS TEXT) END`
+}
+
+// attributeClause builds WHERE fragments restricting trace_id to traces with
+// a span carrying every given attribute value. Indexed keys are an index seek
+// on the main database; other keys, and attached databases, fall back to
+// scanning the span documents. Callers hold s.mu.
+func (s *Store) attributeClause(attrs map[string]string) (string, []interface{}, error) {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		if k == "" || strings.ContainsAny(k, `"\`) {
+			return "", nil, fmt.Errorf("invalid attribute key %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var clause string
+	var args []interface{}
+	for _, k := range keys {
+		path := `$.attributes."` + k + `"`
+		if !s.indexedAttrs[k] {
+			clause += " AND trace_id IN (SELECT trace_id FROM " + s.source("spans", spanSourceColumns) +
+				" WHERE " + attrDocumentValue(spanDocumentExpr) + " = ?)"
+			args = append(args, path, path, attrs[k])
+			continue
+		}
+
+		sub := "SELECT sp.trace_id FROM span_attributes a JOIN main.spans sp ON sp.id = a.span_rowid WHERE a.attr_key = ? AND a.attr_value = ?"
+		args = append(args, k, attrs[k])
+		for _, a := range s.attached {
+			doc := spanDocumentExpr
+			if s.noPayload[a.Name] {
+				doc = "data"
+			}
+			sub += ` UNION ALL SELECT trace_id FROM "` + a.Name + `".spans WHERE ` + attrDocumentValue(doc) + " = ?"
+			args = append(args, path, path, attrs[k])
+		}
+		clause += " AND trace_id IN (" + sub + ")"
+	}
+	return clause, args, nil
+}
+
+// spanAttributeClause builds WHERE fragments restricting main.spans rows to
+// spans carrying every given attribute value, seeking the index for indexed
+// keys. Callers hold s.mu.
+func (s *Store) spanAttributeClause(attrs map[string]string) (string, []interface{}, error) {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		if k == "" || strings.ContainsAny(k, `"\`) {
+			return "", nil, fmt.Errorf("invalid attribute key %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var clause string
+	var args []interface{}
+	for _, k := range keys {
+		if s.indexedAttrs[k] {
+			clause += " AND id IN (SELECT span_rowid FROM span_attributes WHERE attr_key = ? AND attr_value = ?)"
+			args = append(args, k, attrs[k])
+			continue
+		}
+		path := `$.attributes."` + k + `"`
+		clause += " AND " + attrDocumentValue(spanDocumentExpr) + " = ?"
+		args = append(args, path, path, attrs[k])
+	}
+	return clause, args, nil
+}
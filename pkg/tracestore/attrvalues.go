@@ -0,0 +1,107 @@
+package tracestore
+
+import (
+	"context"
+	"fmt"
+)
+
+// AttributeValuesOptions selects the values AttributeValues lists. Time
+// bounds are Unix nanoseconds on span start time.
+type AttributeValuesOptions struct {
+	Field        SpanField
+	ServiceName  string
+	MinStartTime int64
+	MaxStartTime int64
+	// ScanLimit bounds the spans read, most recent first, when the field is
+	// not in the attribute index; 0 reads every span
+	ScanLimit int
+	// Limit caps the values returned; 0 returns every value
+	Limit int
+}
+
+// AttributeValues lists the distinct values of a span attribute, resource
+// attribute or intrinsic, as text and sorted. Booleans are listed as true and
+// false. Span attributes listed in SetIndexedAttributes are read from the
+// attribute index; others are read from the spans themselves.
+func (s *Store) AttributeValues(ctx context.Context, opts AttributeValuesOptions) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	spans := s.scoped(ctx, "spans", s.source("spans", spanSourceColumns))
+	where := "1=1"
+	var whereArgs []interface{}
+	if opts.ServiceName != "" {
+		where += " AND service_name = ?"
+		whereArgs = append(whereArgs, opts.ServiceName)
+	}
+	if opts.MinStartTime > 0 {
+		where += " AND start_time_unix_nano >= ?"
+		whereArgs = append(whereArgs, opts.MinStartTime)
+	}
+	if opts.MaxStartTime > 0 {
+		where += " AND start_time_unix_nano <= ?"
+		whereArgs = append(whereArgs, opts.MaxStartTime)
+	}
+
+	var query string
+	var args []interface{}
+	if opts.Field.Scope == ScopeSpan && s.indexedAttrs[opts.Field.Name] && len(s.attached) == 0 {
+		query = "SELECT DISTINCT a.attr_value FROM span_attributes a JOIN " + spans + " s ON s.id = a.span_rowid" +
+			" WHERE a.attr_key = ? AND a.attr_value IS NOT NULL AND " + where + " ORDER BY 1"
+		args = append(append(args, opts.Field.Name), whereArgs...)
+	} else {
+		expr, exprArgs, err := attributeValueExpr(opts.Field)
+		if err != nil {
+			return nil, err
+		}
+		recent := "SELECT * FROM " + spans + " WHERE " + where
+		if opts.ScanLimit > 0 {
+			recent += " ORDER BY start_time_unix_nano DESC LIMIT ?"
+			whereArgs = append(whereArgs, opts.ScanLimit)
+		}
+		query = "SELECT DISTINCT v FROM (SELECT " + expr + " AS v FROM (" + recent + ")) WHERE v IS NOT NULL ORDER BY v"
+		args = append(append(args, exprArgs...), whereArgs...)
+	}
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attribute values: %w", err)
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// attributeValueExpr returns the SQL expression reading field from a spans
+// row as text, rendering JSON booleans as the attribute index does
+func attributeValueExpr(field SpanField) (string, []interface{}, error) {
+	expr, args, err := spanFieldExpr(field)
+	if err != nil {
+		return "", nil, err
+	}
+	text := func(path string) (string, []interface{}) {
+		return attrDocumentValue(spanDocumentExpr), []interface{}{path, path}
+	}
+	switch {
+	case field.Scope == ScopeSpan || (field.Scope == ScopeResource && len(args) == 1):
+		expr, args := text(args[0].(string))
+		return expr, args, nil
+	case field.Scope == ScopeAny && len(args) == 2:
+		span, spanArgs := text(args[0].(string))
+		resource, resourceArgs := text(args[1].(string))
+		return "COALESCE(" + span + ", " + resource + ")", append(spanArgs, resourceArgs...), nil
+	}
+	return "CAST(" + expr + " AS TEXT)", args, nil
+}
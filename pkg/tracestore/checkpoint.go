@@ -0,0 +1,71 @@
+package tracestore
+
+import (
+	"context"
+	"os"
+)
+
+// WALCheckpointResult reports a checkpoint run by CheckpointWAL
+type WALCheckpointResult struct {
+	// WALBytesBefore and WALBytesAfter are the -wal file sizes around the
+	// checkpoint
+	WALBytesBefore int64
+	WALBytesAfter  int64
+	// LogFrames and CheckpointedFrames are the WAL frames found and copied
+	// into the database by the passive pass
+	LogFrames          int64
+	CheckpointedFrames int64
+	// Busy is set when the WAL could not be truncated, e.g. because a reader
+	// outside the store held a snapshot; the next run tries again
+	Busy bool
+}
+
+// WALSize returns the size of the database's -wal file in bytes, or 0 when
+// there is none.
+func (s *Store) WALSize() (int64, error) {
+	fi, err := os.Stat(s.dbPath + "-wal")
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// CheckpointWAL checkpoints and truncates the WAL if it has grown past
+// maxBytes, returning nil when it is smaller. SQLite's automatic checkpoints
+// copy frames back but never shrink the file, and cannot complete while
+// readers keep it busy, so without this the -wal file of a long-running
+// store only grows.
+//
+// The frames are first copied in a passive checkpoint, which runs alongside
+// reads and writes. The truncate that follows takes the store's write lock so
+// no reader holds the WAL open, and by then has little left to copy.
+func (s *Store) CheckpointWAL(ctx context.Context, maxBytes int64) (*WALCheckpointResult, error) {
+	size, err := s.WALSize()
+	if err != nil || size <= maxBytes {
+		return nil, err
+	}
+	result := &WALCheckpointResult{WALBytesBefore: size}
+
+	var busy int
+	err = s.db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &result.LogFrames, &result.CheckpointedFrames)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var log, checkpointed int64
+	err = s.db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &log, &checkpointed)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	result.Busy = busy != 0
+
+	if result.WALBytesAfter, err = s.WALSize(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,277 @@
+package tracestore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// traceBlobsSchema holds traces merged by CompactTraces: one row per trace
+// with its spans in a gzip-compressed JSON array, replacing the per-span rows.
+// created_at is that of the newest span, so retention treats the trace as one
+// unit.
+const traceBlobsSchema = `
+	CREATE TABLE IF NOT EXISTS trace_blobs (
+		trace_id TEXT NOT NULL,
+		tenant TEXT NOT NULL DEFAULT '',
+		span_count INTEGER NOT NULL,
+		start_time_unix_nano INTEGER NOT NULL,
+		end_time_unix_nano INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		spans BLOB NOT NULL,
+		PRIMARY KEY (trace_id, tenant)
+	);
+	CREATE INDEX IF NOT EXISTS idx_trace_blobs_created_at ON trace_blobs(created_at);
+	`
+
+// blobSpan is one span in a trace blob. Start orders the spans of a trace
+// when late rows are merged with the blob.
+type blobSpan struct {
+	Start   int64           `json:"start"`
+	Header  json.RawMessage `json:"header"`
+	Payload []byte          `json:"payload,omitempty"`
+}
+
+// CompactionResult reports a run of CompactTraces
+type CompactionResult struct {
+	// Traces is the number of traces written to (or merged into) blobs
+	Traces int64
+	// Spans is the number of span rows they replaced
+	Spans int64
+}
+
+// CompactTraces merges the spans of complete traces into a single compressed
+// row in trace_blobs and deletes their span rows. A trace is complete once
+// none of its spans was stored in the last after; candidates are taken from
+// the oldest limit span rows. A span arriving for a trace already compacted
+// is merged into its blob on a later run.
+//
+// Compacted traces are still returned by QueryTraceByID, QueryTracesByIDs and
+// QueryEncodedTrace, and keep their trace summary, so SearchTraces and
+// CountTraces still match them by service, status, duration, time and indexed
+// attributes. They no longer match the other search filters, span queries or
+// the background span joins, so after should be longer than the window those
+// are used over.
+func (s *Store) CompactTraces(ctx context.Context, now time.Time, after time.Duration, limit int) (CompactionResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result CompactionResult
+	cutoff := now.Add(-after).Unix()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT c.trace_id, c.tenant FROM (
+			SELECT trace_id, tenant FROM spans
+			WHERE created_at < ? AND trace_id IS NOT NULL
+			ORDER BY created_at LIMIT ?
+		) c
+		WHERE NOT EXISTS (
+			SELECT 1 FROM spans n WHERE n.trace_id = c.trace_id AND n.tenant = c.tenant AND n.created_at >= ?
+		)`, cutoff, limit, cutoff)
+	if err != nil {
+		return result, err
+	}
+	type traceKey struct{ traceID, tenant string }
+	var traces []traceKey
+	for rows.Next() {
+		var k traceKey
+		if err := rows.Scan(&k.traceID, &k.tenant); err != nil {
+			rows.Close()
+			return result, err
+		}
+		traces = append(traces, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, k := range traces {
+		n, err := compactTrace(ctx, tx, k.traceID, k.tenant)
+		if err != nil {
+			return result, fmt.Errorf("failed to compact trace %s: %w", k.traceID, err)
+		}
+		result.Traces++
+		result.Spans += n
+	}
+	return result, tx.Commit()
+}
+
+// compactTrace moves the span rows of one trace into its blob, merging them
+// with the spans already there, and returns the number of rows moved
+func compactTrace(ctx context.Context, tx *sql.Tx, traceID, tenant string) (int64, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT data, payload, start_time_unix_nano, end_time_unix_nano, created_at FROM spans WHERE trace_id = ? AND tenant = ?",
+		traceID, tenant)
+	if err != nil {
+		return 0, err
+	}
+	var spans []blobSpan
+	var startNs, endNs, createdAt int64
+	for rows.Next() {
+		var data string
+		var payload []byte
+		var start, end, created sql.NullInt64
+		if err := rows.Scan(&data, &payload, &start, &end, &created); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		spans = append(spans, blobSpan{Start: start.Int64, Header: json.RawMessage(data), Payload: payload})
+		if startNs == 0 || (start.Valid && start.Int64 < startNs) {
+			startNs = start.Int64
+		}
+		endNs = max(endNs, end.Int64)
+		createdAt = max(createdAt, created.Int64)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	moved := int64(len(spans))
+
+	var blob []byte
+	var blobStart, blobEnd, blobCreated int64
+	err = tx.QueryRowContext(ctx,
+		"SELECT spans, start_time_unix_nano, end_time_unix_nano, created_at FROM trace_blobs WHERE trace_id = ? AND tenant = ?",
+		traceID, tenant).Scan(&blob, &blobStart, &blobEnd, &blobCreated)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return 0, err
+	default:
+		existing, err := decodeTraceBlob(blob)
+		if err != nil {
+			return 0, err
+		}
+		spans = append(existing, spans...)
+		startNs = min(startNs, blobStart)
+		endNs = max(endNs, blobEnd)
+		createdAt = max(createdAt, blobCreated)
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+
+	if blob, err = encodeTraceBlob(spans); err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT OR REPLACE INTO trace_blobs (trace_id, tenant, span_count, start_time_unix_nano, end_time_unix_nano, created_at, spans)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		traceID, tenant, len(spans), startNs, endNs, createdAt, blob)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM spans WHERE trace_id = ? AND tenant = ?", traceID, tenant); err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+func encodeTraceBlob(spans []blobSpan) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(spans); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeTraceBlob(blob []byte) ([]blobSpan, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace blob: %w", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace blob: %w", err)
+	}
+	var spans []blobSpan
+	if err := json.Unmarshal(data, &spans); err != nil {
+		return nil, fmt.Errorf("invalid trace blob: %w", err)
+	}
+	return spans, nil
+}
+
+// encodedTraces returns the stored spans of each trace, ordered by start
+// time, from both span rows and trace blobs. Traces with no stored spans are
+// absent from the map. Callers hold s.mu.
+func (s *Store) encodedTraces(ctx context.Context, traceIDs []string) (map[string][]blobSpan, error) {
+	traces := make(map[string][]blobSpan)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(traceIDs)), ",")
+	args := make([]interface{}, len(traceIDs))
+	for i, id := range traceIDs {
+		args[i] = id
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT trace_id, data, payload, start_time_unix_nano FROM "+s.scoped(ctx, "spans", s.source("spans", spanSourceColumns))+" WHERE trace_id IN ("+placeholders+") ORDER BY trace_id, start_time_unix_nano",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var traceID, data string
+		var payload []byte
+		var start sql.NullInt64
+		if err := rows.Scan(&traceID, &data, &payload, &start); err != nil {
+			return nil, err
+		}
+		traces[traceID] = append(traces[traceID], blobSpan{Start: start.Int64, Header: json.RawMessage(data), Payload: payload})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query := "SELECT trace_id, spans FROM trace_blobs WHERE trace_id IN (" + placeholders + ")"
+	if tenant, ok := TenantFromContext(ctx); ok {
+		query += " AND tenant = " + sqlString(tenant)
+	}
+	blobs, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer blobs.Close()
+
+	for blobs.Next() {
+		var traceID string
+		var blob []byte
+		if err := blobs.Scan(&traceID, &blob); err != nil {
+			return nil, err
+		}
+		spans, err := decodeTraceBlob(blob)
+		if err != nil {
+			return nil, err
+		}
+		merged := append(spans, traces[traceID]...)
+		sort.SliceStable(merged, func(i, j int) bool { return merged[i].Start < merged[j].Start })
+		traces[traceID] = merged
+	}
+	return traces, blobs.Err()
+}
+
+// cleanupTraceBlobs deletes compacted traces whose newest span is older than
+// cutoff. Callers hold s.mu.
+func (s *Store) cleanupTraceBlobs(ctx context.Context, cutoff int64) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM trace_blobs WHERE created_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,27 @@
+// Package tracestore provides a SQLite-based storage backend for traces and
+// metrics using WAL mode and JSON virtual columns with indexes for efficient
+// querying.
+//
+// It is the same store the sqlite exporter writes to, and has no dependency on
+// the exporter or the collector, so other tools can open a gotel database and
+// query it directly instead of going through the HTTP API:
+//
+//	store, err := tracestore.New("gotel.db")
+//	if err != nil {
+//		return err
+//	}
+//	defer store.Close()
+//
+//	for span, err := range store.IterSpansByTime(ctx, tracestore.SpanTimeQueryOptions{ServiceName: "api"}) {
+//		if err != nil {
+//			return err
+//		}
+//		// ...
+//	}
+//
+// The exported API follows APIVersion: within a version, exported names and
+// the meaning of their fields are only ever added to, never changed or removed.
+package tracestore
+
+// APIVersion identifies the compatibility level of the exported API.
+const APIVersion = "v1"
@@ -0,0 +1,229 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// EncodedSpan is a span stored in the compact format: Payload holds the span
+// in a binary encoding chosen by the writer (the sqlite exporter uses OTLP
+// protobuf), and Header is a small JSON document with the fields the indexed
+// columns are extracted from (trace_id, span_id, parent_span_id,
+// service_name, span_name, start/end_time_unix_nano, status.code,
+// resource."service.version", resource."deployment.environment", scope.name).
+//
+// A span with no Payload is a plain JSON span and Header is the full document.
+type EncodedSpan struct {
+	Header  json.RawMessage
+	Payload []byte
+}
+
+// SpanDecoder turns an encoded span back into the full JSON document that
+// read methods return.
+type SpanDecoder func(header json.RawMessage, payload []byte) (json.RawMessage, error)
+
+// SetSpanDecoder sets the decoder used by read methods for encoded spans.
+// Without one, encoded spans are returned as their header only.
+func (s *Store) SetSpanDecoder(decode SpanDecoder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decoder = decode
+}
+
+// decodeSpan returns the JSON document for a stored row. Callers hold s.mu.
+func (s *Store) decodeSpan(data string, payload []byte) (json.RawMessage, error) {
+	if payload == nil {
+		return s.upgradeSpan(json.RawMessage(data)), nil
+	}
+	if s.decoder == nil {
+		return json.RawMessage(data), nil
+	}
+	return s.decoder(json.RawMessage(data), payload)
+}
+
+// spanDocumentExpr is the full JSON document of a spans row in SQL, for
+// reading fields an encoded row's header leaves out. JSON rows are read as
+// they are; encoded rows are decoded by the span_document function.
+const spanDocumentExpr = "CASE WHEN payload IS NULL THEN data ELSE span_document(data, payload) END"
+
+// spanDocumentSQL implements the span_document SQL function with decodeSpan.
+// It runs inside the queries of methods that hold s.mu.
+func (s *Store) spanDocumentSQL(data string, payload []byte) (string, error) {
+	doc, err := s.decodeSpan(data, payload)
+	return string(doc), err
+}
+
+// migrateSpanPayload adds the payload column to databases created before the
+// compact format existed.
+func (s *Store) migrateSpanPayload() error {
+	has, err := hasSpanPayload(s.db, "main")
+	if err != nil || has {
+		return err
+	}
+	if _, err := s.db.Exec("ALTER TABLE spans ADD COLUMN payload BLOB"); err != nil {
+		return fmt.Errorf("failed to add spans.payload column: %w", err)
+	}
+	return nil
+}
+
+func hasSpanPayload(db *sql.DB, schema string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('spans', ?) WHERE name = 'payload'", schema).Scan(&n)
+	return n > 0, err
+}
+
+// InsertEncodedData stores spans, encoded or not, and metrics in a single
+// transaction. With write batching enabled, the transaction may be shared
+// with concurrent calls; see SetWriteBatching.
+func (s *Store) InsertEncodedData(ctx context.Context, spans []EncodedSpan, metrics []MetricRecord) error {
+	if b := s.batcher; b != nil {
+		return b.write(ctx, spans, metrics)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertEncoded(ctx, tx, spans, metrics); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertEncoded adds spans and metrics to an open transaction
+func insertEncoded(ctx context.Context, tx *sql.Tx, spans []EncodedSpan, metrics []MetricRecord) error {
+	if len(spans) > 0 {
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO spans (data, payload) VALUES (?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, span := range spans {
+			if _, err := stmt.ExecContext(ctx, string(span.Header), span.Payload); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(metrics) > 0 {
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO metrics (name, value, timestamp, tags, exemplar_trace_id) VALUES (?, ?, ?, ?, NULLIF(?, ''))")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, m := range metrics {
+			if _, err := stmt.ExecContext(ctx, m.Name, m.Value, m.Timestamp, m.Tags, m.ExemplarTraceID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// QueryEncodedTrace returns the stored rows of a trace without decoding them,
+// ordered by start time, so encoded payloads can be served as-is.
+func (s *Store) QueryEncodedTrace(ctx context.Context, traceID string) ([]EncodedSpan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	traces, err := s.encodedTraces(ctx, []string{traceID})
+	if err != nil {
+		return nil, err
+	}
+	var spans []EncodedSpan
+	for _, stored := range traces[traceID] {
+		spans = append(spans, EncodedSpan{Header: stored.Header, Payload: stored.Payload})
+	}
+	return spans, nil
+}
+
+// ConvertResult reports one ConvertSpans batch.
+type ConvertResult struct {
+	// LastID is the highest row ID examined; pass it as afterID to continue.
+	LastID    int64
+	Converted int
+	// Skipped counts rows the convert function failed on; they are left as is.
+	Skipped int
+}
+
+// ConvertSpans rewrites up to limit spans with a row ID above afterID that are
+// stored in the other format: plain JSON rows when toEncoded is set, encoded
+// rows otherwise. convert receives the stored row and returns its
+// replacement, which must have a Payload when toEncoded is set and none
+// otherwise. A batch with no examined rows (LastID == afterID) means the
+// conversion is complete.
+func (s *Store) ConvertSpans(ctx context.Context, toEncoded bool, afterID int64, limit int, convert func(EncodedSpan) (EncodedSpan, error)) (ConvertResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := ConvertResult{LastID: afterID}
+	where := "payload IS NOT NULL"
+	if toEncoded {
+		where = "payload IS NULL"
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id, data, payload FROM spans WHERE id > ? AND "+where+" ORDER BY id LIMIT ?",
+		afterID, limit)
+	if err != nil {
+		return result, err
+	}
+	type rewrite struct {
+		id   int64
+		span EncodedSpan
+	}
+	var rewrites []rewrite
+	for rows.Next() {
+		var id int64
+		var data string
+		var payload []byte
+		if err := rows.Scan(&id, &data, &payload); err != nil {
+			rows.Close()
+			return result, err
+		}
+		result.LastID = id
+		converted, err := convert(EncodedSpan{Header: json.RawMessage(data), Payload: payload})
+		if err != nil || (converted.Payload != nil) != toEncoded {
+			result.Skipped++
+			continue
+		}
+		rewrites = append(rewrites, rewrite{id, converted})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	if len(rewrites) > 0 {
+		stmt, err := tx.PrepareContext(ctx, "UPDATE spans SET data = ?, payload = ? WHERE id = ?")
+		if err != nil {
+			return result, err
+		}
+		defer stmt.Close()
+		for _, rw := range rewrites {
+			if _, err := stmt.ExecContext(ctx, string(rw.span.Header), rw.span.Payload, rw.id); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	result.Converted = len(rewrites)
+	return result, nil
+}
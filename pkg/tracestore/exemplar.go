@@ -0,0 +1,74 @@
+package tracestore
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrateMetricExemplar adds metrics.exemplar_trace_id to databases created
+// before metric points carried exemplars.
+func (s *Store) migrateMetricExemplar() error {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_xinfo('metrics') WHERE name = 'exemplar_trace_id'").Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	if _, err := s.db.Exec("ALTER TABLE metrics ADD COLUMN exemplar_trace_id TEXT"); err != nil {
+		return fmt.Errorf("failed to add metrics.exemplar_trace_id column: %w", err)
+	}
+	return nil
+}
+
+// QueryMetricExemplars returns the raw metric points matching opts that
+// carry an exemplar trace ID, ordered by timestamp. Resolution is ignored:
+// rollups do not keep exemplars, and neither are they read from attached
+// databases, which may predate the column.
+func (s *Store) QueryMetricExemplars(ctx context.Context, opts MetricQueryOptions) ([]MetricRecord, error) {
+	query := "SELECT id, name, value, timestamp, tags, exemplar_trace_id FROM " + s.scoped(ctx, "metrics", "metrics") +
+		" WHERE exemplar_trace_id IS NOT NULL"
+	var args []interface{}
+	if opts.Name != "" {
+		if opts.NamePattern {
+			query += " AND name LIKE ? ESCAPE '\\'"
+		} else {
+			query += " AND name = ?"
+		}
+		args = append(args, opts.Name)
+	}
+	if opts.Service != "" {
+		query += " AND service = ?"
+		args = append(args, opts.Service)
+	}
+	if opts.MinTime > 0 {
+		query += " AND timestamp >= ?"
+		args = append(args, opts.MinTime)
+	}
+	if opts.MaxTime > 0 {
+		query += " AND timestamp <= ?"
+		args = append(args, opts.MaxTime)
+	}
+	query += " ORDER BY timestamp"
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metrics []MetricRecord
+	for rows.Next() {
+		var m MetricRecord
+		if err := rows.Scan(&m.ID, &m.Name, &m.Value, &m.Timestamp, &m.Tags, &m.ExemplarTraceID); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rows.Err()
+}
@@ -0,0 +1,227 @@
+package tracestore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// incidentsSchema records the snapshots taken into an incidents database.
+// The spans themselves go into its regular spans table, so the file can be
+// opened or attached like any other gotel database.
+const incidentsSchema = `
+	CREATE TABLE IF NOT EXISTS incidents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service_name TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		detected_at INTEGER NOT NULL,
+		-- Evaluated window, Unix nanoseconds on span start time
+		window_start INTEGER NOT NULL,
+		window_end INTEGER NOT NULL,
+		span_count INTEGER NOT NULL,
+		error_count INTEGER NOT NULL,
+		p95_duration_ns INTEGER NOT NULL,
+		trace_count INTEGER NOT NULL,
+		-- Spans copied; traces already copied by an earlier incident add none
+		copied_spans INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_incidents_detected_at ON incidents(detected_at);
+	`
+
+// incidentSnapshotSchema is the name the incidents database is attached as
+// while SnapshotIncident copies into it.
+const incidentSnapshotSchema = "incident_snapshot"
+
+// ServiceWindowStats summarizes one service's spans over a time window
+type ServiceWindowStats struct {
+	ServiceName   string
+	SpanCount     int64
+	ErrorCount    int64
+	P95DurationNs int64
+}
+
+// Incident is a threshold breach and the traces copied for it
+type Incident struct {
+	ID            int64     `json:"id"`
+	ServiceName   string    `json:"service_name"`
+	Reason        string    `json:"reason"`
+	DetectedAt    time.Time `json:"detected_at"`
+	WindowStart   int64     `json:"window_start"`
+	WindowEnd     int64     `json:"window_end"`
+	SpanCount     int64     `json:"span_count"`
+	ErrorCount    int64     `json:"error_count"`
+	P95DurationNs int64     `json:"p95_duration_ns"`
+	TraceCount    int64     `json:"trace_count"`
+	CopiedSpans   int64     `json:"copied_spans"`
+}
+
+// OpenIncidents opens or creates an incidents database: a regular store with
+// an incidents table.
+func OpenIncidents(dbPath string) (*Store, error) {
+	store, err := New(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.db.Exec(incidentsSchema); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to create incidents table: %w", err)
+	}
+	return store, nil
+}
+
+// ServiceWindowStats returns span and error counts and the nearest-rank p95
+// duration of every service with spans starting in [minStartTime,
+// maxStartTime) (Unix nanoseconds).
+func (s *Store) ServiceWindowStats(ctx context.Context, minStartTime, maxStartTime int64) ([]ServiceWindowStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT service_name, n, errors, duration_ns FROM (
+			SELECT COALESCE(service_name, '') AS service_name, COALESCE(duration_ns, 0) AS duration_ns,
+				ROW_NUMBER() OVER (PARTITION BY service_name ORDER BY duration_ns) AS rn,
+				COUNT(*) OVER (PARTITION BY service_name) AS n,
+				SUM(CASE WHEN status_code = 2 THEN 1 ELSE 0 END) OVER (PARTITION BY service_name) AS errors
+			FROM spans WHERE start_time_unix_nano >= ? AND start_time_unix_nano < ?)
+		WHERE rn = (95 * n + 99) / 100
+		ORDER BY service_name`,
+		minStartTime, maxStartTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []ServiceWindowStats{}
+	for rows.Next() {
+		var st ServiceWindowStats
+		if err := rows.Scan(&st.ServiceName, &st.SpanCount, &st.ErrorCount, &st.P95DurationNs); err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+// SnapshotIncident copies up to maxTraces full traces touching
+// inc.ServiceName within its window into the incidents database at
+// incidentsPath (see OpenIncidents), error traces first and then the
+// slowest, and records the incident there. Spans the incidents database
+// already holds are skipped, so a breach lasting several windows keeps
+// adding only new traces. It returns the incident with its ID and counts.
+func (s *Store) SnapshotIncident(ctx context.Context, incidentsPath string, inc Incident, maxTraces int) (Incident, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// ATTACH only applies to the connection it runs on
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return inc, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+incidentSnapshotSchema, incidentsPath); err != nil {
+		return inc, fmt.Errorf("failed to attach incidents database: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "DETACH DATABASE "+incidentSnapshotSchema)
+
+	rows, err := conn.QueryContext(ctx, `
+		SELECT trace_id FROM main.spans
+		WHERE service_name = ? AND start_time_unix_nano >= ? AND start_time_unix_nano < ? AND trace_id IS NOT NULL
+		GROUP BY trace_id
+		ORDER BY MAX(CASE WHEN status_code = 2 THEN 1 ELSE 0 END) DESC, MAX(duration_ns) DESC
+		LIMIT ?`,
+		inc.ServiceName, inc.WindowStart, inc.WindowEnd, maxTraces)
+	if err != nil {
+		return inc, err
+	}
+	var traceIDs []interface{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return inc, err
+		}
+		traceIDs = append(traceIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return inc, err
+	}
+	inc.TraceCount = int64(len(traceIDs))
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return inc, err
+	}
+	defer tx.Rollback()
+
+	if len(traceIDs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(traceIDs)), ",")
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO `+incidentSnapshotSchema+`.spans (data, payload)
+			SELECT s.data, s.payload FROM main.spans s
+			WHERE s.trace_id IN (`+placeholders+`)
+			AND NOT EXISTS (SELECT 1 FROM `+incidentSnapshotSchema+`.spans t WHERE t.trace_id = s.trace_id AND t.span_id = s.span_id)`,
+			traceIDs...)
+		if err != nil {
+			return inc, fmt.Errorf("failed to copy incident traces: %w", err)
+		}
+		if inc.CopiedSpans, err = res.RowsAffected(); err != nil {
+			return inc, err
+		}
+	}
+
+	if inc.DetectedAt.IsZero() {
+		inc.DetectedAt = time.Now()
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO `+incidentSnapshotSchema+`.incidents (service_name, reason, detected_at, window_start, window_end,
+			span_count, error_count, p95_duration_ns, trace_count, copied_spans)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		inc.ServiceName, inc.Reason, inc.DetectedAt.UnixNano(), inc.WindowStart, inc.WindowEnd,
+		inc.SpanCount, inc.ErrorCount, inc.P95DurationNs, inc.TraceCount, inc.CopiedSpans)
+	if err != nil {
+		return inc, fmt.Errorf("failed to record incident: %w", err)
+	}
+	if inc.ID, err = res.LastInsertId(); err != nil {
+		return inc, err
+	}
+	return inc, tx.Commit()
+}
+
+// ListIncidents returns the incidents recorded in an incidents database,
+// newest first.
+func (s *Store) ListIncidents(ctx context.Context, limit int) ([]Incident, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := `SELECT id, service_name, reason, detected_at, window_start, window_end,
+		span_count, error_count, p95_duration_ns, trace_count, copied_spans
+		FROM incidents ORDER BY detected_at DESC, id DESC`
+	args := []interface{}{}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	incidents := []Incident{}
+	for rows.Next() {
+		var inc Incident
+		var detectedAt int64
+		if err := rows.Scan(&inc.ID, &inc.ServiceName, &inc.Reason, &detectedAt, &inc.WindowStart, &inc.WindowEnd,
+			&inc.SpanCount, &inc.ErrorCount, &inc.P95DurationNs, &inc.TraceCount, &inc.CopiedSpans); err != nil {
+			return nil, err
+		}
+		inc.DetectedAt = time.Unix(0, detectedAt)
+		incidents = append(incidents, inc)
+	}
+	return incidents, rows.Err()
+}
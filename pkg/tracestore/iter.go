@@ -0,0 +1,79 @@
+package tracestore
+
+import (
+	"context"
+	"encoding/json"
+	"iter"
+)
+
+// IterSpansByTime streams spans matching opts instead of loading them all into
+// memory. Iteration stops when the loop breaks, when ctx is cancelled (the
+// cancellation error is yielded last), or on the first query error.
+//
+// The store's read lock is held while iterating, so the loop body must not
+// call write methods (InsertData, Cleanup, ...) on the same Store.
+func (s *Store) IterSpansByTime(ctx context.Context, opts SpanTimeQueryOptions) iter.Seq2[json.RawMessage, error] {
+	return func(yield func(json.RawMessage, error) bool) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		query, args := spansByTimeQuery(s.scoped(ctx, "spans", "spans"), opts)
+		rows, err := s.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var data string
+			var payload []byte
+			if err := rows.Scan(&data, &payload); err != nil {
+				yield(nil, err)
+				return
+			}
+			span, err := s.decodeSpan(data, payload)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(span, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// IterMetrics streams metric records matching opts. It follows the same
+// cancellation and locking rules as IterSpansByTime.
+func (s *Store) IterMetrics(ctx context.Context, opts MetricQueryOptions) iter.Seq2[MetricRecord, error] {
+	return func(yield func(MetricRecord, error) bool) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		query, args := metricsQuery(s.metricSources(ctx), opts)
+		rows, err := s.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			yield(MetricRecord{}, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var m MetricRecord
+			if err := rows.Scan(&m.ID, &m.Name, &m.Value, &m.Timestamp, &m.Tags); err != nil {
+				yield(MetricRecord{}, err)
+				return
+			}
+			if !yield(m, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(MetricRecord{}, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package tracestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// logsSchema stores log records as JSON with virtual indexed columns, like spans
+const logsSchema = `
+	CREATE TABLE IF NOT EXISTS logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		data TEXT NOT NULL,
+		created_at INTEGER DEFAULT (strftime('%s', 'now')),
+
+		-- Virtual generated columns extracted from JSON for indexing
+		timestamp_unix_nano INTEGER GENERATED ALWAYS AS (json_extract(data, '$.timestamp_unix_nano')) VIRTUAL,
+		severity_number INTEGER GENERATED ALWAYS AS (json_extract(data, '$.severity_number')) VIRTUAL,
+		severity_text TEXT GENERATED ALWAYS AS (json_extract(data, '$.severity_text')) VIRTUAL,
+		service_name TEXT GENERATED ALWAYS AS (json_extract(data, '$.service_name')) VIRTUAL,
+		trace_id TEXT GENERATED ALWAYS AS (json_extract(data, '$.trace_id')) VIRTUAL,
+		span_id TEXT GENERATED ALWAYS AS (json_extract(data, '$.span_id')) VIRTUAL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_logs_timestamp ON logs(timestamp_unix_nano);
+	CREATE INDEX IF NOT EXISTS idx_logs_service_timestamp ON logs(service_name, timestamp_unix_nano);
+	CREATE INDEX IF NOT EXISTS idx_logs_trace_id ON logs(trace_id);
+	CREATE INDEX IF NOT EXISTS idx_logs_severity ON logs(severity_number);
+	CREATE INDEX IF NOT EXISTS idx_logs_created_at ON logs(created_at);
+	`
+
+// LogRecord is a stored log record
+type LogRecord struct {
+	ID int64 `json:"id"`
+	// Timestamp is the record time in Unix nanoseconds
+	Timestamp int64           `json:"timestamp_unix_nano"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// LogQueryOptions filters QueryLogs. Time bounds are Unix nanoseconds.
+type LogQueryOptions struct {
+	ServiceName  string
+	TraceID      string
+	SpanID       string
+	SeverityText string // matched case-insensitively
+	MinSeverity  int    // minimum OTLP severity number
+	MaxSeverity  int    // maximum OTLP severity number
+	// Contains lists substrings the record body must all contain
+	Contains     []string
+	MinTimestamp int64
+	MaxTimestamp int64
+	Limit        int
+	// Ascending returns the oldest records first instead of the newest
+	Ascending bool
+}
+
+// logLabelColumns maps the labels ListLogLabelValues accepts to their columns
+var logLabelColumns = map[string]string{
+	"service_name":  "service_name",
+	"severity_text": "severity_text",
+	"trace_id":      "trace_id",
+}
+
+// InsertLogs stores log records as raw JSON in a single transaction
+func (s *Store) InsertLogs(ctx context.Context, logs [][]byte) error {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO logs (data) VALUES (?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, l := range logs {
+		if _, err := stmt.ExecContext(ctx, string(l)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// QueryLogs searches log records with filters, newest first unless
+// opts.Ascending is set.
+func (s *Store) QueryLogs(ctx context.Context, opts LogQueryOptions) ([]LogRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := "SELECT id, COALESCE(timestamp_unix_nano, 0), data FROM logs WHERE 1=1"
+	args := []interface{}{}
+
+	if opts.ServiceName != "" {
+		query += " AND service_name = ?"
+		args = append(args, opts.ServiceName)
+	}
+	if opts.TraceID != "" {
+		query += " AND trace_id = ?"
+		args = append(args, opts.TraceID)
+	}
+	if opts.SpanID != "" {
+		query += " AND span_id = ?"
+		args = append(args, opts.SpanID)
+	}
+	if opts.SeverityText != "" {
+		query += " AND severity_text = ? COLLATE NOCASE"
+		args = append(args, opts.SeverityText)
+	}
+	if opts.MinSeverity > 0 {
+		query += " AND severity_number >= ?"
+		args = append(args, opts.MinSeverity)
+	}
+	if opts.MaxSeverity > 0 {
+		query += " AND severity_number <= ?"
+		args = append(args, opts.MaxSeverity)
+	}
+	for _, substr := range opts.Contains {
+		query += " AND instr(CAST(json_extract(data, '$.body') AS TEXT), ?) > 0"
+		args = append(args, substr)
+	}
+	if opts.MinTimestamp > 0 {
+		query += " AND timestamp_unix_nano >= ?"
+		args = append(args, opts.MinTimestamp)
+	}
+	if opts.MaxTimestamp > 0 {
+		query += " AND timestamp_unix_nano <= ?"
+		args = append(args, opts.MaxTimestamp)
+	}
+
+	if opts.Ascending {
+		query += " ORDER BY timestamp_unix_nano ASC, id ASC"
+	} else {
+		query += " ORDER BY timestamp_unix_nano DESC, id DESC"
+	}
+
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []LogRecord
+	for rows.Next() {
+		var rec LogRecord
+		var data string
+		if err := rows.Scan(&rec.ID, &rec.Timestamp, &data); err != nil {
+			return nil, err
+		}
+		rec.Data = json.RawMessage(data)
+		logs = append(logs, rec)
+	}
+	return logs, rows.Err()
+}
+
+// ListLogLabelValues returns the distinct values of an indexed log label:
+// service_name, severity_text or trace_id.
+func (s *Store) ListLogLabelValues(ctx context.Context, label string) ([]string, error) {
+	column, ok := logLabelColumns[strings.ToLower(label)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported log label %q", label)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT DISTINCT "+column+" FROM logs WHERE "+column+" IS NOT NULL AND "+column+" != '' ORDER BY "+column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,93 @@
+package tracestore
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// MetricSeries is one distinct metric name and tag set
+type MetricSeries struct {
+	Name string
+	Tags string // JSON object, '{}' when the points have no tags
+}
+
+// MetricSeriesOptions filters ListMetricSeries
+type MetricSeriesOptions struct {
+	// Name restricts results to one metric name
+	Name string
+	// TagEquals restricts results to series whose tags hold these values
+	TagEquals map[string]string
+	MinTime   int64
+	MaxTime   int64
+	Limit     int
+}
+
+// tagPath is the json_extract path of a tag key; quoting it lets keys hold
+// dots, as OpenTelemetry attribute names do.
+func tagPath(key string) string {
+	return `$."` + key + `"`
+}
+
+// ListMetricSeries returns the distinct name and tag sets of metric points in
+// [MinTime, MaxTime], from the raw table and both rollup tables, ordered by
+// name and tags. It backs Graphite's tag API, where a series is identified by
+// its name and tags rather than by name alone.
+func (s *Store) ListMetricSeries(ctx context.Context, opts MetricSeriesOptions) ([]MetricSeries, error) {
+	var filter string
+	var filterArgs []interface{}
+	if opts.Name != "" {
+		filter += " AND name = ?"
+		filterArgs = append(filterArgs, opts.Name)
+	}
+	keys := make([]string, 0, len(opts.TagEquals))
+	for k := range opts.TagEquals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		filter += " AND json_extract(tags, ?) = ?"
+		filterArgs = append(filterArgs, tagPath(k), opts.TagEquals[k])
+	}
+	if opts.MinTime > 0 {
+		filter += " AND timestamp >= ?"
+		filterArgs = append(filterArgs, opts.MinTime)
+	}
+	if opts.MaxTime > 0 {
+		filter += " AND timestamp <= ?"
+		filterArgs = append(filterArgs, opts.MaxTime)
+	}
+
+	src := s.metricSources(ctx)
+	sources := []string{src.raw, src.minute, src.hour}
+	parts := make([]string, len(sources))
+	var args []interface{}
+	for i, src := range sources {
+		parts[i] = "SELECT name, COALESCE(tags, '{}') FROM " + src + " WHERE 1=1" + filter
+		args = append(args, filterArgs...)
+	}
+	query := strings.Join(parts, " UNION ") + " ORDER BY 1, 2"
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var series []MetricSeries
+	for rows.Next() {
+		var m MetricSeries
+		if err := rows.Scan(&m.Name, &m.Tags); err != nil {
+			return nil, err
+		}
+		series = append(series, m)
+	}
+	return series, rows.Err()
+}
@@ -0,0 +1,112 @@
+package tracestore
+
+import (
+	"context"
+	"fmt"
+)
+
+// REDGroupBy values for REDQueryOptions.GroupBy
+const (
+	REDGroupNone      = ""
+	REDGroupService   = "service"
+	REDGroupOperation = "operation"
+)
+
+// REDQueryOptions filters REDSummaries. Time bounds are Unix nanoseconds on
+// span start time.
+type REDQueryOptions struct {
+	ServiceName string
+	// Kind keeps spans of one kind as stored, such as "Server"; empty keeps
+	// every span
+	Kind         string
+	GroupBy      string
+	MinStartTime int64
+	MaxStartTime int64
+}
+
+// REDSummary is the request count, errors and latency of one group of spans.
+// Percentiles are nearest-rank over the spans' durations.
+type REDSummary struct {
+	// Group is the service or operation name, or empty with REDGroupNone
+	Group         string
+	Requests      int64
+	Errors        int64
+	DurationNsSum int64
+	DurationNsMax int64
+	P50Ns         int64
+	P90Ns         int64
+	P95Ns         int64
+	P99Ns         int64
+}
+
+// REDSummaries returns request, error and latency figures for the spans
+// matching opts, one row per group ordered by request count, highest first.
+// With REDGroupNone there is a single row, or none when no span matches.
+func (s *Store) REDSummaries(ctx context.Context, opts REDQueryOptions) ([]REDSummary, error) {
+	var group string
+	switch opts.GroupBy {
+	case REDGroupNone:
+		group = "''"
+	case REDGroupService:
+		group = "COALESCE(service_name, '')"
+	case REDGroupOperation:
+		group = "COALESCE(span_name, '')"
+	default:
+		return nil, fmt.Errorf("invalid group %q", opts.GroupBy)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	where := "1=1"
+	var args []interface{}
+	if opts.ServiceName != "" {
+		where += " AND service_name = ?"
+		args = append(args, opts.ServiceName)
+	}
+	if opts.Kind != "" {
+		where += " AND json_extract(" + spanDocumentExpr + ", '$.kind') = ?"
+		args = append(args, opts.Kind)
+	}
+	if opts.MinStartTime > 0 {
+		where += " AND start_time_unix_nano >= ?"
+		args = append(args, opts.MinStartTime)
+	}
+	if opts.MaxStartTime > 0 {
+		where += " AND start_time_unix_nano <= ?"
+		args = append(args, opts.MaxStartTime)
+	}
+
+	// Each span is ranked by duration within its group; the percentile is
+	// the duration at rank ceil(p * n / 100)
+	rank := func(p int) string {
+		return fmt.Sprintf("MAX(CASE WHEN rn = (%d * n + 99) / 100 THEN duration_ns END)", p)
+	}
+	query := `
+		WITH ranked AS (
+			SELECT ` + group + ` AS grp, COALESCE(duration_ns, 0) AS duration_ns, status_code,
+				ROW_NUMBER() OVER (PARTITION BY ` + group + ` ORDER BY COALESCE(duration_ns, 0)) AS rn,
+				COUNT(*) OVER (PARTITION BY ` + group + `) AS n
+			FROM ` + s.scoped(ctx, "spans", s.source("spans", spanSourceColumns)) + `
+			WHERE ` + where + `
+		)
+		SELECT grp, COUNT(*), SUM(CASE WHEN status_code = 2 THEN 1 ELSE 0 END), SUM(duration_ns), MAX(duration_ns),
+			` + rank(50) + `, ` + rank(90) + `, ` + rank(95) + `, ` + rank(99) + `
+		FROM ranked GROUP BY grp ORDER BY 2 DESC, grp`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []REDSummary{}
+	for rows.Next() {
+		var r REDSummary
+		if err := rows.Scan(&r.Group, &r.Requests, &r.Errors, &r.DurationNsSum, &r.DurationNsMax, &r.P50Ns, &r.P90Ns, &r.P95Ns, &r.P99Ns); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, r)
+	}
+	return summaries, rows.Err()
+}
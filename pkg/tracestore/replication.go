@@ -0,0 +1,244 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// SpanRow is a stored span together with its row metadata, used to ship
+// logical records from a primary to a standby.
+type SpanRow struct {
+	ID        int64           `json:"id"`
+	Data      json.RawMessage `json:"data"`
+	Payload   []byte          `json:"payload,omitempty"`
+	CreatedAt int64           `json:"created_at"`
+	// ChildDurationNs is the children's duration UpdateSelfTimes had added
+	// to the span when it was read
+	ChildDurationNs int64 `json:"child_duration_ns,omitempty"`
+}
+
+// LogRow is a stored log record together with its row metadata, shipped
+// like SpanRow.
+type LogRow struct {
+	ID        int64           `json:"id"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+// ChangeSet is a batch of rows committed after a given cursor.
+type ChangeSet struct {
+	Spans   []SpanRow      `json:"spans,omitempty"`
+	Metrics []MetricRecord `json:"metrics,omitempty"`
+	Logs    []LogRow       `json:"logs,omitempty"`
+}
+
+// Empty reports whether the change set carries no rows.
+func (c ChangeSet) Empty() bool {
+	return len(c.Spans) == 0 && len(c.Metrics) == 0 && len(c.Logs) == 0
+}
+
+// LastSpanID returns the highest span row ID in the change set, or 0.
+func (c ChangeSet) LastSpanID() int64 {
+	if len(c.Spans) == 0 {
+		return 0
+	}
+	return c.Spans[len(c.Spans)-1].ID
+}
+
+// LastMetricID returns the highest metric row ID in the change set, or 0.
+func (c ChangeSet) LastMetricID() int64 {
+	if len(c.Metrics) == 0 {
+		return 0
+	}
+	return c.Metrics[len(c.Metrics)-1].ID
+}
+
+// LastLogID returns the highest log row ID in the change set, or 0.
+func (c ChangeSet) LastLogID() int64 {
+	if len(c.Logs) == 0 {
+		return 0
+	}
+	return c.Logs[len(c.Logs)-1].ID
+}
+
+const (
+	replicationSpanCursorKey   = "span_cursor"
+	replicationMetricCursorKey = "metric_cursor"
+	replicationLogCursorKey    = "log_cursor"
+)
+
+// ChangesSince returns up to limit spans, limit metrics and limit logs
+// committed after the given row IDs, ordered by ID.
+func (s *Store) ChangesSince(ctx context.Context, afterSpanID, afterMetricID, afterLogID int64, limit int) (ChangeSet, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var changes ChangeSet
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, data, payload, created_at, child_duration_ns FROM spans WHERE id > ? ORDER BY id LIMIT ?",
+		afterSpanID, limit)
+	if err != nil {
+		return changes, err
+	}
+	for rows.Next() {
+		var row SpanRow
+		var data string
+		var createdAt sql.NullInt64
+		if err := rows.Scan(&row.ID, &data, &row.Payload, &createdAt, &row.ChildDurationNs); err != nil {
+			rows.Close()
+			return changes, err
+		}
+		row.Data = json.RawMessage(data)
+		row.CreatedAt = createdAt.Int64
+		changes.Spans = append(changes.Spans, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return changes, err
+	}
+
+	rows, err = s.db.QueryContext(ctx,
+		"SELECT id, name, value, timestamp, tags, COALESCE(exemplar_trace_id, '') FROM metrics WHERE id > ? ORDER BY id LIMIT ?",
+		afterMetricID, limit)
+	if err != nil {
+		return changes, err
+	}
+	for rows.Next() {
+		var m MetricRecord
+		if err := rows.Scan(&m.ID, &m.Name, &m.Value, &m.Timestamp, &m.Tags, &m.ExemplarTraceID); err != nil {
+			rows.Close()
+			return changes, err
+		}
+		changes.Metrics = append(changes.Metrics, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return changes, err
+	}
+
+	rows, err = s.db.QueryContext(ctx,
+		"SELECT id, data, created_at FROM logs WHERE id > ? ORDER BY id LIMIT ?",
+		afterLogID, limit)
+	if err != nil {
+		return changes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row LogRow
+		var data string
+		var createdAt sql.NullInt64
+		if err := rows.Scan(&row.ID, &data, &createdAt); err != nil {
+			return changes, err
+		}
+		row.Data = json.RawMessage(data)
+		row.CreatedAt = createdAt.Int64
+		changes.Logs = append(changes.Logs, row)
+	}
+	return changes, rows.Err()
+}
+
+// ApplyChanges stores a change set received from a primary and advances the
+// replication cursors in the same transaction, so a batch is applied exactly once.
+func (s *Store) ApplyChanges(ctx context.Context, changes ChangeSet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(changes.Spans) > 0 {
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO spans (data, payload, created_at, child_duration_ns) VALUES (?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, row := range changes.Spans {
+			if _, err := stmt.ExecContext(ctx, string(row.Data), row.Payload, row.CreatedAt, row.ChildDurationNs); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(changes.Metrics) > 0 {
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO metrics (name, value, timestamp, tags, exemplar_trace_id) VALUES (?, ?, ?, ?, NULLIF(?, ''))")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, m := range changes.Metrics {
+			if _, err := stmt.ExecContext(ctx, m.Name, m.Value, m.Timestamp, m.Tags, m.ExemplarTraceID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(changes.Logs) > 0 {
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO logs (data, created_at) VALUES (?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, row := range changes.Logs {
+			if _, err := stmt.ExecContext(ctx, string(row.Data), row.CreatedAt); err != nil {
+				return err
+			}
+		}
+	}
+
+	upsert := "INSERT INTO replication_state (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value"
+	if id := changes.LastSpanID(); id > 0 {
+		if _, err := tx.ExecContext(ctx, upsert, replicationSpanCursorKey, id); err != nil {
+			return err
+		}
+	}
+	if id := changes.LastMetricID(); id > 0 {
+		if _, err := tx.ExecContext(ctx, upsert, replicationMetricCursorKey, id); err != nil {
+			return err
+		}
+	}
+	if id := changes.LastLogID(); id > 0 {
+		if _, err := tx.ExecContext(ctx, upsert, replicationLogCursorKey, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReplicationCursor returns the last primary span, metric and log row IDs
+// applied by ApplyChanges.
+func (s *Store) ReplicationCursor(ctx context.Context) (spanID, metricID, logID int64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT key, value FROM replication_state")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value int64
+		if err := rows.Scan(&key, &value); err != nil {
+			return 0, 0, 0, err
+		}
+		switch key {
+		case replicationSpanCursorKey:
+			spanID = value
+		case replicationMetricCursorKey:
+			metricID = value
+		case replicationLogCursorKey:
+			logID = value
+		}
+	}
+	return spanID, metricID, logID, rows.Err()
+}
@@ -0,0 +1,179 @@
+package tracestore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// metricRollupSchema holds metric points averaged into one-minute and one-hour
+// buckets. Each row keeps the sum and count of the points it replaces, so
+// buckets can be merged again without weighting errors, and value is their
+// average. RollupMetrics moves points into these tables as they age.
+const metricRollupSchema = `
+	CREATE TABLE IF NOT EXISTS metrics_1m (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		value REAL NOT NULL,
+		timestamp INTEGER NOT NULL,
+		tags TEXT DEFAULT '{}',
+		value_sum REAL NOT NULL,
+		value_count INTEGER NOT NULL,
+		value_min REAL NOT NULL,
+		value_max REAL NOT NULL,
+		service TEXT GENERATED ALWAYS AS (json_extract(tags, '$.service')) VIRTUAL,
+		tenant TEXT GENERATED ALWAYS AS (COALESCE(json_extract(tags, '$.tenant'), '')) VIRTUAL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics_1m_series ON metrics_1m(name, timestamp, tags);
+	CREATE INDEX IF NOT EXISTS idx_metrics_1m_timestamp ON metrics_1m(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_metrics_1m_service_timestamp ON metrics_1m(service, timestamp);
+
+	CREATE TABLE IF NOT EXISTS metrics_1h (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		value REAL NOT NULL,
+		timestamp INTEGER NOT NULL,
+		tags TEXT DEFAULT '{}',
+		value_sum REAL NOT NULL,
+		value_count INTEGER NOT NULL,
+		value_min REAL NOT NULL,
+		value_max REAL NOT NULL,
+		service TEXT GENERATED ALWAYS AS (json_extract(tags, '$.service')) VIRTUAL,
+		tenant TEXT GENERATED ALWAYS AS (COALESCE(json_extract(tags, '$.tenant'), '')) VIRTUAL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics_1h_series ON metrics_1h(name, timestamp, tags);
+	CREATE INDEX IF NOT EXISTS idx_metrics_1h_timestamp ON metrics_1h(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_metrics_1h_service_timestamp ON metrics_1h(service, timestamp);
+	`
+
+// Rollup resolutions, as accepted by MetricQueryOptions.Resolution
+const (
+	ResolutionMinute = time.Minute
+	ResolutionHour   = time.Hour
+)
+
+// RollupResult reports the points moved by RollupMetrics
+type RollupResult struct {
+	// RawPoints is the number of raw points folded into one-minute buckets
+	RawPoints int64
+	// MinutePoints is the number of one-minute buckets folded into hourly ones
+	MinutePoints int64
+}
+
+// upsertRollup merges aggregated rows into a rollup table, combining them
+// with a bucket already there (late points, or a bucket rolled up in two
+// runs). The WHERE true resolves the parsing ambiguity SQLite has between an
+// upsert and a join in INSERT ... SELECT.
+func upsertRollup(table, selectRows string) string {
+	return `INSERT INTO ` + table + ` (name, tags, timestamp, value, value_sum, value_count, value_min, value_max)
+		SELECT name, tags, bucket, total / n, total, n, lo, hi FROM (` + selectRows + `) WHERE true
+		ON CONFLICT(name, timestamp, tags) DO UPDATE SET
+			value = (value_sum + excluded.value_sum) / (value_count + excluded.value_count),
+			value_sum = value_sum + excluded.value_sum,
+			value_count = value_count + excluded.value_count,
+			value_min = MIN(value_min, excluded.value_min),
+			value_max = MAX(value_max, excluded.value_max)`
+}
+
+// RollupMetrics averages raw metric points older than minuteAfter into
+// one-minute buckets, and one-minute buckets older than hourAfter into hourly
+// ones, deleting what it rolled up. Only whole buckets are moved. Rolled-up
+// points are still returned by QueryMetrics when a Resolution is set.
+func (s *Store) RollupMetrics(ctx context.Context, now time.Time, minuteAfter, hourAfter time.Duration) (RollupResult, error) {
+	var result RollupResult
+	minuteCutoff := now.Add(-minuteAfter).Unix() / 60 * 60
+	hourCutoff := now.Add(-hourAfter).Unix() / 3600 * 3600
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, upsertRollup("metrics_1m", `
+		SELECT name, COALESCE(tags, '{}') AS tags, timestamp / 60 * 60 AS bucket,
+			SUM(value) AS total, COUNT(*) AS n, MIN(value) AS lo, MAX(value) AS hi
+		FROM metrics WHERE timestamp < ?
+		GROUP BY name, COALESCE(tags, '{}'), timestamp / 60 * 60`), minuteCutoff)
+	if err != nil {
+		return result, fmt.Errorf("failed to roll up raw metrics: %w", err)
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM metrics WHERE timestamp < ?", minuteCutoff)
+	if err != nil {
+		return result, err
+	}
+	result.RawPoints, _ = res.RowsAffected()
+
+	_, err = tx.ExecContext(ctx, upsertRollup("metrics_1h", `
+		SELECT name, tags, timestamp / 3600 * 3600 AS bucket,
+			SUM(value_sum) AS total, SUM(value_count) AS n, MIN(value_min) AS lo, MAX(value_max) AS hi
+		FROM metrics_1m WHERE timestamp < ?
+		GROUP BY name, tags, timestamp / 3600 * 3600`), hourCutoff)
+	if err != nil {
+		return result, fmt.Errorf("failed to roll up minute metrics: %w", err)
+	}
+	res, err = tx.ExecContext(ctx, "DELETE FROM metrics_1m WHERE timestamp < ?", hourCutoff)
+	if err != nil {
+		return result, err
+	}
+	result.MinutePoints, _ = res.RowsAffected()
+
+	return result, tx.Commit()
+}
+
+// rollupMetricsQuery builds the SQL for a QueryMetrics call with a
+// Resolution: raw points and both rollup tables (read from src), averaged
+// into buckets of that size. Rollup tables coarser than the resolution hold
+// only older data and are returned as they are.
+func rollupMetricsQuery(src metricSources, opts MetricQueryOptions) (string, []interface{}) {
+	step := int64(opts.Resolution / time.Second)
+	bucket := "timestamp / " + strconv.FormatInt(step, 10) + " * " + strconv.FormatInt(step, 10)
+
+	var filter string
+	var filterArgs []interface{}
+	if opts.Name != "" {
+		if opts.NamePattern {
+			filter += " AND name LIKE ? ESCAPE '\\'"
+		} else {
+			filter += " AND name = ?"
+		}
+		filterArgs = append(filterArgs, opts.Name)
+	}
+	if opts.Service != "" {
+		filter += " AND service = ?"
+		filterArgs = append(filterArgs, opts.Service)
+	}
+	if opts.MinTime > 0 {
+		// Start at the bucket holding MinTime so it is not averaged from a part
+		filter += " AND timestamp >= ?"
+		filterArgs = append(filterArgs, opts.MinTime/step*step)
+	}
+	if opts.MaxTime > 0 {
+		filter += " AND timestamp <= ?"
+		filterArgs = append(filterArgs, opts.MaxTime)
+	}
+
+	query := `SELECT 0, name, SUM(value_sum) / SUM(value_count), bucket, tags FROM (
+		SELECT name, COALESCE(tags, '{}') AS tags, ` + bucket + ` AS bucket, value AS value_sum, 1 AS value_count
+			FROM ` + src.raw + ` WHERE 1=1` + filter + `
+		UNION ALL
+		SELECT name, tags, ` + bucket + `, value_sum, value_count FROM ` + src.minute + ` WHERE 1=1` + filter + `
+		UNION ALL
+		SELECT name, tags, ` + bucket + `, value_sum, value_count FROM ` + src.hour + ` WHERE 1=1` + filter + `)
+		GROUP BY name, tags, bucket
+		ORDER BY bucket`
+	var args []interface{}
+	for i := 0; i < 3; i++ {
+		args = append(args, filterArgs...)
+	}
+
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+	return query, args
+}
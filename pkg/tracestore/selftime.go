@@ -0,0 +1,141 @@
+package tracestore
+
+import (
+	"context"
+	"fmt"
+)
+
+const selfTimeCursorKey = "self_time"
+
+// selfTimeExpr is a span's duration minus the summed durations of its direct
+// children. Concurrent or asynchronous children can add up to more than the
+// parent, so it is clamped at zero.
+const selfTimeExpr = "MAX(COALESCE(duration_ns, 0) - child_duration_ns, 0)"
+
+// OperationSelfTime is the time spent in one operation's own code, excluding
+// the time its spans waited on child spans
+type OperationSelfTime struct {
+	ServiceName   string
+	SpanName      string
+	SpanCount     int64
+	SelfTimeNsSum int64
+	DurationNsSum int64
+}
+
+// SelfTimeQueryOptions filters OperationSelfTimes. Time bounds are Unix
+// nanoseconds on span start time.
+type SelfTimeQueryOptions struct {
+	ServiceName  string
+	MinStartTime int64
+	MaxStartTime int64
+	Limit        int
+}
+
+// migrateSpanChildDuration adds spans.child_duration_ns to databases created
+// before self-time was tracked.
+func (s *Store) migrateSpanChildDuration() error {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_xinfo('spans') WHERE name = 'child_duration_ns'").Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	if _, err := s.db.Exec("ALTER TABLE spans ADD COLUMN child_duration_ns INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to add spans.child_duration_ns column: %w", err)
+	}
+	return nil
+}
+
+// UpdateSelfTimes adds the durations of up to limit spans stored since the
+// last call to their parents' child_duration_ns, in either arrival order, and
+// advances the cursor in the same transaction. It returns the number of span
+// rows processed; callers repeat until it returns 0 to catch up.
+func (s *Store) UpdateSelfTimes(ctx context.Context, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	lo, hi, processed, err := spanJoinWindow(ctx, tx, selfTimeCursorKey, limit)
+	if err != nil || processed == 0 {
+		return 0, err
+	}
+
+	// Parents stored earlier gain the children that arrived in this window.
+	_, err = tx.ExecContext(ctx, `
+		UPDATE spans SET child_duration_ns = child_duration_ns + (
+			SELECT COALESCE(SUM(c.duration_ns), 0) FROM spans c
+			WHERE c.trace_id = spans.trace_id AND c.parent_span_id = spans.span_id AND c.id > ? AND c.id <= ?)
+		WHERE id IN (
+			SELECT p.id FROM spans c JOIN spans p ON p.trace_id = c.trace_id AND p.span_id = c.parent_span_id
+			WHERE c.id > ? AND c.id <= ? AND p.id <= ?)`,
+		lo, hi, lo, hi, lo)
+	if err != nil {
+		return 0, err
+	}
+
+	// Parents in this window take every child stored so far.
+	_, err = tx.ExecContext(ctx, `
+		UPDATE spans SET child_duration_ns = (
+			SELECT COALESCE(SUM(c.duration_ns), 0) FROM spans c
+			WHERE c.trace_id = spans.trace_id AND c.parent_span_id = spans.span_id AND c.id <= ?)
+		WHERE id > ? AND id <= ?`,
+		hi, lo, hi)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setSpanJoinCursor(ctx, tx, selfTimeCursorKey, hi); err != nil {
+		return 0, err
+	}
+	return processed, tx.Commit()
+}
+
+// OperationSelfTimes returns operations ordered by total self-time, highest
+// first. Only spans UpdateSelfTimes has processed are included, so results
+// lag ingest by up to one update interval.
+func (s *Store) OperationSelfTimes(ctx context.Context, opts SelfTimeQueryOptions) ([]OperationSelfTime, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := "SELECT COALESCE(service_name, ''), COALESCE(span_name, ''), COUNT(*), SUM(" + selfTimeExpr + "), SUM(COALESCE(duration_ns, 0))" +
+		" FROM spans WHERE id <= COALESCE((SELECT value FROM span_join_cursors WHERE key = ?), 0)"
+	args := []interface{}{selfTimeCursorKey}
+
+	if opts.ServiceName != "" {
+		query += " AND service_name = ?"
+		args = append(args, opts.ServiceName)
+	}
+	if opts.MinStartTime > 0 {
+		query += " AND start_time_unix_nano >= ?"
+		args = append(args, opts.MinStartTime)
+	}
+	if opts.MaxStartTime > 0 {
+		query += " AND start_time_unix_nano <= ?"
+		args = append(args, opts.MaxStartTime)
+	}
+	query += " GROUP BY service_name, span_name ORDER BY 4 DESC, service_name, span_name"
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ops := []OperationSelfTime{}
+	for rows.Next() {
+		var op OperationSelfTime
+		if err := rows.Scan(&op.ServiceName, &op.SpanName, &op.SpanCount, &op.SelfTimeNsSum, &op.DurationNsSum); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
@@ -0,0 +1,133 @@
+package tracestore
+
+import (
+	"context"
+	"time"
+)
+
+// serviceEdgesSchema stores calls between services aggregated per minute.
+// An edge is a span whose parent span belongs to a different service, so a
+// client span in service A calling a server span in service B counts as one
+// A -> B call. Errors and durations are taken from the child span.
+const serviceEdgesSchema = `
+	CREATE TABLE IF NOT EXISTS service_edges (
+		parent_service TEXT NOT NULL,
+		child_service TEXT NOT NULL,
+		-- Start of the minute (Unix seconds) the child span started in
+		bucket INTEGER NOT NULL,
+		call_count INTEGER NOT NULL DEFAULT 0,
+		error_count INTEGER NOT NULL DEFAULT 0,
+		duration_ns_sum INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (parent_service, child_service, bucket)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_service_edges_bucket ON service_edges(bucket);
+	`
+
+// serviceEdgeBucketSeconds is the time resolution of service_edges
+const serviceEdgeBucketSeconds = 60
+
+const serviceEdgesCursorKey = "service_edges"
+
+// ServiceEdge is the number of calls from one service to another
+type ServiceEdge struct {
+	Parent        string
+	Child         string
+	CallCount     int64
+	ErrorCount    int64
+	DurationNsSum int64
+}
+
+// serviceEdgesInsert joins the spans in (lo, hi] with their parents and
+// children in either direction. A pair is counted in the window holding the
+// later of its two rows, so it is counted once however far apart the client
+// and server spans arrive.
+const serviceEdgesInsert = `
+	INSERT INTO service_edges (parent_service, child_service, bucket, call_count, error_count, duration_ns_sum)
+	SELECT parent_service, child_service, bucket, COUNT(*),
+		SUM(CASE WHEN status_code = 2 THEN 1 ELSE 0 END), SUM(COALESCE(duration_ns, 0))
+	FROM (
+		SELECT p.service_name AS parent_service, c.service_name AS child_service,
+			(c.start_time_unix_nano / 1000000000 / ?) * ? AS bucket, c.status_code, c.duration_ns
+		FROM spans c JOIN spans p ON p.trace_id = c.trace_id AND p.span_id = c.parent_span_id
+		WHERE c.id > ? AND c.id <= ? AND p.id <= ? AND p.service_name != c.service_name
+		UNION ALL
+		SELECT p.service_name, c.service_name,
+			(c.start_time_unix_nano / 1000000000 / ?) * ?, c.status_code, c.duration_ns
+		FROM spans p JOIN spans c ON c.trace_id = p.trace_id AND c.parent_span_id = p.span_id
+		WHERE p.id > ? AND p.id <= ? AND c.id <= ? AND p.service_name != c.service_name
+	)
+	WHERE true
+	GROUP BY parent_service, child_service, bucket
+	ON CONFLICT(parent_service, child_service, bucket) DO UPDATE SET
+		call_count = call_count + excluded.call_count,
+		error_count = error_count + excluded.error_count,
+		duration_ns_sum = duration_ns_sum + excluded.duration_ns_sum`
+
+// BuildServiceEdges adds the service-to-service calls of up to limit spans
+// stored since the last call to service_edges and advances the cursor in the
+// same transaction. It returns the number of span rows processed; callers
+// repeat until it returns 0 to catch up.
+func (s *Store) BuildServiceEdges(ctx context.Context, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	lo, hi, processed, err := spanJoinWindow(ctx, tx, serviceEdgesCursorKey, limit)
+	if err != nil || processed == 0 {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, serviceEdgesInsert,
+		serviceEdgeBucketSeconds, serviceEdgeBucketSeconds, lo, hi, hi,
+		serviceEdgeBucketSeconds, serviceEdgeBucketSeconds, lo, hi, lo)
+	if err != nil {
+		return 0, err
+	}
+	if err := setSpanJoinCursor(ctx, tx, serviceEdgesCursorKey, hi); err != nil {
+		return 0, err
+	}
+	return processed, tx.Commit()
+}
+
+// QueryServiceEdges returns the calls between services whose child spans
+// started within [minStartTime, maxStartTime] (Unix nanoseconds, 0 for no
+// bound), summed per service pair at minute resolution.
+func (s *Store) QueryServiceEdges(ctx context.Context, minStartTime, maxStartTime int64) ([]ServiceEdge, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := `SELECT parent_service, child_service, SUM(call_count), SUM(error_count), SUM(duration_ns_sum)
+		FROM service_edges WHERE 1=1`
+	args := []interface{}{}
+	if minStartTime > 0 {
+		query += " AND bucket >= ?"
+		args = append(args, minStartTime/int64(time.Second)/serviceEdgeBucketSeconds*serviceEdgeBucketSeconds)
+	}
+	if maxStartTime > 0 {
+		query += " AND bucket <= ?"
+		args = append(args, maxStartTime/int64(time.Second))
+	}
+	query += " GROUP BY parent_service, child_service ORDER BY parent_service, child_service"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edges := []ServiceEdge{}
+	for rows.Next() {
+		var e ServiceEdge
+		if err := rows.Scan(&e.Parent, &e.Child, &e.CallCount, &e.ErrorCount, &e.DurationNsSum); err != nil {
+			return nil, err
+		}
+		edges = append(edges, e)
+	}
+	return edges, rows.Err()
+}
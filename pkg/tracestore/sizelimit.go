@@ -0,0 +1,193 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// EnforceSizeLimit deletes about 1/sizeLimitSteps of the rows per step, and
+// at most sizeLimitBatch, so a small database is not emptied in one step.
+// The store's write lock is released between steps so ingest is not stalled
+// for the whole run.
+const (
+	sizeLimitSteps = 50
+	sizeLimitBatch = 5000
+)
+
+// SizeLimitResult reports a run of EnforceSizeLimit
+type SizeLimitResult struct {
+	// UsedBytesBefore and UsedBytesAfter are the database pages in use,
+	// excluding free pages, around the run
+	UsedBytesBefore int64
+	UsedBytesAfter  int64
+	// FileBytesAfter is the database file size after the incremental vacuum.
+	// It only shrinks in incremental auto-vacuum mode (see UsedBytes).
+	FileBytesAfter int64
+	SpansDeleted   int64
+	// MetricsDeleted counts raw points and rollup rows
+	MetricsDeleted int64
+	LogsDeleted    int64
+}
+
+// IsDiskFull reports whether err comes from a write that failed because the
+// disk holding the database (or its WAL) is full
+func IsDiskFull(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrFull {
+		return true
+	}
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// UsedBytes returns the size of the database pages in use, excluding free
+// pages, and the size of the whole file. New databases are created in
+// incremental auto-vacuum mode, so free pages can be returned to the
+// filesystem; files created before that switch over on their next VACUUM
+// and until then reuse their free pages instead of shrinking.
+func (s *Store) UsedBytes(ctx context.Context) (used, file int64, err error) {
+	var pages, pageSize int64
+	if err := s.db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, 0, fmt.Errorf("failed to read page_count: %w", err)
+	}
+	if err := s.db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, 0, fmt.Errorf("failed to read page_size: %w", err)
+	}
+	free, err := s.freeBytes(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return pages*pageSize - free, pages * pageSize, nil
+}
+
+// IncrementalAutoVacuum reports whether the database file is in incremental
+// auto-vacuum mode, without which EnforceSizeLimit frees pages for reuse but
+// cannot shrink the file. Files created before gotel switched to it report
+// false until their next Vacuum.
+func (s *Store) IncrementalAutoVacuum(ctx context.Context) (bool, error) {
+	var mode int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return false, fmt.Errorf("failed to read auto_vacuum: %w", err)
+	}
+	return mode == 2, nil
+}
+
+// EnforceSizeLimit deletes the oldest spans, metrics, metric rollups and logs
+// once the pages in use exceed maxBytes, until they are at or below lowWaterBytes, and then
+// returns the freed pages to the filesystem with an incremental vacuum. It
+// returns nil when the database is within maxBytes.
+//
+// Rows are deleted oldest first across the tables (span and log created_at
+// against metric and rollup timestamps), so whichever holds the oldest data
+// loses it first.
+func (s *Store) EnforceSizeLimit(ctx context.Context, maxBytes, lowWaterBytes int64) (*SizeLimitResult, error) {
+	used, _, err := s.UsedBytes(ctx)
+	if err != nil || used <= maxBytes {
+		return nil, err
+	}
+	result := &SizeLimitResult{UsedBytesBefore: used}
+
+	var rows int64
+	err = s.db.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM spans) + (SELECT COUNT(*) FROM metrics) +
+		(SELECT COUNT(*) FROM metrics_1m) + (SELECT COUNT(*) FROM metrics_1h) + (SELECT COUNT(*) FROM logs)`).Scan(&rows)
+	if err != nil {
+		return nil, err
+	}
+	batch := min(max(rows/sizeLimitSteps, 1), sizeLimitBatch)
+
+	for used > lowWaterBytes {
+		spans, metrics, logs, err := s.deleteOldestBatch(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		if spans == 0 && metrics == 0 && logs == 0 {
+			break // nothing left to delete
+		}
+		result.SpansDeleted += spans
+		result.MetricsDeleted += metrics
+		result.LogsDeleted += logs
+		if used, _, err = s.UsedBytes(ctx); err != nil {
+			return nil, err
+		}
+	}
+	result.UsedBytesAfter = used
+
+	s.mu.Lock()
+	_, err = s.db.ExecContext(ctx, "PRAGMA incremental_vacuum")
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("incremental vacuum failed: %w", err)
+	}
+	if _, result.FileBytesAfter, err = s.UsedBytes(ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// sizeLimitTables are the tables deleteOldestBatch trims, with the column
+// their age is read from: created_at for spans and logs, the point
+// timestamp for metrics and their rollups. On a tie the earlier table goes
+// first.
+var sizeLimitTables = []struct {
+	table, column string
+}{
+	{"trace_blobs", "created_at"},
+	{"spans", "created_at"},
+	{"metrics", "timestamp"},
+	{"metrics_1m", "timestamp"},
+	{"metrics_1h", "timestamp"},
+	{"logs", "created_at"},
+}
+
+// deleteOldestBatch deletes up to batch rows from whichever of the spans,
+// metrics, metric rollup and logs tables holds the oldest row, or the
+// oldest compacted trace when it is older than all of them. Rollup rows
+// count as metrics.
+func (s *Store) deleteOldestBatch(ctx context.Context, batch int64) (spans, metrics, logs int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var table, column string
+	var oldest int64
+	for _, t := range sizeLimitTables {
+		var at sql.NullInt64
+		if err := s.db.QueryRowContext(ctx, "SELECT MIN("+t.column+") FROM "+t.table).Scan(&at); err != nil {
+			return 0, 0, 0, err
+		}
+		if at.Valid && (table == "" || at.Int64 < oldest) {
+			table, column, oldest = t.table, t.column, at.Int64
+		}
+	}
+
+	switch table {
+	case "":
+		return 0, 0, 0, nil
+	case "trace_blobs":
+		// A compacted trace holds many spans, so they go a trace at a time
+		var n int64
+		err := s.db.QueryRowContext(ctx,
+			"DELETE FROM trace_blobs WHERE rowid = (SELECT rowid FROM trace_blobs ORDER BY created_at LIMIT 1) RETURNING span_count").Scan(&n)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to delete oldest compacted trace: %w", err)
+		}
+		return n, 0, 0, nil
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM "+table+" WHERE id IN (SELECT id FROM "+table+" ORDER BY "+column+" LIMIT ?)", batch)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to delete oldest %s: %w", table, err)
+	}
+	n, _ := res.RowsAffected()
+	switch table {
+	case "spans":
+		return n, 0, 0, nil
+	case "logs":
+		return 0, 0, n, nil
+	}
+	return 0, n, 0, nil
+}
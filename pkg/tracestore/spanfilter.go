@@ -0,0 +1,267 @@
+package tracestore
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// LogicalOp joins two filters.
+type LogicalOp string
+
+// Logical operators.
+const (
+	OpAnd LogicalOp = "and"
+	OpOr  LogicalOp = "or"
+)
+
+// CompareOp compares a span field with a value.
+type CompareOp string
+
+// Comparison operators. The regex operators match the whole value.
+const (
+	CompareEq       CompareOp = "="
+	CompareNeq      CompareOp = "!="
+	CompareGt       CompareOp = ">"
+	CompareGte      CompareOp = ">="
+	CompareLt       CompareOp = "<"
+	CompareLte      CompareOp = "<="
+	CompareRegex    CompareOp = "=~"
+	CompareNotRegex CompareOp = "!~"
+)
+
+// FieldScope says where a span field is looked up.
+type FieldScope string
+
+// Field scopes.
+const (
+	// ScopeIntrinsic fields are name, status, duration, kind and
+	// statusMessage.
+	ScopeIntrinsic FieldScope = "intrinsic"
+	ScopeSpan      FieldScope = "span"
+	ScopeResource  FieldScope = "resource"
+	// ScopeAny looks up a span attribute, then a resource attribute.
+	ScopeAny FieldScope = "any"
+)
+
+// SpanField names a span intrinsic or attribute.
+type SpanField struct {
+	Scope FieldScope
+	Name  string
+}
+
+// SpanCondition is a predicate on a single span: either a comparison of
+// Field with Value, or Left and Right joined by Op. Value is a string,
+// int64, float64 or bool. Intrinsic values are typed as stored: duration is
+// int64 nanoseconds, status the int64 OTLP status code, and kind a lowercase
+// string such as "server".
+type SpanCondition struct {
+	Op          LogicalOp
+	Left, Right *SpanCondition
+
+	Field   SpanField
+	Compare CompareOp
+	Value   interface{}
+}
+
+// TraceFilter selects traces: a spanset matches traces with at least one span
+// satisfying Spanset (any span when Spanset is nil), and Left and Right are
+// joined by Op, each side matched by its own spans.
+type TraceFilter struct {
+	Op          LogicalOp
+	Left, Right *TraceFilter
+
+	Spanset *SpanCondition
+}
+
+// intrinsicColumns maps intrinsic fields to spans columns or expressions
+var intrinsicColumns = map[string]string{
+	"name":          "span_name",
+	"status":        "status_code",
+	"duration":      "duration_ns",
+	"kind":          "lower(json_extract(" + spanDocumentExpr + ", '$.kind'))",
+	"statusMessage": "json_extract(" + spanDocumentExpr + ", '$.status.message')",
+}
+
+// traceFilterClause builds a WHERE fragment on trace_id for f. Callers hold s.mu.
+func (s *Store) traceFilterClause(f *TraceFilter, spans string) (string, []interface{}, error) {
+	if f.Op != "" {
+		if f.Left == nil || f.Right == nil {
+			return "", nil, fmt.Errorf("trace filter %q needs two operands", f.Op)
+		}
+		left, leftArgs, err := s.traceFilterClause(f.Left, spans)
+		if err != nil {
+			return "", nil, err
+		}
+		right, rightArgs, err := s.traceFilterClause(f.Right, spans)
+		if err != nil {
+			return "", nil, err
+		}
+		op, err := sqlLogicalOp(f.Op)
+		if err != nil {
+			return "", nil, err
+		}
+		return "(" + left + " " + op + " " + right + ")", append(leftArgs, rightArgs...), nil
+	}
+
+	if f.Spanset == nil {
+		return "trace_id IN (SELECT trace_id FROM " + spans + ")", nil, nil
+	}
+	cond, args, err := s.spanConditionClause(f.Spanset)
+	if err != nil {
+		return "", nil, err
+	}
+	return "trace_id IN (SELECT trace_id FROM " + spans + " WHERE " + cond + ")", args, nil
+}
+
+// spanConditionClause builds a WHERE fragment on a spans row for c
+func (s *Store) spanConditionClause(c *SpanCondition) (string, []interface{}, error) {
+	if c.Op != "" {
+		if c.Left == nil || c.Right == nil {
+			return "", nil, fmt.Errorf("span condition %q needs two operands", c.Op)
+		}
+		left, leftArgs, err := s.spanConditionClause(c.Left)
+		if err != nil {
+			return "", nil, err
+		}
+		right, rightArgs, err := s.spanConditionClause(c.Right)
+		if err != nil {
+			return "", nil, err
+		}
+		op, err := sqlLogicalOp(c.Op)
+		if err != nil {
+			return "", nil, err
+		}
+		return "(" + left + " " + op + " " + right + ")", append(leftArgs, rightArgs...), nil
+	}
+
+	if c.Compare == CompareEq && c.Field.Scope == ScopeSpan && s.indexedAttrs[c.Field.Name] && len(s.attached) == 0 {
+		switch v := c.Value.(type) {
+		case string:
+			return "id IN (SELECT span_rowid FROM span_attributes WHERE attr_key = ? AND attr_value = ?)", []interface{}{c.Field.Name, v}, nil
+		case int64:
+			return "id IN (SELECT span_rowid FROM span_attributes WHERE attr_key = ? AND attr_value = ?)", []interface{}{c.Field.Name, strconv.FormatInt(v, 10)}, nil
+		}
+	}
+
+	expr, args, err := spanFieldExpr(c.Field)
+	if err != nil {
+		return "", nil, err
+	}
+	switch c.Compare {
+	case CompareEq, CompareNeq, CompareGt, CompareGte, CompareLt, CompareLte:
+		return expr + " " + string(c.Compare) + " ?", append(args, c.Value), nil
+	case CompareRegex, CompareNotRegex:
+		pattern, ok := c.Value.(string)
+		if !ok {
+			return "", nil, fmt.Errorf("%s needs a string pattern", c.Compare)
+		}
+		if _, err := compileAnchored(pattern); err != nil {
+			return "", nil, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+		}
+		match := "regexp(?, CAST(" + expr + " AS TEXT))"
+		if c.Compare == CompareNotRegex {
+			match = "NOT " + match
+		}
+		// The field is repeated for the NULL check, so its arguments are too.
+		all := make([]interface{}, 0, 2*len(args)+1)
+		all = append(all, args...)
+		all = append(all, pattern)
+		all = append(all, args...)
+		return "(" + expr + " IS NOT NULL AND " + match + ")", all, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported comparison %q", c.Compare)
+	}
+}
+
+// spanFieldExpr returns the SQL expression reading field from a spans row.
+// Fields other than the indexed columns are read from the span document, so
+// encoded rows are decoded to match.
+func spanFieldExpr(field SpanField) (string, []interface{}, error) {
+	if field.Name == "" || (field.Scope != ScopeIntrinsic && !validJSONKey(field.Name)) {
+		return "", nil, fmt.Errorf("invalid field name %q", field.Name)
+	}
+	switch field.Scope {
+	case ScopeIntrinsic:
+		col, ok := intrinsicColumns[field.Name]
+		if !ok {
+			return "", nil, fmt.Errorf("unsupported intrinsic %q", field.Name)
+		}
+		return col, nil, nil
+	case ScopeResource:
+		if field.Name == "service.name" {
+			return "service_name", nil, nil
+		}
+		return "json_extract(" + spanDocumentExpr + ", ?)", []interface{}{`$.resource."` + field.Name + `"`}, nil
+	case ScopeSpan:
+		return "json_extract(" + spanDocumentExpr + ", ?)", []interface{}{`$.attributes."` + field.Name + `"`}, nil
+	case ScopeAny:
+		if field.Name == "service.name" {
+			return "COALESCE(json_extract(" + spanDocumentExpr + ", ?), service_name)", []interface{}{`$.attributes."service.name"`}, nil
+		}
+		return "COALESCE(json_extract(" + spanDocumentExpr + ", ?), json_extract(" + spanDocumentExpr + ", ?))",
+			[]interface{}{`$.attributes."` + field.Name + `"`, `$.resource."` + field.Name + `"`}, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported field scope %q", field.Scope)
+	}
+}
+
+// validJSONKey reports whether name can be quoted in a JSON path
+func validJSONKey(name string) bool {
+	for _, r := range name {
+		if r == '"' || r == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func sqlLogicalOp(op LogicalOp) (string, error) {
+	switch op {
+	case OpAnd:
+		return "AND", nil
+	case OpOr:
+		return "OR", nil
+	default:
+		return "", fmt.Errorf("unsupported logical operator %q", op)
+	}
+}
+
+// maxCachedRegexps bounds regexpCache, since patterns come from queries
+const maxCachedRegexps = 1000
+
+// regexpCache holds compiled patterns for the regexp SQL function, which is
+// called once per row.
+var (
+	regexpCacheMu sync.Mutex
+	regexpCache   = make(map[string]*regexp.Regexp)
+)
+
+func compileAnchored(pattern string) (*regexp.Regexp, error) {
+	regexpCacheMu.Lock()
+	defer regexpCacheMu.Unlock()
+
+	if re, ok := regexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+	if len(regexpCache) >= maxCachedRegexps {
+		clear(regexpCache)
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+// sqlRegexp implements regexp(pattern, value) for SQLite, matching the whole
+// value like Prometheus and Tempo do.
+func sqlRegexp(pattern, value string) (bool, error) {
+	re, err := compileAnchored(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(value), nil
+}
@@ -0,0 +1,43 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+)
+
+// spanJoinCursorsSchema tracks background jobs that join newly stored spans
+// with their parents and children (service edges, self-time), or otherwise
+// walk the spans table in row order (UpgradeSpans). Each key holds the
+// highest span row ID the job has processed.
+const spanJoinCursorsSchema = `
+	CREATE TABLE IF NOT EXISTS span_join_cursors (
+		key TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);
+	`
+
+// spanJoinWindow returns the next window (lo, hi] of up to limit span rows
+// after the cursor stored under key, and the number of rows in it.
+func spanJoinWindow(ctx context.Context, tx *sql.Tx, key string, limit int) (lo, hi, count int64, err error) {
+	err = tx.QueryRowContext(ctx, "SELECT value FROM span_join_cursors WHERE key = ?", key).Scan(&lo)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, 0, err
+	}
+
+	var max sql.NullInt64
+	err = tx.QueryRowContext(ctx,
+		"SELECT MAX(id), COUNT(*) FROM (SELECT id FROM spans WHERE id > ? ORDER BY id LIMIT ?)",
+		lo, limit).Scan(&max, &count)
+	if err != nil || !max.Valid {
+		return lo, lo, 0, err
+	}
+	return lo, max.Int64, count, nil
+}
+
+// setSpanJoinCursor records that the job under key has processed rows up to hi
+func setSpanJoinCursor(ctx context.Context, tx *sql.Tx, key string, hi int64) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO span_join_cursors (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+		key, hi)
+	return err
+}
@@ -0,0 +1,129 @@
+package tracestore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// SpanRangeOptions selects the spans SpanRange aggregates and how. Time
+// bounds are Unix nanoseconds on span start time.
+type SpanRangeOptions struct {
+	// Spanset keeps spans satisfying it; nil keeps every span
+	Spanset      *SpanCondition
+	MinStartTime int64
+	MaxStartTime int64
+	// StepNs is the bucket width; buckets start at MinStartTime
+	StepNs int64
+	// GroupBy splits each bucket by the values of these fields
+	GroupBy []SpanField
+	// Quantiles, each between 0 and 1, are computed over span durations
+	Quantiles []float64
+}
+
+// SpanRangePoint is the aggregate of one bucket of one group.
+type SpanRangePoint struct {
+	// Group holds the GroupBy values, nil where a span lacks the field
+	Group       []interface{}
+	BucketStart int64
+	Count       int64
+	// QuantileNs holds the nearest-rank duration for each requested quantile
+	QuantileNs []int64
+}
+
+// SpanRange counts the spans matching opts in buckets of StepNs, per group,
+// ordered by group then bucket. Buckets without spans are omitted.
+func (s *Store) SpanRange(ctx context.Context, opts SpanRangeOptions) ([]SpanRangePoint, error) {
+	if opts.StepNs <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if opts.MinStartTime <= 0 || opts.MaxStartTime < opts.MinStartTime {
+		return nil, fmt.Errorf("invalid time range")
+	}
+	for _, q := range opts.Quantiles {
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("quantile %v is not between 0 and 1", q)
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var args []interface{}
+	cols := []string{"(start_time_unix_nano - ?) / ? AS bucket"}
+	args = append(args, opts.MinStartTime, opts.StepNs)
+	partition := []string{"bucket"}
+	for i, field := range opts.GroupBy {
+		expr, exprArgs, err := spanFieldExpr(field)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, fmt.Sprintf("%s AS g%d", expr, i))
+		args = append(args, exprArgs...)
+		partition = append(partition, fmt.Sprintf("g%d", i))
+	}
+	cols = append(cols, "COALESCE(duration_ns, 0) AS duration_ns")
+
+	where := "start_time_unix_nano >= ? AND start_time_unix_nano <= ?"
+	args = append(args, opts.MinStartTime, opts.MaxStartTime)
+	if opts.Spanset != nil {
+		cond, condArgs, err := s.spanConditionClause(opts.Spanset)
+		if err != nil {
+			return nil, err
+		}
+		where += " AND " + cond
+		args = append(args, condArgs...)
+	}
+
+	keys := strings.Join(partition, ", ")
+	source := "SELECT " + strings.Join(cols, ", ") + " FROM " +
+		s.scoped(ctx, "spans", s.source("spans", spanSourceColumns)) + " WHERE " + where
+	selects := []string{keys, "COUNT(*)"}
+	if len(opts.Quantiles) > 0 {
+		// Each span is ranked by duration within its bucket and group; quantile
+		// q is the duration at rank ceil(q * n), and at least rank 1
+		source = "SELECT *, ROW_NUMBER() OVER (PARTITION BY " + keys + " ORDER BY duration_ns) AS rn, " +
+			"COUNT(*) OVER (PARTITION BY " + keys + ") AS n FROM (" + source + ")"
+		for _, q := range opts.Quantiles {
+			micros := int64(math.Round(q * 1e6))
+			selects = append(selects, fmt.Sprintf("MAX(CASE WHEN rn = MAX(1, (%d * n + 999999) / 1000000) THEN duration_ns END)", micros))
+		}
+	}
+	order := strings.Join(append(partition[1:], "bucket"), ", ")
+	query := "SELECT " + strings.Join(selects, ", ") + " FROM (" + source + ") GROUP BY " + keys + " ORDER BY " + order
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []SpanRangePoint
+	for rows.Next() {
+		var bucket int64
+		p := SpanRangePoint{
+			Group:      make([]interface{}, len(opts.GroupBy)),
+			QuantileNs: make([]int64, len(opts.Quantiles)),
+		}
+		dest := []interface{}{&bucket}
+		for i := range p.Group {
+			dest = append(dest, &p.Group[i])
+		}
+		dest = append(dest, &p.Count)
+		for i := range p.QuantileNs {
+			dest = append(dest, &p.QuantileNs[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, v := range p.Group {
+			if b, ok := v.([]byte); ok {
+				p.Group[i] = string(b)
+			}
+		}
+		p.BucketStart = opts.MinStartTime + bucket*opts.StepNs
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
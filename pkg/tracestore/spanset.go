@@ -0,0 +1,129 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SpanSetOptions selects the spans MatchSpanSets returns for search results.
+type SpanSetOptions struct {
+	TraceIDs []string
+	// Condition keeps spans satisfying it; nil keeps every span
+	Condition *SpanCondition
+	// Fields are read from each span, in order, into SpanSetSpan.Values
+	Fields       []SpanField
+	MinStartTime int64
+	MaxStartTime int64
+	// PerTrace caps the spans returned per trace, earliest first; 0 returns
+	// every matching span
+	PerTrace int
+}
+
+// SpanSetSpan is one span of a SpanSet.
+type SpanSetSpan struct {
+	SpanID            string
+	Name              string
+	ServiceName       string
+	StartTimeUnixNano int64
+	DurationNanos     int64
+	// Values holds the SpanSetOptions.Fields values, nil where absent
+	Values []interface{}
+}
+
+// SpanSet is the spans of one trace matching a search.
+type SpanSet struct {
+	Spans []SpanSetSpan
+	// Matched counts every matching span, including those over PerTrace
+	Matched int64
+}
+
+// MatchSpanSets returns, for each of opts.TraceIDs with a matching span, the
+// spans matching opts.Condition, keyed by trace ID.
+func (s *Store) MatchSpanSets(ctx context.Context, opts SpanSetOptions) (map[string]*SpanSet, error) {
+	sets := make(map[string]*SpanSet)
+	if len(opts.TraceIDs) == 0 {
+		return sets, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var args []interface{}
+	cols := []string{"trace_id", "span_id", "span_name", "service_name", "start_time_unix_nano", "COALESCE(duration_ns, 0)"}
+	for _, field := range opts.Fields {
+		expr, exprArgs, err := spanFieldExpr(field)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, expr)
+		args = append(args, exprArgs...)
+	}
+
+	where := "trace_id IN (?" + strings.Repeat(", ?", len(opts.TraceIDs)-1) + ")"
+	for _, id := range opts.TraceIDs {
+		args = append(args, id)
+	}
+	if opts.MinStartTime > 0 {
+		where += " AND start_time_unix_nano >= ?"
+		args = append(args, opts.MinStartTime)
+	}
+	if opts.MaxStartTime > 0 {
+		where += " AND start_time_unix_nano <= ?"
+		args = append(args, opts.MaxStartTime)
+	}
+	if opts.Condition != nil {
+		cond, condArgs, err := s.spanConditionClause(opts.Condition)
+		if err != nil {
+			return nil, err
+		}
+		where += " AND " + cond
+		args = append(args, condArgs...)
+	}
+
+	query := "SELECT * FROM (SELECT " + strings.Join(cols, ", ") + ", " +
+		"ROW_NUMBER() OVER (PARTITION BY trace_id ORDER BY start_time_unix_nano, span_id) AS rn, " +
+		"COUNT(*) OVER (PARTITION BY trace_id) AS n FROM " +
+		s.scoped(ctx, "spans", s.source("spans", spanSourceColumns)) + " WHERE " + where + ")"
+	if opts.PerTrace > 0 {
+		query += " WHERE rn <= ?"
+		args = append(args, opts.PerTrace)
+	}
+	query += " ORDER BY trace_id, rn"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to match spans: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var traceID string
+		var rn, n int64
+		var span SpanSetSpan
+		var name, service sql.NullString
+		span.Values = make([]interface{}, len(opts.Fields))
+		dest := []interface{}{&traceID, &span.SpanID, &name, &service, &span.StartTimeUnixNano, &span.DurationNanos}
+		for i := range span.Values {
+			dest = append(dest, &span.Values[i])
+		}
+		dest = append(dest, &rn, &n)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		span.Name, span.ServiceName = name.String, service.String
+		for i, v := range span.Values {
+			if b, ok := v.([]byte); ok {
+				span.Values[i] = string(b)
+			}
+		}
+		set, ok := sets[traceID]
+		if !ok {
+			set = &SpanSet{Matched: n}
+			sets[traceID] = set
+		}
+		set.Spans = append(set.Spans, span)
+	}
+	return sets, rows.Err()
+}
@@ -0,0 +1,122 @@
+package tracestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// SpanUpgrader brings a plain JSON span document written by an older version
+// of the writer up to the current one. It returns the document unchanged,
+// with changed unset, when it is already current.
+type SpanUpgrader func(doc json.RawMessage) (upgraded json.RawMessage, changed bool, err error)
+
+// SetSpanUpgrader sets the upgrader applied to plain JSON spans as they are
+// read, so readers only ever see current documents, and used by UpgradeSpans
+// to rewrite old rows in place. Encoded spans are left to the SpanDecoder,
+// which builds current documents from the payload.
+func (s *Store) SetSpanUpgrader(upgrade SpanUpgrader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upgrader = upgrade
+}
+
+// upgradeSpan applies the upgrader to a plain JSON span. A document the
+// upgrader fails on is returned as stored. Callers hold s.mu.
+func (s *Store) upgradeSpan(data json.RawMessage) json.RawMessage {
+	if s.upgrader == nil {
+		return data
+	}
+	upgraded, changed, err := s.upgrader(data)
+	if err != nil || !changed {
+		return data
+	}
+	return upgraded
+}
+
+// UpgradeSpans rewrites, with the store's SpanUpgrader, the plain JSON spans
+// among the next limit span rows whose "v" field is below version. Progress
+// is kept per version in span_join_cursors, so a restart resumes where the
+// last run stopped. A batch with no examined rows (LastID unchanged) means
+// the rewrite has caught up; rows stored later, e.g. replicated from a
+// primary still on an older version, are picked up by the next run.
+func (s *Store) UpgradeSpans(ctx context.Context, version, limit int) (ConvertResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result ConvertResult
+	if s.upgrader == nil {
+		return result, fmt.Errorf("no span upgrader set")
+	}
+	key := fmt.Sprintf("span_upgrade_v%d", version)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	lo, hi, count, err := spanJoinWindow(ctx, tx, key, limit)
+	if err != nil {
+		return result, err
+	}
+	result.LastID = lo
+	if count == 0 {
+		return result, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, data FROM spans
+		WHERE id > ? AND id <= ? AND payload IS NULL AND COALESCE(json_extract(data, '$.v'), 0) < ?`,
+		lo, hi, version)
+	if err != nil {
+		return result, err
+	}
+	type rewrite struct {
+		id   int64
+		data json.RawMessage
+	}
+	var rewrites []rewrite
+	for rows.Next() {
+		var id int64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return result, err
+		}
+		upgraded, changed, err := s.upgrader(json.RawMessage(data))
+		if err != nil {
+			result.Skipped++
+			continue
+		}
+		if changed {
+			rewrites = append(rewrites, rewrite{id, upgraded})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	if len(rewrites) > 0 {
+		stmt, err := tx.PrepareContext(ctx, "UPDATE spans SET data = ? WHERE id = ?")
+		if err != nil {
+			return result, err
+		}
+		defer stmt.Close()
+		for _, rw := range rewrites {
+			if _, err := stmt.ExecContext(ctx, string(rw.data), rw.id); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := setSpanJoinCursor(ctx, tx, key, hi); err != nil {
+		return result, err
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	result.LastID = hi
+	result.Converted = len(rewrites)
+	return result, nil
+}
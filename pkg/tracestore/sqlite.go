@@ -0,0 +1,1325 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a SQLite-backed storage for traces and metrics
+type Store struct {
+	db       *sql.DB
+	dbPath   string
+	attached []AttachedDatabase
+	decoder  SpanDecoder
+	upgrader SpanUpgrader
+	mu       sync.RWMutex
+
+	// indexedAttrs lists the span attribute keys in the attribute index
+	indexedAttrs map[string]bool
+
+	// textSearch is set when the full-text index could be created
+	textSearch bool
+
+	// batcher coalesces InsertEncodedData calls when write batching is on
+	batcher *writeBatcher
+
+	// noPayload lists attached databases whose spans table predates the
+	// payload column.
+	noPayload map[string]bool
+}
+
+// MetricRecord represents a stored metric data point
+type MetricRecord struct {
+	ID        int64   `json:"id"`
+	Name      string  `json:"name"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"`
+	Tags      string  `json:"tags"` // JSON object of tags
+	// ExemplarTraceID is a trace representative of the point, such as the
+	// slowest span's trace for a duration; empty for most points
+	ExemplarTraceID string `json:"exemplar_trace_id,omitempty"`
+}
+
+// New creates a new SQLite store at the given path
+func New(dbPath string) (*Store, error) {
+	return NewWithAttached(dbPath, nil)
+}
+
+// NewWithAttached creates a store that also reads from the given databases.
+// SearchTraces, QueryTraceByID, QueryTracesByIDs, QueryEncodedTrace,
+// QueryMetrics and IterMetrics return rows from the main and every attached
+// database; writes and all other methods only touch the main database.
+func NewWithAttached(dbPath string, attached []AttachedDatabase) (*Store, error) {
+	if err := validateAttached(attached); err != nil {
+		return nil, err
+	}
+
+	// Use WAL mode and other optimizations via connection string
+	dsn := fmt.Sprintf("%s?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_cache_size=-64000&_auto_vacuum=incremental", dbPath)
+
+	store := &Store{
+		dbPath:   dbPath,
+		attached: append([]AttachedDatabase(nil), attached...),
+	}
+	connector, err := newStoreConnector(dsn, attached, store.spanDocumentSQL)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	store.db = db
+
+	// SQLite WAL mode supports concurrent readers with a single writer.
+	// Allow multiple read connections but limit writes via application-level mutex.
+	db.SetMaxOpenConns(4)
+	db.SetMaxIdleConns(4)
+	db.SetConnMaxLifetime(0)
+
+	if err := store.initSchema(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize schema: %w", err)
+	}
+
+	for _, a := range attached {
+		has, err := hasSpanPayload(db, a.Name)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to inspect attached database %q: %w", a.Name, err)
+		}
+		if !has {
+			if store.noPayload == nil {
+				store.noPayload = make(map[string]bool)
+			}
+			store.noPayload[a.Name] = true
+		}
+	}
+
+	return store, nil
+}
+
+// OpenReadOnly opens an existing database for inspection. Unlike New it
+// neither creates the file nor initializes the schema, so nothing is written:
+// migrations and their backfills are left to the next New. Only methods that
+// read work on the returned store.
+func OpenReadOnly(dbPath string) (*Store, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	uri, err := readOnlyURI(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{dbPath: dbPath}
+	connector, err := newStoreConnector(uri+"&_busy_timeout=5000", nil, store.spanDocumentSQL)
+	if err != nil {
+		return nil, err
+	}
+	store.db = sql.OpenDB(connector)
+	store.db.SetMaxOpenConns(1)
+	if err := store.db.Ping(); err != nil {
+		store.db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// schemaMigrations lists the tables and columns New adds to databases created
+// by earlier versions; an empty column stands for the whole table.
+var schemaMigrations = []struct{ table, column string }{
+	{"spans", "payload"},
+	{"spans", "trace_state"},
+	{"spans", "child_duration_ns"},
+	{"spans", "tenant"},
+	{"metrics", "exemplar_trace_id"},
+	{"metrics", "tenant"},
+	{"metrics_1m", "tenant"},
+	{"metrics_1h", "tenant"},
+	{"span_attributes", ""},
+	{"trace_blobs", ""},
+	{"logs", ""},
+	{"service_edges", ""},
+	{"span_join_cursors", ""},
+	{"replication_state", ""},
+	{"trace_summaries", ""},
+	{"trace_summary_attributes", ""},
+}
+
+// PendingMigrations returns the tables and columns, as "table" or
+// "table.column", that the next New will add to the database. It only reads
+// the schema, so it is safe on a store opened with OpenReadOnly.
+func (s *Store) PendingMigrations(ctx context.Context) ([]string, error) {
+	var pending []string
+	for _, m := range schemaMigrations {
+		var n int
+		var err error
+		if m.column == "" {
+			err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", m.table).Scan(&n)
+		} else {
+			err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_xinfo(?) WHERE name = ?", m.table, m.column).Scan(&n)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect the schema: %w", err)
+		}
+		if n > 0 {
+			continue
+		}
+		if m.column == "" {
+			pending = append(pending, m.table)
+		} else {
+			pending = append(pending, m.table+"."+m.column)
+		}
+	}
+	return pending, nil
+}
+
+// initSchema creates tables with JSON columns, virtual columns, and indexes
+func (s *Store) initSchema() error {
+	// Spans table: raw JSON with virtual indexed columns
+	spansSchema := `
+	CREATE TABLE IF NOT EXISTS spans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		data TEXT NOT NULL,
+		-- Encoded span (compact format); data then holds only the header
+		payload BLOB,
+		created_at INTEGER DEFAULT (strftime('%s', 'now')),
+		-- Summed durations of direct children, maintained by UpdateSelfTimes
+		child_duration_ns INTEGER NOT NULL DEFAULT 0,
+		
+		-- Virtual generated columns extracted from JSON for indexing
+		trace_id TEXT GENERATED ALWAYS AS (json_extract(data, '$.trace_id')) VIRTUAL,
+		span_id TEXT GENERATED ALWAYS AS (json_extract(data, '$.span_id')) VIRTUAL,
+		parent_span_id TEXT GENERATED ALWAYS AS (json_extract(data, '$.parent_span_id')) VIRTUAL,
+		service_name TEXT GENERATED ALWAYS AS (json_extract(data, '$.service_name')) VIRTUAL,
+		span_name TEXT GENERATED ALWAYS AS (json_extract(data, '$.span_name')) VIRTUAL,
+		start_time_unix_nano INTEGER GENERATED ALWAYS AS (json_extract(data, '$.start_time_unix_nano')) VIRTUAL,
+		end_time_unix_nano INTEGER GENERATED ALWAYS AS (json_extract(data, '$.end_time_unix_nano')) VIRTUAL,
+		duration_ns INTEGER GENERATED ALWAYS AS (json_extract(data, '$.end_time_unix_nano') - json_extract(data, '$.start_time_unix_nano')) VIRTUAL,
+		status_code INTEGER GENERATED ALWAYS AS (json_extract(data, '$.status.code')) VIRTUAL,
+		
+		-- Resource attribute virtual columns for common queries
+		service_version TEXT GENERATED ALWAYS AS (json_extract(data, '$.resource."service.version"')) VIRTUAL,
+		deployment_environment TEXT GENERATED ALWAYS AS (json_extract(data, '$.resource."deployment.environment"')) VIRTUAL,
+		
+		-- Instrumentation scope
+		scope_name TEXT GENERATED ALWAYS AS (json_extract(data, '$.scope.name')) VIRTUAL,
+
+		-- W3C tracestate (vendor-specific trace context)
+		trace_state TEXT GENERATED ALWAYS AS (json_extract(data, '$.trace_state')) VIRTUAL,
+
+		-- Tenant the span was ingested for, '' for the default tenant
+		tenant TEXT GENERATED ALWAYS AS (COALESCE(json_extract(data, '$.tenant'), '')) VIRTUAL
+	);
+
+	-- Indexes for common query patterns
+	CREATE INDEX IF NOT EXISTS idx_spans_trace_id ON spans(trace_id);
+	CREATE INDEX IF NOT EXISTS idx_spans_service_name ON spans(service_name);
+	CREATE INDEX IF NOT EXISTS idx_spans_span_name ON spans(span_name);
+	CREATE INDEX IF NOT EXISTS idx_spans_start_time ON spans(start_time_unix_nano);
+	CREATE INDEX IF NOT EXISTS idx_spans_status_code ON spans(status_code);
+	CREATE INDEX IF NOT EXISTS idx_spans_service_span ON spans(service_name, span_name);
+	CREATE INDEX IF NOT EXISTS idx_spans_created_at ON spans(created_at);
+	CREATE INDEX IF NOT EXISTS idx_spans_service_version ON spans(service_version);
+	CREATE INDEX IF NOT EXISTS idx_spans_deployment_env ON spans(deployment_environment);
+	CREATE INDEX IF NOT EXISTS idx_spans_scope_name ON spans(scope_name);
+	`
+
+	// Metrics table: time-series data with tags
+	metricsSchema := `
+	CREATE TABLE IF NOT EXISTS metrics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		value REAL NOT NULL,
+		timestamp INTEGER NOT NULL,
+		tags TEXT DEFAULT '{}',
+		-- Trace linked to the point (see MetricRecord.ExemplarTraceID)
+		exemplar_trace_id TEXT,
+		
+		-- Virtual columns for common tag extractions
+		service TEXT GENERATED ALWAYS AS (json_extract(tags, '$.service')) VIRTUAL,
+		span TEXT GENERATED ALWAYS AS (json_extract(tags, '$.span')) VIRTUAL,
+		tenant TEXT GENERATED ALWAYS AS (COALESCE(json_extract(tags, '$.tenant'), '')) VIRTUAL
+	);
+
+	-- Indexes for metric queries
+	CREATE INDEX IF NOT EXISTS idx_metrics_name ON metrics(name);
+	CREATE INDEX IF NOT EXISTS idx_metrics_timestamp ON metrics(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_metrics_name_timestamp ON metrics(name, timestamp);
+	-- Service-scoped queries seek on service and read their time range in
+	-- order; this replaces the older single-column service index
+	DROP INDEX IF EXISTS idx_metrics_service;
+	CREATE INDEX IF NOT EXISTS idx_metrics_service_timestamp ON metrics(service, timestamp);
+	`
+
+	// Replication state: cursors into the primary's spans/metrics tables
+	replicationSchema := `
+	CREATE TABLE IF NOT EXISTS replication_state (
+		key TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);
+	`
+
+	for _, schema := range []string{spansSchema, attrIndexSchema, metricsSchema, metricRollupSchema, traceBlobsSchema, logsSchema, serviceEdgesSchema, spanJoinCursorsSchema, replicationSchema} {
+		if _, err := s.db.Exec(schema); err != nil {
+			return fmt.Errorf("failed to execute schema: %w", err)
+		}
+	}
+
+	if err := s.migrateSpanPayload(); err != nil {
+		return err
+	}
+	if err := s.migrateSpanTraceState(); err != nil {
+		return err
+	}
+	if err := s.migrateSpanChildDuration(); err != nil {
+		return err
+	}
+	if err := s.migrateSpanText(); err != nil {
+		return err
+	}
+	if err := s.migrateMetricExemplar(); err != nil {
+		return err
+	}
+	if err := s.migrateTenant(); err != nil {
+		return err
+	}
+	if err := s.migrateTraceSummaries(); err != nil {
+		return err
+	}
+	return s.loadIndexedAttributes()
+}
+
+// InsertSpan stores a span as raw JSON
+func (s *Store) InsertSpan(ctx context.Context, spanJSON []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, "INSERT INTO spans (data) VALUES (?)", string(spanJSON))
+	return err
+}
+
+// InsertMetric stores a metric data point
+func (s *Store) InsertMetric(ctx context.Context, name string, value float64, timestamp int64, tags map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO metrics (name, value, timestamp, tags) VALUES (?, ?, ?, ?)",
+		name, value, timestamp, string(tagsJSON))
+	return err
+}
+
+// InsertData stores spans and metrics in a single transaction for atomicity
+func (s *Store) InsertData(ctx context.Context, spans [][]byte, metrics []MetricRecord) error {
+	encoded := make([]EncodedSpan, len(spans))
+	for i, spanJSON := range spans {
+		encoded[i] = EncodedSpan{Header: spanJSON}
+	}
+	return s.InsertEncodedData(ctx, encoded, metrics)
+}
+
+// QueryTraceByID retrieves all spans for a given trace ID
+func (s *Store) QueryTraceByID(ctx context.Context, traceID string) ([]json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	traces, err := s.encodedTraces(ctx, []string{traceID})
+	if err != nil {
+		return nil, err
+	}
+	var spans []json.RawMessage
+	for _, stored := range traces[traceID] {
+		span, err := s.decodeSpan(string(stored.Header), stored.Payload)
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+// QueryTracesByIDs retrieves the spans of several traces in a single query,
+// keyed by trace ID. Traces with no stored spans are absent from the map.
+func (s *Store) QueryTracesByIDs(ctx context.Context, traceIDs []string) (map[string][]json.RawMessage, error) {
+	traces := make(map[string][]json.RawMessage)
+	if len(traceIDs) == 0 {
+		return traces, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, err := s.encodedTraces(ctx, traceIDs)
+	if err != nil {
+		return nil, err
+	}
+	for traceID, rows := range stored {
+		spans := make([]json.RawMessage, 0, len(rows))
+		for _, row := range rows {
+			span, err := s.decodeSpan(string(row.Header), row.Payload)
+			if err != nil {
+				return nil, err
+			}
+			spans = append(spans, span)
+		}
+		traces[traceID] = spans
+	}
+	return traces, nil
+}
+
+// QuerySpans searches spans with filters
+func (s *Store) QuerySpans(ctx context.Context, opts SpanQueryOptions) ([]json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	where, args, err := s.spanQueryWhere(opts)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT data, payload FROM " + s.scoped(ctx, "spans", "spans") + " WHERE " + where
+	query += " ORDER BY start_time_unix_nano DESC"
+
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+	if opts.Offset > 0 {
+		query += " OFFSET ?"
+		args = append(args, opts.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spans []json.RawMessage
+	for rows.Next() {
+		var data string
+		var payload []byte
+		if err := rows.Scan(&data, &payload); err != nil {
+			return nil, err
+		}
+		span, err := s.decodeSpan(data, payload)
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, rows.Err()
+}
+
+// CountSpans returns the number of spans QuerySpans would return without
+// Limit and Offset, stopping after max spans like CountTraces.
+func (s *Store) CountSpans(ctx context.Context, opts SpanQueryOptions, max int) (count int64, exact bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	where, args, err := s.spanQueryWhere(opts)
+	if err != nil {
+		return 0, false, err
+	}
+	return s.countCapped(ctx, "SELECT 1 FROM "+s.scoped(ctx, "spans", "spans")+" WHERE "+where, args, max)
+}
+
+// spanQueryWhere builds the conditions shared by QuerySpans and CountSpans.
+// Callers hold s.mu.
+func (s *Store) spanQueryWhere(opts SpanQueryOptions) (string, []interface{}, error) {
+	query := "1=1"
+	args := []interface{}{}
+
+	if opts.ServiceName != "" {
+		query += " AND service_name = ?"
+		args = append(args, opts.ServiceName)
+	}
+	if opts.SpanName != "" {
+		query += " AND span_name = ?"
+		args = append(args, opts.SpanName)
+	}
+	if opts.MinStartTime > 0 {
+		query += " AND start_time_unix_nano >= ?"
+		args = append(args, opts.MinStartTime)
+	}
+	if opts.MaxStartTime > 0 {
+		query += " AND start_time_unix_nano <= ?"
+		args = append(args, opts.MaxStartTime)
+	}
+	if opts.StatusCode != nil {
+		query += " AND status_code = ?"
+		args = append(args, *opts.StatusCode)
+	}
+	if len(opts.Attributes) > 0 {
+		clause, attrArgs, err := s.spanAttributeClause(opts.Attributes)
+		if err != nil {
+			return "", nil, err
+		}
+		query += clause
+		args = append(args, attrArgs...)
+	}
+	return query, args, nil
+}
+
+// QuerySpansByTime retrieves spans within a time range with advanced filtering
+func (s *Store) QuerySpansByTime(ctx context.Context, opts SpanTimeQueryOptions) ([]json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query, args := spansByTimeQuery(s.scoped(ctx, "spans", "spans"), opts)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spans []json.RawMessage
+	for rows.Next() {
+		var data string
+		var payload []byte
+		if err := rows.Scan(&data, &payload); err != nil {
+			return nil, err
+		}
+		span, err := s.decodeSpan(data, payload)
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, rows.Err()
+}
+
+// spansByTimeQuery builds the SQL for QuerySpansByTime and IterSpansByTime,
+// reading spans from source
+func spansByTimeQuery(source string, opts SpanTimeQueryOptions) (string, []interface{}) {
+	query := "SELECT data, payload FROM " + source + " WHERE 1=1"
+	args := []interface{}{}
+
+	if opts.ServiceName != "" {
+		query += " AND service_name = ?"
+		args = append(args, opts.ServiceName)
+	}
+	if opts.SpanName != "" {
+		query += " AND span_name = ?"
+		args = append(args, opts.SpanName)
+	}
+	if opts.MinStartTime > 0 {
+		query += " AND start_time_unix_nano >= ?"
+		args = append(args, opts.MinStartTime)
+	}
+	if opts.MaxStartTime > 0 {
+		query += " AND start_time_unix_nano <= ?"
+		args = append(args, opts.MaxStartTime)
+	}
+	if opts.MinEndTime > 0 {
+		query += " AND end_time_unix_nano >= ?"
+		args = append(args, opts.MinEndTime)
+	}
+	if opts.MaxEndTime > 0 {
+		query += " AND end_time_unix_nano <= ?"
+		args = append(args, opts.MaxEndTime)
+	}
+	if opts.StatusCode != nil {
+		query += " AND status_code = ?"
+		args = append(args, *opts.StatusCode)
+	}
+	if opts.MinDuration != nil {
+		query += " AND (end_time_unix_nano - start_time_unix_nano) >= ?"
+		args = append(args, *opts.MinDuration*int64(time.Millisecond))
+	}
+	if opts.MaxDuration != nil {
+		query += " AND (end_time_unix_nano - start_time_unix_nano) <= ?"
+		args = append(args, *opts.MaxDuration*int64(time.Millisecond))
+	}
+
+	query += " ORDER BY start_time_unix_nano DESC"
+
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+	if opts.Offset > 0 {
+		query += " OFFSET ?"
+		args = append(args, opts.Offset)
+	}
+	return query, args
+}
+
+// SpanQueryOptions defines filters for span queries
+type SpanQueryOptions struct {
+	ServiceName  string
+	SpanName     string
+	MinStartTime int64
+	MaxStartTime int64
+	StatusCode   *int
+	Limit        int
+	Offset       int
+
+	// Attributes restricts results to spans carrying every attribute value.
+	// Keys set with SetIndexedAttributes use the index.
+	Attributes map[string]string
+}
+
+// SpanTimeQueryOptions defines filters for time-based span queries
+type SpanTimeQueryOptions struct {
+	ServiceName  string
+	SpanName     string
+	MinStartTime int64
+	MaxStartTime int64
+	MinEndTime   int64
+	MaxEndTime   int64
+	StatusCode   *int
+	MinDuration  *int64 // milliseconds
+	MaxDuration  *int64 // milliseconds
+	Limit        int
+	Offset       int
+}
+
+// TraceSearchOptions defines filters for trace search.
+//
+// This is intentionally small: it supports the subset of Tempo search parameters
+// that Grafana commonly uses.
+type TraceSearchOptions struct {
+	ServiceName  string
+	SpanName     string
+	MinStartTime int64
+	MaxStartTime int64
+	Limit        int
+	Offset       int
+
+	// Attributes restricts results to traces with a span carrying every
+	// attribute value. Keys set with SetIndexedAttributes use the index.
+	Attributes map[string]string
+
+	// Filter, when set, restricts results to traces it matches.
+	Filter *TraceFilter
+
+	// TraceState restricts results to traces with a span whose W3C
+	// tracestate has every entry.
+	TraceState []TraceStateEntry
+
+	// OverBudget, when non-empty, restricts results to traces containing at
+	// least one span slower than its latency budget.
+	OverBudget []LatencyBudget
+
+	// Status, when set, restricts results to traces whose overall status,
+	// the highest span status code (0 unset, 1 ok, 2 error), equals it.
+	Status *int
+
+	// MinDurationNs and MaxDurationNs, when positive, bound the trace
+	// duration: from its earliest span start to its latest span end.
+	MinDurationNs int64
+	MaxDurationNs int64
+}
+
+// LatencyBudget is the expected maximum duration for a service's spans.
+type LatencyBudget struct {
+	ServiceName string
+	// SpanName limits the budget to one operation. When empty, the budget
+	// applies to every operation of the service without a budget of its own.
+	SpanName      string
+	MaxDurationNs int64
+}
+
+// latencyBudgetClause builds a WHERE fragment matching spans that exceed their budget.
+func latencyBudgetClause(budgets []LatencyBudget) (string, []interface{}) {
+	// Operations with a specific budget are excluded from their service-wide budget.
+	specificOps := make(map[string][]string)
+	for _, b := range budgets {
+		if b.SpanName != "" {
+			specificOps[b.ServiceName] = append(specificOps[b.ServiceName], b.SpanName)
+		}
+	}
+
+	var clauses []string
+	var args []interface{}
+	for _, b := range budgets {
+		if b.SpanName != "" {
+			clauses = append(clauses, "(service_name = ? AND span_name = ? AND duration_ns > ?)")
+			args = append(args, b.ServiceName, b.SpanName, b.MaxDurationNs)
+			continue
+		}
+		clause := "(service_name = ? AND duration_ns > ?"
+		args = append(args, b.ServiceName, b.MaxDurationNs)
+		if ops := specificOps[b.ServiceName]; len(ops) > 0 {
+			clause += " AND span_name NOT IN (?" + strings.Repeat(", ?", len(ops)-1) + ")"
+			for _, op := range ops {
+				args = append(args, op)
+			}
+		}
+		clauses = append(clauses, clause+")")
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// TraceSummary is a lightweight description of a trace, suitable for search results.
+// DurationMs is truncated to whole milliseconds, as Tempo reports it;
+// DurationNanos keeps the precision of sub-millisecond traces.
+type TraceSummary struct {
+	TraceID           string
+	RootServiceName   string
+	RootTraceName     string
+	StartTimeUnixNano int64
+	DurationMs        int64
+	DurationNanos     int64
+	SpanCount         int64
+	ErrorCount        int64
+	StatusCode        int
+}
+
+// SearchTraces returns trace summaries, grouped by trace_id. They are read
+// from the trace summaries table or, when databases are attached, aggregated
+// from the spans of every database.
+func (s *Store) SearchTraces(ctx context.Context, opts TraceSearchOptions) ([]TraceSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.attached) == 0 {
+		return s.searchTraceSummaries(ctx, opts)
+	}
+
+	spans := s.scoped(ctx, "spans", s.source("spans", spanSourceColumns))
+	where, args, err := s.traceSearchWhere(opts, spans)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		WITH filtered AS (
+			SELECT
+				trace_id,
+				service_name,
+				span_name,
+				parent_span_id,
+				start_time_unix_nano,
+				end_time_unix_nano,
+				status_code
+			FROM ` + spans + `
+			WHERE ` + where
+
+	query += `
+		)
+		, roots AS (
+			SELECT
+				trace_id,
+				FIRST_VALUE(service_name) OVER w AS root_service,
+				FIRST_VALUE(span_name) OVER w AS root_name,
+				start_time_unix_nano,
+				end_time_unix_nano,
+				status_code
+			FROM filtered
+			WINDOW w AS (
+				PARTITION BY trace_id
+				ORDER BY
+					CASE
+						WHEN parent_span_id IS NULL OR parent_span_id = '' OR parent_span_id = '0000000000000000' THEN 0
+						ELSE 1
+					END,
+					start_time_unix_nano
+			)
+		)
+		SELECT
+			trace_id,
+			MIN(start_time_unix_nano) AS start_ns,
+			MAX(end_time_unix_nano) AS end_ns,
+			COUNT(*) AS span_count,
+			MAX(status_code) AS max_status,
+			SUM(CASE WHEN status_code = 2 THEN 1 ELSE 0 END) AS error_count,
+			MAX(root_service) AS root_service,
+			MAX(root_name) AS root_name
+		FROM roots
+		WHERE trace_id IS NOT NULL
+	`
+
+	query += " GROUP BY trace_id ORDER BY start_ns DESC"
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+	if opts.Offset > 0 {
+		query += " OFFSET ?"
+		args = append(args, opts.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []TraceSummary
+	for rows.Next() {
+		var traceID string
+		var startNs, endNs, spanCount, errorCount int64
+		var maxStatus int
+		var rootService, rootName sql.NullString
+		if err := rows.Scan(&traceID, &startNs, &endNs, &spanCount, &maxStatus, &errorCount, &rootService, &rootName); err != nil {
+			return nil, err
+		}
+
+		durationNs := int64(0)
+		if endNs > startNs {
+			durationNs = endNs - startNs
+		}
+
+		out = append(out, TraceSummary{
+			TraceID:           traceID,
+			RootServiceName:   rootService.String,
+			RootTraceName:     rootName.String,
+			StartTimeUnixNano: startNs,
+			DurationMs:        durationNs / int64(time.Millisecond),
+			DurationNanos:     durationNs,
+			SpanCount:         spanCount,
+			ErrorCount:        errorCount,
+			StatusCode:        maxStatus,
+		})
+	}
+	return out, rows.Err()
+}
+
+// traceSearchWhere builds the conditions on spans rows shared by SearchTraces
+// and CountTraces. Callers hold s.mu.
+func (s *Store) traceSearchWhere(opts TraceSearchOptions, spans string) (string, []interface{}, error) {
+	query := "trace_id IS NOT NULL"
+	args := []interface{}{}
+	if opts.ServiceName != "" {
+		query += " AND trace_id IN (SELECT trace_id FROM " + spans + " WHERE service_name = ?)"
+		args = append(args, opts.ServiceName)
+	}
+	if opts.SpanName != "" {
+		query += " AND trace_id IN (SELECT trace_id FROM " + spans + " WHERE span_name = ?)"
+		args = append(args, opts.SpanName)
+	}
+	if len(opts.Attributes) > 0 {
+		clause, attrArgs, err := s.attributeClause(opts.Attributes)
+		if err != nil {
+			return "", nil, err
+		}
+		query += clause
+		args = append(args, attrArgs...)
+	}
+	if len(opts.TraceState) > 0 {
+		clause, stateArgs := traceStateClause(opts.TraceState, spans)
+		query += clause
+		args = append(args, stateArgs...)
+	}
+	if opts.Filter != nil {
+		clause, filterArgs, err := s.traceFilterClause(opts.Filter, spans)
+		if err != nil {
+			return "", nil, err
+		}
+		query += " AND " + clause
+		args = append(args, filterArgs...)
+	}
+	if opts.Status != nil {
+		query += traceStatusClause(*opts.Status, spans)
+	}
+	if opts.MinDurationNs > 0 || opts.MaxDurationNs > 0 {
+		clause, durationArgs := traceDurationClause("MAX(end_time_unix_nano) - MIN(start_time_unix_nano)", opts.MinDurationNs, opts.MaxDurationNs)
+		query += " AND trace_id IN (SELECT trace_id FROM " + spans + " WHERE trace_id IS NOT NULL GROUP BY trace_id HAVING " + clause + ")"
+		args = append(args, durationArgs...)
+	}
+	if len(opts.OverBudget) > 0 {
+		clause, budgetArgs := latencyBudgetClause(opts.OverBudget)
+		query += " AND trace_id IN (SELECT trace_id FROM " + spans + " WHERE " + clause + ")"
+		args = append(args, budgetArgs...)
+	}
+	if opts.MinStartTime > 0 && opts.MaxStartTime > 0 {
+		query += " AND trace_id IN (SELECT trace_id FROM " + spans + " WHERE start_time_unix_nano >= ? AND start_time_unix_nano <= ?)"
+		args = append(args, opts.MinStartTime, opts.MaxStartTime)
+	} else {
+		if opts.MinStartTime > 0 {
+			query += " AND trace_id IN (SELECT trace_id FROM " + spans + " WHERE start_time_unix_nano >= ?)"
+			args = append(args, opts.MinStartTime)
+		}
+		if opts.MaxStartTime > 0 {
+			query += " AND trace_id IN (SELECT trace_id FROM " + spans + " WHERE start_time_unix_nano <= ?)"
+			args = append(args, opts.MaxStartTime)
+		}
+	}
+
+	return query, args, nil
+}
+
+// traceStatusClause restricts trace_id to traces with the given overall
+// status, using the status_code index rather than grouping every trace.
+func traceStatusClause(status int, spans string) string {
+	withStatus := func(codes string) string {
+		return "(SELECT trace_id FROM " + spans + " WHERE status_code IN (" + codes + ") AND trace_id IS NOT NULL)"
+	}
+	switch status {
+	case 2:
+		return " AND trace_id IN " + withStatus("2")
+	case 1:
+		return " AND trace_id IN " + withStatus("1") + " AND trace_id NOT IN " + withStatus("2")
+	default:
+		return " AND trace_id NOT IN " + withStatus("1, 2")
+	}
+}
+
+// traceDurationClause bounds the trace duration expression by min and max,
+// each ignored when not positive
+func traceDurationClause(duration string, min, max int64) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	if min > 0 {
+		clauses = append(clauses, duration+" >= ?")
+		args = append(args, min)
+	}
+	if max > 0 {
+		clauses = append(clauses, duration+" <= ?")
+		args = append(args, max)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// CountTraces returns the number of traces SearchTraces would return without
+// Limit and Offset. Counting stops after max traces (when max > 0), in which
+// case exact is false and count is max.
+func (s *Store) CountTraces(ctx context.Context, opts TraceSearchOptions, max int) (count int64, exact bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.attached) == 0 {
+		where, args, err := s.traceSummaryWhere(ctx, opts)
+		if err != nil {
+			return 0, false, err
+		}
+		return s.countCapped(ctx, "SELECT 1 FROM "+s.scoped(ctx, "trace_summaries", "trace_summaries")+" WHERE "+where, args, max)
+	}
+
+	spans := s.scoped(ctx, "spans", s.source("spans", spanSourceColumns))
+	where, args, err := s.traceSearchWhere(opts, spans)
+	if err != nil {
+		return 0, false, err
+	}
+	return s.countCapped(ctx, "SELECT DISTINCT trace_id FROM "+spans+" WHERE "+where, args, max)
+}
+
+// countCapped counts the rows of query, stopping after max rows (when
+// max > 0). Callers hold s.mu.
+func (s *Store) countCapped(ctx context.Context, query string, args []interface{}, max int) (int64, bool, error) {
+	if max > 0 {
+		query += " LIMIT ?"
+		args = append(args, max+1)
+	}
+	var count int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ("+query+")", args...).Scan(&count); err != nil {
+		return 0, false, err
+	}
+	if max > 0 && count > int64(max) {
+		return int64(max), false, nil
+	}
+	return count, true, nil
+}
+
+// QueryMetrics retrieves metrics matching the given pattern
+func (s *Store) QueryMetrics(ctx context.Context, opts MetricQueryOptions) ([]MetricRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query, args := metricsQuery(s.metricSources(ctx), opts)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metrics []MetricRecord
+	for rows.Next() {
+		var m MetricRecord
+		if err := rows.Scan(&m.ID, &m.Name, &m.Value, &m.Timestamp, &m.Tags); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rows.Err()
+}
+
+// metricsQuery builds the SQL for QueryMetrics and IterMetrics, reading from
+// source (see Store.source)
+func metricsQuery(src metricSources, opts MetricQueryOptions) (string, []interface{}) {
+	if opts.Resolution > 0 {
+		return rollupMetricsQuery(src, opts)
+	}
+	query := "SELECT id, name, value, timestamp, tags FROM " + src.raw + " WHERE 1=1"
+	args := []interface{}{}
+
+	if opts.Name != "" {
+		if opts.NamePattern {
+			query += " AND name LIKE ? ESCAPE '\\'"
+			args = append(args, opts.Name)
+		} else {
+			query += " AND name = ?"
+			args = append(args, opts.Name)
+		}
+	}
+	if opts.Service != "" {
+		query += " AND service = ?"
+		args = append(args, opts.Service)
+	}
+	if opts.MinTime > 0 {
+		query += " AND timestamp >= ?"
+		args = append(args, opts.MinTime)
+	}
+	if opts.MaxTime > 0 {
+		query += " AND timestamp <= ?"
+		args = append(args, opts.MaxTime)
+	}
+
+	query += " ORDER BY timestamp"
+
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+	return query, args
+}
+
+// MetricQueryOptions defines filters for metric queries
+type MetricQueryOptions struct {
+	Name        string
+	NamePattern bool // If true, use LIKE pattern matching
+	MinTime     int64
+	MaxTime     int64
+	Limit       int
+	// Service restricts results to points tagged with this service, read
+	// through the (service, timestamp) index
+	Service string
+	// Resolution, when set (e.g. ResolutionMinute), averages points into
+	// buckets of that size and includes the rollup tables
+	Resolution time.Duration
+}
+
+// ListServices returns unique service names
+func (s *Store) ListServices(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT DISTINCT service_name FROM "+s.scoped(ctx, "spans", "spans")+" WHERE service_name IS NOT NULL ORDER BY service_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []string
+	for rows.Next() {
+		var svc string
+		if err := rows.Scan(&svc); err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+	return services, rows.Err()
+}
+
+// ListOperations returns unique span names for a service
+func (s *Store) ListOperations(ctx context.Context, serviceName string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT DISTINCT span_name FROM "+s.scoped(ctx, "spans", "spans")+" WHERE service_name = ? ORDER BY span_name",
+		serviceName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ops []string
+	for rows.Next() {
+		var op string
+		if err := rows.Scan(&op); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+// ListServiceOperations returns every service with its distinct span names
+// in a single scan of the (service_name, span_name) index.
+func (s *Store) ListServiceOperations(ctx context.Context) (map[string][]string, error) {
+	return s.ListServiceOperationsBetween(ctx, 0, 0)
+}
+
+// ListServiceOperationsBetween is ListServiceOperations restricted to spans
+// starting in [minStartTime, maxStartTime] (Unix nanoseconds, 0 for
+// unbounded), read through the start time index, so services that stopped
+// reporting before the window are left out.
+func (s *Store) ListServiceOperationsBetween(ctx context.Context, minStartTime, maxStartTime int64) (map[string][]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := "SELECT DISTINCT service_name, span_name FROM " + s.scoped(ctx, "spans", "spans") + " WHERE service_name IS NOT NULL"
+	args := []interface{}{}
+	if minStartTime > 0 {
+		query += " AND start_time_unix_nano >= ?"
+		args = append(args, minStartTime)
+	}
+	if maxStartTime > 0 {
+		query += " AND start_time_unix_nano <= ?"
+		args = append(args, maxStartTime)
+	}
+	query += " ORDER BY service_name, span_name"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ops := make(map[string][]string)
+	for rows.Next() {
+		var service string
+		var op sql.NullString
+		if err := rows.Scan(&service, &op); err != nil {
+			return nil, err
+		}
+		if op.Valid {
+			ops[service] = append(ops[service], op.String)
+		} else if _, ok := ops[service]; !ok {
+			ops[service] = nil
+		}
+	}
+	return ops, rows.Err()
+}
+
+// Cleanup removes data older than the given duration
+func (s *Store) Cleanup(ctx context.Context, retention time.Duration) (int64, error) {
+	return s.CleanupTables(ctx, retention, retention)
+}
+
+// CleanupTables removes spans, compacted traces, logs and service graph edges
+// older than traceRetention and metrics (raw and rolled up) older than
+// metricRetention, so rolled-up metrics can outlive the raw traces they were
+// derived from.
+func (s *Store) CleanupTables(ctx context.Context, traceRetention, metricRetention time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-traceRetention).Unix()
+	metricCutoff := now.Add(-metricRetention).Unix()
+
+	// Delete old spans
+	result, err := s.db.ExecContext(ctx, "DELETE FROM spans WHERE created_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	spansDeleted, _ := result.RowsAffected()
+
+	// Delete old compacted traces, one row each
+	blobsDeleted, err := s.cleanupTraceBlobs(ctx, cutoff)
+	if err != nil {
+		return spansDeleted, err
+	}
+	spansDeleted += blobsDeleted
+
+	// Delete old metrics
+	result, err = s.db.ExecContext(ctx, "DELETE FROM metrics WHERE timestamp < ?", metricCutoff)
+	if err != nil {
+		return spansDeleted, err
+	}
+	metricsDeleted, _ := result.RowsAffected()
+	for _, table := range []string{"metrics_1m", "metrics_1h"} {
+		result, err = s.db.ExecContext(ctx, "DELETE FROM "+table+" WHERE timestamp < ?", metricCutoff)
+		if err != nil {
+			return spansDeleted + metricsDeleted, err
+		}
+		rolledUp, _ := result.RowsAffected()
+		metricsDeleted += rolledUp
+	}
+
+	// Delete old logs
+	result, err = s.db.ExecContext(ctx, "DELETE FROM logs WHERE created_at < ?", cutoff)
+	if err != nil {
+		return spansDeleted + metricsDeleted, err
+	}
+	logsDeleted, _ := result.RowsAffected()
+
+	// Delete old service graph edges
+	result, err = s.db.ExecContext(ctx, "DELETE FROM service_edges WHERE bucket < ?", cutoff)
+	if err != nil {
+		return spansDeleted + metricsDeleted + logsDeleted, err
+	}
+	edgesDeleted, _ := result.RowsAffected()
+
+	return spansDeleted + metricsDeleted + logsDeleted + edgesDeleted, nil
+}
+
+// Stats returns storage statistics
+func (s *Store) Stats(ctx context.Context) (StorageStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stats StorageStats
+
+	// Single query for all span-related stats
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COUNT(DISTINCT trace_id), COUNT(DISTINCT service_name)
+		FROM spans
+	`).Scan(&stats.SpanCount, &stats.TraceCount, &stats.ServiceCount)
+	if err != nil {
+		return stats, fmt.Errorf("failed to query span stats: %w", err)
+	}
+
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(span_count), 0) FROM trace_blobs").
+		Scan(&stats.CompactedTraceCount, &stats.CompactedSpanCount)
+	if err != nil {
+		return stats, fmt.Errorf("failed to query compacted trace stats: %w", err)
+	}
+
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM metrics").Scan(&stats.MetricCount); err != nil {
+		return stats, fmt.Errorf("failed to count metrics: %w", err)
+	}
+
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM logs").Scan(&stats.LogCount); err != nil {
+		return stats, fmt.Errorf("failed to count logs: %w", err)
+	}
+
+	walBytes, err := s.WALSize()
+	if err != nil {
+		return stats, fmt.Errorf("failed to stat WAL: %w", err)
+	}
+	stats.WALBytes = walBytes
+
+	return stats, nil
+}
+
+// StorageStats contains storage statistics
+type StorageStats struct {
+	SpanCount    int64 `json:"span_count"`
+	MetricCount  int64 `json:"metric_count"`
+	LogCount     int64 `json:"log_count"`
+	TraceCount   int64 `json:"trace_count"`
+	ServiceCount int64 `json:"service_count"`
+	// WALBytes is the size of the -wal file
+	WALBytes int64 `json:"wal_bytes"`
+	// CompactedTraceCount and CompactedSpanCount are the traces merged into
+	// trace blobs by CompactTraces and their spans, which SpanCount and
+	// TraceCount leave out
+	CompactedTraceCount int64 `json:"compacted_trace_count"`
+	CompactedSpanCount  int64 `json:"compacted_span_count"`
+}
+
+// Close flushes pending batched writes and closes the database connection
+func (s *Store) Close() error {
+	if s.batcher != nil {
+		s.batcher.close()
+	}
+	return s.db.Close()
+}
+
+// Checkpoint forces a WAL checkpoint
+func (s *Store) Checkpoint(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+// DedupeReport describes duplicate span rows found by DedupeSpans.
+type DedupeReport struct {
+	// DuplicateSpans is the number of rows sharing a (trace_id, span_id) with an older row
+	DuplicateSpans int64 `json:"duplicate_spans"`
+	// RemovedSpans is the number of duplicate rows deleted (0 on a dry run)
+	RemovedSpans int64 `json:"removed_spans"`
+	// ReclaimableBytes is the space a subsequent VACUUM would return to the
+	// filesystem. On a dry run it is estimated from the duplicate rows' size.
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+}
+
+// dedupeDuplicatesWhere selects every span row except the oldest per (trace_id, span_id).
+const dedupeDuplicatesWhere = `
+	trace_id IS NOT NULL AND span_id IS NOT NULL AND id NOT IN (
+		SELECT MIN(id) FROM spans
+		WHERE trace_id IS NOT NULL AND span_id IS NOT NULL
+		GROUP BY trace_id, span_id
+	)`
+
+// DedupeSpans finds span rows duplicated on (trace_id, span_id), keeping the
+// oldest copy. Unless dryRun is set, the duplicates are deleted.
+func (s *Store) DedupeSpans(ctx context.Context, dryRun bool) (DedupeReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var report DedupeReport
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(length(data) + COALESCE(length(payload), 0)), 0) FROM spans WHERE"+dedupeDuplicatesWhere,
+	).Scan(&report.DuplicateSpans, &report.ReclaimableBytes)
+	if err != nil {
+		return report, fmt.Errorf("failed to count duplicate spans: %w", err)
+	}
+	if dryRun || report.DuplicateSpans == 0 {
+		return report, nil
+	}
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM spans WHERE"+dedupeDuplicatesWhere)
+	if err != nil {
+		return report, fmt.Errorf("failed to delete duplicate spans: %w", err)
+	}
+	report.RemovedSpans, _ = result.RowsAffected()
+
+	freeBytes, err := s.freeBytes(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.ReclaimableBytes = freeBytes
+	return report, nil
+}
+
+// freeBytes returns the size of the database freelist, i.e. what VACUUM would reclaim.
+func (s *Store) freeBytes(ctx context.Context) (int64, error) {
+	var freePages, pageSize int64
+	if err := s.db.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&freePages); err != nil {
+		return 0, fmt.Errorf("failed to read freelist_count: %w", err)
+	}
+	if err := s.db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("failed to read page_size: %w", err)
+	}
+	return freePages * pageSize, nil
+}
+
+// Vacuum rebuilds the database file, returning free pages to the filesystem
+func (s *Store) Vacuum(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+// IntegrityCheck runs SQLite's quick_check and returns the problems it
+// reports, or none when the database is intact.
+func (s *Store) IntegrityCheck(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, "PRAGMA quick_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	return problems, rows.Err()
+}
@@ -0,0 +1,3423 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	store, err := New(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer store.Close()
+
+	// Verify WAL mode is enabled
+	var journalMode string
+	store.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	if journalMode != "wal" {
+		t.Errorf("Expected WAL mode, got %s", journalMode)
+	}
+}
+
+func TestInsertAndQuerySpan(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Create a test span JSON
+	span := map[string]interface{}{
+		"trace_id":             "abc123",
+		"span_id":              "span1",
+		"parent_span_id":       "",
+		"service_name":         "test-service",
+		"span_name":            "test-operation",
+		"start_time_unix_nano": time.Now().UnixNano(),
+		"end_time_unix_nano":   time.Now().Add(100 * time.Millisecond).UnixNano(),
+		"status":               map[string]interface{}{"code": 0},
+	}
+	spanJSON, _ := json.Marshal(span)
+
+	// Insert span
+	if err := store.InsertSpan(ctx, spanJSON); err != nil {
+		t.Fatalf("InsertSpan() error = %v", err)
+	}
+
+	// Query by trace ID
+	spans, err := store.QueryTraceByID(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("QueryTraceByID() error = %v", err)
+	}
+	if len(spans) != 1 {
+		t.Errorf("Expected 1 span, got %d", len(spans))
+	}
+}
+
+func TestQuerySpansWithFilters(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Insert spans with different services and statuses
+	services := []string{"svc-a", "svc-b", "svc-a"}
+	statuses := []int{0, 0, 2} // 2 = error
+	for i, svc := range services {
+		span := map[string]interface{}{
+			"trace_id":             "filter-trace-" + string(rune(i)),
+			"span_id":              "span" + string(rune(i)),
+			"service_name":         svc,
+			"span_name":            "operation",
+			"start_time_unix_nano": time.Now().UnixNano(),
+			"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": statuses[i]},
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	// Query by service
+	spans, err := store.QuerySpans(ctx, SpanQueryOptions{ServiceName: "svc-a"})
+	if err != nil {
+		t.Fatalf("QuerySpans() error = %v", err)
+	}
+	if len(spans) != 2 {
+		t.Errorf("Expected 2 spans for svc-a, got %d", len(spans))
+	}
+
+	// Query by status code (errors)
+	errorCode := 2
+	spans, err = store.QuerySpans(ctx, SpanQueryOptions{StatusCode: &errorCode})
+	if err != nil {
+		t.Fatalf("QuerySpans() error = %v", err)
+	}
+	if len(spans) != 1 {
+		t.Errorf("Expected 1 error span, got %d", len(spans))
+	}
+}
+
+func TestInsertAndQueryMetrics(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now().Unix()
+	tags := map[string]string{"service": "test-svc", "span": "test-op"}
+
+	// Insert metrics
+	if err := store.InsertMetric(ctx, "span_count", 42, now, tags); err != nil {
+		t.Fatalf("InsertMetric() error = %v", err)
+	}
+	if err := store.InsertMetric(ctx, "duration_ms", 125.5, now, tags); err != nil {
+		t.Fatalf("InsertMetric() error = %v", err)
+	}
+
+	// Query all metrics
+	metrics, err := store.QueryMetrics(ctx, MetricQueryOptions{})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Errorf("Expected 2 metrics, got %d", len(metrics))
+	}
+
+	// Query by name
+	metrics, err = store.QueryMetrics(ctx, MetricQueryOptions{Name: "span_count"})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(metrics) != 1 {
+		t.Errorf("Expected 1 metric, got %d", len(metrics))
+	}
+	if metrics[0].Value != 42 {
+		t.Errorf("Expected value 42, got %f", metrics[0].Value)
+	}
+}
+
+func TestListServicesAndOperations(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Insert spans with different services and operations
+	testData := []struct {
+		service string
+		op      string
+	}{
+		{"svc-a", "op1"},
+		{"svc-a", "op2"},
+		{"svc-b", "op1"},
+	}
+	for i, td := range testData {
+		span := map[string]interface{}{
+			"trace_id":             "trace-" + string(rune(i)),
+			"span_id":              "span" + string(rune(i)),
+			"service_name":         td.service,
+			"span_name":            td.op,
+			"start_time_unix_nano": time.Now().UnixNano(),
+			"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	// List services
+	services, err := store.ListServices(ctx)
+	if err != nil {
+		t.Fatalf("ListServices() error = %v", err)
+	}
+	if len(services) != 2 {
+		t.Errorf("Expected 2 services, got %d", len(services))
+	}
+
+	// List operations for svc-a
+	ops, err := store.ListOperations(ctx, "svc-a")
+	if err != nil {
+		t.Fatalf("ListOperations() error = %v", err)
+	}
+	if len(ops) != 2 {
+		t.Errorf("Expected 2 operations for svc-a, got %d", len(ops))
+	}
+}
+
+func TestListServiceOperations(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	for _, sp := range [][2]string{{"api", "GET /users"}, {"api", "POST /users"}, {"api", "GET /users"}, {"db", "query"}} {
+		spanJSON, _ := json.Marshal(map[string]interface{}{"trace_id": "t", "span_id": sp[1], "service_name": sp[0], "span_name": sp[1]})
+		store.InsertSpan(ctx, spanJSON)
+	}
+	store.InsertSpan(ctx, []byte(`{"trace_id":"t","service_name":"unnamed"}`))
+
+	ops, err := store.ListServiceOperations(ctx)
+	if err != nil {
+		t.Fatalf("ListServiceOperations() error = %v", err)
+	}
+	if len(ops) != 3 {
+		t.Fatalf("Expected 3 services, got %v", ops)
+	}
+	if got := ops["api"]; len(got) != 2 || got[0] != "GET /users" || got[1] != "POST /users" {
+		t.Errorf("Unexpected api operations %v", got)
+	}
+	if got, ok := ops["unnamed"]; !ok || len(got) != 0 {
+		t.Errorf("Expected service without span names to be listed, got %v, %v", got, ok)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	records := []map[string]interface{}{
+		{"timestamp_unix_nano": 1000, "severity_number": 9, "severity_text": "INFO", "service_name": "api", "trace_id": "t1", "body": "request started"},
+		{"timestamp_unix_nano": 2000, "severity_number": 17, "severity_text": "ERROR", "service_name": "api", "trace_id": "t1", "body": "request failed: timeout"},
+		{"timestamp_unix_nano": 3000, "severity_number": 9, "severity_text": "INFO", "service_name": "db", "body": "connected"},
+	}
+	var logs [][]byte
+	for _, r := range records {
+		data, _ := json.Marshal(r)
+		logs = append(logs, data)
+	}
+	if err := store.InsertLogs(ctx, logs); err != nil {
+		t.Fatalf("InsertLogs() error = %v", err)
+	}
+
+	all, err := store.QueryLogs(ctx, LogQueryOptions{})
+	if err != nil || len(all) != 3 || all[0].Timestamp != 3000 {
+		t.Fatalf("Expected 3 logs newest first, got %+v, %v", all, err)
+	}
+
+	tests := []struct {
+		name string
+		opts LogQueryOptions
+		want int
+	}{
+		{"service", LogQueryOptions{ServiceName: "api"}, 2},
+		{"trace", LogQueryOptions{TraceID: "t1"}, 2},
+		{"severity text", LogQueryOptions{SeverityText: "error"}, 1},
+		{"min severity", LogQueryOptions{MinSeverity: 13}, 1},
+		{"severity range", LogQueryOptions{MinSeverity: 9, MaxSeverity: 12}, 2},
+		{"contains", LogQueryOptions{Contains: []string{"request", "timeout"}}, 1},
+		{"time range", LogQueryOptions{MinTimestamp: 1500, MaxTimestamp: 2500}, 1},
+		{"limit", LogQueryOptions{Limit: 2, Ascending: true}, 2},
+	}
+	for _, tt := range tests {
+		got, err := store.QueryLogs(ctx, tt.opts)
+		if err != nil || len(got) != tt.want {
+			t.Errorf("%s: expected %d logs, got %d, %v", tt.name, tt.want, len(got), err)
+		}
+	}
+
+	asc, _ := store.QueryLogs(ctx, LogQueryOptions{Limit: 1, Ascending: true})
+	if len(asc) != 1 || asc[0].Timestamp != 1000 {
+		t.Errorf("Expected oldest log first, got %+v", asc)
+	}
+
+	services, err := store.ListLogLabelValues(ctx, "service_name")
+	if err != nil || len(services) != 2 || services[0] != "api" {
+		t.Errorf("Unexpected log services %v, %v", services, err)
+	}
+	if _, err := store.ListLogLabelValues(ctx, "body"); err == nil {
+		t.Error("Expected error for unsupported log label")
+	}
+
+	stats, _ := store.Stats(ctx)
+	if stats.LogCount != 3 {
+		t.Errorf("Expected 3 logs in stats, got %d", stats.LogCount)
+	}
+}
+
+func TestAttributeIndex(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	insert := func(traceID string, attrs map[string]interface{}) {
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id": traceID, "span_id": traceID + "-1", "service_name": "shop", "span_name": "checkout",
+			"start_time_unix_nano": 1000, "end_time_unix_nano": 2000, "status": map[string]interface{}{"code": 0},
+			"attributes": attrs,
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("t1", map[string]interface{}{"enduser.id": "12345", "order.id": 7})
+	insert("t2", map[string]interface{}{"enduser.id": "999", "cache.hit": true})
+
+	search := func(attrs map[string]string) []string {
+		t.Helper()
+		summaries, err := store.SearchTraces(ctx, TraceSearchOptions{Attributes: attrs})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		var ids []string
+		for _, s := range summaries {
+			ids = append(ids, s.TraceID)
+		}
+		return ids
+	}
+
+	// Without an index, lookups scan the span documents.
+	if ids := search(map[string]string{"enduser.id": "12345"}); len(ids) != 1 || ids[0] != "t1" {
+		t.Errorf("Expected t1 from document scan, got %v", ids)
+	}
+
+	// Existing spans are backfilled, new spans are indexed on insert.
+	if err := store.SetIndexedAttributes(ctx, []string{"enduser.id", "order.id", "cache.hit"}); err != nil {
+		t.Fatalf("SetIndexedAttributes() error = %v", err)
+	}
+	insert("t3", map[string]interface{}{"enduser.id": "12345"})
+
+	var indexed int
+	store.db.QueryRow("SELECT COUNT(*) FROM span_attributes").Scan(&indexed)
+	if indexed != 5 {
+		t.Errorf("Expected 5 index rows, got %d", indexed)
+	}
+	if ids := search(map[string]string{"enduser.id": "12345"}); len(ids) != 2 {
+		t.Errorf("Expected t1 and t3 from index, got %v", ids)
+	}
+	if ids := search(map[string]string{"order.id": "7", "enduser.id": "12345"}); len(ids) != 1 || ids[0] != "t1" {
+		t.Errorf("Expected t1 for numeric attribute, got %v", ids)
+	}
+	if ids := search(map[string]string{"cache.hit": "true"}); len(ids) != 1 || ids[0] != "t2" {
+		t.Errorf("Expected t2 for boolean attribute, got %v", ids)
+	}
+
+	// Index rows follow span deletes.
+	store.db.Exec("DELETE FROM spans WHERE trace_id = 't3'")
+	store.db.QueryRow("SELECT COUNT(*) FROM span_attributes").Scan(&indexed)
+	if indexed != 4 {
+		t.Errorf("Expected 4 index rows after delete, got %d", indexed)
+	}
+
+	// Dropping a key removes its rows; the setting survives a reopen.
+	if err := store.SetIndexedAttributes(ctx, []string{"enduser.id"}); err != nil {
+		t.Fatal(err)
+	}
+	store.db.QueryRow("SELECT COUNT(*) FROM span_attributes").Scan(&indexed)
+	if indexed != 2 {
+		t.Errorf("Expected 2 index rows after dropping keys, got %d", indexed)
+	}
+	reopened, err := New(store.dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if keys := reopened.IndexedAttributes(); len(keys) != 1 || keys[0] != "enduser.id" {
+		t.Errorf("Expected indexed keys to be loaded on open, got %v", keys)
+	}
+
+	if _, err := store.SearchTraces(ctx, TraceSearchOptions{Attributes: map[string]string{`a"b`: "x"}}); err == nil {
+		t.Error("Expected error for attribute key with a quote")
+	}
+}
+
+func TestSearchTracesFilter(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	insert := func(traceID, spanID, service, name string, durationMs int64, status int, kind string, attrs map[string]interface{}) {
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id": traceID, "span_id": spanID, "service_name": service, "span_name": name, "kind": kind,
+			"start_time_unix_nano": 1000, "end_time_unix_nano": 1000 + durationMs*1e6,
+			"status": map[string]interface{}{"code": status}, "attributes": attrs,
+			"resource": map[string]interface{}{"service.name": service, "deployment.environment": "prod"},
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("t1", "a", "api", "GET /cart", 250, 0, "Server", map[string]interface{}{"http.status_code": 200, "http.route": "/cart"})
+	insert("t1", "b", "db", "SELECT", 20, 0, "Client", map[string]interface{}{"db.system": "postgres"})
+	insert("t2", "c", "api", "POST /pay", 50, 2, "Server", map[string]interface{}{"http.status_code": 500, "http.route": "/pay"})
+	insert("t3", "d", "worker", "job", 5, 0, "Internal", nil)
+
+	cmp := func(scope FieldScope, name string, op CompareOp, value interface{}) *SpanCondition {
+		return &SpanCondition{Field: SpanField{Scope: scope, Name: name}, Compare: op, Value: value}
+	}
+	spanset := func(c *SpanCondition) *TraceFilter { return &TraceFilter{Spanset: c} }
+
+	tests := []struct {
+		name   string
+		filter *TraceFilter
+		want   []string
+	}{
+		{"any span", spanset(nil), []string{"t1", "t2", "t3"}},
+		{"resource service", spanset(cmp(ScopeResource, "service.name", CompareEq, "api")), []string{"t1", "t2"}},
+		{"duration", spanset(cmp(ScopeIntrinsic, "duration", CompareGt, int64(100e6))), []string{"t1"}},
+		{"status", spanset(cmp(ScopeIntrinsic, "status", CompareEq, int64(2))), []string{"t2"}},
+		{"kind", spanset(cmp(ScopeIntrinsic, "kind", CompareEq, "client")), []string{"t1"}},
+		{"span attribute", spanset(cmp(ScopeSpan, "http.status_code", CompareGte, int64(500))), []string{"t2"}},
+		{"unscoped resource", spanset(cmp(ScopeAny, "deployment.environment", CompareEq, "prod")), []string{"t1", "t2", "t3"}},
+		{"regex", spanset(cmp(ScopeSpan, "http.route", CompareRegex, "/ca.*")), []string{"t1"}},
+		{"regex is anchored", spanset(cmp(ScopeSpan, "http.route", CompareRegex, "ca")), nil},
+		{"not regex skips missing", spanset(cmp(ScopeSpan, "http.route", CompareNotRegex, "/cart")), []string{"t2"}},
+		{"and within span", spanset(&SpanCondition{Op: OpAnd,
+			Left:  cmp(ScopeResource, "service.name", CompareEq, "api"),
+			Right: cmp(ScopeIntrinsic, "duration", CompareLt, int64(100e6))}), []string{"t2"}},
+		{"or within span", spanset(&SpanCondition{Op: OpOr,
+			Left:  cmp(ScopeIntrinsic, "name", CompareEq, "job"),
+			Right: cmp(ScopeIntrinsic, "status", CompareEq, int64(2))}), []string{"t2", "t3"}},
+		{"spansets across spans", &TraceFilter{Op: OpAnd,
+			Left:  spanset(cmp(ScopeResource, "service.name", CompareEq, "api")),
+			Right: spanset(cmp(ScopeSpan, "db.system", CompareEq, "postgres"))}, []string{"t1"}},
+	}
+	for _, tt := range tests {
+		summaries, err := store.SearchTraces(ctx, TraceSearchOptions{Filter: tt.filter})
+		if err != nil {
+			t.Errorf("%s: SearchTraces() error = %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, s := range summaries {
+			got = append(got, s.TraceID)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	bad := []*TraceFilter{
+		spanset(cmp(ScopeIntrinsic, "nope", CompareEq, "x")),
+		spanset(cmp(ScopeSpan, `a"b`, CompareEq, "x")),
+		spanset(cmp(ScopeSpan, "http.route", CompareRegex, "(")),
+		{Op: OpAnd, Left: spanset(nil)},
+	}
+	for _, f := range bad {
+		if _, err := store.SearchTraces(ctx, TraceSearchOptions{Filter: f}); err == nil {
+			t.Errorf("Expected error for filter %+v", f)
+		}
+	}
+}
+
+func TestSearchTracesTraceState(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	for _, sp := range [][2]string{{"t1", "congo=xyz,rojo=00f067aa0ba902b7"}, {"t2", "rojo=abc , congo=XYZ"}, {"t3", ""}} {
+		doc := map[string]interface{}{
+			"trace_id": sp[0], "span_id": sp[0], "service_name": "api", "span_name": "op",
+			"start_time_unix_nano": 1000, "end_time_unix_nano": 2000, "status": map[string]interface{}{"code": 0},
+		}
+		if sp[1] != "" {
+			doc["trace_state"] = sp[1]
+		}
+		spanJSON, _ := json.Marshal(doc)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	var column string
+	if err := store.db.QueryRow("SELECT trace_state FROM spans WHERE trace_id = 't1'").Scan(&column); err != nil || column != "congo=xyz,rojo=00f067aa0ba902b7" {
+		t.Errorf("Expected trace_state column, got %q, %v", column, err)
+	}
+
+	tests := []struct {
+		entries []TraceStateEntry
+		want    string
+	}{
+		{[]TraceStateEntry{{Key: "congo", Value: "xyz"}}, "t1"},
+		{[]TraceStateEntry{{Key: "congo", Value: "XYZ"}}, "t2"},
+		{[]TraceStateEntry{{Key: "congo"}}, "t1,t2"},
+		{[]TraceStateEntry{{Key: "rojo", Value: "abc"}, {Key: "congo"}}, "t2"},
+		{[]TraceStateEntry{{Key: "ongo"}}, ""},
+		{[]TraceStateEntry{{Key: "congo", Value: "xy"}}, ""},
+	}
+	for _, tt := range tests {
+		summaries, err := store.SearchTraces(ctx, TraceSearchOptions{TraceState: tt.entries})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		var got []string
+		for _, s := range summaries {
+			got = append(got, s.TraceID)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("TraceState %+v: got %v, want %q", tt.entries, got, tt.want)
+		}
+	}
+}
+
+func TestTraceStateMigration(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+	store, err := New(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec("ALTER TABLE spans DROP COLUMN trace_state"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = New(dbPath)
+	if err != nil {
+		t.Fatalf("New() on legacy schema error = %v", err)
+	}
+	defer store.Close()
+	store.InsertSpan(context.Background(), []byte(`{"trace_id":"t","trace_state":"congo=1"}`))
+	var ts string
+	if err := store.db.QueryRow("SELECT trace_state FROM spans").Scan(&ts); err != nil || ts != "congo=1" {
+		t.Errorf("Expected migrated trace_state column, got %q, %v", ts, err)
+	}
+}
+
+func TestCountAndOffset(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	baseTime := time.Now()
+	for i := 0; i < 5; i++ {
+		startTime := baseTime.Add(time.Duration(i) * time.Minute)
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":             "count-trace-" + string(rune('a'+i)),
+			"span_id":              "count-span-" + string(rune('a'+i)),
+			"service_name":         "count-svc",
+			"span_name":            "op",
+			"start_time_unix_nano": startTime.UnixNano(),
+			"end_time_unix_nano":   startTime.Add(10 * time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": i % 2},
+		})
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	t.Run("trace pages", func(t *testing.T) {
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{ServiceName: "count-svc", Limit: 2, Offset: 2})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		if len(traces) != 2 || traces[0].TraceID != "count-trace-c" {
+			t.Errorf("Expected second page starting at count-trace-c, got %+v", traces)
+		}
+	})
+
+	t.Run("trace count", func(t *testing.T) {
+		count, exact, err := store.CountTraces(ctx, TraceSearchOptions{ServiceName: "count-svc", Limit: 2}, 0)
+		if err != nil {
+			t.Fatalf("CountTraces() error = %v", err)
+		}
+		if count != 5 || !exact {
+			t.Errorf("Expected exact count 5, got %d (exact=%v)", count, exact)
+		}
+	})
+
+	t.Run("capped count", func(t *testing.T) {
+		count, exact, err := store.CountTraces(ctx, TraceSearchOptions{}, 3)
+		if err != nil {
+			t.Fatalf("CountTraces() error = %v", err)
+		}
+		if count != 3 || exact {
+			t.Errorf("Expected estimate 3, got %d (exact=%v)", count, exact)
+		}
+	})
+
+	t.Run("span pages and count", func(t *testing.T) {
+		errorCode := 1
+		opts := SpanQueryOptions{ServiceName: "count-svc", StatusCode: &errorCode, Limit: 1, Offset: 1}
+		spans, err := store.QuerySpans(ctx, opts)
+		if err != nil {
+			t.Fatalf("QuerySpans() error = %v", err)
+		}
+		if len(spans) != 1 || !strings.Contains(string(spans[0]), "count-span-b") {
+			t.Errorf("Expected count-span-b on the second page, got %s", spans)
+		}
+		count, exact, err := store.CountSpans(ctx, opts, 10)
+		if err != nil {
+			t.Fatalf("CountSpans() error = %v", err)
+		}
+		if count != 2 || !exact {
+			t.Errorf("Expected exact count 2, got %d (exact=%v)", count, exact)
+		}
+	})
+}
+
+func TestServiceEdges(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	start := time.Now().Add(-time.Minute)
+	insert := func(traceID, spanID, parentID, service string, status int) {
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":             traceID,
+			"span_id":              spanID,
+			"parent_span_id":       parentID,
+			"service_name":         service,
+			"span_name":            "op",
+			"start_time_unix_nano": start.UnixNano(),
+			"end_time_unix_nano":   start.Add(5 * time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": status},
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build := func() {
+		for {
+			n, err := store.BuildServiceEdges(ctx, 2)
+			if err != nil {
+				t.Fatalf("BuildServiceEdges() error = %v", err)
+			}
+			if n == 0 {
+				return
+			}
+		}
+	}
+
+	// frontend -> api within one trace, plus an in-process child of api
+	insert("edge-trace-1", "f1", "", "frontend", 0)
+	insert("edge-trace-1", "a1", "f1", "api", 2)
+	insert("edge-trace-1", "a2", "a1", "api", 0)
+	build()
+
+	// The server span is stored (and built) before its client span arrives
+	insert("edge-trace-2", "d1", "a3", "db", 0)
+	build()
+	insert("edge-trace-2", "a3", "", "api", 0)
+	build()
+	build()
+
+	edges, err := store.QueryServiceEdges(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("QueryServiceEdges() error = %v", err)
+	}
+	want := []ServiceEdge{
+		{Parent: "api", Child: "db", CallCount: 1, DurationNsSum: int64(5 * time.Millisecond)},
+		{Parent: "frontend", Child: "api", CallCount: 1, ErrorCount: 1, DurationNsSum: int64(5 * time.Millisecond)},
+	}
+	if len(edges) != len(want) {
+		t.Fatalf("Expected %d edges, got %+v", len(want), edges)
+	}
+	for i := range want {
+		if edges[i] != want[i] {
+			t.Errorf("edge %d = %+v, want %+v", i, edges[i], want[i])
+		}
+	}
+
+	edges, err = store.QueryServiceEdges(ctx, time.Now().Add(time.Hour).UnixNano(), 0)
+	if err != nil {
+		t.Fatalf("QueryServiceEdges() error = %v", err)
+	}
+	if len(edges) != 0 {
+		t.Errorf("Expected no edges after the time range, got %+v", edges)
+	}
+}
+
+func TestSelfTimes(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	start := time.Now().Add(-time.Minute)
+	insert := func(spanID, parentID, name string, duration time.Duration) {
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":             "self-trace",
+			"span_id":              spanID,
+			"parent_span_id":       parentID,
+			"service_name":         "self-svc",
+			"span_name":            name,
+			"start_time_unix_nano": start.UnixNano(),
+			"end_time_unix_nano":   start.Add(duration).UnixNano(),
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update := func() {
+		for {
+			n, err := store.UpdateSelfTimes(ctx, 1)
+			if err != nil {
+				t.Fatalf("UpdateSelfTimes() error = %v", err)
+			}
+			if n == 0 {
+				return
+			}
+		}
+	}
+
+	// One child is stored before its parent, one after, in separate windows.
+	insert("query", "root", "db.query", 30*time.Millisecond)
+	update()
+	insert("root", "", "handler", 100*time.Millisecond)
+	update()
+	insert("render", "root", "render", 20*time.Millisecond)
+
+	// Processed spans only: render is not counted yet.
+	ops, err := store.OperationSelfTimes(ctx, SelfTimeQueryOptions{ServiceName: "self-svc"})
+	if err != nil {
+		t.Fatalf("OperationSelfTimes() error = %v", err)
+	}
+	if len(ops) != 2 || ops[0].SpanName != "handler" || ops[0].SelfTimeNsSum != int64(70*time.Millisecond) {
+		t.Fatalf("Unexpected self-times before update: %+v", ops)
+	}
+
+	update()
+	ops, err = store.OperationSelfTimes(ctx, SelfTimeQueryOptions{ServiceName: "self-svc", Limit: 1})
+	if err != nil {
+		t.Fatalf("OperationSelfTimes() error = %v", err)
+	}
+	want := OperationSelfTime{
+		ServiceName:   "self-svc",
+		SpanName:      "handler",
+		SpanCount:     1,
+		SelfTimeNsSum: int64(50 * time.Millisecond),
+		DurationNsSum: int64(100 * time.Millisecond),
+	}
+	if len(ops) != 1 || ops[0] != want {
+		t.Errorf("OperationSelfTimes() = %+v, want %+v", ops, want)
+	}
+}
+
+func TestSearchTracesStatus(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	// Per-trace span status codes: error wins over ok, ok over unset.
+	for traceID, codes := range map[string][]int{
+		"status-error": {1, 2, 2},
+		"status-ok":    {0, 1},
+		"status-unset": {0, 0},
+	} {
+		for i, code := range codes {
+			spanJSON, _ := json.Marshal(map[string]interface{}{
+				"trace_id":             traceID,
+				"span_id":              traceID + "-" + string(rune('a'+i)),
+				"service_name":         "status-svc",
+				"span_name":            "op",
+				"start_time_unix_nano": now.UnixNano(),
+				"end_time_unix_nano":   now.Add(time.Millisecond).UnixNano(),
+				"status":               map[string]interface{}{"code": code},
+			})
+			store.InsertSpan(ctx, spanJSON)
+		}
+	}
+
+	for status, want := range map[int]string{2: "status-error", 1: "status-ok", 0: "status-unset"} {
+		status := status
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{Status: &status})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		if len(traces) != 1 || traces[0].TraceID != want {
+			t.Errorf("status %d: expected only %s, got %+v", status, want, traces)
+			continue
+		}
+		if status == 2 && traces[0].ErrorCount != 2 {
+			t.Errorf("Expected 2 error spans, got %d", traces[0].ErrorCount)
+		}
+	}
+}
+
+func TestSearchTracesDuration(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	// Trace durations span from the first start to the last end: 10ms, 50ms
+	// and 200ms, although no single span of the last one lasts 200ms
+	for traceID, bounds := range map[string][][2]time.Duration{
+		"duration-10ms":  {{0, 10 * time.Millisecond}},
+		"duration-50ms":  {{0, 30 * time.Millisecond}, {20 * time.Millisecond, 50 * time.Millisecond}},
+		"duration-200ms": {{0, 100 * time.Millisecond}, {150 * time.Millisecond, 200 * time.Millisecond}},
+	} {
+		for i, b := range bounds {
+			spanJSON, _ := json.Marshal(map[string]interface{}{
+				"trace_id":             traceID,
+				"span_id":              fmt.Sprintf("%s-%d", traceID, i),
+				"service_name":         "duration-svc",
+				"span_name":            "op",
+				"start_time_unix_nano": now.Add(b[0]).UnixNano(),
+				"end_time_unix_nano":   now.Add(b[1]).UnixNano(),
+			})
+			if err := store.InsertSpan(ctx, spanJSON); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ms := func(n int64) int64 { return n * int64(time.Millisecond) }
+	for _, tt := range []struct {
+		min, max int64
+		want     []string
+	}{
+		{ms(40), 0, []string{"duration-200ms", "duration-50ms"}},
+		{0, ms(50), []string{"duration-10ms", "duration-50ms"}},
+		{ms(20), ms(100), []string{"duration-50ms"}},
+		{ms(300), 0, nil},
+	} {
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{MinDurationNs: tt.min, MaxDurationNs: tt.max})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		var got []string
+		for _, tr := range traces {
+			got = append(got, tr.TraceID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("min %d, max %d: expected %v, got %v", tt.min, tt.max, tt.want, got)
+		}
+		if count, _, _ := store.CountTraces(ctx, TraceSearchOptions{MinDurationNs: tt.min, MaxDurationNs: tt.max}, 0); count != int64(len(tt.want)) {
+			t.Errorf("min %d, max %d: expected a count of %d, got %d", tt.min, tt.max, len(tt.want), count)
+		}
+	}
+}
+
+func TestREDSummaries(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	insert := func(service, name, kind string, ms, code int) {
+		t.Helper()
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":             fmt.Sprintf("red-%s-%d", service, ms),
+			"span_id":              fmt.Sprintf("%s-%s-%d", service, name, ms),
+			"service_name":         service,
+			"span_name":            name,
+			"kind":                 kind,
+			"start_time_unix_nano": now.UnixNano(),
+			"end_time_unix_nano":   now.Add(time.Duration(ms) * time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": code},
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// checkout serves 1..100ms requests, every tenth failing
+	for ms := 1; ms <= 100; ms++ {
+		code := 1
+		if ms%10 == 0 {
+			code = 2
+		}
+		name := "GET /cart"
+		if ms > 60 {
+			name = "POST /pay"
+		}
+		insert("checkout", name, "Server", ms, code)
+	}
+	insert("checkout", "SELECT", "Client", 500, 0)
+	insert("payments", "charge", "Server", 7, 0)
+
+	total, err := store.REDSummaries(ctx, REDQueryOptions{ServiceName: "checkout", Kind: "Server"})
+	if err != nil {
+		t.Fatalf("REDSummaries() error = %v", err)
+	}
+	want := REDSummary{Requests: 100, Errors: 10, DurationNsSum: 5050 * int64(time.Millisecond), DurationNsMax: int64(100 * time.Millisecond),
+		P50Ns: int64(50 * time.Millisecond), P90Ns: int64(90 * time.Millisecond), P95Ns: int64(95 * time.Millisecond), P99Ns: int64(99 * time.Millisecond)}
+	if len(total) != 1 || total[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, total)
+	}
+
+	ops, err := store.REDSummaries(ctx, REDQueryOptions{ServiceName: "checkout", GroupBy: REDGroupOperation})
+	if err != nil {
+		t.Fatalf("REDSummaries() error = %v", err)
+	}
+	if len(ops) != 3 || ops[0].Group != "GET /cart" || ops[0].Requests != 60 || ops[0].Errors != 6 || ops[1].Group != "POST /pay" || ops[2].Group != "SELECT" {
+		t.Errorf("Unexpected operations %+v", ops)
+	}
+
+	services, _ := store.REDSummaries(ctx, REDQueryOptions{GroupBy: REDGroupService, MinStartTime: now.Add(-time.Minute).UnixNano()})
+	if len(services) != 2 || services[0].Group != "checkout" || services[1].Group != "payments" || services[1].P99Ns != int64(7*time.Millisecond) {
+		t.Errorf("Unexpected services %+v", services)
+	}
+
+	if none, err := store.REDSummaries(ctx, REDQueryOptions{ServiceName: "missing"}); err != nil || len(none) != 0 {
+		t.Errorf("Expected no rows for an unknown service, got %+v (%v)", none, err)
+	}
+	if _, err := store.REDSummaries(ctx, REDQueryOptions{GroupBy: "tenant"}); err == nil {
+		t.Error("Expected an unknown group to be rejected")
+	}
+}
+
+func TestSpanRange(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	base := time.Now().Truncate(time.Minute).Add(-time.Hour)
+	insert := func(i int, offset time.Duration, method string, ms int) {
+		t.Helper()
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":             fmt.Sprintf("range-%d", i),
+			"span_id":              fmt.Sprintf("range-span-%d", i),
+			"service_name":         "api",
+			"span_name":            "handle",
+			"start_time_unix_nano": base.Add(offset).UnixNano(),
+			"end_time_unix_nano":   base.Add(offset + time.Duration(ms)*time.Millisecond).UnixNano(),
+			"attributes":           map[string]interface{}{"http.method": method},
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// First minute: GETs of 10..40ms and one POST; second minute: one GET
+	for i, ms := range []int{10, 20, 30, 40} {
+		insert(i, time.Duration(i)*time.Second, "GET", ms)
+	}
+	insert(4, 5*time.Second, "POST", 100)
+	insert(5, 70*time.Second, "GET", 5)
+
+	opts := SpanRangeOptions{MinStartTime: base.UnixNano(), MaxStartTime: base.Add(2 * time.Minute).UnixNano(), StepNs: int64(time.Minute)}
+	points, err := store.SpanRange(ctx, opts)
+	if err != nil {
+		t.Fatalf("SpanRange() error = %v", err)
+	}
+	if len(points) != 2 || points[0].Count != 5 || points[1].Count != 1 || points[1].BucketStart != base.Add(time.Minute).UnixNano() {
+		t.Errorf("Unexpected buckets %+v", points)
+	}
+
+	opts.GroupBy = []SpanField{{Scope: ScopeSpan, Name: "http.method"}}
+	opts.Quantiles = []float64{0, 0.5, 1}
+	opts.Spanset = &SpanCondition{Field: SpanField{Scope: ScopeIntrinsic, Name: "name"}, Compare: CompareEq, Value: "handle"}
+	points, err = store.SpanRange(ctx, opts)
+	if err != nil {
+		t.Fatalf("SpanRange() error = %v", err)
+	}
+	ms := func(n int64) int64 { return n * int64(time.Millisecond) }
+	if len(points) != 3 || points[0].Group[0] != "GET" || points[0].Count != 4 || points[2].Group[0] != "POST" {
+		t.Fatalf("Unexpected groups %+v", points)
+	}
+	if q := points[0].QuantileNs; q[0] != ms(10) || q[1] != ms(20) || q[2] != ms(40) {
+		t.Errorf("Expected GET quantiles 10, 20 and 40ms, got %v", q)
+	}
+	if q := points[1].QuantileNs; q[0] != ms(5) || q[2] != ms(5) {
+		t.Errorf("Expected a single 5ms span in the second minute, got %v", q)
+	}
+
+	if _, err := store.SpanRange(ctx, SpanRangeOptions{MinStartTime: 1, MaxStartTime: 2}); err == nil {
+		t.Error("Expected a zero step to be rejected")
+	}
+	opts.Quantiles = []float64{1.5}
+	if _, err := store.SpanRange(ctx, opts); err == nil {
+		t.Error("Expected a quantile above 1 to be rejected")
+	}
+}
+
+func TestMatchSpanSets(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	for i, code := range []int{2, 0, 2, 2} {
+		trace := "spanset-a"
+		if i == 3 {
+			trace = "spanset-b"
+		}
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":             trace,
+			"span_id":              fmt.Sprintf("span-%d", i),
+			"service_name":         "api",
+			"span_name":            fmt.Sprintf("op-%d", i),
+			"start_time_unix_nano": now.Add(time.Duration(i) * time.Millisecond).UnixNano(),
+			"end_time_unix_nano":   now.Add(time.Duration(i+5) * time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": code},
+			"attributes":           map[string]interface{}{"http.status_code": 500 + i},
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sets, err := store.MatchSpanSets(ctx, SpanSetOptions{
+		TraceIDs:  []string{"spanset-a", "spanset-b", "spanset-none"},
+		Condition: &SpanCondition{Field: SpanField{Scope: ScopeIntrinsic, Name: "status"}, Compare: CompareEq, Value: int64(2)},
+		Fields:    []SpanField{{Scope: ScopeSpan, Name: "http.status_code"}, {Scope: ScopeSpan, Name: "missing"}},
+		PerTrace:  1,
+	})
+	if err != nil {
+		t.Fatalf("MatchSpanSets() error = %v", err)
+	}
+	if len(sets) != 2 || sets["spanset-a"].Matched != 2 || len(sets["spanset-a"].Spans) != 1 || sets["spanset-b"].Matched != 1 {
+		t.Fatalf("Unexpected span sets %+v", sets)
+	}
+	span := sets["spanset-a"].Spans[0]
+	if span.SpanID != "span-0" || span.Name != "op-0" || span.ServiceName != "api" || span.DurationNanos != int64(5*time.Millisecond) {
+		t.Errorf("Unexpected first span %+v", span)
+	}
+	if span.Values[0] != int64(500) || span.Values[1] != nil {
+		t.Errorf("Expected values [500 <nil>], got %v", span.Values)
+	}
+
+	all, err := store.MatchSpanSets(ctx, SpanSetOptions{TraceIDs: []string{"spanset-a"}})
+	if err != nil || len(all["spanset-a"].Spans) != 3 {
+		t.Errorf("Expected every span of the trace without a condition, got %+v (%v)", all, err)
+	}
+}
+
+func TestAttributeValues(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	for i, attrs := range []map[string]interface{}{
+		{"http.method": "GET", "cache.hit": true},
+		{"http.method": "POST", "cache.hit": false},
+		{"http.method": "GET", "http.status_code": 404},
+	} {
+		service := "web"
+		if i == 2 {
+			service = "worker"
+		}
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":             fmt.Sprintf("values-%d", i),
+			"span_id":              fmt.Sprintf("values-span-%d", i),
+			"service_name":         service,
+			"span_name":            "op",
+			"start_time_unix_nano": now.Add(time.Duration(i) * time.Second).UnixNano(),
+			"end_time_unix_nano":   now.Add(time.Duration(i)*time.Second + time.Millisecond).UnixNano(),
+			"attributes":           attrs,
+			"resource":             map[string]interface{}{"deployment.environment": "prod", "service.name": service},
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(opts AttributeValuesOptions) []string {
+		t.Helper()
+		values, err := store.AttributeValues(ctx, opts)
+		if err != nil {
+			t.Fatalf("AttributeValues(%+v) error = %v", opts.Field, err)
+		}
+		return values
+	}
+	method := SpanField{Scope: ScopeSpan, Name: "http.method"}
+	for _, tt := range []struct {
+		opts AttributeValuesOptions
+		want []string
+	}{
+		{AttributeValuesOptions{Field: method}, []string{"GET", "POST"}},
+		{AttributeValuesOptions{Field: method, ServiceName: "worker"}, []string{"GET"}},
+		{AttributeValuesOptions{Field: method, ScanLimit: 1}, []string{"GET"}},
+		{AttributeValuesOptions{Field: method, Limit: 1}, []string{"GET"}},
+		{AttributeValuesOptions{Field: SpanField{Scope: ScopeSpan, Name: "cache.hit"}}, []string{"false", "true"}},
+		{AttributeValuesOptions{Field: SpanField{Scope: ScopeAny, Name: "http.status_code"}}, []string{"404"}},
+		{AttributeValuesOptions{Field: SpanField{Scope: ScopeResource, Name: "deployment.environment"}}, []string{"prod"}},
+		{AttributeValuesOptions{Field: SpanField{Scope: ScopeResource, Name: "service.name"}, MinStartTime: now.Add(1500 * time.Millisecond).UnixNano()}, []string{"worker"}},
+		{AttributeValuesOptions{Field: SpanField{Scope: ScopeIntrinsic, Name: "name"}}, []string{"op"}},
+	} {
+		if got := list(tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: expected %v, got %v", tt.opts, tt.want, got)
+		}
+	}
+
+	// Indexed attributes are read from the index, with the same filters
+	if err := store.SetIndexedAttributes(ctx, []string{"http.method", "cache.hit"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := list(AttributeValuesOptions{Field: method, ServiceName: "web"}); !reflect.DeepEqual(got, []string{"GET", "POST"}) {
+		t.Errorf("Expected GET and POST from the index, got %v", got)
+	}
+	if got := list(AttributeValuesOptions{Field: SpanField{Scope: ScopeSpan, Name: "cache.hit"}}); !reflect.DeepEqual(got, []string{"false", "true"}) {
+		t.Errorf("Expected booleans from the index, got %v", got)
+	}
+	if _, err := store.AttributeValues(ctx, AttributeValuesOptions{Field: SpanField{Scope: ScopeSpan, Name: `bad"key`}}); err == nil {
+		t.Error("Expected an invalid key to be rejected")
+	}
+}
+
+func TestQuerySpansAttributes(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	if err := store.SetIndexedAttributes(ctx, []string{"http.status_code"}); err != nil {
+		t.Fatalf("SetIndexedAttributes() error = %v", err)
+	}
+	for i, attrs := range []map[string]interface{}{
+		{"http.status_code": 500, "tenant": "acme"},
+		{"http.status_code": 500, "tenant": "globex"},
+		{"http.status_code": 200, "tenant": "acme"},
+	} {
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":     "attr-trace",
+			"span_id":      "attr-span-" + string(rune('a'+i)),
+			"service_name": "attr-svc",
+			"span_name":    "GET /",
+			"attributes":   attrs,
+		})
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	for _, tc := range []struct {
+		attrs map[string]string
+		want  int
+	}{
+		{map[string]string{"http.status_code": "500"}, 2},                   // indexed
+		{map[string]string{"tenant": "acme"}, 2},                            // document scan
+		{map[string]string{"http.status_code": "500", "tenant": "acme"}, 1}, // both
+		{map[string]string{"tenant": "initech"}, 0},
+	} {
+		spans, err := store.QuerySpans(ctx, SpanQueryOptions{Attributes: tc.attrs})
+		if err != nil {
+			t.Fatalf("QuerySpans(%v) error = %v", tc.attrs, err)
+		}
+		if len(spans) != tc.want {
+			t.Errorf("QuerySpans(%v) returned %d spans, want %d", tc.attrs, len(spans), tc.want)
+		}
+		count, _, err := store.CountSpans(ctx, SpanQueryOptions{Attributes: tc.attrs}, 0)
+		if err != nil || count != int64(tc.want) {
+			t.Errorf("CountSpans(%v) = %d, %v; want %d", tc.attrs, count, err, tc.want)
+		}
+	}
+
+	if _, err := store.QuerySpans(ctx, SpanQueryOptions{Attributes: map[string]string{`bad"key`: "x"}}); err == nil {
+		t.Error("Expected error for invalid attribute key")
+	}
+}
+
+func TestSearchText(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	if !store.TextSearchAvailable() {
+		if _, err := store.SearchText(ctx, TextSearchOptions{Query: "x"}); err != ErrTextSearchUnavailable {
+			t.Fatalf("SearchText() error = %v, want ErrTextSearchUnavailable", err)
+		}
+		t.Skip("SQLite built without FTS5; run with -tags sqlite_fts5")
+	}
+
+	for i, span := range []map[string]interface{}{
+		{"span_name": "GET /orders", "status": map[string]interface{}{"code": 2, "message": "upstream: connection refused"}},
+		{"span_name": "db.query", "events": []interface{}{map[string]interface{}{
+			"name": "exception",
+			"attributes": map[string]interface{}{
+				"exception.type":       "java.net.ConnectException",
+				"exception.message":    "Connection refused (Connection refused)",
+				"exception.stacktrace": "at java.net.PlainSocketImpl.socketConnect",
+			},
+		}}},
+		{"span_name": "connection pool refill"},
+	} {
+		span["trace_id"] = "fts-trace-" + string(rune('a'+i))
+		span["span_id"] = "fts-span"
+		span["service_name"] = "fts-svc"
+		span["start_time_unix_nano"] = int64(1000 + i)
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	matches, err := store.SearchText(ctx, TextSearchOptions{Query: "Connection Refused"})
+	if err != nil {
+		t.Fatalf("SearchText() error = %v", err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("SearchText() returned %d matches, want 2: %+v", len(matches), matches)
+	}
+	if matches[0].TraceID != "fts-trace-b" || !strings.Contains(matches[0].Snippet, "[Connection refused]") {
+		t.Errorf("SearchText()[0] = %+v, want the exception match newest first", matches[0])
+	}
+
+	// Punctuation and FTS5 operators are plain text
+	if matches, err := store.SearchText(ctx, TextSearchOptions{Query: `ConnectException"`}); err != nil || len(matches) != 1 {
+		t.Errorf("SearchText(ConnectException) = %d matches, %v; want 1", len(matches), err)
+	}
+	if matches, err := store.SearchText(ctx, TextSearchOptions{Query: "refused", ServiceName: "other"}); err != nil || len(matches) != 0 {
+		t.Errorf("SearchText(service=other) = %d matches, %v; want 0", len(matches), err)
+	}
+
+	// Deleted spans leave the index
+	if _, err := store.db.Exec("DELETE FROM spans WHERE trace_id = 'fts-trace-a'"); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := store.SearchText(ctx, TextSearchOptions{Query: "connection refused"}); len(matches) != 1 {
+		t.Errorf("SearchText() after delete = %d matches, want 1", len(matches))
+	}
+}
+
+func TestCheckpointWAL(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 200; i++ {
+		spanJSON, _ := json.Marshal(map[string]interface{}{
+			"trace_id":     "wal-trace-" + strconv.Itoa(i),
+			"span_id":      "wal-span",
+			"service_name": "wal-svc",
+			"span_name":    strings.Repeat("x", 500),
+		})
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, err := store.WALSize()
+	if err != nil || size == 0 {
+		t.Fatalf("WALSize() = %d, %v; want a non-empty WAL", size, err)
+	}
+
+	if result, err := store.CheckpointWAL(ctx, size); err != nil || result != nil {
+		t.Fatalf("CheckpointWAL(below threshold) = %+v, %v; want nil", result, err)
+	}
+
+	result, err := store.CheckpointWAL(ctx, size/2)
+	if err != nil {
+		t.Fatalf("CheckpointWAL() error = %v", err)
+	}
+	if result == nil || result.WALBytesBefore != size || result.WALBytesAfter != 0 || result.Busy {
+		t.Fatalf("CheckpointWAL() = %+v, want the WAL truncated", result)
+	}
+	if result.LogFrames == 0 || result.CheckpointedFrames != result.LogFrames {
+		t.Errorf("CheckpointWAL() frames = %d/%d, want all copied", result.CheckpointedFrames, result.LogFrames)
+	}
+
+	stats, err := store.Stats(ctx)
+	if err != nil || stats.SpanCount != 200 || stats.WALBytes != 0 {
+		t.Errorf("Stats() = %+v, %v; want 200 spans and an empty WAL", stats, err)
+	}
+}
+
+func TestWriteBatching(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	store.SetWriteBatching(WriteBatchConfig{FlushInterval: 5 * time.Millisecond, MaxRows: 50})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			spans := make([]EncodedSpan, 5)
+			for j := range spans {
+				spans[j] = EncodedSpan{Header: json.RawMessage(`{"trace_id":"batch-` + strconv.Itoa(i) + `","span_id":"` + strconv.Itoa(j) + `"}`)}
+			}
+			metrics := []MetricRecord{{Name: "batch.metric", Value: 1, Timestamp: 1, Tags: "{}"}}
+			errs <- store.InsertEncodedData(ctx, spans, metrics)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("InsertEncodedData() error = %v", err)
+		}
+	}
+
+	stats, err := store.Stats(ctx)
+	if err != nil || stats.SpanCount != 100 || stats.MetricCount != 20 {
+		t.Fatalf("Stats() = %+v, %v; want every batched row committed before the writes returned", stats, err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := store.InsertEncodedData(ctx, []EncodedSpan{{Header: json.RawMessage(`{}`)}}, nil); err != ErrStoreClosed {
+		t.Errorf("InsertEncodedData() after Close error = %v, want ErrStoreClosed", err)
+	}
+}
+
+func TestSnapshotIncident(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	incidentsPath := filepath.Join(t.TempDir(), "incidents.db")
+	incidents, err := OpenIncidents(incidentsPath)
+	if err != nil {
+		t.Fatalf("OpenIncidents() error = %v", err)
+	}
+	defer incidents.Close()
+
+	// Three checkout traces, one failing, each with a downstream span in
+	// another service, and one trace outside the window
+	for i, tc := range []struct {
+		start    int64
+		duration int64
+		status   int
+	}{{100, 10, 0}, {200, 50, 0}, {300, 20, 2}, {5000, 10, 2}} {
+		traceID := "inc-trace-" + strconv.Itoa(i)
+		for j, svc := range []string{"checkout", "payments"} {
+			spanJSON, _ := json.Marshal(map[string]interface{}{
+				"trace_id":             traceID,
+				"span_id":              svc,
+				"service_name":         svc,
+				"span_name":            "op",
+				"start_time_unix_nano": tc.start + int64(j),
+				"end_time_unix_nano":   tc.start + int64(j) + tc.duration,
+				"status":               map[string]interface{}{"code": tc.status},
+			})
+			store.InsertSpan(ctx, spanJSON)
+		}
+	}
+
+	stats, err := store.ServiceWindowStats(ctx, 0, 1000)
+	if err != nil {
+		t.Fatalf("ServiceWindowStats() error = %v", err)
+	}
+	want := []ServiceWindowStats{
+		{ServiceName: "checkout", SpanCount: 3, ErrorCount: 1, P95DurationNs: 50},
+		{ServiceName: "payments", SpanCount: 3, ErrorCount: 1, P95DurationNs: 50},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Fatalf("ServiceWindowStats() = %+v, want %+v", stats, want)
+	}
+
+	inc := Incident{ServiceName: "checkout", Reason: "test", WindowStart: 0, WindowEnd: 1000}
+	got, err := store.SnapshotIncident(ctx, incidentsPath, inc, 2)
+	if err != nil {
+		t.Fatalf("SnapshotIncident() error = %v", err)
+	}
+	if got.ID == 0 || got.TraceCount != 2 || got.CopiedSpans != 4 {
+		t.Fatalf("SnapshotIncident() = %+v, want 2 full traces copied", got)
+	}
+	// The failing trace comes first, then the slowest
+	for _, traceID := range []string{"inc-trace-2", "inc-trace-1"} {
+		if spans, _ := incidents.QueryTraceByID(ctx, traceID); len(spans) != 2 {
+			t.Errorf("incidents trace %s has %d spans, want 2", traceID, len(spans))
+		}
+	}
+
+	// A second snapshot of the same window only adds the remaining trace
+	got, err = store.SnapshotIncident(ctx, incidentsPath, inc, 10)
+	if err != nil || got.TraceCount != 3 || got.CopiedSpans != 2 {
+		t.Fatalf("second SnapshotIncident() = %+v, %v; want 2 new spans", got, err)
+	}
+
+	// Incidents survive cleanup of the main store
+	if _, err := store.Cleanup(ctx, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	list, err := incidents.ListIncidents(ctx, 0)
+	if err != nil || len(list) != 2 || list[0].CopiedSpans != 2 || list[1].CopiedSpans != 4 {
+		t.Fatalf("ListIncidents() = %+v, %v", list, err)
+	}
+	if stats, _ := incidents.Stats(ctx); stats.SpanCount != 6 {
+		t.Errorf("incidents database holds %d spans, want 6", stats.SpanCount)
+	}
+}
+
+func TestQueryMetricsByService(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now().Unix()
+	for _, svc := range []string{"checkout", "payments", "checkout"} {
+		if err := store.InsertMetric(ctx, "otel.requests.count", 1, now, map[string]string{"service": svc}); err != nil {
+			t.Fatalf("InsertMetric() error = %v", err)
+		}
+	}
+
+	for _, resolution := range []time.Duration{0, ResolutionMinute} {
+		metrics, err := store.QueryMetrics(ctx, MetricQueryOptions{Service: "checkout", MinTime: now - 60, Resolution: resolution})
+		if err != nil {
+			t.Fatalf("QueryMetrics() error = %v", err)
+		}
+		want := 2
+		if resolution > 0 {
+			want = 1 // both points fall in one bucket
+		}
+		if len(metrics) != want {
+			t.Errorf("resolution %v: expected %d checkout points, got %d", resolution, want, len(metrics))
+		}
+	}
+
+	query, args := metricsQuery(store.metricSources(ctx), MetricQueryOptions{Service: "checkout", MinTime: now - 60})
+	rows, err := store.db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		t.Fatalf("EXPLAIN QUERY PLAN error = %v", err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var id, parent, notused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	if !strings.Contains(strings.Join(plan, "\n"), "idx_metrics_service_timestamp") {
+		t.Errorf("Expected the (service, timestamp) index in the plan, got %v", plan)
+	}
+}
+
+func TestListMetricSeries(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now().Unix()
+	points := []struct {
+		name string
+		tags map[string]string
+		ts   int64
+	}{
+		{"requests", map[string]string{"service": "checkout", "http.route": "/pay"}, now},
+		{"requests", map[string]string{"service": "checkout", "http.route": "/pay"}, now - 10},
+		{"requests", map[string]string{"service": "payments"}, now},
+		{"latency", map[string]string{"service": "checkout"}, now - 7200},
+		{"latency", nil, now},
+	}
+	for _, p := range points {
+		if err := store.InsertMetric(ctx, p.name, 1, p.ts, p.tags); err != nil {
+			t.Fatalf("InsertMetric() error = %v", err)
+		}
+	}
+
+	series, err := store.ListMetricSeries(ctx, MetricSeriesOptions{})
+	if err != nil {
+		t.Fatalf("ListMetricSeries() error = %v", err)
+	}
+	if len(series) != 4 {
+		t.Fatalf("Expected 4 distinct series, got %+v", series)
+	}
+
+	series, _ = store.ListMetricSeries(ctx, MetricSeriesOptions{
+		TagEquals: map[string]string{"service": "checkout", "http.route": "/pay"},
+	})
+	if len(series) != 1 || series[0].Name != "requests" {
+		t.Errorf("Expected the checkout /pay series, got %+v", series)
+	}
+
+	series, _ = store.ListMetricSeries(ctx, MetricSeriesOptions{Name: "latency", MinTime: now - 60})
+	if len(series) != 1 || series[0].Tags != "{}" {
+		t.Errorf("Expected only the recent untagged latency series, got %+v", series)
+	}
+
+	if _, err := store.RollupMetrics(ctx, time.Unix(now, 0), time.Hour, 24*time.Hour); err != nil {
+		t.Fatalf("RollupMetrics() error = %v", err)
+	}
+	series, _ = store.ListMetricSeries(ctx, MetricSeriesOptions{Name: "latency"})
+	if len(series) != 2 {
+		t.Errorf("Expected rolled-up series to be listed, got %+v", series)
+	}
+}
+
+func TestMetricExemplars(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now().Unix()
+	tags := `{"service":"checkout"}`
+	err := store.InsertData(ctx, nil, []MetricRecord{
+		{Name: "otel.checkout.pay.span_count", Value: 3, Timestamp: now, Tags: tags},
+		{Name: "otel.checkout.pay.duration_ms", Value: 40, Timestamp: now, Tags: tags, ExemplarTraceID: "abc123"},
+		{Name: "otel.checkout.pay.duration_ms", Value: 20, Timestamp: now - 3600, Tags: tags, ExemplarTraceID: "def456"},
+	})
+	if err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+
+	exemplars, err := store.QueryMetricExemplars(ctx, MetricQueryOptions{Name: "otel.checkout.%", NamePattern: true, MinTime: now - 60})
+	if err != nil {
+		t.Fatalf("QueryMetricExemplars() error = %v", err)
+	}
+	if len(exemplars) != 1 || exemplars[0].ExemplarTraceID != "abc123" || exemplars[0].Value != 40 {
+		t.Errorf("Expected the recent duration exemplar, got %+v", exemplars)
+	}
+
+	// Points without an exemplar read back empty, and replicas receive them
+	changes, err := store.ChangesSince(ctx, 0, 0, 0, 10)
+	if err != nil {
+		t.Fatalf("ChangesSince() error = %v", err)
+	}
+	if len(changes.Metrics) != 3 || changes.Metrics[0].ExemplarTraceID != "" || changes.Metrics[1].ExemplarTraceID != "abc123" {
+		t.Errorf("Expected exemplars in the change set, got %+v", changes.Metrics)
+	}
+	replica := newTestStore(t)
+	defer replica.Close()
+	if err := replica.ApplyChanges(ctx, changes); err != nil {
+		t.Fatalf("ApplyChanges() error = %v", err)
+	}
+	if exemplars, _ := replica.QueryMetricExemplars(ctx, MetricQueryOptions{}); len(exemplars) != 2 {
+		t.Errorf("Expected both exemplars on the replica, got %+v", exemplars)
+	}
+
+	// Databases created before the column gain it on open
+	if _, err := store.db.Exec("ALTER TABLE metrics DROP COLUMN exemplar_trace_id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.migrateMetricExemplar(); err != nil {
+		t.Fatalf("migrateMetricExemplar() error = %v", err)
+	}
+	if exemplars, err := store.QueryMetricExemplars(ctx, MetricQueryOptions{}); err != nil || len(exemplars) != 0 {
+		t.Errorf("Expected no exemplars after migrating, got %+v (%v)", exemplars, err)
+	}
+}
+
+func TestRollupMetrics(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Unix(1700000000, 0) // 22:13:20 UTC
+	hourAgo := now.Add(-3*time.Hour).Unix() / 3600 * 3600
+	tags := map[string]string{"service": "checkout"}
+	// Three points in one minute three hours back, two in the current minute
+	for i, v := range []float64{10, 20, 30} {
+		if err := store.InsertMetric(ctx, "otel.checkout.duration_ms", v, hourAgo+int64(i*10), tags); err != nil {
+			t.Fatalf("InsertMetric() error = %v", err)
+		}
+	}
+	for _, v := range []float64{100, 200} {
+		if err := store.InsertMetric(ctx, "otel.checkout.duration_ms", v, now.Unix(), tags); err != nil {
+			t.Fatalf("InsertMetric() error = %v", err)
+		}
+	}
+
+	result, err := store.RollupMetrics(ctx, now, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("RollupMetrics() error = %v", err)
+	}
+	if result.RawPoints != 3 || result.MinutePoints != 0 {
+		t.Errorf("Expected 3 raw points rolled up, got %+v", result)
+	}
+
+	raw, err := store.QueryMetrics(ctx, MetricQueryOptions{Name: "otel.checkout.duration_ms"})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(raw) != 2 {
+		t.Errorf("Expected 2 raw points left, got %d", len(raw))
+	}
+
+	minutes, err := store.QueryMetrics(ctx, MetricQueryOptions{Name: "otel.checkout.duration_ms", Resolution: ResolutionMinute})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(minutes) != 2 || minutes[0].Value != 20 || minutes[0].Timestamp != hourAgo || minutes[1].Value != 150 {
+		t.Errorf("Expected minute averages 20 and 150, got %+v", minutes)
+	}
+
+	// A day later the minute bucket moves into its hour
+	result, err = store.RollupMetrics(ctx, now.Add(48*time.Hour), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("RollupMetrics() error = %v", err)
+	}
+	if result.RawPoints != 2 || result.MinutePoints != 2 {
+		t.Errorf("Expected 2 raw and 2 minute points rolled up, got %+v", result)
+	}
+	hours, err := store.QueryMetrics(ctx, MetricQueryOptions{Name: "otel.checkout.%", NamePattern: true, Resolution: ResolutionHour})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(hours) != 2 || hours[0].Value != 20 || hours[1].Value != 150 {
+		t.Errorf("Expected hourly averages 20 and 150, got %+v", hours)
+	}
+}
+
+func TestEnforceSizeLimit(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	var mode int
+	if err := store.db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil || mode != 2 {
+		t.Fatalf("Expected incremental auto-vacuum (2), got %d, %v", mode, err)
+	}
+
+	filler := strings.Repeat("x", 2048)
+	for i := 0; i < 400; i++ {
+		span := map[string]interface{}{
+			"trace_id":             "size-" + strconv.Itoa(i),
+			"span_id":              "span1",
+			"service_name":         "size-service",
+			"span_name":            "op",
+			"start_time_unix_nano": time.Now().UnixNano(),
+			"end_time_unix_nano":   time.Now().UnixNano(),
+			"attributes":           map[string]interface{}{"filler": filler},
+		}
+		spanJSON, _ := json.Marshal(span)
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatalf("InsertSpan() error = %v", err)
+		}
+	}
+	// Metrics older than every span go first, and logs older still before them
+	if err := store.InsertMetric(ctx, "otel.size.count", 1, time.Now().Add(-time.Hour).Unix(), nil); err != nil {
+		t.Fatalf("InsertMetric() error = %v", err)
+	}
+	if err := store.InsertLogs(ctx, [][]byte{[]byte(`{"service_name":"size-service","body":"old"}`)}); err != nil {
+		t.Fatalf("InsertLogs() error = %v", err)
+	}
+	if _, err := store.db.Exec("UPDATE logs SET created_at = ?", time.Now().Add(-2*time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	// and a rollup bucket older than everything
+	_, err := store.db.Exec(`INSERT INTO metrics_1h (name, value, timestamp, tags, value_sum, value_count, value_min, value_max)
+		VALUES ('otel.size.count', 1, ?, '{}', 1, 1, 1, 1)`, time.Now().Add(-3*time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used, file, err := store.UsedBytes(ctx)
+	if err != nil {
+		t.Fatalf("UsedBytes() error = %v", err)
+	}
+	if result, err := store.EnforceSizeLimit(ctx, used, used/2); err != nil || result != nil {
+		t.Fatalf("Expected no deletions within the limit, got %+v, %v", result, err)
+	}
+
+	result, err := store.EnforceSizeLimit(ctx, used/2, used/4)
+	if err != nil {
+		t.Fatalf("EnforceSizeLimit() error = %v", err)
+	}
+	if result == nil || result.LogsDeleted != 1 || result.MetricsDeleted != 2 || result.SpansDeleted == 0 {
+		t.Fatalf("Expected the rollup, the log, the metric and some spans deleted, got %+v", result)
+	}
+	if result.UsedBytesAfter > used/4 {
+		t.Errorf("Expected at most %d bytes in use, got %d", used/4, result.UsedBytesAfter)
+	}
+	if result.FileBytesAfter >= file {
+		t.Errorf("Expected the file to shrink from %d bytes, got %d", file, result.FileBytesAfter)
+	}
+	stats, _ := store.Stats(ctx)
+	if stats.SpanCount == 0 || stats.SpanCount+result.SpansDeleted != 400 {
+		t.Errorf("Expected the newest spans kept, got %d after deleting %d", stats.SpanCount, result.SpansDeleted)
+	}
+}
+
+func TestIncrementalAutoVacuum(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	defer store.Close()
+	if ok, err := store.IncrementalAutoVacuum(ctx); err != nil || !ok {
+		t.Errorf("Expected a new database in incremental auto-vacuum mode, got %v, %v", ok, err)
+	}
+
+	// A file created without auto-vacuum switches over on its next VACUUM
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE legacy (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	old, err := New(path)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer old.Close()
+	if ok, err := old.IncrementalAutoVacuum(ctx); err != nil || ok {
+		t.Errorf("Expected an old database without incremental auto-vacuum, got %v, %v", ok, err)
+	}
+	if err := old.Vacuum(ctx); err != nil {
+		t.Fatalf("Vacuum() error = %v", err)
+	}
+	if ok, err := old.IncrementalAutoVacuum(ctx); err != nil || !ok {
+		t.Errorf("Expected VACUUM to switch to incremental auto-vacuum, got %v, %v", ok, err)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	ctx := context.Background()
+	if _, err := OpenReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("Expected a missing file to fail rather than be created")
+	}
+
+	// A file from before the trace summaries
+	path := filepath.Join(t.TempDir(), "old.db")
+	created, err := New(path)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	created.Close()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DROP TRIGGER trace_summaries_insert; DROP TRIGGER trace_summaries_delete; DROP TABLE trace_summaries"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	pending, err := store.PendingMigrations(ctx)
+	if err != nil {
+		t.Fatalf("PendingMigrations() error = %v", err)
+	}
+	if len(pending) != 1 || pending[0] != "trace_summaries" {
+		t.Errorf("Expected only trace_summaries pending, got %v", pending)
+	}
+	if problems, err := store.IntegrityCheck(ctx); err != nil || len(problems) > 0 {
+		t.Errorf("IntegrityCheck() = %v, %v", problems, err)
+	}
+	if _, err := store.db.ExecContext(ctx, "CREATE TABLE written (id INTEGER)"); err == nil {
+		t.Error("Expected writes through a read-only store to fail")
+	}
+	store.Close()
+
+	// Opening did not migrate the file; New does
+	migrated, err := New(path)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer migrated.Close()
+	if pending, err := migrated.PendingMigrations(ctx); err != nil || len(pending) > 0 {
+		t.Errorf("Expected no pending migrations after New, got %v, %v", pending, err)
+	}
+}
+
+func TestIsDiskFull(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Cap the file at its current size on one connection, as a full disk would
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA max_page_count = 1"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.ExecContext(ctx, "INSERT INTO metrics (name, value, timestamp, tags) VALUES (?, 1, 1, '{}')", strings.Repeat("x", 1<<16))
+	if err == nil {
+		t.Fatal("Expected the insert to fail")
+	}
+	if !IsDiskFull(fmt.Errorf("failed to insert data: %w", err)) {
+		t.Errorf("Expected %v to be reported as disk full", err)
+	}
+	if IsDiskFull(errors.New("no such table: metrics")) || IsDiskFull(nil) {
+		t.Error("Expected other errors not to be reported as disk full")
+	}
+}
+
+func TestStats(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Insert some data
+	span := map[string]interface{}{
+		"trace_id":             "stats-trace",
+		"span_id":              "span1",
+		"service_name":         "stats-service",
+		"span_name":            "stats-op",
+		"start_time_unix_nano": time.Now().UnixNano(),
+		"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+		"status":               map[string]interface{}{"code": 0},
+	}
+	spanJSON, _ := json.Marshal(span)
+	store.InsertSpan(ctx, spanJSON)
+	store.InsertMetric(ctx, "test_metric", 1, time.Now().Unix(), nil)
+
+	stats, err := store.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.SpanCount != 1 {
+		t.Errorf("Expected 1 span, got %d", stats.SpanCount)
+	}
+	if stats.MetricCount != 1 {
+		t.Errorf("Expected 1 metric, got %d", stats.MetricCount)
+	}
+	if stats.TraceCount != 1 {
+		t.Errorf("Expected 1 trace, got %d", stats.TraceCount)
+	}
+	if stats.ServiceCount != 1 {
+		t.Errorf("Expected 1 service, got %d", stats.ServiceCount)
+	}
+}
+
+func TestListServiceOperationsBetween(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	for _, sp := range []struct {
+		service, name string
+		start         time.Time
+	}{
+		{"retired", "old-op", now.Add(-21 * 24 * time.Hour)},
+		{"current", "get", now.Add(-time.Hour)},
+		{"current", "old-op", now.Add(-21 * 24 * time.Hour)},
+	} {
+		span := map[string]interface{}{
+			"trace_id":             "range-" + sp.service + sp.name,
+			"span_id":              "span1",
+			"service_name":         sp.service,
+			"span_name":            sp.name,
+			"start_time_unix_nano": sp.start.UnixNano(),
+			"end_time_unix_nano":   sp.start.Add(time.Millisecond).UnixNano(),
+		}
+		spanJSON, _ := json.Marshal(span)
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatalf("InsertSpan() error = %v", err)
+		}
+	}
+
+	ops, err := store.ListServiceOperationsBetween(ctx, now.Add(-24*time.Hour).UnixNano(), now.UnixNano())
+	if err != nil {
+		t.Fatalf("ListServiceOperationsBetween() error = %v", err)
+	}
+	if len(ops) != 1 || len(ops["current"]) != 1 || ops["current"][0] != "get" {
+		t.Errorf("Expected only current/get in the last day, got %v", ops)
+	}
+
+	ops, err = store.ListServiceOperationsBetween(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("ListServiceOperationsBetween() error = %v", err)
+	}
+	if len(ops) != 2 || len(ops["current"]) != 2 {
+		t.Errorf("Expected every service unbounded, got %v", ops)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Insert a span (will have current created_at)
+	span := map[string]interface{}{
+		"trace_id":             "cleanup-trace",
+		"span_id":              "span1",
+		"service_name":         "cleanup-service",
+		"span_name":            "cleanup-op",
+		"start_time_unix_nano": time.Now().UnixNano(),
+		"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+		"status":               map[string]interface{}{"code": 0},
+	}
+	spanJSON, _ := json.Marshal(span)
+	store.InsertSpan(ctx, spanJSON)
+
+	// Cleanup with -1 second retention (cutoff = now + 1 second, deletes everything)
+	deleted, err := store.Cleanup(ctx, -time.Second)
+	if err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted, got %d", deleted)
+	}
+
+	// Verify empty
+	stats, _ := store.Stats(ctx)
+	if stats.SpanCount != 0 {
+		t.Errorf("Expected 0 spans after cleanup, got %d", stats.SpanCount)
+	}
+}
+
+func TestCleanupTables(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	span := map[string]interface{}{
+		"trace_id":             "cleanup-trace",
+		"span_id":              "span1",
+		"service_name":         "cleanup-service",
+		"span_name":            "cleanup-op",
+		"start_time_unix_nano": time.Now().UnixNano(),
+		"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+		"status":               map[string]interface{}{"code": 0},
+	}
+	spanJSON, _ := json.Marshal(span)
+	if err := store.InsertSpan(ctx, spanJSON); err != nil {
+		t.Fatalf("InsertSpan() error = %v", err)
+	}
+	// Two days old: outside a one-day trace retention, inside a metric one
+	old := time.Now().Add(-48 * time.Hour).Unix()
+	if err := store.InsertMetric(ctx, "otel.cleanup.count", 1, old, nil); err != nil {
+		t.Fatalf("InsertMetric() error = %v", err)
+	}
+
+	deleted, err := store.CleanupTables(ctx, -time.Second, 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("CleanupTables() error = %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted, got %d", deleted)
+	}
+	stats, _ := store.Stats(ctx)
+	if stats.SpanCount != 0 || stats.MetricCount != 1 {
+		t.Errorf("Expected 0 spans and 1 metric, got %d and %d", stats.SpanCount, stats.MetricCount)
+	}
+
+	deleted, err = store.CleanupTables(ctx, -time.Second, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("CleanupTables() error = %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected the metric deleted, got %d", deleted)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	if err := store.Checkpoint(ctx); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+}
+
+func TestQuerySpansWithTimeRange(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	baseTime := time.Now().UnixNano()
+
+	// Insert spans at different times
+	for i := 0; i < 5; i++ {
+		span := map[string]interface{}{
+			"trace_id":             "time-trace-" + string(rune('a'+i)),
+			"span_id":              "span" + string(rune(i)),
+			"service_name":         "time-service",
+			"span_name":            "time-op",
+			"start_time_unix_nano": baseTime + int64(i*1000000000), // 1 second apart
+			"end_time_unix_nano":   baseTime + int64(i*1000000000) + 1000000,
+			"status":               map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	// Query with min time filter
+	spans, err := store.QuerySpans(ctx, SpanQueryOptions{
+		MinStartTime: baseTime + 2000000000, // After second span
+	})
+	if err != nil {
+		t.Fatalf("QuerySpans() error = %v", err)
+	}
+	if len(spans) != 3 {
+		t.Errorf("Expected 3 spans with min time filter, got %d", len(spans))
+	}
+
+	// Query with max time filter
+	spans, err = store.QuerySpans(ctx, SpanQueryOptions{
+		MaxStartTime: baseTime + 2000000000,
+	})
+	if err != nil {
+		t.Fatalf("QuerySpans() error = %v", err)
+	}
+	if len(spans) != 3 {
+		t.Errorf("Expected 3 spans with max time filter, got %d", len(spans))
+	}
+
+	// Query with limit
+	spans, err = store.QuerySpans(ctx, SpanQueryOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("QuerySpans() error = %v", err)
+	}
+	if len(spans) != 2 {
+		t.Errorf("Expected 2 spans with limit, got %d", len(spans))
+	}
+}
+
+func TestQueryMetricsWithTimeRange(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	baseTime := time.Now().Unix()
+
+	// Insert metrics at different times
+	for i := 0; i < 5; i++ {
+		store.InsertMetric(ctx, "time_metric", float64(i*10), baseTime+int64(i*60), nil)
+	}
+
+	// Query with time range (timestamps: base, base+60, base+120, base+180, base+240)
+	// MinTime 121 includes base+180 and base+240, MaxTime 239 excludes base+240
+	metrics, err := store.QueryMetrics(ctx, MetricQueryOptions{
+		Name:    "time_metric",
+		MinTime: baseTime + 121, // Just after base+120
+		MaxTime: baseTime + 239, // Just before base+240
+	})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(metrics) != 1 {
+		t.Errorf("Expected 1 metric in time range (base+180), got %d", len(metrics))
+	}
+
+	// Query with pattern matching
+	store.InsertMetric(ctx, "pattern.foo.bar", 1, baseTime, nil)
+	store.InsertMetric(ctx, "pattern.foo.baz", 2, baseTime, nil)
+	store.InsertMetric(ctx, "pattern.qux.bar", 3, baseTime, nil)
+
+	metrics, err = store.QueryMetrics(ctx, MetricQueryOptions{
+		Name:        "pattern.foo.%",
+		NamePattern: true,
+	})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Errorf("Expected 2 metrics matching pattern, got %d", len(metrics))
+	}
+}
+
+func TestQuerySpansBySpanName(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Insert spans with different operation names
+	ops := []string{"GET /users", "POST /orders", "GET /users"}
+	for i, op := range ops {
+		span := map[string]interface{}{
+			"trace_id":             "op-trace-" + string(rune('a'+i)),
+			"span_id":              "span" + string(rune(i)),
+			"service_name":         "op-service",
+			"span_name":            op,
+			"start_time_unix_nano": time.Now().UnixNano(),
+			"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	spans, err := store.QuerySpans(ctx, SpanQueryOptions{SpanName: "GET /users"})
+	if err != nil {
+		t.Fatalf("QuerySpans() error = %v", err)
+	}
+	if len(spans) != 2 {
+		t.Errorf("Expected 2 spans for GET /users, got %d", len(spans))
+	}
+}
+
+func TestEmptyQueries(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Query empty store
+	spans, err := store.QueryTraceByID(ctx, "nonexistent")
+	if err != nil {
+		t.Fatalf("QueryTraceByID() error = %v", err)
+	}
+	if len(spans) != 0 {
+		t.Errorf("Expected 0 spans, got %d", len(spans))
+	}
+
+	services, err := store.ListServices(ctx)
+	if err != nil {
+		t.Fatalf("ListServices() error = %v", err)
+	}
+	if len(services) != 0 {
+		t.Errorf("Expected 0 services, got %d", len(services))
+	}
+
+	ops, err := store.ListOperations(ctx, "nonexistent")
+	if err != nil {
+		t.Fatalf("ListOperations() error = %v", err)
+	}
+	if len(ops) != 0 {
+		t.Errorf("Expected 0 operations, got %d", len(ops))
+	}
+}
+
+func TestCleanupWithRetention(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Insert a span and metric
+	span := map[string]interface{}{
+		"trace_id":             "retention-trace",
+		"span_id":              "span1",
+		"service_name":         "retention-service",
+		"span_name":            "retention-op",
+		"start_time_unix_nano": time.Now().UnixNano(),
+		"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+		"status":               map[string]interface{}{"code": 0},
+	}
+	spanJSON, _ := json.Marshal(span)
+	store.InsertSpan(ctx, spanJSON)
+	store.InsertMetric(ctx, "retention_metric", 1, time.Now().Unix(), nil)
+
+	// Cleanup with 1 hour retention should keep everything
+	deleted, err := store.Cleanup(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	if deleted != 0 {
+		t.Errorf("Expected 0 deleted with hour retention, got %d", deleted)
+	}
+
+	stats, _ := store.Stats(ctx)
+	if stats.SpanCount != 1 {
+		t.Errorf("Expected 1 span after retention cleanup, got %d", stats.SpanCount)
+	}
+}
+
+func TestConcurrentInserts(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Note: SQLite with single writer handles this via mutex
+	for i := 0; i < 10; i++ {
+		span := map[string]interface{}{
+			"trace_id":             "concurrent-trace",
+			"span_id":              "span" + string(rune(i)),
+			"service_name":         "concurrent-service",
+			"span_name":            "concurrent-op",
+			"start_time_unix_nano": time.Now().UnixNano() + int64(i),
+			"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano() + int64(i),
+			"status":               map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	spans, err := store.QueryTraceByID(ctx, "concurrent-trace")
+	if err != nil {
+		t.Fatalf("QueryTraceByID() error = %v", err)
+	}
+	if len(spans) != 10 {
+		t.Errorf("Expected 10 spans, got %d", len(spans))
+	}
+}
+
+func TestQuerySpansByTime(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	baseTime := time.Now()
+
+	// Insert spans at different times
+	for i := 0; i < 5; i++ {
+		startTime := baseTime.Add(time.Duration(i) * time.Minute)
+		endTime := startTime.Add(time.Duration((i+1)*100) * time.Millisecond)
+		span := map[string]interface{}{
+			"trace_id":             "time-trace-" + string(rune('a'+i)),
+			"span_id":              "span" + string(rune(i)),
+			"service_name":         "time-service",
+			"span_name":            "time-op",
+			"start_time_unix_nano": startTime.UnixNano(),
+			"end_time_unix_nano":   endTime.UnixNano(),
+			"status":               map[string]interface{}{"code": i % 3}, // mix of status codes
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	// Test basic query
+	t.Run("all spans", func(t *testing.T) {
+		spans, err := store.QuerySpansByTime(ctx, SpanTimeQueryOptions{})
+		if err != nil {
+			t.Fatalf("QuerySpansByTime() error = %v", err)
+		}
+		if len(spans) != 5 {
+			t.Errorf("Expected 5 spans, got %d", len(spans))
+		}
+	})
+
+	// Test with service filter
+	t.Run("service filter", func(t *testing.T) {
+		spans, err := store.QuerySpansByTime(ctx, SpanTimeQueryOptions{
+			ServiceName: "time-service",
+		})
+		if err != nil {
+			t.Fatalf("QuerySpansByTime() error = %v", err)
+		}
+		if len(spans) != 5 {
+			t.Errorf("Expected 5 spans, got %d", len(spans))
+		}
+	})
+
+	// Test with span name filter
+	t.Run("span name filter", func(t *testing.T) {
+		spans, err := store.QuerySpansByTime(ctx, SpanTimeQueryOptions{
+			SpanName: "time-op",
+		})
+		if err != nil {
+			t.Fatalf("QuerySpansByTime() error = %v", err)
+		}
+		if len(spans) != 5 {
+			t.Errorf("Expected 5 spans, got %d", len(spans))
+		}
+	})
+
+	// Test with time range
+	t.Run("time range", func(t *testing.T) {
+		spans, err := store.QuerySpansByTime(ctx, SpanTimeQueryOptions{
+			MinStartTime: baseTime.Add(time.Minute).UnixNano(),
+			MaxStartTime: baseTime.Add(3 * time.Minute).UnixNano(),
+		})
+		if err != nil {
+			t.Fatalf("QuerySpansByTime() error = %v", err)
+		}
+		if len(spans) != 3 {
+			t.Errorf("Expected 3 spans in time range, got %d", len(spans))
+		}
+	})
+
+	// Test with status code filter
+	t.Run("status code filter", func(t *testing.T) {
+		statusCode := 0
+		spans, err := store.QuerySpansByTime(ctx, SpanTimeQueryOptions{
+			StatusCode: &statusCode,
+		})
+		if err != nil {
+			t.Fatalf("QuerySpansByTime() error = %v", err)
+		}
+		if len(spans) != 2 { // indices 0 and 3
+			t.Errorf("Expected 2 spans with status 0, got %d", len(spans))
+		}
+	})
+
+	// Test with duration filter
+	t.Run("duration filter", func(t *testing.T) {
+		minDuration := int64(200) // 200ms
+		spans, err := store.QuerySpansByTime(ctx, SpanTimeQueryOptions{
+			MinDuration: &minDuration,
+		})
+		if err != nil {
+			t.Fatalf("QuerySpansByTime() error = %v", err)
+		}
+		// Spans have durations: 100ms, 200ms, 300ms, 400ms, 500ms
+		if len(spans) < 3 {
+			t.Errorf("Expected at least 3 spans with min duration 200ms, got %d", len(spans))
+		}
+	})
+
+	// Test with limit and offset
+	t.Run("limit and offset", func(t *testing.T) {
+		spans, err := store.QuerySpansByTime(ctx, SpanTimeQueryOptions{
+			Limit:  2,
+			Offset: 1,
+		})
+		if err != nil {
+			t.Fatalf("QuerySpansByTime() error = %v", err)
+		}
+		if len(spans) != 2 {
+			t.Errorf("Expected 2 spans with limit/offset, got %d", len(spans))
+		}
+	})
+}
+
+func TestSearchTraces(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	baseTime := time.Now()
+
+	// Insert spans with different services and operations
+	services := []string{"svc-a", "svc-a", "svc-b", "svc-c", "svc-c"}
+	ops := []string{"op1", "op2", "op1", "op3", "op3"}
+
+	for i := 0; i < 5; i++ {
+		startTime := baseTime.Add(time.Duration(i) * time.Minute)
+		span := map[string]interface{}{
+			"trace_id":             "search-trace-" + string(rune('a'+i)),
+			"span_id":              "span" + string(rune(i)),
+			"parent_span_id":       "", // root span
+			"service_name":         services[i],
+			"span_name":            ops[i],
+			"start_time_unix_nano": startTime.UnixNano(),
+			"end_time_unix_nano":   startTime.Add(100 * time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	// Test basic search
+	t.Run("all traces", func(t *testing.T) {
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		if len(traces) != 5 {
+			t.Errorf("Expected 5 traces, got %d", len(traces))
+		}
+	})
+
+	// Test search by service
+	t.Run("by service", func(t *testing.T) {
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{
+			ServiceName: "svc-a",
+		})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		if len(traces) != 2 {
+			t.Errorf("Expected 2 traces for svc-a, got %d", len(traces))
+		}
+	})
+
+	// Test search by span name
+	t.Run("by span name", func(t *testing.T) {
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{
+			SpanName: "op3",
+		})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		if len(traces) != 2 {
+			t.Errorf("Expected 2 traces for op3, got %d", len(traces))
+		}
+	})
+
+	// Test search by time range
+	t.Run("by time range", func(t *testing.T) {
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{
+			MinStartTime: baseTime.Add(time.Minute).UnixNano(),
+			MaxStartTime: baseTime.Add(3 * time.Minute).UnixNano(),
+		})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		if len(traces) != 3 {
+			t.Errorf("Expected 3 traces in time range, got %d", len(traces))
+		}
+	})
+
+	// Test search with limit
+	t.Run("with limit", func(t *testing.T) {
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{
+			Limit: 2,
+		})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		if len(traces) != 2 {
+			t.Errorf("Expected 2 traces with limit, got %d", len(traces))
+		}
+	})
+
+	// Test trace summary fields
+	t.Run("summary fields", func(t *testing.T) {
+		traces, err := store.SearchTraces(ctx, TraceSearchOptions{
+			ServiceName: "svc-a",
+			SpanName:    "op1",
+			Limit:       1,
+		})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		if len(traces) == 0 {
+			t.Fatal("Expected at least 1 trace")
+		}
+		trace := traces[0]
+		if trace.TraceID == "" {
+			t.Error("Expected TraceID to be set")
+		}
+		if trace.RootServiceName != "svc-a" {
+			t.Errorf("Expected RootServiceName svc-a, got %s", trace.RootServiceName)
+		}
+		if trace.RootTraceName != "op1" {
+			t.Errorf("Expected RootTraceName op1, got %s", trace.RootTraceName)
+		}
+		if trace.SpanCount != 1 {
+			t.Errorf("Expected SpanCount 1, got %d", trace.SpanCount)
+		}
+		if trace.StatusCode != 0 {
+			t.Errorf("Expected StatusCode 0, got %d", trace.StatusCode)
+		}
+	})
+}
+
+func TestSearchTracesSubMillisecondDuration(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	start := time.Now().UnixNano()
+	span, _ := json.Marshal(map[string]interface{}{
+		"trace_id":             "cache-hit-trace",
+		"span_id":              "cachehit",
+		"service_name":         "cache",
+		"span_name":            "GET",
+		"start_time_unix_nano": start,
+		"end_time_unix_nano":   start + 250*int64(time.Microsecond),
+		"status":               map[string]interface{}{"code": 0},
+	})
+	if err := store.InsertSpan(ctx, span); err != nil {
+		t.Fatal(err)
+	}
+
+	traces, err := store.SearchTraces(ctx, TraceSearchOptions{})
+	if err != nil {
+		t.Fatalf("SearchTraces() error = %v", err)
+	}
+	if len(traces) != 1 || traces[0].DurationMs != 0 || traces[0].DurationNanos != 250000 {
+		t.Errorf("Expected a 0ms trace with 250000ns duration, got %+v", traces)
+	}
+}
+
+func TestTraceSummaries(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	span := func(spanID, parent, service, name string, start int64, status int) []byte {
+		b, _ := json.Marshal(map[string]interface{}{
+			"trace_id":             "summary-trace",
+			"span_id":              spanID,
+			"parent_span_id":       parent,
+			"service_name":         service,
+			"span_name":            name,
+			"start_time_unix_nano": start,
+			"end_time_unix_nano":   start + 1000,
+			"status":               map[string]interface{}{"code": status},
+		})
+		return b
+	}
+	// The child arrives first; the root, which starts earlier, replaces it
+	if err := store.InsertData(ctx, [][]byte{span("c1", "r1", "db", "query", 2000, 2)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertData(ctx, [][]byte{span("r1", "", "api", "GET /", 1500, 0), span("c2", "r1", "db", "query", 1000, 1)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	traces, err := store.SearchTraces(ctx, TraceSearchOptions{ServiceName: "db"})
+	if err != nil || len(traces) != 1 {
+		t.Fatalf("Expected one trace for db, got %+v, %v", traces, err)
+	}
+	want := TraceSummary{
+		TraceID: "summary-trace", RootServiceName: "api", RootTraceName: "GET /",
+		StartTimeUnixNano: 1000, DurationNanos: 2000, SpanCount: 3, ErrorCount: 1, StatusCode: 2,
+	}
+	if traces[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, traces[0])
+	}
+	for _, status := range []int{0, 1} {
+		if traces, _ := store.SearchTraces(ctx, TraceSearchOptions{Status: &status}); len(traces) != 0 {
+			t.Errorf("Expected no trace with status %d, got %+v", status, traces)
+		}
+	}
+	if traces, _ := store.SearchTraces(ctx, TraceSearchOptions{ServiceName: "d"}); len(traces) != 0 {
+		t.Errorf("Expected service names matched whole, got %+v", traces)
+	}
+
+	// Reopening rebuilds a dropped table from the spans
+	if _, err := store.db.Exec("DROP TABLE trace_summaries"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = New(store.dbPath)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer store.Close()
+	if traces, err = store.SearchTraces(ctx, TraceSearchOptions{}); err != nil || len(traces) != 1 || traces[0] != want {
+		t.Errorf("Expected backfilled summary %+v, got %+v, %v", want, traces, err)
+	}
+
+	// The summary goes with the trace's last span
+	if _, err := store.db.Exec("DELETE FROM spans"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _, _ := store.CountTraces(ctx, TraceSearchOptions{}, 0); count != 0 {
+		t.Errorf("Expected no summaries after deleting the spans, got %d", count)
+	}
+
+	// Compacted traces keep their summary and indexed attribute values
+	if err := store.SetIndexedAttributes(ctx, []string{"http.route"}); err != nil {
+		t.Fatal(err)
+	}
+	routed := []byte(`{"trace_id":"compacted","span_id":"r1","service_name":"api","span_name":"GET /users","start_time_unix_nano":5000,` +
+		`"end_time_unix_nano":6000,"status":{"code":0},"attributes":{"http.route":"/users"}}`)
+	if err := store.InsertData(ctx, [][]byte{routed}, nil); err != nil {
+		t.Fatal(err)
+	}
+	store.db.Exec("UPDATE spans SET created_at = ?", time.Now().Add(-time.Hour).Unix())
+	if result, err := store.CompactTraces(ctx, time.Now(), time.Minute, 100); err != nil || result.Traces != 1 {
+		t.Fatalf("Expected the trace compacted, got %+v, %v", result, err)
+	}
+	for _, opts := range []TraceSearchOptions{
+		{ServiceName: "api"},
+		{Attributes: map[string]string{"http.route": "/users"}},
+		{MinStartTime: 5500, MaxStartTime: 7000},
+	} {
+		if traces, err := store.SearchTraces(ctx, opts); err != nil || len(traces) != 1 || traces[0].TraceID != "compacted" {
+			t.Errorf("Expected compacted trace for %+v, got %+v, %v", opts, traces, err)
+		}
+	}
+	for _, opts := range []TraceSearchOptions{
+		{Attributes: map[string]string{"http.route": "/orders"}},
+		{MinStartTime: 7000},
+	} {
+		if traces, _ := store.SearchTraces(ctx, opts); len(traces) != 0 {
+			t.Errorf("Expected no trace for %+v, got %+v", opts, traces)
+		}
+	}
+
+	// and lose them with the blob
+	if _, err := store.db.Exec("DELETE FROM trace_blobs"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _, _ := store.CountTraces(ctx, TraceSearchOptions{}, 0); count != 0 {
+		t.Errorf("Expected no summaries after deleting the blob, got %d", count)
+	}
+	var attrs int
+	store.db.QueryRow("SELECT COUNT(*) FROM trace_summary_attributes").Scan(&attrs)
+	if attrs != 0 {
+		t.Errorf("Expected trace attributes removed with the summary, got %d", attrs)
+	}
+}
+
+func TestTenantScoping(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	for _, sp := range []struct{ trace, service, tenant string }{
+		{"trace-a", "checkout", "team-a"},
+		{"trace-b", "billing", "team-b"},
+		{"trace-default", "legacy", ""},
+	} {
+		doc := map[string]interface{}{
+			"trace_id":             sp.trace,
+			"span_id":              sp.trace + "-root",
+			"service_name":         sp.service,
+			"span_name":            "GET /",
+			"start_time_unix_nano": now.UnixNano(),
+			"end_time_unix_nano":   now.Add(time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": 0},
+		}
+		tags := map[string]string{"service": sp.service}
+		if sp.tenant != "" {
+			doc["tenant"] = sp.tenant
+			tags["tenant"] = sp.tenant
+		}
+		span, _ := json.Marshal(doc)
+		if err := store.InsertSpan(ctx, span); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.InsertMetric(ctx, "requests", 1, now.Unix(), tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a tenant, reads see every tenant's data
+	traces, _ := store.SearchTraces(ctx, TraceSearchOptions{})
+	if len(traces) != 3 {
+		t.Errorf("Expected 3 traces across tenants, got %d", len(traces))
+	}
+
+	teamA := WithTenant(ctx, "team-a")
+	traces, err := store.SearchTraces(teamA, TraceSearchOptions{})
+	if err != nil {
+		t.Fatalf("SearchTraces() error = %v", err)
+	}
+	if len(traces) != 1 || traces[0].TraceID != "trace-a" {
+		t.Errorf("Expected only team-a's trace, got %+v", traces)
+	}
+	if spans, _ := store.QueryTraceByID(teamA, "trace-b"); len(spans) != 0 {
+		t.Errorf("Expected team-b's trace to be hidden from team-a, got %d spans", len(spans))
+	}
+	if spans, _ := store.QuerySpans(teamA, SpanQueryOptions{}); len(spans) != 1 {
+		t.Errorf("Expected 1 team-a span, got %d", len(spans))
+	}
+	services, _ := store.ListServices(teamA)
+	if len(services) != 1 || services[0] != "checkout" {
+		t.Errorf("Expected team-a's services only, got %v", services)
+	}
+
+	// The default tenant is the data stored without one
+	services, _ = store.ListServices(WithTenant(ctx, ""))
+	if len(services) != 1 || services[0] != "legacy" {
+		t.Errorf("Expected the default tenant's services only, got %v", services)
+	}
+
+	metrics, err := store.QueryMetrics(teamA, MetricQueryOptions{Name: "requests"})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(metrics) != 1 || !strings.Contains(metrics[0].Tags, "team-a") {
+		t.Errorf("Expected team-a's metric only, got %+v", metrics)
+	}
+	metrics, _ = store.QueryMetrics(teamA, MetricQueryOptions{Name: "requests", Resolution: ResolutionMinute})
+	if len(metrics) != 1 {
+		t.Errorf("Expected team-a's metric only at minute resolution, got %+v", metrics)
+	}
+	series, _ := store.ListMetricSeries(WithTenant(ctx, "team-b"), MetricSeriesOptions{})
+	if len(series) != 1 || !strings.Contains(series[0].Tags, "team-b") {
+		t.Errorf("Expected team-b's series only, got %+v", series)
+	}
+
+	// Quotes in a tenant are data, not SQL
+	if traces, err := store.SearchTraces(WithTenant(ctx, "x' OR '1'='1"), TraceSearchOptions{}); err != nil || len(traces) != 0 {
+		t.Errorf("Expected no traces for a quoted tenant, got %d, %v", len(traces), err)
+	}
+}
+
+func TestInsertData(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Prepare spans
+	var spans [][]byte
+	for i := 0; i < 5; i++ {
+		span := map[string]interface{}{
+			"trace_id":             "data-trace",
+			"span_id":              "span" + string(rune(i)),
+			"service_name":         "data-service",
+			"span_name":            "data-op",
+			"start_time_unix_nano": time.Now().UnixNano(),
+			"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		spans = append(spans, spanJSON)
+	}
+
+	// Prepare metrics
+	var metrics []MetricRecord
+	for i := 0; i < 5; i++ {
+		metrics = append(metrics, MetricRecord{
+			Name:      "data_metric",
+			Value:     float64(i),
+			Timestamp: time.Now().Unix(),
+			Tags:      `{"service":"data"}`,
+		})
+	}
+
+	// Atomic insert
+	if err := store.InsertData(ctx, spans, metrics); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+
+	// Verify spans
+	resultSpans, err := store.QueryTraceByID(ctx, "data-trace")
+	if err != nil {
+		t.Fatalf("QueryTraceByID() error = %v", err)
+	}
+	if len(resultSpans) != 5 {
+		t.Errorf("Expected 5 spans, got %d", len(resultSpans))
+	}
+
+	// Verify metrics
+	resultMetrics, err := store.QueryMetrics(ctx, MetricQueryOptions{Name: "data_metric"})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(resultMetrics) != 5 {
+		t.Errorf("Expected 5 metrics, got %d", len(resultMetrics))
+	}
+}
+
+func TestChangesSinceAndApplyChanges(t *testing.T) {
+	primary := newTestStore(t)
+	defer primary.Close()
+	standby := newTestStore(t)
+	defer standby.Close()
+	ctx := context.Background()
+
+	var spans [][]byte
+	for i := 0; i < 3; i++ {
+		span := map[string]interface{}{
+			"trace_id":             "repl-trace",
+			"span_id":              "span" + string(rune('a'+i)),
+			"service_name":         "repl-service",
+			"span_name":            "repl-op",
+			"start_time_unix_nano": time.Now().UnixNano(),
+			"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+			"status":               map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		spans = append(spans, spanJSON)
+	}
+	metrics := []MetricRecord{{Name: "repl_metric", Value: 1, Timestamp: time.Now().Unix(), Tags: "{}"}}
+	if err := primary.InsertData(ctx, spans, metrics); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+	if _, err := primary.db.Exec("UPDATE spans SET child_duration_ns = 42 WHERE span_id = 'spana'"); err != nil {
+		t.Fatal(err)
+	}
+	logs := [][]byte{
+		[]byte(`{"timestamp_unix_nano":1,"service_name":"repl-service","trace_id":"repl-trace","body":"first"}`),
+		[]byte(`{"timestamp_unix_nano":2,"service_name":"repl-service","trace_id":"repl-trace","body":"second"}`),
+		[]byte(`{"timestamp_unix_nano":3,"service_name":"repl-service","trace_id":"repl-trace","body":"third"}`),
+	}
+	if err := primary.InsertLogs(ctx, logs); err != nil {
+		t.Fatalf("InsertLogs() error = %v", err)
+	}
+
+	// First batch is limited to two spans and two logs
+	changes, err := primary.ChangesSince(ctx, 0, 0, 0, 2)
+	if err != nil {
+		t.Fatalf("ChangesSince() error = %v", err)
+	}
+	if len(changes.Spans) != 2 || len(changes.Metrics) != 1 || len(changes.Logs) != 2 {
+		t.Fatalf("Expected 2 spans, 1 metric and 2 logs, got %d, %d and %d", len(changes.Spans), len(changes.Metrics), len(changes.Logs))
+	}
+	if err := standby.ApplyChanges(ctx, changes); err != nil {
+		t.Fatalf("ApplyChanges() error = %v", err)
+	}
+
+	spanCursor, metricCursor, logCursor, err := standby.ReplicationCursor(ctx)
+	if err != nil {
+		t.Fatalf("ReplicationCursor() error = %v", err)
+	}
+	if spanCursor != changes.LastSpanID() || metricCursor != changes.LastMetricID() || logCursor != changes.LastLogID() {
+		t.Errorf("Unexpected cursor (%d, %d, %d)", spanCursor, metricCursor, logCursor)
+	}
+
+	// Resume from the stored cursor
+	changes, err = primary.ChangesSince(ctx, spanCursor, metricCursor, logCursor, 2)
+	if err != nil {
+		t.Fatalf("ChangesSince() error = %v", err)
+	}
+	if len(changes.Spans) != 1 || len(changes.Metrics) != 0 || len(changes.Logs) != 1 {
+		t.Fatalf("Expected 1 span, 0 metrics and 1 log, got %d, %d and %d", len(changes.Spans), len(changes.Metrics), len(changes.Logs))
+	}
+	if err := standby.ApplyChanges(ctx, changes); err != nil {
+		t.Fatalf("ApplyChanges() error = %v", err)
+	}
+
+	result, err := standby.QueryTraceByID(ctx, "repl-trace")
+	if err != nil {
+		t.Fatalf("QueryTraceByID() error = %v", err)
+	}
+	if len(result) != 3 {
+		t.Errorf("Expected 3 replicated spans, got %d", len(result))
+	}
+	var childDuration int64
+	standby.db.QueryRow("SELECT child_duration_ns FROM spans WHERE span_id = 'spana'").Scan(&childDuration)
+	if childDuration != 42 {
+		t.Errorf("Expected child_duration_ns replicated, got %d", childDuration)
+	}
+	replicatedLogs, err := standby.QueryLogs(ctx, LogQueryOptions{TraceID: "repl-trace", Ascending: true})
+	if err != nil || len(replicatedLogs) != 3 || !strings.Contains(string(replicatedLogs[2].Data), "third") {
+		t.Errorf("Expected 3 replicated logs in order, got %+v, %v", replicatedLogs, err)
+	}
+}
+
+func TestDedupeSpans(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	span := map[string]interface{}{
+		"trace_id":             "dup-trace",
+		"span_id":              "dup-span",
+		"service_name":         "dup-service",
+		"span_name":            "dup-op",
+		"start_time_unix_nano": time.Now().UnixNano(),
+		"end_time_unix_nano":   time.Now().Add(time.Millisecond).UnixNano(),
+		"status":               map[string]interface{}{"code": 0},
+	}
+	spanJSON, _ := json.Marshal(span)
+	for i := 0; i < 3; i++ {
+		if err := store.InsertSpan(ctx, spanJSON); err != nil {
+			t.Fatalf("InsertSpan() error = %v", err)
+		}
+	}
+	span["span_id"] = "unique-span"
+	spanJSON, _ = json.Marshal(span)
+	store.InsertSpan(ctx, spanJSON)
+
+	// Dry run only reports
+	report, err := store.DedupeSpans(ctx, true)
+	if err != nil {
+		t.Fatalf("DedupeSpans(dryRun) error = %v", err)
+	}
+	if report.DuplicateSpans != 2 || report.RemovedSpans != 0 {
+		t.Errorf("Unexpected dry-run report: %+v", report)
+	}
+	if report.ReclaimableBytes <= 0 {
+		t.Errorf("Expected reclaimable bytes estimate, got %d", report.ReclaimableBytes)
+	}
+
+	report, err = store.DedupeSpans(ctx, false)
+	if err != nil {
+		t.Fatalf("DedupeSpans() error = %v", err)
+	}
+	if report.RemovedSpans != 2 {
+		t.Errorf("Expected 2 removed spans, got %d", report.RemovedSpans)
+	}
+
+	spans, _ := store.QueryTraceByID(ctx, "dup-trace")
+	if len(spans) != 2 {
+		t.Errorf("Expected 2 spans after dedupe, got %d", len(spans))
+	}
+
+	if err := store.Vacuum(ctx); err != nil {
+		t.Fatalf("Vacuum() error = %v", err)
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+
+	problems, err := store.IntegrityCheck(context.Background())
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected a fresh database to pass quick_check, got %v, %v", problems, err)
+	}
+}
+
+func TestSearchTracesOverBudget(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	insert := func(traceID, service, name string, duration time.Duration) {
+		span := map[string]interface{}{
+			"trace_id":             traceID,
+			"span_id":              traceID + "-span",
+			"service_name":         service,
+			"span_name":            name,
+			"start_time_unix_nano": now.UnixNano(),
+			"end_time_unix_nano":   now.Add(duration).UnixNano(),
+			"status":               map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+	insert("fast-checkout", "checkout", "POST /orders", 100*time.Millisecond)
+	insert("slow-checkout", "checkout", "POST /orders", 400*time.Millisecond)
+	insert("slow-health", "checkout", "GET /health", 400*time.Millisecond)
+	insert("slow-other", "other", "work", time.Second)
+
+	budgets := []LatencyBudget{
+		{ServiceName: "checkout", MaxDurationNs: int64(50 * time.Millisecond)},
+		{ServiceName: "checkout", SpanName: "POST /orders", MaxDurationNs: int64(250 * time.Millisecond)},
+	}
+	traces, err := store.SearchTraces(ctx, TraceSearchOptions{OverBudget: budgets})
+	if err != nil {
+		t.Fatalf("SearchTraces() error = %v", err)
+	}
+
+	got := map[string]bool{}
+	for _, tr := range traces {
+		got[tr.TraceID] = true
+	}
+	if len(got) != 2 || !got["slow-checkout"] || !got["slow-health"] {
+		t.Errorf("Expected slow-checkout and slow-health, got %v", got)
+	}
+}
+
+func TestIterators(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	baseTime := time.Now()
+	for i := 0; i < 3; i++ {
+		span := map[string]interface{}{
+			"trace_id":             "iter-trace",
+			"span_id":              "iter-span-" + string(rune('a'+i)),
+			"service_name":         "iter-service",
+			"span_name":            "iter-op",
+			"start_time_unix_nano": baseTime.Add(time.Duration(i) * time.Second).UnixNano(),
+			"end_time_unix_nano":   baseTime.Add(time.Duration(i+1) * time.Second).UnixNano(),
+		}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+		store.InsertMetric(ctx, "iter.metric", float64(i), baseTime.Unix()+int64(i), nil)
+	}
+
+	t.Run("spans", func(t *testing.T) {
+		count := 0
+		for span, err := range store.IterSpansByTime(ctx, SpanTimeQueryOptions{ServiceName: "iter-service"}) {
+			if err != nil {
+				t.Fatalf("IterSpansByTime() error = %v", err)
+			}
+			if len(span) == 0 {
+				t.Error("Expected span data")
+			}
+			count++
+		}
+		if count != 3 {
+			t.Errorf("Expected 3 spans, got %d", count)
+		}
+	})
+
+	t.Run("early break", func(t *testing.T) {
+		count := 0
+		for range store.IterSpansByTime(ctx, SpanTimeQueryOptions{}) {
+			count++
+			break
+		}
+		if count != 1 {
+			t.Errorf("Expected 1 iteration, got %d", count)
+		}
+		// The read lock must be released after breaking out of the loop.
+		if err := store.InsertMetric(ctx, "after.break", 1, baseTime.Unix(), nil); err != nil {
+			t.Fatalf("InsertMetric() after break error = %v", err)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		var values []float64
+		for m, err := range store.IterMetrics(ctx, MetricQueryOptions{Name: "iter.metric"}) {
+			if err != nil {
+				t.Fatalf("IterMetrics() error = %v", err)
+			}
+			values = append(values, m.Value)
+		}
+		if len(values) != 3 || values[0] != 0 || values[2] != 2 {
+			t.Errorf("Unexpected metric values %v", values)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		var gotErr error
+		for _, err := range store.IterSpansByTime(cancelled, SpanTimeQueryOptions{}) {
+			if err != nil {
+				gotErr = err
+				break
+			}
+		}
+		if gotErr == nil {
+			t.Error("Expected an error from a cancelled context")
+		}
+	})
+}
+
+func TestQueryTracesByIDs(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	for _, ids := range [][2]string{{"batch-a", "s1"}, {"batch-a", "s2"}, {"batch-b", "s3"}} {
+		span := map[string]interface{}{"trace_id": ids[0], "span_id": ids[1], "service_name": "svc"}
+		spanJSON, _ := json.Marshal(span)
+		store.InsertSpan(ctx, spanJSON)
+	}
+
+	traces, err := store.QueryTracesByIDs(ctx, []string{"batch-a", "batch-b", "batch-none"})
+	if err != nil {
+		t.Fatalf("QueryTracesByIDs() error = %v", err)
+	}
+	if len(traces["batch-a"]) != 2 || len(traces["batch-b"]) != 1 {
+		t.Errorf("Unexpected span counts: a=%d b=%d", len(traces["batch-a"]), len(traces["batch-b"]))
+	}
+	if _, ok := traces["batch-none"]; ok {
+		t.Error("Expected unknown trace to be absent")
+	}
+
+	empty, err := store.QueryTracesByIDs(ctx, nil)
+	if err != nil || len(empty) != 0 {
+		t.Errorf("Expected empty result for no IDs, got %v, %v", empty, err)
+	}
+}
+
+func TestNewWithAttached(t *testing.T) {
+	ctx := context.Background()
+
+	archive := newTestStore(t)
+	archivePath := archive.dbPath
+	for _, ids := range [][2]string{{"old-trace", "o1"}, {"old-trace", "o2"}} {
+		span := map[string]interface{}{
+			"trace_id": ids[0], "span_id": ids[1], "service_name": "svc", "span_name": "old-op",
+			"start_time_unix_nano": 1000, "end_time_unix_nano": 2000, "status": map[string]interface{}{"code": 0},
+		}
+		spanJSON, _ := json.Marshal(span)
+		archive.InsertSpan(ctx, spanJSON)
+	}
+	archive.InsertMetric(ctx, "otel.svc.calls", 1, 100, nil)
+	archive.Close()
+
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpFile.Name()) })
+	tmpFile.Close()
+
+	store, err := NewWithAttached(tmpFile.Name(), []AttachedDatabase{{Name: "yesterday", Path: archivePath}})
+	if err != nil {
+		t.Fatalf("NewWithAttached() error = %v", err)
+	}
+	defer store.Close()
+
+	span := map[string]interface{}{
+		"trace_id": "new-trace", "span_id": "n1", "service_name": "svc", "span_name": "new-op",
+		"start_time_unix_nano": 5000, "end_time_unix_nano": 6000, "status": map[string]interface{}{"code": 0},
+	}
+	spanJSON, _ := json.Marshal(span)
+	if err := store.InsertSpan(ctx, spanJSON); err != nil {
+		t.Fatalf("InsertSpan() error = %v", err)
+	}
+	store.InsertMetric(ctx, "otel.svc.calls", 2, 200, nil)
+
+	summaries, err := store.SearchTraces(ctx, TraceSearchOptions{ServiceName: "svc", Limit: 10})
+	if err != nil {
+		t.Fatalf("SearchTraces() error = %v", err)
+	}
+	if len(summaries) != 2 || summaries[0].TraceID != "new-trace" || summaries[1].TraceID != "old-trace" {
+		t.Fatalf("Expected traces from both databases, got %+v", summaries)
+	}
+	if summaries[1].SpanCount != 2 {
+		t.Errorf("Expected 2 spans in attached trace, got %d", summaries[1].SpanCount)
+	}
+	if long, err := store.SearchTraces(ctx, TraceSearchOptions{MinDurationNs: 1001}); err != nil || len(long) != 0 {
+		t.Errorf("Expected no trace over 1001ns across databases, got %+v (%v)", long, err)
+	}
+	if short, err := store.SearchTraces(ctx, TraceSearchOptions{MaxDurationNs: 1000}); err != nil || len(short) != 2 {
+		t.Errorf("Expected both 1000ns traces across databases, got %+v (%v)", short, err)
+	}
+
+	spans, err := store.QueryTraceByID(ctx, "old-trace")
+	if err != nil || len(spans) != 2 {
+		t.Errorf("Expected attached trace to be readable, got %d spans, %v", len(spans), err)
+	}
+	traces, err := store.QueryTracesByIDs(ctx, []string{"old-trace", "new-trace"})
+	if err != nil || len(traces) != 2 {
+		t.Errorf("Expected both traces from batch lookup, got %d, %v", len(traces), err)
+	}
+
+	metrics, err := store.QueryMetrics(ctx, MetricQueryOptions{Name: "otel.svc.calls"})
+	if err != nil {
+		t.Fatalf("QueryMetrics() error = %v", err)
+	}
+	if len(metrics) != 2 || metrics[0].Timestamp != 100 || metrics[1].Timestamp != 200 {
+		t.Errorf("Expected metrics from both databases in time order, got %+v", metrics)
+	}
+
+	// Writes only go to the main database, and the attached one is read-only.
+	stats, err := store.Stats(ctx)
+	if err != nil || stats.SpanCount != 1 {
+		t.Errorf("Expected 1 span in main database, got %d, %v", stats.SpanCount, err)
+	}
+	if _, err := store.db.ExecContext(ctx, `DELETE FROM "yesterday".spans`); err == nil {
+		t.Error("Expected attached database to be read-only")
+	}
+}
+
+func TestNewWithAttachedInvalid(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpFile.Name()) })
+	tmpFile.Close()
+
+	for name, attached := range map[string][]AttachedDatabase{
+		"bad name":  {{Name: "bad-name", Path: tmpFile.Name()}},
+		"reserved":  {{Name: "main", Path: tmpFile.Name()}},
+		"duplicate": {{Name: "a", Path: tmpFile.Name()}, {Name: "A", Path: tmpFile.Name()}},
+		"no path":   {{Name: "a"}},
+		"missing":   {{Name: "a", Path: filepath.Join(t.TempDir(), "missing.db")}},
+	} {
+		store, err := NewWithAttached(tmpFile.Name(), attached)
+		if err == nil {
+			store.Close()
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestEncodedSpans(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	header := json.RawMessage(`{"trace_id":"enc-trace","span_id":"e1","service_name":"svc","span_name":"op","start_time_unix_nano":1000,"end_time_unix_nano":2000,"status":{"code":0}}`)
+	spanJSON := []byte(`{"trace_id":"enc-trace","span_id":"j1","service_name":"svc","span_name":"op","start_time_unix_nano":500,"end_time_unix_nano":900,"status":{"code":0}}`)
+	if err := store.InsertData(ctx, [][]byte{spanJSON}, nil); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+	if err := store.InsertEncodedData(ctx, []EncodedSpan{{Header: header, Payload: []byte("payload-e1")}}, nil); err != nil {
+		t.Fatalf("InsertEncodedData() error = %v", err)
+	}
+
+	// Indexed columns come from the header.
+	summaries, err := store.SearchTraces(ctx, TraceSearchOptions{ServiceName: "svc"})
+	if err != nil || len(summaries) != 1 || summaries[0].SpanCount != 2 {
+		t.Fatalf("Expected one trace with 2 spans, got %+v, %v", summaries, err)
+	}
+
+	// Without a decoder the header is returned.
+	spans, err := store.QueryTraceByID(ctx, "enc-trace")
+	if err != nil || len(spans) != 2 || string(spans[1]) != string(header) {
+		t.Fatalf("Expected header for undecoded span, got %s, %v", spans, err)
+	}
+
+	store.SetSpanDecoder(func(h json.RawMessage, payload []byte) (json.RawMessage, error) {
+		return json.RawMessage(`{"decoded":"` + string(payload) + `"}`), nil
+	})
+	spans, err = store.QueryTraceByID(ctx, "enc-trace")
+	if err != nil || string(spans[0]) != string(spanJSON) || string(spans[1]) != `{"decoded":"payload-e1"}` {
+		t.Errorf("Expected JSON span as stored and encoded span decoded, got %s, %v", spans, err)
+	}
+	byTime, err := store.QuerySpansByTime(ctx, SpanTimeQueryOptions{ServiceName: "svc"})
+	if err != nil || len(byTime) != 2 {
+		t.Errorf("Expected 2 spans by time, got %d, %v", len(byTime), err)
+	}
+
+	encoded, err := store.QueryEncodedTrace(ctx, "enc-trace")
+	if err != nil || len(encoded) != 2 {
+		t.Fatalf("QueryEncodedTrace() = %d spans, %v", len(encoded), err)
+	}
+	if encoded[0].Payload != nil || string(encoded[1].Payload) != "payload-e1" {
+		t.Errorf("Unexpected raw payloads: %q, %q", encoded[0].Payload, encoded[1].Payload)
+	}
+
+	// Convert the JSON row to the encoded format, skipping nothing.
+	res, err := store.ConvertSpans(ctx, true, 0, 100, func(span EncodedSpan) (EncodedSpan, error) {
+		return EncodedSpan{Header: span.Header, Payload: []byte("converted")}, nil
+	})
+	if err != nil || res.Converted != 1 || res.Skipped != 0 {
+		t.Fatalf("ConvertSpans(toEncoded) = %+v, %v", res, err)
+	}
+	if res, err = store.ConvertSpans(ctx, true, res.LastID, 100, nil); err != nil || res.Converted != 0 {
+		t.Errorf("Expected no JSON rows left, got %+v, %v", res, err)
+	}
+
+	// Convert back, failing on one row so it is skipped and left encoded.
+	res, err = store.ConvertSpans(ctx, false, 0, 100, func(span EncodedSpan) (EncodedSpan, error) {
+		if string(span.Payload) == "payload-e1" {
+			return EncodedSpan{}, errors.New("corrupt")
+		}
+		return EncodedSpan{Header: span.Header}, nil
+	})
+	if err != nil || res.Converted != 1 || res.Skipped != 1 {
+		t.Fatalf("ConvertSpans(toJSON) = %+v, %v", res, err)
+	}
+	encoded, _ = store.QueryEncodedTrace(ctx, "enc-trace")
+	if encoded[0].Payload != nil || encoded[1].Payload == nil {
+		t.Errorf("Expected converted row plain and skipped row encoded, got %q, %q", encoded[0].Payload, encoded[1].Payload)
+	}
+
+	// Payloads are shipped by replication.
+	changes, err := store.ChangesSince(ctx, 0, 0, 0, 10)
+	if err != nil || len(changes.Spans) != 2 || string(changes.Spans[1].Payload) != "payload-e1" {
+		t.Fatalf("Expected payload in change set, got %+v, %v", changes.Spans, err)
+	}
+	standby := newTestStore(t)
+	defer standby.Close()
+	if err := standby.ApplyChanges(ctx, changes); err != nil {
+		t.Fatalf("ApplyChanges() error = %v", err)
+	}
+	if replicated, _ := standby.QueryEncodedTrace(ctx, "enc-trace"); len(replicated) != 2 || string(replicated[1].Payload) != "payload-e1" {
+		t.Errorf("Expected payload on standby, got %+v", replicated)
+	}
+}
+
+func TestEncodedSpanFilters(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	// The header has only the indexed columns; kind and the attributes are
+	// in the payload
+	header := json.RawMessage(`{"trace_id":"enc-trace","span_id":"e1","service_name":"svc","span_name":"op","start_time_unix_nano":1000,"end_time_unix_nano":2000,"status":{"code":0}}`)
+	if err := store.InsertEncodedData(ctx, []EncodedSpan{{Header: header, Payload: []byte("payload-e1")}}, nil); err != nil {
+		t.Fatalf("InsertEncodedData() error = %v", err)
+	}
+	store.SetSpanDecoder(func(h json.RawMessage, payload []byte) (json.RawMessage, error) {
+		return json.RawMessage(`{"kind":"Server","attributes":{"http.method":"GET","cache.hit":true},"resource":{"host.name":"node-1"}}`), nil
+	})
+
+	match := func(field SpanField, value interface{}) int {
+		t.Helper()
+		summaries, err := store.SearchTraces(ctx, TraceSearchOptions{Filter: &TraceFilter{Spanset: &SpanCondition{Field: field, Compare: CompareEq, Value: value}}})
+		if err != nil {
+			t.Fatalf("SearchTraces() error = %v", err)
+		}
+		return len(summaries)
+	}
+	if n := match(SpanField{Scope: ScopeSpan, Name: "http.method"}, "GET"); n != 1 {
+		t.Errorf("Expected a span attribute filter to decode the payload, got %d traces", n)
+	}
+	if n := match(SpanField{Scope: ScopeResource, Name: "host.name"}, "node-1"); n != 1 {
+		t.Errorf("Expected a resource attribute filter to decode the payload, got %d traces", n)
+	}
+	if n := match(SpanField{Scope: ScopeIntrinsic, Name: "kind"}, "server"); n != 1 {
+		t.Errorf("Expected a kind filter to decode the payload, got %d traces", n)
+	}
+	if n := match(SpanField{Scope: ScopeSpan, Name: "http.method"}, "POST"); n != 0 {
+		t.Errorf("Expected no trace for another value, got %d", n)
+	}
+
+	summaries, err := store.SearchTraces(ctx, TraceSearchOptions{Attributes: map[string]string{"cache.hit": "true"}})
+	if err != nil || len(summaries) != 1 {
+		t.Errorf("Expected the tag search to decode the payload, got %+v, %v", summaries, err)
+	}
+	values, err := store.AttributeValues(ctx, AttributeValuesOptions{Field: SpanField{Scope: ScopeSpan, Name: "http.method"}})
+	if err != nil || !reflect.DeepEqual(values, []string{"GET"}) {
+		t.Errorf("Expected the attribute values of the payload, got %v, %v", values, err)
+	}
+
+	// Keys added to the attribute index are backfilled from the payload
+	if err := store.SetIndexedAttributes(ctx, []string{"http.method"}); err != nil {
+		t.Fatalf("SetIndexedAttributes() error = %v", err)
+	}
+	if n := match(SpanField{Scope: ScopeSpan, Name: "http.method"}, "GET"); n != 1 {
+		t.Errorf("Expected the backfilled index to find the span, got %d traces", n)
+	}
+}
+
+func TestUpgradeSpans(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	old := []byte(`{"trace_id":"up-trace","span_id":"a","service_name":"svc","span_name":"op","start_time_unix_nano":1000,"end_time_unix_nano":2000,"status":{"code":0}}`)
+	current := []byte(`{"trace_id":"up-trace","span_id":"b","service_name":"svc","span_name":"op","start_time_unix_nano":1500,"end_time_unix_nano":2000,"status":{"code":0},"kind":"Server","v":1}`)
+	if err := store.InsertData(ctx, [][]byte{old, current}, nil); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+
+	if _, err := store.UpgradeSpans(ctx, 1, 100); err == nil {
+		t.Error("Expected UpgradeSpans to fail without an upgrader")
+	}
+	var calls int
+	store.SetSpanUpgrader(func(doc json.RawMessage) (json.RawMessage, bool, error) {
+		calls++
+		if strings.Contains(string(doc), `"v":1`) {
+			return doc, false, nil
+		}
+		return json.RawMessage(strings.TrimSuffix(string(doc), "}") + `,"kind":"Unspecified","v":1}`), true, nil
+	})
+
+	// Old documents are upgraded as they are read.
+	spans, err := store.QueryTraceByID(ctx, "up-trace")
+	if err != nil || len(spans) != 2 || !strings.Contains(string(spans[0]), `"v":1`) || string(spans[1]) != string(current) {
+		t.Fatalf("Expected both spans current, got %s, %v", spans, err)
+	}
+	var n int
+	store.db.QueryRow("SELECT COUNT(*) FROM spans WHERE json_extract(data, '$.kind') IS NULL").Scan(&n)
+	if n != 1 {
+		t.Fatalf("Expected the stored row untouched by reads, got %d rows without kind", n)
+	}
+
+	// The rewriter only hands the old row to the upgrader, and resumes from
+	// its cursor.
+	calls = 0
+	res, err := store.UpgradeSpans(ctx, 1, 100)
+	if err != nil || res.Converted != 1 || calls != 1 {
+		t.Fatalf("UpgradeSpans() = %+v, %v with %d upgrader calls", res, err, calls)
+	}
+	store.db.QueryRow("SELECT COUNT(*) FROM spans WHERE json_extract(data, '$.kind') IS NULL").Scan(&n)
+	if n != 0 {
+		t.Errorf("Expected the old row rewritten, got %d rows without kind", n)
+	}
+	if next, err := store.UpgradeSpans(ctx, 1, 100); err != nil || next.Converted != 0 || next.LastID != res.LastID {
+		t.Errorf("Expected the rewrite complete, got %+v, %v", next, err)
+	}
+
+	// A newer version starts over from the first row.
+	if res, err := store.UpgradeSpans(ctx, 2, 100); err != nil || res.Converted != 0 || calls != 3 {
+		t.Errorf("UpgradeSpans(v2) = %+v, %v with %d upgrader calls", res, err, calls)
+	}
+}
+
+func TestCompactTraces(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	span := func(traceID, spanID string, start int64) []byte {
+		return []byte(`{"trace_id":"` + traceID + `","span_id":"` + spanID + `","service_name":"svc","span_name":"op","start_time_unix_nano":` +
+			strconv.FormatInt(start, 10) + `,"end_time_unix_nano":` + strconv.FormatInt(start+100, 10) + `,"status":{"code":0}}`)
+	}
+	if err := store.InsertData(ctx, [][]byte{span("old", "b", 2000), span("old", "a", 1000), span("busy", "c", 3000)}, nil); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+	if err := store.InsertEncodedData(ctx, []EncodedSpan{{Header: span("old", "e", 1500), Payload: []byte("enc")}}, nil); err != nil {
+		t.Fatalf("InsertEncodedData() error = %v", err)
+	}
+	// Age every span but the second one of "busy", which keeps it incomplete
+	hourAgo := now.Add(-time.Hour).Unix()
+	if _, err := store.db.Exec("UPDATE spans SET created_at = ?", hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertData(ctx, [][]byte{span("busy", "d", 3100)}, nil); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+
+	result, err := store.CompactTraces(ctx, now, 10*time.Minute, 100)
+	if err != nil {
+		t.Fatalf("CompactTraces() error = %v", err)
+	}
+	if result.Traces != 1 || result.Spans != 3 {
+		t.Errorf("Expected 1 trace of 3 spans compacted, got %+v", result)
+	}
+
+	var rows int
+	store.db.QueryRow("SELECT COUNT(*) FROM spans WHERE trace_id = 'old'").Scan(&rows)
+	if rows != 0 {
+		t.Errorf("Expected compacted span rows deleted, %d left", rows)
+	}
+	spans, err := store.QueryTraceByID(ctx, "old")
+	if err != nil || len(spans) != 3 || !strings.Contains(string(spans[0]), `"span_id":"a"`) || !strings.Contains(string(spans[2]), `"span_id":"b"`) {
+		t.Fatalf("Expected compacted trace in start order, got %s, %v", spans, err)
+	}
+	encoded, err := store.QueryEncodedTrace(ctx, "old")
+	if err != nil || len(encoded) != 3 || string(encoded[1].Payload) != "enc" {
+		t.Errorf("Expected payload kept in blob, got %+v, %v", encoded, err)
+	}
+	if busy, _ := store.QueryTraceByID(ctx, "busy"); len(busy) != 2 {
+		t.Errorf("Expected incomplete trace left as rows, got %d spans", len(busy))
+	}
+
+	// A late span is merged into the existing blob on the next run
+	if err := store.InsertData(ctx, [][]byte{span("old", "z", 500)}, nil); err != nil {
+		t.Fatalf("InsertData() error = %v", err)
+	}
+	byIDs, err := store.QueryTracesByIDs(ctx, []string{"old"})
+	if err != nil || len(byIDs["old"]) != 4 || !strings.Contains(string(byIDs["old"][0]), `"span_id":"z"`) {
+		t.Fatalf("Expected late row merged with blob on read, got %s, %v", byIDs["old"], err)
+	}
+	store.db.Exec("UPDATE spans SET created_at = ? WHERE trace_id = 'old'", hourAgo)
+	if result, err = store.CompactTraces(ctx, now, 10*time.Minute, 100); err != nil || result.Traces != 1 || result.Spans != 1 {
+		t.Fatalf("Expected late span compacted, got %+v, %v", result, err)
+	}
+	stats, _ := store.Stats(ctx)
+	if stats.CompactedTraceCount != 1 || stats.CompactedSpanCount != 4 || stats.SpanCount != 2 {
+		t.Errorf("Unexpected stats after compaction: %+v", stats)
+	}
+
+	// Tenant scoping applies to blobs
+	if spans, _ := store.QueryTraceByID(WithTenant(ctx, "other"), "old"); len(spans) != 0 {
+		t.Errorf("Expected no spans for another tenant, got %d", len(spans))
+	}
+
+	// Retention removes blobs by their newest span
+	store.db.Exec("UPDATE trace_blobs SET created_at = ?", now.Add(-48*time.Hour).Unix())
+	if _, err := store.Cleanup(ctx, 24*time.Hour); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	if spans, _ := store.QueryTraceByID(ctx, "old"); len(spans) != 0 {
+		t.Errorf("Expected compacted trace removed by retention, got %d spans", len(spans))
+	}
+}
+
+func TestSpanPayloadMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	initial, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial.Close()
+
+	// Recreate a database from before the payload column existed.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := `
+		ALTER TABLE spans DROP COLUMN payload;
+		INSERT INTO spans (data) VALUES ('{"trace_id":"legacy","span_id":"l1"}');
+	`
+	if _, err := db.Exec(legacy); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Attached read-only, the legacy file is not migrated but still readable.
+	withLegacy, err := NewWithAttached(filepath.Join(t.TempDir(), "main.db"), []AttachedDatabase{{Name: "legacy", Path: path}})
+	if err != nil {
+		t.Fatalf("NewWithAttached() with legacy database error = %v", err)
+	}
+	if spans, err := withLegacy.QueryTraceByID(context.Background(), "legacy"); err != nil || len(spans) != 1 {
+		t.Errorf("Expected legacy span through attached database, got %d, %v", len(spans), err)
+	}
+	withLegacy.Close()
+
+	store, err := New(path)
+	if err != nil {
+		t.Fatalf("New() on legacy database error = %v", err)
+	}
+	defer store.Close()
+
+	has, err := hasSpanPayload(store.db, "main")
+	if err != nil || !has {
+		t.Fatalf("Expected payload column after migration, got %v, %v", has, err)
+	}
+	encoded, err := store.QueryEncodedTrace(context.Background(), "legacy")
+	if err != nil || len(encoded) != 1 || encoded[0].Payload != nil {
+		t.Errorf("Expected legacy row readable as JSON, got %+v, %v", encoded, err)
+	}
+}
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	tmpFile, err := os.CreateTemp("", "gotel-test-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(tmpFile.Name()) })
+	tmpFile.Close()
+
+	store, err := New(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return store
+}
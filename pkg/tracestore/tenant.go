@@ -0,0 +1,106 @@
+package tracestore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Spans record their tenant in the document's tenant field and metric points
+// in their tenant tag. Rows without one belong to the default tenant, "".
+const (
+	spanTenantExpr   = `COALESCE(json_extract(data, '$.tenant'), '')`
+	metricTenantExpr = `COALESCE(json_extract(tags, '$.tenant'), '')`
+)
+
+// tenantColumns maps each tenant-scoped table to the expression its tenant
+// column is generated from
+var tenantColumns = map[string]string{
+	"spans":      spanTenantExpr,
+	"metrics":    metricTenantExpr,
+	"metrics_1m": metricTenantExpr,
+	"metrics_1h": metricTenantExpr,
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a context that scopes reads to tenant. Tenant-aware
+// read methods (see scoped) only return spans and metrics stored for that
+// tenant; without it they return every tenant's data.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set by WithTenant
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// scoped returns src, the FROM target for reading table, restricted to the
+// tenant in ctx. A bare table is filtered on its indexed tenant column; a
+// union over attached databases is filtered on the document, since older
+// files have no tenant column.
+//
+// SearchTraces, CountTraces, QueryTraceByID, QueryTracesByIDs,
+// QueryEncodedTrace, QuerySpans, CountSpans, QuerySpansByTime,
+// IterSpansByTime, QueryMetrics, IterMetrics, ListMetricSeries, SearchText and
+// the service and operation listings are tenant-aware; the other read methods
+// return every tenant's data.
+func (s *Store) scoped(ctx context.Context, table, src string) string {
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return src
+	}
+	col := "tenant"
+	if src != table {
+		col = tenantColumns[table]
+	}
+	return "(SELECT * FROM " + src + " WHERE " + col + " = " + sqlString(tenant) + ")"
+}
+
+// metricSources are the FROM targets metric queries read raw points and both
+// rollup tables from
+type metricSources struct {
+	raw, minute, hour string
+}
+
+// metricSources returns the metric tables as scoped for ctx. Only raw points
+// are read from attached databases.
+func (s *Store) metricSources(ctx context.Context) metricSources {
+	return metricSources{
+		raw:    s.scoped(ctx, "metrics", s.source("metrics", metricSourceColumns)),
+		minute: s.scoped(ctx, "metrics_1m", "metrics_1m"),
+		hour:   s.scoped(ctx, "metrics_1h", "metrics_1h"),
+	}
+}
+
+// sqlString quotes v as an SQL string literal. Tenants are inlined rather
+// than bound because scoped sources are spliced into queries at varying
+// positions relative to their other parameters.
+func sqlString(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
+
+// migrateTenant adds the tenant columns to databases created before they
+// existed, and indexes them
+func (s *Store) migrateTenant() error {
+	for _, table := range []string{"spans", "metrics", "metrics_1m", "metrics_1h"} {
+		var n int
+		err := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_xinfo(?) WHERE name = 'tenant'", table).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			stmt := "ALTER TABLE " + table + " ADD COLUMN tenant TEXT GENERATED ALWAYS AS (" + tenantColumns[table] + ") VIRTUAL"
+			if _, err := s.db.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to add %s.tenant column: %w", table, err)
+			}
+		}
+	}
+	_, err := s.db.Exec(`
+	CREATE INDEX IF NOT EXISTS idx_spans_tenant_start_time ON spans(tenant, start_time_unix_nano);
+	CREATE INDEX IF NOT EXISTS idx_metrics_tenant_timestamp ON metrics(tenant, timestamp);
+	`)
+	return err
+}
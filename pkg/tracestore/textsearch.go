@@ -0,0 +1,171 @@
+package tracestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTextSearchUnavailable is returned by SearchText when the SQLite library
+// was built without FTS5 (go-sqlite3 needs the sqlite_fts5 build tag).
+var ErrTextSearchUnavailable = errors.New("full-text search requires SQLite built with FTS5 (build tag sqlite_fts5)")
+
+// spanTextSchema is a full-text index of span names, status messages and
+// exception events, keyed by span row ID. As with the attribute index,
+// triggers keep it in step with the spans table on every insert path, on
+// rewrites and on deletes. Compact-format spans are indexed from their
+// header, which the sqlite exporter fills with the status message and
+// exception events for this purpose.
+var spanTextSchema = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS span_text USING fts5(
+		span_name, status_message, exceptions
+	);
+
+	CREATE TRIGGER IF NOT EXISTS span_text_insert AFTER INSERT ON spans
+	BEGIN
+		INSERT INTO span_text (rowid, span_name, status_message, exceptions)
+		SELECT NEW.id, ` + spanTextColumns("NEW.data") + `;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS span_text_update AFTER UPDATE OF data ON spans
+	BEGIN
+		DELETE FROM span_text WHERE rowid = OLD.id;
+		INSERT INTO span_text (rowid, span_name, status_message, exceptions)
+		SELECT NEW.id, ` + spanTextColumns("NEW.data") + `;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS span_text_delete AFTER DELETE ON spans
+	BEGIN
+		DELETE FROM span_text WHERE rowid = OLD.id;
+	END;
+	`
+
+// spanTextColumns extracts the indexed text from a span document: one line
+// per exception event with its type, message and stack trace.
+func spanTextColumns(data string) string {
+	return `json_extract(` + data + `, '$.span_name'),
+		json_extract(` + data + `, '$.status.message'),
+		(SELECT group_concat(concat_ws(' ',
+				json_extract(e.value, '$.attributes."exception.type"'),
+				json_extract(e.value, '$.attributes."exception.message"'),
+				json_extract(e.value, '$.attributes."exception.stacktrace"')), char(10))
+			FROM json_each(` + data + `, '$.events') e
+			WHERE json_extract(e.value, '$.name') = 'exception')`
+}
+
+// TextSearchOptions filters SearchText. Time bounds are Unix nanoseconds on
+// span start time.
+type TextSearchOptions struct {
+	// Query is matched as a phrase, case-insensitively, against whole words
+	Query        string
+	ServiceName  string
+	MinStartTime int64
+	MaxStartTime int64
+	Limit        int
+}
+
+// TextMatch is a span whose indexed text contains the query
+type TextMatch struct {
+	TraceID           string
+	SpanID            string
+	ServiceName       string
+	SpanName          string
+	StartTimeUnixNano int64
+	StatusCode        int
+	// Snippet is the best-matching text around the query, which is
+	// wrapped in [ ]
+	Snippet string
+}
+
+// migrateSpanText creates the full-text index if the SQLite library supports
+// FTS5, backfilling it from the stored spans the first time. Without FTS5 the
+// store works as before and SearchText returns ErrTextSearchUnavailable.
+func (s *Store) migrateSpanText() error {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'span_text'").Scan(&n)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(spanTextSchema); err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return nil
+		}
+		return fmt.Errorf("failed to create full-text index: %w", err)
+	}
+	s.textSearch = true
+	if n > 0 {
+		return nil
+	}
+	_, err = s.db.Exec(`INSERT INTO span_text (rowid, span_name, status_message, exceptions)
+		SELECT id, ` + spanTextColumns("data") + ` FROM spans`)
+	if err != nil {
+		return fmt.Errorf("failed to backfill full-text index: %w", err)
+	}
+	return nil
+}
+
+// TextSearchAvailable reports whether the full-text index exists
+func (s *Store) TextSearchAvailable() bool {
+	return s.textSearch
+}
+
+// SearchText returns spans whose name, status message or exception events
+// contain the query, newest first.
+func (s *Store) SearchText(ctx context.Context, opts TextSearchOptions) ([]TextMatch, error) {
+	if !s.textSearch {
+		return nil, ErrTextSearchUnavailable
+	}
+	phrase := strings.TrimSpace(opts.Query)
+	if phrase == "" {
+		return nil, fmt.Errorf("empty query")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// A quoted FTS5 string is a phrase; operators and punctuation inside it
+	// are plain text.
+	match := `"` + strings.ReplaceAll(phrase, `"`, `""`) + `"`
+	query := `SELECT COALESCE(s.trace_id, ''), COALESCE(s.span_id, ''), COALESCE(s.service_name, ''), COALESCE(s.span_name, ''),
+			COALESCE(s.start_time_unix_nano, 0), COALESCE(s.status_code, 0),
+			COALESCE(snippet(span_text, -1, '[', ']', '...', 16), '')
+		FROM span_text JOIN ` + s.scoped(ctx, "spans", "spans") + ` s ON s.id = span_text.rowid
+		WHERE span_text MATCH ?`
+	args := []interface{}{match}
+
+	if opts.ServiceName != "" {
+		query += " AND s.service_name = ?"
+		args = append(args, opts.ServiceName)
+	}
+	if opts.MinStartTime > 0 {
+		query += " AND s.start_time_unix_nano >= ?"
+		args = append(args, opts.MinStartTime)
+	}
+	if opts.MaxStartTime > 0 {
+		query += " AND s.start_time_unix_nano <= ?"
+		args = append(args, opts.MaxStartTime)
+	}
+	query += " ORDER BY s.start_time_unix_nano DESC"
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []TextMatch{}
+	for rows.Next() {
+		var m TextMatch
+		if err := rows.Scan(&m.TraceID, &m.SpanID, &m.ServiceName, &m.SpanName,
+			&m.StartTimeUnixNano, &m.StatusCode, &m.Snippet); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
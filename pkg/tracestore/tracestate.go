@@ -0,0 +1,46 @@
+package tracestore
+
+import "fmt"
+
+// TraceStateEntry filters on a W3C tracestate list member. An empty Value
+// matches any value of Key.
+type TraceStateEntry struct {
+	Key   string
+	Value string
+}
+
+// traceStateExpr is the span's tracestate with optional whitespace around the
+// list separators removed and a comma added at both ends, so a member can be
+// found with instr(expr, ',key=value,'). It reads the document rather than the
+// trace_state column so it also works on attached databases that predate it.
+const traceStateExpr = `',' || replace(replace(json_extract(data, '$.trace_state'), ' ,', ','), ', ', ',') || ','`
+
+// migrateSpanTraceState adds the trace_state column to databases created
+// before it existed.
+func (s *Store) migrateSpanTraceState() error {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_xinfo('spans') WHERE name = 'trace_state'").Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	if _, err := s.db.Exec(`ALTER TABLE spans ADD COLUMN trace_state TEXT GENERATED ALWAYS AS (json_extract(data, '$.trace_state')) VIRTUAL`); err != nil {
+		return fmt.Errorf("failed to add spans.trace_state column: %w", err)
+	}
+	return nil
+}
+
+// traceStateClause builds WHERE fragments restricting trace_id to traces with
+// a span whose tracestate has every entry.
+func traceStateClause(entries []TraceStateEntry, spans string) (string, []interface{}) {
+	var clause string
+	var args []interface{}
+	for _, e := range entries {
+		member := "," + e.Key + "=" + e.Value + ","
+		if e.Value == "" {
+			member = "," + e.Key + "="
+		}
+		clause += " AND trace_id IN (SELECT trace_id FROM " + spans + " WHERE instr(" + traceStateExpr + ", ?) > 0)"
+		args = append(args, member)
+	}
+	return clause, args
+}
@@ -0,0 +1,294 @@
+package tracestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// traceSummariesSchema keeps one row per trace with what trace search
+// returns, so SearchTraces reads a row per trace instead of grouping every
+// span. Triggers fold each inserted span into its trace's row on every insert
+// path (including replication), and drop the row once the trace has neither
+// span rows nor a compacted blob left. Spans deleted from a trace that keeps
+// others (retention cutting through a trace, dedupe) are still counted until
+// the whole trace goes.
+//
+// The root is the earliest span without a parent, or the earliest span while
+// none has arrived. services lists the trace's services as ",a,b,".
+// trace_summary_attributes holds the values of the indexed attribute keys
+// seen on each trace's spans, so those searches also match compacted traces.
+const traceSummariesSchema = `
+	CREATE TABLE trace_summaries (
+		trace_id TEXT NOT NULL,
+		tenant TEXT NOT NULL DEFAULT '',
+		start_time_unix_nano INTEGER NOT NULL,
+		end_time_unix_nano INTEGER NOT NULL,
+		span_count INTEGER NOT NULL,
+		error_count INTEGER NOT NULL,
+		max_status INTEGER NOT NULL,
+		root_service TEXT,
+		root_name TEXT,
+		has_root INTEGER NOT NULL,
+		services TEXT NOT NULL,
+		PRIMARY KEY (trace_id, tenant)
+	);
+	CREATE INDEX idx_trace_summaries_start_time ON trace_summaries(start_time_unix_nano);
+	CREATE INDEX idx_trace_summaries_tenant_start_time ON trace_summaries(tenant, start_time_unix_nano);
+	`
+
+const traceSummaryAttributesSchema = `
+	CREATE TABLE trace_summary_attributes (
+		trace_id TEXT NOT NULL,
+		tenant TEXT NOT NULL DEFAULT '',
+		attr_key TEXT NOT NULL,
+		attr_value TEXT NOT NULL,
+		PRIMARY KEY (trace_id, tenant, attr_key, attr_value)
+	);
+	CREATE INDEX idx_trace_summary_attributes_lookup ON trace_summary_attributes(attr_key, attr_value);
+	`
+
+// spanIsRoot is 1 for a spans row without a parent
+const spanIsRoot = `CASE WHEN NEW.parent_span_id IS NULL OR NEW.parent_span_id = '' OR NEW.parent_span_id = '0000000000000000' THEN 1 ELSE 0 END`
+
+// traceSummaryTriggers keep the summary tables in step with the spans.
+// trace_summaries_delete is recreated on every start, since earlier versions
+// also dropped the summaries of compacted traces.
+const traceSummaryTriggers = `
+	CREATE TRIGGER IF NOT EXISTS trace_summaries_insert AFTER INSERT ON spans
+	WHEN NEW.trace_id IS NOT NULL
+	BEGIN
+		INSERT INTO trace_summaries (trace_id, tenant, start_time_unix_nano, end_time_unix_nano, span_count,
+			error_count, max_status, root_service, root_name, has_root, services)
+		VALUES (NEW.trace_id, NEW.tenant, COALESCE(NEW.start_time_unix_nano, 0), COALESCE(NEW.end_time_unix_nano, 0), 1,
+			CASE WHEN NEW.status_code = 2 THEN 1 ELSE 0 END, COALESCE(NEW.status_code, 0),
+			NEW.service_name, NEW.span_name, ` + spanIsRoot + `,
+			CASE WHEN NEW.service_name IS NULL THEN ',' ELSE ',' || NEW.service_name || ',' END)
+		ON CONFLICT(trace_id, tenant) DO UPDATE SET
+			root_service = CASE WHEN ` + rootReplaced + ` THEN excluded.root_service ELSE root_service END,
+			root_name = CASE WHEN ` + rootReplaced + ` THEN excluded.root_name ELSE root_name END,
+			has_root = MAX(has_root, excluded.has_root),
+			start_time_unix_nano = MIN(start_time_unix_nano, excluded.start_time_unix_nano),
+			end_time_unix_nano = MAX(end_time_unix_nano, excluded.end_time_unix_nano),
+			span_count = span_count + 1,
+			error_count = error_count + excluded.error_count,
+			max_status = MAX(max_status, excluded.max_status),
+			services = CASE WHEN instr(services, excluded.services) > 0 THEN services
+				ELSE services || substr(excluded.services, 2) END;
+	END;
+
+	DROP TRIGGER IF EXISTS main.trace_summaries_delete;
+	CREATE TRIGGER trace_summaries_delete AFTER DELETE ON spans
+	WHEN OLD.trace_id IS NOT NULL
+	BEGIN
+		DELETE FROM trace_summaries WHERE trace_id = OLD.trace_id AND tenant = OLD.tenant
+			AND NOT EXISTS (SELECT 1 FROM spans WHERE trace_id = OLD.trace_id AND tenant = OLD.tenant)
+			AND NOT EXISTS (SELECT 1 FROM trace_blobs WHERE trace_id = OLD.trace_id AND tenant = OLD.tenant);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trace_summaries_blob_delete AFTER DELETE ON trace_blobs
+	BEGIN
+		DELETE FROM trace_summaries WHERE trace_id = OLD.trace_id AND tenant = OLD.tenant
+			AND NOT EXISTS (SELECT 1 FROM spans WHERE trace_id = OLD.trace_id AND tenant = OLD.tenant);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trace_summary_attributes_insert AFTER INSERT ON span_attributes
+	WHEN NEW.attr_value IS NOT NULL
+	BEGIN
+		INSERT OR IGNORE INTO trace_summary_attributes (trace_id, tenant, attr_key, attr_value)
+		SELECT trace_id, tenant, NEW.attr_key, NEW.attr_value FROM spans
+		WHERE id = NEW.span_rowid AND trace_id IS NOT NULL;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS trace_summary_attributes_delete AFTER DELETE ON trace_summaries
+	BEGIN
+		DELETE FROM trace_summary_attributes WHERE trace_id = OLD.trace_id AND tenant = OLD.tenant;
+	END;
+	`
+
+// rootReplaced is true when the span being folded in becomes the trace's root
+const rootReplaced = `(excluded.has_root > has_root OR (excluded.has_root = has_root AND excluded.start_time_unix_nano < start_time_unix_nano))`
+
+// migrateTraceSummaries creates the trace summary tables and fills them from
+// the stored spans, which scans the spans table once, so the first start
+// after an upgrade may take a while on a large database. Traces compacted
+// before then have no summary.
+func (s *Store) migrateTraceSummaries() error {
+	for _, m := range []struct{ table, schema, backfill string }{
+		{"trace_summaries", traceSummariesSchema, traceSummariesBackfill},
+		{"trace_summary_attributes", traceSummaryAttributesSchema, traceSummaryAttributesBackfill},
+	} {
+		var n int
+		err := s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", m.table).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(m.schema); err != nil {
+			return fmt.Errorf("failed to create %s: %w", m.table, err)
+		}
+		if _, err := tx.Exec(m.backfill); err != nil {
+			return fmt.Errorf("failed to backfill %s: %w", m.table, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	_, err := s.db.Exec(traceSummaryTriggers)
+	return err
+}
+
+// traceSummaryAttributesBackfill builds trace_summary_attributes from the
+// attribute index
+const traceSummaryAttributesBackfill = `
+	INSERT OR IGNORE INTO trace_summary_attributes (trace_id, tenant, attr_key, attr_value)
+	SELECT sp.trace_id, sp.tenant, a.attr_key, a.attr_value
+	FROM span_attributes a JOIN spans sp ON sp.id = a.span_rowid
+	WHERE sp.trace_id IS NOT NULL AND a.attr_value IS NOT NULL
+	`
+
+// traceSummariesBackfill builds trace_summaries from the spans table, picking
+// roots as SearchTraces did before the table existed
+const traceSummariesBackfill = `
+	INSERT INTO trace_summaries (trace_id, tenant, start_time_unix_nano, end_time_unix_nano, span_count,
+		error_count, max_status, root_service, root_name, has_root, services)
+	SELECT trace_id, tenant, COALESCE(MIN(start_time_unix_nano), 0), COALESCE(MAX(end_time_unix_nano), 0), COUNT(*),
+		SUM(CASE WHEN status_code = 2 THEN 1 ELSE 0 END), COALESCE(MAX(status_code), 0),
+		MAX(root_service), MAX(root_name), MAX(is_root),
+		',' || COALESCE((SELECT group_concat(DISTINCT s2.service_name) FROM spans s2
+			WHERE s2.trace_id = r.trace_id AND s2.tenant = r.tenant), '') || ','
+	FROM (
+		SELECT trace_id, tenant, start_time_unix_nano, end_time_unix_nano, status_code,
+			CASE WHEN parent_span_id IS NULL OR parent_span_id = '' OR parent_span_id = '0000000000000000' THEN 1 ELSE 0 END AS is_root,
+			FIRST_VALUE(service_name) OVER w AS root_service,
+			FIRST_VALUE(span_name) OVER w AS root_name
+		FROM spans
+		WHERE trace_id IS NOT NULL
+		WINDOW w AS (
+			PARTITION BY trace_id, tenant
+			ORDER BY
+				CASE
+					WHEN parent_span_id IS NULL OR parent_span_id = '' OR parent_span_id = '0000000000000000' THEN 0
+					ELSE 1
+				END,
+				start_time_unix_nano
+		)
+	) r
+	GROUP BY trace_id, tenant
+	`
+
+// searchTraceSummaries is SearchTraces read from trace_summaries, for stores
+// without attached databases. Callers hold s.mu.
+func (s *Store) searchTraceSummaries(ctx context.Context, opts TraceSearchOptions) ([]TraceSummary, error) {
+	where, args, err := s.traceSummaryWhere(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT trace_id, start_time_unix_nano, end_time_unix_nano, span_count, max_status, error_count, root_service, root_name
+		FROM ` + s.scoped(ctx, "trace_summaries", "trace_summaries") + ` WHERE ` + where + `
+		ORDER BY start_time_unix_nano DESC`
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+	if opts.Offset > 0 {
+		query += " OFFSET ?"
+		args = append(args, opts.Offset)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []TraceSummary
+	for rows.Next() {
+		var t TraceSummary
+		var endNs int64
+		var rootService, rootName sql.NullString
+		if err := rows.Scan(&t.TraceID, &t.StartTimeUnixNano, &endNs, &t.SpanCount, &t.StatusCode, &t.ErrorCount, &rootService, &rootName); err != nil {
+			return nil, err
+		}
+		if endNs > t.StartTimeUnixNano {
+			t.DurationNanos = endNs - t.StartTimeUnixNano
+		}
+		t.DurationMs = t.DurationNanos / int64(time.Millisecond)
+		t.RootServiceName = rootService.String
+		t.RootTraceName = rootName.String
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// traceSummaryWhere builds the conditions on trace_summaries rows for opts.
+// The service, status, duration, time and indexed attribute filters read the
+// summary tables, so they also match compacted traces; the others restrict
+// trace_id through the spans table as traceSearchWhere does. Callers hold
+// s.mu.
+func (s *Store) traceSummaryWhere(ctx context.Context, opts TraceSearchOptions) (string, []interface{}, error) {
+	service, status := opts.ServiceName, opts.Status
+	minDuration, maxDuration := opts.MinDurationNs, opts.MaxDurationNs
+	minStart, maxStart := opts.MinStartTime, opts.MaxStartTime
+	opts.ServiceName, opts.Status = "", nil
+	opts.MinDurationNs, opts.MaxDurationNs = 0, 0
+	opts.MinStartTime, opts.MaxStartTime = 0, 0
+
+	indexed := map[string]string{}
+	if len(opts.Attributes) > 0 {
+		rest := map[string]string{}
+		for k, v := range opts.Attributes {
+			if s.indexedAttrs[k] {
+				indexed[k] = v
+			} else {
+				rest[k] = v
+			}
+		}
+		opts.Attributes = rest
+	}
+
+	where, args, err := s.traceSearchWhere(opts, s.scoped(ctx, "spans", "spans"))
+	if err != nil {
+		return "", nil, err
+	}
+	if service != "" {
+		where += " AND instr(services, ?) > 0"
+		args = append(args, ","+service+",")
+	}
+	if status != nil {
+		where += " AND max_status = ?"
+		args = append(args, *status)
+	}
+	if minDuration > 0 || maxDuration > 0 {
+		clause, durationArgs := traceDurationClause("(end_time_unix_nano - start_time_unix_nano)", minDuration, maxDuration)
+		where += " AND " + clause
+		args = append(args, durationArgs...)
+	}
+	if minStart > 0 {
+		where += " AND end_time_unix_nano >= ?"
+		args = append(args, minStart)
+	}
+	if maxStart > 0 {
+		where += " AND start_time_unix_nano <= ?"
+		args = append(args, maxStart)
+	}
+	keys := make([]string, 0, len(indexed))
+	for k := range indexed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		where += " AND (trace_id, tenant) IN (SELECT trace_id, tenant FROM trace_summary_attributes WHERE attr_key = ? AND attr_value = ?)"
+		args = append(args, k, indexed[k])
+	}
+	return where, args, nil
+}
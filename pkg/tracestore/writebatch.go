@@ -0,0 +1,171 @@
+package tracestore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStoreClosed is returned by writes issued after Close
+var ErrStoreClosed = errors.New("store is closed")
+
+// WriteBatchConfig configures write coalescing
+type WriteBatchConfig struct {
+	// FlushInterval is how long a batch stays open for more writes after the
+	// first one arrives. 0 takes only the writes already queued, which adds
+	// no latency: writes that queue up while a transaction commits share
+	// the next one.
+	FlushInterval time.Duration
+	// MaxRows caps the spans and metrics per transaction; a single write
+	// larger than this is still committed whole.
+	MaxRows int
+}
+
+// writeBatcher is a group commit: InsertEncodedData calls queue their rows
+// and wait while a single goroutine commits everything queued in one
+// transaction, so concurrent writers pay for one commit instead of one each.
+type writeBatcher struct {
+	store *Store
+	cfg   WriteBatchConfig
+
+	requests chan *writeRequest
+	stop     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+type writeRequest struct {
+	spans   []EncodedSpan
+	metrics []MetricRecord
+	done    chan error
+}
+
+func (r *writeRequest) rows() int {
+	return len(r.spans) + len(r.metrics)
+}
+
+// SetWriteBatching routes InsertEncodedData and InsertData through a group
+// commit writer. Each call still returns only once its rows are committed,
+// and with the error of the transaction they were part of, so a failed
+// batch fails every call in it. Call it once, before writing.
+func (s *Store) SetWriteBatching(cfg WriteBatchConfig) {
+	if cfg.MaxRows <= 0 {
+		cfg.MaxRows = 1
+	}
+	b := &writeBatcher{
+		store:    s,
+		cfg:      cfg,
+		requests: make(chan *writeRequest),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	s.batcher = b
+	go b.run()
+}
+
+// write queues rows and waits for their transaction. Once queued the rows
+// are committed whatever happens to ctx, so the call waits for the outcome
+// rather than report a write that may still succeed as failed.
+func (b *writeBatcher) write(ctx context.Context, spans []EncodedSpan, metrics []MetricRecord) error {
+	req := &writeRequest{spans: spans, metrics: metrics, done: make(chan error, 1)}
+	select {
+	case b.requests <- req:
+	case <-b.stopped:
+		return ErrStoreClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-req.done
+}
+
+func (b *writeBatcher) run() {
+	defer close(b.stopped)
+	for {
+		select {
+		case req := <-b.requests:
+			b.commit(b.collect(req))
+		case <-b.stop:
+			// Commit writes that were already waiting to be queued
+			for {
+				select {
+				case req := <-b.requests:
+					b.commit(b.collect(req))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// collect adds queued requests to first until MaxRows is reached, the
+// flush interval ends or, without one, the queue is empty.
+func (b *writeBatcher) collect(first *writeRequest) []*writeRequest {
+	batch := []*writeRequest{first}
+	rows := first.rows()
+
+	var timeout <-chan time.Time
+	if b.cfg.FlushInterval > 0 {
+		timer := time.NewTimer(b.cfg.FlushInterval)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for rows < b.cfg.MaxRows {
+		if timeout == nil {
+			select {
+			case req := <-b.requests:
+				batch = append(batch, req)
+				rows += req.rows()
+				continue
+			default:
+				return batch
+			}
+		}
+		select {
+		case req := <-b.requests:
+			batch = append(batch, req)
+			rows += req.rows()
+		case <-timeout:
+			return batch
+		case <-b.stop:
+			return batch
+		}
+	}
+	return batch
+}
+
+// commit writes a batch in one transaction and reports the result to every
+// request in it.
+func (b *writeBatcher) commit(batch []*writeRequest) {
+	err := b.store.insertBatch(batch)
+	for _, req := range batch {
+		req.done <- err
+	}
+}
+
+func (s *Store) insertBatch(batch []*writeRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, req := range batch {
+		if err := insertEncoded(ctx, tx, req.spans, req.metrics); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// close commits pending writes and stops the writer
+func (b *writeBatcher) close() {
+	b.once.Do(func() { close(b.stop) })
+	<-b.stopped
+}